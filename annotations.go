@@ -0,0 +1,189 @@
+package flywheel
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// NotifyAnnotations - the owner, notes or links were changed
+const NotifyAnnotations = "annotations"
+
+// Longest notes accepted, and most links
+const (
+	maxNotes = 2000
+	maxLinks = 10
+)
+
+// Annotations - context set by admins with the API, kept in the state
+// store: who owns the environment now, notes such as "do not stop before
+// Friday's audit", and links. Shown on the status pages and sent with the
+// notifications.
+type Annotations struct {
+	// Replaces the owner of the config, apart from its webhook
+	Owner *OwnerConfig `json:"owner,omitempty"`
+
+	Notes string           `json:"notes,omitempty"`
+	Links []AnnotationLink `json:"links,omitempty"`
+
+	UpdatedBy string    `json:"updated-by,omitempty"`
+	UpdatedAt time.Time `json:"updated-at"`
+}
+
+// AnnotationLink - a link, e.g. to a ticket or a runbook
+type AnnotationLink struct {
+	Title string `json:"title,omitempty"`
+	URL   string `json:"url"`
+}
+
+// Validate - check the notes fit on a page and the links are web links
+func (a *Annotations) Validate() error {
+	if a.Owner != nil && a.Owner.Webhook != "" {
+		return fmt.Errorf("The owner's webhook can only be set in the config")
+	}
+	if len(a.Notes) > maxNotes {
+		return fmt.Errorf("Notes can be at most %d characters", maxNotes)
+	}
+	if len(a.Links) > maxLinks {
+		return fmt.Errorf("At most %d links are allowed", maxLinks)
+	}
+	for _, link := range a.Links {
+		u, err := url.Parse(link.URL)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("Invalid link %q, expected an http or https URL", link.URL)
+		}
+	}
+	return nil
+}
+
+// empty - true if there's nothing to show
+func (a *Annotations) empty() bool {
+	return a == nil || (a.Owner == nil && a.Notes == "" && len(a.Links) == 0)
+}
+
+// ownerContact - the owner, as transferred with the API if it was
+func (fw *Flywheel) ownerContact() OwnerConfig {
+	return fw.config.annotatedOwner(fw.annotations)
+}
+
+// annotatedOwner - the owner of the config, or the one of the annotations.
+// The webhook stays the config's.
+func (c *Config) annotatedOwner(a *Annotations) OwnerConfig {
+	owner := c.OwnerContact()
+	if a != nil && a.Owner != nil {
+		webhook := owner.Webhook
+		owner = *a.Owner
+		owner.Webhook = webhook
+	}
+	return owner
+}
+
+// annotate - replace the annotations, from a ping. Nil clears them.
+func (fw *Flywheel) annotate(a *Annotations, user string) {
+	previous := fw.ownerContact()
+	if a.empty() {
+		fw.annotations = nil
+	} else {
+		a.UpdatedBy = user
+		a.UpdatedAt = fw.now()
+		fw.annotations = a
+	}
+	fw.SaveState()
+
+	if owner := fw.ownerContact(); owner.Team != previous.Team || owner.Email != previous.Email || owner.Slack != previous.Slack {
+		fw.notify(NotifyAnnotations, "Ownership transferred from %s to %s by %s", ownerName(previous), ownerName(owner), user)
+	} else {
+		fw.notify(NotifyAnnotations, "Notes and links changed by %s", user)
+	}
+}
+
+// ownerName - the team, or how else to reach the owner
+func ownerName(owner OwnerConfig) string {
+	for _, name := range []string{owner.Team, owner.Email, owner.Slack} {
+		if name != "" {
+			return name
+		}
+	}
+	return "nobody"
+}
+
+// notesFooter - the notes and links, for the status pages
+func (a *Annotations) notesFooter() string {
+	if a == nil || (a.Notes == "" && len(a.Links) == 0) {
+		return ""
+	}
+	var parts []string
+	if a.Notes != "" {
+		parts = append(parts, strings.Replace(html.EscapeString(a.Notes), "\n", "<br>", -1))
+	}
+	var links []string
+	for _, link := range a.Links {
+		title := link.Title
+		if title == "" {
+			title = link.URL
+		}
+		links = append(links, fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(link.URL), html.EscapeString(title)))
+	}
+	if len(links) > 0 {
+		parts = append(parts, strings.Join(links, " &middot; "))
+	}
+	return fmt.Sprintf(`<p style="text-align: center; font-size: smaller;">%s</p>`, strings.Join(parts, "<br>"))
+}
+
+// apiAnnotations - show, replace or clear the annotations. Changes need an
+// admin token.
+func (handler *Handler) apiAnnotations(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		handler.writeJSON(w, http.StatusOK, handler.Flywheel.Snapshot().Annotations)
+		return
+	case "PUT", "POST", "DELETE":
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST, DELETE")
+		handler.apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+		return
+	}
+	if !handler.authorizeAdmin(w, r) {
+		return
+	}
+
+	a := &Annotations{}
+	if r.Method == "DELETE" {
+		a = nil
+	} else if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(a); err != nil {
+			handler.apiError(w, http.StatusBadRequest, err)
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			handler.apiError(w, http.StatusBadRequest, err)
+			return
+		}
+		owner := OwnerConfig{Team: r.Form.Get("team"), Email: r.Form.Get("email"), Slack: r.Form.Get("slack")}
+		if owner != (OwnerConfig{}) {
+			a.Owner = &owner
+		}
+		a.Notes = r.Form.Get("notes")
+		for _, link := range r.Form["link"] {
+			a.Links = append(a.Links, AnnotationLink{URL: link})
+		}
+	}
+	if a != nil {
+		if err := a.Validate(); err != nil {
+			handler.apiError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	pong := handler.ping(Ping{annotate: true, annotations: a, user: requestUser(r)})
+	if pong.Err != nil {
+		handler.apiError(w, http.StatusConflict, pong.Err)
+		return
+	}
+	handler.writeJSON(w, http.StatusOK, pong.Annotations)
+}
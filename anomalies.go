@@ -0,0 +1,197 @@
+package flywheel
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// NotifyAnomaly - the environment is woken or kept up far more than usual
+const NotifyAnomaly = "anomaly"
+
+// Anomaly kinds
+const (
+	AnomalyStartStorm     = "start-storm"
+	AnomalyNeverSleeps    = "never-sleeps"
+	AnomalyExtensionStorm = "extension-storm"
+)
+
+// AnomaliesConfig - look for wake and extend patterns that usually mean a
+// misconfigured client is quietly keeping the environment up, e.g. 40
+// starts in a night, or an environment that never sleeps any more
+type AnomaliesConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// More starts than this within the window, and more than the factor
+	// times the usual number, are a start storm. Defaults to 10 in 12h, 3
+	// times the average of the previous 4 weeks.
+	MaxStarts      int      `json:"max-starts"`
+	StartWindow    Duration `json:"start-window"`
+	BaselineFactor float64  `json:"baseline-factor"`
+
+	// Up more than this percentage of the window, when it wasn't the
+	// window before, the environment never sleeps. Defaults to 95 in 168h.
+	MaxUptime    float64  `json:"max-uptime"`
+	UptimeWindow Duration `json:"uptime-window"`
+
+	// More extensions by one client within the clients window are an
+	// extension storm. Defaults to 20.
+	MaxExtensions int `json:"max-extensions"`
+
+	// How often the history is checked, default 10m
+	Interval Duration `json:"interval"`
+}
+
+// Validate - anomalies are found in the history, so one must be kept.
+// Fills in the defaults.
+func (c *AnomaliesConfig) Validate(historyFile string) error {
+	if !c.Enabled {
+		return nil
+	}
+	if historyFile == "" {
+		return fmt.Errorf("Anomaly detection needs a history-file")
+	}
+	if c.MaxUptime < 0 || c.MaxUptime > 100 {
+		return fmt.Errorf("Anomalies max-uptime must be between 0 and 100, got %v", c.MaxUptime)
+	}
+	if c.MaxStarts <= 0 {
+		c.MaxStarts = 10
+	}
+	if c.StartWindow <= 0 {
+		c.StartWindow = Duration(12 * time.Hour)
+	}
+	if c.BaselineFactor <= 0 {
+		c.BaselineFactor = 3
+	}
+	if c.MaxUptime == 0 {
+		c.MaxUptime = 95
+	}
+	if c.UptimeWindow <= 0 {
+		c.UptimeWindow = Duration(7 * 24 * time.Hour)
+	}
+	if c.MaxExtensions <= 0 {
+		c.MaxExtensions = 20
+	}
+	if c.Interval <= 0 {
+		c.Interval = Duration(10 * time.Minute)
+	}
+	return nil
+}
+
+// Anomaly - an unusual wake or extend pattern, as long as it lasts
+type Anomaly struct {
+	Kind    string    `json:"kind"`
+	Message string    `json:"message"`
+	Since   time.Time `json:"since"`
+}
+
+// anomalyState - the anomalies found by the last check. Only the flywheel
+// goroutine uses it.
+type anomalyState struct {
+	active    map[string]Anomaly
+	nextCheck time.Time
+}
+
+// Starts are compared with the average of this long before the window
+const anomalyBaseline = 28 * 24 * time.Hour
+
+// findAnomalies - the anomalies in the history and client activity, by kind
+func (fw *Flywheel) findAnomalies(now time.Time) map[string]string {
+	c := &fw.config.Anomalies
+	found := make(map[string]string)
+
+	// Starts within the window, and on average per window before
+	window := time.Duration(c.StartWindow)
+	var starts, before int
+	for _, event := range fw.history.Events(HistoryTransition, now.Add(-window-anomalyBaseline)) {
+		if event.To != "STARTING" {
+			continue
+		}
+		if event.Time.After(now.Add(-window)) {
+			starts++
+		} else {
+			before++
+		}
+	}
+	usual := float64(before) * float64(window) / float64(anomalyBaseline)
+	if starts > c.MaxStarts && float64(starts) > c.BaselineFactor*usual {
+		found[AnomalyStartStorm] = fmt.Sprintf("Started %d times within %v, usually %.1f times", starts, window, usual)
+	}
+
+	// Up most of the window, after sleeping the window before
+	window = time.Duration(c.UptimeWindow)
+	uptime := func(from, to time.Time) float64 {
+		var hours float64
+		for _, day := range fw.history.Usage(from, to, time.UTC, now).Days {
+			hours += day.UptimeHours
+		}
+		return 100 * hours / to.Sub(from).Hours()
+	}
+	// Without history of the window before, it's not known whether it slept
+	events := fw.history.Events("", time.Time{})
+	known := len(events) > 0 && events[0].Time.Before(now.Add(-2*window))
+	current, previous := uptime(now.Add(-window), now), uptime(now.Add(-2*window), now.Add(-window))
+	if known && current >= c.MaxUptime && previous < c.MaxUptime {
+		found[AnomalyNeverSleeps] = fmt.Sprintf("Up %.0f%% of the last %v, up from %.0f%% the %v before", current, window, previous, window)
+	}
+
+	// Clients extending over and over
+	var extenders []string
+	for _, a := range fw.clients.report(&fw.config.Clients, now) {
+		if a.Extensions > c.MaxExtensions {
+			extenders = append(extenders, fmt.Sprintf("%s (%d)", a.Client, a.Extensions))
+		}
+	}
+	if len(extenders) > 0 {
+		sort.Strings(extenders)
+		found[AnomalyExtensionStorm] = fmt.Sprintf("Extended over and over within %v by %v", time.Duration(fw.config.Clients.Window), extenders)
+	}
+	return found
+}
+
+// checkAnomalies - look for anomalies every interval, notifying when one
+// begins. It is reported in the status for as long as it lasts.
+func (fw *Flywheel) checkAnomalies() {
+	c := &fw.config.Anomalies
+	now := fw.now()
+	if !c.Enabled || now.Before(fw.anomalies.nextCheck) {
+		return
+	}
+	fw.anomalies.nextCheck = now.Add(time.Duration(c.Interval))
+
+	found := fw.findAnomalies(now)
+	var kinds []string
+	for kind := range found {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	active := make(map[string]Anomaly)
+	for _, kind := range kinds {
+		message := found[kind]
+		anomaly, ok := fw.anomalies.active[kind]
+		if !ok {
+			anomaly.Kind, anomaly.Since = kind, now
+			fw.notify(NotifyAnomaly, "%s. A misconfigured client may be keeping the environment up.", message)
+		}
+		anomaly.Message = message
+		active[kind] = anomaly
+	}
+	fw.anomalies.active = active
+}
+
+// list - the active anomalies, sorted by kind
+func (s *anomalyState) list() []Anomaly {
+	var list []Anomaly
+	for _, anomaly := range s.active {
+		list = append(list, anomaly)
+	}
+	sort.Sort(anomalyList(list))
+	return list
+}
+
+type anomalyList []Anomaly
+
+func (l anomalyList) Len() int           { return len(l) }
+func (l anomalyList) Less(i, j int) bool { return l[i].Kind < l[j].Kind }
+func (l anomalyList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
@@ -0,0 +1,245 @@
+package flywheel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIPrefix - requests under this path are handled by flywheel itself and
+// never proxied.
+const APIPrefix = "/flywheel/api/"
+
+// serveAPI - route requests for the flywheel API
+func (handler *Handler) serveAPI(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, APIPrefix)
+	path = strings.TrimPrefix(path, APIVersion+"/")
+	if !handler.cors(w, r) {
+		return
+	}
+	if path == "ready" {
+		// Called by instances, with a signature instead of a token
+		handler.apiReady(w, r)
+		return
+	}
+	if !handler.authorize(w, r) {
+		return
+	}
+
+	switch path {
+	case "status":
+		handler.apiStatus(w, r)
+	case "start":
+		handler.apiStart(w, r)
+	case "stop":
+		handler.apiStop(w, r)
+	case "timeout":
+		handler.apiTimeout(w, r)
+	case "extend":
+		handler.apiExtend(w, r)
+	case "heartbeat":
+		handler.apiHeartbeat(w, r)
+	case "export":
+		handler.apiExport(w, r)
+	case "history":
+		handler.apiHistory(w, r)
+	case "history/export":
+		handler.apiHistoryExport(w, r)
+	case "history/heatmap":
+		handler.apiHeatmap(w, r)
+	case "history/recommendation":
+		handler.apiRecommendation(w, r)
+	case "version":
+		handler.apiVersion(w, r)
+	case "config":
+		// The effective configuration, with the defaults filled in
+		handler.writeJSON(w, http.StatusOK, handler.Flywheel.config)
+	case "vhosts":
+		handler.apiVhosts(w, r)
+	case "diagnostics":
+		handler.apiDiagnostics(w, r)
+	case "monitoring/prometheus-rules":
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(handler.Flywheel.config.PrometheusRules())
+	case "monitoring/grafana-dashboard":
+		handler.apiGrafanaDashboard(w, r)
+	case "calendar":
+		handler.apiCalendar(w, r)
+	case "clients":
+		handler.apiClients(w, r)
+	case "read-only":
+		handler.apiReadOnly(w, r)
+	case "annotations":
+		handler.apiAnnotations(w, r)
+	default:
+		handler.apiError(w, http.StatusNotFound, fmt.Errorf("Unknown API endpoint %s", r.URL.Path))
+	}
+}
+
+func (handler *Handler) apiExtend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		handler.apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+		return
+	}
+
+	var req struct {
+		Duration Duration `json:"duration"`
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			handler.apiError(w, http.StatusBadRequest, err)
+			return
+		}
+	} else if err := req.Duration.UnmarshalText([]byte(r.FormValue("duration"))); err != nil {
+		handler.apiError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	pong := handler.ping(Ping{extend: time.Duration(req.Duration), user: requestUser(r)})
+	if pong.Err != nil {
+		handler.apiError(w, http.StatusConflict, pong.Err)
+		return
+	}
+	handler.writeJSON(w, http.StatusOK, pong)
+}
+
+// apiVersion - the build info, and the latest release if checking
+func (handler *Handler) apiVersion(w http.ResponseWriter, r *http.Request) {
+	info := GetBuildInfo()
+	info.Latest = handler.Flywheel.updates.Latest()
+	info.UpdateAvailable = newerVersion(info.Latest, info.Version)
+	handler.writeJSON(w, http.StatusOK, info)
+}
+
+// apiHeartbeat - agents report activity, for the heartbeat idle strategy
+func (handler *Handler) apiHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		handler.apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+		return
+	}
+	handler.Flywheel.activity.Heartbeat(handler.Flywheel.now())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiExport - download an archive of the environment. Secrets in the config
+// are masked, so they have to be filled in again after importing.
+func (handler *Handler) apiExport(w http.ResponseWriter, r *http.Request) {
+	fw := handler.Flywheel
+	config, err := json.MarshalIndent(fw.config, "", "    ")
+	if err != nil {
+		handler.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var buf bytes.Buffer
+	err = WriteArchive(&buf, &Archive{
+		Config:  config,
+		State:   handler.sendPing("status", ""),
+		History: fw.History().Events("", time.Time{}),
+		Time:    fw.now(),
+	})
+	if err != nil {
+		handler.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	filename := fmt.Sprintf("flywheel-%s.tar.gz", fw.now().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Write(buf.Bytes())
+}
+
+func (handler *Handler) apiHistory(w http.ResponseWriter, r *http.Request) {
+	since, err := parseSince(r.URL.Query().Get("since"), 7*24*time.Hour, handler.Flywheel.now())
+	if err != nil {
+		handler.apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	events := handler.Flywheel.History().Events(r.URL.Query().Get("type"), since)
+	handler.writeJSON(w, http.StatusOK, events)
+}
+
+func (handler *Handler) apiHeatmap(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	since, err := parseSince(query.Get("since"), 28*24*time.Hour, handler.Flywheel.now())
+	if err != nil {
+		handler.apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	loc := time.Local
+	if tz := query.Get("tz"); tz != "" {
+		loc, err = time.LoadLocation(tz)
+		if err != nil {
+			handler.apiError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	heatmap := handler.Flywheel.History().Heatmap(since, loc)
+	handler.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"since":    since,
+		"timezone": loc.String(),
+		"days":     heatmap,
+	})
+}
+
+func (handler *Handler) apiRecommendation(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	since, err := parseSince(query.Get("since"), 28*24*time.Hour, handler.Flywheel.now())
+	if err != nil {
+		handler.apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	percentile := 95.0
+	if p := query.Get("percentile"); p != "" {
+		percentile, err = strconv.ParseFloat(p, 64)
+		if err != nil || percentile <= 0 || percentile > 100 {
+			handler.apiError(w, http.StatusBadRequest, fmt.Errorf("Invalid percentile %q", p))
+			return
+		}
+	}
+
+	fw := handler.Flywheel
+	handler.writeJSON(w, http.StatusOK, fw.History().RecommendIdleTimeout(fw.idleTimeout, percentile, since))
+}
+
+// parseSince - parse a "since" parameter, either an RFC3339 time or a
+// duration before now.
+func parseSince(value string, def time.Duration, now time.Time) (time.Time, error) {
+	if value == "" {
+		return now.Add(-def), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	d, err := ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid since %q: expected RFC3339 time or duration", value)
+	}
+	return now.Add(-d), nil
+}
+
+func (handler *Handler) apiError(w http.ResponseWriter, code int, err error) {
+	handler.writeJSON(w, code, struct {
+		Error       string    `json:"error"`
+		ErrorDetail *AWSError `json:"error-detail,omitempty"`
+	}{err.Error(), errorDetail(err)})
+}
+
+func (handler *Handler) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	buf, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(buf)
+}
@@ -0,0 +1,139 @@
+package flywheel
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// Archive - everything needed to move an environment to another flywheel
+// host: the config, the runtime state and the usage history
+type Archive struct {
+	Config  []byte
+	State   Pong
+	History []HistoryEvent
+
+	// When it was written, the time of its files
+	Time time.Time
+}
+
+// Names of the files in the archive
+const (
+	archiveConfig  = "config.json"
+	archiveState   = "state.json"
+	archiveHistory = "history.jsonl"
+)
+
+// WriteArchive - write the archive as a gzipped tarball
+func WriteArchive(w io.Writer, a *Archive) error {
+	state, err := json.MarshalIndent(a.State, "", "    ")
+	if err != nil {
+		return err
+	}
+	var history bytes.Buffer
+	for _, event := range a.History {
+		buf, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		history.Write(buf)
+		history.WriteByte('\n')
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	files := []struct {
+		name string
+		body []byte
+	}{
+		{archiveConfig, a.Config},
+		{archiveState, state},
+		{archiveHistory, history.Bytes()},
+	}
+	for _, file := range files {
+		err = tw.WriteHeader(&tar.Header{
+			Name:    file.name,
+			Mode:    0644,
+			Size:    int64(len(file.body)),
+			ModTime: a.Time,
+		})
+		if err == nil {
+			_, err = tw.Write(file.body)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// ReadArchive - read an archive written by WriteArchive
+func ReadArchive(r io.Reader) (*Archive, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	a := &Archive{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+
+		switch hdr.Name {
+		case archiveConfig:
+			a.Config = body
+		case archiveState:
+			if err = json.Unmarshal(body, &a.State); err != nil {
+				return nil, fmt.Errorf("Invalid %s: %v", archiveState, err)
+			}
+		case archiveHistory:
+			scanner := bufio.NewScanner(bytes.NewReader(body))
+			for scanner.Scan() {
+				var event HistoryEvent
+				if err = json.Unmarshal(scanner.Bytes(), &event); err != nil {
+					return nil, fmt.Errorf("Invalid %s: %v", archiveHistory, err)
+				}
+				a.History = append(a.History, event)
+			}
+		}
+	}
+	return a, nil
+}
+
+// Export - write an archive of this flywheel. Only safe to call while Spin
+// isn't running; the API takes the state from a status ping instead.
+func (fw *Flywheel) Export(w io.Writer, config []byte) error {
+	return WriteArchive(w, &Archive{
+		Config:  config,
+		State:   fw.statusPong(),
+		History: fw.history.Events("", time.Time{}),
+		Time:    fw.now(),
+	})
+}
+
+// Import - take over the state and history from an archive. Only safe to
+// call while Spin isn't running.
+func (fw *Flywheel) Import(a *Archive) {
+	fw.restore(a.State)
+	fw.history.Append(a.History)
+}
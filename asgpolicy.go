@@ -0,0 +1,314 @@
+package flywheel
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// Processes of an autoscaling group that may be suspended
+var scalingProcesses = []string{
+	"Launch", "Terminate", "AddToLoadBalancer", "AlarmNotification", "AZRebalance",
+	"HealthCheck", "InstanceRefresh", "ReplaceUnhealthy", "ScheduledActions",
+}
+
+// Processes suspended by default while a stop group is powered down: all
+// that may replace, rebalance or scale in the stopped instances
+var stopProcesses = []string{
+	"AlarmNotification", "AZRebalance", "HealthCheck", "InstanceRefresh", "ReplaceUnhealthy", "ScheduledActions",
+}
+
+// Processes suspended for the groups in stop, as they always were. Groups
+// get stopProcesses by opting in with a policy.
+var legacyStopProcesses = []string{"ReplaceUnhealthy"}
+
+// GroupPolicy - how an autoscaling group is powered down, and what it's
+// restored to
+type GroupPolicy struct {
+	// suspend only suspends the processes and leaves the instances
+	// running, stop also stops the instances, terminate scales the group
+	// to zero
+	Action string `json:"action"`
+
+	// Processes suspended while powered down, and resumed when started
+	// unless the group had them suspended before. Default all that act on
+	// stopped instances for stop, all of them for suspend, none for
+	// terminate.
+	Suspend []string `json:"suspend"`
+
+	// Sizes restored by terminate. The desired capacity is left to the
+	// group unless given.
+	MinSize         int64  `json:"min-size"`
+	MaxSize         int64  `json:"max-size"`
+	DesiredCapacity *int64 `json:"desired-capacity"`
+}
+
+// Validate - check the action, processes and sizes
+func (p *GroupPolicy) Validate(groupName string) error {
+	switch p.Action {
+	case PolicySuspend, PolicyStop, PolicyTerminate:
+	default:
+		return fmt.Errorf("Unknown action %q for autoscaling group %s, expected suspend, stop or terminate", p.Action, groupName)
+	}
+	for _, process := range p.Suspend {
+		if !contains(scalingProcesses, process) {
+			return fmt.Errorf("Unknown process %s for autoscaling group %s", process, groupName)
+		}
+		if p.Action == PolicyTerminate && (process == "Launch" || process == "Terminate") {
+			return fmt.Errorf("Autoscaling group %s can't be terminated with %s suspended", groupName, process)
+		}
+	}
+	if p.Action != PolicyTerminate {
+		if p.MinSize != 0 || p.MaxSize != 0 || p.DesiredCapacity != nil {
+			return fmt.Errorf("Sizes of autoscaling group %s are only restored by terminate", groupName)
+		}
+		return nil
+	}
+	if p.MaxSize <= 0 || p.MinSize < 0 || p.MinSize > p.MaxSize {
+		return fmt.Errorf("Autoscaling group %s needs a max-size above 0 and a min-size up to it", groupName)
+	}
+	if d := p.DesiredCapacity; d != nil && (*d < p.MinSize || *d > p.MaxSize) {
+		return fmt.Errorf("Desired capacity of autoscaling group %s must be between %d and %d", groupName, p.MinSize, p.MaxSize)
+	}
+	return nil
+}
+
+// suspended - the processes suspended while powered down
+func (p GroupPolicy) suspended() []string {
+	switch {
+	case len(p.Suspend) > 0:
+		return p.Suspend
+	case p.Action == PolicyStop:
+		return stopProcesses
+	case p.Action == PolicySuspend:
+		return scalingProcesses
+	}
+	return nil
+}
+
+// policies - the policy of every group, from groups and from the terminate,
+// stop and policy settings they replace
+func (c *AutoScalingConfig) policies() map[string]GroupPolicy {
+	policies := make(map[string]GroupPolicy)
+	for groupName, size := range c.Terminate {
+		if c.Policy[groupName] == PolicyStop {
+			policies[groupName] = GroupPolicy{Action: PolicyStop}
+		} else {
+			policies[groupName] = GroupPolicy{Action: PolicyTerminate, MinSize: size, MaxSize: size}
+		}
+	}
+	for _, groupName := range c.Stop {
+		policies[groupName] = GroupPolicy{Action: PolicyStop, Suspend: legacyStopProcesses}
+	}
+	for groupName, policy := range c.Groups {
+		policies[groupName] = policy
+	}
+	return policies
+}
+
+// SuspendGroups - the groups that only have their processes suspended when
+// powered down
+func (c *AutoScalingConfig) SuspendGroups() []string {
+	var groups []string
+	for groupName, policy := range c.Groups {
+		if policy.Action == PolicySuspend {
+			groups = append(groups, groupName)
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// managed - true if the group is powered down in any way
+func (c *AutoScalingConfig) managed(groupName string) bool {
+	_, warmPool := c.WarmPool[groupName]
+	_, policy := c.policies()[groupName]
+	return warmPool || policy
+}
+
+// groupNames - all the groups powered down, sorted
+func (c *AutoScalingConfig) groupNames() []string {
+	var groups []string
+	for groupName := range c.policies() {
+		groups = append(groups, groupName)
+	}
+	for groupName := range c.WarmPool {
+		groups = append(groups, groupName)
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// validatePolicies - check each group is configured once, and its policy
+func (c *AutoScalingConfig) validatePolicies() error {
+	for groupName, policy := range c.Groups {
+		_, terminate := c.Terminate[groupName]
+		_, warmPool := c.WarmPool[groupName]
+		if terminate || warmPool || contains(c.Stop, groupName) {
+			return fmt.Errorf("Autoscaling group %s configured more than once", groupName)
+		}
+		if err := policy.Validate(groupName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// suspendedAny - true if any of the processes is suspended in the group
+func suspendedAny(group *autoscaling.Group, processes []string) bool {
+	for _, process := range group.SuspendedProcesses {
+		if contains(processes, aws.StringValue(process.ProcessName)) {
+			return true
+		}
+	}
+	return false
+}
+
+// processQuery - the processes of a group to suspend or resume
+func processQuery(groupName string, processes []string) *autoscaling.ScalingProcessQuery {
+	return &autoscaling.ScalingProcessQuery{
+		AutoScalingGroupName: aws.String(groupName),
+		ScalingProcesses:     aws.StringSlice(processes),
+	}
+}
+
+// SuspendedProcesses - the processes a group had suspended before it was
+// powered down, which stay suspended when it's started
+type SuspendedProcesses struct {
+	Before []string `json:"before"`
+
+	// Set once the processes suspended by the power down are resumed, so a
+	// retried power down records the group again
+	Resumed bool `json:"resumed,omitempty"`
+}
+
+// suspendedProcesses - SuspendedProcesses by group. The health check
+// goroutine resumes stop groups, so they're locked.
+type suspendedProcesses struct {
+	mu     sync.Mutex
+	groups map[string]SuspendedProcesses
+}
+
+// record - remember the processes the group has suspended, unless a
+// power down that failed already suspended more
+func (s *suspendedProcesses) record(group *autoscaling.Group) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	groupName := aws.StringValue(group.AutoScalingGroupName)
+	if previous, ok := s.groups[groupName]; ok && !previous.Resumed {
+		return
+	}
+	before := []string{}
+	for _, process := range group.SuspendedProcesses {
+		before = append(before, aws.StringValue(process.ProcessName))
+	}
+	sort.Strings(before)
+	if s.groups == nil {
+		s.groups = make(map[string]SuspendedProcesses)
+	}
+	s.groups[groupName] = SuspendedProcesses{Before: before}
+}
+
+// resumable - the processes to resume, leaving those suspended before
+func (s *suspendedProcesses) resumable(groupName string, processes []string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var resume []string
+	for _, process := range processes {
+		if !contains(s.groups[groupName].Before, process) {
+			resume = append(resume, process)
+		}
+	}
+	return resume
+}
+
+// resumed - the processes of the power down are resumed
+func (s *suspendedProcesses) resumed(groupName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if g, ok := s.groups[groupName]; ok {
+		g.Resumed = true
+		s.groups[groupName] = g
+	}
+}
+
+// all - a copy, for the state
+func (s *suspendedProcesses) all() map[string]SuspendedProcesses {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.groups) == 0 {
+		return nil
+	}
+	groups := make(map[string]SuspendedProcesses, len(s.groups))
+	for groupName, g := range s.groups {
+		groups[groupName] = g
+	}
+	return groups
+}
+
+// load - take over the groups from the state
+func (s *suspendedProcesses) load(groups map[string]SuspendedProcesses) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.groups = groups
+}
+
+// suspendGroup - record the processes the group has suspended, then
+// suspend those of the policy
+func (fw *Flywheel) suspendGroup(groupName string, group *autoscaling.Group, processes []string) error {
+	fw.suspended.record(group)
+	_, err := fw.autoscaling.SuspendProcesses(processQuery(groupName, processes))
+	return err
+}
+
+// resumeGroup - resume the processes of the policy, apart from those the
+// group had suspended before
+func (fw *Flywheel) resumeGroup(groupName string, processes []string) error {
+	if processes = fw.suspended.resumable(groupName, processes); len(processes) > 0 {
+		if _, err := fw.autoscaling.ResumeProcesses(processQuery(groupName, processes)); err != nil {
+			return err
+		}
+	}
+	fw.suspended.resumed(groupName)
+	return nil
+}
+
+// suspendAutoScaling - suspend the processes of the suspend groups, which
+// keep their instances running
+func (fw *Flywheel) suspendAutoScaling() error {
+	groupNames := fw.config.AutoScaling.SuspendGroups()
+	groups, err := fw.describeConfigured(groupNames)
+	if err != nil {
+		return err
+	}
+	for _, groupName := range groupNames {
+		group, ok := groups[groupName]
+		if !ok || fw.config.Observed(groupName) || fw.deferred(ResourceAutoScalingGroup, groupName) {
+			continue
+		}
+		fw.logf("Suspending autoscaling group %s", groupName)
+		policy := fw.config.AutoScaling.Groups[groupName]
+		if err := fw.suspendGroup(groupName, group, policy.suspended()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resumeAutoScaling - resume the processes of the suspend groups
+func (fw *Flywheel) resumeAutoScaling() error {
+	for _, groupName := range fw.config.AutoScaling.SuspendGroups() {
+		if fw.missing(groupName) || fw.config.Observed(groupName) || fw.deferred(ResourceAutoScalingGroup, groupName) {
+			continue
+		}
+		fw.logf("Resuming autoscaling group %s", groupName)
+		policy := fw.config.AutoScaling.Groups[groupName]
+		if err := fw.resumeGroup(groupName, policy.suspended()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package flywheel
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/private/protocol"
+	"github.com/aws/aws-sdk-go/private/protocol/query"
+)
+
+// newQueryClient - a client for a service using the query protocol that
+// the vendored SDK has no package for, e.g. CloudWatch
+func newQueryClient(sess *session.Session, serviceName, apiVersion string) *client.Client {
+	config := sess.ClientConfig(serviceName)
+	c := client.New(
+		*config.Config,
+		metadata.ClientInfo{
+			ServiceName:   serviceName,
+			SigningRegion: config.SigningRegion,
+			Endpoint:      config.Endpoint,
+			APIVersion:    apiVersion,
+		},
+		config.Handlers,
+	)
+	c.Handlers.Sign.PushBackNamed(v4.SignRequestHandler)
+	c.Handlers.Build.PushBackNamed(query.BuildHandler)
+	c.Handlers.Unmarshal.PushBackNamed(query.UnmarshalHandler)
+	c.Handlers.UnmarshalMeta.PushBackNamed(query.UnmarshalMetaHandler)
+	c.Handlers.UnmarshalError.PushBackNamed(query.UnmarshalErrorHandler)
+	return c
+}
+
+// newJSONClient - a client for a service using the JSON protocol, e.g.
+// Cloud Map. The vendored SDK has no JSON protocol, so requests and
+// responses are plain encoding/json.
+func newJSONClient(sess *session.Session, endpointPrefix, signingName, targetPrefix string) *client.Client {
+	config := sess.ClientConfig(endpointPrefix)
+	c := client.New(
+		*config.Config,
+		metadata.ClientInfo{
+			ServiceName:   signingName,
+			SigningName:   signingName,
+			SigningRegion: config.SigningRegion,
+			Endpoint:      config.Endpoint,
+			JSONVersion:   "1.1",
+			TargetPrefix:  targetPrefix,
+		},
+		config.Handlers,
+	)
+	c.Handlers.Sign.PushBackNamed(v4.SignRequestHandler)
+	c.Handlers.Build.PushBackNamed(request.NamedHandler{Name: "flywheel.JSONBuild", Fn: jsonBuild})
+	c.Handlers.Unmarshal.PushBackNamed(request.NamedHandler{Name: "flywheel.JSONUnmarshal", Fn: jsonUnmarshal})
+	c.Handlers.UnmarshalError.PushBackNamed(request.NamedHandler{Name: "flywheel.JSONUnmarshalError", Fn: jsonUnmarshalError})
+	return c
+}
+
+func jsonBuild(r *request.Request) {
+	buf, err := json.Marshal(r.Params)
+	if err != nil {
+		r.Error = awserr.New("SerializationError", "failed encoding JSON request", err)
+		return
+	}
+	r.SetBufferBody(buf)
+	r.HTTPRequest.Header.Set("X-Amz-Target", r.ClientInfo.TargetPrefix+"."+r.Operation.Name)
+	r.HTTPRequest.Header.Set("Content-Type", "application/x-amz-json-"+r.ClientInfo.JSONVersion)
+}
+
+func jsonUnmarshal(r *request.Request) {
+	defer r.HTTPResponse.Body.Close()
+	if r.DataFilled() {
+		if err := json.NewDecoder(r.HTTPResponse.Body).Decode(r.Data); err != nil {
+			r.Error = awserr.New("SerializationError", "failed decoding JSON response", err)
+		}
+	}
+}
+
+func jsonUnmarshalError(r *request.Request) {
+	defer r.HTTPResponse.Body.Close()
+	buf, err := ioutil.ReadAll(r.HTTPResponse.Body)
+	if err != nil {
+		r.Error = awserr.New("SerializationError", "failed reading JSON error response", err)
+		return
+	}
+	var body struct {
+		Type    string `json:"__type"`
+		Message string `json:"message"`
+	}
+	json.Unmarshal(buf, &body)
+	// The type may be prefixed with a namespace, e.g. "aws.foo#NotFound"
+	code := body.Type
+	if i := strings.LastIndex(code, "#"); i >= 0 {
+		code = code[i+1:]
+	}
+	if code == "" {
+		code = r.HTTPResponse.Status
+	}
+	r.Error = awserr.NewRequestFailure(awserr.New(code, body.Message, nil),
+		r.HTTPResponse.StatusCode, r.RequestID)
+}
+
+// awsCall - call an action that is newer than the vendored SDK, with
+// hand written input and output types. A nil output discards the response.
+func awsCall(c *client.Client, action string, input, output interface{}) error {
+	op := &request.Operation{
+		Name:       action,
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}
+	req := c.NewRequest(op, input, output)
+	if output == nil {
+		req.Handlers.Unmarshal.Clear()
+		req.Handlers.Unmarshal.PushBackNamed(protocol.UnmarshalDiscardBodyHandler)
+	}
+	return req.Send()
+}
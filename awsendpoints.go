@@ -0,0 +1,89 @@
+package flywheel
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// Services flywheel calls, by endpoint prefix
+var awsServices = []string{"ec2", "autoscaling", "monitoring", "elasticloadbalancing", "ssm", "servicediscovery", "s3"}
+
+// AWSConfig - endpoints other than the public AWS ones, for LocalStack or
+// moto in development, or private regions and VPC endpoints
+type AWSConfig struct {
+	// Endpoint URL of all services, e.g. http://localhost:4566
+	Endpoint string `json:"endpoint"`
+
+	// Endpoint URL of each service, by its endpoint prefix, overriding
+	// endpoint
+	Endpoints map[string]string `json:"endpoints"`
+
+	// Address S3 buckets in the path instead of the hostname
+	S3PathStyle bool `json:"s3-path-style"`
+}
+
+// Validate - check the endpoints are URLs of known services
+func (c *AWSConfig) Validate() error {
+	endpoints := []string{c.Endpoint}
+	for service, endpoint := range c.Endpoints {
+		known := false
+		for _, name := range awsServices {
+			known = known || name == service
+		}
+		if !known {
+			return fmt.Errorf("Unknown AWS service %q, expected one of %s", service, strings.Join(awsServices, ", "))
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	for _, endpoint := range endpoints {
+		if endpoint == "" {
+			continue
+		}
+		if u, err := url.Parse(endpoint); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("Invalid AWS endpoint %q, expected an http or https URL", endpoint)
+		}
+	}
+	return nil
+}
+
+// session - the session for a service, with its endpoint if configured
+func (c *AWSConfig) session(sess *session.Session, service string) *session.Session {
+	if sess == nil {
+		return nil
+	}
+	config := &aws.Config{}
+	if endpoint := c.Endpoints[service]; endpoint != "" {
+		config.Endpoint = aws.String(endpoint)
+	} else if c.Endpoint != "" {
+		config.Endpoint = aws.String(c.Endpoint)
+	}
+	if service == "s3" && c.S3PathStyle {
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+	if config.Endpoint == nil && config.S3ForcePathStyle == nil {
+		return sess
+	}
+	return sess.Copy(config)
+}
+
+// s3URL - the URL of an S3 object, at the endpoint of the session if it
+// has one, and in the path if the session is path style
+func s3URL(config *aws.Config, bucket, key, region string) string {
+	u := url.URL{Scheme: "https", Host: fmt.Sprintf("s3.%s.amazonaws.com", region)}
+	if endpoint := aws.StringValue(config.Endpoint); endpoint != "" {
+		if parsed, err := url.Parse(endpoint); err == nil && parsed.Host != "" {
+			u.Scheme, u.Host = parsed.Scheme, parsed.Host
+		}
+	}
+	if aws.BoolValue(config.S3ForcePathStyle) {
+		u.Path = "/" + bucket + "/" + key
+	} else {
+		u.Host = bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	return u.String()
+}
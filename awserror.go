@@ -0,0 +1,134 @@
+package flywheel
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// Kinds of AWS errors, so users can tell what needs fixing
+const (
+	ErrorPermissions = "permissions"
+	ErrorCapacity    = "capacity"
+	ErrorThrottling  = "throttling"
+	ErrorNotFound    = "not-found"
+	ErrorOther       = "other"
+)
+
+// AWSError - a failed AWS call, with the operation and the resources it
+// was called for
+type AWSError struct {
+	Operation  string   `json:"operation"`
+	Resources  []string `json:"resources,omitempty"`
+	Code       string   `json:"code,omitempty"`
+	Kind       string   `json:"kind"`
+	Message    string   `json:"message"`
+	StatusCode int      `json:"status-code,omitempty"`
+	RequestID  string   `json:"request-id,omitempty"`
+}
+
+func (e *AWSError) Error() string {
+	msg := e.Message
+	if e.Code != "" {
+		msg = e.Code + ": " + msg
+	}
+	if len(e.Resources) > 0 {
+		return fmt.Sprintf("%s on %s failed: %s", e.Operation, strings.Join(e.Resources, ", "), msg)
+	}
+	return fmt.Sprintf("%s failed: %s", e.Operation, msg)
+}
+
+// errorKind - classify an AWS error code
+func errorKind(code string) string {
+	switch {
+	case code == "UnauthorizedOperation" || code == "AccessDenied" || code == "AccessDeniedException" ||
+		strings.HasPrefix(code, "AuthFailure") || strings.HasSuffix(code, "TokenExpired") ||
+		code == "InvalidClientTokenId" || code == "SignatureDoesNotMatch":
+		return ErrorPermissions
+	case strings.HasSuffix(code, "LimitExceeded") || strings.HasPrefix(code, "InsufficientInstanceCapacity") ||
+		code == "InsufficientCapacity" || code == "Unsupported":
+		return ErrorCapacity
+	case code == "Throttling" || code == "ThrottlingException" || code == "RequestLimitExceeded":
+		return ErrorThrottling
+	case strings.HasSuffix(code, ".NotFound") || strings.HasSuffix(code, ".Malformed") || code == "ValidationError":
+		return ErrorNotFound
+	}
+	return ErrorOther
+}
+
+// awsErrorHandler - replaces the error of a failed call with an AWSError,
+// once the SDK has given up retrying it
+var awsErrorHandler = request.NamedHandler{
+	Name: "flywheel.AWSError",
+	Fn: func(r *request.Request) {
+		if r.Error == nil {
+			return
+		}
+		if _, ok := r.Error.(*AWSError); ok {
+			return
+		}
+		e := &AWSError{
+			Operation: r.Operation.Name,
+			Resources: requestResources(r.Params),
+			Message:   r.Error.Error(),
+		}
+		if aerr, ok := r.Error.(awserr.Error); ok {
+			e.Code = aerr.Code()
+			e.Message = aerr.Message()
+		}
+		if rerr, ok := r.Error.(awserr.RequestFailure); ok {
+			e.StatusCode = rerr.StatusCode()
+			e.RequestID = rerr.RequestID()
+		}
+		e.Kind = errorKind(e.Code)
+		r.Error = e
+	},
+}
+
+// resourceFields - input fields naming the resources of a call
+var resourceFields = []string{
+	"InstanceIds", "InstanceId", "AutoScalingGroupName", "AutoScalingGroupNames", "LaunchTemplateIds",
+}
+
+// requestResources - the instances and groups a call was made for
+func requestResources(params interface{}) []string {
+	v := reflect.ValueOf(params)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var resources []string
+	for _, name := range resourceFields {
+		field := v.FieldByName(name)
+		if !field.IsValid() {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.Ptr:
+			if s, ok := field.Interface().(*string); ok && s != nil {
+				resources = append(resources, *s)
+			}
+		case reflect.Slice:
+			if list, ok := field.Interface().([]*string); ok {
+				for _, s := range list {
+					if s != nil {
+						resources = append(resources, *s)
+					}
+				}
+			}
+		}
+	}
+	return resources
+}
+
+// errorDetail - the structured form of an error, nil if it isn't from AWS
+func errorDetail(err error) *AWSError {
+	e, _ := err.(*AWSError)
+	return e
+}
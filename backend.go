@@ -0,0 +1,266 @@
+package flywheel
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// NotifyBackend - the backend couldn't be resolved
+const NotifyBackend = "backend"
+
+// Backend addresses of tagged instances
+const (
+	AddressPrivateIP  = "private-ip"
+	AddressPublicIP   = "public-ip"
+	AddressPrivateDNS = "private-dns"
+	AddressPublicDNS  = "public-dns"
+)
+
+// BackendConfig - resolve the endpoint from the managed resources each time
+// the environment has started, as their addresses change
+type BackendConfig struct {
+	// A managed instance with this tag, e.g. "Role=lb"
+	InstanceTag string `json:"instance-tag"`
+	// Which address of the instance, default private-ip
+	Address string `json:"address"`
+
+	// Or the load balancer attached to this autoscaling group
+	LoadBalancerGroup string `json:"load-balancer-group"`
+
+	// Port to append to the address, if any
+	Port int `json:"port"`
+
+	// Or look it up in Consul or Cloud Map, which gives the port
+	Discovery DiscoveryConfig `json:"discovery"`
+}
+
+// Enabled - true if the endpoint is resolved
+func (c *BackendConfig) Enabled() bool {
+	return c.InstanceTag != "" || c.LoadBalancerGroup != "" || c.Discovery.Enabled()
+}
+
+// Validate - check only one source is given
+func (c *BackendConfig) Validate() error {
+	sources := 0
+	for _, enabled := range []bool{c.InstanceTag != "", c.LoadBalancerGroup != "", c.Discovery.Enabled()} {
+		if enabled {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return fmt.Errorf("Backend can be resolved from an instance tag, a load balancer group or service discovery, only one")
+	}
+	if err := c.Discovery.Validate(); err != nil {
+		return err
+	}
+	if c.InstanceTag != "" && !strings.Contains(c.InstanceTag, "=") {
+		return fmt.Errorf("Backend instance tag %s must be key=value", c.InstanceTag)
+	}
+	switch c.Address {
+	case "":
+		c.Address = AddressPrivateIP
+	case AddressPrivateIP, AddressPublicIP, AddressPrivateDNS, AddressPublicDNS:
+	default:
+		return fmt.Errorf("Unknown backend address %s", c.Address)
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("Invalid backend port %d", c.Port)
+	}
+	return nil
+}
+
+// hostPort - the address with the port, if any
+func (c *BackendConfig) hostPort(address string) string {
+	return joinPort(address, c.Port)
+}
+
+// instanceAddress - the configured address of the instance
+func (c *BackendConfig) instanceAddress(instance *ec2.Instance) string {
+	switch c.Address {
+	case AddressPublicIP:
+		return aws.StringValue(instance.PublicIpAddress)
+	case AddressPrivateDNS:
+		return aws.StringValue(instance.PrivateDnsName)
+	case AddressPublicDNS:
+		return aws.StringValue(instance.PublicDnsName)
+	}
+	return aws.StringValue(instance.PrivateIpAddress)
+}
+
+// resolveBackend - look up the endpoint. On failure the previous endpoint
+// is kept, and a warning shown.
+func (fw *Flywheel) resolveBackend() {
+	backend := &fw.config.Backend
+	if backend.InstanceTag == "" && backend.LoadBalancerGroup == "" {
+		return
+	}
+
+	var address string
+	var err error
+	if backend.InstanceTag != "" {
+		address, err = fw.taggedInstanceAddress()
+	} else {
+		address, err = fw.loadBalancerAddress()
+	}
+	if err != nil {
+		fw.warn(NotifyBackend, "Unable to resolve the backend, still using %s: %v", fw.endpoint, err)
+		return
+	}
+
+	endpoint := backend.hostPort(address)
+	if endpoint != fw.endpoint {
+		fw.logf("Backend resolved to %s", endpoint)
+	}
+	fw.endpoint = endpoint
+}
+
+// taggedInstanceAddress - the address of the first running managed instance
+// with the tag. Instances of the managed autoscaling groups count too.
+func (fw *Flywheel) taggedInstanceAddress() (string, error) {
+	c := fw.config
+	tag := strings.SplitN(c.Backend.InstanceTag, "=", 2)
+
+	var found []*ec2.Instance
+	err := fw.ec2.DescribeInstancesPages(
+		&ec2.DescribeInstancesInput{
+			Filters: []*ec2.Filter{
+				{Name: aws.String("tag:" + tag[0]), Values: aws.StringSlice([]string{tag[1]})},
+				{Name: aws.String("instance-state-name"), Values: aws.StringSlice([]string{"running"})},
+			},
+		},
+		func(page *ec2.DescribeInstancesOutput, last bool) bool {
+			for _, reservation := range page.Reservations {
+				for _, instance := range reservation.Instances {
+					if c.managesInstance(instance) {
+						found = append(found, instance)
+					}
+				}
+			}
+			return true
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	sort.Sort(instancesByID(found))
+	for _, instance := range found {
+		if address := c.Backend.instanceAddress(instance); address != "" {
+			return address, nil
+		}
+	}
+	return "", fmt.Errorf("No running managed instance tagged %s with a %s", c.Backend.InstanceTag, c.Backend.Address)
+}
+
+// managesInstance - true if the instance is configured, or a member of a
+// configured autoscaling group
+func (c *Config) managesInstance(instance *ec2.Instance) bool {
+	if contains(c.Instances, aws.StringValue(instance.InstanceId)) {
+		return true
+	}
+	for _, tag := range instance.Tags {
+		if aws.StringValue(tag.Key) != "aws:autoscaling:groupName" {
+			continue
+		}
+		return c.AutoScaling.managed(aws.StringValue(tag.Value))
+	}
+	return false
+}
+
+type describeLoadBalancerTargetGroupsInput struct {
+	_ struct{} `type:"structure"`
+
+	AutoScalingGroupName *string `type:"string"`
+}
+
+type describeLoadBalancerTargetGroupsOutput struct {
+	_ struct{} `type:"structure"`
+
+	LoadBalancerTargetGroups []*struct {
+		LoadBalancerTargetGroupARN *string `type:"string"`
+	} `type:"list"`
+}
+
+type describeTargetGroupsInput struct {
+	_ struct{} `type:"structure"`
+
+	TargetGroupArns []*string `type:"list"`
+}
+
+type describeTargetGroupsOutput struct {
+	_ struct{} `type:"structure"`
+
+	TargetGroups []*struct {
+		LoadBalancerArns []*string `type:"list"`
+	} `type:"list"`
+}
+
+type describeLoadBalancersInput struct {
+	_ struct{} `type:"structure"`
+
+	LoadBalancerArns []*string `type:"list"`
+}
+
+type describeLoadBalancersOutput struct {
+	_ struct{} `type:"structure"`
+
+	LoadBalancers []*struct {
+		DNSName *string `type:"string"`
+	} `type:"list"`
+}
+
+// loadBalancerAddress - the DNS name of the application or network load
+// balancer attached to the group
+func (fw *Flywheel) loadBalancerAddress() (string, error) {
+	groupName := fw.config.Backend.LoadBalancerGroup
+
+	var attached describeLoadBalancerTargetGroupsOutput
+	err := awsCall(fw.autoscaling.Client, "DescribeLoadBalancerTargetGroups", &describeLoadBalancerTargetGroupsInput{
+		AutoScalingGroupName: aws.String(groupName),
+	}, &attached)
+	if err != nil {
+		return "", err
+	}
+	var arns []*string
+	for _, tg := range attached.LoadBalancerTargetGroups {
+		arns = append(arns, tg.LoadBalancerTargetGroupARN)
+	}
+	if len(arns) == 0 {
+		return "", fmt.Errorf("No target groups attached to autoscaling group %s", groupName)
+	}
+
+	var targetGroups describeTargetGroupsOutput
+	err = awsCall(fw.elbv2, "DescribeTargetGroups", &describeTargetGroupsInput{TargetGroupArns: arns}, &targetGroups)
+	if err != nil {
+		return "", err
+	}
+	var lbs []*string
+	for _, tg := range targetGroups.TargetGroups {
+		lbs = append(lbs, tg.LoadBalancerArns...)
+	}
+	if len(lbs) == 0 {
+		return "", fmt.Errorf("No load balancer for the target groups of autoscaling group %s", groupName)
+	}
+
+	var loadBalancers describeLoadBalancersOutput
+	err = awsCall(fw.elbv2, "DescribeLoadBalancers", &describeLoadBalancersInput{LoadBalancerArns: lbs[:1]}, &loadBalancers)
+	if err != nil {
+		return "", err
+	}
+	if len(loadBalancers.LoadBalancers) == 0 {
+		return "", fmt.Errorf("Load balancer %s not found", aws.StringValue(lbs[0]))
+	}
+	return aws.StringValue(loadBalancers.LoadBalancers[0].DNSName), nil
+}
+
+type instancesByID []*ec2.Instance
+
+func (l instancesByID) Len() int      { return len(l) }
+func (l instancesByID) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l instancesByID) Less(i, j int) bool {
+	return aws.StringValue(l[i].InstanceId) < aws.StringValue(l[j].InstanceId)
+}
@@ -0,0 +1,82 @@
+package flywheel
+
+import (
+	"fmt"
+	"time"
+)
+
+// BlackoutWindow - a window on some days of the week, e.g. business hours
+// or release days, during which the environment is never stopped
+// automatically. The idle timeout, deadlines, the idle strategy and
+// scheduled stops wait until it ends; stop requests still work.
+type BlackoutWindow struct {
+	ClockWindow
+
+	// Shown in the log and the status, e.g. "Business hours"
+	Name string `json:"name"`
+
+	// e.g. "mon-fri" or "thu", default every day. A window past midnight
+	// belongs to the day it starts on.
+	Days string `json:"days"`
+
+	days uint64
+}
+
+// Validate - parse the days, times and timezone
+func (w *BlackoutWindow) Validate() error {
+	days := w.Days
+	if days == "" {
+		days = "*"
+	}
+	dow, err := parseCronField(days, 0, 7, cronWeekdays)
+	if err != nil {
+		return fmt.Errorf("Invalid blackout days %q: %v", w.Days, err)
+	}
+	w.days = sundays(dow)
+	if w.Name == "" {
+		w.Name = fmt.Sprintf("%s-%s", w.From, w.To)
+	}
+	return w.ClockWindow.Validate()
+}
+
+// Contains - true if the time is within the window on one of its days
+func (w *BlackoutWindow) Contains(now time.Time) bool {
+	if !w.ClockWindow.Contains(now) {
+		return false
+	}
+	local := now.In(w.location)
+	day := local.Weekday()
+	if w.from > w.to && local.Hour()*60+local.Minute() < w.to {
+		// After midnight, in the window of the day before
+		day = (day + 6) % 7
+	}
+	return w.days&(1<<uint(day)) != 0
+}
+
+// blackout - the blackout window the environment is in, if any
+func (fw *Flywheel) blackout() *BlackoutWindow {
+	now := fw.now()
+	for i := range fw.config.Blackouts {
+		if w := &fw.config.Blackouts[i]; w.Contains(now) {
+			return w
+		}
+	}
+	return nil
+}
+
+// pollBlackout - log when a blackout window starts and ends
+func (fw *Flywheel) pollBlackout() {
+	name := ""
+	if w := fw.blackout(); w != nil {
+		name = w.Name
+	}
+	if name == fw.blackoutName {
+		return
+	}
+	if name != "" {
+		fw.logf("Blackout window %s - automatic stops are suspended", name)
+	} else {
+		fw.logf("Blackout window %s ended. Stop scheduled for %v", fw.blackoutName, fw.stopAt)
+	}
+	fw.blackoutName = name
+}
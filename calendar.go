@@ -0,0 +1,603 @@
+package flywheel
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CalendarConfig - start the environment ahead of calendar events, e.g.
+// demos, and keep it running until they end
+type CalendarConfig struct {
+	// iCalendar feed, e.g. the secret iCal address of a Google calendar
+	URL Secret `json:"url"`
+
+	// Events with one of these in the title or description, ignoring case.
+	// Defaults to "demo".
+	Keywords []string `json:"keywords"`
+
+	// Start this long before the event, default 15m
+	LeadTime Duration `json:"lead-time"`
+
+	// How often the calendar is fetched, default 15m
+	RefreshInterval Duration `json:"refresh-interval"`
+
+	// Time zone of all day events and times without one, default local
+	Timezone string `json:"timezone"`
+
+	location *time.Location
+}
+
+// Validate - check the time zone and fill in the defaults
+func (c *CalendarConfig) Validate() error {
+	if c.URL == "" {
+		return nil
+	}
+	if len(c.Keywords) == 0 {
+		c.Keywords = []string{"demo"}
+	}
+	if c.LeadTime <= 0 {
+		c.LeadTime = Duration(15 * time.Minute)
+	}
+	if c.RefreshInterval <= 0 {
+		c.RefreshInterval = Duration(15 * time.Minute)
+	}
+	c.location = time.Local
+	if c.Timezone != "" {
+		loc, err := time.LoadLocation(c.Timezone)
+		if err != nil {
+			return fmt.Errorf("Invalid calendar timezone %s: %v", c.Timezone, err)
+		}
+		c.location = loc
+	}
+	return nil
+}
+
+// Occurrences of recurring events are listed this far ahead
+const calendarHorizon = 8 * 24 * time.Hour
+
+// CalendarEvent - an occurrence of a calendar event with a keyword
+type CalendarEvent struct {
+	UID     string    `json:"-"`
+	Summary string    `json:"summary"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+}
+
+// key - identifies the occurrence, so it's only pre-warmed once
+func (e CalendarEvent) key() string {
+	return e.UID + "@" + e.Start.UTC().Format(time.RFC3339)
+}
+
+// Calendar - the upcoming events from the calendar feed. A nil Calendar
+// has none.
+type Calendar struct {
+	config *CalendarConfig
+	client *http.Client
+	clock  Clock
+
+	mu     sync.Mutex
+	events []CalendarEvent
+}
+
+// NewCalendar - create the calendar, nil if not configured
+func NewCalendar(config *CalendarConfig, clock Clock) *Calendar {
+	if config.URL == "" {
+		return nil
+	}
+	if config.location == nil {
+		config.location = time.Local
+	}
+	return &Calendar{
+		config: config,
+		client: &http.Client{Timeout: 30 * time.Second},
+		clock:  clock,
+	}
+}
+
+// Run - fetch the calendar now and then every refresh interval
+func (c *Calendar) Run() {
+	for {
+		if err := c.Fetch(c.clock.Now()); err != nil {
+			log.Printf("Unable to fetch calendar: %v", err)
+		}
+		sleep(c.clock, time.Duration(c.config.RefreshInterval))
+	}
+}
+
+// Fetch - fetch the calendar and keep the events with a keyword
+func (c *Calendar) Fetch(now time.Time) error {
+	resp, err := c.client.Get(string(c.config.URL))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Calendar returned %s", resp.Status)
+	}
+	return c.Load(resp.Body, now)
+}
+
+// Load - read the events from an iCalendar file, keeping the occurrences
+// with a keyword from a day ago until the horizon
+func (c *Calendar) Load(r io.Reader, now time.Time) error {
+	all, err := parseICS(r, now.Add(-24*time.Hour), now.Add(calendarHorizon), c.config.location)
+	if err != nil {
+		return err
+	}
+	var events []CalendarEvent
+	for _, event := range all {
+		if c.matches(event.text) {
+			events = append(events, event.CalendarEvent)
+		}
+	}
+	sort.Sort(calendarEvents(events))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.events = events
+	return nil
+}
+
+// matches - true if the text has one of the keywords
+func (c *Calendar) matches(text string) bool {
+	text = strings.ToLower(text)
+	for _, keyword := range c.config.Keywords {
+		if strings.Contains(text, strings.ToLower(keyword)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Upcoming - the events that haven't ended yet
+func (c *Calendar) Upcoming(now time.Time) []CalendarEvent {
+	events := []CalendarEvent{}
+	if c == nil {
+		return events
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, event := range c.events {
+		if event.End.After(now) {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// Active - the event the environment should be running for now, from the
+// lead time before it starts until it ends
+func (c *Calendar) Active(now time.Time) (CalendarEvent, bool) {
+	for _, event := range c.Upcoming(now) {
+		if !now.Before(event.Start.Add(-time.Duration(c.config.LeadTime))) {
+			return event, true
+		}
+	}
+	return CalendarEvent{}, false
+}
+
+// Calendar - the calendar, nil if not configured
+func (fw *Flywheel) Calendar() *Calendar {
+	return fw.calendar
+}
+
+// pollCalendar - start the environment ahead of a calendar event, once per
+// occurrence, and keep it running until the event ends. A stop during the
+// event isn't overridden.
+func (fw *Flywheel) pollCalendar() {
+	now := fw.now()
+	event, ok := fw.calendar.Active(now)
+	if !ok {
+		fw.calendarHold = nil
+		return
+	}
+	if fw.calendarHold == nil || fw.calendarHold.key() != event.key() {
+		if fw.isReadOnly() {
+			return
+		}
+		fw.calendarHold = &event
+		if fw.status == STOPPED {
+			fw.logf("Pre-warming for %q at %v", event.Summary, event.Start)
+			fw.because(TriggerCalendar, "")
+			if err := fw.Start(); err != nil {
+				fw.logf("Unable to pre-warm: %v", err)
+				return
+			}
+		}
+	}
+	hold := fw.calendarHold
+	if (fw.status == STARTING || fw.status == STARTED) && fw.stopAt.Before(hold.End) {
+		if err := fw.setDeadline(hold.End); err != nil {
+			// Held as long as it's allowed to run
+			fw.logf("Unable to hold for %q: %v", hold.Summary, err)
+			hold.End = fw.stopAt
+		}
+	}
+}
+
+// calendarHeld - true while the environment is held for a calendar event,
+// so the idle strategy can't stop it
+func (fw *Flywheel) calendarHeld() bool {
+	return fw.calendarHold != nil && fw.now().Before(fw.calendarHold.End)
+}
+
+// apiCalendar - the upcoming events the environment is pre-warmed for
+func (handler *Handler) apiCalendar(w http.ResponseWriter, r *http.Request) {
+	fw := handler.Flywheel
+	handler.writeJSON(w, http.StatusOK, fw.calendar.Upcoming(fw.now()))
+}
+
+type calendarEvents []CalendarEvent
+
+func (l calendarEvents) Len() int           { return len(l) }
+func (l calendarEvents) Less(i, j int) bool { return l[i].Start.Before(l[j].Start) }
+func (l calendarEvents) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// icsEvent - an occurrence, with the text searched for keywords
+type icsEvent struct {
+	CalendarEvent
+	text string
+}
+
+// icsProperty - a content line, e.g. DTSTART;TZID=Europe/London:20160606T090000
+type icsProperty struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// icsLines - the unfolded content lines
+func icsLines(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// parseProperty - split a content line into its name, parameters and value.
+// Parameter values may be quoted, and contain colons then.
+func parseProperty(line string) icsProperty {
+	p := icsProperty{params: make(map[string]string)}
+	quoted := false
+	colon := -1
+	for i, r := range line {
+		if r == '"' {
+			quoted = !quoted
+		} else if r == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return icsProperty{name: strings.ToUpper(line), params: p.params}
+	}
+	p.value = line[colon+1:]
+	parts := strings.Split(line[:colon], ";")
+	p.name = strings.ToUpper(parts[0])
+	for _, param := range parts[1:] {
+		if kv := strings.SplitN(param, "=", 2); len(kv) == 2 {
+			p.params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return p
+}
+
+// icsText - unescape a text value
+func icsText(value string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(value)
+}
+
+// icsTime - a date or date-time value. Dates are midnight in loc, as are
+// times without a time zone. Unknown time zones, e.g. Windows names, fall
+// back to loc.
+func icsTime(p icsProperty, loc *time.Location) (time.Time, bool, error) {
+	value := p.value
+	if p.params["VALUE"] == "DATE" || len(value) == 8 {
+		t, err := time.ParseInLocation("20060102", value, loc)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse("20060102T150405Z", value)
+		return t, false, err
+	}
+	if tzid := p.params["TZID"]; tzid != "" {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+	t, err := time.ParseInLocation("20060102T150405", value, loc)
+	return t, false, err
+}
+
+var icsDurationPattern = regexp.MustCompile(`^([+-])?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// icsDuration - a duration value, e.g. PT1H30M
+func icsDuration(value string) (time.Duration, error) {
+	m := icsDurationPattern.FindStringSubmatch(value)
+	if m == nil {
+		return 0, fmt.Errorf("Invalid duration %s", value)
+	}
+	var d time.Duration
+	for i, unit := range []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second} {
+		if n, err := strconv.Atoi(m[i+2]); err == nil {
+			d += time.Duration(n) * unit
+		}
+	}
+	if m[1] == "-" {
+		d = -d
+	}
+	return d, nil
+}
+
+// icsComponent - the properties of a VEVENT
+type icsComponent []icsProperty
+
+func (c icsComponent) get(name string) (icsProperty, bool) {
+	for _, p := range c {
+		if p.name == name {
+			return p, true
+		}
+	}
+	return icsProperty{}, false
+}
+
+// parseICS - the occurrences of the events in an iCalendar file that end
+// after from and start before to. Daily, weekly, monthly and yearly
+// recurrences are expanded; rules with parts other than BYDAY on weekly
+// recurrences only count their first occurrence.
+func parseICS(r io.Reader, from, to time.Time, loc *time.Location) ([]icsEvent, error) {
+	lines, err := icsLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var components []icsComponent
+	var current icsComponent
+	inEvent := false
+	for _, line := range lines {
+		p := parseProperty(line)
+		switch {
+		case p.name == "BEGIN" && strings.EqualFold(p.value, "VEVENT"):
+			inEvent, current = true, nil
+		case p.name == "END" && strings.EqualFold(p.value, "VEVENT"):
+			if inEvent {
+				components = append(components, current)
+			}
+			inEvent = false
+		case inEvent:
+			current = append(current, p)
+		}
+	}
+
+	// Modified occurrences of recurring events replace the original
+	overridden := make(map[string]bool)
+	for _, c := range components {
+		if id, ok := c.get("RECURRENCE-ID"); ok {
+			uid, _ := c.get("UID")
+			if t, _, err := icsTime(id, loc); err == nil {
+				overridden[uid.value+"@"+t.UTC().Format(time.RFC3339)] = true
+			}
+		}
+	}
+
+	var events []icsEvent
+	for _, c := range components {
+		if status, ok := c.get("STATUS"); ok && strings.EqualFold(status.value, "CANCELLED") {
+			continue
+		}
+		occurrences, err := expandEvent(c, from, to, loc)
+		if err != nil {
+			uid, _ := c.get("UID")
+			log.Printf("Skipping calendar event %s: %v", uid.value, err)
+			continue
+		}
+		_, isOverride := c.get("RECURRENCE-ID")
+		for _, event := range occurrences {
+			if !isOverride && overridden[event.key()] {
+				continue
+			}
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// expandEvent - the occurrences of an event between from and to
+func expandEvent(c icsComponent, from, to time.Time, loc *time.Location) ([]icsEvent, error) {
+	dtstart, ok := c.get("DTSTART")
+	if !ok {
+		return nil, fmt.Errorf("No DTSTART")
+	}
+	start, allDay, err := icsTime(dtstart, loc)
+	if err != nil {
+		return nil, err
+	}
+
+	var length time.Duration
+	if dtend, ok := c.get("DTEND"); ok {
+		end, _, err := icsTime(dtend, loc)
+		if err != nil {
+			return nil, err
+		}
+		length = end.Sub(start)
+	} else if duration, ok := c.get("DURATION"); ok {
+		if length, err = icsDuration(duration.value); err != nil {
+			return nil, err
+		}
+	} else if allDay {
+		length = 24 * time.Hour
+	}
+
+	uid, _ := c.get("UID")
+	summary, _ := c.get("SUMMARY")
+	description, _ := c.get("DESCRIPTION")
+	base := icsEvent{
+		CalendarEvent: CalendarEvent{UID: uid.value, Summary: icsText(summary.value)},
+		text:          icsText(summary.value) + "\n" + icsText(description.value),
+	}
+
+	excluded := make(map[time.Time]bool)
+	for _, p := range c {
+		if p.name != "EXDATE" {
+			continue
+		}
+		for _, value := range strings.Split(p.value, ",") {
+			p.value = value
+			if t, _, err := icsTime(p, loc); err == nil {
+				excluded[t.UTC()] = true
+			}
+		}
+	}
+
+	var events []icsEvent
+	add := func(t time.Time) {
+		if excluded[t.UTC()] || !t.Add(length).After(from) || !t.Before(to) {
+			return
+		}
+		event := base
+		event.Start, event.End = t, t.Add(length)
+		events = append(events, event)
+	}
+
+	rrule, ok := c.get("RRULE")
+	if !ok {
+		add(start)
+		return events, nil
+	}
+	rule, err := parseRRule(rrule.value, loc)
+	if err != nil {
+		log.Printf("Only the first occurrence of calendar event %s: %v", uid.value, err)
+		add(start)
+		return events, nil
+	}
+	rule.each(start, to, add)
+	return events, nil
+}
+
+// rrule - the supported parts of a recurrence rule
+type rrule struct {
+	freq     string
+	interval int
+	count    int
+	until    time.Time
+	byDay    []time.Weekday
+}
+
+var icsWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// parseRRule - parse a recurrence rule, e.g. FREQ=WEEKLY;BYDAY=MO,WE
+func parseRRule(value string, loc *time.Location) (*rrule, error) {
+	rule := &rrule{interval: 1}
+	for _, part := range strings.Split(value, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		var err error
+		switch key, v := strings.ToUpper(kv[0]), kv[1]; key {
+		case "FREQ":
+			rule.freq = strings.ToUpper(v)
+		case "INTERVAL":
+			rule.interval, err = strconv.Atoi(v)
+			if err == nil && rule.interval < 1 {
+				err = fmt.Errorf("Invalid interval %s", v)
+			}
+		case "COUNT":
+			rule.count, err = strconv.Atoi(v)
+		case "UNTIL":
+			rule.until, _, err = icsTime(icsProperty{value: v}, loc)
+		case "BYDAY":
+			for _, day := range strings.Split(v, ",") {
+				weekday, ok := icsWeekdays[strings.ToUpper(strings.TrimLeft(day, "+-0123456789"))]
+				if !ok || day != strings.TrimLeft(day, "+-0123456789") {
+					return nil, fmt.Errorf("Unsupported BYDAY %s", v)
+				}
+				rule.byDay = append(rule.byDay, weekday)
+			}
+		case "WKST":
+		default:
+			return nil, fmt.Errorf("Unsupported %s", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch rule.freq {
+	case "DAILY", "MONTHLY", "YEARLY":
+		if len(rule.byDay) > 0 {
+			return nil, fmt.Errorf("Unsupported BYDAY on %s", rule.freq)
+		}
+	case "WEEKLY":
+	default:
+		return nil, fmt.Errorf("Unsupported frequency %s", rule.freq)
+	}
+	return rule, nil
+}
+
+// Recurrences are expanded at most this many times, so an old daily event
+// can't keep the parser busy
+const maxRecurrences = 100000
+
+// each - call add with each occurrence from start until to
+func (r *rrule) each(start, to time.Time, add func(time.Time)) {
+	n := 0
+	for i := 0; i < maxRecurrences; i++ {
+		var candidates []time.Time
+		switch r.freq {
+		case "DAILY":
+			candidates = []time.Time{start.AddDate(0, 0, i*r.interval)}
+		case "WEEKLY":
+			week := start.AddDate(0, 0, 7*i*r.interval)
+			if len(r.byDay) == 0 {
+				candidates = []time.Time{week}
+				break
+			}
+			// The days of the week starting on Monday, like the default WKST
+			monday := week.AddDate(0, 0, -((int(week.Weekday()) + 6) % 7))
+			for _, day := range r.byDay {
+				t := monday.AddDate(0, 0, (int(day)+6)%7)
+				if !t.Before(start) {
+					candidates = append(candidates, t)
+				}
+			}
+			sort.Sort(timeList(candidates))
+		case "MONTHLY":
+			candidates = []time.Time{start.AddDate(0, i*r.interval, 0)}
+		case "YEARLY":
+			candidates = []time.Time{start.AddDate(i*r.interval, 0, 0)}
+		}
+		for _, t := range candidates {
+			if !t.Before(to) || (!r.until.IsZero() && t.After(r.until)) || (r.count > 0 && n >= r.count) {
+				return
+			}
+			n++
+			add(t)
+		}
+	}
+}
+
+type timeList []time.Time
+
+func (l timeList) Len() int           { return len(l) }
+func (l timeList) Less(i, j int) bool { return l[i].Before(l[j]) }
+func (l timeList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
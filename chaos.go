@@ -0,0 +1,108 @@
+package flywheel
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/corehandlers"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// ChaosConfig - simulate a degraded AWS, to test dashboards, alerts and
+// retries. Failures are answered by flywheel without calling AWS; the SDK
+// retries them like real ones.
+type ChaosConfig struct {
+	// Every call is delayed by a random time between Delay and MaxDelay
+	Delay    Duration `json:"delay"`
+	MaxDelay Duration `json:"max-delay"`
+
+	// Fractions of calls that fail with a 500 error, or are throttled
+	FailureRate  float64 `json:"failure-rate"`
+	ThrottleRate float64 `json:"throttle-rate"`
+
+	// Only affect these operations, e.g. "StartInstances". Default all.
+	Operations []string `json:"operations"`
+}
+
+// Enabled - true if anything is simulated
+func (c *ChaosConfig) Enabled() bool {
+	return c.Delay > 0 || c.MaxDelay > 0 || c.FailureRate > 0 || c.ThrottleRate > 0
+}
+
+// Validate - check the rates and delays
+func (c *ChaosConfig) Validate() error {
+	if c.FailureRate < 0 || c.ThrottleRate < 0 || c.FailureRate+c.ThrottleRate > 1 {
+		return fmt.Errorf("Chaos failure and throttle rates must be between 0 and 1 in total")
+	}
+	if c.MaxDelay < c.Delay {
+		c.MaxDelay = c.Delay
+	}
+	return nil
+}
+
+// applies - true if the operation is affected
+func (c *ChaosConfig) applies(operation string) bool {
+	if len(c.Operations) == 0 {
+		return true
+	}
+	for _, op := range c.Operations {
+		if op == operation {
+			return true
+		}
+	}
+	return false
+}
+
+// install - send the client's requests through the simulation
+func (c *ChaosConfig) install(cl *client.Client) {
+	cl.Handlers.Send.Remove(corehandlers.SendHandler)
+	cl.Handlers.Send.PushBackNamed(request.NamedHandler{
+		Name: "flywheel.ChaosSend",
+		Fn:   c.send,
+	})
+}
+
+// send - delay, fail or throttle the request, or send it to AWS
+func (c *ChaosConfig) send(r *request.Request) {
+	if !c.applies(r.Operation.Name) {
+		corehandlers.SendHandler.Fn(r)
+		return
+	}
+
+	delay := time.Duration(c.Delay)
+	if spread := int64(c.MaxDelay - c.Delay); spread > 0 {
+		delay += time.Duration(rand.Int63n(spread))
+	}
+	time.Sleep(delay)
+
+	roll := rand.Float64()
+	switch {
+	case roll < c.FailureRate:
+		chaosFault(r, http.StatusInternalServerError, "InternalError", "An internal error has occurred")
+	case roll < c.FailureRate+c.ThrottleRate:
+		code := "Throttling"
+		if r.ClientInfo.ServiceName == "ec2" {
+			code = "RequestLimitExceeded"
+		}
+		chaosFault(r, http.StatusBadRequest, code, "Rate exceeded")
+	default:
+		corehandlers.SendHandler.Fn(r)
+	}
+}
+
+// chaosFault - answer the request with a simulated error
+func chaosFault(r *request.Request, status int, code, message string) {
+	r.HTTPResponse = &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+	}
+	r.Error = awserr.NewRequestFailure(awserr.New(code, message+" (simulated)", nil), status, "flywheel-chaos")
+}
@@ -0,0 +1,253 @@
+package flywheel
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NotifyClient - a client was flagged for waking the environment at odd
+// hours
+const NotifyClient = "client"
+
+// ClientsConfig - track who wakes and extends the environment, and flag
+// clients that keep waking it at odd hours, e.g. a forgotten cron job
+type ClientsConfig struct {
+	// Odd hours, as HH:MM. They may span midnight.
+	OddHours ClockWindow `json:"odd-hours"`
+
+	// Flag a client after this many wake-ups at odd hours within the window
+	FlagAfter int      `json:"flag-after"`
+	Window    Duration `json:"window"`
+
+	// Refuse wake-ups at odd hours by flagged clients
+	Block bool `json:"block"`
+}
+
+// Validate - check the odd hours and fill in the defaults
+func (c *ClientsConfig) Validate() error {
+	if c.FlagAfter <= 0 {
+		c.FlagAfter = 3
+	}
+	if c.Window <= 0 {
+		c.Window = Duration(7 * 24 * time.Hour)
+	}
+	if c.OddHours.From == "" && c.OddHours.To == "" {
+		return nil
+	}
+	return c.OddHours.Validate()
+}
+
+// ClockWindow - a daily window of time, as HH:MM in a timezone
+type ClockWindow struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Timezone string `json:"timezone"`
+
+	location *time.Location
+	from, to int
+	valid    bool
+}
+
+// Validate - parse the times and timezone
+func (w *ClockWindow) Validate() error {
+	var err error
+	if w.from, err = parseClock(w.From); err != nil {
+		return err
+	}
+	if w.to, err = parseClock(w.To); err != nil {
+		return err
+	}
+	if w.location, err = time.LoadLocation(w.Timezone); err != nil {
+		return err
+	}
+	w.valid = true
+	return nil
+}
+
+// Contains - true if the time is within the window. An unset window
+// contains nothing.
+func (w *ClockWindow) Contains(now time.Time) bool {
+	if !w.valid {
+		return false
+	}
+	local := now.In(w.location)
+	return withinClock(w.from, w.to, local.Hour()*60+local.Minute())
+}
+
+// ClientActivity - what a client did within the window
+type ClientActivity struct {
+	Client         string    `json:"client"`
+	WakeUps        int       `json:"wake-ups"`
+	OddHourWakeUps int       `json:"odd-hour-wake-ups"`
+	Extensions     int       `json:"extensions"`
+	LastWakeUp     time.Time `json:"last-wake-up,omitempty"`
+	Flagged        bool      `json:"flagged"`
+	Blocked        int       `json:"blocked-wake-ups,omitempty"`
+}
+
+// clientRecord - the events of one client
+type clientRecord struct {
+	wakeUps    []time.Time
+	oddHours   []time.Time
+	extensions []time.Time
+	blocked    int
+}
+
+// clientTracker - the events of all clients, pruned to the window. Written
+// by the flywheel goroutine, read by the API.
+type clientTracker struct {
+	mu      sync.Mutex
+	clients map[string]*clientRecord
+}
+
+// since - the times after the cutoff
+func since(times []time.Time, cutoff time.Time) []time.Time {
+	i := sort.Search(len(times), func(i int) bool { return times[i].After(cutoff) })
+	return times[i:]
+}
+
+func (t *clientTracker) get(client string, c *ClientsConfig, now time.Time) *clientRecord {
+	if t.clients == nil {
+		t.clients = make(map[string]*clientRecord)
+	}
+	r, ok := t.clients[client]
+	if !ok {
+		r = &clientRecord{}
+		t.clients[client] = r
+	}
+	cutoff := now.Add(-time.Duration(c.Window))
+	r.wakeUps = since(r.wakeUps, cutoff)
+	r.oddHours = since(r.oddHours, cutoff)
+	r.extensions = since(r.extensions, cutoff)
+	return r
+}
+
+// flagged - true if the client woke the environment at odd hours too often
+func (c *ClientsConfig) flagged(r *clientRecord) bool {
+	return c.FlagAfter > 0 && len(r.oddHours) >= c.FlagAfter
+}
+
+// waker - the first of the clients that may wake the environment now
+func (t *clientTracker) waker(clients []string, c *ClientsConfig, now time.Time) (string, bool) {
+	if !c.Block || !c.OddHours.Contains(now) {
+		return clients[0], true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, client := range clients {
+		if !c.flagged(t.get(client, c, now)) {
+			return client, true
+		}
+	}
+	for _, client := range clients {
+		t.get(client, c, now).blocked++
+	}
+	return "", false
+}
+
+// wokeUp - record a wake-up. Returns true if it got the client flagged.
+func (t *clientTracker) wokeUp(client string, c *ClientsConfig, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := t.get(client, c, now)
+	r.wakeUps = append(r.wakeUps, now)
+	if !c.OddHours.Contains(now) {
+		return false
+	}
+	r.oddHours = append(r.oddHours, now)
+	return len(r.oddHours) == c.FlagAfter
+}
+
+// extended - record an extension
+func (t *clientTracker) extended(client string, c *ClientsConfig, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := t.get(client, c, now)
+	r.extensions = append(r.extensions, now)
+}
+
+// report - the activity of each client, the most odd-hour wake-ups first
+func (t *clientTracker) report(c *ClientsConfig, now time.Time) []ClientActivity {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var list []ClientActivity
+	for client := range t.clients {
+		r := t.get(client, c, now)
+		a := ClientActivity{
+			Client:         client,
+			WakeUps:        len(r.wakeUps),
+			OddHourWakeUps: len(r.oddHours),
+			Extensions:     len(r.extensions),
+			Flagged:        c.flagged(r),
+			Blocked:        r.blocked,
+		}
+		if len(r.wakeUps) > 0 {
+			a.LastWakeUp = r.wakeUps[len(r.wakeUps)-1]
+		}
+		list = append(list, a)
+	}
+	sort.Sort(clientActivityList(list))
+	return list
+}
+
+// BlockedError - the wake-up was refused
+type BlockedError struct {
+	Clients []string
+}
+
+func (e *BlockedError) Error() string {
+	return fmt.Sprintf("Wake-up refused: %s woke the environment at odd hours too often", strings.Join(e.Clients, ", "))
+}
+
+// wakeFor - start the environment for the clients, unless they are all
+// blocked
+func (fw *Flywheel) wakeFor(clients []string) error {
+	c := &fw.config.Clients
+	now := fw.now()
+	client, ok := fw.clients.waker(clients, c, now)
+	if !ok {
+		return &BlockedError{Clients: clients}
+	}
+	fw.because(TriggerRequest, client)
+	if err := fw.Start(); err != nil {
+		return err
+	}
+	fw.coldStart.woken(now)
+	if fw.clients.wokeUp(client, c, now) {
+		fw.notify(NotifyClient, "%s woke the environment at odd hours %d times within %v",
+			client, c.FlagAfter, time.Duration(c.Window))
+	}
+	return nil
+}
+
+// flaggedClients - a summary of the flagged clients, for the digest
+func (fw *Flywheel) flaggedClients() string {
+	var flagged []string
+	for _, a := range fw.clients.report(&fw.config.Clients, fw.now()) {
+		if a.Flagged {
+			flagged = append(flagged, fmt.Sprintf("%s (%d odd-hour wake-ups)", a.Client, a.OddHourWakeUps))
+		}
+	}
+	return strings.Join(flagged, ", ")
+}
+
+// apiClients - who woke and extended the environment
+func (handler *Handler) apiClients(w http.ResponseWriter, r *http.Request) {
+	fw := handler.Flywheel
+	handler.writeJSON(w, http.StatusOK, fw.clients.report(&fw.config.Clients, fw.now()))
+}
+
+type clientActivityList []ClientActivity
+
+func (l clientActivityList) Len() int      { return len(l) }
+func (l clientActivityList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l clientActivityList) Less(i, j int) bool {
+	if l[i].OddHourWakeUps != l[j].OddHourWakeUps {
+		return l[i].OddHourWakeUps > l[j].OddHourWakeUps
+	}
+	return l[i].Client < l[j].Client
+}
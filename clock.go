@@ -0,0 +1,212 @@
+package flywheel
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock - the time, and the timers waiting for it. The flywheel loop, idle
+// timers and schedules use it, so tests can move time along with a
+// FakeClock instead of sleeping.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer - a time.Timer of a Clock
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker - a time.Ticker of a Clock
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Steps of the wall clock larger than this are logged
+const clockStepThreshold = 2 * time.Second
+
+// rebase - t as the clock has it now: now plus the time left until t. The
+// monotonic reading of t is kept, and the wall time follows steps of the
+// wall clock since t was taken. Times without a monotonic reading, like
+// those read back from the status file or parsed from requests, get one,
+// so later steps don't move them.
+func rebase(t, now time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	return now.Add(t.Sub(now))
+}
+
+// clockStep - how far the wall clock was stepped between two readings of
+// it, e.g. by an NTP correction. Zero for times without a monotonic
+// reading, as a FakeClock has them.
+func clockStep(last, now time.Time) time.Duration {
+	return now.Round(0).Sub(last.Round(0)) - now.Sub(last)
+}
+
+// sleep - wait until the clock has moved on by d
+func sleep(clock Clock, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	<-clock.NewTimer(d).C()
+}
+
+// SystemClock - the real time
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTimer struct{ timer *time.Timer }
+
+func (t systemTimer) C() <-chan time.Time        { return t.timer.C }
+func (t systemTimer) Stop() bool                 { return t.timer.Stop() }
+func (t systemTimer) Reset(d time.Duration) bool { return t.timer.Reset(d) }
+
+type systemTicker struct{ ticker *time.Ticker }
+
+func (t systemTicker) C() <-chan time.Time { return t.ticker.C }
+func (t systemTicker) Stop()               { t.ticker.Stop() }
+
+// FakeClock - a Clock that only moves when told to. Timers and tickers fire
+// as Advance passes them.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters fakeTimers
+}
+
+// NewFakeClock - a FakeClock stopped at now
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now - the fake time
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Set - move the time to now, firing the timers due by then. Moving it
+// back fires nothing.
+func (c *FakeClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Before(c.now) {
+		c.now = now
+		return
+	}
+	// Fire in order, so a ticker fires for every period passed
+	for {
+		sort.Sort(c.waiters)
+		if len(c.waiters) == 0 || c.waiters[0].at.After(now) {
+			break
+		}
+		t := c.waiters[0]
+		c.now = t.at
+		c.waiters = c.waiters[1:]
+		select {
+		case t.c <- t.at:
+		default:
+			// Like time.Ticker, drop ticks nobody is waiting for
+		}
+		if t.period > 0 {
+			t.at = t.at.Add(t.period)
+			c.waiters = append(c.waiters, t)
+		}
+	}
+	c.now = now
+}
+
+// Advance - move the time forward by d, firing the timers due by then
+func (c *FakeClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// Waiters - the number of timers and tickers waiting to fire, so tests can
+// wait for a goroutine to get to its timer before advancing
+func (c *FakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+// NewTimer - a timer firing once the time is d from now
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	return c.add(d, 0)
+}
+
+// NewTicker - a ticker firing every d
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	return fakeTicker{c.add(d, d)}
+}
+
+func (c *FakeClock) add(d, period time.Duration) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1), at: c.now.Add(d), period: period}
+	c.waiters = append(c.waiters, t)
+	return t
+}
+
+// remove - stop a timer, true if it was waiting
+func (c *FakeClock) remove(t *fakeTimer) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, waiter := range c.waiters {
+		if waiter == t {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTimer struct {
+	clock  *FakeClock
+	c      chan time.Time
+	at     time.Time
+	period time.Duration
+}
+
+type fakeTimers []*fakeTimer
+
+func (l fakeTimers) Len() int           { return len(l) }
+func (l fakeTimers) Less(i, j int) bool { return l[i].at.Before(l[j].at) }
+func (l fakeTimers) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	return t.clock.remove(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	active := t.clock.remove(t)
+	t.clock.mu.Lock()
+	t.at = t.clock.now.Add(d)
+	t.clock.waiters = append(t.clock.waiters, t)
+	t.clock.mu.Unlock()
+	return active
+}
+
+type fakeTicker struct{ *fakeTimer }
+
+func (t fakeTicker) Stop() { t.fakeTimer.Stop() }
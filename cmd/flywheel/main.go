@@ -1,20 +1,29 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
-	"os/signal"
-	"os/user"
-	"strconv"
-	"syscall"
+	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/fairfaxmedia/flywheel"
 )
 
+func init() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] [export|import <archive.tar.gz>|replay <recording>|monitoring <rules|dashboard>|inventory <inventory.json>|service <install|remove|start|stop>]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+}
+
 func main() {
 	var err error
 	var config *flywheel.Config
@@ -22,71 +31,374 @@ func main() {
 	var listen string
 	var configFile string
 	var statusFile string
+	var promFile string
+	var envFile string
 	var setuid string
+	var pool string
+	var drainTimeout time.Duration
+	var serviceName string
+	var windowsService bool
+	var includeSecrets bool
+	var version bool
 
-	flag.StringVar(&listen, "listen", "0.0.0.0:80", "Address and port to listen on")
+	flag.StringVar(&listen, "listen", "", "Addresses and ports to listen on, comma separated (default \"0.0.0.0:80\", or the listen addresses of the config)")
 	flag.StringVar(&configFile, "config", "", "Config file to read settings from")
 	flag.StringVar(&statusFile, "status-file", "", "File to save runtime status to")
+	flag.StringVar(&promFile, "prometheus-file", "", "File to export runtime status to in the Prometheus textfile format")
+	flag.StringVar(&envFile, "env-file", "", "File to export runtime status to as KEY=value lines")
 	flag.StringVar(&setuid, "setuid", "", "Switch to user after opening socket")
+	flag.StringVar(&pool, "pool", "", "Pool of the config to export, import, replay or generate monitoring for")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 30*time.Second, "How long open requests may take to finish after an upgrade (SIGUSR2)")
+	flag.StringVar(&serviceName, "service-name", "flywheel", "Name of the Windows service to install, remove, start or stop, and of its event log source")
+	flag.BoolVar(&windowsService, "windows-service", false, "Run as a Windows service, set by service install")
+	flag.BoolVar(&includeSecrets, "include-secrets", false, "Export the config file as it is, rather than with its secrets masked")
+	flag.BoolVar(&version, "version", false, "Print the version and exit")
 	flag.Parse()
 
-	sock, err := net.Listen("tcp", listen)
+	if version {
+		fmt.Println(flywheel.GetBuildInfo())
+		return
+	}
+
+	switch flag.Arg(0) {
+	case "":
+	case "export":
+		exportArchive(flag.Arg(1), configFile, pool, poolFile(statusFile, pool), includeSecrets)
+		return
+	case "import":
+		importArchive(flag.Arg(1), configFile, pool, poolFile(statusFile, pool))
+		return
+	case "replay":
+		replay(flag.Arg(1), configFile, pool)
+		return
+	case "monitoring":
+		monitoring(flag.Arg(1), configFile, pool)
+		return
+	case "inventory":
+		inventory(flag.Arg(1))
+		return
+	case "service":
+		if err = manageService(flag.Arg(1), serviceName); err != nil {
+			log.Fatal(err)
+		}
+		return
+	default:
+		log.Fatalf("Unknown command %q. Please run with -help for more info", flag.Arg(0))
+	}
+
+	// Logs go to the event log from here on
+	if windowsService {
+		if err = runService(serviceName); err != nil {
+			log.Fatal(err)
+		}
+		defer serviceStopped()
+	}
+
+	if configFile == "" {
+		log.Fatal("Config file missing. Please run with -help for more info")
+	}
+
+	config, err = flywheel.ReadConfig(configFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if setuid != "" {
-		user, err := user.Lookup(setuid)
+	// After an upgrade, the sockets of the previous process are used
+	handover, err := inherit()
+	if err != nil {
+		log.Fatal(err)
+	}
+	d := &daemon{}
+	if handover != nil {
+		d.socks, d.dns = handover.socks, handover.dns
+	} else {
+		addresses := config.Listen.Addresses
+		if listen != "" {
+			addresses = strings.Split(listen, ",")
+		} else if len(addresses) == 0 {
+			addresses = []string{"0.0.0.0:80"}
+		}
+		d.socks, err = flywheel.Listen(addresses, config.Listen.IPv6Only)
 		if err != nil {
 			log.Fatal(err)
 		}
-		uid, err := strconv.ParseInt(user.Uid, 10, 64)
-		if err != nil {
-			log.Fatalf("Invalid uid (%s: %s): %v", setuid, user.Uid, err)
+
+		// Opened before setuid, DNS usually needs a privileged port
+		if config.WakeDNS.Listen != "" {
+			d.dns, err = net.ListenPacket("udp", config.WakeDNS.Listen)
+			if err != nil {
+				log.Fatal(err)
+			}
 		}
+	}
 
-		err = syscall.Setuid(int(uid))
-		if err != nil {
+	if setuid != "" {
+		if err = setUser(setuid); err != nil {
 			log.Fatal(err)
 		}
 	}
 
-	if configFile == "" {
-		log.Fatal("Config file missing. Please run with -help for more info")
+	// A single environment is the pool without a name
+	pools := map[string]*flywheel.Config{"": config}
+	if names := config.PoolNames(); len(names) > 0 {
+		pools = make(map[string]*flywheel.Config)
+		for _, name := range names {
+			pools[name] = config.Pools[name].Config()
+		}
 	}
+	d.fws = make(map[string]*flywheel.Flywheel)
+	handlers := make(map[string]http.Handler)
+	for name, poolConfig := range pools {
+		fw := flywheel.New(poolConfig)
+		defer fw.History().Close()
+		defer fw.Recorder().Close()
 
-	config, err = flywheel.ReadConfig(configFile)
+		poolStatusFile := poolFile(statusFile, name)
+		if poolStatusFile != "" {
+			fw.ReadStatusFile(poolStatusFile)
+			defer fw.WriteStatusFile(poolStatusFile)
+		}
+		fw.LoadState()
+		if handover != nil {
+			handover.restore(fw, name)
+		}
+		defer fw.SaveState()
+		fw.SetStatusFiles(flywheel.StatusFiles{
+			JSON:       poolStatusFile,
+			Prometheus: poolFile(promFile, name),
+			KeyValue:   poolFile(envFile, name),
+		})
+
+		if updates := fw.Updates(); updates != nil {
+			go updates.Run()
+		}
+		if discovery := fw.Discovery(); discovery != nil {
+			go discovery.Run()
+		}
+		if rampUp := fw.RampUp(); rampUp != nil {
+			go rampUp.Run()
+		}
+		if calendar := fw.Calendar(); calendar != nil {
+			go calendar.Run()
+		}
+		d.fws[name] = fw
+		handlers[name] = flywheel.NewHandler(fw)
+	}
+
+	if len(d.fws) == 1 {
+		http.Handle("/", handlers[""])
+	} else {
+		log.Printf("Managing pools %s", strings.Join(config.PoolNames(), ", "))
+		http.Handle("/", flywheel.NewPoolRouter(config, handlers))
+	}
+	d.handler = http.DefaultServeMux
+
+	log.Printf("Flywheel starting: %s", flywheel.GetBuildInfo())
+	d.start()
+	if handover != nil {
+		handover.serving()
+	}
+	serviceStarted()
+
+	ch := make(chan os.Signal, 1)
+	notifySignals(ch)
+	for sig := range ch {
+		if !isUpgrade(sig) {
+			break
+		}
+		// The new process has the state now, this one mustn't save it
+		if d.upgrade(drainTimeout) {
+			for _, fw := range d.fws {
+				fw.History().Close()
+				fw.Recorder().Close()
+			}
+			os.Exit(0)
+		}
+	}
+	log.Print("Stopping flywheel...")
+	d.shutdown(3 * time.Second)
+	d.stop()
+}
+
+// poolFile - the file of a pool, e.g. status-staging.json for status.json
+// and the pool staging. The file itself for a single environment.
+func poolFile(filename, pool string) string {
+	if filename == "" || pool == "" {
+		return filename
+	}
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "-" + pool + ext
+}
+
+// readPoolConfig - read the config, or the config of a pool of it
+func readPoolConfig(configFile, pool string) (*flywheel.Config, error) {
+	config, err := flywheel.ReadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if pool == "" {
+		if len(config.Pools) > 0 {
+			return nil, fmt.Errorf("%s has pools, choose one with -pool", configFile)
+		}
+		return config, nil
+	}
+	p, ok := config.Pools[pool]
+	if !ok {
+		return nil, fmt.Errorf("No pool %s in %s", pool, configFile)
+	}
+	return p.Config(), nil
+}
+
+// exportArchive - write the config, state and history to an archive, for
+// moving the environment to another flywheel host. Secrets in the config
+// are masked, like the API does, unless they're included on request; either
+// way only the owner can read the archive.
+func exportArchive(filename, configFile, pool, statusFile string, includeSecrets bool) {
+	if filename == "" || configFile == "" {
+		log.Fatal("Usage: flywheel -config <file> [-status-file <file>] [-include-secrets] export <archive.tar.gz>")
+	}
+
+	config, err := readPoolConfig(configFile, pool)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var raw []byte
+	if includeSecrets {
+		raw, err = ioutil.ReadFile(configFile)
+	} else {
+		raw, err = json.MarshalIndent(config, "", "    ")
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	fw := flywheel.New(config)
-
+	defer fw.History().Close()
 	if statusFile != "" {
 		fw.ReadStatusFile(statusFile)
-		defer fw.WriteStatusFile(statusFile)
 	}
+	fw.LoadState()
 
-	go fw.Spin()
+	fd, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer fd.Close()
 
-	handler := &flywheel.Handler{
-		Flywheel: fw,
+	if err = fw.Export(fd, raw); err != nil {
+		log.Fatal(err)
 	}
+	log.Printf("Exported to %s", filename)
+}
 
-	http.Handle("/", handler)
+// importArchive - take over the state and history from an archive. The
+// config file is created from the archive if it doesn't exist yet. Importing
+// again is harmless: the state is replaced and known history is skipped.
+func importArchive(filename, configFile, pool, statusFile string) {
+	if filename == "" || configFile == "" {
+		log.Fatal("Usage: flywheel -config <file> [-status-file <file>] import <archive.tar.gz>")
+	}
 
-	go func() {
-		log.Print("Flywheel starting")
-		err = http.Serve(sock, nil)
-		if err != nil {
+	fd, err := os.Open(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer fd.Close()
+
+	archive, err := flywheel.ReadArchive(fd)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err = os.Stat(configFile); os.IsNotExist(err) {
+		if err = ioutil.WriteFile(configFile, archive.Config, 0600); err != nil {
 			log.Fatal(err)
 		}
-	}()
+		log.Printf("Created %s from the archive", configFile)
+	}
 
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
-	<-ch
-	sock.Close()
-	log.Print("Stopping flywheel...")
-	time.Sleep(3 * time.Second)
+	config, err := readPoolConfig(configFile, pool)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fw := flywheel.New(config)
+	defer fw.History().Close()
+	fw.Import(archive)
+	if statusFile != "" {
+		fw.WriteStatusFile(statusFile)
+	}
+	fw.SaveState()
+	log.Printf("Imported %s", filename)
+}
+
+// replay - feed a recording through the state machine and show what
+// happens, to explain past transitions. Nothing is changed in AWS.
+func replay(filename, configFile, pool string) {
+	if filename == "" || configFile == "" {
+		log.Fatal("Usage: flywheel -config <file> replay <recording>")
+	}
+
+	config, err := readPoolConfig(configFile, pool)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fd, err := os.Open(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer fd.Close()
+
+	events, err := flywheel.ReadRecording(fd)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if mismatches := flywheel.Replay(config, events, os.Stdout); mismatches > 0 {
+		log.Fatalf("%d transitions differ from the recording", mismatches)
+	}
+}
+
+// monitoring - print the Prometheus alerting rules or Grafana dashboard for
+// the configured environment
+func monitoring(kind, configFile, pool string) {
+	if configFile == "" || (kind != "rules" && kind != "dashboard") {
+		log.Fatal("Usage: flywheel -config <file> monitoring <rules|dashboard>")
+	}
+
+	config, err := readPoolConfig(configFile, pool)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	buf := config.PrometheusRules()
+	if kind == "dashboard" {
+		if buf, err = config.GrafanaDashboard(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	os.Stdout.Write(buf)
+}
+
+// inventory - report the resources across the Organization that flywheel
+// could manage, and what they cost idle
+func inventory(inventoryFile string) {
+	if inventoryFile == "" {
+		log.Fatal("Usage: flywheel inventory <inventory.json>")
+	}
+	config, err := flywheel.ReadInventoryConfig(inventoryFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	report, err := flywheel.Inventory(session.New(), config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	buf, err := json.MarshalIndent(report, "", "    ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(append(buf, '\n'))
+	log.Printf("%d of %d resources unmanaged, idle cost %.2f a month", report.Unmanaged, len(report.Resources), report.IdleCost)
 }
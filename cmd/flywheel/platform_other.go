@@ -0,0 +1,61 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// setUser - switch to the user, after opening the sockets
+func setUser(name string) error {
+	user, err := user.Lookup(name)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.ParseInt(user.Uid, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid uid (%s: %s): %v", name, user.Uid, err)
+	}
+	return syscall.Setuid(int(uid))
+}
+
+// notifySignals - the signals that stop flywheel, and SIGUSR2 to upgrade it
+func notifySignals(ch chan os.Signal) {
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+}
+
+// isUpgrade - true if the signal asks for an upgrade
+func isUpgrade(sig os.Signal) bool {
+	return sig == syscall.SIGUSR2
+}
+
+// nonblocking - put sockets handed to a process back into non-blocking
+// mode. Starting it made them blocking, and they share the mode with the
+// sockets this process still serves until it's drained, whose Close would
+// otherwise hang on a blocked read.
+func nonblocking(files []*os.File) {
+	for _, f := range files {
+		syscall.SetNonblock(int(f.Fd()), true)
+	}
+}
+
+// manageService - Windows services only, use systemd or the like elsewhere
+func manageService(action, name string) error {
+	return fmt.Errorf("Services are only supported on Windows")
+}
+
+// runService - Windows services only
+func runService(name string) error {
+	return fmt.Errorf("-windows-service is only supported on Windows")
+}
+
+// serviceStarted - nothing to report outside a Windows service
+func serviceStarted() {}
+
+// serviceStopped - nothing to report outside a Windows service
+func serviceStopped() {}
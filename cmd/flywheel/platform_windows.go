@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// setUser - Windows has no setuid, run the service as the user instead
+func setUser(name string) error {
+	return fmt.Errorf("-setuid isn't supported on Windows, install the service to run as %s instead", name)
+}
+
+// notifySignals - Ctrl+C and Ctrl+Break stop flywheel, as does the service
+// manager when it runs as a service
+func notifySignals(ch chan os.Signal) {
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	if service.stop != nil {
+		go func() {
+			<-service.stop
+			ch <- os.Interrupt
+		}()
+	}
+}
+
+// isUpgrade - never, Windows can't hand the sockets over to a new process
+func isUpgrade(sig os.Signal) bool {
+	return false
+}
+
+// nonblocking - nothing to do, there are no upgrades on Windows
+func nonblocking(files []*os.File) {}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// The service manager and event log, called directly rather than through
+// golang.org/x/sys/windows
+var (
+	advapi32 = syscall.NewLazyDLL("advapi32.dll")
+
+	procOpenSCManager                = advapi32.NewProc("OpenSCManagerW")
+	procCreateService                = advapi32.NewProc("CreateServiceW")
+	procOpenService                  = advapi32.NewProc("OpenServiceW")
+	procDeleteService                = advapi32.NewProc("DeleteService")
+	procStartService                 = advapi32.NewProc("StartServiceW")
+	procControlService               = advapi32.NewProc("ControlService")
+	procCloseServiceHandle           = advapi32.NewProc("CloseServiceHandle")
+	procStartServiceCtrlDispatcher   = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus             = advapi32.NewProc("SetServiceStatus")
+	procRegisterEventSource          = advapi32.NewProc("RegisterEventSourceW")
+	procReportEvent                  = advapi32.NewProc("ReportEventW")
+	procRegCreateKeyEx               = advapi32.NewProc("RegCreateKeyExW")
+	procRegSetValueEx                = advapi32.NewProc("RegSetValueExW")
+	procRegDeleteKey                 = advapi32.NewProc("RegDeleteKeyW")
+)
+
+const (
+	scManagerAllAccess = 0xF003F
+	serviceAllAccess   = 0xF01FF
+
+	serviceWin32OwnProcess = 0x10
+	serviceAutoStart       = 2
+	serviceErrorNormal     = 1
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+	serviceAcceptStop         = 1
+	serviceAcceptShutdown     = 4
+
+	serviceStoppedState      = 1
+	serviceStartPendingState = 2
+	serviceStopPendingState  = 3
+	serviceRunningState      = 4
+
+	eventlogErrorType       = 1
+	eventlogInformationType = 4
+)
+
+// Event sources are registered under this key, with the service name
+const eventLogKey = `SYSTEM\CurrentControlSet\Services\EventLog\Application\`
+
+// Message file with a message that just shows the text. Flywheel doesn't
+// ship its own.
+const eventMessageFile = `%SystemRoot%\System32\EventCreate.exe`
+
+// serviceStatus - SERVICE_STATUS
+type serviceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+// serviceTableEntry - SERVICE_TABLE_ENTRYW
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+// service - flywheel running as a Windows service. stop is signalled by the
+// service manager, started and done are closed by main.
+var service struct {
+	name    *uint16
+	table   []serviceTableEntry
+	handle  uintptr
+	stop    chan struct{}
+	started chan struct{}
+	done    chan struct{}
+	exited  chan struct{}
+
+	sync.Mutex
+	status serviceStatus
+}
+
+// manageService - install, remove, start or stop the service
+func manageService(action, name string) error {
+	switch action {
+	case "install":
+		return installService(name)
+	case "remove":
+		return removeService(name)
+	case "start":
+		return withService(name, func(h uintptr) error {
+			if r, _, err := procStartService.Call(h, 0, 0); r == 0 {
+				return fmt.Errorf("Unable to start service %s: %v", name, err)
+			}
+			log.Printf("Started service %s", name)
+			return nil
+		})
+	case "stop":
+		return withService(name, func(h uintptr) error {
+			var status serviceStatus
+			if r, _, err := procControlService.Call(h, serviceControlStop, uintptr(unsafe.Pointer(&status))); r == 0 {
+				return fmt.Errorf("Unable to stop service %s: %v", name, err)
+			}
+			log.Printf("Stopping service %s", name)
+			return nil
+		})
+	}
+	return fmt.Errorf("Usage: flywheel [-service-name <name>] service <install|remove|start|stop>")
+}
+
+// serviceArgs - the flags the service runs with, the paths made absolute as
+// services start in the system directory
+func serviceArgs() ([]string, error) {
+	args := []string{"-windows-service"}
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		value := f.Value.String()
+		switch f.Name {
+		case "windows-service":
+			return
+		case "config", "status-file", "prometheus-file", "env-file":
+			if value != "" {
+				if value, err = filepath.Abs(value); err != nil {
+					return
+				}
+			}
+		}
+		args = append(args, "-"+f.Name+"="+value)
+	})
+	return args, err
+}
+
+// installService - create the service, started automatically with the flags
+// of this command, and register it as an event source
+func installService(name string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args, err := serviceArgs()
+	if err != nil {
+		return err
+	}
+	cmdline := syscall.EscapeArg(exe)
+	for _, arg := range args {
+		cmdline += " " + syscall.EscapeArg(arg)
+	}
+
+	scm, err := openSCManager()
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(scm)
+
+	display := "Flywheel"
+	if name != "flywheel" {
+		display += " " + name
+	}
+	h, _, err := procCreateService.Call(scm, uintptr(unsafe.Pointer(utf16(name))), uintptr(unsafe.Pointer(utf16(display))),
+		serviceAllAccess, serviceWin32OwnProcess, serviceAutoStart, serviceErrorNormal,
+		uintptr(unsafe.Pointer(utf16(cmdline))), 0, 0, 0, 0, 0)
+	if h == 0 {
+		return fmt.Errorf("Unable to install service %s: %v", name, err)
+	}
+	procCloseServiceHandle.Call(h)
+
+	if err = installEventSource(name); err != nil {
+		return err
+	}
+	log.Printf("Installed service %s: %s", name, cmdline)
+	return nil
+}
+
+// installEventSource - register the service as a source of the Application
+// event log
+func installEventSource(name string) error {
+	var key syscall.Handle
+	var disposition uint32
+	r, _, _ := procRegCreateKeyEx.Call(uintptr(syscall.HKEY_LOCAL_MACHINE), uintptr(unsafe.Pointer(utf16(eventLogKey+name))), 0, 0, 0,
+		syscall.KEY_SET_VALUE, 0, uintptr(unsafe.Pointer(&key)), uintptr(unsafe.Pointer(&disposition)))
+	if r != 0 {
+		return fmt.Errorf("Unable to register event source %s: %v", name, syscall.Errno(r))
+	}
+	defer syscall.RegCloseKey(key)
+
+	file, _ := syscall.UTF16FromString(eventMessageFile)
+	r, _, _ = procRegSetValueEx.Call(uintptr(key), uintptr(unsafe.Pointer(utf16("EventMessageFile"))), 0, syscall.REG_EXPAND_SZ,
+		uintptr(unsafe.Pointer(&file[0])), uintptr(len(file)*2))
+	if r != 0 {
+		return fmt.Errorf("Unable to register event source %s: %v", name, syscall.Errno(r))
+	}
+	types := uint32(7)
+	r, _, _ = procRegSetValueEx.Call(uintptr(key), uintptr(unsafe.Pointer(utf16("TypesSupported"))), 0, syscall.REG_DWORD,
+		uintptr(unsafe.Pointer(&types)), 4)
+	if r != 0 {
+		return fmt.Errorf("Unable to register event source %s: %v", name, syscall.Errno(r))
+	}
+	return nil
+}
+
+// removeService - delete the service and its event source. A running
+// service is removed once it stops.
+func removeService(name string) error {
+	err := withService(name, func(h uintptr) error {
+		if r, _, err := procDeleteService.Call(h); r == 0 {
+			return fmt.Errorf("Unable to remove service %s: %v", name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if r, _, _ := procRegDeleteKey.Call(uintptr(syscall.HKEY_LOCAL_MACHINE), uintptr(unsafe.Pointer(utf16(eventLogKey+name)))); r != 0 {
+		log.Printf("Unable to remove event source %s: %v", name, syscall.Errno(r))
+	}
+	log.Printf("Removed service %s", name)
+	return nil
+}
+
+// openSCManager - connect to the service manager
+func openSCManager() (uintptr, error) {
+	scm, _, err := procOpenSCManager.Call(0, 0, scManagerAllAccess)
+	if scm == 0 {
+		return 0, fmt.Errorf("Unable to connect to the service manager: %v", err)
+	}
+	return scm, nil
+}
+
+// withService - call fn with a handle of the installed service
+func withService(name string, fn func(uintptr) error) error {
+	scm, err := openSCManager()
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(scm)
+
+	h, _, err := procOpenService.Call(scm, uintptr(unsafe.Pointer(utf16(name))), serviceAllAccess)
+	if h == 0 {
+		return fmt.Errorf("Unable to open service %s: %v", name, err)
+	}
+	defer procCloseServiceHandle.Call(h)
+	return fn(h)
+}
+
+// runService - connect to the service manager, and log to the event log.
+// The service manager is told it's running once main calls serviceStarted.
+func runService(name string) error {
+	source, _, err := procRegisterEventSource.Call(0, uintptr(unsafe.Pointer(utf16(name))))
+	if source == 0 {
+		return fmt.Errorf("Unable to open the event log: %v", err)
+	}
+	// The event log has its own timestamps
+	log.SetFlags(0)
+	log.SetOutput(eventLog(source))
+
+	service.name = utf16(name)
+	service.table = []serviceTableEntry{{service.name, syscall.NewCallback(serviceMain)}, {}}
+	service.stop = make(chan struct{}, 1)
+	service.started = make(chan struct{})
+	service.done = make(chan struct{})
+	service.exited = make(chan struct{})
+
+	// The dispatcher runs until the service has stopped
+	go func() {
+		runtime.LockOSThread()
+		defer close(service.exited)
+		if r, _, err := procStartServiceCtrlDispatcher.Call(uintptr(unsafe.Pointer(&service.table[0]))); r == 0 {
+			log.Fatalf("Unable to connect to the service manager: %v", err)
+		}
+	}()
+	return nil
+}
+
+// serviceMain - ServiceMain, reports the service started once flywheel
+// listens, and stopped once it's done
+func serviceMain(argc, argv uintptr) uintptr {
+	h, _, err := procRegisterServiceCtrlHandlerEx.Call(uintptr(unsafe.Pointer(service.name)), syscall.NewCallback(serviceHandler), 0)
+	if h == 0 {
+		log.Fatalf("Unable to register the service handler: %v", err)
+	}
+	service.Lock()
+	service.handle = h
+	service.Unlock()
+
+	setServiceStatus(serviceStartPendingState, 0, 30*time.Second)
+	select {
+	case <-service.started:
+		setServiceStatus(serviceRunningState, serviceAcceptStop|serviceAcceptShutdown, 0)
+		<-service.done
+	case <-service.done:
+	}
+	setServiceStatus(serviceStoppedState, 0, 0)
+	return 0
+}
+
+// serviceHandler - HandlerEx, passes stops on to main
+func serviceHandler(control, eventType, eventData, context uintptr) uintptr {
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		setServiceStatus(serviceStopPendingState, 0, 10*time.Second)
+		select {
+		case service.stop <- struct{}{}:
+		default:
+		}
+	case serviceControlInterrogate:
+		service.Lock()
+		status := service.status
+		service.Unlock()
+		setServiceStatus(status.CurrentState, status.ControlsAccepted, 0)
+	}
+	return 0
+}
+
+// setServiceStatus - report the state to the service manager
+func setServiceStatus(state, accepts uint32, wait time.Duration) {
+	service.Lock()
+	defer service.Unlock()
+	if state == service.status.CurrentState && state != serviceRunningState {
+		service.status.CheckPoint++
+	} else {
+		service.status.CheckPoint = 0
+	}
+	service.status.ServiceType = serviceWin32OwnProcess
+	service.status.CurrentState = state
+	service.status.ControlsAccepted = accepts
+	service.status.WaitHint = uint32(wait / time.Millisecond)
+	if r, _, err := procSetServiceStatus.Call(service.handle, uintptr(unsafe.Pointer(&service.status))); r == 0 {
+		log.Printf("Unable to report service status: %v", err)
+	}
+}
+
+// serviceStarted - tell the service manager flywheel is running
+func serviceStarted() {
+	if service.started != nil {
+		close(service.started)
+	}
+}
+
+// serviceStopped - tell the service manager flywheel has stopped, and wait
+// for the dispatcher to return
+func serviceStopped() {
+	if service.done == nil {
+		return
+	}
+	close(service.done)
+	select {
+	case <-service.exited:
+	case <-time.After(10 * time.Second):
+	}
+}
+
+// eventLog - writes log lines to the event log of the service. Lines that
+// look like errors are logged as errors.
+type eventLog uintptr
+
+func (source eventLog) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\r\n")
+	kind := uintptr(eventlogInformationType)
+	if lower := strings.ToLower(msg); strings.Contains(lower, "error") || strings.Contains(lower, "unable") {
+		kind = eventlogErrorType
+	}
+	strs := []*uint16{utf16(msg)}
+	// Event 1 of EventCreate.exe shows the string as it is
+	r, _, err := procReportEvent.Call(uintptr(source), kind, 0, 1, 0, 1, 0, uintptr(unsafe.Pointer(&strs[0])), 0)
+	runtime.KeepAlive(strs)
+	if r == 0 {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// utf16 - a string for the Windows API. NULs aren't expected in the
+// strings passed, they are cut off.
+func utf16(s string) *uint16 {
+	if i := strings.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	p, _ := syscall.UTF16PtrFromString(s)
+	return p
+}
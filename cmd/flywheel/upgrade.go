@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fairfaxmedia/flywheel"
+)
+
+// Environment of a process started by an upgrade. The sockets are passed
+// from fd 3: the listeners, the wake DNS connection if any, then the pipe
+// the new process signals it's ready on.
+const (
+	envUpgradeListeners = "FLYWHEEL_UPGRADE_LISTENERS"
+	envUpgradeDNS       = "FLYWHEEL_UPGRADE_DNS"
+	envUpgradeState     = "FLYWHEEL_UPGRADE_STATE"
+)
+
+// How long the new process may take to start serving
+const upgradeReadyTimeout = 30 * time.Second
+
+// daemon - the flywheels, by pool, and the sockets they serve
+type daemon struct {
+	fws     map[string]*flywheel.Flywheel
+	handler http.Handler
+	socks   []net.Listener
+	dns     net.PacketConn
+	server  *http.Server
+	stop    func()
+}
+
+// start - run the flywheels, and serve the sockets
+func (d *daemon) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for _, fw := range d.fws {
+		wg.Add(1)
+		go func(fw *flywheel.Flywheel) {
+			defer wg.Done()
+			fw.Run(ctx)
+		}(fw)
+	}
+	d.stop = func() {
+		cancel()
+		wg.Wait()
+	}
+
+	// Pools can't have wake DNS, so this is the single environment
+	if fw := d.fws[""]; d.dns != nil && fw != nil {
+		go fw.ServeWakeDNS(d.dns)
+	}
+
+	server := &http.Server{Handler: d.handler}
+	d.server = server
+	for _, sock := range d.socks {
+		log.Printf("Listening on %s", sock.Addr())
+		go func(sock net.Listener) {
+			if err := server.Serve(sock); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}(sock)
+	}
+}
+
+// shutdown - stop accepting, and wait up to the timeout for the requests
+// being served
+func (d *daemon) shutdown(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if d.dns != nil {
+		d.dns.Close()
+	}
+	if err := d.server.Shutdown(ctx); err != nil {
+		log.Printf("Requests still open after %v: %v", timeout, err)
+	}
+}
+
+// filer - listeners and connections whose socket can be duplicated
+type filer interface {
+	File() (*os.File, error)
+}
+
+// upgrade - start the current binary with the sockets and the state, then
+// drain the requests being served while it takes over. Connections wait in
+// the sockets' backlog meanwhile, none are refused. If the new process
+// doesn't get ready, this one serves again and false is returned.
+func (d *daemon) upgrade(drainTimeout time.Duration) bool {
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	sockets := make([]interface{}, 0, len(d.socks)+1)
+	for _, sock := range d.socks {
+		sockets = append(sockets, sock)
+	}
+	if d.dns != nil {
+		sockets = append(sockets, d.dns)
+	}
+	for _, sock := range sockets {
+		s, ok := sock.(filer)
+		if !ok {
+			log.Printf("Unable to upgrade: %T can't be handed over", sock)
+			return false
+		}
+		f, err := s.File()
+		if err != nil {
+			log.Printf("Unable to upgrade: %v", err)
+			return false
+		}
+		files = append(files, f)
+	}
+	state, err := ioutil.TempFile("", "flywheel-upgrade")
+	if err != nil {
+		log.Printf("Unable to upgrade: %v", err)
+		return false
+	}
+	state.Close()
+
+	// Nothing may change once the state is handed over. Requests still being
+	// drained are answered from the last status meanwhile, without waiting
+	// for the stopped flywheels.
+	log.Printf("Upgrading, handing over %d sockets", len(files))
+	drained := make(chan struct{})
+	old := *d
+	go func() {
+		old.shutdown(drainTimeout)
+		close(drained)
+	}()
+	d.stop()
+	for name, fw := range d.fws {
+		fw.SaveState()
+		fw.WriteStatusFile(poolFile(state.Name(), name))
+	}
+
+	pid, err := d.spawn(files, state.Name())
+	if err != nil {
+		log.Printf("Upgrade failed, serving again: %v", err)
+		os.Remove(state.Name())
+		for name := range d.fws {
+			os.Remove(poolFile(state.Name(), name))
+		}
+		if err := d.resume(files); err != nil {
+			log.Fatal(err)
+		}
+		return false
+	}
+	log.Printf("Upgraded, process %d took over. Draining...", pid)
+	<-drained
+	return true
+}
+
+// spawn - start the new process, and wait until it's serving
+func (d *daemon) spawn(files []*os.File, state string) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(append([]*os.File{}, files...), readyW)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%d", envUpgradeListeners, len(d.socks)),
+		fmt.Sprintf("%s=%t", envUpgradeDNS, d.dns != nil),
+		fmt.Sprintf("%s=%s", envUpgradeState, state),
+	)
+	err = cmd.Start()
+	readyW.Close()
+	nonblocking(files)
+	if err != nil {
+		return 0, err
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		if _, err := ready.Read(buf); err != nil {
+			result <- fmt.Errorf("Process %d exited before it was ready", cmd.Process.Pid)
+			return
+		}
+		result <- nil
+	}()
+	select {
+	case err = <-result:
+	case <-time.After(upgradeReadyTimeout):
+		err = fmt.Errorf("Process %d not ready after %v", cmd.Process.Pid, upgradeReadyTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, err
+	}
+	// Not waited for, it outlives this process
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+	return pid, nil
+}
+
+// resume - serve the handed over sockets again
+func (d *daemon) resume(files []*os.File) error {
+	n := len(d.socks)
+	d.socks = nil
+	for _, f := range files[:n] {
+		sock, err := net.FileListener(f)
+		if err != nil {
+			return err
+		}
+		d.socks = append(d.socks, sock)
+	}
+	if d.dns != nil {
+		conn, err := net.FilePacketConn(files[n])
+		if err != nil {
+			return err
+		}
+		d.dns = conn
+	}
+	d.start()
+	return nil
+}
+
+// handover - the sockets and state from the process being upgraded. Nil if
+// this process wasn't started by an upgrade.
+type handover struct {
+	socks []net.Listener
+	dns   net.PacketConn
+	state string
+	ready *os.File
+}
+
+// inherit - take over the sockets, if started by an upgrade
+func inherit() (*handover, error) {
+	count := os.Getenv(envUpgradeListeners)
+	if count == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s %q", envUpgradeListeners, count)
+	}
+	h := &handover{state: os.Getenv(envUpgradeState)}
+	fd := uintptr(3)
+	for i := 0; i < n; i++ {
+		f := os.NewFile(fd, "listener")
+		fd++
+		sock, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		h.socks = append(h.socks, sock)
+	}
+	if strings.EqualFold(os.Getenv(envUpgradeDNS), "true") {
+		f := os.NewFile(fd, "wake-dns")
+		fd++
+		h.dns, err = net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	h.ready = os.NewFile(fd, "ready")
+
+	// Not for the processes of a later upgrade
+	for _, name := range []string{envUpgradeListeners, envUpgradeDNS, envUpgradeState} {
+		os.Unsetenv(name)
+	}
+	return h, nil
+}
+
+// restore - take over the state of a pool of the process being upgraded
+func (h *handover) restore(fw *flywheel.Flywheel, pool string) {
+	if h.state == "" {
+		return
+	}
+	state := poolFile(h.state, pool)
+	fw.ReadStatusFile(state)
+	os.Remove(state)
+	// Pools have a file each, next to the one handed over
+	os.Remove(h.state)
+}
+
+// serving - tell the process being upgraded to drain and exit
+func (h *handover) serving() {
+	h.ready.Write([]byte{1})
+	h.ready.Close()
+}
@@ -0,0 +1,177 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fairfaxmedia/flywheel"
+)
+
+// What the test binary does when an upgrade starts it: fail before it's
+// ready, or take over and report what it was handed
+const (
+	envTestUpgrade = "FLYWHEEL_TEST_UPGRADE"
+	envTestReport  = "FLYWHEEL_TEST_REPORT"
+)
+
+// TestMain - run as the new process when started by an upgrade
+func TestMain(m *testing.M) {
+	if os.Getenv(envUpgradeListeners) != "" {
+		upgradedProcess()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// upgradedProcess - write the addresses of the sockets and the state to the
+// report files, then serve a single request
+func upgradedProcess() {
+	if os.Getenv(envTestUpgrade) == "fail" {
+		os.Exit(1)
+	}
+	report := os.Getenv(envTestReport)
+	h, err := inherit()
+	if err != nil || len(h.socks) != 1 || h.dns == nil {
+		os.Exit(2)
+	}
+	fw := flywheel.New(&flywheel.Config{Endpoint: "10.0.0.1:80"}, flywheel.WithDriver(runningDriver{}))
+	h.restore(fw, "")
+	fw.WriteStatusFile(report + ".json")
+	addrs := fmt.Sprintf("%s %s", h.socks[0].Addr(), h.dns.LocalAddr())
+	if err = ioutil.WriteFile(report, []byte(addrs), 0644); err != nil {
+		os.Exit(3)
+	}
+
+	served := make(chan struct{})
+	go http.Serve(h.socks[0], http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "upgraded")
+		close(served)
+	}))
+	h.serving()
+	select {
+	case <-served:
+		time.Sleep(100 * time.Millisecond)
+	case <-time.After(10 * time.Second):
+	}
+	os.Exit(0)
+}
+
+// runningDriver - resources that are always running
+type runningDriver struct{}
+
+func (runningDriver) Start() error { return nil }
+func (runningDriver) Stop() error  { return nil }
+func (runningDriver) Ready() ([]flywheel.ResourceState, error) {
+	return []flywheel.ResourceState{{Resource: "app", State: "running", Share: 1}}, nil
+}
+func (runningDriver) Describe() []flywheel.ResourceHealth { return nil }
+
+// testDaemon - a started environment, serving on a local port and wake DNS
+func testDaemon(t *testing.T, dir string) (*daemon, time.Time) {
+	stopAt := time.Now().Add(time.Hour).Round(time.Second)
+	status := filepath.Join(dir, "status.json")
+	if err := flywheel.FileStateStore(status).Save(flywheel.Pong{StatusName: "STARTED", StopAt: stopAt, LastStarted: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	fw := flywheel.New(&flywheel.Config{Endpoint: "10.0.0.1:80"}, flywheel.WithDriver(runningDriver{}))
+	fw.ReadStatusFile(status)
+
+	sock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dns, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &daemon{
+		fws:     map[string]*flywheel.Flywheel{"": fw},
+		handler: flywheel.NewHandler(fw),
+		socks:   []net.Listener{sock},
+		dns:     dns,
+	}
+	d.start()
+	return d, stopAt
+}
+
+func TestUpgrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flywheel-upgrade-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	report := filepath.Join(dir, "report")
+	os.Setenv(envTestUpgrade, "report")
+	os.Setenv(envTestReport, report)
+	defer os.Unsetenv(envTestUpgrade)
+	defer os.Unsetenv(envTestReport)
+
+	d, stopAt := testDaemon(t, dir)
+	addr, dnsAddr := d.socks[0].Addr().String(), d.dns.LocalAddr().String()
+	if !d.upgrade(time.Second) {
+		t.Fatalf("Expected the upgrade to succeed")
+	}
+
+	// The new process serves the same socket
+	resp, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatalf("Expected the new process to serve, but got %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "upgraded" {
+		t.Errorf("Expected the new process to answer, but got %q", body)
+	}
+
+	buf, err := ioutil.ReadFile(report)
+	if err != nil {
+		t.Fatalf("Expected a report from the new process, but got %v", err)
+	}
+	if string(buf) != addr+" "+dnsAddr {
+		t.Errorf("Expected the sockets %s %s, but got %s", addr, dnsAddr, buf)
+	}
+	state, err := flywheel.FileStateStore(report + ".json").Load()
+	if err != nil || state.StatusName != "STARTED" || !state.StopAt.Equal(stopAt) {
+		t.Errorf("Expected the state to be handed over, but got %s %v %v", state.StatusName, state.StopAt, err)
+	}
+}
+
+func TestUpgradeRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flywheel-upgrade-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv(envTestUpgrade, "fail")
+	defer os.Unsetenv(envTestUpgrade)
+
+	d, _ := testDaemon(t, dir)
+	defer d.stop()
+	addr := d.socks[0].Addr().String()
+	if d.upgrade(time.Second) {
+		t.Fatalf("Expected the upgrade to fail")
+	}
+
+	// Serving the same socket again, with the flywheel running
+	begin := time.Now()
+	resp, err := http.PostForm("http://"+addr+"/flywheel/api/v1/timeout", url.Values{"duration": {"2h"}})
+	if err != nil {
+		t.Fatalf("Expected the old process to serve again, but got %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || time.Since(begin) >= flywheel.PingTimeout {
+		t.Errorf("Expected the flywheel to answer, but got %d after %v", resp.StatusCode, time.Since(begin))
+	}
+	if d.dns == nil || d.dns.LocalAddr() == nil {
+		t.Errorf("Expected wake DNS to be served again")
+	}
+}
@@ -0,0 +1,160 @@
+package flywheel
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ColdStartSLOConfig - a target for how long users wait after waking the
+// environment. A cold start is timed from the request that woke it to the
+// first response proxied from the backend.
+type ColdStartSLOConfig struct {
+	// The percentile of cold starts should be served within this, e.g.
+	// "3m". Unset, cold starts are still measured but not judged.
+	Target Duration `json:"target"`
+
+	// Default 95
+	Percentile float64 `json:"percentile"`
+
+	// Cold starts within this window are reported, default 168h
+	Window Duration `json:"window"`
+}
+
+// Validate - cold starts are kept in the history, so the SLO needs one.
+// Fills in the defaults.
+func (c *ColdStartSLOConfig) Validate(historyFile string) error {
+	if c.Target < 0 {
+		return fmt.Errorf("Cold start target can't be negative")
+	}
+	if c.Target > 0 && historyFile == "" {
+		return fmt.Errorf("A cold start target needs a history-file")
+	}
+	if c.Percentile < 0 || c.Percentile > 100 {
+		return fmt.Errorf("Cold start percentile must be between 0 and 100, got %v", c.Percentile)
+	}
+	if c.Percentile == 0 {
+		c.Percentile = 95
+	}
+	if c.Window <= 0 {
+		c.Window = Duration(7 * 24 * time.Hour)
+	}
+	return nil
+}
+
+// coldStart - times the cold start in progress. The environment is woken in
+// the flywheel goroutine, and responses are proxied in the handlers.
+type coldStart struct {
+	mu      sync.Mutex
+	wokenAt time.Time
+	latency time.Duration
+	served  bool
+}
+
+// woken - a request started the environment. Only the first request of a
+// start is timed.
+func (c *coldStart) woken(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.wokenAt.IsZero() {
+		c.wokenAt = now
+		c.served = false
+	}
+}
+
+// respond - a response was proxied. Only the first after a wake-up counts.
+func (c *coldStart) respond(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.wokenAt.IsZero() && !c.served {
+		c.latency = now.Sub(c.wokenAt)
+		c.served = true
+	}
+}
+
+// take - the latency of the cold start, once it was served
+func (c *coldStart) take() (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.served {
+		return 0, false
+	}
+	latency := c.latency
+	c.wokenAt = time.Time{}
+	c.served = false
+	return latency, true
+}
+
+// cancel - the environment stopped before anything was served
+func (c *coldStart) cancel() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wokenAt = time.Time{}
+	c.served = false
+}
+
+// pollColdStart - record the cold start once its first response was served
+func (fw *Flywheel) pollColdStart() {
+	latency, ok := fw.coldStart.take()
+	if !ok {
+		return
+	}
+	fw.logf("Cold start took %v to the first response", latency)
+	fw.history.RecordColdStart(fw.now(), latency)
+	fw.exportStatus()
+}
+
+// coldStartReport - the cold start latencies within the SLO window
+type coldStartReport struct {
+	count    int
+	sum      time.Duration
+	p50, p95 time.Duration
+
+	// The configured percentile, and whether it's within the target. Unset
+	// without a target.
+	percentile time.Duration
+	met        *bool
+}
+
+// coldStarts - report the cold starts within the window
+func (fw *Flywheel) coldStarts() coldStartReport {
+	slo := &fw.config.ColdStartSLO
+	var latencies []time.Duration
+	var report coldStartReport
+	for _, event := range fw.history.Events(HistoryColdStart, fw.now().Add(-time.Duration(slo.Window))) {
+		latencies = append(latencies, event.Duration)
+		report.sum += event.Duration
+	}
+	report.count = len(latencies)
+	if report.count == 0 {
+		return report
+	}
+	sort.Sort(durations(latencies))
+	report.p50 = nearestRank(latencies, 50)
+	report.p95 = nearestRank(latencies, 95)
+	if slo.Target > 0 {
+		report.percentile = nearestRank(latencies, slo.Percentile)
+		met := report.percentile <= time.Duration(slo.Target)
+		report.met = &met
+	}
+	return report
+}
+
+// summary - the report, for the digest
+func (r coldStartReport) summary(slo *ColdStartSLOConfig) string {
+	if r.count == 0 {
+		return fmt.Sprintf("No cold starts in the last %v", time.Duration(slo.Window))
+	}
+	message := fmt.Sprintf("%d cold starts in the last %v, p50 %v, p95 %v",
+		r.count, time.Duration(slo.Window), r.p50.Round(time.Second), r.p95.Round(time.Second))
+	if r.met != nil {
+		verdict := "met"
+		if !*r.met {
+			verdict = "missed"
+		}
+		message += fmt.Sprintf(" (SLO %s: p%g %v against a target of %v)",
+			verdict, slo.Percentile, r.percentile.Round(time.Second), time.Duration(slo.Target))
+	}
+	return message
+}
@@ -0,0 +1,70 @@
+package flywheel
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Interstitial pages are polled by monitoring, often every 30 seconds for
+// as long as an environment is stopped. They have an ETag, and the time the
+// status last changed as Last-Modified, so a conditional request gets a 304
+// instead of the page, despite the page's 503 status.
+
+// pageETag - the ETag of a page, from what's shown on it. Weak, as the
+// request ID in the footer differs every time.
+func pageETag(code int, layout, lang, title string, body interface{}, footer string) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%d\x00%s\x00%s\x00%s\x00%v\x00%s", code, layout, lang, title, body, footer)))
+	return `W/"` + hex.EncodeToString(sum[:10]) + `"`
+}
+
+// notModified - true if the client has the page already. If-None-Match
+// takes precedence over If-Modified-Since, and is compared weakly.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, tag := range strings.Split(match, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if modified.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modified.Truncate(time.Second).After(since)
+}
+
+// interstitial - write a page standing in for the backend, or 304 Not
+// Modified if the client has it already. HEAD requests get the headers
+// only.
+func (handler *Handler) interstitial(w http.ResponseWriter, r *http.Request, pong Pong, code int, layout, lang, name string, body interface{}) {
+	config := handler.Flywheel.config
+	if body == nil {
+		body = config.Message(lang, name+".body")
+	}
+	etag := pageETag(code, layout, lang, config.Message(lang, name+".title"), body, config.contact(lang, pong.Annotations))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if !pong.StatusSince.IsZero() {
+		w.Header().Set("Last-Modified", pong.StatusSince.UTC().Format(http.TimeFormat))
+	}
+	if notModified(r, etag, pong.StatusSince) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if r.Method == "HEAD" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(code)
+		return
+	}
+	handler.page(w, code, layout, lang, name, body)
+}
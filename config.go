@@ -1,38 +1,169 @@
 package flywheel
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/url"
-	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // Config flywheel config file
 type Config struct {
-	Vhosts      map[string]string `json:"vhosts"`
-	Region      string            `json:"aws_region"`
-	Endpoint    string            `json:"endpoint"`
-	Instances   []string          `json:"instances"`
-	HcInterval  Duration          `json:"healthcheck-interval"`
-	IdleTimeout Duration          `json:"idle-timeout"`
-	AutoScaling AutoScalingConfig `json:"autoscaling"`
+	Vhosts         map[string]string      `json:"vhosts"`
+	Region         string                 `json:"aws_region"`
+	Endpoint       string                 `json:"endpoint"`
+	Instances      []string               `json:"instances"`
+	InstanceDelays map[string]Duration    `json:"instance-delays"`
+	HcInterval     Duration               `json:"healthcheck-interval"`
+	HcTransition   Duration               `json:"healthcheck-transition-interval"`
+	PollInterval   Duration               `json:"poll-interval"`
+	IdleInterval   Duration               `json:"idle-check-interval"`
+	Jitter         float64                `json:"jitter"`
+	IdleTimeout    Duration               `json:"idle-timeout"`
+	IdleTimeouts   []IdleTimeoutWindow    `json:"idle-timeouts"`
+	Blackouts      []BlackoutWindow       `json:"blackouts"`
+	AutoScaling    AutoScalingConfig      `json:"autoscaling"`
+	Pools          map[string]*PoolConfig `json:"pools"`
+	Team           string                 `json:"team"`
+	Owner          OwnerConfig            `json:"owner"`
+	APITokens      map[string][]Secret    `json:"api-tokens"`
+	AdminTokens    []Secret               `json:"admin-tokens"`
+	CORS           CORSConfig             `json:"cors"`
+	ReadOnly       bool                   `json:"read-only"`
+	HistoryFile    string                 `json:"history-file"`
+	HistoryMaxAge  Duration               `json:"history-max-age"`
+	RecordFile     string                 `json:"record-file"`
+	Notify         NotifyConfig           `json:"notify"`
+	StateStore     StateStoreConfig       `json:"state-store"`
+	MaxLifetime    Duration               `json:"max-lifetime"`
+	ObserveOnly    []string               `json:"observe-only"`
+	Shared         SharedConfig           `json:"shared"`
+	WakeDNS        WakeDNSConfig          `json:"wake-dns"`
+	Listen         ListenConfig           `json:"listen"`
+	WarmStandby    WarmStandbyConfig      `json:"warm-standby"`
+	Downsize       DownsizeConfig         `json:"downsize"`
+	GPU            GPUConfig              `json:"gpu"`
+	Idle           IdleConfig             `json:"idle"`
+	Chaos          ChaosConfig            `json:"chaos"`
+	UpdateCheck    UpdateCheckConfig      `json:"update-check"`
+
+	StopConfirmation StopConfirmationConfig `json:"stop-confirmation"`
+	Backend          BackendConfig          `json:"backend"`
+	RampUp           RampUpConfig           `json:"ramp-up"`
+	StartupLimit     StartupLimitConfig     `json:"startup-limit"`
+	Clients          ClientsConfig          `json:"clients"`
+	ProxyErrors      ProxyErrorsConfig      `json:"proxy-errors"`
+	ProxyTimeout     ProxyTimeoutConfig     `json:"proxy-timeout"`
+	Recovery         RecoveryConfig         `json:"recovery"`
+	AppHealth        AppHealthConfig        `json:"app-health"`
+	HealthRules      HealthRulesConfig      `json:"health-rules"`
+	Parked           ParkedConfig           `json:"parked"`
+	Diagnostics      DiagnosticsConfig      `json:"diagnostics"`
+	Readiness        ReadinessConfig        `json:"readiness"`
+	Monitoring       MonitoringConfig       `json:"monitoring"`
+
+	InstanceScheduler InstanceSchedulerConfig `json:"instance-scheduler"`
+	Drain             DrainConfig             `json:"drain"`
+	Calendar          CalendarConfig          `json:"calendar"`
+	Schedule          ScheduleConfig          `json:"schedule"`
+	Middleware        MiddlewareConfig        `json:"middleware"`
+	TrustedProxies    []string                `json:"trusted-proxies"`
+	Anomalies         AnomaliesConfig         `json:"anomalies"`
+	ColdStartSLO      ColdStartSLOConfig      `json:"cold-start-slo"`
+	Mirror            MirrorConfig            `json:"mirror"`
+	WebhookReplay     WebhookReplayConfig     `json:"webhook-replay"`
+	Exec              []ExecResource          `json:"exec"`
+	RDS               RDSConfig               `json:"rds"`
+	ECS               []ECSService            `json:"ecs"`
+	Kubernetes        KubernetesConfig        `json:"kubernetes"`
+	ShortLinks        ShortLinksConfig        `json:"short-links"`
+	RequestID         RequestIDConfig         `json:"request-id"`
+	AWS               AWSConfig               `json:"aws"`
+	WakeHooks         []WakeHook              `json:"wake-hooks"`
+	Maintenance       MaintenanceConfig       `json:"maintenance"`
+
+	DefaultLanguage string             `json:"language"`
+	Catalogs        map[string]Catalog `json:"catalogs"`
+
+	Favicon       string              `json:"favicon"`
+	RobotsTxt     string              `json:"robots-txt"`
+	StatusHeaders bool                `json:"status-headers"`
+	WarningBanner WarningBannerConfig `json:"warning-banner"`
+	ErrorPages    ErrorPagesConfig    `json:"error-pages"`
+
+	MaxExtensionPerDay  Duration `json:"max-extension-per-day"`
+	MaxExtensionPerUser Duration `json:"max-extension-per-user"`
+
+	// Wildcard and regular expression vhosts, compiled by Validate
+	vhostPatterns []vhostPattern
+
+	// The trusted-proxies, parsed by Validate
+	trustedNetworks []*net.IPNet
 }
 
 // AutoScalingConfig list of terminate/stop AWS ASG
 type AutoScalingConfig struct {
 	Terminate map[string]int64 `json:"terminate"`
 	Stop      []string         `json:"stop"`
+	WarmPool  map[string]int64 `json:"warm-pool"`
+
+	// Policy overrides how a group in Terminate is powered down
+	Policy map[string]string `json:"policy"`
+
+	// How each group is powered down, instead of terminate, stop and
+	// policy
+	Groups map[string]GroupPolicy `json:"groups"`
+
+	PinLaunchTemplates bool `json:"pin-launch-templates"`
+}
+
+// Autoscaling group power down policies
+const (
+	PolicyTerminate = "terminate"
+	PolicyStop      = "stop"
+	PolicySuspend   = "suspend"
+)
+
+// TerminateGroups - the groups scaled to zero when powered down, with their
+// largest size
+func (c *AutoScalingConfig) TerminateGroups() map[string]int64 {
+	groups := make(map[string]int64)
+	for groupName, policy := range c.policies() {
+		if policy.Action == PolicyTerminate {
+			groups[groupName] = policy.MaxSize
+		}
+	}
+	return groups
 }
 
-// Duration helper type to parse duration from json
+// StopGroups - the groups that keep their instances, which are stopped when
+// powered down. Stopped instances keep their ENIs and private IPs.
+func (c *AutoScalingConfig) StopGroups() []string {
+	groups := append([]string{}, c.Stop...)
+	var extra []string
+	for groupName, policy := range c.policies() {
+		if policy.Action == PolicyStop && !contains(c.Stop, groupName) {
+			extra = append(extra, groupName)
+		}
+	}
+	sort.Strings(extra)
+	return append(groups, extra...)
+}
+
+// Duration helper type to parse duration from json. Durations are strings
+// like "45m", "2h30m" or "7d".
 type Duration time.Duration
 
 // UnmarshalText - unmarshal duration from JSON
 func (d *Duration) UnmarshalText(b []byte) error {
-	v, err := time.ParseDuration(string(b))
+	v, err := ParseDuration(string(b))
 	if err != nil {
 		return err
 	}
@@ -40,16 +171,102 @@ func (d *Duration) UnmarshalText(b []byte) error {
 	return nil
 }
 
-// ReadConfig - read config file from a file
+// UnmarshalJSON - a duration string. Plain numbers are refused, as they'd
+// be taken as nanoseconds.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] != '"' {
+		return fmt.Errorf("Duration %s needs a unit, e.g. \"%ss\" or \"%sm\"", b, b, b)
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.UnmarshalText([]byte(s))
+}
+
+// MarshalText - the duration as a string, e.g. "2h30m0s"
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// ParseDuration - time.ParseDuration, with days as well, e.g. "7d" or
+// "1d12h"
+func ParseDuration(s string) (time.Duration, error) {
+	var days time.Duration
+	if i := strings.Index(s, "d"); i > 0 {
+		n, err := strconv.Atoi(s[:i])
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("Invalid duration %q", s)
+		}
+		days = time.Duration(n) * 24 * time.Hour
+		if s = s[i+1:]; s == "" {
+			return days, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	return days + d, nil
+}
+
+// durationLimit - the range of a timing setting. Anything shorter than the
+// minimum is most likely missing its unit. Zero is unlimited.
+type durationLimit struct {
+	name     string
+	value    Duration
+	min, max time.Duration
+}
+
+func (c *Config) durationLimits() []durationLimit {
+	limits := []durationLimit{
+		{"idle-timeout", c.IdleTimeout, time.Minute, 0},
+		{"healthcheck-interval", c.HcInterval, time.Second, 0},
+		{"healthcheck-transition-interval", c.HcTransition, time.Second, 0},
+		{"poll-interval", c.PollInterval, 100 * time.Millisecond, time.Minute},
+		{"idle-check-interval", c.IdleInterval, time.Second, 0},
+		{"max-lifetime", c.MaxLifetime, time.Minute, 0},
+		{"history-max-age", c.HistoryMaxAge, time.Hour, 0},
+		{"max-extension-per-day", c.MaxExtensionPerDay, time.Minute, 0},
+		{"max-extension-per-user", c.MaxExtensionPerUser, time.Minute, 0},
+	}
+	for _, w := range c.IdleTimeouts {
+		limits = append(limits, durationLimit{"idle-timeouts timeout", w.Timeout, time.Minute, 0})
+	}
+	return limits
+}
+
+// validateDurations - check the timing settings are in range, once the
+// defaults are filled in
+func (c *Config) validateDurations() error {
+	for _, limit := range c.durationLimits() {
+		d := time.Duration(limit.value)
+		switch {
+		case d < 0:
+			return fmt.Errorf("%s can't be negative, got %v", limit.name, d)
+		case d > 0 && d < limit.min:
+			return fmt.Errorf("%s of %v is too short, the minimum is %v", limit.name, d, limit.min)
+		case limit.max > 0 && d > limit.max:
+			return fmt.Errorf("%s of %v is too long, the maximum is %v", limit.name, d, limit.max)
+		}
+	}
+	return nil
+}
+
+// ReadConfig - read config file from a file, with the base policies it
+// extends
 func ReadConfig(filename string) (*Config, error) {
-	fd, err := os.Open(filename)
+	merged, err := readConfigJSON(filename, nil)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := json.Marshal(merged)
 	if err != nil {
 		return nil, err
 	}
-	defer fd.Close()
 
 	cfg := &Config{}
-	if err = cfg.Parse(fd); err != nil {
+	if err = cfg.Parse(bytes.NewReader(buf)); err != nil {
 		return nil, err
 	}
 
@@ -67,7 +284,12 @@ func (c *Config) Parse(rd io.Reader) error {
 		return fmt.Errorf("Could not decode json: %v", err)
 	}
 
-	err = c.Validate()
+	// With pools, the top-level settings are only their defaults
+	if len(c.Pools) > 0 {
+		err = c.parsePools(in)
+	} else {
+		err = c.Validate()
+	}
 	if err != nil {
 		return fmt.Errorf("Invalid configuration: %v", err)
 	}
@@ -83,18 +305,325 @@ func (c *Config) AwsInstances() []*string {
 	return awsIds
 }
 
+// Observed - true for an instance or autoscaling group that is health
+// checked, but never started or stopped
+func (c *Config) Observed(name string) bool {
+	return contains(c.ObserveOnly, name)
+}
+
+// controlledInstances - the instances that are started and stopped
+func (c *Config) controlledInstances() []string {
+	var ids []string
+	for _, id := range c.Instances {
+		if !c.Observed(id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// uncontrolled - true for an instance that may be running while this
+// environment is stopped
+func (c *Config) uncontrolled(id string) bool {
+	_, downsize := c.Downsize.InstanceTypes[id]
+	return c.Observed(id) || downsize || contains(c.Shared.Instances, id) || contains(c.WarmStandby.Instances, id)
+}
+
+// stopInstanceIds - the instances stopped when powering down
+func (c *Config) stopInstanceIds() []string {
+	var ids []string
+	for _, id := range c.Instances {
+		if !c.uncontrolled(id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// configured - true if the name is a configured instance, autoscaling group,
+// RDS database, ECS service, Kubernetes workload or exec resource
+func (c *Config) configured(name string) bool {
+	if c.AutoScaling.managed(name) || contains(c.Instances, name) || c.RDS.configured(name) || c.Kubernetes.configured(name) {
+		return true
+	}
+	for _, s := range c.ECS {
+		if s.Name() == name {
+			return true
+		}
+	}
+	for _, r := range c.Exec {
+		if r.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 // EndpointURL get endpoint URL as an URL type
 func (c *Config) EndpointURL() (*url.URL, error) {
 	return url.Parse(c.Endpoint)
 }
 
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 // Validate config content
 func (c *Config) Validate() error {
-	if len(c.Instances) == 0 && len(c.AutoScaling.Stop) == 0 && len(c.AutoScaling.Terminate) == 0 {
-		return fmt.Errorf("No instances or asg configured")
+	if len(c.Instances) == 0 && len(c.AutoScaling.groupNames()) == 0 && len(c.Exec) == 0 &&
+		len(c.RDS.Instances) == 0 && len(c.RDS.Clusters) == 0 && len(c.ECS) == 0 && len(c.Kubernetes.Workloads) == 0 {
+		return fmt.Errorf("No instances, asg, rds, ecs, kubernetes or exec resources configured")
+	}
+
+	if err := c.RDS.Validate(); err != nil {
+		return err
+	}
+
+	if err := validateECS(c.ECS); err != nil {
+		return err
+	}
+
+	if err := c.Kubernetes.Validate(); err != nil {
+		return err
+	}
+
+	for groupName := range c.AutoScaling.WarmPool {
+		_, terminate := c.AutoScaling.Terminate[groupName]
+		if terminate || contains(c.AutoScaling.Stop, groupName) {
+			return fmt.Errorf("Autoscaling group %s configured more than once", groupName)
+		}
 	}
 
-	if len(c.Endpoint) == 0 {
+	for groupName, policy := range c.AutoScaling.Policy {
+		switch policy {
+		case PolicyTerminate, PolicyStop:
+		default:
+			return fmt.Errorf("Unknown policy %q for autoscaling group %s", policy, groupName)
+		}
+		if _, ok := c.AutoScaling.Terminate[groupName]; !ok {
+			return fmt.Errorf("Policy configured for autoscaling group %s, which isn't in terminate", groupName)
+		}
+	}
+
+	if err := c.AutoScaling.validatePolicies(); err != nil {
+		return err
+	}
+
+	for _, name := range c.ObserveOnly {
+		if !c.configured(name) {
+			return fmt.Errorf("Observe only resource %s isn't a configured instance, autoscaling group, RDS database, ECS service, Kubernetes workload or exec resource", name)
+		}
+	}
+
+	if err := c.Shared.Validate(c.Instances); err != nil {
+		return err
+	}
+
+	if err := c.WakeDNS.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Listen.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.WarmStandby.Validate(c); err != nil {
+		return err
+	}
+
+	if err := c.Downsize.Validate(c.Instances); err != nil {
+		return err
+	}
+
+	for i := range c.IdleTimeouts {
+		if err := c.IdleTimeouts[i].Validate(); err != nil {
+			return err
+		}
+	}
+
+	for i := range c.Blackouts {
+		if err := c.Blackouts[i].Validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := c.GPU.Validate(c.Instances); err != nil {
+		return err
+	}
+
+	if c.DefaultLanguage != "" && !c.hasLanguage(c.DefaultLanguage) {
+		return fmt.Errorf("No catalog for language %s", c.DefaultLanguage)
+	}
+
+	if err := c.Chaos.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.ErrorPages.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.StopConfirmation.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.RampUp.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.StartupLimit.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Clients.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.ProxyErrors.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.ProxyTimeout.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Recovery.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.AppHealth.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.HealthRules.Validate(); err != nil {
+		return err
+	}
+	for name := range c.HealthRules.Weights {
+		if !c.configured(name) {
+			return fmt.Errorf("Health weight for %s, which isn't a configured instance, autoscaling group, RDS database, ECS service, Kubernetes workload or exec resource", name)
+		}
+	}
+
+	if err := c.Parked.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Diagnostics.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Readiness.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Monitoring.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.InstanceScheduler.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Drain.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Calendar.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Schedule.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Middleware.Validate(); err != nil {
+		return err
+	}
+
+	c.trustedNetworks = nil
+	for _, proxy := range c.TrustedProxies {
+		network, err := parseNetwork(proxy)
+		if err != nil {
+			return err
+		}
+		c.trustedNetworks = append(c.trustedNetworks, network)
+	}
+
+	if err := c.Anomalies.Validate(c.HistoryFile); err != nil {
+		return err
+	}
+
+	if err := c.ColdStartSLO.Validate(c.HistoryFile); err != nil {
+		return err
+	}
+
+	if err := c.Mirror.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.WebhookReplay.Validate(); err != nil {
+		return err
+	}
+
+	if err := validateExec(c.Exec); err != nil {
+		return err
+	}
+
+	if err := c.ShortLinks.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Maintenance.Validate(); err != nil {
+		return err
+	}
+
+	hooks := make(map[string]bool)
+	for i := range c.WakeHooks {
+		if err := c.WakeHooks[i].Validate(); err != nil {
+			return err
+		}
+		if hooks[c.WakeHooks[i].Name] {
+			return fmt.Errorf("Duplicate wake hook %s", c.WakeHooks[i].Name)
+		}
+		hooks[c.WakeHooks[i].Name] = true
+	}
+
+	if err := c.RequestID.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.AWS.Validate(); err != nil {
+		return err
+	}
+
+	patterns, err := compileVhosts(c.Vhosts)
+	if err != nil {
+		return err
+	}
+	c.vhostPatterns = patterns
+
+	if c.Idle.Type != "" {
+		if err := c.Idle.Validate(); err != nil {
+			return err
+		}
+	}
+
+	for id := range c.InstanceDelays {
+		if !contains(c.Instances, id) {
+			return fmt.Errorf("Delay configured for unknown instance %s", id)
+		}
+	}
+
+	if err := c.Backend.Validate(); err != nil {
+		return err
+	}
+
+	if len(c.Endpoint) == 0 && !c.Backend.Enabled() {
 		return fmt.Errorf("No endpoint configured")
 	}
 
@@ -106,6 +635,59 @@ func (c *Config) Validate() error {
 		c.IdleTimeout = Duration(3 * time.Hour)
 	}
 
+	if c.HcTransition <= 0 {
+		c.HcTransition = Duration(5 * time.Second)
+	}
+	if c.HcTransition > c.HcInterval {
+		c.HcTransition = c.HcInterval
+	}
+
+	if c.PollInterval <= 0 {
+		c.PollInterval = Duration(SpinINTERVAL)
+	}
+
+	if c.IdleInterval <= 0 {
+		c.IdleInterval = c.HcInterval
+	}
+
+	if err := c.validateDurations(); err != nil {
+		return err
+	}
+
+	if c.Jitter < 0 || c.Jitter >= 1 {
+		return fmt.Errorf("Jitter must be at least 0 and less than 1, got %v", c.Jitter)
+	}
+
+	seen := make(map[Secret]string)
+	for team, tokens := range c.APITokens {
+		for _, token := range tokens {
+			if token == "" {
+				return fmt.Errorf("Empty API token for team %s", team)
+			}
+			if other, ok := seen[token]; ok && other != team {
+				return fmt.Errorf("API token shared by teams %s and %s", other, team)
+			}
+			seen[token] = team
+		}
+	}
+
+	if err := c.CORS.Validate(); err != nil {
+		return err
+	}
+
+	if c.WarningBanner.Enabled {
+		if c.WarningBanner.WarnBefore <= 0 {
+			c.WarningBanner.WarnBefore = Duration(5 * time.Minute)
+		}
+		if c.WarningBanner.Extend <= 0 {
+			c.WarningBanner.Extend = Duration(time.Hour)
+		}
+	}
+
+	if err := c.StateStore.Validate(); err != nil {
+		return err
+	}
+
 	if c.Region == "" {
 		c.Region = "ap-southeast-2"
 	}
@@ -2,6 +2,12 @@ package flywheel
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -100,6 +106,14 @@ func TestDefaultValuesConfig(t *testing.T) {
 		t.Errorf("Expexted idle-timeout 30s, but got %v", c.HcInterval)
 	}
 
+	if c.PollInterval != Duration(time.Second) {
+		t.Errorf("Expected poll-interval 1s, but got %v", c.PollInterval)
+	}
+
+	if c.IdleInterval != c.HcInterval {
+		t.Errorf("Expected idle-check-interval %v, but got %v", c.HcInterval, c.IdleInterval)
+	}
+
 }
 
 // Missing instances and autoscaling groups
@@ -122,3 +136,437 @@ func TestMissingEndpointConfig(t *testing.T) {
 	}
 
 }
+
+var configTenancyJSON = `
+{
+  "endpoint": "dev.example.com",
+  "instances": ["i-deadbeef"],
+  "team": "payments",
+  "api-tokens": {
+    "payments": ["pay-token"],
+    "search": ["search-token"]
+  }
+}
+`
+
+func TestTenancyConfig(t *testing.T) {
+	c := &Config{}
+
+	if err := c.Parse(bytes.NewBufferString(configTenancyJSON)); err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+
+	testTable := []struct {
+		token  string
+		access int
+	}{
+		{"pay-token", AccessGranted},
+		{"search-token", AccessHidden},
+		{"bogus", AccessDenied},
+		{"", AccessDenied},
+	}
+
+	for _, tt := range testTable {
+		if access := c.Authorize(tt.token); access != tt.access {
+			t.Errorf("Expected access %d for token %q, but got %d", tt.access, tt.token, access)
+		}
+	}
+
+	buf, err := json.Marshal(c)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	if bytes.Contains(buf, []byte("pay-token")) {
+		t.Errorf("Expected API tokens to be hidden, but got %s", buf)
+	}
+}
+
+func TestStartStages(t *testing.T) {
+	c := &Config{
+		Instances: []string{"i-nfs", "i-cache", "i-app1", "i-app2"},
+		InstanceDelays: map[string]Duration{
+			"i-app1": Duration(time.Minute),
+		},
+	}
+
+	stages := c.startStages()
+	if len(stages) != 2 {
+		t.Fatalf("Expected 2 stages, but got %v", stages)
+	}
+	if stages[0].delay != 0 || len(stages[0].instances) != 2 || stages[0].instances[1] != "i-cache" {
+		t.Errorf("Expected first stage with i-nfs and i-cache, but got %v", stages[0])
+	}
+	if stages[1].delay != time.Minute || len(stages[1].instances) != 2 || stages[1].instances[0] != "i-app1" {
+		t.Errorf("Expected second stage with i-app1 and i-app2 after 1m, but got %v", stages[1])
+	}
+}
+
+func TestAutoScalingPolicy(t *testing.T) {
+	c := &Config{
+		Endpoint: "10.0.0.1:80",
+		AutoScaling: AutoScalingConfig{
+			Terminate: map[string]int64{"web": 2, "legacy": 1},
+			Stop:      []string{"worker"},
+			Policy:    map[string]string{"legacy": PolicyStop},
+		},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Expected valid config but got %v", err)
+	}
+
+	terminate := c.AutoScaling.TerminateGroups()
+	if len(terminate) != 1 || terminate["web"] != 2 {
+		t.Errorf("Expected only web to be terminated, but got %v", terminate)
+	}
+	stop := c.AutoScaling.StopGroups()
+	if len(stop) != 2 || stop[0] != "worker" || stop[1] != "legacy" {
+		t.Errorf("Expected worker and legacy to be stopped, but got %v", stop)
+	}
+	// Groups in stop keep only ReplaceUnhealthy suspended, the policy opts
+	// in to the others that act on stopped instances
+	policies := c.AutoScaling.policies()
+	if suspended := policies["worker"].suspended(); fmt.Sprint(suspended) != "[ReplaceUnhealthy]" {
+		t.Errorf("Expected only ReplaceUnhealthy suspended for worker, but got %v", suspended)
+	}
+	if suspended := policies["legacy"].suspended(); !contains(suspended, "AZRebalance") || !contains(suspended, "ReplaceUnhealthy") {
+		t.Errorf("Expected AZRebalance and ReplaceUnhealthy suspended for legacy, but got %v", suspended)
+	}
+
+	for _, policy := range []map[string]string{
+		{"legacy": "suspend"},
+		{"worker": PolicyStop},
+	} {
+		c.AutoScaling.Policy = policy
+		if err := c.Validate(); err == nil {
+			t.Errorf("Expected an error for policy %v", policy)
+		}
+	}
+}
+
+func TestObserveOnly(t *testing.T) {
+	c := &Config{
+		Endpoint:    "10.0.0.1:80",
+		Instances:   []string{"i-db", "i-app"},
+		ObserveOnly: []string{"i-db"},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Expected valid config but got %v", err)
+	}
+
+	ids := c.controlledInstances()
+	if len(ids) != 1 || ids[0] != "i-app" {
+		t.Errorf("Expected only i-app to be controlled, but got %v", ids)
+	}
+	stages := c.startStages()
+	if len(stages) != 1 || len(stages[0].instances) != 1 {
+		t.Errorf("Expected i-db not to be started, but got %v", stages)
+	}
+
+	c.ObserveOnly = []string{"i-other"}
+	if err := c.Validate(); err == nil {
+		t.Errorf("Expected an error for an unknown observe only resource")
+	}
+}
+
+func TestSharedConfig(t *testing.T) {
+	instances := []string{"i-bastion", "i-app"}
+	tests := []struct {
+		shared SharedConfig
+		valid  bool
+	}{
+		{SharedConfig{}, true},
+		{SharedConfig{Holder: "a", Instances: []string{"i-bastion"}, Directory: "/mnt/refs"}, true},
+		{SharedConfig{Holder: "a", Instances: []string{"i-bastion"}, Redis: &RedisStateConfig{Address: "redis:6379"}}, true},
+		{SharedConfig{Instances: []string{"i-bastion"}, Directory: "/mnt/refs"}, false},
+		{SharedConfig{Holder: "a", Instances: []string{"i-bastion"}}, false},
+		{SharedConfig{Holder: "a", Instances: []string{"i-other"}, Directory: "/mnt/refs"}, false},
+	}
+	for i, test := range tests {
+		err := test.shared.Validate(instances)
+		if (err == nil) != test.valid {
+			t.Errorf("Test %d: Expected valid=%v but got %v", i, test.valid, err)
+		}
+	}
+}
+
+func TestWarmStandby(t *testing.T) {
+	c := &Config{
+		Endpoint:    "10.0.0.1:80",
+		Instances:   []string{"i-small", "i-app"},
+		AutoScaling: AutoScalingConfig{Terminate: map[string]int64{"web": 4}},
+		WarmStandby: WarmStandbyConfig{
+			Instances:   []string{"i-small"},
+			AutoScaling: map[string]int64{"web": 1},
+			Endpoint:    "10.0.0.9:80",
+		},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Expected valid config but got %v", err)
+	}
+	ids := c.stopInstanceIds()
+	if len(ids) != 1 || ids[0] != "i-app" {
+		t.Errorf("Expected only i-app to be stopped, but got %v", ids)
+	}
+
+	c.WarmStandby.AutoScaling["web"] = 4
+	if err := c.Validate(); err == nil {
+		t.Errorf("Expected an error for a standby as large as the group")
+	}
+	c.WarmStandby = WarmStandbyConfig{Instances: []string{"i-small"}}
+	if err := c.Validate(); err == nil {
+		t.Errorf("Expected an error for a standby without endpoint")
+	}
+}
+
+func TestDownsizeOffPeak(t *testing.T) {
+	c := DownsizeConfig{
+		InstanceTypes: map[string]string{"i-app": "t3.small"},
+		From:          "19:00",
+		To:            "07:00",
+		Timezone:      "UTC",
+	}
+	if err := c.Validate([]string{"i-app"}); err != nil {
+		t.Fatalf("Expected valid config but got %v", err)
+	}
+
+	tests := []struct {
+		clock   string
+		offPeak bool
+	}{
+		{"18:59", false},
+		{"19:00", true},
+		{"23:30", true},
+		{"03:00", true},
+		{"07:00", false},
+		{"12:00", false},
+	}
+	for _, test := range tests {
+		now, _ := time.Parse("2006-01-02 15:04", "2026-10-15 "+test.clock)
+		if c.OffPeak(now) != test.offPeak {
+			t.Errorf("Expected off-peak %v at %s", test.offPeak, test.clock)
+		}
+	}
+
+	if err := c.Validate([]string{"i-other"}); err == nil {
+		t.Errorf("Expected an error for an unknown instance")
+	}
+}
+
+func TestGPUConfig(t *testing.T) {
+	c := GPUConfig{Instances: []string{"i-gpu"}}
+	if err := c.Validate([]string{"i-gpu"}); err != nil {
+		t.Fatalf("Expected valid config but got %v", err)
+	}
+	if c.Namespace != "CWAgent" || c.Metric != "nvidia_smi_utilization_gpu" || c.Threshold != 10 {
+		t.Errorf("Expected CloudWatch agent defaults but got %+v", c)
+	}
+	if err := c.Validate([]string{"i-other"}); err == nil {
+		t.Errorf("Expected an error for an unknown instance")
+	}
+}
+
+func TestVhostPatterns(t *testing.T) {
+	c := &Config{
+		Endpoint: "dev.example.com",
+		Vhosts: map[string]string{
+			"www.example.com":                 "www.backend",
+			"*.dev.example.com":               "$1.backend:8080",
+			"api.*.dev.example.com":           "$1-api.backend",
+			`~^(?P<app>[a-z]+)-(?P<pr>\d+)\.`: "${app}.pr-${pr}.backend",
+		},
+	}
+	patterns, err := compileVhosts(c.Vhosts)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	c.vhostPatterns = patterns
+	fw := &Flywheel{config: c}
+
+	tests := []struct {
+		host, endpoint string
+	}{
+		{"www.example.com", "www.backend"},
+		{"feature-x.dev.example.com", "feature-x.backend:8080"},
+		{"feature-x.dev.example.com:8443", "feature-x.backend:8080"},
+		{"FEATURE-X.dev.example.com", "FEATURE-X.backend:8080"},
+		{"api.feature-x.dev.example.com", "feature-x-api.backend"},
+		{"a.b.dev.example.com", "dev.example.com"},
+		{"shop-42.example.org", "shop.pr-42.backend"},
+		{"other.example.com", "dev.example.com"},
+	}
+	for _, test := range tests {
+		if endpoint := fw.ProxyEndpoint(test.host); endpoint != test.endpoint {
+			t.Errorf("Expected %s for %s, but got %s", test.endpoint, test.host, endpoint)
+		}
+	}
+
+	if _, err := compileVhosts(map[string]string{"~(": "x"}); err == nil {
+		t.Errorf("Expected an error for an invalid pattern")
+	}
+}
+
+func TestDurations(t *testing.T) {
+	tests := []struct {
+		json     string
+		expected time.Duration
+		ok       bool
+	}{
+		{`"45m"`, 45 * time.Minute, true},
+		{`"2h30m"`, 150 * time.Minute, true},
+		{`"7d"`, 7 * 24 * time.Hour, true},
+		{`"1d12h"`, 36 * time.Hour, true},
+		{`45`, 0, false},
+		{`"45"`, 0, false},
+		{`"xd"`, 0, false},
+	}
+	for _, test := range tests {
+		var d Duration
+		err := json.Unmarshal([]byte(test.json), &d)
+		if (err == nil) != test.ok || time.Duration(d) != test.expected {
+			t.Errorf("Expected %v for %s, but got %v, %v", test.expected, test.json, time.Duration(d), err)
+		}
+	}
+
+	buf, _ := json.Marshal(struct {
+		D Duration `json:"d"`
+	}{Duration(150 * time.Minute)})
+	if string(buf) != `{"d":"2h30m0s"}` {
+		t.Errorf("Expected a duration string, but got %s", buf)
+	}
+
+	c := &Config{
+		Endpoint:    "dev.example.com",
+		Instances:   []string{"i-1"},
+		IdleTimeout: Duration(45 * time.Second),
+	}
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "idle-timeout") {
+		t.Errorf("Expected an idle-timeout error, but got %v", err)
+	}
+}
+
+func TestMonitoring(t *testing.T) {
+	c := &Config{
+		Endpoint:    "dev.example.com",
+		Team:        "payments",
+		MaxLifetime: Duration(8 * time.Hour),
+		Monitoring:  MonitoringConfig{Selector: `instance="dev:9100"`},
+	}
+	c.Monitoring.Validate()
+
+	rules := string(c.PrometheusRules())
+	for _, expected := range []string{
+		`name: "flywheel-payments"`,
+		`alert: FlywheelUnhealthy`,
+		`expr: "flywheel_status{status=\"UNHEALTHY\", instance=\"dev:9100\"} == 1"`,
+		`for: 5m`,
+		`alert: FlywheelStuckStarting`,
+		`for: 15m`,
+		`> 600"`,
+		`alert: FlywheelMaxLifetimeExceeded`,
+		`> 28800"`,
+		`environment: "payments"`,
+		`team: "payments"`,
+	} {
+		if !strings.Contains(rules, expected) {
+			t.Errorf("Expected %s in the rules but got %s", expected, rules)
+		}
+	}
+
+	buf, err := c.GrafanaDashboard()
+	if err != nil {
+		t.Fatalf("Expected a dashboard but got %v", err)
+	}
+	var dashboard struct {
+		Title  string `json:"title"`
+		UID    string `json:"uid"`
+		Panels []struct {
+			Targets []struct {
+				Expr string `json:"expr"`
+			} `json:"targets"`
+		} `json:"panels"`
+	}
+	if err := json.Unmarshal(buf, &dashboard); err != nil {
+		t.Fatalf("Expected dashboard JSON but got %v", err)
+	}
+	if dashboard.Title != "Flywheel - payments" || dashboard.UID != "flywheel-payments" || len(dashboard.Panels) != 4 {
+		t.Errorf("Expected the payments dashboard but got %+v", dashboard)
+	}
+	if expr := dashboard.Panels[0].Targets[0].Expr; !strings.Contains(expr, `instance="dev:9100"`) {
+		t.Errorf("Expected the selector in %s", expr)
+	}
+
+	c.MaxLifetime = 0
+	c.Monitoring.Environment = "staging eu"
+	if rules := string(c.PrometheusRules()); strings.Contains(rules, "FlywheelMaxLifetimeExceeded") || !strings.Contains(rules, `environment: "staging eu"`) {
+		t.Errorf("Expected staging eu rules without a lifetime alert but got %s", rules)
+	}
+	if uid := dashboardUID("staging eu"); uid != "flywheel-staging-eu" {
+		t.Errorf("Expected flywheel-staging-eu but got %s", uid)
+	}
+}
+
+func TestConfigExtends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flywheel-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) string {
+		filename := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(filename), 0755)
+		if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+
+	write("policies/standard.json", `{
+		"idle-timeout": "2h",
+		"max-lifetime": "12h",
+		"notify": {"webhook": "https://hooks.example.com/flywheel", "digest-interval": "24h"},
+		"owner": {"team": "platform"}
+	}`)
+	write("policies/business-hours.json", `{
+		"extends": "standard.json",
+		"idle-timeout": "1h",
+		"downsize": {"from": "19:00", "to": "07:00"}
+	}`)
+	staging := write("staging.json", `{
+		"extends": "policies/business-hours.json",
+		"endpoint": "staging.example.com",
+		"instances": ["i-staging"],
+		"notify": {"digest-interval": "12h"},
+		"max-lifetime": null
+	}`)
+
+	c, err := ReadConfig(staging)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	if time.Duration(c.IdleTimeout) != time.Hour || c.MaxLifetime != 0 || c.Owner.Team != "platform" {
+		t.Errorf("Expected the policy with overrides, but got idle-timeout %v, max-lifetime %v, team %s",
+			time.Duration(c.IdleTimeout), time.Duration(c.MaxLifetime), c.Owner.Team)
+	}
+	if c.Notify.Webhook != "https://hooks.example.com/flywheel" || time.Duration(c.Notify.DigestInterval) != 12*time.Hour {
+		t.Errorf("Expected the notify settings merged, but got %+v", c.Notify)
+	}
+	if c.Endpoint != "staging.example.com" || c.Downsize.From != "19:00" {
+		t.Errorf("Expected the environment's own settings, but got %+v", c)
+	}
+
+	tests := []struct {
+		name, config, err string
+	}{
+		{"loop.json", `{"extends": "loop.json", "endpoint": "x"}`, "extends itself"},
+		{"typo.json", `{"extends": "policies/typo.json", "endpoint": "x"}`, "unknown field"},
+		{"missing.json", `{"extends": "policies/missing.json", "endpoint": "x"}`, "no such file"},
+		{"list.json", `{"extends": [1], "endpoint": "x"}`, "Invalid extends"},
+	}
+	write("policies/typo.json", `{"idle-timout": "1h"}`)
+	for _, test := range tests {
+		_, err := ReadConfig(write(test.name, test.config))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Expected an error with %q for %s, but got %v", test.err, test.name, err)
+		}
+	}
+}
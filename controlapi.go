@@ -0,0 +1,147 @@
+package flywheel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// APIVersion - the version prefix of the API. The same endpoints are served
+// without it.
+const APIVersion = "v1"
+
+// apiStatus - the status, as the ?flywheel=status page has it
+func (handler *Handler) apiStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		handler.apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+		return
+	}
+	handler.writeJSON(w, http.StatusOK, handler.Flywheel.Snapshot())
+}
+
+// apiStart - start the environment. 202 while it's starting, 200 once it
+// has started.
+func (handler *Handler) apiStart(w http.ResponseWriter, r *http.Request) {
+	if !handler.apiPost(w, r) {
+		return
+	}
+	pong := handler.ping(Ping{requestStart: true, user: requestUser(r)})
+	if pong.Err != nil {
+		handler.apiError(w, http.StatusConflict, pong.Err)
+		return
+	}
+	code := http.StatusAccepted
+	if pong.Status == STARTED {
+		code = http.StatusOK
+	}
+	handler.writeJSON(w, code, pong)
+}
+
+// apiStop - stop the environment. Stops of stateful resources need
+// confirm, or a second stop by the same user.
+func (handler *Handler) apiStop(w http.ResponseWriter, r *http.Request) {
+	if !handler.apiPost(w, r) {
+		return
+	}
+	var req struct {
+		Confirm bool `json:"confirm"`
+	}
+	if !handler.apiRequest(w, r, &req, func() error {
+		req.Confirm = r.FormValue("confirm") == "true"
+		return nil
+	}) {
+		return
+	}
+
+	pong := handler.ping(Ping{requestStop: true, confirmed: req.Confirm, user: requestUser(r)})
+	if pong.Err == nil && pong.Status != STOPPING && pong.Status != STOPPED {
+		pong.Err = fmt.Errorf("Cannot stop while %s", pong.StatusName)
+	}
+	if pong.Err != nil {
+		handler.apiError(w, http.StatusConflict, pong.Err)
+		return
+	}
+	code := http.StatusAccepted
+	if pong.Status == STOPPED {
+		code = http.StatusOK
+	}
+	handler.writeJSON(w, code, pong)
+}
+
+// apiTimeout - set when the environment stops, in a duration from now or
+// at a time, like stop_in and stop_at
+func (handler *Handler) apiTimeout(w http.ResponseWriter, r *http.Request) {
+	if !handler.apiPost(w, r) {
+		return
+	}
+	var req struct {
+		Duration Duration `json:"duration"`
+		StopAt   string   `json:"stop-at"`
+	}
+	if !handler.apiRequest(w, r, &req, func() error {
+		req.StopAt = r.FormValue("stop-at")
+		if d := r.FormValue("duration"); d != "" {
+			return req.Duration.UnmarshalText([]byte(d))
+		}
+		return nil
+	}) {
+		return
+	}
+
+	sreq := Ping{setTimeout: time.Duration(req.Duration), user: requestUser(r)}
+	if req.StopAt != "" {
+		t, err := parseDeadline(req.StopAt, handler.Flywheel.now())
+		if err != nil {
+			handler.apiError(w, http.StatusBadRequest, err)
+			return
+		}
+		sreq.stopAt = t
+	}
+	if sreq.stopAt.IsZero() && sreq.setTimeout <= 0 {
+		handler.apiError(w, http.StatusBadRequest, fmt.Errorf("Expected a duration or stop-at"))
+		return
+	}
+
+	// Only a started environment has a stop time
+	pong := handler.ping(sreq)
+	if pong.Err == nil && pong.Status != STARTED {
+		pong.Err = fmt.Errorf("Cannot set the stop time while %s", pong.StatusName)
+	}
+	if pong.Err != nil {
+		handler.apiError(w, http.StatusConflict, pong.Err)
+		return
+	}
+	handler.writeJSON(w, http.StatusOK, pong)
+}
+
+// apiPost - only allow POST. False if the request was answered.
+func (handler *Handler) apiPost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		handler.apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+		return false
+	}
+	return true
+}
+
+// apiRequest - decode a JSON body into req, or read form values with form.
+// An empty body is no fields. False if the request was answered.
+func (handler *Handler) apiRequest(w http.ResponseWriter, r *http.Request, req interface{}, form func() error) bool {
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err = json.NewDecoder(r.Body).Decode(req); err == io.EOF {
+			err = nil
+		}
+	} else {
+		err = form()
+	}
+	if err != nil {
+		handler.apiError(w, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,130 @@
+package flywheel
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig - which browser origins may call the API, e.g. a developer
+// portal showing the status and start buttons
+type CORSConfig struct {
+	// Origins allowed, like https://portal.example.com. *.example.com
+	// allows the subdomains, * any origin.
+	Origins []string `json:"origins"`
+
+	// Methods allowed, default GET, HEAD and POST
+	Methods []string `json:"methods"`
+
+	// Request headers allowed, default Authorization and Content-Type
+	Headers []string `json:"headers"`
+
+	// Allow cookies and HTTP authentication. Not with any origin.
+	Credentials bool `json:"credentials"`
+
+	// How long browsers cache a preflight, default 10m
+	MaxAge Duration `json:"max-age"`
+}
+
+// Enabled - true if any origin is allowed
+func (c *CORSConfig) Enabled() bool {
+	return len(c.Origins) > 0
+}
+
+// Validate - check the origins, and fill in the defaults
+func (c *CORSConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	for _, origin := range c.Origins {
+		if origin == "*" {
+			if c.Credentials {
+				return fmt.Errorf("CORS credentials can't be allowed for any origin")
+			}
+			continue
+		}
+		u, err := url.Parse(strings.Replace(origin, "*.", "", 1))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return fmt.Errorf("Invalid CORS origin %q, expected a scheme and host like https://portal.example.com", origin)
+		}
+	}
+	if len(c.Methods) == 0 {
+		c.Methods = []string{"GET", "HEAD", "POST"}
+	}
+	for i, method := range c.Methods {
+		c.Methods[i] = strings.ToUpper(method)
+	}
+	if len(c.Headers) == 0 {
+		c.Headers = []string{"Authorization", "Content-Type"}
+	}
+	if c.MaxAge <= 0 {
+		c.MaxAge = Duration(10 * time.Minute)
+	}
+	return nil
+}
+
+// allowed - true if the origin may call the API
+func (c *CORSConfig) allowed(origin string) bool {
+	for _, allowed := range c.Origins {
+		allowed = strings.TrimSuffix(allowed, "/")
+		switch {
+		case allowed == "*", strings.EqualFold(allowed, origin):
+			return true
+		case strings.Contains(allowed, "://*."):
+			// The scheme has to match, then any subdomain
+			parts := strings.SplitN(allowed, "://*.", 2)
+			prefix, domain := parts[0]+"://", "."+parts[1]
+			if strings.HasPrefix(origin, prefix) && len(origin) > len(prefix)+len(domain) &&
+				strings.HasSuffix(strings.ToLower(origin), strings.ToLower(domain)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cors - add the CORS headers for the origin of the request, and answer
+// preflights. False if the request was answered.
+func (handler *Handler) cors(w http.ResponseWriter, r *http.Request) bool {
+	c := &handler.Flywheel.config.CORS
+	origin := r.Header.Get("Origin")
+	if !c.Enabled() || origin == "" {
+		return true
+	}
+	w.Header().Add("Vary", "Origin")
+	preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+	if !c.allowed(origin) {
+		if preflight {
+			handler.apiError(w, http.StatusForbidden, fmt.Errorf("Origin %s not allowed", origin))
+			return false
+		}
+		// Answered without the headers, so the browser hides the response
+		return true
+	}
+
+	if contains(c.Origins, "*") {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.Credentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		return true
+	}
+
+	method := r.Header.Get("Access-Control-Request-Method")
+	if !contains(c.Methods, method) {
+		handler.apiError(w, http.StatusForbidden, fmt.Errorf("Method %s not allowed from %s", method, origin))
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(c.Methods, ", "))
+	w.Header().Set("Access-Control-Allow-Headers", strings.Join(c.Headers, ", "))
+	w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(time.Duration(c.MaxAge)/time.Second)))
+	w.WriteHeader(http.StatusNoContent)
+	return false
+}
@@ -0,0 +1,173 @@
+package flywheel
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// How many resources are described per AWS call
+const describeBatchSize = 100
+
+// described - the instances and groups as of the last health check. Only
+// the health check goroutine uses it, so later checks in the same round,
+// like the GPU probe, don't have to call AWS again.
+type described struct {
+	at        time.Time
+	instances map[string]*ec2.Instance
+	groups    map[string]*autoscaling.Group
+
+	// Configured groups that don't exist
+	missing []string
+}
+
+// describe - describe all the groups, then all the instances including
+// those of the stop groups, in as few calls as possible
+func (fw *Flywheel) describe() (*described, error) {
+	d := &described{
+		at:        fw.now(),
+		instances: make(map[string]*ec2.Instance),
+	}
+
+	var err error
+	groupNames := fw.config.AutoScaling.groupNames()
+	if d.groups, err = fw.describeGroups(groupNames); err != nil {
+		return nil, err
+	}
+	d.missing = missingGroups(groupNames, d.groups)
+
+	instanceIds := append([]string{}, fw.config.Instances...)
+	for _, name := range fw.config.AutoScaling.StopGroups() {
+		if group, ok := d.groups[name]; ok {
+			for _, instance := range group.Instances {
+				instanceIds = append(instanceIds, aws.StringValue(instance.InstanceId))
+			}
+		}
+	}
+	err = batches(instanceIds, func(ids []string) error {
+		return fw.ec2.DescribeInstancesPages(
+			&ec2.DescribeInstancesInput{
+				InstanceIds: aws.StringSlice(ids),
+			},
+			func(page *ec2.DescribeInstancesOutput, last bool) bool {
+				for _, reservation := range page.Reservations {
+					for _, instance := range reservation.Instances {
+						d.instances[aws.StringValue(instance.InstanceId)] = instance
+					}
+				}
+				return true
+			},
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// describeGroups - describe the groups in as few calls as possible. Groups
+// that don't exist are left out, instead of failing the call.
+func (fw *Flywheel) describeGroups(groupNames []string) (map[string]*autoscaling.Group, error) {
+	groups := make(map[string]*autoscaling.Group)
+	err := batches(groupNames, func(names []string) error {
+		return fw.autoscaling.DescribeAutoScalingGroupsPages(
+			&autoscaling.DescribeAutoScalingGroupsInput{
+				AutoScalingGroupNames: aws.StringSlice(names),
+			},
+			func(page *autoscaling.DescribeAutoScalingGroupsOutput, last bool) bool {
+				for _, group := range page.AutoScalingGroups {
+					groups[aws.StringValue(group.AutoScalingGroupName)] = group
+				}
+				return true
+			},
+		)
+	})
+	return groups, err
+}
+
+// describeConfigured - describe the groups, noting those that don't exist
+// as config errors instead of failing on them
+func (fw *Flywheel) describeConfigured(groupNames []string) (map[string]*autoscaling.Group, error) {
+	groups, err := fw.describeGroups(groupNames)
+	if err != nil {
+		return nil, err
+	}
+	fw.setMissingGroups(groupNames, missingGroups(groupNames, groups))
+	return groups, nil
+}
+
+// setMissingGroups - update the groups that don't exist, of those checked
+func (fw *Flywheel) setMissingGroups(checked, missing []string) {
+	all := append([]string{}, missing...)
+	for _, groupName := range fw.missingGroups {
+		if !contains(checked, groupName) {
+			all = append(all, groupName)
+		}
+	}
+	sort.Strings(all)
+	for _, groupName := range all {
+		if !contains(fw.missingGroups, groupName) {
+			fw.logf("Autoscaling group %s doesn't exist, skipping it", groupName)
+		}
+	}
+	for _, groupName := range fw.missingGroups {
+		if !contains(all, groupName) {
+			fw.logf("Autoscaling group %s exists again", groupName)
+		}
+	}
+	fw.missingGroups = all
+}
+
+// missing - true if the group didn't exist at the last describe
+func (fw *Flywheel) missing(groupName string) bool {
+	return contains(fw.missingGroups, groupName)
+}
+
+// configErrors - the config errors for the status
+func (fw *Flywheel) configErrors() []string {
+	var errs []string
+	for _, groupName := range fw.missingGroups {
+		errs = append(errs, fmt.Sprintf("Autoscaling group %s doesn't exist", groupName))
+	}
+	return errs
+}
+
+// missingGroups - the groups that weren't described, sorted
+func missingGroups(groupNames []string, groups map[string]*autoscaling.Group) []string {
+	var missing []string
+	for _, name := range groupNames {
+		if _, ok := groups[name]; !ok && !contains(missing, name) {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// batches - call fn with up to describeBatchSize distinct values at a time.
+// Nothing is called for no values, an empty list would describe everything.
+func batches(values []string, fn func([]string) error) error {
+	seen := make(map[string]bool)
+	var batch []string
+	for _, v := range values {
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+		batch = append(batch, v)
+		if len(batch) == describeBatchSize {
+			if err := fn(batch); err != nil {
+				return err
+			}
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		return fn(batch)
+	}
+	return nil
+}
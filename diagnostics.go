@@ -0,0 +1,227 @@
+package flywheel
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// How often diagnostics are collected again while a start is failing
+const diagnosticsRefresh = time.Minute
+
+// Diagnostics are collected for this many failing instances at most
+const diagnosticsMaxInstances = 10
+
+// DiagnosticsConfig - collect the console output and status checks of
+// instances that fail to boot, so users don't need the AWS console
+type DiagnosticsConfig struct {
+	// STARTING for longer than this counts as failing, default 10m
+	StartingAfter Duration `json:"starting-after"`
+
+	// Lines of console output kept per instance, default 50
+	Lines int `json:"lines"`
+}
+
+// Validate - fill in the defaults
+func (c *DiagnosticsConfig) Validate() error {
+	if c.StartingAfter <= 0 {
+		c.StartingAfter = Duration(10 * time.Minute)
+	}
+	if c.Lines <= 0 {
+		c.Lines = 50
+	}
+	return nil
+}
+
+// InstanceDiagnostics - why an instance may not have booted
+type InstanceDiagnostics struct {
+	InstanceID     string   `json:"instance-id"`
+	State          string   `json:"state"`
+	SystemStatus   string   `json:"system-status,omitempty"`
+	InstanceStatus string   `json:"instance-status,omitempty"`
+	Details        []string `json:"details,omitempty"`
+	ConsoleOutput  string   `json:"console-output,omitempty"`
+	Error          string   `json:"error,omitempty"`
+}
+
+// BootDiagnostics - the failing instances of a start
+type BootDiagnostics struct {
+	CollectedAt time.Time             `json:"collected-at"`
+	Reason      string                `json:"reason"`
+	Instances   []InstanceDiagnostics `json:"instances"`
+}
+
+// diagnosticsStore - the latest diagnostics. Written by the health check
+// goroutine, read by the API.
+type diagnosticsStore struct {
+	mu     sync.Mutex
+	latest *BootDiagnostics
+}
+
+func (s *diagnosticsStore) get() *BootDiagnostics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.latest
+}
+
+func (s *diagnosticsStore) set(d *BootDiagnostics) {
+	s.mu.Lock()
+	s.latest = d
+	s.mu.Unlock()
+}
+
+// diagnosticsReason - why the start looks like it failed, empty if it
+// doesn't
+func (c *DiagnosticsConfig) diagnosticsReason(pong Pong, now time.Time) string {
+	// Only while a start hasn't completed
+	if pong.LastStarted.IsZero() || pong.StartedAt.After(pong.LastStarted) {
+		return ""
+	}
+	starting := now.Sub(pong.LastStarted)
+	switch {
+	case pong.Status == UNHEALTHY:
+		return "UNHEALTHY while starting"
+	case pong.Status == STARTING && starting >= time.Duration(c.StartingAfter):
+		return fmt.Sprintf("STARTING for %v", starting.Truncate(time.Second))
+	}
+	return ""
+}
+
+// collectDiagnostics - collect the diagnostics of a failing start, at most
+// every diagnosticsRefresh. This runs in the health check goroutine, with
+// the instances it just described.
+func (fw *Flywheel) collectDiagnostics(d *described) {
+	if d == nil {
+		return
+	}
+	now := fw.now()
+	reason := fw.config.Diagnostics.diagnosticsReason(fw.Snapshot(), now)
+	if reason == "" {
+		return
+	}
+	if latest := fw.diagnostics.get(); latest != nil && now.Sub(latest.CollectedAt) < diagnosticsRefresh {
+		return
+	}
+
+	var ids []string
+	for id := range d.instances {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	statuses := make(map[string]*ec2.InstanceStatus)
+	err := batches(ids, func(batch []string) error {
+		return fw.ec2.DescribeInstanceStatusPages(
+			&ec2.DescribeInstanceStatusInput{
+				InstanceIds:         aws.StringSlice(batch),
+				IncludeAllInstances: aws.Bool(true),
+			},
+			func(page *ec2.DescribeInstanceStatusOutput, last bool) bool {
+				for _, status := range page.InstanceStatuses {
+					statuses[aws.StringValue(status.InstanceId)] = status
+				}
+				return true
+			},
+		)
+	})
+	if err != nil {
+		fw.logf("Unable to describe instance status for diagnostics: %v", err)
+	}
+
+	diagnostics := &BootDiagnostics{CollectedAt: now, Reason: reason}
+	for _, id := range ids {
+		diag := instanceDiagnostics(d.instances[id], statuses[id])
+		if diag.State == "running" && diag.SystemStatus == "ok" && diag.InstanceStatus == "ok" {
+			continue
+		}
+		if len(diagnostics.Instances) == diagnosticsMaxInstances {
+			break
+		}
+		output, err := fw.consoleOutput(id)
+		if err != nil {
+			diag.Error = err.Error()
+		}
+		diag.ConsoleOutput = output
+		diagnostics.Instances = append(diagnostics.Instances, diag)
+	}
+	fw.logf("Collected boot diagnostics of %d instances: %s", len(diagnostics.Instances), reason)
+	fw.diagnostics.set(diagnostics)
+}
+
+// instanceDiagnostics - the state and status checks of an instance
+func instanceDiagnostics(instance *ec2.Instance, status *ec2.InstanceStatus) InstanceDiagnostics {
+	diag := InstanceDiagnostics{InstanceID: aws.StringValue(instance.InstanceId)}
+	if instance.State != nil {
+		diag.State = aws.StringValue(instance.State.Name)
+	}
+	if instance.StateReason != nil {
+		diag.Details = append(diag.Details, aws.StringValue(instance.StateReason.Message))
+	}
+	if status == nil {
+		return diag
+	}
+	for _, summary := range []struct {
+		name    string
+		status  *ec2.InstanceStatusSummary
+		summary *string
+	}{
+		{"system", status.SystemStatus, &diag.SystemStatus},
+		{"instance", status.InstanceStatus, &diag.InstanceStatus},
+	} {
+		if summary.status == nil {
+			continue
+		}
+		*summary.summary = aws.StringValue(summary.status.Status)
+		for _, detail := range summary.status.Details {
+			if aws.StringValue(detail.Status) == "passed" {
+				continue
+			}
+			line := fmt.Sprintf("%s %s: %s", summary.name, aws.StringValue(detail.Name), aws.StringValue(detail.Status))
+			if detail.ImpairedSince != nil {
+				line += fmt.Sprintf(" since %v", detail.ImpairedSince.Format(time.RFC3339))
+			}
+			diag.Details = append(diag.Details, line)
+		}
+	}
+	return diag
+}
+
+// consoleOutput - the end of the instance's console output
+func (fw *Flywheel) consoleOutput(id string) (string, error) {
+	out, err := fw.ec2.GetConsoleOutput(&ec2.GetConsoleOutputInput{InstanceId: aws.String(id)})
+	if err != nil {
+		return "", err
+	}
+	return consoleTail(aws.StringValue(out.Output), fw.config.Diagnostics.Lines)
+}
+
+// consoleTail - the last lines of base64 encoded console output
+func consoleTail(output string, lines int) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(output)
+	if err != nil {
+		return "", err
+	}
+	text := strings.TrimRight(strings.Replace(string(decoded), "\r\n", "\n", -1), "\n")
+	all := strings.Split(text, "\n")
+	if len(all) > lines {
+		all = all[len(all)-lines:]
+	}
+	return strings.Join(all, "\n"), nil
+}
+
+// apiDiagnostics - the boot diagnostics of the last failing start
+func (handler *Handler) apiDiagnostics(w http.ResponseWriter, r *http.Request) {
+	diagnostics := handler.Flywheel.diagnostics.get()
+	if diagnostics == nil {
+		handler.apiError(w, http.StatusNotFound, fmt.Errorf("No failing start has been diagnosed"))
+		return
+	}
+	handler.writeJSON(w, http.StatusOK, diagnostics)
+}
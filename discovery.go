@@ -0,0 +1,276 @@
+package flywheel
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// Service discovery types
+const (
+	DiscoveryConsul   = "consul"
+	DiscoveryCloudMap = "cloud-map"
+)
+
+// How soon after the last lookup a proxy failure triggers another one
+const discoveryMinRefresh = 5 * time.Second
+
+// DiscoveryConfig - look up the backend in a service registry
+type DiscoveryConfig struct {
+	Type    string `json:"type"`
+	Service string `json:"service"`
+
+	// Consul agent, default http://127.0.0.1:8500
+	Address    string `json:"address"`
+	Token      Secret `json:"token"`
+	Tag        string `json:"tag"`
+	Datacenter string `json:"datacenter"`
+
+	// Cloud Map namespace
+	Namespace string `json:"namespace"`
+
+	// How often to look up the service again, default 30s. Proxy failures
+	// also trigger a lookup.
+	Interval Duration `json:"interval"`
+}
+
+// Enabled - true if the backend is discovered
+func (c *DiscoveryConfig) Enabled() bool {
+	return c.Type != ""
+}
+
+// Validate - check the registry settings and fill in the defaults
+func (c *DiscoveryConfig) Validate() error {
+	switch c.Type {
+	case "":
+		return nil
+	case DiscoveryConsul:
+		if c.Address == "" {
+			c.Address = "http://127.0.0.1:8500"
+		}
+	case DiscoveryCloudMap:
+		if c.Namespace == "" {
+			return fmt.Errorf("Cloud Map discovery needs a namespace")
+		}
+	default:
+		return fmt.Errorf("Unknown discovery type %s", c.Type)
+	}
+	if c.Service == "" {
+		return fmt.Errorf("No service to discover")
+	}
+	if c.Interval <= 0 {
+		c.Interval = Duration(30 * time.Second)
+	}
+	return nil
+}
+
+// Discovery - keeps the backend endpoint up to date from a service registry.
+// A nil Discovery knows no endpoint.
+type Discovery struct {
+	config   *DiscoveryConfig
+	lookup   func() ([]string, error)
+	client   *http.Client
+	cloudMap *client.Client
+	refresh  chan struct{}
+	clock    Clock
+
+	mu       sync.Mutex
+	endpoint string
+	lookedUp time.Time
+}
+
+// NewDiscovery - create the resolver, nil if not configured
+func NewDiscovery(config *DiscoveryConfig, sess *session.Session, clock Clock) *Discovery {
+	if !config.Enabled() {
+		return nil
+	}
+	d := &Discovery{
+		config:  config,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		refresh: make(chan struct{}, 1),
+		clock:   clock,
+	}
+	switch config.Type {
+	case DiscoveryConsul:
+		d.lookup = d.consul
+	case DiscoveryCloudMap:
+		d.cloudMap = newJSONClient(sess, "data-servicediscovery", "servicediscovery", "Route53AutoNaming_v20170314")
+		d.cloudMap.Handlers.AfterRetry.PushBackNamed(awsErrorHandler)
+		d.lookup = d.discoverInstances
+	}
+	return d
+}
+
+// Run - look up the service now, then every interval or after a proxy
+// failure
+func (d *Discovery) Run() {
+	interval := time.Duration(d.config.Interval)
+	timer := d.clock.NewTimer(0)
+	for {
+		select {
+		case <-timer.C():
+		case <-d.refresh:
+			timer.Stop()
+			d.mu.Lock()
+			wait := discoveryMinRefresh - d.clock.Now().Sub(d.lookedUp)
+			d.mu.Unlock()
+			sleep(d.clock, wait)
+		}
+		if err := d.Resolve(); err != nil {
+			log.Printf("Unable to discover %s: %v", d.config.Service, err)
+		}
+		timer.Reset(interval)
+	}
+}
+
+// Resolve - look up the service. The current endpoint is kept while it is
+// still registered, otherwise the first one is used.
+func (d *Discovery) Resolve() error {
+	endpoints, err := d.lookup()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lookedUp = d.clock.Now()
+	if err != nil {
+		return err
+	}
+	if len(endpoints) == 0 {
+		return fmt.Errorf("No healthy instances registered")
+	}
+	sort.Strings(endpoints)
+	if !contains(endpoints, d.endpoint) {
+		log.Printf("Discovered %s at %s", d.config.Service, endpoints[0])
+		d.endpoint = endpoints[0]
+	}
+	return nil
+}
+
+// Endpoint - the discovered endpoint, empty if none yet
+func (d *Discovery) Endpoint() string {
+	if d == nil {
+		return ""
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.endpoint
+}
+
+// Failed - the endpoint didn't answer, look up the service again soon
+func (d *Discovery) Failed() {
+	if d == nil {
+		return
+	}
+	select {
+	case d.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// consul - the passing instances of the service
+func (d *Discovery) consul() ([]string, error) {
+	query := url.Values{"passing": {"1"}}
+	if d.config.Tag != "" {
+		query.Set("tag", d.config.Tag)
+	}
+	if d.config.Datacenter != "" {
+		query.Set("dc", d.config.Datacenter)
+	}
+	req, err := http.NewRequest("GET", d.config.Address+"/v1/health/service/"+url.PathEscape(d.config.Service)+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if d.config.Token != "" {
+		req.Header.Set("X-Consul-Token", string(d.config.Token))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Consul returned %s", resp.Status)
+	}
+
+	var entries []struct {
+		Node struct {
+			Address string
+		}
+		Service struct {
+			Address string
+			Port    int
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+	var endpoints []string
+	for _, entry := range entries {
+		address := entry.Service.Address
+		if address == "" {
+			address = entry.Node.Address
+		}
+		endpoints = append(endpoints, joinPort(address, entry.Service.Port))
+	}
+	return endpoints, nil
+}
+
+type discoverInstancesInput struct {
+	NamespaceName string `json:"NamespaceName"`
+	ServiceName   string `json:"ServiceName"`
+	HealthStatus  string `json:"HealthStatus"`
+}
+
+type discoverInstancesOutput struct {
+	Instances []struct {
+		Attributes map[string]string `json:"Attributes"`
+	} `json:"Instances"`
+}
+
+// discoverInstances - the healthy instances of the Cloud Map service
+func (d *Discovery) discoverInstances() ([]string, error) {
+	var out discoverInstancesOutput
+	err := awsCall(d.cloudMap, "DiscoverInstances", &discoverInstancesInput{
+		NamespaceName: d.config.Namespace,
+		ServiceName:   d.config.Service,
+		HealthStatus:  "HEALTHY",
+	}, &out)
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []string
+	for _, instance := range out.Instances {
+		address := instance.Attributes["AWS_INSTANCE_IPV4"]
+		if address == "" {
+			address = instance.Attributes["AWS_INSTANCE_CNAME"]
+		}
+		if address == "" {
+			continue
+		}
+		port, _ := strconv.Atoi(instance.Attributes["AWS_INSTANCE_PORT"])
+		endpoints = append(endpoints, joinPort(address, port))
+	}
+	return endpoints, nil
+}
+
+// joinPort - the address with the port, if any
+func joinPort(address string, port int) string {
+	if port == 0 {
+		return address
+	}
+	return net.JoinHostPort(address, strconv.Itoa(port))
+}
+
+// Discovery - the service discovery, nil if not enabled
+func (fw *Flywheel) Discovery() *Discovery {
+	return fw.discovery
+}
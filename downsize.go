@@ -0,0 +1,233 @@
+package flywheel
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// DownsizeConfig - instances that are switched to a smaller instance type
+// during off-peak hours, instead of being stopped. The original types are
+// restored when the window ends.
+type DownsizeConfig struct {
+	// Instance ID to off-peak instance type
+	InstanceTypes map[string]string `json:"instance-types"`
+	// Off-peak window, as HH:MM. It may span midnight.
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Timezone string `json:"timezone"`
+
+	location *time.Location
+	from, to int
+}
+
+// Validate - check the window and instances
+func (c *DownsizeConfig) Validate(instances []string) error {
+	if len(c.InstanceTypes) == 0 {
+		return nil
+	}
+	for id := range c.InstanceTypes {
+		if !contains(instances, id) {
+			return fmt.Errorf("Downsize instance %s isn't in instances", id)
+		}
+	}
+
+	var err error
+	if c.from, err = parseClock(c.From); err != nil {
+		return err
+	}
+	if c.to, err = parseClock(c.To); err != nil {
+		return err
+	}
+	c.location, err = time.LoadLocation(c.Timezone)
+	return err
+}
+
+// parseClock - minutes since midnight of a HH:MM time
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time %q: expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// OffPeak - true if the time is within the off-peak window
+func (c *DownsizeConfig) OffPeak(now time.Time) bool {
+	if len(c.InstanceTypes) == 0 {
+		return false
+	}
+	local := now.In(c.location)
+	return withinClock(c.from, c.to, local.Hour()*60+local.Minute())
+}
+
+// withinClock - true if the minute of the day is in the window from-to,
+// which may span midnight
+func withinClock(from, to, minute int) bool {
+	if from <= to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to
+}
+
+// resizeResult - outcome of a resize, sent back to the flywheel goroutine
+type resizeResult struct {
+	// Types the instances had before the resize
+	previous map[string]string
+	restore  bool
+	err      error
+}
+
+// stopDownsized - called instead of stopping the downsize instances. During
+// off-peak hours they're switched to their smaller types and kept running,
+// otherwise they're stopped as usual.
+func (fw *Flywheel) stopDownsized() error {
+	config := &fw.config.Downsize
+	if len(config.InstanceTypes) == 0 {
+		return nil
+	}
+
+	if config.OffPeak(fw.now()) {
+		fw.startResize(config.InstanceTypes, true, false)
+		return nil
+	}
+
+	var ids []string
+	for id := range config.InstanceTypes {
+		if !fw.config.Observed(id) {
+			ids = append(ids, id)
+		}
+	}
+	fw.logf("Stopping instances %v", ids)
+	_, err := fw.ec2.StopInstances(
+		&ec2.StopInstancesInput{
+			InstanceIds: aws.StringSlice(ids),
+		},
+	)
+	return err
+}
+
+// pollDownsize - restore the original types once off-peak hours are over
+func (fw *Flywheel) pollDownsize() {
+	if fw.resizing || len(fw.originalTypes) == 0 || fw.config.Downsize.OffPeak(fw.now()) || fw.isReadOnly() {
+		return
+	}
+	running := fw.status == STARTING || fw.status == STARTED
+	fw.startResize(fw.originalTypes, running, true)
+}
+
+// startResize - change the instance types in the background, as the
+// instances have to be stopped first. The result arrives on fw.resized.
+func (fw *Flywheel) startResize(types map[string]string, start, restore bool) {
+	if fw.resizing {
+		return
+	}
+	fw.resizing = true
+
+	targets := make(map[string]string)
+	for id, instanceType := range types {
+		if !fw.config.Observed(id) {
+			targets[id] = instanceType
+		}
+	}
+	go func() {
+		previous, err := fw.resize(targets, start)
+		fw.resized <- resizeResult{previous: previous, restore: restore, err: err}
+	}()
+}
+
+// resize - stop, modify and optionally start the instances again
+func (fw *Flywheel) resize(types map[string]string, start bool) (map[string]string, error) {
+	var ids []string
+	for id := range types {
+		ids = append(ids, id)
+	}
+	fw.logf("Resizing instances %v", types)
+
+	resp, err := fw.ec2.DescribeInstances(
+		&ec2.DescribeInstancesInput{
+			InstanceIds: aws.StringSlice(ids),
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	previous := make(map[string]string)
+	for _, reservation := range resp.Reservations {
+		for _, instance := range reservation.Instances {
+			previous[aws.StringValue(instance.InstanceId)] = aws.StringValue(instance.InstanceType)
+		}
+	}
+
+	_, err = fw.ec2.StopInstances(
+		&ec2.StopInstancesInput{
+			InstanceIds: aws.StringSlice(ids),
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	err = fw.ec2.WaitUntilInstanceStopped(
+		&ec2.DescribeInstancesInput{
+			InstanceIds: aws.StringSlice(ids),
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for id, instanceType := range types {
+		if previous[id] == instanceType {
+			continue
+		}
+		_, err = fw.ec2.ModifyInstanceAttribute(
+			&ec2.ModifyInstanceAttributeInput{
+				InstanceId:   aws.String(id),
+				InstanceType: &ec2.AttributeValue{Value: aws.String(instanceType)},
+			},
+		)
+		if err != nil {
+			return previous, err
+		}
+	}
+
+	if !start {
+		return previous, nil
+	}
+	_, err = fw.ec2.StartInstances(
+		&ec2.StartInstancesInput{
+			InstanceIds: aws.StringSlice(ids),
+		},
+	)
+	return previous, err
+}
+
+// resizeDone - keep track of the original types
+func (fw *Flywheel) resizeDone(result resizeResult) {
+	fw.resizing = false
+	if result.err != nil {
+		fw.warn(NotifyError, "Resizing instances failed: %v", result.err)
+		if result.previous == nil {
+			return
+		}
+	}
+
+	if result.restore {
+		if result.err == nil {
+			fw.originalTypes = nil
+		}
+	} else {
+		if fw.originalTypes == nil {
+			fw.originalTypes = make(map[string]string)
+		}
+		for id, instanceType := range result.previous {
+			// Keep the first recorded type if resized twice
+			if _, ok := fw.originalTypes[id]; !ok {
+				fw.originalTypes[id] = instanceType
+			}
+		}
+	}
+	fw.SaveState()
+}
@@ -0,0 +1,182 @@
+package flywheel
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// DrainConfig - instances registered in load balancer target groups are
+// deregistered before stopping, and only stopped once their connections
+// are drained. Requests that bypass the proxy aren't cut off.
+type DrainConfig struct {
+	// ARNs of the application or network load balancer target groups the
+	// instances are registered in
+	TargetGroups []string `json:"target-groups"`
+
+	// Stop anyway after this long. Defaults to 5m, the default
+	// deregistration delay of a target group.
+	Timeout Duration `json:"timeout"`
+}
+
+// Validate - check the ARNs and fill in the defaults
+func (c *DrainConfig) Validate() error {
+	for _, arn := range c.TargetGroups {
+		if !strings.HasPrefix(arn, "arn:") || !strings.Contains(arn, ":targetgroup/") {
+			return fmt.Errorf("Drain target group %s isn't a target group ARN", arn)
+		}
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = Duration(5 * time.Minute)
+	}
+	return nil
+}
+
+// Enabled - true if instances are drained before stopping
+func (c *DrainConfig) Enabled() bool {
+	return len(c.TargetGroups) > 0
+}
+
+// draining - instances deregistered and waiting for their connections to
+// drain before they are stopped
+type draining struct {
+	instances []string
+	until     time.Time
+	nextCheck time.Time
+}
+
+type targetDescription struct {
+	_ struct{} `type:"structure"`
+
+	Id *string `type:"string"`
+}
+
+type registerTargetsInput struct {
+	_ struct{} `type:"structure"`
+
+	TargetGroupArn *string              `type:"string"`
+	Targets        []*targetDescription `type:"list"`
+}
+
+type describeTargetHealthOutput struct {
+	_ struct{} `type:"structure"`
+
+	TargetHealthDescriptions []*struct {
+		Target       *targetDescription `type:"structure"`
+		TargetHealth *struct {
+			State *string `type:"string"`
+		} `type:"structure"`
+	} `type:"list"`
+}
+
+// targets - the instances as targets of a target group
+func targets(ids []string) []*targetDescription {
+	var list []*targetDescription
+	for _, id := range ids {
+		list = append(list, &targetDescription{Id: aws.String(id)})
+	}
+	return list
+}
+
+// drainInstances - deregister the instances to stop from the target groups.
+// They are stopped by Poll once drained. Without target groups they are
+// stopped right away.
+func (fw *Flywheel) drainInstances() error {
+	c := &fw.config.Drain
+	ids := fw.undeferred(fw.config.stopInstanceIds())
+	if !c.Enabled() || len(ids) == 0 {
+		return fw.stopInstances()
+	}
+
+	fw.logf("Deregistering instances %v from their target groups", ids)
+	for _, arn := range c.TargetGroups {
+		err := awsCall(fw.elbv2, "DeregisterTargets", &registerTargetsInput{
+			TargetGroupArn: aws.String(arn),
+			Targets:        targets(ids),
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	now := fw.now()
+	fw.draining = &draining{instances: ids, until: now.Add(time.Duration(c.Timeout)), nextCheck: now}
+	return nil
+}
+
+// pollDraining - stop the draining instances once no target is draining
+// any more, or the timeout has passed
+func (fw *Flywheel) pollDraining() {
+	d := fw.draining
+	now := fw.now()
+	if d == nil || now.Before(d.nextCheck) {
+		return
+	}
+	d.nextCheck = now.Add(time.Duration(fw.config.HcTransition))
+
+	if now.Before(d.until) {
+		drained, err := fw.drained(d.instances)
+		if err != nil {
+			fw.logf("Unable to check draining: %v", err)
+			return
+		}
+		if !drained {
+			return
+		}
+		fw.logf("Connections drained")
+	} else {
+		fw.logf("Connections still draining after %v, stopping anyway", time.Duration(fw.config.Drain.Timeout))
+	}
+
+	fw.draining = nil
+	fw.logf("Stopping instances %v", d.instances)
+	_, err := fw.ec2.StopInstances(&ec2.StopInstancesInput{InstanceIds: aws.StringSlice(d.instances)})
+	if err != nil {
+		fw.logf("Error stopping: %v", err)
+		return
+	}
+	fw.refreshHealth()
+}
+
+// drained - true if none of the instances is still draining in any of the
+// target groups
+func (fw *Flywheel) drained(ids []string) (bool, error) {
+	for _, arn := range fw.config.Drain.TargetGroups {
+		var health describeTargetHealthOutput
+		err := awsCall(fw.elbv2, "DescribeTargetHealth", &registerTargetsInput{
+			TargetGroupArn: aws.String(arn),
+			Targets:        targets(ids),
+		}, &health)
+		if err != nil {
+			return false, err
+		}
+		for _, target := range health.TargetHealthDescriptions {
+			if target.TargetHealth != nil && aws.StringValue(target.TargetHealth.State) == "draining" {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// registerInstances - register the started instances in the target groups
+// again. Registering a registered instance changes nothing, so this doesn't
+// depend on the instances having been drained by this flywheel.
+func (fw *Flywheel) registerInstances() {
+	c := &fw.config.Drain
+	ids := fw.undeferred(fw.config.stopInstanceIds())
+	if !c.Enabled() || len(ids) == 0 {
+		return
+	}
+	for _, arn := range c.TargetGroups {
+		err := awsCall(fw.elbv2, "RegisterTargets", &registerTargetsInput{
+			TargetGroupArn: aws.String(arn),
+			Targets:        targets(ids),
+		}, nil)
+		if err != nil {
+			fw.warn(NotifyError, "Instances aren't registered in target group %s: %v", arn, err)
+		}
+	}
+}
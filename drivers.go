@@ -0,0 +1,223 @@
+package flywheel
+
+import (
+	"sort"
+)
+
+// ResourceDriver - a kind of resource started and stopped with the
+// environment. Flywheel starts the drivers in order, stops them in reverse,
+// and asks each for the states of its resources at every health check. New
+// kinds of resources can be added with WithDriver. If a driver fails to
+// start, those started before it are stopped again, in reverse.
+type ResourceDriver interface {
+	// Start - start the resources, without waiting for them
+	Start() error
+
+	// Stop - stop the resources, without waiting for them
+	Stop() error
+
+	// Ready - the state of each resource, one of running, pending,
+	// stopping or stopped. The environment is STARTED once they are all
+	// running. An error makes it UNHEALTHY.
+	Ready() ([]ResourceState, error)
+
+	// Describe - the resources, as listed in the status
+	Describe() []ResourceHealth
+}
+
+// resourceDrivers - the built-in drivers, in the order they are started,
+// then those given to New. Databases take the longest, and the instances
+// may need them. Container services come after the groups, which may be
+// the capacity of their cluster.
+func (fw *Flywheel) resourceDrivers() []ResourceDriver {
+	drivers := []ResourceDriver{
+		rdsDriver{fw},
+		ec2Driver{fw},
+		autoScalingDriver{fw},
+		ecsDriver{fw},
+		kubernetesDriver{fw},
+		execDriver{fw},
+	}
+	return append(drivers, fw.drivers...)
+}
+
+// startDrivers - start the drivers in order. If one fails, stop those
+// already started in reverse order, so a failed start leaves nothing
+// running, and return its error.
+func (fw *Flywheel) startDrivers() error {
+	drivers := fw.resourceDrivers()
+	for i, driver := range drivers {
+		if err := driver.Start(); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				if serr := drivers[j].Stop(); serr != nil {
+					fw.logf("Error stopping after a failed start: %v", serr)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// stopDrivers - stop the drivers in reverse order, until one fails
+func (fw *Flywheel) stopDrivers() error {
+	drivers := fw.resourceDrivers()
+	for i := len(drivers) - 1; i >= 0; i-- {
+		if err := drivers[i].Stop(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDrivers - add the states of the resources of every driver to the
+// health
+func (fw *Flywheel) checkDrivers(health *healthStates) error {
+	for _, driver := range fw.resourceDrivers() {
+		states, err := driver.Ready()
+		*health = append(*health, states...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// describeResources - the resources of every driver, for the status
+func (fw *Flywheel) describeResources() []ResourceHealth {
+	var resources []ResourceHealth
+	for _, driver := range fw.resourceDrivers() {
+		resources = append(resources, driver.Describe()...)
+	}
+	sort.Sort(resourceList(resources))
+	return resources
+}
+
+// rdsDriver - RDS DB instances and Aurora clusters
+type rdsDriver struct{ fw *Flywheel }
+
+func (d rdsDriver) Start() error { return d.fw.startRDS() }
+func (d rdsDriver) Stop() error  { return d.fw.stopRDS() }
+
+func (d rdsDriver) Ready() ([]ResourceState, error) {
+	var health healthStates
+	err := d.fw.checkRDS(&health)
+	return health, err
+}
+
+func (d rdsDriver) Describe() []ResourceHealth {
+	return d.fw.resources.kinds(ResourceDBInstance, ResourceDBCluster)
+}
+
+// ec2Driver - EC2 instances, started in stages and drained before they are
+// stopped. Their states come from the describe of every health check.
+type ec2Driver struct{ fw *Flywheel }
+
+func (d ec2Driver) Start() error { return d.fw.startInstances() }
+func (d ec2Driver) Stop() error  { return d.fw.drainInstances() }
+
+func (d ec2Driver) Ready() ([]ResourceState, error) {
+	var health healthStates
+	d.fw.checkInstances(d.fw.described, &health)
+	return health, nil
+}
+
+func (d ec2Driver) Describe() []ResourceHealth {
+	return d.fw.resources.kinds(ResourceInstance)
+}
+
+// autoScalingDriver - autoscaling groups, whose instances are stopped,
+// terminated or kept in a warm pool, with the processes their policies
+// suspend
+type autoScalingDriver struct{ fw *Flywheel }
+
+func (d autoScalingDriver) Start() error {
+	fw := d.fw
+	err := fw.unterminateAutoScaling()
+	if err == nil {
+		err = fw.startAutoScaling()
+	}
+	if err == nil {
+		err = fw.startWarmPoolAutoScaling()
+	}
+	if err == nil {
+		err = fw.resumeAutoScaling()
+	}
+	return err
+}
+
+func (d autoScalingDriver) Stop() error {
+	fw := d.fw
+	err := fw.terminateAutoScaling()
+	if err == nil {
+		err = fw.stopAutoScaling()
+	}
+	if err == nil {
+		err = fw.stopWarmPoolAutoScaling()
+	}
+	if err == nil {
+		err = fw.suspendAutoScaling()
+	}
+	return err
+}
+
+func (d autoScalingDriver) Ready() ([]ResourceState, error) {
+	var health healthStates
+	if err := d.fw.checkStoppedAutoScalingGroups(d.fw.described, &health); err != nil {
+		return health, err
+	}
+	d.fw.checkWarmPoolAutoScalingGroups(d.fw.described, &health)
+	return health, nil
+}
+
+func (d autoScalingDriver) Describe() []ResourceHealth {
+	return d.fw.resources.kinds(ResourceAutoScalingGroup)
+}
+
+// ecsDriver - ECS services, scaled to zero tasks
+type ecsDriver struct{ fw *Flywheel }
+
+func (d ecsDriver) Start() error { return d.fw.startECS() }
+func (d ecsDriver) Stop() error  { return d.fw.stopECS() }
+
+func (d ecsDriver) Ready() ([]ResourceState, error) {
+	var health healthStates
+	err := d.fw.checkECS(&health)
+	return health, err
+}
+
+func (d ecsDriver) Describe() []ResourceHealth {
+	return d.fw.resources.kinds(ResourceECSService)
+}
+
+// kubernetesDriver - Deployments and StatefulSets, scaled to zero replicas
+type kubernetesDriver struct{ fw *Flywheel }
+
+func (d kubernetesDriver) Start() error { return d.fw.startKubernetes() }
+func (d kubernetesDriver) Stop() error  { return d.fw.stopKubernetes() }
+
+func (d kubernetesDriver) Ready() ([]ResourceState, error) {
+	var health healthStates
+	err := d.fw.checkKubernetes(&health)
+	return health, err
+}
+
+func (d kubernetesDriver) Describe() []ResourceHealth {
+	return d.fw.resources.kinds(ResourceDeployment, ResourceStatefulSet)
+}
+
+// execDriver - resources of exec providers
+type execDriver struct{ fw *Flywheel }
+
+func (d execDriver) Start() error { return d.fw.startExec() }
+func (d execDriver) Stop() error  { return d.fw.stopExec() }
+
+func (d execDriver) Ready() ([]ResourceState, error) {
+	var health healthStates
+	err := d.fw.checkExec(&health)
+	return health, err
+}
+
+func (d execDriver) Describe() []ResourceHealth {
+	return d.fw.resources.kinds(ResourceExec)
+}
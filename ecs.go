@@ -0,0 +1,201 @@
+package flywheel
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ResourceECSService - an ECS service scaled to zero when powered down
+const ResourceECSService = "ecs-service"
+
+// ECSService - an ECS service scaled to zero tasks when powered down, and
+// back to its desired count when started
+type ECSService struct {
+	Cluster string `json:"cluster"`
+	Service string `json:"service"`
+
+	// Tasks restored when started
+	DesiredCount int64 `json:"desired-count"`
+}
+
+// Name - cluster/service, as in observe-only and the status
+func (s *ECSService) Name() string {
+	return s.Cluster + "/" + s.Service
+}
+
+// validateECS - check each service is configured once, with a count to
+// restore
+func validateECS(services []ECSService) error {
+	seen := make(map[string]bool)
+	for _, s := range services {
+		if s.Cluster == "" || s.Service == "" {
+			return fmt.Errorf("ECS service needs a cluster and a service")
+		}
+		if s.DesiredCount <= 0 {
+			return fmt.Errorf("ECS service %s needs a desired-count above 0", s.Name())
+		}
+		if seen[s.Name()] {
+			return fmt.Errorf("ECS service %s configured more than once", s.Name())
+		}
+		seen[s.Name()] = true
+	}
+	return nil
+}
+
+type describeServicesInput struct {
+	Cluster  string   `json:"cluster"`
+	Services []string `json:"services"`
+}
+
+type ecsServiceState struct {
+	ServiceName  string `json:"serviceName"`
+	Status       string `json:"status"`
+	DesiredCount int64  `json:"desiredCount"`
+	RunningCount int64  `json:"runningCount"`
+	PendingCount int64  `json:"pendingCount"`
+}
+
+type describeServicesOutput struct {
+	Services []ecsServiceState `json:"services"`
+	Failures []struct {
+		Arn    string `json:"arn"`
+		Reason string `json:"reason"`
+	} `json:"failures"`
+}
+
+type updateServiceInput struct {
+	Cluster      string `json:"cluster"`
+	Service      string `json:"service"`
+	DesiredCount int64  `json:"desiredCount"`
+}
+
+// DescribeServices takes this many services at most
+const ecsDescribeBatch = 10
+
+// describeECS - the configured services, by name, described in batches for
+// each cluster. Services that don't exist are left out.
+func (fw *Flywheel) describeECS() (map[string]ecsServiceState, error) {
+	clusters := make(map[string][]string)
+	for _, s := range fw.config.ECS {
+		clusters[s.Cluster] = append(clusters[s.Cluster], s.Service)
+	}
+	var names []string
+	for cluster := range clusters {
+		names = append(names, cluster)
+	}
+	sort.Strings(names)
+
+	states := make(map[string]ecsServiceState)
+	for _, cluster := range names {
+		services := clusters[cluster]
+		for len(services) > 0 {
+			n := len(services)
+			if n > ecsDescribeBatch {
+				n = ecsDescribeBatch
+			}
+			var out describeServicesOutput
+			err := awsCall(fw.ecs, "DescribeServices", &describeServicesInput{Cluster: cluster, Services: services[:n]}, &out)
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range out.Services {
+				states[cluster+"/"+s.ServiceName] = s
+			}
+			services = services[n:]
+		}
+	}
+	return states, nil
+}
+
+// ecsState - the state of the service, as the health check counts them.
+// Tasks that are still starting or stopping keep the environment STARTING
+// or STOPPING. Empty if the service isn't active.
+func ecsState(s ecsServiceState) string {
+	switch {
+	case s.Status != "ACTIVE":
+		return ""
+	case s.DesiredCount == 0 && s.RunningCount+s.PendingCount == 0:
+		return "stopped"
+	case s.DesiredCount == 0:
+		return "stopping"
+	case s.RunningCount >= s.DesiredCount:
+		return "running"
+	}
+	return "pending"
+}
+
+// scaleECS - set the desired count of the services, zero to stop them
+func (fw *Flywheel) scaleECS(start bool) error {
+	for _, s := range fw.config.ECS {
+		if fw.config.Observed(s.Name()) {
+			continue
+		}
+		count := int64(0)
+		if start {
+			count = s.DesiredCount
+			fw.logf("Starting ECS service %s with %d tasks", s.Name(), count)
+		} else {
+			fw.logf("Stopping ECS service %s", s.Name())
+		}
+		err := awsCall(fw.ecs, "UpdateService", &updateServiceInput{Cluster: s.Cluster, Service: s.Service, DesiredCount: count}, nil)
+		if err != nil {
+			fw.resources.fail(ResourceECSService, s.Name(), err, fw.now())
+			return err
+		}
+	}
+	return nil
+}
+
+// startECS - scale the services back up
+func (fw *Flywheel) startECS() error {
+	return fw.scaleECS(true)
+}
+
+// stopECS - scale the services to zero
+func (fw *Flywheel) stopECS() error {
+	return fw.scaleECS(false)
+}
+
+// checkECS - add the states of the services to the health. A service is
+// only running once it runs as many tasks as it desires. One that is
+// missing or isn't active makes the environment UNHEALTHY.
+func (fw *Flywheel) checkECS(health *healthStates) error {
+	if len(fw.config.ECS) == 0 {
+		return nil
+	}
+	now := fw.now()
+	states, err := fw.describeECS()
+	var problems []string
+	for _, s := range fw.config.ECS {
+		name := s.Name()
+		if err != nil {
+			fw.resources.set(ResourceECSService, name, "unknown", err, now)
+			continue
+		}
+		described, ok := states[name]
+		if !ok {
+			fw.resources.set(ResourceECSService, name, "not-found", nil, now)
+			problems = append(problems, fmt.Sprintf("ECS service %s not found", name))
+			continue
+		}
+		state := ecsState(described)
+		if state == "" {
+			fw.resources.set(ResourceECSService, name, strings.ToLower(described.Status), nil, now)
+			problems = append(problems, fmt.Sprintf("ECS service %s is %s", name, described.Status))
+			continue
+		}
+		fw.resources.set(ResourceECSService, name, fmt.Sprintf("%s: %d/%d tasks", state, described.RunningCount, described.DesiredCount), nil, now)
+		if state == "running" && fw.config.Observed(name) {
+			state = runningUncontrolled
+		}
+		health.add(name, state, 1)
+	}
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, ", "))
+	}
+	return nil
+}
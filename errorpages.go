@@ -0,0 +1,103 @@
+package flywheel
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// Ways to handle backend error responses
+const (
+	ErrorPassthrough = "passthrough"
+	ErrorReplace     = "replace"
+)
+
+// How much of the backend's error response is shown as details
+const errorDetailsLimit = 4096
+
+// ErrorPagePolicy - how backend 4xx and 5xx responses are handled
+type ErrorPagePolicy struct {
+	ClientErrors string `json:"4xx"`
+	ServerErrors string `json:"5xx"`
+	// Include the backend's response in replacement pages. Don't enable it
+	// for production, it may leak internals.
+	ShowDetails *bool `json:"show-details"`
+}
+
+// ErrorPagesConfig - the error page policy, with overrides per vhost
+type ErrorPagesConfig struct {
+	ErrorPagePolicy
+	Vhosts map[string]ErrorPagePolicy `json:"vhosts"`
+}
+
+// Validate - check the policies
+func (c *ErrorPagesConfig) Validate() error {
+	policies := []ErrorPagePolicy{c.ErrorPagePolicy}
+	for _, policy := range c.Vhosts {
+		policies = append(policies, policy)
+	}
+	for _, policy := range policies {
+		for _, mode := range []string{policy.ClientErrors, policy.ServerErrors} {
+			switch mode {
+			case "", ErrorPassthrough, ErrorReplace:
+			default:
+				return fmt.Errorf("Unknown error page mode %q: expected %s or %s", mode, ErrorPassthrough, ErrorReplace)
+			}
+		}
+	}
+	return nil
+}
+
+// policy - whether to replace the response for the host and status code,
+// and whether to show details
+func (c *ErrorPagesConfig) policy(host string, code int) (bool, bool) {
+	vhost := c.Vhosts[host]
+
+	var mode string
+	switch {
+	case code >= 400 && code < 500:
+		mode = firstNonEmpty(vhost.ClientErrors, c.ClientErrors)
+	case code >= 500:
+		mode = firstNonEmpty(vhost.ServerErrors, c.ServerErrors)
+	}
+
+	details := false
+	if vhost.ShowDetails != nil {
+		details = *vhost.ShowDetails
+	} else if c.ShowDetails != nil {
+		details = *c.ShowDetails
+	}
+	return mode == ErrorReplace, details
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// replaceError - write a flywheel error page instead of the backend's error
+// response, if configured. The status code is kept.
+func (handler *Handler) replaceError(w http.ResponseWriter, r *http.Request, resp *http.Response) bool {
+	config := handler.Flywheel.config
+	replace, details := config.ErrorPages.policy(r.Host, resp.StatusCode)
+	if !replace {
+		return false
+	}
+
+	lang := config.Language(r)
+	body := config.Message(lang, "backend.body")
+	if details {
+		upstream, _ := ioutil.ReadAll(io.LimitReader(resp.Body, errorDetailsLimit))
+		body = fmt.Sprintf(`%s</p><pre style="margin: 20px auto; max-width: 80%%; white-space: pre-wrap;">%s %s</pre><p>`,
+			body, html.EscapeString(resp.Status), html.EscapeString(string(upstream)))
+	}
+	w.Header().Set("Content-Language", lang)
+	handler.page(w, resp.StatusCode, HTMLERROR, lang, "backend", body)
+	return true
+}
@@ -0,0 +1,250 @@
+package flywheel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResourceExec - a resource started, stopped and checked by an exec provider
+const ResourceExec = "exec"
+
+// Exec provider actions
+const (
+	ExecStart  = "start"
+	ExecStop   = "stop"
+	ExecHealth = "health"
+)
+
+// ExecResource - a resource flywheel has no native support for, like a
+// license server or a SaaS sandbox, started, stopped and checked by a
+// command or an HTTP endpoint.
+//
+// The command is run with the action as its last argument, and the endpoint
+// is POSTed to, with an ExecRequest as JSON. The command writes an
+// ExecResponse as JSON to its standard output, the endpoint answers with
+// one. A command exiting with an error, or an endpoint answering with an
+// error status, fails the action.
+type ExecResource struct {
+	Name    string            `json:"name"`
+	Command []string          `json:"command"`
+	URL     string            `json:"url"`
+	Headers map[string]Secret `json:"headers"`
+
+	// How long an action may take, default 30s
+	Timeout Duration `json:"timeout"`
+
+	// Check the health only this often while STARTED or STOPPED, for
+	// providers that are slow or rate limited. Default every health check.
+	Interval Duration `json:"interval"`
+}
+
+// ExecRequest - what an exec provider is asked to do
+type ExecRequest struct {
+	Action   string `json:"action"`
+	Resource string `json:"resource"`
+}
+
+// ExecResponse - the answer of an exec provider. Health answers with the
+// state of the resource, one of running, pending, stopping or stopped.
+// Start and stop may answer with nothing.
+type ExecResponse struct {
+	State   string `json:"state"`
+	Message string `json:"message,omitempty"`
+}
+
+// validateExec - check the exec resources, and fill in the defaults
+func validateExec(resources []ExecResource) error {
+	seen := make(map[string]bool)
+	for i := range resources {
+		r := &resources[i]
+		if r.Name == "" {
+			return fmt.Errorf("Exec resource %d has no name", i)
+		}
+		if seen[r.Name] {
+			return fmt.Errorf("Exec resource %s configured more than once", r.Name)
+		}
+		seen[r.Name] = true
+		if (len(r.Command) == 0) == (r.URL == "") {
+			return fmt.Errorf("Exec resource %s needs a command or a url", r.Name)
+		}
+		if r.Timeout <= 0 {
+			r.Timeout = Duration(30 * time.Second)
+		}
+	}
+	return nil
+}
+
+// call - ask the provider to perform the action
+func (r *ExecResource) call(action string) (ExecResponse, error) {
+	var resp ExecResponse
+	req, err := json.Marshal(ExecRequest{Action: action, Resource: r.Name})
+	if err != nil {
+		return resp, err
+	}
+	out, err := r.invoke(action, req)
+	if err != nil {
+		return resp, fmt.Errorf("Exec resource %s %s failed: %v", r.Name, action, err)
+	}
+	if len(bytes.TrimSpace(out)) == 0 {
+		return resp, nil
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return resp, fmt.Errorf("Exec resource %s %s answered with invalid JSON: %v", r.Name, action, err)
+	}
+	return resp, nil
+}
+
+// invoke - run the command, or POST to the endpoint, within the timeout
+func (r *ExecResource) invoke(action string, req []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(r.Timeout))
+	defer cancel()
+	if r.URL != "" {
+		return r.post(ctx, req)
+	}
+	return r.run(ctx, action, req)
+}
+
+// run - run the command with the action, the request on its input
+func (r *ExecResource) run(ctx context.Context, action string, req []byte) ([]byte, error) {
+	args := append(append([]string{}, r.Command[1:]...), action)
+	cmd := exec.CommandContext(ctx, r.Command[0], args...)
+	cmd.Stdin = bytes.NewReader(req)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil && stderr.Len() > 0 {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, err
+}
+
+// post - POST the request to the endpoint
+func (r *ExecResource) post(ctx context.Context, req []byte) ([]byte, error) {
+	hr, err := http.NewRequest("POST", r.URL, bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	hr.Header.Set("Content-Type", "application/json")
+	for key, value := range r.Headers {
+		hr.Header.Set(key, string(value))
+	}
+	resp, err := http.DefaultClient.Do(hr.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return body, nil
+}
+
+// startExec - start the exec resources
+func (fw *Flywheel) startExec() error {
+	for i := range fw.config.Exec {
+		r := &fw.config.Exec[i]
+		if fw.config.Observed(r.Name) {
+			continue
+		}
+		fw.logf("Starting exec resource %s", r.Name)
+		if _, err := r.call(ExecStart); err != nil {
+			fw.resources.fail(ResourceExec, r.Name, err, fw.now())
+			return err
+		}
+	}
+	return nil
+}
+
+// stopExec - stop the exec resources
+func (fw *Flywheel) stopExec() error {
+	for i := range fw.config.Exec {
+		r := &fw.config.Exec[i]
+		if fw.config.Observed(r.Name) {
+			continue
+		}
+		fw.logf("Stopping exec resource %s", r.Name)
+		if _, err := r.call(ExecStop); err != nil {
+			fw.resources.fail(ResourceExec, r.Name, err, fw.now())
+			return err
+		}
+	}
+	return nil
+}
+
+// execCheck - the result of checking the health of an exec resource
+type execCheck struct {
+	at    time.Time
+	state string
+	err   error
+}
+
+// checkHealth - ask the provider for the state of the resource
+func (r *ExecResource) checkHealth(now time.Time) execCheck {
+	resp, err := r.call(ExecHealth)
+	if err == nil {
+		switch resp.State {
+		case "running", "pending", "stopping", "stopped":
+		default:
+			err = fmt.Errorf("Exec resource %s answered with unknown state %q", r.Name, resp.State)
+		}
+	}
+	return execCheck{at: now, state: resp.State, err: err}
+}
+
+// checkExec - add the states of the exec resources to the health. They are
+// checked at the same time, so slow providers don't add up, and those with
+// an interval only once it has passed, unless starting or stopping. A
+// resource that can't be checked, or answers with an unknown state, makes
+// the environment UNHEALTHY.
+func (fw *Flywheel) checkExec(health *healthStates) error {
+	now := fw.now()
+	status := fw.Snapshot().Status
+	steady := status == STARTED || status == STOPPED
+	if fw.execChecks == nil {
+		fw.execChecks = make(map[string]execCheck)
+	}
+
+	checks := make([]execCheck, len(fw.config.Exec))
+	var wg sync.WaitGroup
+	for i := range fw.config.Exec {
+		r := &fw.config.Exec[i]
+		last, ok := fw.execChecks[r.Name]
+		if ok && steady && now.Sub(last.at) < time.Duration(r.Interval) {
+			checks[i] = last
+			continue
+		}
+		wg.Add(1)
+		go func(i int, r *ExecResource) {
+			defer wg.Done()
+			checks[i] = r.checkHealth(now)
+		}(i, r)
+	}
+	wg.Wait()
+
+	for i := range fw.config.Exec {
+		r, check := &fw.config.Exec[i], checks[i]
+		fw.execChecks[r.Name] = check
+		fw.resources.set(ResourceExec, r.Name, check.state, check.err, check.at)
+		if check.err != nil {
+			return check.err
+		}
+		state := check.state
+		if state == "running" && fw.config.Observed(r.Name) {
+			state = runningUncontrolled
+		}
+		health.add(r.Name, state, 1)
+	}
+	return nil
+}
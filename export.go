@@ -0,0 +1,199 @@
+package flywheel
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// StatusFiles - files the state is exported to on every status change.
+// Empty names are skipped.
+type StatusFiles struct {
+	JSON       string
+	Prometheus string
+	KeyValue   string
+}
+
+// SetStatusFiles - export the state to these files on every status change
+func (fw *Flywheel) SetStatusFiles(files StatusFiles) {
+	fw.statusFiles = files
+}
+
+// exportStatus - write all the configured status files
+func (fw *Flywheel) exportStatus() {
+	files := fw.statusFiles
+	if files.JSON != "" {
+		fw.WriteStatusFile(files.JSON)
+	}
+	if files.Prometheus != "" {
+		if err := writeFileAtomic(files.Prometheus, fw.prometheusStatus()); err != nil {
+			fw.logf("Unable to write prometheus status file: %v", err)
+		}
+	}
+	if files.KeyValue != "" {
+		if err := writeFileAtomic(files.KeyValue, fw.keyValueStatus()); err != nil {
+			fw.logf("Unable to write key=value status file: %v", err)
+		}
+	}
+}
+
+// statusPong - the current state, as saved in the status file
+func (fw *Flywheel) statusPong() Pong {
+	pong := Pong{
+		Status:      fw.status,
+		StatusName:  StatusString(fw.status),
+		LastStarted: fw.lastStarted,
+		LastStopped: fw.lastStopped,
+		StopAt:      fw.stopAt,
+		Deadline:    fw.deadline,
+
+		Warnings:           fw.warnings,
+		LaunchTemplates:    fw.launchTemplates,
+		OriginalTypes:      fw.originalTypes,
+		Resources:          fw.describeResources(),
+		ReadOnly:           fw.isReadOnly(),
+		Endpoint:           fw.endpoint,
+		StartedAt:          fw.startedAt,
+		StatusSince:        fw.statusSince,
+		Vhosts:             fw.vhosts,
+		Health:             fw.health,
+		NotReady:           fw.notReady,
+		LastStop:           fw.lastStop,
+		Protected:          fw.protected,
+		Annotations:        fw.annotations,
+		Maintenance:        fw.maintenance,
+		SuspendedProcesses: fw.suspended.all(),
+		ConfigErrors:       fw.configErrors(),
+		RecoveryAttempts:   fw.recovery.attempts,
+		RecoveryFailed:     fw.recovery.failed,
+		vhostPatterns:      fw.vhostPatterns,
+	}
+	pong.StopIn = pong.stopIn(fw.now())
+	pong.SchedulerConflicts = fw.schedulerConflicts()
+	pong.Anomalies = fw.anomalies.list()
+	if fw.calendarHeld() {
+		event := *fw.calendarHold
+		pong.CalendarEvent = &event
+	}
+	if w := fw.blackout(); w != nil {
+		pong.Blackout = w.Name
+	}
+	fw.describeWaiting(&pong)
+	if latest := fw.updates.Latest(); newerVersion(latest, Version) {
+		pong.UpdateAvailable = latest
+	}
+	return pong
+}
+
+// prometheusStatus - the state in the node_exporter textfile format
+func (fw *Flywheel) prometheusStatus() []byte {
+	var buf bytes.Buffer
+
+	fmt.Fprintln(&buf, "# HELP flywheel_status Current status, 1 for the active one.")
+	fmt.Fprintln(&buf, "# TYPE flywheel_status gauge")
+	for status := STOPPED; status <= UNHEALTHY; status++ {
+		value := 0
+		if status == fw.status {
+			value = 1
+		}
+		fmt.Fprintf(&buf, "flywheel_status{status=%q} %d\n", StatusString(status), value)
+	}
+
+	timestamps := []struct {
+		name, help string
+		t          time.Time
+	}{
+		{"flywheel_last_started_timestamp_seconds", "When the last startup began.", fw.lastStarted},
+		{"flywheel_last_stopped_timestamp_seconds", "When the last shutdown began.", fw.lastStopped},
+		{"flywheel_stop_due_timestamp_seconds", "When the idle timeout will stop the environment.", fw.stopAt},
+	}
+	for _, ts := range timestamps {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", ts.name, ts.help)
+		fmt.Fprintf(&buf, "# TYPE %s gauge\n", ts.name)
+		fmt.Fprintf(&buf, "%s %d\n", ts.name, unixTime(ts.t))
+	}
+
+	if fw.history != nil {
+		fw.prometheusColdStarts(&buf)
+	}
+	return buf.Bytes()
+}
+
+// prometheusColdStarts - the cold start latencies within the SLO window as
+// a summary, and whether they meet the target
+func (fw *Flywheel) prometheusColdStarts(buf *bytes.Buffer) {
+	report := fw.coldStarts()
+	slo := &fw.config.ColdStartSLO
+	fmt.Fprintf(buf, "# HELP flywheel_cold_start_seconds Time from the request that woke the environment to the first response, over the last %v.\n", time.Duration(slo.Window))
+	fmt.Fprintln(buf, "# TYPE flywheel_cold_start_seconds summary")
+	if report.count > 0 {
+		fmt.Fprintf(buf, "flywheel_cold_start_seconds{quantile=\"0.5\"} %g\n", report.p50.Seconds())
+		fmt.Fprintf(buf, "flywheel_cold_start_seconds{quantile=\"0.95\"} %g\n", report.p95.Seconds())
+	}
+	fmt.Fprintf(buf, "flywheel_cold_start_seconds_sum %g\n", report.sum.Seconds())
+	fmt.Fprintf(buf, "flywheel_cold_start_seconds_count %d\n", report.count)
+	if slo.Target <= 0 {
+		return
+	}
+	fmt.Fprintln(buf, "# HELP flywheel_cold_start_slo_target_seconds The cold start latency target.")
+	fmt.Fprintln(buf, "# TYPE flywheel_cold_start_slo_target_seconds gauge")
+	fmt.Fprintf(buf, "flywheel_cold_start_slo_target_seconds{percentile=\"%g\"} %g\n", slo.Percentile, time.Duration(slo.Target).Seconds())
+	if report.met != nil {
+		met := 0
+		if *report.met {
+			met = 1
+		}
+		fmt.Fprintln(buf, "# HELP flywheel_cold_start_slo_met 1 if the cold starts meet the target.")
+		fmt.Fprintln(buf, "# TYPE flywheel_cold_start_slo_met gauge")
+		fmt.Fprintf(buf, "flywheel_cold_start_slo_met %d\n", met)
+	}
+}
+
+// keyValueStatus - the state as shell variable assignments
+func (fw *Flywheel) keyValueStatus() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "FLYWHEEL_STATUS=%s\n", StatusString(fw.status))
+	fmt.Fprintf(&buf, "FLYWHEEL_LAST_STARTED=%d\n", unixTime(fw.lastStarted))
+	fmt.Fprintf(&buf, "FLYWHEEL_LAST_STOPPED=%d\n", unixTime(fw.lastStopped))
+	fmt.Fprintf(&buf, "FLYWHEEL_STOP_AT=%d\n", unixTime(fw.stopAt))
+	if fw.lastStop != nil {
+		fmt.Fprintf(&buf, "FLYWHEEL_LAST_STOP_REASON=%s\n", fw.lastStop.Reason)
+	}
+	return buf.Bytes()
+}
+
+// unixTime - seconds since the epoch, 0 for unset times
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// writeFileAtomic - write to a temporary file and rename it into place, so
+// readers never see a partial file
+func writeFileAtomic(filename string, data []byte) error {
+	fd, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	tmpName := fd.Name()
+
+	_, err = fd.Write(data)
+	if err == nil {
+		err = fd.Chmod(0644)
+	}
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = replaceFile(tmpName, filename)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+	}
+	return err
+}
@@ -1,230 +1,1040 @@
 package flywheel
 
 import (
+	"context"
 	"encoding/json"
-	"io"
-	"log"
-	"os"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
 // How often flywheel will update its internal state and/or check for idle
-// timeouts
+// timeouts, unless configured otherwise
 const SpinINTERVAL = time.Second
 
+// PingQueueSize - requests queued up for the flywheel goroutine before
+// senders have to wait
+const PingQueueSize = 256
+
+// PingTimeout - how long a request waits for the flywheel goroutine before
+// falling back to the last published status
+const PingTimeout = 5 * time.Second
+
+// ErrBusy - the flywheel goroutine didn't answer in time
+var ErrBusy = errors.New("Flywheel is busy, please try again")
+
 // Ping - HTTP requests "ping" the flywheel goroutine. This updates the idle timeout,
-// and returns the current status to the http request.
+// and returns the current status to the http request. Pings are compared
+// whole by mutates, so new fields must be comparable: pointers rather than
+// slices, maps or funcs.
 type Ping struct {
 	replyTo      chan Pong
 	setTimeout   time.Duration
+	stopAt       time.Time
+	extend       time.Duration
+	user         string
 	requestStart bool
 	requestStop  bool
+	confirmed    bool
 	noop         bool
+	idle         bool
+	readOnly     *bool
+	vhost        *vhostChange
+	backendDown  string
+	annotate     bool
+	annotations  *Annotations
+
+	// Set by Handler.ping, so a request it gave up waiting for isn't
+	// applied later, after the caller was told to try again
+	claim *int32
+}
+
+// States of a ping's claim
+const (
+	pingPending int32 = iota
+	pingTaken
+	pingAbandoned
+)
+
+// take - claim the ping for the flywheel goroutine. False if the caller
+// already gave up on it.
+func (p *Ping) take() bool {
+	if p.claim == nil {
+		return true
+	}
+	return atomic.CompareAndSwapInt32(p.claim, pingPending, pingTaken) || atomic.LoadInt32(p.claim) == pingTaken
+}
+
+// abandon - give up on the ping. False if the flywheel goroutine already
+// took it, so it is going to be applied.
+func (p *Ping) abandon() bool {
+	return p.claim == nil || atomic.CompareAndSwapInt32(p.claim, pingPending, pingAbandoned)
+}
+
+// mutates - true unless the request only counts as activity. Anything set
+// besides who sent it asks for a change, so new kinds of requests are
+// covered without being listed here.
+func (p *Ping) mutates() bool {
+	activity := Ping{replyTo: p.replyTo, user: p.user, noop: p.noop, claim: p.claim}
+	return *p != activity
 }
 
 // Pong - result of the ping request
 type Pong struct {
 	Status      int       `json:"-"`
 	StatusName  string    `json:"status"`
-	Err         error     `json:"error,omitempty"`
+	Err         error     `json:"-"`
 	LastStarted time.Time `json:"last-started,omitempty"`
 	LastStopped time.Time `json:"last-stopped,omitempty"`
 	StopAt      time.Time `json:"stop-due-at"`
+	Warnings    []string  `json:"warnings,omitempty"`
+	// Start requests received after the first one, while starting
+	Waiting int    `json:"waiting,omitempty"`
+	Message string `json:"message,omitempty"`
+
+	// Seconds left until the stop while started, on the monotonic clock,
+	// so clients don't depend on their clock agreeing with stop-due-at
+	StopIn int64 `json:"stop-in-seconds,omitempty"`
+
+	// The stop time was set through the API or by an extension, rather than
+	// by the idle timeout
+	Deadline bool `json:"deadline,omitempty"`
+
+	// Launch template version of each terminated group at stop time
+	LaunchTemplates map[string]string `json:"launch-templates,omitempty"`
+
+	// Instance types of downsized instances, to restore after off-peak hours
+	OriginalTypes map[string]string `json:"original-instance-types,omitempty"`
+
+	// Health of each managed resource, as of the last health check
+	Resources []ResourceHealth `json:"resources,omitempty"`
+
+	// A newer flywheel release, if the update check found one
+	UpdateAvailable string `json:"update-available,omitempty"`
+
+	// Start, stop and scaling changes are refused
+	ReadOnly bool `json:"read-only,omitempty"`
+
+	// Stateful resources an unconfirmed stop would affect
+	StopRisks []StopRisk `json:"stop-risks,omitempty"`
+
+	// Unusual wake and extend patterns, as long as they last
+	Anomalies []Anomaly `json:"anomalies,omitempty"`
+
+	// The calendar event the environment is held for
+	CalendarEvent *CalendarEvent `json:"calendar-event,omitempty"`
+
+	// The blackout window automatic stops wait for
+	Blackout string `json:"blackout,omitempty"`
+
+	// Resources AWS Instance Scheduler also has a schedule for
+	SchedulerConflicts []SchedulerConflict `json:"scheduler-conflicts,omitempty"`
+
+	// The endpoint resolved from the resources, if configured
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// When startup last completed
+	StartedAt time.Time `json:"started-at,omitempty"`
+
+	// When the status last changed
+	StatusSince time.Time `json:"status-since,omitempty"`
+
+	// Infrastructure and application health, apart
+	Health HealthReport `json:"health"`
+
+	// Instances that haven't signaled they are ready while starting
+	NotReady []string `json:"not-ready,omitempty"`
+
+	// Why the environment was last stopped
+	LastStop *StopReason `json:"last-stop,omitempty"`
+
+	// Resources the last stop left running, because they're protected
+	Protected []ProtectedResource `json:"protected,omitempty"`
+
+	// Owner, notes and links set with the API
+	Annotations *Annotations `json:"annotations,omitempty"`
+
+	// Upcoming EC2 scheduled events of the instances
+	Maintenance []MaintenanceEvent `json:"maintenance,omitempty"`
+
+	// Processes the autoscaling groups had suspended before powering down
+	SuspendedProcesses map[string]SuspendedProcesses `json:"suspended-processes,omitempty"`
+
+	// Mistakes in the config found against AWS, like autoscaling groups
+	// that don't exist
+	ConfigErrors []string `json:"config-errors,omitempty"`
+
+	// Restarts after breaking by itself while STARTED
+	RecoveryAttempts int  `json:"recovery-attempts,omitempty"`
+	RecoveryFailed   bool `json:"recovery-failed,omitempty"`
+
+	// Vhosts added with the API
+	Vhosts        map[string]string `json:"vhosts,omitempty"`
+	vhostPatterns []vhostPattern
 }
 
 // Flywheel struct holds all the state required by the flywheel goroutine.
 type Flywheel struct {
-	config      *Config
-	running     bool
-	pings       chan Ping
-	status      int
-	ready       bool
-	stopAt      time.Time
-	lastStarted time.Time
-	lastStopped time.Time
-	ec2         *ec2.EC2
-	autoscaling *autoscaling.AutoScaling
-	hcInterval  time.Duration
-	idleTimeout time.Duration
+	config       *Config
+	running      bool
+	pings        chan Ping
+	status       int
+	ready        bool
+	stopAt       time.Time
+	lastStarted  time.Time
+	lastStopped  time.Time
+	startedAt    time.Time
+	statusSince  time.Time
+	ec2          *ec2.EC2
+	autoscaling  *autoscaling.AutoScaling
+	cloudwatch   *client.Client
+	elbv2        *client.Client
+	rds          *client.Client
+	ecs          *client.Client
+	kube         *kubeClient
+	ssm          *client.Client
+	hcInterval   time.Duration
+	idleTimeout  time.Duration
+	jitter       float64
+	history      *History
+	statusFiles  StatusFiles
+	store        StateStore
+	refs         RefCounter
+	idle         IdleStrategy
+	refresh      chan struct{}
+	recorder     *Recorder
+	updates      *UpdateChecker
+	discovery    *Discovery
+	rampUp       *RampUp
+	readOnly     bool
+	endpoint     string
+	vhosts       map[string]string
+	clock        Clock
+	logger       Logger
+	notifier     Notifier
+	described    *described
+	draining     *draining
+	calendar     *Calendar
+	calendarHold *CalendarEvent
+	// When the schedule was last checked, and how long a scheduled start
+	// holds the environment up
+	scheduleChecked time.Time
+	scheduleHold    time.Time
+	anomalies       anomalyState
+	mirror          *Mirror
+	webhooks        *WebhookReplay
+	resources       resourceHealth
+	clients         clientTracker
+	diagnostics     diagnosticsStore
+	readiness       readinessSignals
+	activity        *Activity
+	// The blackout window the environment is in, when it was last polled
+	blackoutName string
+	// When the history was last pruned to history-max-age
+	historyPruned time.Time
+
+	warnings        []string
+	launchTemplates map[string]string
+
+	// Startup stages waiting for their delay
+	pendingStages []startStage
+	nextStageAt   time.Time
+
+	// Start requests since the last start
+	startRequests int
+
+	// Stop request waiting for confirmation
+	pendingStop *pendingStop
+
+	// Compiled patterns of the runtime vhosts
+	vhostPatterns []vhostPattern
+
+	// What caused the start or stop under way, for the history
+	cause transitionCause
+
+	// Why the environment was last stopped
+	lastStop *StopReason
+
+	// When the idle timer was last restarted, to reschedule the stop when
+	// another idle timeout window starts
+	idleSince time.Time
+
+	// When the loop last polled, to notice steps of the wall clock
+	lastPoll time.Time
+
+	// Resources the last stop left running
+	protected []ProtectedResource
+
+	// Owner, notes and links set with the API, nil if none
+	annotations *Annotations
+
+	// Scheduled events of the instances, as of the last check, and when
+	// the health check goroutine checks next
+	maintenance    []MaintenanceEvent
+	maintenanceDue time.Time
+
+	// Processes the groups had suspended before powering down
+	suspended suspendedProcesses
+
+	// Configured autoscaling groups that don't exist, as of the last
+	// describe
+	missingGroups []string
+
+	// The last health check of each exec resource. Only the health check
+	// goroutine uses it.
+	execChecks map[string]execCheck
+
+	// The stop time was set or extended through the API, rather than by
+	// the idle timeout
+	deadline bool
+
+	// Restarts after breaking by itself while STARTED
+	recovery recoveryState
+
+	// The wait for the first response after a request woke the environment
+	coldStart coldStart
+
+	// Resource drivers given to New, after the built-in ones
+	drivers []ResourceDriver
+
+	// Infrastructure and application health
+	health HealthReport
+
+	// Instances that haven't signaled they are ready
+	notReady []string
+
+	// Status published for readers that mustn't wait for the goroutine,
+	// and closed once Run has returned, so they don't wait for a goroutine
+	// that's gone
+	snapshotMu sync.RWMutex
+	snapshot   Pong
+	halted     chan struct{}
+
+	// Off-peak instance type changes
+	originalTypes map[string]string
+	resizing      bool
+	resized       chan resizeResult
+
+	// Extensions granted today, per user
+	extensions   map[string]time.Duration
+	extensionDay string
 }
 
 // New - Create new Flywheel type
-func New(config *Config) *Flywheel {
+func New(config *Config, opts ...Option) *Flywheel {
+	o := newOptions(config, opts)
+	sess := o.sess
 
-	awsConfig := &aws.Config{Region: &config.Region}
-	sess := session.New(awsConfig)
-
-	return &Flywheel{
+	fw := &Flywheel{
+		logger:      o.logger,
+		clock:       o.clock,
+		notifier:    o.notifier,
+		drivers:     o.drivers,
 		hcInterval:  time.Duration(config.HcInterval),
+		jitter:      config.Jitter,
 		idleTimeout: time.Duration(config.IdleTimeout),
 		config:      config,
-		pings:       make(chan Ping),
-		stopAt:      time.Now(),
-		ec2:         ec2.New(sess),
-		autoscaling: autoscaling.New(sess),
+		pings:       make(chan Ping, PingQueueSize),
+		resized:     make(chan resizeResult),
+		refresh:     make(chan struct{}, 1),
+		health: HealthReport{
+			Infrastructure: HealthState{Status: HealthUnknown},
+			Application:    HealthState{Status: HealthUnknown},
+		},
+		stopAt:      o.clock.Now(),
+		ec2:         ec2.New(config.AWS.session(sess, "ec2")),
+		autoscaling: autoscaling.New(config.AWS.session(sess, "autoscaling")),
+		cloudwatch:  newQueryClient(config.AWS.session(sess, "monitoring"), "monitoring", "2010-08-01"),
+		elbv2:       newQueryClient(config.AWS.session(sess, "elasticloadbalancing"), "elasticloadbalancing", "2015-12-01"),
+		rds:         newQueryClient(config.AWS.session(sess, "rds"), "rds", "2014-10-31"),
+		ecs:         newJSONClient(config.AWS.session(sess, "ecs"), "ecs", "ecs", "AmazonEC2ContainerServiceV20141113"),
+		kube:        newKubeClient(&config.Kubernetes),
+		ssm:         newJSONClient(config.AWS.session(sess, "ssm"), "ssm", "ssm", "AmazonSSM"),
+		updates:     NewUpdateChecker(&config.UpdateCheck),
+		discovery:   NewDiscovery(&config.Backend.Discovery, config.AWS.session(sess, "servicediscovery"), o.clock),
+		calendar:    NewCalendar(&config.Calendar, o.clock),
+		mirror:      NewMirror(&config.Mirror, config.AWS.session(sess, "s3"), config.Region),
+		webhooks:    NewWebhookReplay(&config.WebhookReplay, config.AWS.session(sess, "sqs")),
+		store:       o.store,
+		refs:        newRefCounter(&config.Shared),
+		activity:    NewActivity(o.clock),
 	}
+	if config.HistoryFile != "" {
+		var err error
+		if fw.history, err = OpenHistory(config.HistoryFile); err != nil {
+			fw.logf("Unable to open history file: %v", err)
+		}
+	}
+	if config.RecordFile != "" {
+		var err error
+		if fw.recorder, err = OpenRecorder(config.RecordFile); err != nil {
+			fw.logf("Unable to open record file: %v", err)
+		}
+	}
+	fw.idle = fw.newIdleStrategy(&config.Idle)
+	fw.rampUp = NewRampUp(fw, &config.RampUp)
+	if config.Chaos.Enabled() {
+		fw.logf("Chaos mode: AWS calls are delayed %v-%v, %v fail, %v are throttled",
+			config.Chaos.Delay, config.Chaos.MaxDelay, config.Chaos.FailureRate, config.Chaos.ThrottleRate)
+	}
+	for _, c := range []*client.Client{fw.ec2.Client, fw.autoscaling.Client, fw.cloudwatch, fw.elbv2, fw.rds, fw.ecs, fw.ssm} {
+		c.Handlers.AfterRetry.PushBackNamed(awsErrorHandler)
+		if config.Chaos.Enabled() {
+			config.Chaos.install(c)
+		}
+	}
+	return fw
+}
+
+// MarshalJSON - include the error message, and its details for AWS errors
+func (p Pong) MarshalJSON() ([]byte, error) {
+	type pong Pong
+	out := struct {
+		pong
+		Error       string    `json:"error,omitempty"`
+		ErrorDetail *AWSError `json:"error-detail,omitempty"`
+	}{pong: pong(p)}
+	if p.Err != nil {
+		out.Error = p.Err.Error()
+		out.ErrorDetail = errorDetail(p.Err)
+	}
+	return json.Marshal(out)
+}
+
+// Snapshot - the status as of the last iteration of the flywheel goroutine.
+// It never blocks, so it's safe to use when the goroutine is busy.
+func (fw *Flywheel) Snapshot() Pong {
+	fw.snapshotMu.RLock()
+	pong := fw.snapshot
+	fw.snapshotMu.RUnlock()
+	pong.StopIn = pong.stopIn(fw.now())
+	return pong
+}
+
+// publish - update the snapshot
+func (fw *Flywheel) publish() {
+	pong := fw.statusPong()
+	fw.snapshotMu.Lock()
+	fw.snapshot = pong
+	fw.snapshotMu.Unlock()
+}
+
+// setHalted - record whether Run has returned
+func (fw *Flywheel) setHalted(halted bool) {
+	var ch chan struct{}
+	if halted {
+		ch = make(chan struct{})
+		close(ch)
+	}
+	fw.snapshotMu.Lock()
+	fw.halted = ch
+	fw.snapshotMu.Unlock()
+}
+
+// haltedChan - closed if Run has returned, nil before it runs or while it
+// does
+func (fw *Flywheel) haltedChan() <-chan struct{} {
+	fw.snapshotMu.RLock()
+	defer fw.snapshotMu.RUnlock()
+	return fw.halted
+}
+
+// History - the usage history, nil if not enabled
+func (fw *Flywheel) History() *History {
+	return fw.history
+}
+
+// Updates - the update checker, nil if not enabled
+func (fw *Flywheel) Updates() *UpdateChecker {
+	return fw.updates
+}
+
+// Recorder - the recording of the state machine's inputs, nil if not enabled
+func (fw *Flywheel) Recorder() *Recorder {
+	return fw.recorder
+}
+
+// setStatus - change the status, recording the transition
+func (fw *Flywheel) setStatus(status int) {
+	if fw.status == status {
+		return
+	}
+	now := fw.now()
+	fw.recorder.Record(RecordedEvent{Time: now, Kind: RecordTransition, From: StatusString(fw.status), Status: StatusString(status)})
+	cause := fw.cause
+	fw.cause = transitionCause{}
+	if cause.trigger == "" {
+		cause.trigger = TriggerHealth
+	}
+	fw.history.RecordTransition(now, fw.status, status, cause.trigger, cause.user)
+	if reason := stopReason(fw.status, status, cause.trigger); reason != "" {
+		fw.stopped(reason, cause.user, now)
+	}
+	if status == STOPPING || status == STOPPED {
+		fw.coldStart.cancel()
+	}
+	if fw.status == STARTING && status == STARTED && !fw.lastStarted.IsZero() {
+		fw.history.RecordStartup(now, now.Sub(fw.lastStarted))
+	}
+	if status == STARTED {
+		fw.startedAt = now
+	}
+	fw.status = status
+	fw.statusSince = now
+	fw.exportStatus()
+	fw.SaveState()
+}
+
+// transitionCause - the trigger and user of a start or stop
+type transitionCause struct {
+	trigger, user string
+}
+
+// because - record what causes the next transition
+func (fw *Flywheel) because(trigger, user string) {
+	fw.cause = transitionCause{trigger, user}
 }
 
 // ProxyEndpoint - retrieve the reverse proxy destination
 func (fw *Flywheel) ProxyEndpoint(hostname string) string {
+	return fw.proxyEndpoint(hostname, fw.Snapshot())
+}
+
+// proxyEndpoint - the vhost's endpoint, else the discovered or resolved
+// backend, else the configured endpoint. Runtime vhosts come first.
+func (fw *Flywheel) proxyEndpoint(hostname string, pong Pong) string {
+	if vhost, ok := pong.Vhosts[hostname]; ok {
+		return vhost
+	}
+	if vhost, ok := matchVhosts(pong.vhostPatterns, hostname); ok {
+		return vhost
+	}
 	vhost, ok := fw.config.Vhosts[hostname]
 	if ok {
 		return vhost
 	}
+	if vhost, ok := fw.config.vhostEndpoint(hostname); ok {
+		return vhost
+	}
+	if endpoint := fw.discovery.Endpoint(); endpoint != "" {
+		return endpoint
+	}
+	if pong.Endpoint != "" {
+		return pong.Endpoint
+	}
 	return fw.config.Endpoint
 }
 
-// Spin - Runs the main loop for the Flywheel.
+// Spin - Runs the main loop for the Flywheel, forever
 func (fw *Flywheel) Spin() {
-	hchan := make(chan int, 1)
+	fw.Run(context.Background())
+}
+
+// Run - Runs the main loop for the Flywheel until ctx is done. The loop and
+// the health watcher are restarted if they panic. Once it returns, nothing
+// changes the state, so it can be saved or handed over. Requests served
+// after that, e.g. while draining for an upgrade, don't wait for it.
+func (fw *Flywheel) Run(ctx context.Context) {
+	fw.setHalted(false)
+	defer fw.setHalted(true)
+	hchan := make(chan healthResult, 1)
 
-	go fw.HealthWatcher(hchan)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	background := func(name string, loop func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fw.supervise(ctx, name, loop)
+		}()
+	}
+	background("health watcher", func() { fw.HealthWatcher(ctx, hchan) })
+	if fw.webhooks != nil {
+		background("webhook replay", func() { fw.replayWebhooks(ctx) })
+	}
+	fw.supervise(ctx, "flywheel", func() { fw.spin(ctx, hchan) })
+}
+
+// spin - the flywheel loop
+func (fw *Flywheel) spin(ctx context.Context, hchan <-chan healthResult) {
+	var digest <-chan time.Time
+	if fw.config.Notify.DigestInterval > 0 {
+		ticker := fw.timeSource().NewTicker(time.Duration(fw.config.Notify.DigestInterval))
+		defer ticker.Stop()
+		digest = ticker.C()
+	}
 
-	ticker := time.NewTicker(SpinINTERVAL)
+	poll := fw.timeSource().NewTimer(fw.jittered(time.Duration(fw.config.PollInterval)))
+	defer poll.Stop()
+	fw.recorder.Record(RecordedEvent{Time: fw.now(), Kind: RecordState, Status: StatusString(fw.status), StopAt: fw.stopAt})
+	fw.publish()
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case ping := <-fw.pings:
-			fw.RecvPing(&ping)
-		case <-ticker.C:
+			if ping.requestStart && fw.status == STOPPED {
+				fw.coalesceStart(ping)
+			} else {
+				fw.RecvPing(&ping)
+			}
+		case <-poll.C():
+			fw.checkClock()
 			fw.Poll()
-		case status := <-hchan:
-			if fw.status != status {
-				log.Printf("Healthcheck - status is now %v", StatusString(status))
-				// Status may change from STARTED to UNHEALTHY to STARTED due
-				// to things like AWS RequestLimitExceeded errors.
-				// If there is an active timeout, keep it instead of resetting.
-				if status == STARTED && fw.stopAt.Before(time.Now()) {
-					fw.stopAt = time.Now().Add(fw.idleTimeout)
-					log.Printf("Timer update. Stop scheduled for %v", fw.stopAt)
-				}
-				fw.status = status
+			poll.Reset(fw.jittered(time.Duration(fw.config.PollInterval)))
+		case <-digest:
+			fw.Digest()
+		case result := <-fw.resized:
+			fw.resizeDone(result)
+		case result := <-hchan:
+			fw.applyHealthResult(result)
+		}
+		fw.publish()
+	}
+}
+
+// applyHealth - update the status from a health check result
+func (fw *Flywheel) applyHealth(status int) {
+	fw.recorder.Record(RecordedEvent{Time: fw.now(), Kind: RecordHealth, Status: StatusString(status)})
+	if len(fw.pendingStages) > 0 && status != UNHEALTHY {
+		// Later stages are still stopped, that's expected
+		status = STARTING
+	}
+	if fw.draining != nil && status != UNHEALTHY {
+		// Instances keep running until their connections are drained
+		status = STOPPING
+	}
+	if fw.recover(status) {
+		return
+	}
+	if fw.status != status {
+		fw.logf("Healthcheck - status is now %v", StatusString(status))
+		if status == STARTED && fw.status == STARTING {
+			fw.registerInstances()
+		}
+		// Status may change from STARTED to UNHEALTHY to STARTED due
+		// to things like AWS RequestLimitExceeded errors.
+		// If there is an active timeout, keep it instead of resetting.
+		if status == STARTED && fw.stopAt.Before(fw.now()) {
+			fw.restartIdleTimer()
+			fw.deadline = false
+			fw.logf("Timer update. Stop scheduled for %v", fw.stopAt)
+		}
+		fw.setStatus(status)
+	}
+}
+
+// now - the current time, or the replayed time
+func (fw *Flywheel) now() time.Time {
+	return fw.timeSource().Now()
+}
+
+// checkClock - log steps of the wall clock between polls. Timers run on the
+// monotonic clock and keep the time they had left; the times they're shown
+// with are moved with the wall clock.
+func (fw *Flywheel) checkClock() {
+	now := fw.now()
+	last := fw.lastPoll
+	fw.lastPoll = now
+	if last.IsZero() {
+		return
+	}
+	step := clockStep(last, now)
+	if step > -clockStepThreshold && step < clockStepThreshold {
+		return
+	}
+	fw.stopAt = rebase(fw.stopAt, now)
+	fw.idleSince = rebase(fw.idleSince, now)
+	fw.lastStarted = rebase(fw.lastStarted, now)
+	fw.nextStageAt = rebase(fw.nextStageAt, now)
+	fw.maintenanceDue = rebase(fw.maintenanceDue, now)
+	fw.logf("Wall clock stepped by %v, timers keep the time they had left. Stop scheduled for %v", step, fw.stopAt)
+	fw.exportStatus()
+}
+
+// stopIn - seconds left until the stop, zero unless started
+func (p *Pong) stopIn(now time.Time) int64 {
+	if p.Status != STARTED || !p.StopAt.After(now) {
+		return 0
+	}
+	return int64(p.StopAt.Sub(now) / time.Second)
+}
+
+// timeSource - the clock given to New, else the system clock
+func (fw *Flywheel) timeSource() Clock {
+	if fw.clock != nil {
+		return fw.clock
+	}
+	return SystemClock
+}
+
+// record - record a ping, for replays
+func (fw *Flywheel) record(ping Ping) {
+	if event, ok := recordPing(fw.now(), ping); ok {
+		fw.recorder.Record(event)
+	}
+}
+
+// coalesceStart - start once for all the start requests that are queued up,
+// e.g. when many users hit a stopped environment at once. They all get the
+// same reply.
+func (fw *Flywheel) coalesceStart(first Ping) {
+	starts := []Ping{first}
+	var others []Ping
+	for queued := true; queued; {
+		select {
+		case ping := <-fw.pings:
+			if ping.requestStart {
+				starts = append(starts, ping)
+			} else {
+				others = append(others, ping)
 			}
+		default:
+			queued = false
 		}
 	}
+
+	taken := starts[:0]
+	for _, ping := range starts {
+		if ping.take() {
+			taken = append(taken, ping)
+		} else {
+			close(ping.replyTo)
+		}
+	}
+	starts = taken
+	if len(starts) == 0 {
+		for i := range others {
+			fw.RecvPing(&others[i])
+		}
+		return
+	}
+
+	var users []string
+	for _, ping := range starts {
+		fw.record(ping)
+		users = append(users, ping.user)
+	}
+	err := fw.wakeFor(users)
+	fw.startRequests = len(starts)
+	pong := fw.statusPong()
+	pong.Err = err
+	for _, ping := range starts {
+		ping.replyTo <- pong
+		close(ping.replyTo)
+	}
+
+	for i := range others {
+		fw.RecvPing(&others[i])
+	}
+}
+
+// describeWaiting - report the start requests piling up while starting
+func (fw *Flywheel) describeWaiting(pong *Pong) {
+	if fw.status != STARTING || fw.startRequests < 2 {
+		return
+	}
+	pong.Waiting = fw.startRequests - 1
+	pong.Message = fmt.Sprintf("Start already in progress, %d users waiting", pong.Waiting)
 }
 
 // RecvPing - process user ping requests and update state if needed
 func (fw *Flywheel) RecvPing(ping *Ping) {
+	if !ping.take() {
+		// The caller timed out waiting and was told to try again
+		close(ping.replyTo)
+		return
+	}
 	var pong Pong
+	fw.record(*ping)
 
 	ch := ping.replyTo
 	defer close(ch)
 
+	if ping.readOnly != nil {
+		fw.setReadOnly(*ping.readOnly, ping.user)
+		ch <- fw.statusPong()
+		return
+	}
+	if ping.backendDown != "" {
+		fw.backendDown(ping.backendDown)
+		ch <- fw.statusPong()
+		return
+	}
+	if ping.annotate {
+		fw.annotate(ping.annotations, ping.user)
+		ch <- fw.statusPong()
+		return
+	}
+	if ping.vhost != nil {
+		err := fw.changeVhost(ping.vhost, ping.user)
+		pong = fw.statusPong()
+		pong.Err = err
+		ch <- pong
+		return
+	}
+
 	switch fw.status {
 	case STOPPED:
 		if ping.requestStart {
-			pong.Err = fw.Start()
+			pong.Err = fw.wakeFor([]string{ping.user})
+			fw.startRequests = 1
+		}
+
+	case STARTING:
+		if ping.requestStart {
+			fw.startRequests++
+		}
+
+	case UNHEALTHY:
+		if ping.requestStart && fw.recovery.failed {
+			// Automatic restarts gave up, someone tries again
+			fw.recovery = recoveryState{}
+			pong.Err = fw.wakeFor([]string{ping.user})
 		}
 
 	case STARTED:
-		if ping.noop {
+		if ping.idle && (fw.calendarHeld() || fw.scheduleHeld() || fw.blackout() != nil) {
+			// Held for a calendar event, until the scheduled stop or for a
+			// blackout window
+		} else if ping.idle {
+			fw.logf("Idle - shutting down")
+			fw.because(TriggerIdle, "")
+			pong.Err = fw.Stop()
+		} else if ping.noop {
 			// Status requests, etc. Don't update idle timer
 		} else if ping.requestStop {
-			pong.Err = fw.Stop()
+			if pong.Err = fw.confirmStop(ping); pong.Err == nil {
+				fw.because(TriggerStop, ping.user)
+				pong.Err = fw.Stop()
+			}
+		} else if ping.extend != 0 {
+			if pong.Err = fw.extend(ping.user, ping.extend); pong.Err == nil {
+				fw.clients.extended(ping.user, &fw.config.Clients, fw.now())
+			}
+		} else if !ping.stopAt.IsZero() {
+			pong.Err = fw.setDeadline(ping.stopAt)
 		} else if int64(ping.setTimeout) != 0 {
-			fw.stopAt = time.Now().Add(ping.setTimeout)
-			log.Printf("Timer update. Stop scheduled for %v", fw.stopAt)
+			pong.Err = fw.setDeadline(fw.now().Add(ping.setTimeout))
+		} else if fw.deadline {
+			// A stop time set through the API or an extension stays until
+			// it passes; requests don't bring it forward
+			fw.idleSince = fw.now()
 		} else {
-			fw.stopAt = time.Now().Add(fw.idleTimeout)
-			log.Printf("Timer update. Stop scheduled for %v", fw.stopAt)
+			fw.restartIdleTimer()
+			fw.logf("Timer update. Stop scheduled for %v", fw.stopAt)
 		}
 	}
 
-	pong.Status = fw.status
-	pong.StatusName = StatusString(fw.status)
-	pong.LastStarted = fw.lastStarted
-	pong.LastStopped = fw.lastStopped
-	pong.StopAt = fw.stopAt
+	if ping.extend != 0 && fw.status != STARTED {
+		pong.Err = fmt.Errorf("Cannot extend while %s", StatusString(fw.status))
+	}
+
+	err := pong.Err
+	pong = fw.statusPong()
+	pong.Err = err
+	if confirm, ok := err.(*ConfirmStopError); ok {
+		pong.StopRisks = confirm.Risks
+	}
 
 	ch <- pong
 }
 
+// setDeadline - schedule the stop for a specific time, as long as it's within
+// the maximum lifetime.
+func (fw *Flywheel) setDeadline(stopAt time.Time) error {
+	if !stopAt.After(fw.now()) {
+		return fmt.Errorf("Stop time %v is in the past", stopAt)
+	}
+	if max := time.Duration(fw.config.MaxLifetime); max > 0 {
+		limit := fw.lastStarted.Add(max)
+		if stopAt.After(limit) {
+			return fmt.Errorf("Stop time %v is beyond the maximum lifetime of %v (%v)", stopAt, max, limit)
+		}
+	}
+	fw.stopAt = rebase(stopAt, fw.now())
+	fw.deadline = true
+	fw.logf("Timer update. Stop scheduled for %v", fw.stopAt)
+	return nil
+}
+
+// extend - postpone the stop, within the daily and per user extension limits
+func (fw *Flywheel) extend(user string, d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("Invalid extension %v", d)
+	}
+
+	now := fw.now()
+	if day := now.Format("2006-01-02"); day != fw.extensionDay || fw.extensions == nil {
+		fw.extensions = make(map[string]time.Duration)
+		fw.extensionDay = day
+	}
+
+	if max := time.Duration(fw.config.MaxExtensionPerUser); max > 0 && fw.extensions[user]+d > max {
+		return fmt.Errorf("Extension refused: %s has %v of %v left today", user, max-fw.extensions[user], max)
+	}
+	if max := time.Duration(fw.config.MaxExtensionPerDay); max > 0 {
+		var total time.Duration
+		for _, e := range fw.extensions {
+			total += e
+		}
+		if total+d > max {
+			return fmt.Errorf("Extension refused: %v of %v left today", max-total, max)
+		}
+	}
+
+	from := fw.stopAt
+	if from.Before(now) {
+		from = now
+	}
+	if err := fw.setDeadline(from.Add(d)); err != nil {
+		return err
+	}
+	fw.extensions[user] += d
+	fw.logf("Extended by %v for %s", d, user)
+	return nil
+}
+
 // Poll - The periodic check for starting/stopping state transitions and idle
 // timeouts
 func (fw *Flywheel) Poll() {
+	fw.pollColdStart()
+	fw.pollCalendar()
+	fw.pollSchedule()
+	fw.pollBlackout()
+	fw.checkAnomalies()
+	fw.pruneHistory()
+	fw.startPendingStage()
+	fw.pollDownsize()
+
 	switch fw.status {
 	case STARTED:
-		if time.Now().After(fw.stopAt) {
-			fw.Stop()
-			log.Print("Idle timeout - shutting down")
-			fw.status = STOPPING
+		fw.pollIdleTimeouts()
+		// An idle strategy replaces the idle timeout
+		if fw.idle == nil && fw.now().After(fw.stopAt) && !fw.isReadOnly() && fw.blackout() == nil {
+			if fw.deadline {
+				fw.logf("Stop time reached - shutting down")
+				fw.because(TriggerDeadline, "")
+			} else {
+				fw.logf("Idle timeout - shutting down")
+				fw.because(TriggerIdleTimeout, "")
+			}
+			if err := fw.Stop(); err == nil {
+				fw.setStatus(STOPPING)
+			}
 		}
 
 	case STOPPING:
+		fw.pollDraining()
 		if fw.ready {
-			log.Print("Shutdown complete")
-			fw.status = STOPPED
+			fw.logf("Shutdown complete")
+			fw.setStatus(STOPPED)
 		}
 
 	case STARTING:
 		if fw.ready {
-			fw.status = STARTED
-			fw.stopAt = time.Now().Add(fw.idleTimeout)
-			log.Printf("Startup complete. Stop scheduled for %v", fw.stopAt)
+			fw.resolveBackend()
+			fw.setStatus(STARTED)
+			fw.restartIdleTimer()
+			fw.deadline = false
+			fw.logf("Startup complete. Stop scheduled for %v", fw.stopAt)
 		}
 	}
 }
 
 // Start all the resources managed by the flywheel.
 func (fw *Flywheel) Start() error {
-	fw.lastStarted = time.Now()
-	log.Print("Startup beginning")
+	if fw.isReadOnly() {
+		return ErrReadOnly
+	}
+	if err := fw.claim(STARTING); err != nil {
+		fw.cause = transitionCause{}
+		return err
+	}
+	fw.lastStarted = fw.now()
+	fw.warnings = nil
+	fw.draining = nil
+	fw.activity.Reset(fw.lastStarted)
+	fw.logf("Startup beginning")
 
 	var err error
-	err = fw.startInstances()
-
-	if err == nil {
-		err = fw.unterminateAutoScaling()
+	if fw.refs != nil {
+		err = fw.acquireShared()
 	}
+
 	if err == nil {
-		err = fw.startAutoScaling()
+		err = fw.startDrivers()
 	}
 
 	if err != nil {
-		log.Printf("Error starting: %v", err)
+		fw.logf("Error starting: %v", err)
+		fw.cause = transitionCause{}
 		return err
 	}
 
 	fw.ready = false
-	fw.stopAt = time.Now().Add(fw.idleTimeout)
-	fw.status = STARTING
+	fw.restartIdleTimer()
+	fw.deadline = false
+	fw.setStatus(STARTING)
+	fw.refreshHealth()
 	return nil
 }
 
-// Start EC2 instances
+// Start EC2 instances. Only the first stage is started here, the rest are
+// started by Poll once their delay has passed.
 func (fw *Flywheel) startInstances() error {
-	if len(fw.config.Instances) == 0 {
+	stages := fw.config.startStages()
+	if len(stages) == 0 {
 		return nil
 	}
-	log.Printf("Starting instances %v", fw.config.Instances)
-	_, err := fw.ec2.StartInstances(
-		&ec2.StartInstancesInput{
-			InstanceIds: fw.config.AwsInstances(),
-		},
-	)
-	return err
+	if err := fw.startStage(stages[0]); err != nil {
+		return err
+	}
+	fw.pendingStages = stages[1:]
+	if len(fw.pendingStages) > 0 {
+		fw.nextStageAt = fw.now().Add(fw.pendingStages[0].delay)
+	}
+	return nil
 }
 
-// UnterminateAutoScaling - Restore autoscaling group instances
+// UnterminateAutoScaling - Restore autoscaling group instances, and resume
+// the processes suspended by their policy
 func (fw *Flywheel) unterminateAutoScaling() error {
-	var err error
-	for groupName, size := range fw.config.AutoScaling.Terminate {
-		log.Printf("Restoring autoscaling group %s", groupName)
+	err := fw.checkLaunchTemplates()
+	if err != nil {
+		return err
+	}
+	policies := fw.config.AutoScaling.policies()
+	for groupName := range fw.config.AutoScaling.TerminateGroups() {
+		if fw.missing(groupName) || fw.config.Observed(groupName) || fw.deferred(ResourceAutoScalingGroup, groupName) {
+			continue
+		}
+		policy := policies[groupName]
+		fw.logf("Restoring autoscaling group %s", groupName)
 		_, err = fw.autoscaling.UpdateAutoScalingGroup(
 			&autoscaling.UpdateAutoScalingGroupInput{
-				AutoScalingGroupName: &groupName,
-				MaxSize:              &size,
-				MinSize:              &size,
+				AutoScalingGroupName: aws.String(groupName),
+				MaxSize:              aws.Int64(policy.MaxSize),
+				MinSize:              aws.Int64(policy.MinSize),
+				DesiredCapacity:      policy.DesiredCapacity,
 			},
 		)
 		if err != nil {
 			return err
 		}
+		if processes := policy.suspended(); len(processes) > 0 {
+			if err = fw.resumeGroup(groupName, processes); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
@@ -233,19 +1043,17 @@ func (fw *Flywheel) unterminateAutoScaling() error {
 // @note The autoscale group isn't unsuspended here. It's done by the
 //       healthcheck once all the instances are healthy.
 func (fw *Flywheel) startAutoScaling() error {
-	for _, groupName := range fw.config.AutoScaling.Stop {
-		log.Printf("Starting autoscaling group %s", groupName)
-
-		resp, err := fw.autoscaling.DescribeAutoScalingGroups(
-			&autoscaling.DescribeAutoScalingGroupsInput{
-				AutoScalingGroupNames: []*string{&groupName},
-			},
-		)
-		if err != nil {
-			return err
+	groupNames := fw.config.AutoScaling.StopGroups()
+	groups, err := fw.describeConfigured(groupNames)
+	if err != nil {
+		return err
+	}
+	for _, groupName := range groupNames {
+		group, ok := groups[groupName]
+		if !ok || fw.config.Observed(groupName) || fw.deferred(ResourceAutoScalingGroup, groupName) {
+			continue
 		}
-
-		group := resp.AutoScalingGroups[0]
+		fw.logf("Starting autoscaling group %s", groupName)
 
 		instanceIds := []*string{}
 		for _, instance := range group.Instances {
@@ -267,81 +1075,79 @@ func (fw *Flywheel) startAutoScaling() error {
 
 // Stop all resources managed by the flywheel
 func (fw *Flywheel) Stop() error {
-	fw.lastStopped = time.Now()
+	if fw.isReadOnly() {
+		return ErrReadOnly
+	}
+	if err := fw.claim(STOPPING); err != nil {
+		fw.cause = transitionCause{}
+		return err
+	}
+	fw.lastStopped = fw.now()
+	fw.pendingStages = nil
+	fw.protected = nil
 
 	var err error
-	err = fw.stopInstances()
-
+	if fw.refs != nil {
+		err = fw.releaseShared()
+	}
 	if err == nil {
-		err = fw.terminateAutoScaling()
+		err = fw.stopDownsized()
 	}
 	if err == nil {
-		err = fw.stopAutoScaling()
+		err = fw.stopDrivers()
 	}
 
 	if err != nil {
-		log.Printf("Error stopping: %v", err)
+		fw.logf("Error stopping: %v", err)
+		fw.cause = transitionCause{}
 		return err
 	}
 
 	fw.ready = false
-	fw.status = STOPPING
+	fw.setStatus(STOPPING)
+	fw.refreshHealth()
 	fw.stopAt = fw.lastStopped
 	return nil
 }
 
 // Stop EC2 instances
 func (fw *Flywheel) stopInstances() error {
-	if len(fw.config.Instances) == 0 {
+	ids := fw.undeferred(fw.config.stopInstanceIds())
+	if len(ids) == 0 {
 		return nil
 	}
-	log.Printf("Stopping instances %v", fw.config.Instances)
-	_, err := fw.ec2.StopInstances(
-		&ec2.StopInstancesInput{
-			InstanceIds: fw.config.AwsInstances(),
-		},
-	)
-	return err
+	fw.logf("Stopping instances %v", ids)
+	return fw.stopUnprotected(ids, "")
 }
 
-// Suspend ReplaceUnhealthy in an autoscale group and stop the instances.
+// Suspend the processes of an autoscale group that may terminate or replace
+// the stopped instances, and stop the instances. Groups in stop only have
+// ReplaceUnhealthy suspended.
 func (fw *Flywheel) stopAutoScaling() error {
-	for _, groupName := range fw.config.AutoScaling.Stop {
-		log.Printf("Stopping autoscaling group %s", groupName)
-
-		resp, err := fw.autoscaling.DescribeAutoScalingGroups(
-			&autoscaling.DescribeAutoScalingGroupsInput{
-				AutoScalingGroupNames: []*string{&groupName},
-			},
-		)
-		if err != nil {
-			return err
+	policies := fw.config.AutoScaling.policies()
+	groupNames := fw.config.AutoScaling.StopGroups()
+	groups, err := fw.describeConfigured(groupNames)
+	if err != nil {
+		return err
+	}
+	for _, groupName := range groupNames {
+		group, ok := groups[groupName]
+		if !ok || fw.config.Observed(groupName) || fw.deferred(ResourceAutoScalingGroup, groupName) {
+			continue
 		}
+		fw.logf("Stopping autoscaling group %s", groupName)
 
-		group := resp.AutoScalingGroups[0]
-
-		_, err = fw.autoscaling.SuspendProcesses(
-			&autoscaling.ScalingProcessQuery{
-				AutoScalingGroupName: group.AutoScalingGroupName,
-				ScalingProcesses: []*string{
-					aws.String("ReplaceUnhealthy"),
-				},
-			},
-		)
+		err = fw.suspendGroup(groupName, group, policies[groupName].suspended())
 		if err != nil {
 			return err
 		}
 
-		instanceIds := []*string{}
+		instanceIds := []string{}
 		for _, instance := range group.Instances {
-			instanceIds = append(instanceIds, instance.InstanceId)
+			instanceIds = append(instanceIds, aws.StringValue(instance.InstanceId))
 		}
 
-		_, err = fw.ec2.StopInstances(
-			&ec2.StopInstancesInput{
-				InstanceIds: instanceIds,
-			},
-		)
+		err = fw.stopUnprotected(instanceIds, groupName)
 		if err != nil {
 			return err
 		}
@@ -350,17 +1156,42 @@ func (fw *Flywheel) stopAutoScaling() error {
 	return nil
 }
 
-// Reduce autoscaling min/max instances to 0, causing the instances to be terminated.
+// Reduce autoscaling min/max instances to 0, causing the instances to be
+// terminated. Groups with a warm standby size keep that many instances.
 func (fw *Flywheel) terminateAutoScaling() error {
-	var err error
-	var zero int64
-	for groupName := range fw.config.AutoScaling.Terminate {
-		log.Printf("Terminating autoscaling group %s", groupName)
+	fw.recordLaunchTemplates()
+	policies := fw.config.AutoScaling.policies()
+	var groupNames []string
+	for groupName := range fw.config.AutoScaling.TerminateGroups() {
+		groupNames = append(groupNames, groupName)
+	}
+	sort.Strings(groupNames)
+	groups, err := fw.describeConfigured(groupNames)
+	if err != nil {
+		return err
+	}
+	for _, groupName := range groupNames {
+		group, ok := groups[groupName]
+		if !ok || fw.config.Observed(groupName) || fw.deferred(ResourceAutoScalingGroup, groupName) {
+			continue
+		}
+		if processes := policies[groupName].suspended(); len(processes) > 0 {
+			if err = fw.suspendGroup(groupName, group, processes); err != nil {
+				return err
+			}
+		}
+		size := fw.config.WarmStandby.AutoScaling[groupName]
+		if size > 0 {
+			fw.logf("Scaling autoscaling group %s down to %d warm standby instances", groupName, size)
+		} else {
+			fw.logf("Terminating autoscaling group %s", groupName)
+		}
+		fw.checkScaleInProtection(groupName, group, size)
 		_, err = fw.autoscaling.UpdateAutoScalingGroup(
 			&autoscaling.UpdateAutoScalingGroupInput{
 				AutoScalingGroupName: &groupName,
-				MaxSize:              &zero,
-				MinSize:              &zero,
+				MaxSize:              &size,
+				MinSize:              &size,
 			},
 		)
 		if err != nil {
@@ -372,64 +1203,54 @@ func (fw *Flywheel) terminateAutoScaling() error {
 
 // WriteStatusFile - Before we exit the application we write the current state
 func (fw *Flywheel) WriteStatusFile(statusFile string) {
-	var pong Pong
-
-	fd, err := os.OpenFile(statusFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Printf("Unable to write status file: %s", err)
-		return
-	}
-	defer fd.Close()
-
-	pong.Status = fw.status
-	pong.StatusName = StatusString(fw.status)
-	pong.LastStarted = fw.lastStarted
-	pong.LastStopped = fw.lastStopped
-
-	buf, err := json.Marshal(pong)
-	if err != nil {
-		log.Printf("Unable to write status file: %s", err)
-		return
-	}
-
-	_, err = fd.Write(buf)
+	err := FileStateStore(statusFile).Save(fw.statusPong())
 	if err != nil {
-		log.Printf("Unable to write status file: %s", err)
-		return
+		fw.logf("Unable to write status file: %s", err)
 	}
 }
 
 // ReadStatusFile load status from the status file
 func (fw *Flywheel) ReadStatusFile(statusFile string) {
-	fd, err := os.Open(statusFile)
+	status, err := FileStateStore(statusFile).Load()
 	if err != nil {
-		if err != os.ErrNotExist {
-			log.Printf("Unable to load status file: %v", err)
+		if err != ErrNoState {
+			fw.logf("Unable to load status file: %v", err)
 		}
 		return
 	}
 
-	stat, err := fd.Stat()
-	if err != nil {
-		log.Printf("Unable to load status file: %v", err)
-		return
-	}
+	fw.restore(status)
+}
 
-	buf := make([]byte, int(stat.Size()))
-	_, err = io.ReadFull(fd, buf)
-	if err != nil {
-		log.Printf("Unable to load status file: %v", err)
-		return
+// restore - take over a previously saved state
+func (fw *Flywheel) restore(status Pong) {
+	// Status isn't marshalled, only its name
+	if s, ok := StatusFromString(status.StatusName); ok {
+		fw.status = s
 	}
-
-	var status Pong
-	err = json.Unmarshal(buf, &status)
-	if err != nil {
-		log.Printf("Unable to load status file: %v", err)
-		return
-	}
-
-	fw.status = status.Status
-	fw.lastStarted = status.LastStarted
+	// Saved without monotonic readings
+	now := fw.now()
+	fw.lastStarted = rebase(status.LastStarted, now)
 	fw.lastStopped = status.LastStopped
+	fw.warnings = status.Warnings
+	fw.launchTemplates = status.LaunchTemplates
+	fw.originalTypes = status.OriginalTypes
+	fw.readOnly = status.ReadOnly
+	fw.endpoint = status.Endpoint
+	fw.startedAt = status.StartedAt
+	fw.statusSince = status.StatusSince
+	fw.vhosts = status.Vhosts
+	fw.compileRuntimeVhosts()
+	fw.lastStop = status.LastStop
+	fw.protected = status.Protected
+	fw.annotations = status.Annotations
+	fw.maintenance = status.Maintenance
+	fw.suspended.load(status.SuspendedProcesses)
+	fw.recovery.attempts = status.RecoveryAttempts
+	fw.recovery.failed = status.RecoveryFailed
+	fw.recovery.crashed = status.RecoveryAttempts > 0 || status.RecoveryFailed
+	if status.StopAt.After(now) {
+		fw.stopAt = rebase(status.StopAt, now)
+	}
+	fw.deadline = status.Deadline
 }
@@ -0,0 +1,2523 @@
+package flywheel
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestExtendLimits(t *testing.T) {
+	fw := &Flywheel{
+		config: &Config{
+			MaxExtensionPerDay:  Duration(3 * time.Hour),
+			MaxExtensionPerUser: Duration(2 * time.Hour),
+		},
+		status: STARTED,
+		stopAt: time.Now().Add(time.Hour),
+	}
+
+	stopAt := fw.stopAt
+	if err := fw.extend("alice", 90*time.Minute); err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	if !fw.stopAt.Equal(stopAt.Add(90 * time.Minute)) {
+		t.Errorf("Expected stop at %v, but got %v", stopAt.Add(90*time.Minute), fw.stopAt)
+	}
+
+	if err := fw.extend("alice", time.Hour); err == nil {
+		t.Errorf("Expected per user limit to refuse extension")
+	}
+	if err := fw.extend("bob", 90*time.Minute); err != nil {
+		t.Errorf("Expected no error, but got %s", err)
+	}
+	if err := fw.extend("carol", time.Minute); err == nil {
+		t.Errorf("Expected daily limit to refuse extension")
+	}
+}
+
+func TestExportStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flywheel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fw := &Flywheel{config: &Config{}, status: STOPPED}
+	fw.SetStatusFiles(StatusFiles{
+		JSON:       filepath.Join(dir, "status.json"),
+		Prometheus: filepath.Join(dir, "flywheel.prom"),
+		KeyValue:   filepath.Join(dir, "flywheel.env"),
+	})
+	fw.setStatus(STARTING)
+
+	prom, _ := ioutil.ReadFile(filepath.Join(dir, "flywheel.prom"))
+	if !strings.Contains(string(prom), `flywheel_status{status="STARTING"} 1`) {
+		t.Errorf("Expected STARTING status in prometheus file, but got %s", prom)
+	}
+
+	env, _ := ioutil.ReadFile(filepath.Join(dir, "flywheel.env"))
+	if !strings.HasPrefix(string(env), "FLYWHEEL_STATUS=STARTING\n") {
+		t.Errorf("Expected STARTING status in env file, but got %s", env)
+	}
+
+	restored := &Flywheel{config: &Config{}}
+	restored.ReadStatusFile(filepath.Join(dir, "status.json"))
+	if restored.status != STARTING {
+		t.Errorf("Expected STARTING status from status file, but got %s", StatusString(restored.status))
+	}
+}
+
+func TestCoalesceStart(t *testing.T) {
+	fw := &Flywheel{config: &Config{}, status: STOPPED, pings: make(chan Ping)}
+
+	replies := make(chan Pong, 5)
+	for i := 0; i < 4; i++ {
+		go func() {
+			replyTo := make(chan Pong, 1)
+			fw.pings <- Ping{requestStart: true, replyTo: replyTo}
+			replies <- <-replyTo
+		}()
+	}
+	// Let the other requests queue up
+	time.Sleep(50 * time.Millisecond)
+
+	first := Ping{requestStart: true, replyTo: make(chan Pong, 1)}
+	fw.coalesceStart(first)
+	replies <- <-first.replyTo
+
+	for i := 0; i < 5; i++ {
+		pong := <-replies
+		if pong.Status != STARTING || pong.Waiting != 4 {
+			t.Errorf("Expected STARTING with 4 waiting, but got %s with %d", pong.StatusName, pong.Waiting)
+		}
+	}
+	if fw.startRequests != 5 {
+		t.Errorf("Expected 5 start requests, but got %d", fw.startRequests)
+	}
+}
+
+type fixedIdle bool
+
+func (f fixedIdle) Idle(now time.Time) (bool, error) {
+	return bool(f), nil
+}
+
+func TestIdleStrategies(t *testing.T) {
+	now := time.Now()
+	activity := NewActivity(SystemClock)
+	activity.Reset(now.Add(-time.Hour))
+
+	tests := []struct {
+		name     string
+		strategy IdleStrategy
+		idle     bool
+	}{
+		{"all idle", compositeIdle{all: true, strategies: []IdleStrategy{fixedIdle(true), fixedIdle(true)}}, true},
+		{"all mixed", compositeIdle{all: true, strategies: []IdleStrategy{fixedIdle(true), fixedIdle(false)}}, false},
+		{"any mixed", compositeIdle{strategies: []IdleStrategy{fixedIdle(false), fixedIdle(true)}}, true},
+		{"any busy", compositeIdle{strategies: []IdleStrategy{fixedIdle(false), fixedIdle(false)}}, false},
+		{"connections quiet", connectionsIdle{activity, 30 * time.Minute}, true},
+		{"heartbeat recent", heartbeatIdle{activity, 2 * time.Hour}, false},
+	}
+	for _, test := range tests {
+		idle, err := test.strategy.Idle(now)
+		if err != nil || idle != test.idle {
+			t.Errorf("%s: Expected idle %v but got %v (%v)", test.name, test.idle, idle, err)
+		}
+	}
+
+	activity.Begin()
+	if idle, _ := (connectionsIdle{activity, 30 * time.Minute}).Idle(now); idle {
+		t.Errorf("Expected a request in flight not to be idle")
+	}
+	activity.End()
+}
+
+func TestAWSError(t *testing.T) {
+	handler := awsErrorHandler.Fn
+	tests := []struct {
+		operation string
+		params    interface{}
+		err       error
+		expected  string
+		kind      string
+	}{
+		{
+			"StartInstances",
+			&ec2.StartInstancesInput{InstanceIds: []*string{aws.String("i-1"), aws.String("i-2")}},
+			awserr.NewRequestFailure(awserr.New("UnauthorizedOperation", "You are not authorized", nil), 403, "req-1"),
+			"StartInstances on i-1, i-2 failed: UnauthorizedOperation: You are not authorized",
+			ErrorPermissions,
+		},
+		{
+			"UpdateAutoScalingGroup",
+			&autoscaling.UpdateAutoScalingGroupInput{AutoScalingGroupName: aws.String("web")},
+			awserr.New("InstanceLimitExceeded", "Your quota allows for 0 more running instance(s)", nil),
+			"UpdateAutoScalingGroup on web failed: InstanceLimitExceeded: Your quota allows for 0 more running instance(s)",
+			ErrorCapacity,
+		},
+		{
+			"DescribeInstances",
+			nil,
+			errors.New("connection refused"),
+			"DescribeInstances failed: connection refused",
+			ErrorOther,
+		},
+	}
+	for _, test := range tests {
+		r := &request.Request{Operation: &request.Operation{Name: test.operation}, Params: test.params, Error: test.err}
+		handler(r)
+		detail := errorDetail(r.Error)
+		if detail == nil {
+			t.Fatalf("Expected an AWSError, but got %#v", r.Error)
+		}
+		if detail.Error() != test.expected {
+			t.Errorf("Expected %q, but got %q", test.expected, detail.Error())
+		}
+		if detail.Kind != test.kind {
+			t.Errorf("Expected kind %s, but got %s", test.kind, detail.Kind)
+		}
+	}
+
+	buf, err := json.Marshal(Pong{StatusName: "stopped", Err: &AWSError{Operation: "StartInstances", Code: "UnauthorizedOperation", Kind: ErrorPermissions}})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	if !strings.Contains(string(buf), `"kind":"permissions"`) || !strings.Contains(string(buf), `"error":"StartInstances failed`) {
+		t.Errorf("Expected the error and its details, but got %s", buf)
+	}
+}
+
+func TestSupervise(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC))
+	fw := &Flywheel{config: &Config{}, clock: clock}
+	var runs int32
+	done := make(chan struct{})
+	go func() {
+		fw.supervise(context.Background(), "test", func() {
+			if atomic.AddInt32(&runs, 1) == 1 {
+				var m map[string]int
+				m["panic"] = 1
+			}
+		})
+		close(done)
+	}()
+
+	// Restarted once the delay has passed on the clock
+	for clock.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Errorf("Expected 1 run before the restart delay, but got %d", n)
+	}
+	clock.Advance(RestartDelay)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the loop to be restarted and return, but it didn't")
+	}
+	if n := atomic.LoadInt32(&runs); n != 2 {
+		t.Errorf("Expected 2 runs, but got %d", n)
+	}
+}
+
+func TestJittered(t *testing.T) {
+	tests := []struct {
+		jitter   float64
+		min, max time.Duration
+	}{
+		{0, 10 * time.Second, 10 * time.Second},
+		{0.1, 9 * time.Second, 11 * time.Second},
+		{0.5, 5 * time.Second, 15 * time.Second},
+	}
+	for _, test := range tests {
+		fw := &Flywheel{jitter: test.jitter}
+		for i := 0; i < 100; i++ {
+			if d := fw.jittered(10 * time.Second); d < test.min || d > test.max {
+				t.Fatalf("Expected between %v and %v for jitter %v, but got %v", test.min, test.max, test.jitter, d)
+			}
+		}
+	}
+
+	c := &Config{Endpoint: "dev.example.com", Instances: []string{"i-deadbeef"}, Jitter: 1}
+	if err := c.Validate(); err == nil {
+		t.Errorf("Expected an error for jitter 1, but got nil")
+	}
+}
+
+func TestBatches(t *testing.T) {
+	var values []string
+	for i := 0; i < 250; i++ {
+		values = append(values, fmt.Sprintf("i-%d", i%210))
+	}
+
+	var sizes []int
+	batches(values, func(batch []string) error {
+		sizes = append(sizes, len(batch))
+		return nil
+	})
+	if fmt.Sprint(sizes) != "[100 100 10]" {
+		t.Errorf("Expected batches of [100 100 10], but got %v", sizes)
+	}
+
+	called := false
+	batches(nil, func([]string) error {
+		called = true
+		return nil
+	})
+	if called {
+		t.Errorf("Expected no call for no values, but got one")
+	}
+}
+
+func TestCheckDescribed(t *testing.T) {
+	instance := func(id, state string) *ec2.Instance {
+		return &ec2.Instance{InstanceId: aws.String(id), State: &ec2.InstanceState{Name: aws.String(state)}}
+	}
+	fw := &Flywheel{
+		config: &Config{
+			Instances: []string{"i-1", "i-2"},
+			AutoScaling: AutoScalingConfig{
+				Stop:     []string{"workers"},
+				WarmPool: map[string]int64{"web": 2},
+			},
+		},
+	}
+	d := &described{
+		instances: map[string]*ec2.Instance{
+			"i-1": instance("i-1", "running"),
+			"i-2": instance("i-2", "pending"),
+			"i-3": instance("i-3", "running"),
+		},
+		groups: map[string]*autoscaling.Group{
+			"workers": {
+				AutoScalingGroupName: aws.String("workers"),
+				Instances:            []*autoscaling.Instance{{InstanceId: aws.String("i-3")}},
+			},
+			"web": {
+				AutoScalingGroupName: aws.String("web"),
+				DesiredCapacity:      aws.Int64(2),
+			},
+		},
+	}
+
+	var states healthStates
+	fw.checkInstances(d, &states)
+	if err := fw.checkStoppedAutoScalingGroups(d, &states); err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	fw.checkWarmPoolAutoScalingGroups(d, &states)
+
+	if health := states.counts(); health["running"] != 2 || health["pending"] != 2 {
+		t.Errorf("Expected 2 running and 2 pending, but got %v", health)
+	}
+}
+
+func TestBackend(t *testing.T) {
+	c := &Config{
+		Endpoint:    "static.example.com",
+		Vhosts:      map[string]string{"admin.example.com": "admin.backend"},
+		Instances:   []string{"i-1"},
+		AutoScaling: AutoScalingConfig{Stop: []string{"web"}},
+		Backend:     BackendConfig{InstanceTag: "Role=lb", Port: 8080},
+	}
+	if err := c.Backend.Validate(); err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+
+	lb := &ec2.Instance{
+		InstanceId:       aws.String("i-2"),
+		PrivateIpAddress: aws.String("10.0.0.5"),
+		Tags:             []*ec2.Tag{{Key: aws.String("aws:autoscaling:groupName"), Value: aws.String("web")}},
+	}
+	other := &ec2.Instance{
+		InstanceId: aws.String("i-3"),
+		Tags:       []*ec2.Tag{{Key: aws.String("aws:autoscaling:groupName"), Value: aws.String("other")}},
+	}
+	if !c.managesInstance(lb) || c.managesInstance(other) {
+		t.Errorf("Expected only instances of managed groups to be managed")
+	}
+	if endpoint := c.Backend.hostPort(c.Backend.instanceAddress(lb)); endpoint != "10.0.0.5:8080" {
+		t.Errorf("Expected 10.0.0.5:8080, but got %s", endpoint)
+	}
+
+	fw := &Flywheel{config: c}
+	tests := []struct {
+		host, resolved, endpoint string
+	}{
+		{"www.example.com", "", "static.example.com"},
+		{"www.example.com", "10.0.0.5:8080", "10.0.0.5:8080"},
+		{"admin.example.com", "10.0.0.5:8080", "admin.backend"},
+	}
+	for _, test := range tests {
+		if endpoint := fw.proxyEndpoint(test.host, Pong{Endpoint: test.resolved}); endpoint != test.endpoint {
+			t.Errorf("Expected %s for %s, but got %s", test.endpoint, test.host, endpoint)
+		}
+	}
+
+	invalid := []BackendConfig{
+		{InstanceTag: "Role"},
+		{InstanceTag: "Role=lb", LoadBalancerGroup: "web"},
+		{InstanceTag: "Role=lb", Address: "mac"},
+	}
+	for _, b := range invalid {
+		if err := b.Validate(); err == nil {
+			t.Errorf("Expected an error for %+v", b)
+		}
+	}
+}
+
+func TestResourceHealth(t *testing.T) {
+	c := &Config{
+		Instances:   []string{"i-1", "i-2"},
+		AutoScaling: AutoScalingConfig{Stop: []string{"workers"}},
+	}
+	d := &described{
+		instances: map[string]*ec2.Instance{
+			"i-1": {InstanceId: aws.String("i-1"), State: &ec2.InstanceState{Name: aws.String("running")}},
+			"i-3": {InstanceId: aws.String("i-3"), State: &ec2.InstanceState{Name: aws.String("stopped")}},
+			"i-4": {InstanceId: aws.String("i-4"), State: &ec2.InstanceState{Name: aws.String("running")}},
+		},
+		groups: map[string]*autoscaling.Group{
+			"workers": {Instances: []*autoscaling.Instance{{InstanceId: aws.String("i-3")}, {InstanceId: aws.String("i-4")}}},
+		},
+	}
+
+	var h resourceHealth
+	now := time.Now()
+	h.record(c, d, nil, now)
+	h.fail(ResourceAutoScalingGroup, "workers", errors.New("Throttling"), now)
+
+	expected := []ResourceHealth{
+		{Type: ResourceAutoScalingGroup, ID: "workers", State: "mixed: running, stopped", CheckedAt: now, LastError: "Throttling", LastErrorAt: now},
+		{Type: ResourceInstance, ID: "i-1", State: "running", CheckedAt: now},
+		{Type: ResourceInstance, ID: "i-2", State: "not-found", CheckedAt: now},
+	}
+	if list := h.list(); fmt.Sprint(list) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, but got %v", expected, list)
+	}
+
+	h.record(c, nil, errors.New("RequestLimitExceeded"), now)
+	for _, r := range h.list() {
+		if r.State != "unknown" || r.LastError != "RequestLimitExceeded" {
+			t.Errorf("Expected the describe error for %s, but got %+v", r.ID, r)
+		}
+	}
+}
+
+func TestInstanceScheduler(t *testing.T) {
+	c := &Config{
+		Instances:         []string{"i-1", "i-2", "i-3"},
+		InstanceScheduler: InstanceSchedulerConfig{Mode: SchedulerDefer},
+	}
+	if err := c.InstanceScheduler.Validate(); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	schedule := func(value string) []*ec2.Tag {
+		return []*ec2.Tag{{Key: aws.String(DefaultScheduleTag), Value: aws.String(value)}}
+	}
+	d := &described{
+		instances: map[string]*ec2.Instance{
+			"i-1": {State: &ec2.InstanceState{Name: aws.String("running")}, Tags: schedule("office-hours")},
+			"i-2": {State: &ec2.InstanceState{Name: aws.String("running")}, Tags: schedule("flywheel")},
+			"i-3": {State: &ec2.InstanceState{Name: aws.String("running")}},
+		},
+	}
+	fw := &Flywheel{config: c}
+	fw.resources.record(c, d, nil, time.Now())
+
+	if ids := fw.undeferred(c.Instances); fmt.Sprint(ids) != "[i-2 i-3]" {
+		t.Errorf("Expected i-1 to be left to Instance Scheduler, but got %v", ids)
+	}
+	expected := []SchedulerConflict{{Type: ResourceInstance, ID: "i-1", Schedule: "office-hours", Action: SchedulerDefer}}
+	if conflicts := fw.schedulerConflicts(); fmt.Sprint(conflicts) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, but got %v", expected, conflicts)
+	}
+
+	// Owned, the previous schedule is still reported
+	c.InstanceScheduler.Mode = SchedulerOwn
+	d.instances["i-1"].Tags = append(schedule("flywheel"), &ec2.Tag{Key: aws.String(PreviousScheduleTag), Value: aws.String("office-hours")})
+	fw.resources.record(c, d, nil, time.Now())
+	if ids := fw.undeferred(c.Instances); len(ids) != 3 {
+		t.Errorf("Expected all instances to be owned, but got %v", ids)
+	}
+	expected[0].Action = SchedulerOwn
+	if conflicts := fw.schedulerConflicts(); fmt.Sprint(conflicts) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, but got %v", expected, conflicts)
+	}
+
+	c.InstanceScheduler.Mode = "maybe"
+	if err := c.InstanceScheduler.Validate(); err == nil {
+		t.Errorf("Expected an error for an unknown mode")
+	}
+}
+
+func TestConfirmStop(t *testing.T) {
+	c := &Config{
+		Instances: []string{"i-db", "i-web"},
+		AutoScaling: AutoScalingConfig{
+			Terminate: map[string]int64{"cache": 2, "app": 2},
+		},
+		StopConfirmation: StopConfirmationConfig{Stateful: []string{"cache"}},
+	}
+	c.StopConfirmation.Validate()
+	d := &described{
+		instances: map[string]*ec2.Instance{
+			"i-db": {
+				State: &ec2.InstanceState{Name: aws.String("running")},
+				Tags:  []*ec2.Tag{{Key: aws.String(DefaultStatefulTag), Value: aws.String("true")}},
+			},
+			"i-web": {
+				State: &ec2.InstanceState{Name: aws.String("running")},
+				Tags:  []*ec2.Tag{{Key: aws.String(DefaultStatefulTag), Value: aws.String("false")}},
+			},
+		},
+	}
+	clock := NewFakeClock(time.Now())
+	fw := &Flywheel{config: c, clock: clock}
+	fw.resources.record(c, d, nil, clock.Now())
+
+	expected := []StopRisk{
+		{Type: ResourceAutoScalingGroup, ID: "cache", Action: StopActionTerminate, Risk: stopRisks[StopActionTerminate]},
+		{Type: ResourceInstance, ID: "i-db", Action: StopActionStop, Risk: stopRisks[StopActionStop]},
+	}
+	if risks := fw.statefulRisks(); fmt.Sprint(risks) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, but got %v", expected, risks)
+	}
+
+	tests := []struct {
+		user      string
+		confirmed bool
+		after     time.Duration
+		ok        bool
+	}{
+		{"alice", false, 0, false},
+		{"bob", false, time.Second, false},
+		{"bob", false, 2 * time.Second, true},
+		{"alice", false, 2 * time.Minute, false},
+		{"alice", false, 4 * time.Minute, false},
+		{"alice", true, 0, true},
+	}
+	for _, test := range tests {
+		clock.Advance(test.after)
+		err := fw.confirmStop(&Ping{requestStop: true, user: test.user, confirmed: test.confirmed})
+		if _, refused := err.(*ConfirmStopError); refused == test.ok {
+			t.Errorf("Expected ok %v for %s after %v, but got %v", test.ok, test.user, test.after, err)
+		}
+	}
+}
+
+func TestClients(t *testing.T) {
+	c := &ClientsConfig{
+		OddHours:  ClockWindow{From: "22:00", To: "06:00", Timezone: "UTC"},
+		FlagAfter: 2,
+		Block:     true,
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+
+	var tracker clientTracker
+	at := func(day int, clock string) time.Time {
+		t, _ := time.Parse("2006-01-02 15:04", fmt.Sprintf("2026-10-%02d %s", day, clock))
+		return t
+	}
+	tests := []struct {
+		now     time.Time
+		clients []string
+		waker   string
+		flagged bool
+	}{
+		{at(1, "03:00"), []string{"cron"}, "cron", false},
+		{at(1, "12:00"), []string{"alice"}, "alice", false},
+		{at(2, "03:00"), []string{"cron"}, "cron", true},
+		{at(3, "03:00"), []string{"cron"}, "", false},
+		{at(3, "03:00"), []string{"cron", "alice"}, "alice", false},
+		{at(3, "12:00"), []string{"cron"}, "cron", false},
+		// The first odd-hour wake-up is out of the window by now, so this
+		// one is let through, and flags again
+		{at(8, "23:00"), []string{"cron"}, "cron", true},
+	}
+	for i, test := range tests {
+		waker, ok := tracker.waker(test.clients, c, test.now)
+		if waker != test.waker || ok != (test.waker != "") {
+			t.Errorf("Expected waker %q for wake-up %d, but got %q", test.waker, i, waker)
+		}
+		if ok {
+			if flagged := tracker.wokeUp(waker, c, test.now); flagged != test.flagged {
+				t.Errorf("Expected flagged %v for wake-up %d, but got %v", test.flagged, i, flagged)
+			}
+		}
+	}
+	tracker.extended("alice", c, at(8, "23:00"))
+
+	report := tracker.report(c, at(8, "23:00"))
+	expected := []ClientActivity{
+		{Client: "cron", WakeUps: 3, OddHourWakeUps: 2, LastWakeUp: at(8, "23:00"), Flagged: true, Blocked: 1},
+		{Client: "alice", WakeUps: 1, OddHourWakeUps: 1, Extensions: 1, LastWakeUp: at(3, "03:00")},
+	}
+	if fmt.Sprint(report) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, but got %v", expected, report)
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	config := &Config{Recovery: RecoveryConfig{Attempts: 2}}
+	config.Recovery.Validate()
+	start := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	fw := &Flywheel{config: config, status: STARTED, clock: clock, refresh: make(chan struct{}, 1)}
+
+	tests := []struct {
+		after    time.Duration
+		health   int
+		status   int
+		attempts int
+	}{
+		{0, STOPPING, STOPPING, 0},
+		{10 * time.Second, STOPPED, STARTING, 1},
+		{20 * time.Second, STOPPED, UNHEALTHY, 1},
+		{70 * time.Second, STOPPED, STARTING, 2},
+		{3 * time.Minute, STOPPED, UNHEALTHY, 2},
+		// Given up, it stays UNHEALTHY
+		{4 * time.Minute, STOPPED, UNHEALTHY, 2},
+	}
+	for i, test := range tests {
+		clock.Set(start.Add(test.after))
+		fw.applyHealth(test.health)
+		if fw.status != test.status || fw.recovery.attempts != test.attempts {
+			t.Errorf("Expected %s after %d attempts for check %d, but got %s after %d",
+				StatusString(test.status), test.attempts, i, StatusString(fw.status), fw.recovery.attempts)
+		}
+	}
+	if pong := fw.statusPong(); !pong.RecoveryFailed {
+		t.Errorf("Expected recovery-failed, but got %v", pong.RecoveryFailed)
+	}
+
+	ping := Ping{requestStart: true, replyTo: make(chan Pong, 1)}
+	fw.RecvPing(&ping)
+	if pong := <-ping.replyTo; pong.Status != STARTING || pong.RecoveryFailed {
+		t.Errorf("Expected a manual start, but got %s", pong.StatusName)
+	}
+	fw.applyHealth(STARTED)
+
+	// Describe errors aren't taken for a crash
+	fw.applyHealth(UNHEALTHY)
+	if fw.status != UNHEALTHY || fw.recovery.attempts != 0 {
+		t.Errorf("Expected no restart while UNHEALTHY, but got %s after %d attempts", StatusString(fw.status), fw.recovery.attempts)
+	}
+}
+
+func TestHealthDimensions(t *testing.T) {
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			http.Error(w, "broken deploy", http.StatusInternalServerError)
+		}
+	}))
+	defer app.Close()
+
+	config := &Config{Endpoint: strings.TrimPrefix(app.URL, "http://")}
+	config.AppHealth.Validate()
+	fw := &Flywheel{config: config, status: STARTED}
+
+	tests := []struct {
+		url            string
+		result         healthResult
+		infrastructure string
+		application    string
+		status         int
+	}{
+		{"", healthResult{status: STARTED}, HealthHealthy, HealthUnknown, STARTED},
+		{"/healthz", healthResult{status: STARTED, probed: true}, HealthHealthy, HealthHealthy, STARTED},
+		{"/broken", healthResult{status: UNHEALTHY, probed: true}, HealthHealthy, HealthUnhealthy, UNHEALTHY},
+		{"", healthResult{status: UNHEALTHY, infrastructure: "Throttling: Rate exceeded"}, HealthUnhealthy, HealthUnknown, UNHEALTHY},
+	}
+	for i, test := range tests {
+		result := test.result
+		if test.url != "" {
+			fw.config.AppHealth.URL = test.url
+			if err := fw.probeApplication(); err != nil {
+				result.application = err.Error()
+			}
+		}
+		fw.applyHealthResult(result)
+		health := fw.statusPong().Health
+		if health.Infrastructure.Status != test.infrastructure || health.Application.Status != test.application || fw.status != test.status {
+			t.Errorf("Expected %s infrastructure, %s application and %s for check %d, but got %v and %s",
+				test.infrastructure, test.application, StatusString(test.status), i, health, StatusString(fw.status))
+		}
+	}
+	if reason := fw.health.Infrastructure.Reason; reason != "Throttling: Rate exceeded" {
+		t.Errorf("Expected the throttling reason, but got %q", reason)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	c := &DiagnosticsConfig{}
+	c.Validate()
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	reasons := []struct {
+		pong   Pong
+		reason string
+	}{
+		{Pong{Status: STARTING, LastStarted: now.Add(-5 * time.Minute)}, ""},
+		{Pong{Status: STARTING, LastStarted: now.Add(-12 * time.Minute)}, "STARTING for 12m0s"},
+		{Pong{Status: UNHEALTHY, LastStarted: now.Add(-time.Minute)}, "UNHEALTHY while starting"},
+		// Started fine, broke later
+		{Pong{Status: UNHEALTHY, LastStarted: now.Add(-time.Hour), StartedAt: now.Add(-50 * time.Minute)}, ""},
+		{Pong{Status: STOPPED}, ""},
+	}
+	for i, test := range reasons {
+		if reason := c.diagnosticsReason(test.pong, now); reason != test.reason {
+			t.Errorf("Expected reason %q for status %d, but got %q", test.reason, i, reason)
+		}
+	}
+
+	output := base64.StdEncoding.EncodeToString([]byte("line 1\r\nline 2\r\nKernel panic\r\n"))
+	if tail, err := consoleTail(output, 2); err != nil || tail != "line 2\nKernel panic" {
+		t.Errorf("Expected the last 2 lines, but got %q, %v", tail, err)
+	}
+
+	instance := &ec2.Instance{InstanceId: aws.String("i-1"), State: &ec2.InstanceState{Name: aws.String("running")}}
+	status := &ec2.InstanceStatus{
+		SystemStatus: &ec2.InstanceStatusSummary{Status: aws.String("ok")},
+		InstanceStatus: &ec2.InstanceStatusSummary{
+			Status: aws.String("impaired"),
+			Details: []*ec2.InstanceStatusDetails{
+				{Name: aws.String("reachability"), Status: aws.String("failed")},
+			},
+		},
+	}
+	diag := instanceDiagnostics(instance, status)
+	if diag.InstanceStatus != "impaired" || fmt.Sprint(diag.Details) != "[instance reachability: failed]" {
+		t.Errorf("Expected the failed reachability check, but got %+v", diag)
+	}
+}
+
+func TestChaos(t *testing.T) {
+	tests := []struct {
+		config ChaosConfig
+		code   string
+	}{
+		{ChaosConfig{FailureRate: 1}, "InternalError"},
+		{ChaosConfig{ThrottleRate: 1}, "RequestLimitExceeded"},
+		{ChaosConfig{FailureRate: 1, Operations: []string{"StopInstances"}}, ""},
+	}
+	for _, test := range tests {
+		sent := false
+		r := &request.Request{
+			Operation:  &request.Operation{Name: "StartInstances"},
+			ClientInfo: metadata.ClientInfo{ServiceName: "ec2"},
+		}
+		if !test.config.applies(r.Operation.Name) {
+			sent = true
+		} else {
+			test.config.send(r)
+		}
+
+		if test.code == "" {
+			if !sent {
+				t.Errorf("Expected the request to be sent, but got %v", r.Error)
+			}
+			continue
+		}
+		aerr, ok := r.Error.(awserr.Error)
+		if !ok || aerr.Code() != test.code {
+			t.Errorf("Expected %s, but got %v", test.code, r.Error)
+		}
+	}
+
+	c := ChaosConfig{FailureRate: 0.6, ThrottleRate: 0.6}
+	if err := c.Validate(); err == nil {
+		t.Errorf("Expected an error for rates above 1, but got nil")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	var recording bytes.Buffer
+	start := time.Date(2016, 6, 6, 9, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	fw := &Flywheel{
+		config:      &Config{PollInterval: Duration(time.Second)},
+		idleTimeout: time.Hour,
+		clock:       clock,
+		recorder:    &Recorder{enc: json.NewEncoder(&recording)},
+	}
+	fw.recorder.Record(RecordedEvent{Time: start, Kind: RecordState, Status: "STOPPED"})
+
+	// Started by a user, healthy, requests until 10:00, then idle
+	fw.coalesceStart(Ping{requestStart: true, user: "alice", replyTo: make(chan Pong, 1)})
+	clock.Advance(5 * time.Minute)
+	fw.applyHealth(STARTED)
+	clock.Advance(55 * time.Minute)
+	fw.RecvPing(&Ping{replyTo: make(chan Pong, 1)})
+	clock.Advance(time.Hour + time.Second)
+	fw.Poll()
+	clock.Advance(time.Minute)
+	fw.applyHealth(STOPPED)
+
+	events, err := ReadRecording(&recording)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+
+	var out bytes.Buffer
+	if mismatches := Replay(&Config{IdleTimeout: Duration(time.Hour), PollInterval: Duration(time.Second)}, events, &out); mismatches != 0 {
+		t.Errorf("Expected no mismatches, but got %d:\n%s", mismatches, out.String())
+	}
+	if !strings.Contains(out.String(), "2016-06-06T11:00:01Z idle timeout") {
+		t.Errorf("Expected the idle timeout at 11:00:01, but got:\n%s", out.String())
+	}
+
+	// A longer idle timeout wouldn't have stopped
+	out.Reset()
+	if mismatches := Replay(&Config{IdleTimeout: Duration(3 * time.Hour), PollInterval: Duration(time.Second)}, events, &out); mismatches == 0 {
+		t.Errorf("Expected mismatches with a longer idle timeout, but got none:\n%s", out.String())
+	}
+}
+
+type memStateStore struct {
+	pong Pong
+}
+
+func (s *memStateStore) Load() (Pong, error) { return s.pong, nil }
+func (s *memStateStore) Save(pong Pong) error {
+	s.pong = pong
+	return nil
+}
+
+type notifications []Notification
+
+func (n *notifications) Notify(notification Notification) {
+	*n = append(*n, notification)
+}
+
+func TestOptions(t *testing.T) {
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unexpected AWS call", http.StatusBadRequest)
+	}))
+	defer endpoint.Close()
+
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	var logs bytes.Buffer
+	store := &memStateStore{pong: Pong{StatusName: "STARTED", StopAt: now.Add(time.Hour)}}
+	var sent notifications
+	config := &Config{PollInterval: Duration(time.Minute), HcInterval: Duration(time.Minute)}
+	fw := New(config,
+		WithClock(NewFakeClock(now)),
+		WithLogger(log.New(&logs, "", 0)),
+		WithStateStore(store),
+		WithNotifier(&sent),
+		WithProvider(session.New(&aws.Config{Region: aws.String("us-east-1"), Endpoint: aws.String(endpoint.URL)})),
+	)
+
+	if !fw.now().Equal(now) {
+		t.Errorf("Expected the injected time but got %v", fw.now())
+	}
+	fw.LoadState()
+	if fw.status != STARTED || !fw.stopAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("Expected the state of the injected store but got %s until %v", StatusString(fw.status), fw.stopAt)
+	}
+	if got := fw.ec2.Endpoint; got != endpoint.URL {
+		t.Errorf("Expected clients of the injected session but got %s", got)
+	}
+
+	fw.notify(NotifyError, "Something broke")
+	if len(sent) != 1 || sent[0].Message != "Something broke" {
+		t.Errorf("Expected the notification to be delivered to the notifier but got %v", sent)
+	}
+	if !strings.Contains(logs.String(), "Notification (error): Something broke") {
+		t.Errorf("Expected the notification in the injected log but got %q", logs.String())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		fw.Run(ctx)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Run to return once the context was done, but it didn't")
+	}
+}
+
+func TestFakeClockIdleTimeout(t *testing.T) {
+	var stopped int32
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.Form.Get("Action") {
+		case "DescribeInstances":
+			state := "running"
+			if atomic.LoadInt32(&stopped) == 1 {
+				state = "stopped"
+			}
+			fmt.Fprintf(w, `<DescribeInstancesResponse><reservationSet><item><instancesSet><item>
+				<instanceId>i-web</instanceId><instanceState><name>%s</name></instanceState>
+			</item></instancesSet></item></reservationSet></DescribeInstancesResponse>`, state)
+		case "StopInstances":
+			atomic.StoreInt32(&stopped, 1)
+			fmt.Fprint(w, `<StopInstancesResponse></StopInstancesResponse>`)
+		default:
+			http.Error(w, "unexpected AWS call", http.StatusBadRequest)
+		}
+	}))
+	defer endpoint.Close()
+
+	start := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	config := &Config{
+		Instances:    []string{"i-web"},
+		PollInterval: Duration(time.Minute),
+		HcInterval:   Duration(2 * time.Hour),
+		IdleTimeout:  Duration(time.Hour),
+	}
+	fw := New(config,
+		WithClock(clock),
+		WithStateStore(&memStateStore{pong: Pong{StatusName: "STARTED", StopAt: start.Add(time.Hour)}}),
+		WithProvider(session.New(&aws.Config{
+			Region:      aws.String("us-east-1"),
+			Endpoint:    aws.String(endpoint.URL),
+			Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		})),
+	)
+	fw.LoadState()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go fw.Run(ctx)
+
+	waitFor := func(what string, ok func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !ok() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %s, but it didn't happen", what)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// The poll and health check timers
+	waitFor("the timers to be set", func() bool { return clock.Waiters() == 2 })
+
+	clock.Advance(59 * time.Minute)
+	waitFor("a poll", func() bool { return clock.Waiters() == 2 })
+	if status := fw.Snapshot().Status; status != STARTED {
+		t.Errorf("Expected STARTED before the idle timeout, but got %s", StatusString(status))
+	}
+
+	clock.Advance(2 * time.Minute)
+	waitFor("the idle timeout to stop the environment", func() bool { return fw.Snapshot().Status != STARTED })
+	if status := fw.Snapshot().Status; status != STOPPING {
+		t.Errorf("Expected STOPPING after the idle timeout, but got %s", StatusString(status))
+	}
+}
+
+func TestHealthRules(t *testing.T) {
+	states := healthStates{
+		{"i-1", "running", 1},
+		{"i-2", "running", 1},
+		{"i-3", "running", 1},
+		{"i-4", "stopped", 1},
+		{"web", "running", 0.5},
+		{"web", "pending", 0.5},
+	}
+	tests := []struct {
+		rules  HealthRulesConfig
+		status int
+	}{
+		{HealthRulesConfig{}, UNHEALTHY},
+		{HealthRulesConfig{Rule: HealthRuleQuorum}, UNHEALTHY},
+		{HealthRulesConfig{Rule: HealthRuleQuorum, Quorum: 0.6}, STARTED},
+		{HealthRulesConfig{Rule: HealthRuleWeighted, Weights: map[string]float64{"i-4": 10}}, UNHEALTHY},
+		{HealthRulesConfig{Rule: HealthRuleWeighted, Weights: map[string]float64{"i-4": 0, "web": 0}}, STARTED},
+		{HealthRulesConfig{Rule: HealthRuleWeighted, Quorum: 1, Weights: map[string]float64{"i-4": 0, "web": 0}}, STARTED},
+	}
+	for i, test := range tests {
+		if err := test.rules.Validate(); err != nil {
+			t.Fatalf("Expected no error, but got %s", err)
+		}
+		if status, reason := test.rules.aggregate(states); status != test.status {
+			t.Errorf("Expected %s for rules %d, but got %s %s", StatusString(test.status), i, StatusString(status), reason)
+		}
+	}
+
+	invalid := []HealthRulesConfig{{Rule: "most"}, {Quorum: 0.5}, {Weights: map[string]float64{"i-1": -1}}}
+	for _, rules := range invalid {
+		if err := rules.Validate(); err == nil {
+			t.Errorf("Expected an error for %+v", rules)
+		}
+	}
+
+	// Exec resources with an interval are only checked again once it passed
+	var checks int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&checks, 1)
+		json.NewEncoder(w).Encode(ExecResponse{State: "running"})
+	}))
+	defer server.Close()
+	clock := NewFakeClock(time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC))
+	config := &Config{Endpoint: "localhost:8080", Exec: []ExecResource{
+		{Name: "slow", URL: server.URL, Interval: Duration(10 * time.Minute)},
+		{Name: "fast", URL: server.URL},
+	}}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	fw := New(config, WithClock(clock), WithStateStore(&memStateStore{}))
+	fw.status = STARTED
+	fw.publish()
+	for _, advance := range []time.Duration{0, time.Minute, 10 * time.Minute} {
+		clock.Advance(advance)
+		if status, reason := fw.CheckAll(); status != STARTED {
+			t.Errorf("Expected STARTED, but got %s %s", StatusString(status), reason)
+		}
+	}
+	if n := atomic.LoadInt32(&checks); n != 5 {
+		t.Errorf("Expected 5 health checks, but got %d", n)
+	}
+}
+
+func TestStopProtection(t *testing.T) {
+	var stopped []string
+	var mu sync.Mutex
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Form.Get("Action") {
+		case "StopInstances":
+			var ids []string
+			for i := 1; r.Form.Get(fmt.Sprintf("InstanceId.%d", i)) != ""; i++ {
+				ids = append(ids, r.Form.Get(fmt.Sprintf("InstanceId.%d", i)))
+			}
+			for _, id := range ids {
+				if id == "i-locked" {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprint(w, `<Response><Errors><Error><Code>OperationNotPermitted</Code>
+						<Message>The instance 'i-locked' may not be stopped.</Message></Error></Errors><RequestID>1</RequestID></Response>`)
+					return
+				}
+			}
+			stopped = append(stopped, ids...)
+			fmt.Fprint(w, `<StopInstancesResponse></StopInstancesResponse>`)
+		case "DescribeInstanceAttribute":
+			fmt.Fprintf(w, `<DescribeInstanceAttributeResponse><instanceId>%s</instanceId>
+				<disableApiStop><value>%v</value></disableApiStop></DescribeInstanceAttributeResponse>`,
+				r.Form.Get("InstanceId"), r.Form.Get("InstanceId") == "i-locked")
+		default:
+			http.Error(w, "unexpected AWS call", http.StatusBadRequest)
+		}
+	}))
+	defer endpoint.Close()
+
+	config := &Config{Instances: []string{"i-web", "i-locked"}}
+	fw := New(config,
+		WithStateStore(&memStateStore{}),
+		WithProvider(session.New(&aws.Config{
+			Region:      aws.String("us-east-1"),
+			Endpoint:    aws.String(endpoint.URL),
+			Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+			MaxRetries:  aws.Int(0),
+		})),
+	)
+	fw.status = STARTED
+
+	if err := fw.Stop(); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if fmt.Sprint(stopped) != "[i-web]" {
+		t.Errorf("Expected only i-web to be stopped, but got %v", stopped)
+	}
+	pong := fw.statusPong()
+	if len(pong.Protected) != 1 || pong.Protected[0].ID != "i-locked" || pong.Protected[0].Protection != ProtectionStop {
+		t.Errorf("Expected i-locked with stop protection, but got %+v", pong.Protected)
+	}
+	if len(pong.Warnings) != 1 || !strings.Contains(pong.Warnings[0], "i-locked") {
+		t.Errorf("Expected a warning about i-locked, but got %v", pong.Warnings)
+	}
+}
+
+func TestDrainBeforeStop(t *testing.T) {
+	var calls []string
+	var mu sync.Mutex
+	draining := true
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		action := r.Form.Get("Action")
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, action)
+		switch action {
+		case "DeregisterTargets", "RegisterTargets":
+			if id := r.Form.Get("Targets.member.1.Id"); id != "i-web" {
+				t.Errorf("Expected target i-web, but got %q", id)
+			}
+			fmt.Fprintf(w, `<%sResponse></%sResponse>`, action, action)
+		case "DescribeTargetHealth":
+			state := "unused"
+			if draining {
+				state = "draining"
+			}
+			fmt.Fprintf(w, `<DescribeTargetHealthResponse><DescribeTargetHealthResult><TargetHealthDescriptions><member>
+				<Target><Id>i-web</Id></Target><TargetHealth><State>%s</State></TargetHealth>
+			</member></TargetHealthDescriptions></DescribeTargetHealthResult></DescribeTargetHealthResponse>`, state)
+		case "StopInstances":
+			fmt.Fprint(w, `<StopInstancesResponse></StopInstancesResponse>`)
+		default:
+			http.Error(w, "unexpected AWS call", http.StatusBadRequest)
+		}
+	}))
+	defer endpoint.Close()
+
+	clock := NewFakeClock(time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC))
+	config := &Config{
+		Instances:    []string{"i-web"},
+		HcTransition: Duration(5 * time.Second),
+		Drain:        DrainConfig{TargetGroups: []string{"arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/web/0123456789abcdef"}},
+	}
+	if err := config.Drain.Validate(); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	fw := New(config,
+		WithClock(clock),
+		WithStateStore(&memStateStore{}),
+		WithProvider(session.New(&aws.Config{
+			Region:      aws.String("us-east-1"),
+			Endpoint:    aws.String(endpoint.URL),
+			Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		})),
+	)
+	fw.status = STARTED
+
+	if err := fw.Stop(); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	fw.Poll()
+	clock.Advance(5 * time.Second)
+	mu.Lock()
+	draining = false
+	mu.Unlock()
+	fw.Poll()
+
+	expected := "[DeregisterTargets DescribeTargetHealth DescribeTargetHealth StopInstances]"
+	if fmt.Sprint(calls) != expected {
+		t.Errorf("Expected %s, but got %v", expected, calls)
+	}
+	if fw.draining != nil {
+		t.Errorf("Expected draining to be done, but got %+v", fw.draining)
+	}
+
+	// Registered again once started
+	calls = nil
+	fw.status = STARTING
+	fw.applyHealth(STARTED)
+	if fmt.Sprint(calls) != "[RegisterTargets]" {
+		t.Errorf("Expected the instance to be registered again, but got %v", calls)
+	}
+}
+
+func TestCalendar(t *testing.T) {
+	ics := strings.Replace(`BEGIN:VCALENDAR
+BEGIN:VEVENT
+UID:standup
+SUMMARY:Standup
+DTSTART:20261012T230000Z
+DURATION:PT15M
+RRULE:FREQ=DAILY
+END:VEVENT
+BEGIN:VEVENT
+UID:weekly
+SUMMARY:Customer demo
+DTSTART;TZID=Australia/Sydney:20261005T140000
+DTEND;TZID=Australia/Sydney:20261005T150000
+RRULE:FREQ=WEEKLY;BYDAY=MO,WE;UNTIL=20261231T000000Z
+EXDATE;TZID=Australia/Sydney:20261014T140000
+END:VEVENT
+BEGIN:VEVENT
+UID:weekly
+RECURRENCE-ID;TZID=Australia/Sydney:20261019T140000
+SUMMARY:Customer demo (moved)
+DTSTART;TZID=Australia/Sydney:20261019T160000
+DTEND;TZID=Australia/Sydney:20261019T170000
+END:VEVENT
+BEGIN:VEVENT
+UID:cancelled
+SUMMARY:Board demo
+DESCRIPTION:Cancelled\, see email
+STATUS:CANCELLED
+DTSTART:20261013T000000Z
+END:VEVENT
+BEGIN:VEVENT
+UID:allday
+SUMMARY:Offsite
+DESCRIPTION:Demo day\, bring
+  laptops
+DTSTART;VALUE=DATE:20261016
+END:VEVENT
+END:VCALENDAR
+`, "\n", "\r\n", -1)
+
+	sydney, err := time.LoadLocation("Australia/Sydney")
+	if err != nil {
+		t.Skip(err)
+	}
+	config := &CalendarConfig{URL: "https://calendar.example.com/basic.ics", Timezone: "Australia/Sydney"}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	calendar := NewCalendar(config, SystemClock)
+	now := time.Date(2026, 10, 12, 9, 0, 0, 0, sydney)
+	if err := calendar.Load(strings.NewReader(ics), now); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	expected := []string{
+		"Customer demo 2026-10-12 14:00",
+		"Offsite 2026-10-16 00:00",
+		"Customer demo (moved) 2026-10-19 16:00",
+	}
+	var got []string
+	for _, event := range calendar.Upcoming(now) {
+		got = append(got, event.Summary+" "+event.Start.In(sydney).Format("2006-01-02 15:04"))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, but got %v", expected, got)
+	}
+
+	// Held from the lead time before the demo until it ends
+	clock := NewFakeClock(time.Date(2026, 10, 12, 13, 50, 0, 0, sydney))
+	fw := &Flywheel{config: &Config{}, clock: clock, calendar: calendar, status: STARTED, stopAt: clock.Now().Add(time.Minute)}
+	fw.pollCalendar()
+	if end := time.Date(2026, 10, 12, 15, 0, 0, 0, sydney); !fw.stopAt.Equal(end) {
+		t.Errorf("Expected the stop to be held until %v, but got %v", end, fw.stopAt)
+	}
+	if !fw.calendarHeld() {
+		t.Errorf("Expected the environment to be held for the demo")
+	}
+	clock.Advance(time.Hour + 10*time.Minute)
+	fw.pollCalendar()
+	if fw.calendarHeld() {
+		t.Errorf("Expected no hold once the demo ended")
+	}
+}
+
+// conflictingStateStore - another writer always got there first
+type conflictingStateStore struct {
+	memStateStore
+}
+
+func (s *conflictingStateStore) Save(pong Pong) error { return ErrStateConflict }
+
+func TestClaimTransition(t *testing.T) {
+	store := &conflictingStateStore{memStateStore{pong: Pong{StatusName: "STARTING"}}}
+	fw := &Flywheel{config: &Config{}, store: store, status: STOPPED, refresh: make(chan struct{}, 1)}
+
+	if err := fw.Start(); err != ErrDeferred {
+		t.Errorf("Expected ErrDeferred, but got %v", err)
+	}
+	if fw.status != STARTING || !fw.lastStarted.IsZero() {
+		t.Errorf("Expected the other writer's STARTING without starting, but got %s", StatusString(fw.status))
+	}
+
+	fw.store = &memStateStore{}
+	fw.status = STOPPED
+	if err := fw.Start(); err != nil {
+		t.Errorf("Expected the claim to succeed, but got %v", err)
+	}
+	if fw.status != STARTING || fw.lastStarted.IsZero() {
+		t.Errorf("Expected STARTING, but got %s", StatusString(fw.status))
+	}
+}
+
+func TestExecResources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flywheel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	state := filepath.Join(dir, "state")
+	ioutil.WriteFile(state, []byte("stopped"), 0600)
+	script := `case "$1" in
+start) echo running > "$STATE" ;;
+stop) echo stopped > "$STATE" ;;
+health) printf '{"state": "%s"}' "$(cat "$STATE")" ;;
+esac`
+	os.Setenv("STATE", state)
+	defer os.Unsetenv("STATE")
+
+	var mu sync.Mutex
+	sandbox := "stopped"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ExecRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if r.Header.Get("Authorization") != "Bearer token" || req.Resource != "sandbox" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch req.Action {
+		case ExecStart:
+			sandbox = "pending"
+		case ExecStop:
+			sandbox = "stopped"
+		case ExecHealth:
+			json.NewEncoder(w).Encode(ExecResponse{State: sandbox})
+		}
+	}))
+	defer server.Close()
+
+	config := &Config{Endpoint: "localhost:8080", Exec: []ExecResource{
+		{Name: "license", Command: []string{"sh", "-c", script, "license"}},
+		{Name: "sandbox", URL: server.URL, Headers: map[string]Secret{"Authorization": "Bearer token"}},
+	}}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	fw := &Flywheel{config: config}
+
+	check := func(expected int) {
+		if status, reason := fw.CheckAll(); status != expected {
+			t.Errorf("Expected %s, but got %s %s", StatusString(expected), StatusString(status), reason)
+		}
+	}
+	check(STOPPED)
+	if err := fw.startExec(); err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	check(STARTING)
+	mu.Lock()
+	sandbox = "running"
+	mu.Unlock()
+	check(STARTED)
+	if err := fw.stopExec(); err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	check(STOPPED)
+
+	// Unknown states and failing commands are errors
+	mu.Lock()
+	sandbox = "sleeping"
+	mu.Unlock()
+	check(UNHEALTHY)
+	fail := ExecResource{Name: "broken", Command: []string{"sh", "-c", "echo no licenses left >&2; exit 1"}, Timeout: Duration(time.Second)}
+	if _, err := fail.call(ExecStart); err == nil || !strings.Contains(err.Error(), "no licenses left") {
+		t.Errorf("Expected the command's error output, but got %v", err)
+	}
+
+	for _, r := range []ExecResource{{Name: "both", Command: []string{"true"}, URL: server.URL}, {Name: "neither"}} {
+		if err := validateExec([]ExecResource{r}); err == nil {
+			t.Errorf("Expected an error for exec resource %s", r.Name)
+		}
+	}
+}
+
+func TestStopReason(t *testing.T) {
+	sent := &notifications{}
+	store := &memStateStore{}
+	fw := &Flywheel{config: &Config{}, status: STARTED, notifier: sent, store: store, idleTimeout: time.Hour}
+
+	fw.because(TriggerStop, "alice")
+	fw.setStatus(STOPPING)
+	fw.setStatus(STOPPED)
+	stop := store.pong.LastStop
+	if stop == nil || stop.Reason != StopManual || stop.User != "alice" || stop.Message != "Powered down by alice" {
+		t.Fatalf("Expected a manual stop by alice, but got %+v", stop)
+	}
+	if len(*sent) != 1 || (*sent)[0].Event != NotifyStop {
+		t.Errorf("Expected a single stop notification, but got %+v", *sent)
+	}
+
+	// Stopped without going through STOPPING, by something else
+	fw.status = STARTED
+	fw.setStatus(STOPPED)
+	if stop := store.pong.LastStop; stop == nil || stop.Reason != StopExternal {
+		t.Errorf("Expected an external stop, but got %+v", stop)
+	}
+
+	tests := []struct {
+		from, to int
+		trigger  string
+		reason   string
+	}{
+		{STARTED, STOPPING, TriggerIdleTimeout, StopIdleTimeout},
+		{STARTED, STOPPING, TriggerDeadline, StopDeadline},
+		{STARTED, STOPPING, TriggerIdle, StopIdle},
+		{STOPPING, STOPPED, TriggerHealth, ""},
+		{STOPPED, STARTING, TriggerRequest, ""},
+	}
+	for _, test := range tests {
+		if reason := stopReason(test.from, test.to, test.trigger); reason != test.reason {
+			t.Errorf("Expected %q for %s to %s by %s, but got %q", test.reason, StatusString(test.from), StatusString(test.to), test.trigger, reason)
+		}
+	}
+
+	fw.setDeadline(time.Now().Add(time.Hour))
+	if !fw.deadline {
+		t.Errorf("Expected a stop time set through the API to be a deadline")
+	}
+
+	message := fw.config.stopMessage("en", &StopReason{Reason: StopManual, User: "<bob>"})
+	if message != "It was powered down by &lt;bob&gt;." {
+		t.Errorf("Expected the user escaped in the stopped page, but got %q", message)
+	}
+}
+
+func TestAWSEndpoints(t *testing.T) {
+	invalid := []AWSConfig{
+		{Endpoint: "localhost:4566"},
+		{Endpoint: "ftp://localhost"},
+		{Endpoints: map[string]string{"lambda": "http://localhost:4566"}},
+		{Endpoints: map[string]string{"ec2": "http://"}},
+	}
+	for _, c := range invalid {
+		if err := c.Validate(); err == nil {
+			t.Errorf("Expected an error for %+v but got none", c)
+		}
+	}
+
+	region := "ap-southeast-2"
+	urls := []struct {
+		config AWSConfig
+		url    string
+	}{
+		{AWSConfig{}, "https://bucket.s3.ap-southeast-2.amazonaws.com/state.json"},
+		{AWSConfig{S3PathStyle: true}, "https://s3.ap-southeast-2.amazonaws.com/bucket/state.json"},
+		{AWSConfig{Endpoint: "http://localhost:4566", S3PathStyle: true}, "http://localhost:4566/bucket/state.json"},
+		{AWSConfig{Endpoints: map[string]string{"s3": "https://s3.internal"}}, "https://bucket.s3.internal/state.json"},
+	}
+	for _, u := range urls {
+		sess := u.config.session(session.New(&aws.Config{Region: aws.String(region)}), "s3")
+		if got := s3URL(sess.Config, "bucket", "state.json", region); got != u.url {
+			t.Errorf("Expected %s for %+v but got %s", u.url, u.config, got)
+		}
+	}
+
+	var calls int32
+	ec2Endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		fmt.Fprint(w, `<DescribeInstancesResponse><reservationSet/></DescribeInstancesResponse>`)
+	}))
+	defer ec2Endpoint.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Expected EC2 calls at the EC2 endpoint but got %s", r.URL)
+	}))
+	defer other.Close()
+
+	config := &Config{AWS: AWSConfig{
+		Endpoint:  other.URL,
+		Endpoints: map[string]string{"ec2": ec2Endpoint.URL},
+	}}
+	fw := New(config,
+		WithStateStore(&memStateStore{}),
+		WithProvider(session.New(&aws.Config{
+			Region:      aws.String(region),
+			Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		})),
+	)
+	if _, err := fw.ec2.DescribeInstances(&ec2.DescribeInstancesInput{}); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("Expected 1 call at the EC2 endpoint but got %d", calls)
+	}
+}
+
+func TestIdleTimeoutWindows(t *testing.T) {
+	config := &Config{
+		IdleTimeout: Duration(2 * time.Hour),
+		IdleTimeouts: []IdleTimeoutWindow{
+			{ClockWindow: ClockWindow{From: "19:00", To: "07:00", Timezone: "Australia/Sydney"}, Timeout: Duration(15 * time.Minute)},
+		},
+	}
+	if err := config.IdleTimeouts[0].Validate(); err != nil {
+		t.Fatal(err)
+	}
+	sydney, _ := time.LoadLocation("Australia/Sydney")
+	clock := NewFakeClock(time.Date(2026, 10, 1, 18, 30, 0, 0, sydney))
+	fw := &Flywheel{config: config, status: STARTED, clock: clock, idleTimeout: 2 * time.Hour}
+
+	fw.restartIdleTimer()
+	if want := clock.Now().Add(2 * time.Hour); !fw.stopAt.Equal(want) {
+		t.Errorf("Expected the workday timeout, stopping at %v but got %v", want, fw.stopAt)
+	}
+
+	// At night the last request is 35 minutes ago, more than the timeout
+	clock.Advance(35 * time.Minute)
+	fw.pollIdleTimeouts()
+	if want := fw.idleSince.Add(15 * time.Minute); !fw.stopAt.Equal(want) || !fw.stopAt.Before(clock.Now()) {
+		t.Errorf("Expected the night timeout, stopping at %v but got %v", want, fw.stopAt)
+	}
+	fw.restartIdleTimer()
+	if want := clock.Now().Add(15 * time.Minute); !fw.stopAt.Equal(want) {
+		t.Errorf("Expected a request at night to keep it up 15 minutes, until %v but got %v", want, fw.stopAt)
+	}
+
+	// Deadlines aren't rescheduled
+	deadline := clock.Now().Add(5 * time.Hour)
+	fw.stopAt, fw.deadline = deadline, true
+	fw.pollIdleTimeouts()
+	if !fw.stopAt.Equal(deadline) {
+		t.Errorf("Expected the deadline %v to stay but got %v", deadline, fw.stopAt)
+	}
+
+	bad := Config{IdleTimeouts: []IdleTimeoutWindow{{ClockWindow: ClockWindow{From: "19:00", To: "7pm"}, Timeout: Duration(time.Minute)}}}
+	if err := bad.IdleTimeouts[0].Validate(); err == nil {
+		t.Errorf("Expected an error for an invalid window but got none")
+	}
+}
+
+func TestMonotonicTimers(t *testing.T) {
+	now := time.Now()
+
+	// A stop time read back from the status file has no monotonic reading
+	saved := now.Add(30 * time.Minute).Round(0)
+	if stopAt := rebase(saved, now); !strings.Contains(stopAt.String(), "m=") || stopAt.Sub(now) != 30*time.Minute {
+		t.Errorf("Expected a stop in 30m on the monotonic clock but got %v", stopAt)
+	}
+	if step := clockStep(now, now.Add(time.Minute)); step != 0 {
+		t.Errorf("Expected no step of the clock but got %v", step)
+	}
+
+	fw := &Flywheel{config: &Config{}}
+	fw.restore(Pong{StatusName: "STARTED", StopAt: saved, LastStarted: now.Add(-time.Hour).Round(0)})
+	if !strings.Contains(fw.stopAt.String(), "m=") || !strings.Contains(fw.lastStarted.String(), "m=") {
+		t.Errorf("Expected the restored times on the monotonic clock but got %v and %v", fw.stopAt, fw.lastStarted)
+	}
+	if err := fw.setDeadline(now.Add(time.Hour).Round(0)); err != nil || !strings.Contains(fw.stopAt.String(), "m=") {
+		t.Errorf("Expected the deadline on the monotonic clock but got %v, %v", fw.stopAt, err)
+	}
+
+	pong := Pong{Status: STARTED, StopAt: now.Add(30 * time.Minute)}
+	if left := pong.stopIn(now); left != 1800 {
+		t.Errorf("Expected 1800 seconds left but got %d", left)
+	}
+	pong.Status = STOPPED
+	if left := pong.stopIn(now); left != 0 {
+		t.Errorf("Expected no time left while stopped but got %d", left)
+	}
+
+	activity := NewActivity(SystemClock)
+	activity.Begin()
+	activity.End()
+	if _, since := activity.Connections(); !strings.Contains(since.String(), "m=") {
+		t.Errorf("Expected the last activity on the monotonic clock but got %v", since)
+	}
+}
+
+func TestMaintenanceEvents(t *testing.T) {
+	var calls int32
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("Action") != "DescribeInstanceStatus" {
+			http.Error(w, "unexpected AWS call", http.StatusBadRequest)
+			return
+		}
+		atomic.AddInt32(&calls, 1)
+		fmt.Fprint(w, `<DescribeInstanceStatusResponse><instanceStatusSet>
+<item><instanceId>i-web</instanceId><eventsSet>
+<item><code>instance-retirement</code><description>The instance is running on degraded hardware</description><notBefore>2026-10-08T00:00:00Z</notBefore></item>
+<item><code>system-reboot</code><description>[Completed] Scheduled reboot</description><notBefore>2026-09-01T00:00:00Z</notBefore></item>
+</eventsSet></item>
+<item><instanceId>i-db</instanceId><eventsSet/></item>
+</instanceStatusSet></DescribeInstanceStatusResponse>`)
+	}))
+	defer endpoint.Close()
+
+	var sent notifications
+	clock := NewFakeClock(time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC))
+	config := &Config{Instances: []string{"i-web", "i-db"}, Maintenance: MaintenanceConfig{Enabled: true}}
+	if err := config.Maintenance.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	fw := New(config,
+		WithClock(clock),
+		WithStateStore(&memStateStore{}),
+		WithNotifier(&sent),
+		WithProvider(session.New(&aws.Config{
+			Region:      aws.String("us-east-1"),
+			Endpoint:    aws.String(endpoint.URL),
+			Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		})),
+	)
+	d := &described{instances: map[string]*ec2.Instance{"i-web": {}, "i-db": {}}}
+
+	fw.applyMaintenance(fw.checkMaintenance(d))
+	events := fw.statusPong().Maintenance
+	if len(events) != 1 || events[0].InstanceID != "i-web" || events[0].Code != "instance-retirement" {
+		t.Fatalf("Expected the upcoming retirement of i-web, but got %+v", events)
+	}
+	if len(sent) != 1 || sent[0].Event != NotifyMaintenance {
+		t.Errorf("Expected a maintenance notification, but got %v", sent)
+	}
+
+	// Not due again for an hour, and then notified once
+	if check := fw.checkMaintenance(d); check != nil || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("Expected no check before the interval, but got %d calls", calls)
+	}
+	clock.Advance(time.Hour)
+	fw.applyMaintenance(fw.checkMaintenance(d))
+	if atomic.LoadInt32(&calls) != 2 || len(sent) != 1 {
+		t.Errorf("Expected a second check without notifying again, but got %d calls and %v", calls, sent)
+	}
+
+	config.Maintenance.Migrate = true
+	if err := config.Maintenance.Validate(); err == nil {
+		t.Errorf("Expected an error for migrations without a window but got none")
+	}
+}
+
+func TestInventory(t *testing.T) {
+	var mu sync.Mutex
+	var roles []string
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") == "AWSOrganizationsV20161128.ListAccounts" {
+			fmt.Fprint(w, `{"Accounts": [{"Id": "111111111111", "Status": "ACTIVE"}, {"Id": "222222222222", "Status": "ACTIVE"}, {"Id": "333333333333", "Status": "SUSPENDED"}]}`)
+			return
+		}
+		r.ParseForm()
+		switch r.Form.Get("Action") {
+		case "GetCallerIdentity":
+			fmt.Fprint(w, `<GetCallerIdentityResponse><GetCallerIdentityResult><Account>111111111111</Account></GetCallerIdentityResult></GetCallerIdentityResponse>`)
+		case "AssumeRole":
+			mu.Lock()
+			roles = append(roles, r.Form.Get("RoleArn"))
+			mu.Unlock()
+			fmt.Fprint(w, `<AssumeRoleResponse><AssumeRoleResult><Credentials><AccessKeyId>AK</AccessKeyId><SecretAccessKey>SK</SecretAccessKey><SessionToken>ST</SessionToken></Credentials></AssumeRoleResult></AssumeRoleResponse>`)
+		case "DescribeInstances":
+			if r.Form.Get("InstanceId.1") == "i-asg2" {
+				fmt.Fprint(w, `<DescribeInstancesResponse><reservationSet><item><instancesSet>
+<item><instanceId>i-asg2</instanceId><instanceType>m5.large</instanceType><instanceState><name>running</name></instanceState></item>
+</instancesSet></item></reservationSet></DescribeInstancesResponse>`)
+				return
+			}
+			fmt.Fprint(w, `<DescribeInstancesResponse><reservationSet><item><instancesSet>
+<item><instanceId>i-web</instanceId><instanceType>m5.large</instanceType><instanceState><name>running</name></instanceState></item>
+<item><instanceId>i-dev</instanceId><instanceType>m5.large</instanceType><instanceState><name>running</name></instanceState><tagSet><item><key>Name</key><value>dev box</value></item></tagSet></item>
+<item><instanceId>i-old</instanceId><instanceType>t3.small</instanceType><instanceState><name>stopped</name></instanceState></item>
+<item><instanceId>i-asg1</instanceId><instanceType>c5.xlarge</instanceType><instanceState><name>running</name></instanceState></item>
+</instancesSet></item></reservationSet></DescribeInstancesResponse>`)
+		case "DescribeAutoScalingGroups":
+			fmt.Fprint(w, `<DescribeAutoScalingGroupsResponse><DescribeAutoScalingGroupsResult><AutoScalingGroups>
+<member><AutoScalingGroupName>workers</AutoScalingGroupName><DesiredCapacity>2</DesiredCapacity>
+<Instances><member><InstanceId>i-asg1</InstanceId></member><member><InstanceId>i-asg2</InstanceId></member></Instances>
+<Tags><member><Key>flywheel</Key><Value>yes</Value></member></Tags></member>
+<member><AutoScalingGroupName>untagged</AutoScalingGroupName><DesiredCapacity>1</DesiredCapacity></member>
+</AutoScalingGroups></DescribeAutoScalingGroupsResult></DescribeAutoScalingGroupsResponse>`)
+		default:
+			http.Error(w, "unexpected AWS call", http.StatusBadRequest)
+		}
+	}))
+	defer endpoint.Close()
+
+	dir, err := ioutil.TempDir("", "flywheel-inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "environments"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "environments", "web.json"), []byte(`{"endpoint": "web:80", "instances": ["i-web"]}`), 0644)
+	inventoryFile := filepath.Join(dir, "inventory.json")
+	ioutil.WriteFile(inventoryFile, []byte(`{"regions": ["us-east-1"], "configs": ["environments/*.json"], "prices": {"m5.large": 0.1}, "working-hours": 40}`), 0644)
+
+	config, err := ReadInventoryConfig(inventoryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	report, err := Inventory(session.New(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(endpoint.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(roles) != 1 || roles[0] != "arn:aws:iam::222222222222:role/OrganizationAccountAccessRole" {
+		t.Errorf("Expected the role to be assumed in the other active account only, but got %v", roles)
+	}
+	// i-web, i-dev, i-old and workers in each of the 2 accounts
+	if report.Accounts != 2 || len(report.Resources) != 8 || report.Unmanaged != 6 {
+		t.Fatalf("Expected 8 resources, 6 unmanaged, in 2 accounts but got %+v", report)
+	}
+	for _, r := range report.Resources {
+		if r.ID == "workers" && (r.Running != 2 || r.State != "2/2 running") {
+			t.Errorf("Expected both instances of the group running but got %+v", r)
+		}
+		if r.ID == "i-asg1" {
+			t.Errorf("Expected group instances under the group only but got %+v", r)
+		}
+	}
+	// i-dev and an m5.large of workers, for (168-40)*52/12 hours a month
+	idle := 2 * 2 * 0.1 * 128 * 52 / 12
+	if diff := report.IdleCost - idle; diff > 0.01 || diff < -0.01 {
+		t.Errorf("Expected an idle cost of %.2f but got %.2f", idle, report.IdleCost)
+	}
+	if fmt.Sprint(report.Unpriced) != "[c5.xlarge t3.small]" {
+		t.Errorf("Expected c5.xlarge and t3.small unpriced but got %v", report.Unpriced)
+	}
+}
+
+func TestAutoScalingGroupPolicies(t *testing.T) {
+	var calls []string
+	var mu sync.Mutex
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		mu.Lock()
+		defer mu.Unlock()
+		action := r.Form.Get("Action")
+		switch action {
+		case "SuspendProcesses", "ResumeProcesses":
+			var processes []string
+			for i := 1; r.Form.Get(fmt.Sprintf("ScalingProcesses.member.%d", i)) != ""; i++ {
+				processes = append(processes, r.Form.Get(fmt.Sprintf("ScalingProcesses.member.%d", i)))
+			}
+			calls = append(calls, fmt.Sprintf("%s %s %v", action, r.Form.Get("AutoScalingGroupName"), processes))
+			fmt.Fprintf(w, `<%sResponse></%sResponse>`, action, action)
+		case "UpdateAutoScalingGroup":
+			calls = append(calls, fmt.Sprintf("%s %s %s-%s/%s", action, r.Form.Get("AutoScalingGroupName"),
+				r.Form.Get("MinSize"), r.Form.Get("MaxSize"), r.Form.Get("DesiredCapacity")))
+			fmt.Fprint(w, `<UpdateAutoScalingGroupResponse></UpdateAutoScalingGroupResponse>`)
+		case "DescribeAutoScalingGroups":
+			// web has AlarmNotification suspended by someone else, and wbe
+			// is a typo
+			groups := ""
+			for i := 1; r.Form.Get(fmt.Sprintf("AutoScalingGroupNames.member.%d", i)) != ""; i++ {
+				name := r.Form.Get(fmt.Sprintf("AutoScalingGroupNames.member.%d", i))
+				suspended := ""
+				switch name {
+				case "wbe":
+					continue
+				case "web":
+					suspended = `<member><ProcessName>AlarmNotification</ProcessName></member>`
+				}
+				groups += fmt.Sprintf(`<member><AutoScalingGroupName>%s</AutoScalingGroupName>
+					<SuspendedProcesses>%s</SuspendedProcesses></member>`, name, suspended)
+			}
+			fmt.Fprintf(w, `<DescribeAutoScalingGroupsResponse><DescribeAutoScalingGroupsResult><AutoScalingGroups>%s
+				</AutoScalingGroups></DescribeAutoScalingGroupsResult></DescribeAutoScalingGroupsResponse>`, groups)
+		default:
+			http.Error(w, "unexpected AWS call", http.StatusBadRequest)
+		}
+	}))
+	defer endpoint.Close()
+
+	config := &Config{
+		Endpoint: "10.0.0.1:80",
+		AutoScaling: AutoScalingConfig{
+			Groups: map[string]GroupPolicy{
+				"batch": {Action: PolicySuspend, Suspend: []string{"ScheduledActions"}},
+				"web":   {Action: PolicyTerminate, Suspend: []string{"AlarmNotification", "ScheduledActions"}, MinSize: 1, MaxSize: 4, DesiredCapacity: aws.Int64(2)},
+				"wbe":   {Action: PolicySuspend},
+			},
+		},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected valid config but got %v", err)
+	}
+	if stop := config.AutoScaling.SuspendGroups(); fmt.Sprint(stop) != "[batch wbe]" {
+		t.Errorf("Expected batch to be suspended, but got %v", stop)
+	}
+	if terminate := config.AutoScaling.TerminateGroups(); len(terminate) != 1 || terminate["web"] != 4 {
+		t.Errorf("Expected web to be terminated from 4, but got %v", terminate)
+	}
+
+	fw := New(config,
+		WithStateStore(&memStateStore{}),
+		WithProvider(session.New(&aws.Config{
+			Region:      aws.String("us-east-1"),
+			Endpoint:    aws.String(endpoint.URL),
+			Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+			MaxRetries:  aws.Int(0),
+		})),
+	)
+	fw.status = STARTED
+	if err := fw.Stop(); err != nil {
+		t.Fatalf("Expected no error stopping, but got %v", err)
+	}
+	if suspended := fw.statusPong().SuspendedProcesses; fmt.Sprint(suspended) != "map[batch:{[] false} web:{[AlarmNotification] false}]" {
+		t.Errorf("Expected the processes suspended before in the state, but got %v", suspended)
+	}
+	if errs := fw.statusPong().ConfigErrors; fmt.Sprint(errs) != "[Autoscaling group wbe doesn't exist]" {
+		t.Errorf("Expected the missing group as a config error, but got %v", errs)
+	}
+	fw.status = STOPPED
+	if err := fw.Start(); err != nil {
+		t.Fatalf("Expected no error starting, but got %v", err)
+	}
+	// AlarmNotification of web stays suspended, as it was before
+	expected := []string{
+		"SuspendProcesses web [AlarmNotification ScheduledActions]",
+		"UpdateAutoScalingGroup web 0-0/",
+		"SuspendProcesses batch [ScheduledActions]",
+		"UpdateAutoScalingGroup web 1-4/2",
+		"ResumeProcesses web [ScheduledActions]",
+		"ResumeProcesses batch [ScheduledActions]",
+	}
+	if strings.Join(calls, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected calls %q but got %q", expected, calls)
+	}
+
+	for _, policy := range []GroupPolicy{
+		{Action: "scale"},
+		{Action: PolicyStop, Suspend: []string{"Rebalance"}},
+		{Action: PolicyStop, MaxSize: 2},
+		{Action: PolicyTerminate},
+		{Action: PolicyTerminate, MaxSize: 2, Suspend: []string{"Terminate"}},
+		{Action: PolicyTerminate, MinSize: 1, MaxSize: 2, DesiredCapacity: aws.Int64(3)},
+	} {
+		config.AutoScaling.Groups = map[string]GroupPolicy{"web": policy}
+		if err := config.Validate(); err == nil {
+			t.Errorf("Expected an error for policy %+v", policy)
+		}
+	}
+	config.AutoScaling.Groups = map[string]GroupPolicy{"web": {Action: PolicyStop}}
+	config.AutoScaling.Stop = []string{"web"}
+	if err := config.Validate(); err == nil {
+		t.Errorf("Expected an error for web configured twice")
+	}
+}
+
+func TestRDS(t *testing.T) {
+	var calls []string
+	states := map[string]string{"db1": "stopped", "aurora1": "stopped"}
+	var mu sync.Mutex
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		mu.Lock()
+		defer mu.Unlock()
+		action := r.Form.Get("Action")
+		switch action {
+		case "DescribeDBInstances", "DescribeDBClusters":
+			kind, key := "DBInstance", "DBInstanceIdentifier"
+			status := "DBInstanceStatus"
+			if action == "DescribeDBClusters" {
+				kind, key, status = "DBCluster", "DBClusterIdentifier", "Status"
+			}
+			var members string
+			for i := 1; r.Form.Get(fmt.Sprintf("Filters.Filter.1.Values.Value.%d", i)) != ""; i++ {
+				id := r.Form.Get(fmt.Sprintf("Filters.Filter.1.Values.Value.%d", i))
+				if state, ok := states[id]; ok {
+					members += fmt.Sprintf("<%s><%s>%s</%s><%s>%s</%s></%s>", kind, key, id, key, status, state, status, kind)
+				}
+			}
+			fmt.Fprintf(w, "<%sResponse><%sResult><%ss>%s</%ss></%sResult></%sResponse>", action, action, kind, members, kind, action, action)
+		case "StartDBInstance", "StopDBInstance":
+			calls = append(calls, action+" "+r.Form.Get("DBInstanceIdentifier"))
+			fmt.Fprintf(w, "<%sResponse></%sResponse>", action, action)
+		case "StartDBCluster", "StopDBCluster":
+			calls = append(calls, action+" "+r.Form.Get("DBClusterIdentifier"))
+			fmt.Fprintf(w, "<%sResponse></%sResponse>", action, action)
+		default:
+			http.Error(w, "unexpected AWS call", http.StatusBadRequest)
+		}
+	}))
+	defer endpoint.Close()
+
+	config := &Config{
+		Endpoint: "10.0.0.1:80",
+		RDS:      RDSConfig{Instances: []string{"db1"}, Clusters: []string{"aurora1"}},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected valid config but got %v", err)
+	}
+	fw := New(config,
+		WithStateStore(&memStateStore{}),
+		WithProvider(session.New(&aws.Config{
+			Region:      aws.String("us-east-1"),
+			Endpoint:    aws.String(endpoint.URL),
+			Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+			MaxRetries:  aws.Int(0),
+		})),
+	)
+	if err := fw.Start(); err != nil {
+		t.Fatalf("Expected no error starting, but got %v", err)
+	}
+
+	// Only ready once both are available
+	for _, test := range []struct {
+		db1, aurora1 string
+		status       int
+	}{
+		{"starting", "starting", STARTING},
+		{"available", "starting", STARTING},
+		{"available", "backing-up", STARTED},
+		{"available", "inaccessible-encryption-credentials", UNHEALTHY},
+	} {
+		mu.Lock()
+		states["db1"], states["aurora1"] = test.db1, test.aurora1
+		mu.Unlock()
+		if status, reason := fw.CheckAll(); status != test.status {
+			t.Errorf("Expected %s for %s and %s but got %s %s", StatusString(test.status), test.db1, test.aurora1, StatusString(status), reason)
+		}
+	}
+
+	mu.Lock()
+	states["aurora1"] = "available"
+	mu.Unlock()
+	fw.status = STARTED
+	if err := fw.Stop(); err != nil {
+		t.Fatalf("Expected no error stopping, but got %v", err)
+	}
+	expected := []string{
+		"StartDBCluster aurora1",
+		"StartDBInstance db1",
+		"StopDBCluster aurora1",
+		"StopDBInstance db1",
+	}
+	if strings.Join(calls, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected calls %q but got %q", expected, calls)
+	}
+
+	// A database that is starting can't be stopped yet
+	mu.Lock()
+	states["db1"] = "starting"
+	mu.Unlock()
+	fw.status = STARTED
+	if err := fw.Stop(); err == nil || !strings.Contains(err.Error(), "DB instance db1 is starting") {
+		t.Errorf("Expected an error stopping a starting database, but got %v", err)
+	}
+
+	config.RDS.Clusters = []string{"db1"}
+	if err := config.Validate(); err == nil {
+		t.Errorf("Expected an error for db1 configured twice")
+	}
+}
+
+func TestECS(t *testing.T) {
+	var calls []string
+	services := map[string]map[string]interface{}{
+		"apps/web":    {"serviceName": "web", "status": "ACTIVE", "desiredCount": 0, "runningCount": 0},
+		"apps/worker": {"serviceName": "worker", "status": "ACTIVE", "desiredCount": 0, "runningCount": 0},
+	}
+	var mu sync.Mutex
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var req struct {
+			Cluster      string   `json:"cluster"`
+			Service      string   `json:"service"`
+			Services     []string `json:"services"`
+			DesiredCount int64    `json:"desiredCount"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		switch r.Header.Get("X-Amz-Target") {
+		case "AmazonEC2ContainerServiceV20141113.DescribeServices":
+			out := map[string][]interface{}{"services": {}, "failures": {}}
+			for _, name := range req.Services {
+				if s, ok := services[req.Cluster+"/"+name]; ok {
+					out["services"] = append(out["services"], s)
+				} else {
+					out["failures"] = append(out["failures"], map[string]string{"arn": name, "reason": "MISSING"})
+				}
+			}
+			json.NewEncoder(w).Encode(out)
+		case "AmazonEC2ContainerServiceV20141113.UpdateService":
+			calls = append(calls, fmt.Sprintf("UpdateService %s/%s %d", req.Cluster, req.Service, req.DesiredCount))
+			fmt.Fprint(w, `{}`)
+		default:
+			http.Error(w, "unexpected AWS call", http.StatusBadRequest)
+		}
+	}))
+	defer endpoint.Close()
+
+	config := &Config{
+		Endpoint: "10.0.0.1:80",
+		ECS: []ECSService{
+			{Cluster: "apps", Service: "web", DesiredCount: 2},
+			{Cluster: "apps", Service: "worker", DesiredCount: 1},
+		},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected valid config but got %v", err)
+	}
+	fw := New(config,
+		WithStateStore(&memStateStore{}),
+		WithProvider(session.New(&aws.Config{
+			Region:      aws.String("us-east-1"),
+			Endpoint:    aws.String(endpoint.URL),
+			Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+			MaxRetries:  aws.Int(0),
+		})),
+	)
+	if status, reason := fw.CheckAll(); status != STOPPED {
+		t.Errorf("Expected STOPPED with no tasks but got %s %s", StatusString(status), reason)
+	}
+	if err := fw.Start(); err != nil {
+		t.Fatalf("Expected no error starting, but got %v", err)
+	}
+
+	// Ready once every service runs as many tasks as it desires
+	for _, test := range []struct {
+		web, worker int
+		status      int
+	}{
+		{0, 0, STARTING},
+		{1, 1, STARTING},
+		{2, 1, STARTED},
+	} {
+		mu.Lock()
+		services["apps/web"]["desiredCount"], services["apps/web"]["runningCount"] = 2, test.web
+		services["apps/worker"]["desiredCount"], services["apps/worker"]["runningCount"] = 1, test.worker
+		mu.Unlock()
+		if status, reason := fw.CheckAll(); status != test.status {
+			t.Errorf("Expected %s with %d and %d tasks but got %s %s", StatusString(test.status), test.web, test.worker, StatusString(status), reason)
+		}
+	}
+
+	fw.status = STARTED
+	if err := fw.Stop(); err != nil {
+		t.Fatalf("Expected no error stopping, but got %v", err)
+	}
+	expected := []string{
+		"UpdateService apps/web 2",
+		"UpdateService apps/worker 1",
+		"UpdateService apps/web 0",
+		"UpdateService apps/worker 0",
+	}
+	if strings.Join(calls, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected calls %q but got %q", expected, calls)
+	}
+
+	mu.Lock()
+	delete(services, "apps/worker")
+	mu.Unlock()
+	if status, reason := fw.CheckAll(); status != UNHEALTHY || reason != "ECS service apps/worker not found" {
+		t.Errorf("Expected UNHEALTHY for a missing service but got %s %s", StatusString(status), reason)
+	}
+
+	config.ECS = append(config.ECS, ECSService{Cluster: "apps", Service: "web", DesiredCount: 1})
+	if err := config.Validate(); err == nil {
+		t.Errorf("Expected an error for apps/web configured twice")
+	}
+}
+
+func TestKubernetes(t *testing.T) {
+	var calls []string
+	workloads := map[string]map[string]interface{}{
+		"/apis/apps/v1/namespaces/dev/deployments/api":    {"spec": map[string]int{"replicas": 0}, "status": map[string]int{}},
+		"/apis/apps/v1/namespaces/dev/statefulsets/cache": {"spec": map[string]int{"replicas": 0}, "status": map[string]int{}},
+	}
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, `{"message": "Unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			workload, ok := workloads[r.URL.Path]
+			if !ok {
+				http.Error(w, `{"kind": "Status", "message": "not found"}`, http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(workload)
+		case "PATCH":
+			body, _ := ioutil.ReadAll(r.Body)
+			calls = append(calls, fmt.Sprintf("%s %s %s", r.Header.Get("Content-Type"), r.URL.Path, body))
+			fmt.Fprint(w, `{}`)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "flywheel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kubeconfig := filepath.Join(dir, "kubeconfig")
+	ioutil.WriteFile(kubeconfig, []byte(`apiVersion: v1
+kind: Config
+clusters:
+- cluster:
+    server: `+server.URL+`
+  name: dev
+contexts:
+- context:
+    cluster: dev
+    user: flywheel
+  name: dev
+current-context: dev # the only one
+users:
+- name: flywheel
+  user:
+    token: "secret"
+`), 0600)
+
+	config := &Config{
+		Endpoint: "10.0.0.1:80",
+		Kubernetes: KubernetesConfig{
+			Kubeconfig: kubeconfig,
+			Workloads: []KubernetesWorkload{
+				{Namespace: "dev", Name: "api", Replicas: 2},
+				{Kind: "StatefulSet", Namespace: "dev", Name: "cache", Replicas: 1},
+			},
+		},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected valid config but got %v", err)
+	}
+	fw := New(config, WithStateStore(&memStateStore{}))
+	if status, reason := fw.CheckAll(); status != STOPPED {
+		t.Errorf("Expected STOPPED with no replicas but got %s %s", StatusString(status), reason)
+	}
+	if err := fw.Start(); err != nil {
+		t.Fatalf("Expected no error starting, but got %v", err)
+	}
+
+	// Ready once every workload has as many ready replicas as it desires
+	for _, test := range []struct {
+		api, cache int
+		status     int
+	}{
+		{0, 0, STARTING},
+		{2, 0, STARTING},
+		{2, 1, STARTED},
+	} {
+		mu.Lock()
+		workloads["/apis/apps/v1/namespaces/dev/deployments/api"]["spec"] = map[string]int{"replicas": 2}
+		workloads["/apis/apps/v1/namespaces/dev/deployments/api"]["status"] = map[string]int{"replicas": 2, "readyReplicas": test.api}
+		workloads["/apis/apps/v1/namespaces/dev/statefulsets/cache"]["spec"] = map[string]int{"replicas": 1}
+		workloads["/apis/apps/v1/namespaces/dev/statefulsets/cache"]["status"] = map[string]int{"replicas": 1, "readyReplicas": test.cache}
+		mu.Unlock()
+		if status, reason := fw.CheckAll(); status != test.status {
+			t.Errorf("Expected %s with %d and %d ready but got %s %s", StatusString(test.status), test.api, test.cache, StatusString(status), reason)
+		}
+	}
+
+	fw.status = STARTED
+	if err := fw.Stop(); err != nil {
+		t.Fatalf("Expected no error stopping, but got %v", err)
+	}
+	expected := []string{
+		`application/merge-patch+json /apis/apps/v1/namespaces/dev/deployments/api/scale {"spec":{"replicas":2}}`,
+		`application/merge-patch+json /apis/apps/v1/namespaces/dev/statefulsets/cache/scale {"spec":{"replicas":1}}`,
+		`application/merge-patch+json /apis/apps/v1/namespaces/dev/deployments/api/scale {"spec":{"replicas":0}}`,
+		`application/merge-patch+json /apis/apps/v1/namespaces/dev/statefulsets/cache/scale {"spec":{"replicas":0}}`,
+	}
+	if strings.Join(calls, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected calls %q but got %q", expected, calls)
+	}
+
+	mu.Lock()
+	delete(workloads, "/apis/apps/v1/namespaces/dev/statefulsets/cache")
+	mu.Unlock()
+	if status, reason := fw.CheckAll(); status != UNHEALTHY || reason != "Kubernetes statefulset dev/cache not found" {
+		t.Errorf("Expected UNHEALTHY for a missing workload but got %s %s", StatusString(status), reason)
+	}
+
+	config.Kubernetes.Workloads = append(config.Kubernetes.Workloads, KubernetesWorkload{Kind: "statefulset", Namespace: "dev", Name: "api", Replicas: 1})
+	if err := config.Validate(); err == nil {
+		t.Errorf("Expected an error for dev/api configured twice")
+	}
+}
+
+func TestParseKubeconfig(t *testing.T) {
+	// As aws eks update-kubeconfig writes it
+	config, err := parseKubeconfig([]byte(`apiVersion: v1
+clusters:
+- cluster:
+    certificate-authority-data: TFMwdA==
+    server: https://ABCD.gr7.ap-southeast-2.eks.amazonaws.com
+  name: arn:aws:eks:ap-southeast-2:123456789012:cluster/dev
+contexts:
+- context:
+    cluster: arn:aws:eks:ap-southeast-2:123456789012:cluster/dev
+    user: arn:aws:eks:ap-southeast-2:123456789012:cluster/dev
+  name: arn:aws:eks:ap-southeast-2:123456789012:cluster/dev
+current-context: arn:aws:eks:ap-southeast-2:123456789012:cluster/dev
+kind: Config
+preferences: {}
+users:
+- name: arn:aws:eks:ap-southeast-2:123456789012:cluster/dev
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1beta1
+      args:
+      - --region
+      - ap-southeast-2
+      - eks
+      - get-token
+      - --cluster-name
+      - dev
+      command: aws
+      env:
+      - name: AWS_PROFILE
+        value: 'dev'
+`))
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	if len(config.Clusters) != 1 || config.Clusters[0].Cluster.Server != "https://ABCD.gr7.ap-southeast-2.eks.amazonaws.com" || config.Clusters[0].Cluster.CAData != "TFMwdA==" {
+		t.Errorf("Expected the EKS cluster but got %+v", config.Clusters)
+	}
+	if len(config.Contexts) != 1 || config.Contexts[0].Context.User != config.CurrentContext {
+		t.Errorf("Expected the context of the cluster but got %+v", config.Contexts)
+	}
+	exec := config.Users[0].User.Exec
+	if exec == nil || exec.Command != "aws" || strings.Join(exec.Args, " ") != "--region ap-southeast-2 eks get-token --cluster-name dev" ||
+		len(exec.Env) != 1 || exec.Env[0].Value != "dev" {
+		t.Errorf("Expected the aws eks get-token plugin but got %+v", exec)
+	}
+
+	if _, err := parseKubeconfig([]byte("users:\n- name: a\n  user:\n    token: |\n      multi\n")); err == nil {
+		t.Errorf("Expected an error for a multi-line string")
+	}
+}
+
+// fakeDriver - a resource driver in a given state, recording its calls
+type fakeDriver struct {
+	name     string
+	state    string
+	err      error
+	startErr error
+	calls    *[]string
+}
+
+func (d *fakeDriver) Start() error {
+	*d.calls = append(*d.calls, "start "+d.name)
+	return d.startErr
+}
+
+func (d *fakeDriver) Stop() error {
+	*d.calls = append(*d.calls, "stop "+d.name)
+	return nil
+}
+
+func (d *fakeDriver) Ready() ([]ResourceState, error) {
+	return []ResourceState{{Resource: d.name, State: d.state, Share: 1}}, d.err
+}
+
+func (d *fakeDriver) Describe() []ResourceHealth {
+	return []ResourceHealth{{Type: "fake", ID: d.name, State: d.state}}
+}
+
+func TestResourceDriver(t *testing.T) {
+	var calls []string
+	queue := &fakeDriver{name: "queue", state: "stopped", calls: &calls}
+	search := &fakeDriver{name: "search", state: "stopped", calls: &calls}
+	fw := New(&Config{Endpoint: "10.0.0.1:80"}, WithStateStore(&memStateStore{}), WithDriver(queue), WithDriver(search))
+	if status, reason := fw.CheckAll(); status != STOPPED {
+		t.Errorf("Expected STOPPED but got %s %s", StatusString(status), reason)
+	}
+	if err := fw.Start(); err != nil {
+		t.Fatalf("Expected no error starting, but got %v", err)
+	}
+
+	// STARTED once every driver's resources are running
+	queue.state = "running"
+	search.state = "pending"
+	if status, reason := fw.CheckAll(); status != STARTING {
+		t.Errorf("Expected STARTING but got %s %s", StatusString(status), reason)
+	}
+	search.state = "running"
+	if status, reason := fw.CheckAll(); status != STARTED {
+		t.Errorf("Expected STARTED but got %s %s", StatusString(status), reason)
+	}
+	if resources := fw.statusPong().Resources; len(resources) != 2 || resources[0].ID != "queue" || resources[1].State != "running" {
+		t.Errorf("Expected the described resources in the status, but got %v", resources)
+	}
+
+	// Stopped in reverse
+	fw.status = STARTED
+	if err := fw.Stop(); err != nil {
+		t.Fatalf("Expected no error stopping, but got %v", err)
+	}
+	expected := []string{"start queue", "start search", "stop search", "stop queue"}
+	if strings.Join(calls, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("Expected calls %q but got %q", expected, calls)
+	}
+
+	search.err = fmt.Errorf("Search cluster unreachable")
+	if status, reason := fw.CheckAll(); status != UNHEALTHY || reason != "Search cluster unreachable" {
+		t.Errorf("Expected UNHEALTHY for a failing driver but got %s %s", StatusString(status), reason)
+	}
+}
+
+func TestResourceDriverStartFailure(t *testing.T) {
+	var calls []string
+	queue := &fakeDriver{name: "queue", state: "stopped", calls: &calls}
+	search := &fakeDriver{name: "search", state: "stopped", calls: &calls}
+	cache := &fakeDriver{name: "cache", state: "stopped", calls: &calls, startErr: fmt.Errorf("No capacity")}
+	mail := &fakeDriver{name: "mail", state: "stopped", calls: &calls}
+	fw := New(&Config{Endpoint: "10.0.0.1:80"}, WithStateStore(&memStateStore{}),
+		WithDriver(queue), WithDriver(search), WithDriver(cache), WithDriver(mail))
+	fw.CheckAll()
+
+	if err := fw.Start(); err == nil || err.Error() != "No capacity" {
+		t.Errorf("Expected the driver's error starting, but got %v", err)
+	}
+	// Those already started are stopped again, in reverse
+	expected := []string{"start queue", "start search", "start cache", "stop search", "stop queue"}
+	if strings.Join(calls, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("Expected calls %q but got %q", expected, calls)
+	}
+	if fw.status != STOPPED {
+		t.Errorf("Expected STOPPED after a failed start but got %s", StatusString(fw.status))
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	monday := time.Date(2026, 10, 12, 8, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		expr    string
+		t       time.Time
+		matches bool
+	}{
+		{"0 8 * * mon-fri", monday, true},
+		{"0 8 * * mon-fri", monday.AddDate(0, 0, 5), false},
+		{"0 8 * * 1-5", monday.Add(time.Minute), false},
+		{"*/15 * * * *", monday.Add(45 * time.Minute), true},
+		{"*/15 * * * *", monday.Add(50 * time.Minute), false},
+		{"0 8 * * 7", monday.AddDate(0, 0, 6), true},
+		{"0 8 1 jan,oct *", monday.AddDate(0, 0, -11), true},
+		// Restricted days of the month and of the week match either
+		{"0 8 1 * sun", monday, false},
+		{"0 8 12 * sun", monday, true},
+	} {
+		c, err := parseCron(test.expr)
+		if err != nil {
+			t.Errorf("Expected %q to parse, but got %v", test.expr, err)
+			continue
+		}
+		if c.matches(test.t) != test.matches {
+			t.Errorf("Expected %q matching %v to be %v", test.expr, test.t, test.matches)
+		}
+	}
+	for _, expr := range []string{"0 8 * *", "60 8 * * *", "0 8 * * fri-mon", "*/0 * * * *", "0 8 * foo *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("Expected an error for %q", expr)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	// Sunday evening
+	clock := NewFakeClock(time.Date(2026, 10, 11, 20, 0, 0, 0, time.UTC))
+	var calls []string
+	driver := &fakeDriver{name: "app", state: "stopped", calls: &calls}
+	config := &Config{
+		Endpoint:    "10.0.0.1:80",
+		IdleTimeout: Duration(time.Hour),
+		Schedule: ScheduleConfig{
+			Windows:  []ScheduleWindow{{Days: "mon-fri", Start: "08:00", Stop: "19:00"}},
+			Timezone: "UTC",
+		},
+	}
+	if err := config.Schedule.Validate(); err != nil {
+		t.Fatalf("Expected a valid schedule, but got %v", err)
+	}
+	fw := New(config, WithStateStore(&memStateStore{}), WithClock(clock), WithDriver(driver))
+	fw.Poll()
+
+	// Warmed up on Monday morning, and held past the idle timeout
+	clock.Advance(12*time.Hour + time.Second)
+	fw.Poll()
+	if fw.status != STARTING {
+		t.Fatalf("Expected a scheduled start, but got %s", StatusString(fw.status))
+	}
+	fw.ready = true
+	fw.Poll()
+	fw.Poll()
+	if expected := time.Date(2026, 10, 12, 19, 0, 0, 0, time.UTC); !fw.stopAt.Equal(expected) {
+		t.Errorf("Expected to be held until %v, but got %v", expected, fw.stopAt)
+	}
+
+	// Stopped in the evening, even though it's in use
+	clock.Advance(10 * time.Hour)
+	fw.Poll()
+	if fw.status != STARTED {
+		t.Fatalf("Expected STARTED before the stop, but got %s", StatusString(fw.status))
+	}
+	clock.Advance(time.Hour)
+	fw.Poll()
+	if fw.status != STOPPING || fw.lastStop == nil || fw.lastStop.Reason != StopSchedule {
+		t.Errorf("Expected a scheduled stop, but got %s %v", StatusString(fw.status), fw.lastStop)
+	}
+	if expected := []string{"start app", "stop app"}; strings.Join(calls, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("Expected calls %q but got %q", expected, calls)
+	}
+
+	// Not started at the weekend
+	fw.status = STOPPED
+	clock.Advance(5 * 24 * time.Hour)
+	fw.Poll()
+	if fw.status != STOPPED {
+		t.Errorf("Expected no start on Saturday, but got %s", StatusString(fw.status))
+	}
+
+	config.Schedule.Windows = []ScheduleWindow{{Days: "someday", Start: "08:00"}}
+	if err := config.Schedule.Validate(); err == nil {
+		t.Errorf("Expected an error for invalid days")
+	}
+}
+
+func TestBlackout(t *testing.T) {
+	// Monday morning
+	clock := NewFakeClock(time.Date(2026, 10, 12, 10, 0, 0, 0, time.UTC))
+	var calls []string
+	driver := &fakeDriver{name: "app", state: "stopped", calls: &calls}
+	config := &Config{
+		Endpoint:    "10.0.0.1:80",
+		IdleTimeout: Duration(time.Hour),
+		Blackouts: []BlackoutWindow{
+			{Name: "Business hours", Days: "mon-fri", ClockWindow: ClockWindow{From: "09:00", To: "17:00", Timezone: "UTC"}},
+			{Days: "fri", ClockWindow: ClockWindow{From: "22:00", To: "02:00"}},
+		},
+	}
+	for i := range config.Blackouts {
+		if err := config.Blackouts[i].Validate(); err != nil {
+			t.Fatalf("Expected a valid blackout, but got %v", err)
+		}
+	}
+	fw := New(config, WithStateStore(&memStateStore{}), WithClock(clock), WithDriver(driver))
+	if err := fw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	fw.ready = true
+	fw.Poll()
+
+	// Idle through a long meeting, but not stopped
+	clock.Advance(2 * time.Hour)
+	fw.Poll()
+	fw.RecvPing(&Ping{idle: true, replyTo: make(chan Pong, 1)})
+	if fw.status != STARTED {
+		t.Fatalf("Expected STARTED during the blackout, but got %s", StatusString(fw.status))
+	}
+	if pong := fw.statusPong(); pong.Blackout != "Business hours" {
+		t.Errorf("Expected the blackout in the status, but got %q", pong.Blackout)
+	}
+
+	// Stopped once it ends
+	clock.Advance(5 * time.Hour)
+	fw.Poll()
+	if fw.status != STOPPING || fw.lastStop == nil || fw.lastStop.Reason != StopIdleTimeout {
+		t.Errorf("Expected an idle stop after the blackout, but got %s %v", StatusString(fw.status), fw.lastStop)
+	}
+
+	for _, test := range []struct {
+		at       time.Time
+		expected bool
+	}{
+		{time.Date(2026, 10, 16, 23, 0, 0, 0, time.UTC), true},
+		{time.Date(2026, 10, 17, 1, 0, 0, 0, time.UTC), true},
+		{time.Date(2026, 10, 16, 1, 0, 0, 0, time.UTC), false},
+		{time.Date(2026, 10, 17, 10, 0, 0, 0, time.UTC), false},
+	} {
+		if contains := config.Blackouts[1].Contains(test.at) || config.Blackouts[0].Contains(test.at); contains != test.expected {
+			t.Errorf("Expected %v to be in a blackout: %v, but got %v", test.at, test.expected, contains)
+		}
+	}
+	if config.Blackouts[1].Name != "22:00-02:00" {
+		t.Errorf("Expected a name from the times, but got %q", config.Blackouts[1].Name)
+	}
+
+	config.Blackouts[0].Days = "someday"
+	if err := config.Blackouts[0].Validate(); err == nil {
+		t.Errorf("Expected an error for invalid days")
+	}
+}
+
+func TestDeadlineSurvivesActivity(t *testing.T) {
+	now := time.Date(2026, 10, 15, 9, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(now)
+	fw := New(&Config{Endpoint: "10.0.0.1:80", IdleTimeout: Duration(time.Hour)}, WithStateStore(&memStateStore{}), WithClock(clock))
+	fw.status = STARTED
+	fw.lastStarted = now
+	deadline := now.Add(9*time.Hour + 30*time.Minute)
+	if err := fw.setDeadline(deadline); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Minute)
+	ping := Ping{replyTo: make(chan Pong, 1)}
+	fw.RecvPing(&ping)
+	if !fw.deadline || !fw.stopAt.Equal(deadline) {
+		t.Errorf("Expected the deadline %v to stay after a request, but got %v %v", deadline, fw.deadline, fw.stopAt)
+	}
+}
+
+func TestExtensionSurvivesActivity(t *testing.T) {
+	now := time.Date(2026, 10, 15, 9, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(now)
+	fw := New(&Config{Endpoint: "10.0.0.1:80", IdleTimeout: Duration(time.Hour), MaxExtensionPerUser: Duration(4 * time.Hour)},
+		WithStateStore(&memStateStore{}), WithClock(clock))
+	fw.status = STARTED
+	fw.lastStarted = now
+	fw.restartIdleTimer()
+
+	extend := Ping{extend: 3 * time.Hour, user: "alice", replyTo: make(chan Pong, 1)}
+	fw.RecvPing(&extend)
+	if pong := <-extend.replyTo; pong.Err != nil || !pong.StopAt.Equal(now.Add(4*time.Hour)) {
+		t.Fatalf("Expected the stop extended to %v, but got %v %v", now.Add(4*time.Hour), pong.StopAt, pong.Err)
+	}
+
+	clock.Advance(time.Minute)
+	ping := Ping{user: "alice", replyTo: make(chan Pong, 1)}
+	fw.RecvPing(&ping)
+	if !fw.deadline || !fw.stopAt.Equal(now.Add(4*time.Hour)) {
+		t.Errorf("Expected the extension to survive a request, but got %v %v", fw.deadline, fw.stopAt)
+	}
+}
+
+func TestRestoreDeadline(t *testing.T) {
+	now := time.Date(2026, 10, 15, 9, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(now)
+	fw := New(&Config{Endpoint: "10.0.0.1:80", IdleTimeout: Duration(time.Hour)}, WithStateStore(&memStateStore{}), WithClock(clock))
+	fw.status = STARTED
+	fw.lastStarted = now
+	if err := fw.setDeadline(now.Add(3 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Saved, and read back after a restart
+	buf, err := json.Marshal(fw.statusPong())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved Pong
+	if err := json.Unmarshal(buf, &saved); err != nil {
+		t.Fatal(err)
+	}
+	restored := New(&Config{Endpoint: "10.0.0.1:80", IdleTimeout: Duration(time.Hour)}, WithStateStore(&memStateStore{}), WithClock(clock))
+	restored.restore(saved)
+	if !restored.deadline || !restored.stopAt.Equal(now.Add(3*time.Hour)) {
+		t.Fatalf("Expected the deadline at %v to be restored, but got %v %v", now.Add(3*time.Hour), restored.deadline, restored.stopAt)
+	}
+
+	clock.Advance(3*time.Hour + time.Second)
+	restored.Poll()
+	if restored.lastStop == nil || restored.lastStop.Reason != StopDeadline {
+		t.Errorf("Expected a stop for the deadline, but got %v", restored.lastStop)
+	}
+}
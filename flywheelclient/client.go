@@ -0,0 +1,349 @@
+// Package flywheelclient - a client for the flywheel HTTP API, for tools and
+// tests that need to control an environment.
+package flywheelclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Environment statuses, as reported by flywheel
+const (
+	Stopped   = "STOPPED"
+	Starting  = "STARTING"
+	Started   = "STARTED"
+	Stopping  = "STOPPING"
+	Unhealthy = "UNHEALTHY"
+)
+
+// Errors for the responses that callers are likely to handle
+var (
+	ErrUnauthorized = errors.New("Flywheel: missing or invalid API token")
+	ErrNotFound     = errors.New("Flywheel: environment or endpoint not found")
+	ErrUnhealthy    = errors.New("Flywheel: environment is unhealthy")
+)
+
+// APIError - any other error response
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("Flywheel: %d %s", e.StatusCode, e.Message)
+}
+
+// Status - the status of an environment
+type Status struct {
+	Status      string    `json:"status"`
+	LastStarted time.Time `json:"last-started"`
+	LastStopped time.Time `json:"last-stopped"`
+	StopAt      time.Time `json:"stop-due-at"`
+	Warnings    []string  `json:"warnings"`
+
+	// Seconds left until the stop while started, whatever the clock of
+	// the client says
+	StopIn int64 `json:"stop-in-seconds"`
+
+	// Why the environment was last stopped, nil if it hasn't been
+	LastStop *StopReason `json:"last-stop"`
+
+	// Instances the last stop left running, because they're protected
+	Protected []ProtectedResource `json:"protected"`
+
+	// Owner, notes and links set by admins, nil if none
+	Annotations *Annotations `json:"annotations"`
+}
+
+// StopReason - why an environment was stopped: idle, idle-timeout,
+// deadline, manual or external
+type StopReason struct {
+	Reason  string    `json:"reason"`
+	User    string    `json:"user"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// ProtectedResource - an instance with stop or scale-in protection
+type ProtectedResource struct {
+	Type       string `json:"type"`
+	ID         string `json:"id"`
+	Protection string `json:"protection"`
+	Group      string `json:"group"`
+}
+
+// Annotations - context about an environment: who owns it now, notes and
+// links
+type Annotations struct {
+	Owner     *Owner    `json:"owner,omitempty"`
+	Notes     string    `json:"notes,omitempty"`
+	Links     []Link    `json:"links,omitempty"`
+	UpdatedBy string    `json:"updated-by,omitempty"`
+	UpdatedAt time.Time `json:"updated-at"`
+}
+
+// Owner - who owns an environment, replacing the owner of its config
+type Owner struct {
+	Team  string `json:"team,omitempty"`
+	Email string `json:"email,omitempty"`
+	Slack string `json:"slack,omitempty"`
+}
+
+// Link - a link of the annotations, e.g. to a ticket or a runbook
+type Link struct {
+	Title string `json:"title,omitempty"`
+	URL   string `json:"url"`
+}
+
+// Vhost - a vhost served by an environment, and whether it was added with
+// the API rather than in the config
+type Vhost struct {
+	Host     string `json:"host"`
+	Endpoint string `json:"endpoint"`
+	Runtime  bool   `json:"runtime"`
+}
+
+// Content types of request bodies
+const (
+	formType = "application/x-www-form-urlencoded"
+	jsonType = "application/json"
+)
+
+// Client - talks to one flywheel environment
+type Client struct {
+	// BaseURL - any URL of the environment, e.g. "https://staging.example.com"
+	BaseURL string
+	// Token - API token, sent as a bearer token when set
+	Token string
+	// Retries - how often a request is retried after a network error or a
+	// 5xx response
+	Retries int
+	// RetryDelay - wait before the first retry, doubled for each further one
+	RetryDelay time.Duration
+
+	HTTPClient *http.Client
+}
+
+// New - create a client with the default retry settings
+func New(baseURL, token string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		Token:      token,
+		Retries:    3,
+		RetryDelay: time.Second,
+		HTTPClient: &http.Client{
+			Timeout: 30 * time.Second,
+			// Start answers with a redirect to the site itself
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// Status - fetch the current status
+func (c *Client) Status(ctx context.Context) (*Status, error) {
+	var status Status
+	err := c.do(ctx, "GET", "/?flywheel=status", "", nil, &status)
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Start - request a start. It returns once the request is accepted, use
+// WaitForStarted to wait for the environment.
+func (c *Client) Start(ctx context.Context) error {
+	return c.do(ctx, "GET", "/?flywheel=start", "", nil, nil)
+}
+
+// Stop - request a stop
+func (c *Client) Stop(ctx context.Context) (*Status, error) {
+	var status Status
+	err := c.do(ctx, "GET", "/?flywheel=stop", "", nil, &status)
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Extend - postpone the stop of a running environment
+func (c *Client) Extend(ctx context.Context, d time.Duration) (*Status, error) {
+	var status Status
+	body := url.Values{"duration": {d.String()}}.Encode()
+	err := c.do(ctx, "POST", "/flywheel/api/extend", formType, strings.NewReader(body), &status)
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Timeout - stop a running environment after the duration, whether that's
+// earlier or later than it would have
+func (c *Client) Timeout(ctx context.Context, d time.Duration) (*Status, error) {
+	var status Status
+	body := url.Values{"duration": {d.String()}}.Encode()
+	err := c.do(ctx, "POST", "/flywheel/api/v1/timeout", formType, strings.NewReader(body), &status)
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Vhosts - the vhosts added with the API, then those of the config
+func (c *Client) Vhosts(ctx context.Context) ([]Vhost, error) {
+	var vhosts []Vhost
+	err := c.do(ctx, "GET", "/flywheel/api/v1/vhosts", "", nil, &vhosts)
+	return vhosts, err
+}
+
+// SetVhost - add a vhost, or replace the endpoint of one added with the
+// API. Needs an admin token.
+func (c *Client) SetVhost(ctx context.Context, host, endpoint string) error {
+	return c.doJSON(ctx, "POST", "/flywheel/api/v1/vhosts", Vhost{Host: host, Endpoint: endpoint}, nil)
+}
+
+// DeleteVhost - remove a vhost added with the API. Needs an admin token.
+func (c *Client) DeleteVhost(ctx context.Context, host string) error {
+	return c.do(ctx, "DELETE", "/flywheel/api/v1/vhosts?host="+url.QueryEscape(host), "", nil, nil)
+}
+
+// Annotations - the owner, notes and links set by admins, nil if none
+func (c *Client) Annotations(ctx context.Context) (*Annotations, error) {
+	var a *Annotations
+	err := c.do(ctx, "GET", "/flywheel/api/v1/annotations", "", nil, &a)
+	return a, err
+}
+
+// SetAnnotations - replace the annotations. Needs an admin token.
+func (c *Client) SetAnnotations(ctx context.Context, a *Annotations) (*Annotations, error) {
+	var result *Annotations
+	err := c.doJSON(ctx, "PUT", "/flywheel/api/v1/annotations", a, &result)
+	return result, err
+}
+
+// ClearAnnotations - remove the annotations. Needs an admin token.
+func (c *Client) ClearAnnotations(ctx context.Context) error {
+	return c.do(ctx, "DELETE", "/flywheel/api/v1/annotations", "", nil, nil)
+}
+
+// WaitForStarted - start the environment if needed, and poll until it's
+// started, it becomes unhealthy or the context is done
+func (c *Client) WaitForStarted(ctx context.Context, interval time.Duration) (*Status, error) {
+	for {
+		status, err := c.Status(ctx)
+		if err != nil {
+			return nil, err
+		}
+		switch status.Status {
+		case Started:
+			return status, nil
+		case Unhealthy:
+			return status, ErrUnhealthy
+		case Stopped:
+			if err = c.Start(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// doJSON - send in as the JSON body of a request
+func (c *Client) doJSON(ctx context.Context, method, path string, in, out interface{}) error {
+	buf, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, method, path, jsonType, bytes.NewReader(buf), out)
+}
+
+// do - send a request, retrying on network errors and 5xx responses, and
+// decode the JSON reply into out
+func (c *Client) do(ctx context.Context, method, path, contentType string, body io.ReadSeeker, out interface{}) error {
+	delay := c.RetryDelay
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		retry, err = c.once(ctx, method, path, contentType, body, out)
+		if !retry || attempt >= c.Retries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if body != nil {
+			if _, err = body.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *Client) once(ctx context.Context, method, path, contentType string, body io.Reader, out interface{}) (bool, error) {
+	req, err := http.NewRequest(method, c.BaseURL+path, body)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return false, ErrUnauthorized
+	case resp.StatusCode == http.StatusNotFound:
+		return false, ErrNotFound
+	case resp.StatusCode >= 400:
+		return resp.StatusCode >= 500, responseError(resp)
+	}
+
+	if out == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	return false, json.NewDecoder(resp.Body).Decode(out)
+}
+
+// responseError - the error message of an API error response, or the start
+// of the body for anything else
+func responseError(resp *http.Response) error {
+	buf, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	var reply struct {
+		Error string `json:"error"`
+	}
+	message := strings.TrimSpace(string(buf))
+	if json.Unmarshal(buf, &reply) == nil && reply.Error != "" {
+		message = reply.Error
+	}
+	return &APIError{StatusCode: resp.StatusCode, Message: message}
+}
@@ -0,0 +1,144 @@
+package flywheelclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWaitForStarted(t *testing.T) {
+	status := Stopped
+	var failures, starts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if failures < 1 {
+			failures++
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		switch r.URL.Query().Get("flywheel") {
+		case "start":
+			starts++
+			status = Starting
+			w.Header().Set("Location", "/")
+			w.WriteHeader(http.StatusTemporaryRedirect)
+		case "status":
+			fmt.Fprintf(w, `{"status": %q}`, status)
+			if status == Starting {
+				status = Started
+			}
+		}
+	}))
+	defer server.Close()
+
+	client := New(server.URL, "secret")
+	client.RetryDelay = time.Millisecond
+	s, err := client.WaitForStarted(context.Background(), time.Millisecond)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	if s.Status != Started || starts != 1 {
+		t.Errorf("Expected STARTED after one start, but got %s after %d", s.Status, starts)
+	}
+
+	client.Token = "wrong"
+	if _, err = client.Status(context.Background()); err != ErrUnauthorized {
+		t.Errorf("Expected ErrUnauthorized but got %v", err)
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, `{"error": "Cannot extend while STOPPED"}`)
+	}))
+	defer server.Close()
+
+	_, err := New(server.URL, "").Extend(context.Background(), time.Hour)
+	apiErr, ok := err.(*APIError)
+	if !ok || apiErr.StatusCode != http.StatusConflict || apiErr.Message != "Cannot extend while STOPPED" {
+		t.Errorf("Expected a 409 APIError but got %#v", err)
+	}
+}
+
+func TestVhostsAndAnnotations(t *testing.T) {
+	var vhost Vhost
+	var annotations *Annotations
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Body != nil && r.Method != "GET" && r.Method != "DELETE" && r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Expected a JSON body but got %s", r.Header.Get("Content-Type"))
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "POST /flywheel/api/v1/vhosts":
+			json.NewDecoder(r.Body).Decode(&vhost)
+			vhost.Runtime = true
+		case "DELETE /flywheel/api/v1/vhosts":
+			if r.FormValue("host") != vhost.Host {
+				w.WriteHeader(http.StatusConflict)
+				fmt.Fprintf(w, `{"error": "No runtime vhost %s"}`, r.FormValue("host"))
+				return
+			}
+			vhost = Vhost{}
+		case "GET /flywheel/api/v1/vhosts":
+		case "PUT /flywheel/api/v1/annotations":
+			annotations = &Annotations{}
+			json.NewDecoder(r.Body).Decode(annotations)
+			annotations.UpdatedBy = "admin"
+		case "DELETE /flywheel/api/v1/annotations":
+			annotations = nil
+		case "GET /flywheel/api/v1/annotations":
+		default:
+			t.Errorf("Unexpected %s %s", r.Method, r.URL.Path)
+		}
+		if r.URL.Path == "/flywheel/api/v1/vhosts" {
+			json.NewEncoder(w).Encode([]Vhost{vhost})
+		} else {
+			json.NewEncoder(w).Encode(annotations)
+		}
+	}))
+	defer server.Close()
+	ctx := context.Background()
+	client := New(server.URL+"/", "secret")
+
+	if err := client.SetVhost(ctx, "new.example.com", "10.0.0.5:8080"); err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	vhosts, err := client.Vhosts(ctx)
+	if err != nil || len(vhosts) != 1 || vhosts[0] != (Vhost{Host: "new.example.com", Endpoint: "10.0.0.5:8080", Runtime: true}) {
+		t.Errorf("Expected the new vhost but got %+v %v", vhosts, err)
+	}
+	if err = client.DeleteVhost(ctx, "other.example.com"); err == nil {
+		t.Errorf("Expected an error removing an unknown vhost")
+	}
+	if err = client.DeleteVhost(ctx, "new.example.com"); err != nil {
+		t.Errorf("Expected no error but got %v", err)
+	}
+
+	set := &Annotations{Owner: &Owner{Team: "checkout"}, Links: []Link{{Title: "AUD-12", URL: "https://jira.example.com/browse/AUD-12"}}}
+	a, err := client.SetAnnotations(ctx, set)
+	if err != nil || a == nil || a.Owner.Team != "checkout" || a.Links[0].Title != "AUD-12" || a.UpdatedBy != "admin" {
+		t.Errorf("Expected the annotations back but got %+v %v", a, err)
+	}
+	if err = client.ClearAnnotations(ctx); err != nil {
+		t.Errorf("Expected no error but got %v", err)
+	}
+	if a, err = client.Annotations(ctx); a != nil || err != nil {
+		t.Errorf("Expected no annotations but got %+v %v", a, err)
+	}
+
+	client.Token = "wrong"
+	if err = client.SetVhost(ctx, "new.example.com", "10.0.0.5:8080"); err != ErrUnauthorized {
+		t.Errorf("Expected ErrUnauthorized but got %v", err)
+	}
+}
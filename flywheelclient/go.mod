@@ -0,0 +1,3 @@
+module github.com/fairfaxmedia/flywheel/flywheelclient
+
+go 1.18
@@ -0,0 +1,205 @@
+package flywheel
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// GPUConfig - GPU instances, e.g. ML dev boxes. Their GPU utilization, as
+// reported to CloudWatch by the CloudWatch agent, counts as activity, and
+// they must pass a probe before the environment is STARTED.
+type GPUConfig struct {
+	Instances []string `json:"instances"`
+	// CloudWatch metric with the GPU utilization in percent, aggregated by
+	// InstanceId
+	Namespace string  `json:"namespace"`
+	Metric    string  `json:"metric"`
+	Threshold float64 `json:"threshold"`
+	// URL that answers 200 when the GPU is usable; {ip} is replaced with
+	// the instance's private IP
+	ProbeURL string `json:"probe-url"`
+}
+
+// Validate - check the instances, and set the metric defaults
+func (c *GPUConfig) Validate(instances []string) error {
+	if len(c.Instances) == 0 {
+		return nil
+	}
+	for _, id := range c.Instances {
+		if !contains(instances, id) {
+			return fmt.Errorf("GPU instance %s isn't in instances", id)
+		}
+	}
+	if c.Namespace == "" {
+		c.Namespace = "CWAgent"
+	}
+	if c.Metric == "" {
+		c.Metric = "nvidia_smi_utilization_gpu"
+	}
+	if c.Threshold <= 0 {
+		c.Threshold = 10
+	}
+	return nil
+}
+
+type getMetricStatisticsInput struct {
+	_ struct{} `type:"structure"`
+
+	Namespace  *string            `type:"string"`
+	MetricName *string            `type:"string"`
+	Dimensions []*metricDimension `type:"list"`
+	StartTime  *time.Time         `type:"timestamp" timestampFormat:"iso8601"`
+	EndTime    *time.Time         `type:"timestamp" timestampFormat:"iso8601"`
+	Period     *int64             `type:"integer"`
+	Statistics []*string          `type:"list"`
+}
+
+type metricDimension struct {
+	_ struct{} `type:"structure"`
+
+	Name  *string `type:"string"`
+	Value *string `type:"string"`
+}
+
+type getMetricStatisticsOutput struct {
+	_ struct{} `type:"structure"`
+
+	Datapoints []*struct {
+		Maximum *float64 `type:"double"`
+	} `type:"list"`
+}
+
+// checkHealth - CheckAll, with the application probe and the GPU checks
+// once everything is running. This runs in the health check goroutine, so it
+// may take its time.
+func (fw *Flywheel) checkHealth() healthResult {
+	var result healthResult
+	result.status, result.infrastructure = fw.CheckAll()
+	if fw.described != nil {
+		result.checkedGroups = fw.config.AutoScaling.groupNames()
+		result.missingGroups = fw.described.missing
+	}
+	fw.collectDiagnostics(fw.described)
+	result.maintenance = fw.checkMaintenance(fw.described)
+	if result.status != STARTED {
+		return result
+	}
+
+	// Only a start waits for the signals, not instances replaced later
+	if fw.config.Readiness.Enabled() && fw.described != nil && fw.Snapshot().Status != STARTED {
+		if result.notReady = fw.unready(fw.described); len(result.notReady) > 0 {
+			fw.logf("Waiting for %s to signal they are ready", strings.Join(result.notReady, ", "))
+			result.status = STARTING
+			return result
+		}
+	}
+
+	if fw.config.AppHealth.URL != "" {
+		result.probed = true
+		if err := fw.probeApplication(); err != nil {
+			fw.logf("Application probe failed: %v", err)
+			result.application = err.Error()
+			// Still booting while starting; broken once it had started
+			if fw.Snapshot().Status == STARTING {
+				result.status = STARTING
+			} else {
+				result.status = UNHEALTHY
+			}
+			return result
+		}
+	}
+
+	gpu := &fw.config.GPU
+	if len(gpu.Instances) == 0 {
+		return result
+	}
+
+	if gpu.ProbeURL != "" {
+		if err := fw.probeGPUs(); err != nil {
+			fw.logf("GPU probe failed: %v", err)
+			result.status = STARTING
+			return result
+		}
+	}
+
+	busy, err := fw.gpuBusy()
+	if err != nil {
+		fw.logf("Unable to check GPU utilization: %v", err)
+	} else if busy {
+		// Same as a request, resets the idle timer
+		fw.pings <- Ping{replyTo: make(chan Pong, 1)}
+	}
+	return result
+}
+
+// checkIdle - ask the flywheel goroutine to stop if the idle strategy says
+// so. It only stops a STARTED environment.
+func (fw *Flywheel) checkIdle() {
+	idle, err := fw.idle.Idle(fw.now())
+	if err != nil {
+		fw.logf("Unable to check if idle: %v", err)
+		return
+	}
+	if idle {
+		fw.pings <- Ping{idle: true, replyTo: make(chan Pong, 1)}
+	}
+}
+
+// gpuBusy - true if any GPU was used above the threshold in the last check
+// interval
+func (fw *Flywheel) gpuBusy() (bool, error) {
+	gpu := &fw.config.GPU
+	end := fw.now()
+	start := end.Add(-fw.hcInterval - time.Minute)
+
+	for _, id := range gpu.Instances {
+		var out getMetricStatisticsOutput
+		err := awsCall(fw.cloudwatch, "GetMetricStatistics", &getMetricStatisticsInput{
+			Namespace:  aws.String(gpu.Namespace),
+			MetricName: aws.String(gpu.Metric),
+			Dimensions: []*metricDimension{
+				{Name: aws.String("InstanceId"), Value: aws.String(id)},
+			},
+			StartTime:  &start,
+			EndTime:    &end,
+			Period:     aws.Int64(60),
+			Statistics: []*string{aws.String("Maximum")},
+		}, &out)
+		if err != nil {
+			return false, err
+		}
+		for _, point := range out.Datapoints {
+			if aws.Float64Value(point.Maximum) >= gpu.Threshold {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// probeGPUs - request the probe URL of every GPU instance
+func (fw *Flywheel) probeGPUs() error {
+	// The GPU instances were described by the health check just now
+	client := &http.Client{Timeout: 5 * time.Second}
+	for _, id := range fw.config.GPU.Instances {
+		instance, ok := fw.described.instances[id]
+		if !ok {
+			return fmt.Errorf("Instance %s not found", id)
+		}
+		ip := aws.StringValue(instance.PrivateIpAddress)
+		url := strings.Replace(fw.config.GPU.ProbeURL, "{ip}", ip, -1)
+		probe, err := client.Get(url)
+		if err != nil {
+			return err
+		}
+		probe.Body.Close()
+		if probe.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s answered %s", url, probe.Status)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package flywheel
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Notifications of health changes, one per dimension
+const (
+	NotifyInfrastructure = "infrastructure-health"
+	NotifyApplication    = "application-health"
+)
+
+// Health of a dimension
+const (
+	HealthUnknown   = "unknown"
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+)
+
+// AppHealthConfig - an application probe, checked with the health checks
+// once the instances are running
+type AppHealthConfig struct {
+	// Path on the backend, or a full URL, that answers 200 when the
+	// application works
+	URL string `json:"url"`
+
+	// Default 5s
+	Timeout Duration `json:"timeout"`
+}
+
+// Validate - fill in the defaults
+func (c *AppHealthConfig) Validate() error {
+	if c.Timeout <= 0 {
+		c.Timeout = Duration(5 * time.Second)
+	}
+	return nil
+}
+
+// HealthState - the health of one dimension, and why
+type HealthState struct {
+	Status string    `json:"status"`
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since,omitempty"`
+}
+
+// HealthReport - infrastructure and application health, reported apart so a
+// broken deploy isn't mistaken for AWS throttling. Infrastructure is the
+// state of the instances and groups; application the probe, and failures to
+// reach the backend.
+type HealthReport struct {
+	Infrastructure HealthState `json:"infrastructure"`
+	Application    HealthState `json:"application"`
+}
+
+// healthResult - a health check: the overall status, and why each dimension
+// is unhealthy. The application is unknown when it wasn't probed.
+type healthResult struct {
+	status         int
+	infrastructure string
+	application    string
+	probed         bool
+	notReady       []string
+	maintenance    *maintenanceCheck
+
+	// The groups described, and those of them that don't exist
+	checkedGroups []string
+	missingGroups []string
+}
+
+// setHealth - update a dimension, and notify when it turns unhealthy or
+// recovers
+func (fw *Flywheel) setHealth(state *HealthState, event, status, reason string) {
+	if state.Status == status && state.Reason == reason {
+		return
+	}
+	name := "Infrastructure"
+	if event == NotifyApplication {
+		name = "Application"
+	}
+	switch {
+	case status == HealthUnhealthy:
+		fw.notify(event, "%s unhealthy: %s", name, reason)
+	case state.Status == HealthUnhealthy && status == HealthHealthy:
+		fw.notify(event, "%s healthy again", name)
+	}
+	if state.Status != status {
+		state.Since = fw.now()
+	}
+	state.Status, state.Reason = status, reason
+}
+
+// applyHealthResult - update both dimensions, then the status
+func (fw *Flywheel) applyHealthResult(result healthResult) {
+	infrastructure := HealthHealthy
+	if result.infrastructure != "" {
+		infrastructure = HealthUnhealthy
+	}
+	fw.setHealth(&fw.health.Infrastructure, NotifyInfrastructure, infrastructure, result.infrastructure)
+
+	application := HealthUnknown
+	switch {
+	case result.application != "":
+		application = HealthUnhealthy
+	case result.probed:
+		application = HealthHealthy
+	}
+	fw.setHealth(&fw.health.Application, NotifyApplication, application, result.application)
+	fw.notReady = result.notReady
+	fw.applyMaintenance(result.maintenance)
+	fw.setMissingGroups(result.checkedGroups, result.missingGroups)
+
+	fw.applyHealth(result.status)
+}
+
+// probeApplication - check the application answers 200. This runs in the
+// health check goroutine.
+func (fw *Flywheel) probeApplication() error {
+	url := fw.backendURL(fw.config.AppHealth.URL)
+	client := &http.Client{Timeout: time.Duration(fw.config.AppHealth.Timeout)}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return nil
+}
+
+// backendURL - a full URL, or a path on the backend
+func (fw *Flywheel) backendURL(url string) string {
+	if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+		return url
+	}
+	return "http://" + fw.ProxyEndpoint("") + url
+}
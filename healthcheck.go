@@ -1,12 +1,12 @@
 package flywheel
 
 import (
-	"log"
+	"context"
+	"math/rand"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
-	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
 // Different state of the systems
@@ -18,6 +18,9 @@ const (
 	UNHEALTHY
 )
 
+// Health state of running instances that are observed or shared
+const runningUncontrolled = "running-uncontrolled"
+
 // StatusString - Working with integer statuses is mostly better, but it's
 // occasionally necessary to output the status name.
 func StatusString(n int) string {
@@ -37,143 +40,153 @@ func StatusString(n int) string {
 	}
 }
 
+// StatusFromString - the reverse of StatusString
+func StatusFromString(name string) (int, bool) {
+	for status := STOPPED; status <= UNHEALTHY; status++ {
+		if StatusString(status) == name {
+			return status, true
+		}
+	}
+	return STOPPED, false
+}
+
 // HealthWatcher - Check the status of the instances. Currently checks if they are "ready"; all
 // stopped or all started. Will need to be extended to determine actual status.
-func (fw *Flywheel) HealthWatcher(out chan<- int) {
-	out <- fw.CheckAll()
+func (fw *Flywheel) HealthWatcher(ctx context.Context, out chan<- healthResult) {
+	result := fw.checkHealth()
+	select {
+	case out <- result:
+	case <-ctx.Done():
+		return
+	}
 
-	ticker := time.NewTicker(fw.hcInterval)
+	clock := fw.timeSource()
+	health := clock.NewTimer(fw.jittered(fw.healthInterval(result.status)))
+	defer health.Stop()
+
+	// Idle strategies are checked on their own schedule
+	var idle <-chan time.Time
+	interval := time.Duration(fw.config.IdleInterval)
+	if fw.idle != nil {
+		idle = clock.NewTimer(fw.jittered(interval)).C()
+	}
 	for {
 		select {
-		case <-ticker.C:
-			out <- fw.CheckAll()
+		case <-ctx.Done():
+			return
+		case <-fw.refresh:
+			// Started or stopped, check soon instead of waiting for the
+			// steady state interval
+			health.Stop()
+			health.Reset(fw.jittered(fw.healthInterval(STARTING)))
+		case <-health.C():
+			result = fw.checkHealth()
+			select {
+			case out <- result:
+			case <-ctx.Done():
+				return
+			}
+			health.Reset(fw.jittered(fw.healthInterval(result.status)))
+		case <-idle:
+			if fw.Snapshot().Status == STARTED {
+				fw.checkIdle()
+			}
+			idle = clock.NewTimer(fw.jittered(interval)).C()
 		}
 	}
 }
 
-// CheckAll - check asg/instance state
-// TODO - add more information what is unhealthy
-func (fw *Flywheel) CheckAll() int {
-	health := make(map[string]int)
-
-	err := fw.checkInstances(health)
-	if err != nil {
-		log.Print(err)
-		return UNHEALTHY
-	}
-
-	err = fw.checkStoppedAutoScalingGroups(health)
-	if err != nil {
-		log.Print(err)
-		return UNHEALTHY
+// healthInterval - check often while starting or stopping, and less often
+// in a steady state
+func (fw *Flywheel) healthInterval(status int) time.Duration {
+	switch status {
+	case STARTING, STOPPING:
+		return time.Duration(fw.config.HcTransition)
 	}
+	return fw.hcInterval
+}
 
-	_, terminated := health["terminated"]
-	_, starting := health["pending"]
-	_, stopping := health["stopping"]
-	_, shutting := health["shutting-down"]
-	_, running := health["running"]
-	_, stopped := health["stopped"]
-
-	switch {
-	case starting && (stopping || shutting):
-		log.Print("Unhealthy: Mix of starting and stopping resources")
-		return UNHEALTHY
-
-	case running && stopped:
-		log.Print("Unhealthy: Mix of running and stopped resources")
-		return UNHEALTHY
-
-	case terminated:
-		log.Print("Instance terminated, manual intervention required")
-		return UNHEALTHY
-
-	case starting:
-		return STARTING
-
-	case stopping, shutting:
-		return STOPPING
-
-	case running:
-		return STARTED
-
-	case stopped:
-		return STOPPED
-
+// refreshHealth - tell the health watcher the status is about to change
+func (fw *Flywheel) refreshHealth() {
+	select {
+	case fw.refresh <- struct{}{}:
 	default:
-		log.Printf("Unhealthy: %v", health)
-		return UNHEALTHY
 	}
 }
 
-func (fw *Flywheel) checkInstances(health map[string]int) error {
-	if len(fw.config.Instances) == 0 {
-		return nil
-	}
-	resp, err := fw.ec2.DescribeInstances(
-		&ec2.DescribeInstancesInput{
-			InstanceIds: fw.config.AwsInstances(),
-		},
-	)
-	if err != nil {
-		log.Print(err)
-		return err
+// jittered - the interval, randomly shortened or lengthened by up to the
+// configured jitter, so environments don't all call AWS at the same time
+func (fw *Flywheel) jittered(interval time.Duration) time.Duration {
+	if fw.jitter <= 0 {
+		return interval
 	}
-
-	for _, reservation := range resp.Reservations {
-		for _, instance := range reservation.Instances {
-			state := *instance.State.Name
-			health[state] = health[state] + 1
-		}
-	}
-
-	return nil
+	return interval + time.Duration((rand.Float64()*2-1)*fw.jitter*float64(interval))
 }
 
-func (fw *Flywheel) checkStoppedAutoScalingGroups(health map[string]int) error {
-	var err error
-	var awsGroupNames []*string
+// CheckAll - check asg/instance state. When UNHEALTHY, also says why.
+func (fw *Flywheel) CheckAll() (int, string) {
+	var health healthStates
 
-	for _, groupName := range fw.config.AutoScaling.Stop {
-		awsGroupNames = append(awsGroupNames, &groupName)
+	d, err := fw.describe()
+	fw.resources.record(fw.config, d, err, fw.now())
+	if err != nil {
+		fw.logf("%v", err)
+		return UNHEALTHY, err.Error()
 	}
+	fw.described = d
+	fw.ownSchedules(d)
 
-	resp, err := fw.autoscaling.DescribeAutoScalingGroups(
-		&autoscaling.DescribeAutoScalingGroupsInput{
-			AutoScalingGroupNames: awsGroupNames,
-		},
-	)
-	if err != nil {
-		log.Print(err)
-		return err
+	if err := fw.checkDrivers(&health); err != nil {
+		fw.logf("%v", err)
+		return UNHEALTHY, err.Error()
 	}
 
-	for _, group := range resp.AutoScalingGroups {
-		running := true
+	status, reason := fw.config.HealthRules.aggregate(health)
+	if status == UNHEALTHY {
+		fw.logf("Unhealthy: %s", reason)
+	}
+	return status, reason
+}
 
-		instanceIds := []*string{}
-		for _, instance := range group.Instances {
-			instanceIds = append(instanceIds, instance.InstanceId)
+func (fw *Flywheel) checkInstances(d *described, health *healthStates) {
+	for _, id := range fw.config.Instances {
+		instance, ok := d.instances[id]
+		if !ok {
+			continue
+		}
+		state := aws.StringValue(instance.State.Name)
+		if state == "running" && (fw.config.uncontrolled(id) || fw.deferred(ResourceInstance, id)) {
+			state = runningUncontrolled
 		}
+		health.add(id, state, 1)
+	}
+}
 
-		iResp, err := fw.ec2.DescribeInstances(
-			&ec2.DescribeInstancesInput{
-				InstanceIds: instanceIds,
-			},
-		)
-		if err != nil {
-			return err
+func (fw *Flywheel) checkStoppedAutoScalingGroups(d *described, health *healthStates) error {
+	policies := fw.config.AutoScaling.policies()
+	for _, groupName := range fw.config.AutoScaling.StopGroups() {
+		group, ok := d.groups[groupName]
+		if !ok {
+			continue
 		}
+		running := true
+		deferred := fw.deferred(ResourceAutoScalingGroup, groupName)
 
-		for _, reservation := range iResp.Reservations {
-			for _, instance := range reservation.Instances {
-				state := *instance.State.Name
-				health[state] = health[state] + 1
-				running = running && *instance.State.Name == "running"
+		for _, member := range group.Instances {
+			instance, ok := d.instances[aws.StringValue(member.InstanceId)]
+			if !ok {
+				continue
+			}
+			state := aws.StringValue(instance.State.Name)
+			running = running && state == "running"
+			if state == "running" && deferred {
+				state = runningUncontrolled
 			}
+			health.add(groupName, state, 1/float64(len(group.Instances)))
 		}
 
-		if running && len(group.SuspendedProcesses) > 0 {
+		resume := fw.suspended.resumable(groupName, policies[groupName].suspended())
+		if running && suspendedAny(group, resume) && !fw.config.Observed(groupName) && !deferred && !fw.Snapshot().ReadOnly {
 			for _, instance := range group.Instances {
 				fw.autoscaling.SetInstanceHealth(
 					&autoscaling.SetInstanceHealthInput{
@@ -183,12 +196,9 @@ func (fw *Flywheel) checkStoppedAutoScalingGroups(health map[string]int) error {
 				)
 			}
 
-			_, err = fw.autoscaling.ResumeProcesses(
-				&autoscaling.ScalingProcessQuery{
-					AutoScalingGroupName: group.AutoScalingGroupName,
-				},
-			)
+			err := fw.resumeGroup(groupName, resume)
 			if err != nil {
+				fw.resources.fail(ResourceAutoScalingGroup, groupName, err, fw.now())
 				return err
 			}
 		}
@@ -198,11 +208,11 @@ func (fw *Flywheel) checkStoppedAutoScalingGroups(health map[string]int) error {
 }
 
 // NOT USED ?
-func (fw *Flywheel) checkTerminatedAutoScalingGroups(health map[string]int) error {
+func (fw *Flywheel) checkTerminatedAutoScalingGroups(health *healthStates) error {
 	var err error
 	var awsGroupNames []*string
 
-	for groupName := range fw.config.AutoScaling.Terminate {
+	for groupName := range fw.config.AutoScaling.TerminateGroups() {
 		awsGroupNames = append(awsGroupNames, &groupName)
 	}
 
@@ -212,16 +222,16 @@ func (fw *Flywheel) checkTerminatedAutoScalingGroups(health map[string]int) erro
 		},
 	)
 	if err != nil {
-		log.Print(err)
+		fw.logf("%v", err)
 		return err
 	}
 
 	for _, group := range resp.AutoScalingGroups {
 		if *group.MaxSize == 0 {
 			if len(group.Instances) == 0 {
-				health["stopped"]++
+				health.add(aws.StringValue(group.AutoScalingGroupName), "stopped", 1)
 			} else {
-				health["stopping"]++
+				health.add(aws.StringValue(group.AutoScalingGroupName), "stopping", 1)
 			}
 			continue
 		}
@@ -235,7 +245,7 @@ func (fw *Flywheel) checkTerminatedAutoScalingGroups(health map[string]int) erro
 		}
 
 		if healthy {
-			health["running"]++
+			health.add(aws.StringValue(group.AutoScalingGroupName), "running", 1)
 			if len(group.SuspendedProcesses) > 0 {
 				_, err = fw.autoscaling.ResumeProcesses(
 					&autoscaling.ScalingProcessQuery{
@@ -247,7 +257,7 @@ func (fw *Flywheel) checkTerminatedAutoScalingGroups(health map[string]int) erro
 				}
 			}
 		} else {
-			health["starting"]++
+			health.add(aws.StringValue(group.AutoScalingGroupName), "starting", 1)
 		}
 	}
 
@@ -0,0 +1,192 @@
+package flywheel
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Rules for turning the states of the resources into the status
+const (
+	HealthRuleAll      = "all"
+	HealthRuleQuorum   = "quorum"
+	HealthRuleWeighted = "weighted"
+)
+
+// HealthRulesConfig - how the states of the resources make up the status.
+// With all, every resource has to agree, a mix is UNHEALTHY. With quorum,
+// the state of at least the quorum share of the resources wins, and with
+// weighted the share is of their weights, so e.g. a flaky reporting
+// instance doesn't keep a large environment UNHEALTHY.
+type HealthRulesConfig struct {
+	Rule string `json:"rule"`
+
+	// Share needed to win, above 0.5 and up to 1, default 0.75
+	Quorum float64 `json:"quorum"`
+
+	// Weight of each instance, autoscaling group or exec resource by ID or
+	// name, default 1. The instances of a group share its weight.
+	Weights map[string]float64 `json:"weights"`
+}
+
+// Validate - check the rule and fill in the defaults
+func (c *HealthRulesConfig) Validate() error {
+	switch c.Rule {
+	case "":
+		c.Rule = HealthRuleAll
+	case HealthRuleAll, HealthRuleQuorum, HealthRuleWeighted:
+	default:
+		return fmt.Errorf("Unknown health rule %q, expected all, quorum or weighted", c.Rule)
+	}
+	if c.Quorum == 0 {
+		c.Quorum = 0.75
+	}
+	if c.Quorum <= 0.5 || c.Quorum > 1 {
+		return fmt.Errorf("Health quorum must be above 0.5 and up to 1, got %v", c.Quorum)
+	}
+	for name, weight := range c.Weights {
+		if weight < 0 {
+			return fmt.Errorf("Health weight of %s can't be negative", name)
+		}
+	}
+	return nil
+}
+
+// weight - the weight of a resource under the rule
+func (c *HealthRulesConfig) weight(resource string) float64 {
+	if c.Rule != HealthRuleWeighted {
+		return 1
+	}
+	if weight, ok := c.Weights[resource]; ok {
+		return weight
+	}
+	return 1
+}
+
+// ResourceState - the state of a resource, or of one instance of a group,
+// which then has a share of the group's weight. Exported for the Ready
+// method of drivers added with WithDriver.
+type ResourceState struct {
+	Resource string
+	State    string
+	Share    float64
+}
+
+// healthStates - the states found by a health check
+type healthStates []ResourceState
+
+// add - record the state of a resource. Group instances add a share.
+func (h *healthStates) add(resource, state string, share float64) {
+	*h = append(*h, ResourceState{Resource: resource, State: state, Share: share})
+}
+
+// controlled - the states, leaving out observed and shared instances that
+// may be running for someone else. They only count as running when there
+// is nothing else.
+func (h healthStates) controlled() healthStates {
+	var states healthStates
+	for _, s := range h {
+		if s.State != runningUncontrolled {
+			states = append(states, s)
+		}
+	}
+	if len(states) > 0 {
+		return states
+	}
+	for _, s := range h {
+		s.State = "running"
+		states = append(states, s)
+	}
+	return states
+}
+
+// counts - how many resources are in each state
+func (h healthStates) counts() map[string]int {
+	counts := make(map[string]int)
+	for _, s := range h {
+		counts[s.State]++
+	}
+	return counts
+}
+
+// statusOfState - the status a resource state stands for
+func statusOfState(state string) (int, bool) {
+	switch state {
+	case "pending":
+		return STARTING, true
+	case "stopping", "shutting-down":
+		return STOPPING, true
+	case "running":
+		return STARTED, true
+	case "stopped":
+		return STOPPED, true
+	}
+	return UNHEALTHY, false
+}
+
+// aggregate - the status of the states under the rule. When UNHEALTHY,
+// also says why.
+func (c *HealthRulesConfig) aggregate(h healthStates) (int, string) {
+	h = h.controlled()
+	if c.Rule == "" || c.Rule == HealthRuleAll {
+		return aggregateAll(h.counts())
+	}
+
+	weights := make(map[int]float64)
+	var total float64
+	for _, s := range h {
+		weight := c.weight(s.Resource) * s.Share
+		status, _ := statusOfState(s.State)
+		weights[status] += weight
+		total += weight
+	}
+	if total == 0 {
+		return aggregateAll(h.counts())
+	}
+	for status, weight := range weights {
+		if status != UNHEALTHY && weight/total >= c.Quorum {
+			return status, ""
+		}
+	}
+
+	var shares []string
+	for status, weight := range weights {
+		shares = append(shares, fmt.Sprintf("%s %.0f%%", StatusString(status), 100*weight/total))
+	}
+	sort.Strings(shares)
+	return UNHEALTHY, fmt.Sprintf("No status has a quorum of %.0f%%: %s", 100*c.Quorum, strings.Join(shares, ", "))
+}
+
+// aggregateAll - every resource has to agree
+func aggregateAll(health map[string]int) (int, string) {
+	_, terminated := health["terminated"]
+	_, starting := health["pending"]
+	_, stopping := health["stopping"]
+	_, shutting := health["shutting-down"]
+	_, running := health["running"]
+	_, stopped := health["stopped"]
+
+	switch {
+	case starting && (stopping || shutting):
+		return UNHEALTHY, "Mix of starting and stopping resources"
+
+	case running && stopped:
+		return UNHEALTHY, "Mix of running and stopped resources"
+
+	case terminated:
+		return UNHEALTHY, "Instance terminated, manual intervention required"
+
+	case starting:
+		return STARTING, ""
+
+	case stopping, shutting:
+		return STOPPING, ""
+
+	case running:
+		return STARTED, ""
+
+	case stopped:
+		return STOPPED, ""
+	}
+	return UNHEALTHY, fmt.Sprintf("Unexpected resource states %v", health)
+}
@@ -0,0 +1,337 @@
+package flywheel
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Types of history events
+const (
+	HistoryRequests   = "requests"
+	HistoryTransition = "transition"
+	HistoryStartup    = "startup"
+	HistoryGap        = "gap"
+	HistoryColdStart  = "cold-start"
+)
+
+// What caused a transition. Transitions completed by the health checks,
+// e.g. STARTING to STARTED, have no other cause.
+const (
+	TriggerRequest     = "request"
+	TriggerStop        = "stop"
+	TriggerIdle        = "idle"
+	TriggerIdleTimeout = "idle-timeout"
+	TriggerDeadline    = "deadline"
+	TriggerRecovery    = "recovery"
+	TriggerCalendar    = "calendar"
+	TriggerHealth      = "health-check"
+)
+
+// Gaps between requests shorter than this aren't recorded; they're
+// irrelevant to choosing an idle timeout.
+const minHistoryGap = time.Minute
+
+// HistoryEvent - a single entry in the usage history
+type HistoryEvent struct {
+	Time     time.Time     `json:"time"`
+	Type     string        `json:"type"`
+	Count    int           `json:"count,omitempty"`
+	From     string        `json:"from,omitempty"`
+	To       string        `json:"to,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+	Trigger  string        `json:"trigger,omitempty"`
+	User     string        `json:"user,omitempty"`
+
+	// Why a transition stopped the environment
+	StopReason string `json:"stop-reason,omitempty"`
+}
+
+// How often the history is pruned to history-max-age
+const historyPruneInterval = time.Hour
+
+// History - usage history store. Events are appended to a file, one JSON
+// object per line, and kept in memory for queries. Request counts are
+// aggregated per hour before being written.
+type History struct {
+	mu       sync.Mutex
+	filename string
+	fd       *os.File
+	events   []HistoryEvent
+	hour     time.Time
+	requests int
+	last     time.Time
+}
+
+// OpenHistory - load the history file, creating it if needed
+func OpenHistory(filename string) (*History, error) {
+	fd, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &History{filename: filename, fd: fd}
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		var event HistoryEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue
+		}
+		h.events = append(h.events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// Close - flush pending request counts and close the file
+func (h *History) Close() error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.flushRequests()
+	return h.fd.Close()
+}
+
+// RecordRequest - count a request in the hourly totals
+func (h *History) RecordRequest(now time.Time) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.last.IsZero() && now.Sub(h.last) >= minHistoryGap {
+		h.append(HistoryEvent{Time: now, Type: HistoryGap, Duration: now.Sub(h.last)})
+	}
+	h.last = now
+
+	hour := now.Truncate(time.Hour)
+	if !hour.Equal(h.hour) {
+		h.flushRequests()
+		h.hour = hour
+	}
+	h.requests++
+}
+
+// RecordTransition - record a status change, what caused it and for whom
+func (h *History) RecordTransition(now time.Time, from, to int, trigger, user string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.append(HistoryEvent{
+		Time:    now,
+		Type:    HistoryTransition,
+		From:    StatusString(from),
+		To:      StatusString(to),
+		Trigger: trigger,
+		User:    user,
+
+		StopReason: stopReason(from, to, trigger),
+	})
+}
+
+// RecordStartup - record how long a startup took
+func (h *History) RecordStartup(now time.Time, duration time.Duration) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.append(HistoryEvent{
+		Time:     now,
+		Type:     HistoryStartup,
+		Duration: duration,
+	})
+}
+
+// RecordColdStart - record how long the first request of a start waited
+// for a response
+func (h *History) RecordColdStart(now time.Time, latency time.Duration) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.append(HistoryEvent{
+		Time:     now,
+		Type:     HistoryColdStart,
+		Duration: latency,
+	})
+}
+
+// Append - add events, e.g. from an imported archive. Events already in
+// the history are skipped, so importing an archive again doesn't add its
+// history twice.
+func (h *History) Append(events []HistoryEvent) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	seen := map[HistoryEvent]bool{}
+	for _, event := range h.events {
+		seen[event.key()] = true
+	}
+	for _, event := range events {
+		if !seen[event.key()] {
+			seen[event.key()] = true
+			h.append(event)
+		}
+	}
+}
+
+// key - the event with its time in UTC, to compare events read from
+// different files
+func (e HistoryEvent) key() HistoryEvent {
+	e.Time = e.Time.UTC()
+	return e
+}
+
+// pruneHistory - drop history older than history-max-age, hourly
+func (fw *Flywheel) pruneHistory() {
+	maxAge := time.Duration(fw.config.HistoryMaxAge)
+	now := fw.now()
+	if fw.history == nil || maxAge == 0 || now.Sub(fw.historyPruned) < historyPruneInterval {
+		return
+	}
+	fw.historyPruned = now
+	if err := fw.history.Prune(now.Add(-maxAge)); err != nil {
+		fw.logf("Unable to prune history: %v", err)
+	}
+}
+
+// Prune - drop the events before a point in time, from memory and from the
+// file, which is rewritten and replaces the old one
+func (h *History) Prune(before time.Time) error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var kept []HistoryEvent
+	for _, event := range h.events {
+		if !event.Time.Before(before) {
+			kept = append(kept, event)
+		}
+	}
+	if len(kept) == len(h.events) {
+		return nil
+	}
+	h.events = kept
+	if h.fd == nil {
+		return nil
+	}
+
+	tmp := h.filename + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fd)
+	encoder := json.NewEncoder(w)
+	for _, event := range kept {
+		if err = encoder.Encode(event); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Windows can't replace an open file. Appends go to whichever file is
+	// in place afterwards.
+	h.fd.Close()
+	if err = os.Rename(tmp, h.filename); err != nil {
+		os.Remove(tmp)
+	}
+	fd, oerr := os.OpenFile(h.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if oerr != nil {
+		h.fd = nil
+		return oerr
+	}
+	h.fd = fd
+	return err
+}
+
+// Events - all events of the given type since a point in time. An empty
+// type matches every event.
+func (h *History) Events(eventType string, since time.Time) []HistoryEvent {
+	result := []HistoryEvent{}
+	if h == nil {
+		return result
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, event := range h.pending() {
+		if eventType != "" && event.Type != eventType {
+			continue
+		}
+		if event.Time.Before(since) {
+			continue
+		}
+		result = append(result, event)
+	}
+	return result
+}
+
+// Heatmap - request counts by weekday (0 = Sunday) and hour of day
+func (h *History) Heatmap(since time.Time, loc *time.Location) [7][24]int {
+	var heatmap [7][24]int
+	for _, event := range h.Events(HistoryRequests, since) {
+		t := event.Time.In(loc)
+		heatmap[t.Weekday()][t.Hour()] += event.Count
+	}
+	return heatmap
+}
+
+// pending - the stored events plus the request count for the current hour
+func (h *History) pending() []HistoryEvent {
+	if h.requests == 0 {
+		return h.events
+	}
+	events := make([]HistoryEvent, len(h.events), len(h.events)+1)
+	copy(events, h.events)
+	return append(events, HistoryEvent{Time: h.hour, Type: HistoryRequests, Count: h.requests})
+}
+
+func (h *History) flushRequests() {
+	if h.requests == 0 {
+		return
+	}
+	h.append(HistoryEvent{Time: h.hour, Type: HistoryRequests, Count: h.requests})
+	h.requests = 0
+}
+
+func (h *History) append(event HistoryEvent) {
+	h.events = append(h.events, event)
+	if h.fd == nil {
+		return
+	}
+	buf, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Unable to write history: %v", err)
+		return
+	}
+	if _, err = h.fd.Write(append(buf, '\n')); err != nil {
+		log.Printf("Unable to write history: %v", err)
+	}
+}
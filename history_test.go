@@ -0,0 +1,374 @@
+package flywheel
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistoryPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flywheel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "history.jsonl")
+
+	h, err := OpenHistory(filename)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+
+	// Monday 2016-06-06 09:xx and 10:xx UTC
+	monday := time.Date(2016, 6, 6, 9, 15, 0, 0, time.UTC)
+	h.RecordRequest(monday)
+	h.RecordRequest(monday.Add(time.Minute))
+	h.RecordRequest(monday.Add(time.Hour))
+	h.RecordTransition(monday, STOPPED, STARTING, TriggerRequest, "alice")
+	h.RecordStartup(monday, 90*time.Second)
+	h.Close()
+
+	h, err = OpenHistory(filename)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	defer h.Close()
+
+	heatmap := h.Heatmap(time.Time{}, time.UTC)
+	if heatmap[time.Monday][9] != 2 {
+		t.Errorf("Expected 2 requests at 9:00, but got %d", heatmap[time.Monday][9])
+	}
+	if heatmap[time.Monday][10] != 1 {
+		t.Errorf("Expected 1 request at 10:00, but got %d", heatmap[time.Monday][10])
+	}
+
+	startups := h.Events(HistoryStartup, time.Time{})
+	if len(startups) != 1 || startups[0].Duration != 90*time.Second {
+		t.Errorf("Expected one 90s startup, but got %v", startups)
+	}
+
+	transitions := h.Events(HistoryTransition, time.Time{})
+	if len(transitions) != 1 || transitions[0].To != "STARTING" {
+		t.Errorf("Expected transition to STARTING, but got %v", transitions)
+	} else if transitions[0].Trigger != TriggerRequest || transitions[0].User != "alice" {
+		t.Errorf("Expected a request by alice, but got %v", transitions[0])
+	}
+}
+
+func TestHistoryUsage(t *testing.T) {
+	h := &History{}
+	day := time.Date(2016, 6, 6, 0, 0, 0, 0, time.UTC)
+
+	// Up since the day before, stopped at 2:00, started by a request at
+	// 9:00 and stopped when idle at 17:30 the next day
+	h.RecordTransition(day.Add(-time.Hour), STOPPED, STARTING, TriggerRequest, "bob")
+	h.RecordTransition(day.Add(2*time.Hour), STARTED, STOPPING, TriggerStop, "")
+	h.RecordTransition(day.Add(2*time.Hour+time.Minute), STOPPING, STOPPED, TriggerHealth, "")
+	h.RecordTransition(day.Add(9*time.Hour), STOPPED, STARTING, TriggerRequest, "alice")
+	h.RecordTransition(day.Add(9*time.Hour+2*time.Minute), STARTING, STARTED, TriggerHealth, "")
+	h.RecordRequest(day.Add(9 * time.Hour))
+	h.RecordTransition(day.Add(41*time.Hour+30*time.Minute), STARTED, STOPPING, TriggerIdle, "")
+	h.RecordTransition(day.Add(41*time.Hour+31*time.Minute), STOPPING, STOPPED, TriggerHealth, "")
+
+	report := h.Usage(day, day.AddDate(0, 0, 2), time.UTC, day.AddDate(0, 0, 3))
+	if len(report.Transitions) != 6 {
+		t.Errorf("Expected 6 transitions, but got %v", report.Transitions)
+	}
+	if len(report.Days) != 2 {
+		t.Fatalf("Expected 2 days, but got %v", report.Days)
+	}
+	monday, tuesday := report.Days[0], report.Days[1]
+	if expected := 2 + 1.0/60 + 15; monday.UptimeHours != expected {
+		t.Errorf("Expected %v hours up on Monday but got %v", expected, monday.UptimeHours)
+	}
+	if expected := 17 + 31.0/60; tuesday.UptimeHours != expected {
+		t.Errorf("Expected %v hours up on Tuesday but got %v", expected, tuesday.UptimeHours)
+	}
+	if monday.Starts != 1 || monday.Stops != 1 || monday.Requests != 1 {
+		t.Errorf("Expected a start, a stop and a request on Monday, but got %+v", monday)
+	}
+	if monday.Triggers[TriggerRequest] != 1 || monday.Triggers[TriggerStop] != 1 || len(monday.Users) != 1 || monday.Users[0] != "alice" {
+		t.Errorf("Expected a stop, and a request by alice on Monday, but got %+v", monday)
+	}
+
+	// Until now, at 12:00 on Tuesday
+	report = h.Usage(day, day.AddDate(0, 0, 2), time.UTC, day.Add(36*time.Hour))
+	if report.Days[1].UptimeHours != 12 {
+		t.Errorf("Expected 12 hours up on Tuesday so far, but got %v", report.Days[1].UptimeHours)
+	}
+
+	rows := report.dayRows()
+	if len(rows) != 3 || rows[1][0] != "2016-06-06" || rows[1][5] != "request:1 stop:1" || rows[2][1] != "12.00" {
+		t.Errorf("Expected a header and a row per day, but got %v", rows)
+	}
+}
+
+func TestHistoryPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flywheel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "history.jsonl")
+
+	h, err := OpenHistory(filename)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	monday := time.Date(2016, 6, 6, 9, 15, 0, 0, time.UTC)
+	for day := 0; day < 10; day++ {
+		h.RecordStartup(monday.AddDate(0, 0, day), time.Minute)
+	}
+	if err := h.Prune(monday.AddDate(0, 0, 7)); err != nil {
+		t.Fatalf("Expected no error pruning, but got %s", err)
+	}
+	if startups := h.Events(HistoryStartup, time.Time{}); len(startups) != 3 {
+		t.Errorf("Expected 3 startups left, but got %v", startups)
+	}
+
+	// Events recorded after pruning go to the rewritten file
+	h.RecordStartup(monday.AddDate(0, 0, 10), time.Minute)
+	h.Close()
+	h, err = OpenHistory(filename)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	defer h.Close()
+	startups := h.Events(HistoryStartup, time.Time{})
+	if len(startups) != 4 || !startups[0].Time.Equal(monday.AddDate(0, 0, 7)) {
+		t.Errorf("Expected the 4 newest startups in the file, but got %v", startups)
+	}
+	if _, err := os.Stat(filename + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Expected no temporary file left, but got %v", err)
+	}
+}
+
+func TestPruneHistory(t *testing.T) {
+	now := time.Date(2016, 6, 6, 9, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(now)
+	fw := New(&Config{Endpoint: "10.0.0.1:80", HistoryMaxAge: Duration(24 * time.Hour)}, WithStateStore(&memStateStore{}), WithClock(clock))
+	fw.history = &History{}
+	fw.history.RecordStartup(now.Add(-48*time.Hour), time.Minute)
+	fw.history.RecordStartup(now.Add(-time.Hour), time.Minute)
+
+	fw.Poll()
+	if startups := fw.history.Events(HistoryStartup, time.Time{}); len(startups) != 1 {
+		t.Errorf("Expected only the startup within history-max-age, but got %v", startups)
+	}
+}
+
+func TestRecommendIdleTimeout(t *testing.T) {
+	h := &History{}
+
+	now := time.Date(2016, 6, 6, 9, 0, 0, 0, time.UTC)
+	h.RecordTransition(now, STARTING, STARTED, TriggerHealth, "")
+	h.RecordRequest(now)
+	for i := 0; i < 40; i++ {
+		// Mostly 10 minute gaps, with an occasional long lunch break
+		gap := 10 * time.Minute
+		if i%20 == 19 {
+			gap = 90 * time.Minute
+		}
+		now = now.Add(gap)
+		h.RecordRequest(now)
+	}
+
+	rec := h.RecommendIdleTimeout(time.Hour, 95, time.Time{})
+	if rec.Samples != 40 {
+		t.Errorf("Expected 40 samples, but got %d", rec.Samples)
+	}
+	if rec.Recommended != "15m0s" {
+		t.Errorf("Expected recommendation of 15m0s, but got %s (%s)", rec.Recommended, rec.Message)
+	}
+
+	// Gaps while stopped aren't counted: overnight, or until the request
+	// that started it again
+	h.RecordTransition(now, STARTED, STOPPING, TriggerIdleTimeout, "")
+	h.RecordTransition(now.Add(time.Minute), STOPPING, STOPPED, TriggerHealth, "")
+	now = now.Add(14 * time.Hour)
+	h.RecordRequest(now)
+	h.RecordTransition(now, STOPPED, STARTING, TriggerRequest, "")
+	h.RecordTransition(now.Add(5*time.Minute), STARTING, STARTED, TriggerHealth, "")
+	now = now.Add(20 * time.Minute)
+	h.RecordRequest(now)
+	rec = h.RecommendIdleTimeout(time.Hour, 95, time.Time{})
+	if rec.Samples != 40 {
+		t.Errorf("Expected only the 40 samples while started, but got %d", rec.Samples)
+	}
+	now = now.Add(10 * time.Minute)
+	h.RecordRequest(now)
+	if rec = h.RecommendIdleTimeout(time.Hour, 95, time.Time{}); rec.Samples != 41 {
+		t.Errorf("Expected a gap while started again to count, but got %d samples", rec.Samples)
+	}
+
+	rec = (&History{}).RecommendIdleTimeout(time.Hour, 95, time.Time{})
+	if rec.Recommended != "" {
+		t.Errorf("Expected no recommendation without data, but got %s", rec.Recommended)
+	}
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	stopAt := time.Date(2016, 6, 6, 18, 30, 0, 0, time.UTC)
+	archive := &Archive{
+		Config: []byte(`{"endpoint": "dev.example.com"}`),
+		State:  Pong{StatusName: "STARTED", StopAt: stopAt},
+		History: []HistoryEvent{
+			{Time: stopAt, Type: HistoryStartup, Duration: time.Minute},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteArchive(&buf, archive); err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+
+	restored, err := ReadArchive(&buf)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	if string(restored.Config) != string(archive.Config) {
+		t.Errorf("Expected config %s, but got %s", archive.Config, restored.Config)
+	}
+	if restored.State.StatusName != "STARTED" || !restored.State.StopAt.Equal(stopAt) {
+		t.Errorf("Expected state %+v, but got %+v", archive.State, restored.State)
+	}
+	if len(restored.History) != 1 || restored.History[0].Duration != time.Minute {
+		t.Errorf("Expected history %v, but got %v", archive.History, restored.History)
+	}
+}
+
+func TestAppendSkipsKnownEvents(t *testing.T) {
+	started := time.Date(2016, 6, 6, 18, 30, 0, 0, time.UTC)
+	h := &History{}
+	h.RecordTransition(started, STOPPED, STARTING, TriggerRequest, "")
+
+	// The same events, read from an archive in another time zone
+	sydney := time.FixedZone("AEST", 10*60*60)
+	imported := []HistoryEvent{
+		{Time: started.In(sydney), Type: HistoryTransition, From: "STOPPED", To: "STARTING", Trigger: TriggerRequest},
+		{Time: started.Add(time.Minute).In(sydney), Type: HistoryStartup, Duration: time.Minute},
+	}
+	h.Append(imported)
+	h.Append(imported)
+	if events := h.Events("", time.Time{}); len(events) != 2 {
+		t.Errorf("Expected each event once, but got %v", events)
+	}
+}
+
+func TestAnomalies(t *testing.T) {
+	now := time.Date(2026, 10, 15, 6, 0, 0, 0, time.UTC)
+	config := &Config{Anomalies: AnomaliesConfig{Enabled: true}}
+	if err := config.Anomalies.Validate("history.jsonl"); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	var notified notifications
+	newFlywheel := func(h *History) *Flywheel {
+		return &Flywheel{config: config, history: h, clock: NewFakeClock(now), notifier: &notified}
+	}
+
+	// Started 12 times overnight, usually about twice a day
+	h := &History{}
+	for i := 0; i < 56; i++ {
+		h.RecordTransition(now.Add(-15*24*time.Hour+time.Duration(i)*6*time.Hour), STOPPED, STARTING, TriggerRequest, "")
+	}
+	for i := 0; i < 12; i++ {
+		h.RecordTransition(now.Add(-time.Duration(i)*30*time.Minute), STOPPED, STARTING, TriggerRequest, "cron")
+	}
+	fw := newFlywheel(h)
+	fw.checkAnomalies()
+	if anomalies := fw.anomalies.list(); len(anomalies) != 1 || anomalies[0].Kind != AnomalyStartStorm {
+		t.Errorf("Expected a start storm, but got %v", anomalies)
+	}
+	if len(notified) != 1 || notified[0].Event != NotifyAnomaly {
+		t.Errorf("Expected an anomaly notification, but got %v", notified)
+	}
+
+	// Notified once, not at every check
+	fw.clock.(*FakeClock).Advance(time.Hour)
+	fw.checkAnomalies()
+	if len(notified) != 1 {
+		t.Errorf("Expected a single notification, but got %v", notified)
+	}
+
+	// Up for the last 10 days, after sleeping most of the week before
+	notified = nil
+	h = &History{}
+	h.RecordTransition(now.Add(-20*24*time.Hour), STARTED, STOPPING, TriggerIdle, "")
+	h.RecordTransition(now.Add(-20*24*time.Hour), STOPPING, STOPPED, TriggerHealth, "")
+	h.RecordTransition(now.Add(-10*24*time.Hour), STOPPED, STARTING, TriggerRequest, "")
+	h.RecordTransition(now.Add(-10*24*time.Hour), STARTING, STARTED, TriggerHealth, "")
+	fw = newFlywheel(h)
+	fw.checkAnomalies()
+	if anomalies := fw.anomalies.list(); len(anomalies) != 1 || anomalies[0].Kind != AnomalyNeverSleeps {
+		t.Errorf("Expected the environment to never sleep, but got %v", anomalies)
+	}
+}
+
+func TestColdStart(t *testing.T) {
+	now := time.Date(2026, 10, 15, 9, 0, 0, 0, time.UTC)
+	config := &Config{ColdStartSLO: ColdStartSLOConfig{Target: Duration(3 * time.Minute)}}
+	if err := config.ColdStartSLO.Validate(""); err == nil {
+		t.Errorf("Expected an error for a cold start target without a history-file")
+	}
+	if err := config.ColdStartSLO.Validate("history.jsonl"); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	clock := NewFakeClock(now)
+	fw := &Flywheel{config: config, history: &History{}, clock: clock}
+
+	// Timed from the first wake-up to the first response
+	fw.coldStart.woken(clock.Now())
+	clock.Advance(30 * time.Second)
+	fw.coldStart.woken(clock.Now())
+	clock.Advance(90 * time.Second)
+	fw.coldStart.respond(clock.Now())
+	clock.Advance(time.Second)
+	fw.coldStart.respond(clock.Now())
+	fw.pollColdStart()
+	fw.pollColdStart()
+	events := fw.history.Events(HistoryColdStart, time.Time{})
+	if len(events) != 1 || events[0].Duration != 2*time.Minute {
+		t.Fatalf("Expected a cold start of 2m, but got %v", events)
+	}
+
+	// Stopped before anything was served, or served without a wake-up
+	fw.coldStart.woken(clock.Now())
+	fw.coldStart.cancel()
+	fw.coldStart.respond(clock.Now())
+	fw.pollColdStart()
+	if events := fw.history.Events(HistoryColdStart, time.Time{}); len(events) != 1 {
+		t.Errorf("Expected no more cold starts, but got %v", events)
+	}
+
+	for _, latency := range []time.Duration{time.Minute, time.Minute, 2 * time.Minute, 4 * time.Minute} {
+		fw.history.RecordColdStart(clock.Now(), latency)
+	}
+	report := fw.coldStarts()
+	if report.count != 5 || report.p50 != 2*time.Minute || report.p95 != 4*time.Minute {
+		t.Errorf("Expected 5 cold starts, p50 2m and p95 4m, but got %+v", report)
+	}
+	if report.met == nil || *report.met {
+		t.Errorf("Expected the SLO to be missed, but got %+v", report)
+	}
+	metrics := string(fw.prometheusStatus())
+	for _, line := range []string{
+		`flywheel_cold_start_seconds{quantile="0.5"} 120`,
+		`flywheel_cold_start_seconds{quantile="0.95"} 240`,
+		`flywheel_cold_start_seconds_count 5`,
+		`flywheel_cold_start_slo_met 0`,
+	} {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("Expected %q in the metrics, but got %s", line, metrics)
+		}
+	}
+
+	// Older cold starts fall out of the window
+	clock.Advance(8 * 24 * time.Hour)
+	if report := fw.coldStarts(); report.count != 0 || report.met != nil {
+		t.Errorf("Expected no cold starts in the window, but got %+v", report)
+	}
+}
@@ -4,57 +4,125 @@ package flywheel
 This could probably be smarter, but it'll do for now.
 */
 
+// The pages take the language, title, body and owner contact as parameters;
+// see Catalogs
+
 // HTMLSTOPPED - display when system is stopped
 const HTMLSTOPPED = `
-	<html>
+	<html lang="%[1]s">
+		<head>
+			<meta name="robots" content="noindex, nofollow">
+		</head>
 		<body style="color: #333333; background: #f5f5f5;">
-			<h1 style="text-align: center; margin-top: 50px; font-size: larger;">Your service is currently powered down</h1>
-			<p style="text-align: center;"><a href="%s">Click here</a> to start.</p>
+			<h1 style="text-align: center; margin-top: 50px; font-size: larger;">%[2]s</h1>
+			<p style="text-align: center;">%[3]s</p>%[4]s
 		</body>
 	</html>`
 
 // HTMLSTARTING - display when system is starting
 const HTMLSTARTING = `
-	<html>
+	<html lang="%[1]s">
+		<head>
+			<meta name="robots" content="noindex, nofollow">
+		</head>
 		<script>
 			setTimeout(function() {
 				window.location.reload(1);
 			}, 5000);
 		</script>
 		<body style="color: #333333; background: #f5f5f5">
-			<h1 style="text-align: center; margin-top: 50px; font-size: larger;">Your service is starting, please wait.</h1>
-			<p style="text-align: center;">Your site will be loaded once startup is complete.</p>
+			<h1 style="text-align: center; margin-top: 50px; font-size: larger;">%[2]s</h1>
+			<p style="text-align: center;">%[3]s</p>%[4]s
 		</body>
 	</html>`
 
 // HTMLSTOPPING - display when system is stopping
 const HTMLSTOPPING = `
-	<html>
+	<html lang="%[1]s">
+		<head>
+			<meta name="robots" content="noindex, nofollow">
+		</head>
 		<script>
 			setTimeout(function() {
 				window.location.reload(1);
 			}, 5000);
 		</script>
 		<body style="color: #333333; background: #f5f5f5">
-			<h1 style="text-align: center; margin-top: 50px; font-size: larger;">Your service is being powered down.</h1>
-			<p style="text-align: center;">Please wait for shutdown to complete before restarting.</p>
+			<h1 style="text-align: center; margin-top: 50px; font-size: larger;">%[2]s</h1>
+			<p style="text-align: center;">%[3]s</p>%[4]s
 		</body>
 	</html>`
 
 // HTMLUNHEALTHY - display when system is unhealthy
 const HTMLUNHEALTHY = `
-	<html>
+	<html lang="%[1]s">
+		<head>
+			<meta name="robots" content="noindex, nofollow">
+		</head>
 		<body style="color: #333333; background: #f5f5f5">
-			<h1 style="text-align: center; margin-top: 50px; font-size: larger;">Your service appears to be in an unhealthy or inconsistent state</h1>
-			<p style="text-align: center;">This may be a temporary error, or may require manual intervention.</p>
+			<h1 style="text-align: center; margin-top: 50px; font-size: larger;">%[2]s</h1>
+			<p style="text-align: center;">%[3]s</p>%[4]s
 		</body>
 	</html>`
 
 // HTMLERROR - display when error
 const HTMLERROR = `
-	<html>
+	<html lang="%[1]s">
+		<head>
+			<meta name="robots" content="noindex, nofollow">
+		</head>
 		<body style="color: #333333; background: #f5f5f5">
-			<h1 style="text-align: center; margin-top: 50px; font-size: larger;">An error occured processing your request</h1>
-			<p style="text-align: center;">%v</p>
+			<h1 style="text-align: center; margin-top: 50px; font-size: larger;">%[2]s</h1>
+			<p style="text-align: center;">%[3]v</p>%[4]s
 		</body>
 	</html>`
+
+// HTMLWARNING - injected into proxied pages to warn about the upcoming
+// shutdown. Parameters: time left and warning period in milliseconds, the
+// extension duration, and the countdown and failure messages as JS strings.
+const HTMLWARNING = `<script>
+(function() {
+	var stopAt = Date.now() + %[1]d, warnBefore = %[2]d, toast = null;
+	function check() {
+		var left = stopAt - Date.now();
+		if (left > warnBefore) {
+			if (toast) { toast.style.display = "none"; }
+			return;
+		}
+		if (!toast) {
+			toast = document.createElement("div");
+			toast.style.cssText = "position: fixed; bottom: 20px; right: 20px; z-index: 2147483647; padding: 12px 16px; color: #333333; background: #f5f5f5; border: 1px solid #cccccc; font: 14px sans-serif; cursor: pointer;";
+			toast.onclick = extend;
+			document.body.appendChild(toast);
+		}
+		var minutes = Math.max(0, Math.ceil(left / 60000));
+		toast.textContent = %[4]s.replace("{minutes}", minutes).replace("{extend}", "%[3]v");
+		toast.style.display = "block";
+	}
+	function extend() {
+		var xhr = new XMLHttpRequest();
+		// Through the site, so the extension goes the same way as the page
+		xhr.open("POST", location.pathname + "?flywheel=extend:%[3]v");
+		xhr.onload = function() {
+			try {
+				var reply = JSON.parse(xhr.responseText);
+				if (xhr.status == 200) {
+					stopAt = Date.now() + reply["stop-in-seconds"] * 1000;
+					check();
+				} else {
+					toast.textContent = %[5]s + reply.error;
+				}
+			} catch (e) {
+				toast.textContent = %[5]s + xhr.status;
+			}
+		};
+		xhr.send();
+	}
+	setInterval(check, 10000);
+	check();
+})();
+</script>`
+
+// HTMLPARKED - overlaid on the pages of the parked site. Parameters: the
+// start URL and the button text.
+const HTMLPARKED = `<a href="%[1]s" style="position: fixed; bottom: 20px; right: 20px; z-index: 2147483647; padding: 12px 16px; color: #f5f5f5; background: #333333; font: 14px sans-serif; text-decoration: none;">%[2]s</a>`
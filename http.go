@@ -1,14 +1,16 @@
 package flywheel
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 )
@@ -21,11 +23,24 @@ type Handler struct {
 	// HTTPClient is the HTTP client to use when proxying request to the backends
 	// This is used to control redirect behavior.
 	HTTPClient *http.Client
+
+	startup     startupLimiter
+	failures    proxyFailures
+	wakeReplays wakeHookReplays
 }
 
 // ErrIgnoreRedirects used for proxy redirect ignore
 var ErrIgnoreRedirects = errors.New("Ignore Redirect Error")
 
+// copyBuffers - buffers for copying response bodies, so they aren't
+// allocated for every request
+var copyBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 32*1024)
+		return &buf
+	},
+}
+
 // NewHandler create flywheel http handler
 func NewHandler(fw *Flywheel) *Handler {
 	return &Handler{
@@ -34,16 +49,25 @@ func NewHandler(fw *Flywheel) *Handler {
 			CheckRedirect: func(req *http.Request, via []*http.Request) error {
 				return ErrIgnoreRedirects
 			},
+			// Keep enough idle connections to the backends for busy sites;
+			// the default of 2 per host means a new connection for most
+			// requests of a page.
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				MaxIdleConns:        256,
+				MaxIdleConnsPerHost: 64,
+				IdleConnTimeout:     90 * time.Second,
+			},
 		},
 	}
 }
 
 // sendPing - sends a request to the flywheel to retrieve/change the state
-func (handler *Handler) sendPing(op string) Pong {
+func (handler *Handler) sendPing(op, user string) Pong {
 	var err error
 
 	replyTo := make(chan Pong, 1)
-	sreq := Ping{replyTo: replyTo}
+	sreq := Ping{replyTo: replyTo, user: user}
 	switch op {
 	case "start":
 		sreq.requestStart = true
@@ -54,39 +78,193 @@ func (handler *Handler) sendPing(op string) Pong {
 	}
 	if strings.HasPrefix(op, "stop_in:") {
 		suffix := op[8:]
-		dur, e := time.ParseDuration(suffix)
+		dur, e := ParseDuration(suffix)
 		if e != nil {
 			err = e
 		}
 		sreq.setTimeout = dur
 	}
+	if strings.HasPrefix(op, "extend:") {
+		dur, e := ParseDuration(op[7:])
+		if e != nil {
+			err = e
+		}
+		sreq.extend = dur
+	}
+	if strings.HasPrefix(op, "stop_at:") {
+		t, e := parseDeadline(op[8:], handler.Flywheel.now())
+		if e != nil {
+			err = e
+		}
+		sreq.stopAt = t
+	}
 
-	handler.Flywheel.pings <- sreq
-	status := <-replyTo
+	status := handler.ping(sreq)
 	if err != nil && status.Err == nil {
 		status.Err = err
 	}
 	return status
 }
 
+// ping - send a request to the flywheel goroutine and wait for the reply.
+// Status requests are answered from the snapshot. If the goroutine is too
+// busy, or has stopped, requests that only count as activity get the
+// snapshot too, others fail with ErrBusy, and are dropped if still queued so
+// a retry doesn't apply them twice.
+func (handler *Handler) ping(sreq Ping) Pong {
+	fw := handler.Flywheel
+	if sreq.noop {
+		return fw.Snapshot()
+	}
+	if sreq.replyTo == nil {
+		sreq.replyTo = make(chan Pong, 1)
+	}
+	claim := pingPending
+	sreq.claim = &claim
+
+	timeout := time.NewTimer(PingTimeout)
+	defer timeout.Stop()
+	halted := fw.haltedChan()
+
+	select {
+	case fw.pings <- sreq:
+		select {
+		case pong := <-sreq.replyTo:
+			return pong
+		case <-timeout.C:
+		case <-halted:
+		}
+		if !sreq.abandon() {
+			// Taken just now, so it's being applied
+			return <-sreq.replyTo
+		}
+	case <-timeout.C:
+	case <-halted:
+	}
+
+	select {
+	case <-halted:
+		handler.Flywheel.logf("Flywheel goroutine stopped, answering from the last status")
+	default:
+		handler.Flywheel.logf("Timed out waiting for the flywheel goroutine")
+	}
+	pong := fw.Snapshot()
+	if sreq.mutates() {
+		pong.Err = ErrBusy
+	}
+	return pong
+}
+
+// sameOrigin - false if a page of another site sent the request. Browsers
+// send its Origin with every POST.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// requestUser - identify who made a request: the X-Forwarded-User set by an
+// authenticating middleware or a trusted proxy, otherwise the client IP.
+// ServeHTTP drops the header from other clients.
+func requestUser(r *http.Request) string {
+	if user := r.Header.Get("X-Forwarded-User"); user != "" {
+		return user
+	}
+	return clientIP(r.RemoteAddr)
+}
+
+// trustsProxy - true if the request comes from a trusted proxy, which may
+// say who the user is
+func (c *Config) trustsProxy(r *http.Request) bool {
+	return inNetworks(c.trustedNetworks, r.RemoteAddr)
+}
+
+// parseDeadline - parse an absolute stop time. Either RFC3339, or a time of
+// day ("18:30") which is taken as today, local time.
+func parseDeadline(value string, now time.Time) (time.Time, error) {
+	// An unescaped + in the query string arrives as a space
+	value = strings.Replace(value, " ", "+", -1)
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("15:04", value, now.Location())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid stop time %q: expected RFC3339 or HH:MM", value)
+	}
+	year, month, day := now.Date()
+	return time.Date(year, month, day, t.Hour(), t.Minute(), 0, 0, now.Location()), nil
+}
+
 // TODO - refactor this function to use context
 // TODO - add support for SSL
-func (handler *Handler) proxy(w http.ResponseWriter, r *http.Request) {
+func (handler *Handler) proxy(w http.ResponseWriter, r *http.Request, pong Pong) {
+	fw := handler.Flywheel
+	capture := fw.mirror.capture(r, pong, fw.now())
+	if capture != nil {
+		w = capture.wrap(w)
+	}
+	timeout := fw.config.ProxyTimeout.timeout(pong.StartedAt, fw.now())
+	err := handler.forward(w, r, fw.proxyEndpoint(r.Host, pong), pong.StopAt, timeout)
+	if err != nil {
+		fw.discovery.Failed()
+		handler.proxyError(w, r, err, pong)
+	} else {
+		handler.failures.succeeded()
+		fw.coldStart.respond(fw.now())
+	}
+	capture.finish(err, fw.now())
+}
 
-	r.URL.Host = handler.Flywheel.ProxyEndpoint(r.Host)
+// forward - proxy the request to an endpoint. The warning banner counts
+// down to stopAt; it's left out when stopAt is zero. If the endpoint can't
+// be reached, or doesn't start answering within the timeout, nothing is
+// written and the error is returned. A zero timeout waits.
+func (handler *Handler) forward(w http.ResponseWriter, r *http.Request, endpoint string, stopAt time.Time, timeout time.Duration) error {
+	activity := handler.Flywheel.activity
+	activity.Begin()
+	defer activity.End()
+
+	r.URL.Host = endpoint
 	r.URL.Scheme = "http"
 	r.RequestURI = ""
-	r.URL.Query().Del("flywheel")
+	handler.prepareInjection(r)
 
+	// Only waiting for the response is timed, not copying it
+	var timer *time.Timer
+	if timeout > 0 {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		timer = time.AfterFunc(timeout, cancel)
+		r = r.WithContext(ctx)
+	}
 	resp, err := handler.HTTPClient.Do(r)
+	if timer != nil && !timer.Stop() && err != nil {
+		err = &url.Error{Op: r.Method, URL: r.URL.String(), Err: proxyTimeoutError(timeout)}
+	}
 
 	if err != nil {
 		if urlError, ok := err.(*url.Error); ok && urlError.Err == ErrIgnoreRedirects {
 			err = nil
 		} else {
-			log.Print(err)
-			w.WriteHeader(http.StatusServiceUnavailable)
-			return
+			handler.Flywheel.logf("%s: %v", r.Header.Get(handler.Flywheel.config.RequestID.header()), err)
+			return err
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 && handler.replaceError(w, r, resp) {
+		return nil
+	}
+
+	if !stopAt.IsZero() {
+		if err = handler.injectWarning(resp, stopAt, handler.Flywheel.config.Language(r)); err != nil {
+			handler.Flywheel.logf("%v", err)
+			w.WriteHeader(http.StatusBadGateway)
+			return nil
 		}
 	}
 
@@ -95,19 +273,66 @@ func (handler *Handler) proxy(w http.ResponseWriter, r *http.Request) {
 	}
 	w.WriteHeader(resp.StatusCode)
 
-	_, err = io.Copy(w, resp.Body)
+	buf := copyBuffers.Get().(*[]byte)
+	_, err = io.CopyBuffer(w, resp.Body, *buf)
+	copyBuffers.Put(buf)
 	// if response code is between 300 and 400 sometimes body does not exist
 	if err != nil && (!(resp.StatusCode >= 300 && resp.StatusCode < 400)) {
-		log.Print(err)
+		handler.Flywheel.logf("%v", err)
 	}
+	return nil
 }
 
 func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Printf("[%s] %s %s", r.RemoteAddr, r.Method, r.RequestURI)
+	id := handler.Flywheel.config.RequestID.requestID(w, r)
+	handler.Flywheel.logf("[%s] %s %s %s", clientIP(r.RemoteAddr), r.Method, r.RequestURI, id)
+
+	// Clients can't say who they are, only the chain and trusted proxies
+	if !handler.Flywheel.config.trustsProxy(r) {
+		r.Header.Del("X-Forwarded-User")
+	}
+
+	if r.URL.Path == OIDCCallbackPath {
+		handler.serveOIDCCallback(w, r)
+		return
+	}
+	if !handler.guard(w, r) {
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, APIPrefix) {
+		handler.serveAPI(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, WakeHookPrefix) {
+		handler.serveWakeHook(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, ShortLinkPrefix) {
+		handler.serveShortLink(w, r)
+		return
+	}
 
 	query := r.URL.Query()
 	param := query.Get("flywheel")
 
+	// "start" is linked from the stopped page, so it stays open to everyone,
+	// and so does "extend", which the warning banner asks for. Using the site
+	// keeps it up anyway, and the extension limits apply. Extending takes a
+	// POST from the site's own pages though, so links and other sites can't.
+	extend := strings.HasPrefix(param, "extend:")
+	if extend && r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		handler.apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+		return
+	}
+	if extend && !sameOrigin(r) {
+		handler.apiError(w, http.StatusForbidden, fmt.Errorf("Origin %s not allowed", r.Header.Get("Origin")))
+		return
+	}
+	if param != "" && param != "start" && !extend && !handler.authorize(w, r) {
+		return
+	}
+
 	if param == "config" {
 		buf, err := json.MarshalIndent(handler.Flywheel.config, "", "    ") // Might be unsafe, but this should be read only.
 		if err != nil {
@@ -120,7 +345,22 @@ func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	pong := handler.sendPing(param)
+	if param == "" {
+		if isPassive(r.URL.Path) {
+			handler.servePassive(w, r)
+			return
+		}
+		handler.Flywheel.History().RecordRequest(handler.Flywheel.now())
+	}
+
+	var pong Pong
+	if param == "stop" {
+		// Stops of stateful resources need confirm=true, or a second stop
+		pong = handler.ping(Ping{requestStop: true, confirmed: query.Get("confirm") == "true", user: requestUser(r)})
+		query.Del("confirm")
+	} else {
+		pong = handler.sendPing(param, requestUser(r))
+	}
 
 	if param == "start" {
 		query.Del("flywheel")
@@ -155,6 +395,11 @@ func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			if acceptHTML {
 				w.Header().Set("Location", r.URL.String())
 				w.WriteHeader(http.StatusTemporaryRedirect)
+			} else if _, ok := pong.Err.(*ConfirmStopError); ok {
+				w.WriteHeader(http.StatusConflict)
+			} else if pong.Err != nil && strings.HasPrefix(param, "extend:") {
+				handler.apiError(w, http.StatusConflict, pong.Err)
+				return
 			}
 			w.Write(buf)
 		} else {
@@ -164,30 +409,104 @@ func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if handler.Flywheel.webhooks.stores(r, pong) {
+		handler.serveWebhook(w, r)
+		return
+	}
+
+	if pong.Status != STARTED || pong.Err != nil {
+		// Interstitial pages must not end up in search engines
+		w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	}
+
+	lang := handler.Flywheel.config.Language(r)
+	w.Header().Set("Content-Language", lang)
+
 	if pong.Err != nil {
-		body := fmt.Sprintf(HTMLERROR, pong.Err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(body))
+		handler.page(w, http.StatusInternalServerError, HTMLERROR, lang, "error", handler.errorBody(lang, pong.Err))
+		return
+	}
+
+	if handler.Flywheel.config.WarmStandby.Enabled() && (pong.Status == STOPPED || pong.Status == STARTING) {
+		handler.serveWarm(w, r, pong)
 		return
 	}
 
 	switch pong.Status {
 	case STOPPED:
+		target := r.URL.EscapedPath()
+		if len(query) > 0 {
+			target += "?" + query.Encode()
+		}
 		query.Set("flywheel", "start")
+		start := *r.URL
+		start.RawQuery = query.Encode()
+		if handler.Flywheel.config.Parked.Enabled() && handler.serveParked(w, r, start.String(), lang) {
+			return
+		}
 		r.URL.RawQuery = query.Encode()
-		body := fmt.Sprintf(HTMLSTOPPED, r.URL)
-		w.WriteHeader(http.StatusServiceUnavailable)
-		w.Write([]byte(body))
+		body := fmt.Sprintf(handler.Flywheel.config.Message(lang, "stopped.body"), r.URL)
+		if reason := handler.Flywheel.config.stopMessage(lang, pong.LastStop); reason != "" {
+			body = reason + " " + body
+		}
+		// Links are only signed for this site, not to be open redirects
+		if handler.Flywheel.config.ShortLinks.Enabled && localPath(target) {
+			body += "<br><br>" + handler.shortLinkBody(r, target, lang)
+		}
+		handler.interstitial(w, r, pong, http.StatusServiceUnavailable, HTMLSTOPPED, lang, "stopped", body)
 	case STARTING:
-		w.WriteHeader(http.StatusServiceUnavailable)
-		w.Write([]byte(HTMLSTARTING))
+		handler.interstitial(w, r, pong, http.StatusServiceUnavailable, HTMLSTARTING, lang, "starting", nil)
 	case STARTED:
-		handler.proxy(w, r)
+		if !handler.Flywheel.rampUp.Admit(r) {
+			// Not this user's turn yet while the backends warm up
+			handler.page(w, http.StatusServiceUnavailable, HTMLSTARTING, lang, "starting", nil)
+			return
+		}
+		if handler.limitStartup(w, r, pong) {
+			return
+		}
+		if handler.Flywheel.config.StatusHeaders {
+			w.Header().Set("X-Flywheel-Status", pong.StatusName)
+			w.Header().Set("X-Flywheel-Stop-At", pong.StopAt.Format(time.RFC3339))
+		}
+		handler.proxy(w, r, pong)
 	case STOPPING:
-		w.WriteHeader(http.StatusServiceUnavailable)
-		w.Write([]byte(HTMLSTOPPING))
+		handler.interstitial(w, r, pong, http.StatusServiceUnavailable, HTMLSTOPPING, lang, "stopping", nil)
 	case UNHEALTHY:
-		w.WriteHeader(http.StatusServiceUnavailable)
-		w.Write([]byte(HTMLUNHEALTHY))
+		if pong.RecoveryFailed {
+			query.Set("flywheel", "start")
+			r.URL.RawQuery = query.Encode()
+			body := fmt.Sprintf(handler.Flywheel.config.Message(lang, "recovery.body"), pong.RecoveryAttempts, r.URL)
+			handler.interstitial(w, r, pong, http.StatusServiceUnavailable, HTMLUNHEALTHY, lang, "unhealthy", body)
+			return
+		}
+		handler.interstitial(w, r, pong, http.StatusServiceUnavailable, HTMLUNHEALTHY, lang, "unhealthy", nil)
+	}
+}
+
+// errorBody - the error message, with a hint about what to fix for AWS errors
+func (handler *Handler) errorBody(lang string, err error) string {
+	body := html.EscapeString(err.Error())
+	if detail := errorDetail(err); detail != nil && detail.Kind != ErrorOther {
+		body += "<br><br>" + handler.Flywheel.config.Message(lang, "error."+detail.Kind)
+	}
+	return body
+}
+
+// page - write an interstitial page. The title and body are the page's
+// messages in the language, unless a body is given. The request ID is
+// shown under the owner contact.
+func (handler *Handler) page(w http.ResponseWriter, code int, layout, lang, name string, body interface{}) {
+	config := handler.Flywheel.config
+	if body == nil {
+		body = config.Message(lang, name+".body")
+	}
+	footer := config.contact(lang, handler.Flywheel.Snapshot().Annotations)
+	if id := w.Header().Get(config.RequestID.header()); id != "" {
+		footer += fmt.Sprintf(`<p style="text-align: center; font-size: smaller; color: #999999;">%s</p>`,
+			fmt.Sprintf(config.Message(lang, "request.id"), html.EscapeString(id)))
 	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, layout, lang, config.Message(lang, name+".title"), body, footer)
 }
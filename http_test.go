@@ -1,12 +1,35 @@
 package flywheel
 
 import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
 // MockedHandler to verify if non 200 http codes return unmodified values
@@ -83,9 +106,2016 @@ func TestProxyFunction(t *testing.T) {
 		req, _ := http.NewRequest(tt.method, tt.url, nil)
 		req.Host = tt.host
 
-		handler.proxy(w, req)
+		handler.proxy(w, req, Pong{})
 		if w.Code != tt.code {
 			t.Errorf("Expexted code %d, but got %d", tt.code, w.Code)
 		}
 	}
 }
+
+func TestParseDeadline(t *testing.T) {
+	loc := time.FixedZone("AEST", 10*3600)
+	now := time.Date(2016, 6, 6, 9, 0, 0, 0, loc)
+
+	testTable := []struct {
+		value    string
+		expected time.Time
+		err      bool
+	}{
+		{"18:30", time.Date(2016, 6, 6, 18, 30, 0, 0, loc), false},
+		{"2016-06-07T08:00:00+10:00", time.Date(2016, 6, 7, 8, 0, 0, 0, loc), false},
+		{"2016-06-07T08:00:00 10:00", time.Date(2016, 6, 7, 8, 0, 0, 0, loc), false},
+		{"tomorrow", time.Time{}, true},
+	}
+
+	for _, tt := range testTable {
+		deadline, err := parseDeadline(tt.value, now)
+		if (err != nil) != tt.err {
+			t.Errorf("Expected error %v for %q, but got %v", tt.err, tt.value, err)
+		}
+		if !deadline.Equal(tt.expected) {
+			t.Errorf("Expected %v for %q, but got %v", tt.expected, tt.value, deadline)
+		}
+	}
+}
+
+func TestInjectWarning(t *testing.T) {
+	fw := Flywheel{
+		config: &Config{
+			WarningBanner: WarningBannerConfig{
+				Enabled:    true,
+				WarnBefore: Duration(5 * time.Minute),
+				Extend:     Duration(time.Hour),
+			},
+		},
+	}
+	handler := NewHandler(&fw)
+
+	page := "<html><body><p>Hello</p></BODY></html>"
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+		Body:       ioutil.NopCloser(strings.NewReader(page)),
+	}
+
+	if err := handler.injectWarning(resp, time.Now(), "en"); err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "<script>") || !strings.HasSuffix(string(body), "</script></BODY></html>") {
+		t.Errorf("Expected script before </body>, but got %s", body)
+	}
+	if !strings.Contains(string(body), `location.pathname + "?flywheel=extend:1h0m0s"`) {
+		t.Errorf("Expected the extension through the site, but got %s", body)
+	}
+	if resp.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+		t.Errorf("Expected Content-Length %d, but got %s", len(body), resp.Header.Get("Content-Length"))
+	}
+
+	// Large pages are passed through whole, without the banner
+	page = "<html><body>" + strings.Repeat("x", maxInjectedPage) + "</body></html>"
+	resp = &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/html"}, "Content-Length": {strconv.Itoa(len(page))}},
+		Body:       ioutil.NopCloser(strings.NewReader(page)),
+	}
+	if err := handler.injectWarning(resp, time.Now(), "en"); err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	if string(body) != page || resp.Header.Get("Content-Length") != strconv.Itoa(len(page)) {
+		t.Errorf("Expected the large page unchanged, but got %d bytes", len(body))
+	}
+}
+
+func TestStatusFromSnapshot(t *testing.T) {
+	// No goroutine is reading the pings, status must not wait for one
+	fw := &Flywheel{config: &Config{}, status: STARTED, pings: make(chan Ping)}
+	fw.publish()
+	handler := &Handler{Flywheel: fw}
+
+	pong := handler.sendPing("status", "")
+	if pong.Status != STARTED || pong.StatusName != "STARTED" {
+		t.Errorf("Expected STARTED from the snapshot, but got %v", pong.StatusName)
+	}
+}
+
+func TestExtendControl(t *testing.T) {
+	now := time.Date(2026, 10, 15, 9, 0, 0, 0, time.UTC)
+	fw := &Flywheel{
+		config: &Config{
+			APITokens:          map[string][]Secret{"web": {"secret"}},
+			MaxExtensionPerDay: Duration(time.Hour),
+		},
+		status: STARTED,
+		stopAt: now.Add(10 * time.Minute),
+		clock:  NewFakeClock(now),
+		pings:  make(chan Ping),
+	}
+	go func() {
+		for ping := range fw.pings {
+			fw.RecvPing(&ping)
+		}
+	}()
+	defer close(fw.pings)
+	handler := NewHandler(fw)
+
+	// The warning banner extends without a token, from any page
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/docs/page?flywheel=extend:30m", nil))
+	if w.Code != http.StatusOK || !fw.stopAt.Equal(now.Add(40*time.Minute)) {
+		t.Errorf("Expected the stop to be postponed to %v, but got %d %v", now.Add(40*time.Minute), w.Code, fw.stopAt)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/docs/page?flywheel=extend:1h", nil))
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "Extension refused") {
+		t.Errorf("Expected the daily limit to refuse, but got %d %s", w.Code, w.Body.String())
+	}
+
+	// Not from a link, or from another site
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/docs/page?flywheel=extend:30m", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected GET to be refused, but got %d", w.Code)
+	}
+	for _, origin := range []string{"https://attacker.example.net", "null"} {
+		r := httptest.NewRequest("POST", "/docs/page?flywheel=extend:30m", nil)
+		r.Header.Set("Origin", origin)
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected a POST from %s to be refused, but got %d", origin, w.Code)
+		}
+	}
+	r := httptest.NewRequest("POST", "/docs/page?flywheel=extend:30m", nil)
+	r.Header.Set("Origin", "https://"+r.Host)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !fw.stopAt.Equal(now.Add(70*time.Minute)) {
+		t.Errorf("Expected a POST from the site to extend, but got %d %v", w.Code, fw.stopAt)
+	}
+
+	// Other controls still need one
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/?flywheel=stop_in:5h", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected stop_in to need a token, but got %d", w.Code)
+	}
+}
+
+// benchmarkHandler - a handler for a started environment, proxying to a
+// small backend
+func benchmarkHandler(b *testing.B) (*Handler, func()) {
+	log.SetOutput(ioutil.Discard)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/javascript")
+		w.Write([]byte("console.log('ok')"))
+	}))
+	backendURL, _ := url.Parse(backend.URL)
+
+	fw := &Flywheel{
+		config:      &Config{Endpoint: backendURL.Host},
+		status:      STARTED,
+		pings:       make(chan Ping, PingQueueSize),
+		idleTimeout: time.Hour,
+	}
+	go func() {
+		for ping := range fw.pings {
+			fw.RecvPing(&ping)
+		}
+	}()
+
+	return NewHandler(fw), func() {
+		close(fw.pings)
+		backend.Close()
+		log.SetOutput(os.Stderr)
+	}
+}
+
+func BenchmarkServeHTTP(b *testing.B) {
+	handler, done := benchmarkHandler(b)
+	defer done()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := httptest.NewRequest("GET", "http://app.example.com/static/app.js?v=1", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			b.Fatalf("Expected 200 but got %d", w.Code)
+		}
+	}
+}
+
+func BenchmarkProxy(b *testing.B) {
+	handler, done := benchmarkHandler(b)
+	defer done()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := httptest.NewRequest("GET", "http://app.example.com/static/app.js", nil)
+		w := httptest.NewRecorder()
+		handler.proxy(w, r, Pong{})
+		if w.Code != http.StatusOK {
+			b.Fatalf("Expected 200 but got %d", w.Code)
+		}
+	}
+}
+
+func TestLanguage(t *testing.T) {
+	c := &Config{
+		DefaultLanguage: "fr",
+		Catalogs: map[string]Catalog{
+			"es": {"stopped.title": "Su servicio está apagado"},
+		},
+	}
+	tests := []struct {
+		accept string
+		lang   string
+	}{
+		{"", "fr"},
+		{"de-AT,de;q=0.9,en;q=0.8", "de"},
+		{"en;q=0.5, ja", "ja"},
+		{"pt-BR, es;q=0.7", "es"},
+		{"pt-BR", "fr"},
+		{"de;q=0, en", "en"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Language", test.accept)
+		if lang := c.Language(r); lang != test.lang {
+			t.Errorf("Expected %s for %q, but got %s", test.lang, test.accept, lang)
+		}
+	}
+
+	if msg := c.Message("es", "stopped.title"); msg != "Su servicio está apagado" {
+		t.Errorf("Expected the custom message, but got %s", msg)
+	}
+	if msg := c.Message("es", "starting.title"); msg != Catalogs["en"]["starting.title"] {
+		t.Errorf("Expected the English fallback, but got %s", msg)
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		w.WriteHeader(code)
+		fmt.Fprint(w, "stack trace <here>")
+	}))
+	defer server.Close()
+
+	details := true
+	fw := Flywheel{
+		config: &Config{
+			ErrorPages: ErrorPagesConfig{
+				ErrorPagePolicy: ErrorPagePolicy{ServerErrors: ErrorReplace},
+				Vhosts: map[string]ErrorPagePolicy{
+					"dev.example.org": {ClientErrors: ErrorReplace, ShowDetails: &details},
+					"api.example.org": {ServerErrors: ErrorPassthrough},
+				},
+			},
+		},
+	}
+	handler := NewHandler(&fw)
+	endpoint := strings.TrimPrefix(server.URL, "http://")
+
+	tests := []struct {
+		host     string
+		code     int
+		replaced bool
+		details  bool
+	}{
+		{"www.example.org", 404, false, false},
+		{"www.example.org", 502, true, false},
+		{"dev.example.org", 404, true, true},
+		{"dev.example.org", 500, true, true},
+		{"api.example.org", 500, false, false},
+		{"api.example.org", 200, false, false},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", fmt.Sprintf("/%d", test.code), nil)
+		r.Host = test.host
+		handler.forward(w, r, endpoint, time.Time{}, 0)
+
+		body := w.Body.String()
+		if w.Code != test.code {
+			t.Errorf("Expected code %d for %s, but got %d", test.code, test.host, w.Code)
+		}
+		if replaced := strings.Contains(body, Catalogs["en"]["backend.title"]); replaced != test.replaced {
+			t.Errorf("Expected replaced %v for %s %d, but got %s", test.replaced, test.host, test.code, body)
+		}
+		if shown := strings.Contains(body, "stack trace &lt;here&gt;"); shown != test.details {
+			t.Errorf("Expected details %v for %s %d, but got %s", test.details, test.host, test.code, body)
+		}
+	}
+
+	bad := ErrorPagesConfig{ErrorPagePolicy: ErrorPagePolicy{ClientErrors: "hide"}}
+	if err := bad.Validate(); err == nil {
+		t.Errorf("Expected an error for an unknown mode, but got nil")
+	}
+}
+
+func TestOwnerContact(t *testing.T) {
+	received := make(chan Notification, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n Notification
+		json.NewDecoder(r.Body).Decode(&n)
+		received <- n
+	}))
+	defer server.Close()
+
+	fw := &Flywheel{
+		config: &Config{
+			Team: "search",
+			Owner: OwnerConfig{
+				Email:   "search@example.com",
+				Slack:   "#search-dev",
+				Webhook: server.URL + "/owner",
+			},
+			Notify: NotifyConfig{Webhook: server.URL + "/all"},
+		},
+	}
+	handler := NewHandler(fw)
+
+	w := httptest.NewRecorder()
+	handler.page(w, http.StatusServiceUnavailable, HTMLSTARTING, "en", "starting", nil)
+	expected := `search &middot; <a href="mailto:search@example.com">search@example.com</a> &middot; #search-dev`
+	if !strings.Contains(w.Body.String(), expected) {
+		t.Errorf("Expected the contact line %s, but got %s", expected, w.Body.String())
+	}
+
+	fw.notify(NotifyError, "Something broke")
+	for i := 0; i < 2; i++ {
+		select {
+		case n := <-received:
+			if n.Owner.Team != "search" || n.Owner.Webhook != "" {
+				t.Errorf("Expected the owner without the webhook, but got %+v", n.Owner)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected 2 notifications, but got %d", i)
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		newer bool
+	}{
+		{"v1.10.0", "1.9.2", true},
+		{"1.2", "1.2.0", false},
+		{"v1.2.1", "v1.2.0", true},
+		{"1.2.0", "1.3.0", false},
+		{"v2.0.0", "dev", false},
+		{"", "1.0.0", false},
+	}
+	for _, test := range tests {
+		if newer := newerVersion(test.a, test.b); newer != test.newer {
+			t.Errorf("Expected %v for %s newer than %s, but got %v", test.newer, test.a, test.b, newer)
+		}
+	}
+
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"tag_name": "v99.0.0"}`)
+	}))
+	defer github.Close()
+
+	updates := NewUpdateChecker(&UpdateCheckConfig{Enabled: true})
+	updates.url = github.URL
+	if err := updates.Check(); err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+
+	defer func(v string) { Version = v }(Version)
+	Version = "1.0.0"
+	handler := NewHandler(&Flywheel{config: &Config{}, updates: updates})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/flywheel/api/version", nil))
+
+	var info BuildInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Expected JSON, but got %s", w.Body.String())
+	}
+	if info.Version != "1.0.0" || info.Latest != "v99.0.0" || !info.UpdateAvailable {
+		t.Errorf("Expected 1.0.0 with update v99.0.0, but got %+v", info)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	fw := &Flywheel{config: &Config{AdminTokens: []Secret{"admin"}}, status: STOPPED, pings: make(chan Ping)}
+	go func() {
+		for ping := range fw.pings {
+			fw.RecvPing(&ping)
+		}
+	}()
+	defer close(fw.pings)
+	handler := NewHandler(fw)
+
+	tests := []struct {
+		token string
+		body  string
+		code  int
+	}{
+		{"", "read-only=true", http.StatusUnauthorized},
+		{"other", "read-only=true", http.StatusUnauthorized},
+		{"admin", "read-only=maybe", http.StatusBadRequest},
+		{"admin", "read-only=true", http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/flywheel/api/read-only", strings.NewReader(test.body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("Expected %d for token %q and %s, but got %d", test.code, test.token, test.body, w.Code)
+		}
+	}
+
+	pong := handler.ping(Ping{requestStart: true})
+	if pong.Err != ErrReadOnly || pong.Status != STOPPED || !pong.ReadOnly {
+		t.Errorf("Expected the start to be refused, but got %s, %v", pong.StatusName, pong.Err)
+	}
+
+	fw.config.AdminTokens = nil
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/flywheel/api/read-only", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected %d without admin tokens, but got %d", http.StatusForbidden, w.Code)
+	}
+}
+
+func TestVhostsAPI(t *testing.T) {
+	fw := &Flywheel{
+		config: &Config{AdminTokens: []Secret{"admin"}, Endpoint: "default:80", Vhosts: map[string]string{"config.example.com": "config:80"}},
+		status: STOPPED,
+		pings:  make(chan Ping),
+	}
+	go func() {
+		for ping := range fw.pings {
+			fw.RecvPing(&ping)
+			fw.publish()
+		}
+	}()
+	defer close(fw.pings)
+	handler := NewHandler(fw)
+
+	tests := []struct {
+		method string
+		url    string
+		body   string
+		code   int
+	}{
+		{"POST", "/flywheel/api/vhosts", `{"host": "new.example.com", "endpoint": "new:80"}`, http.StatusOK},
+		{"POST", "/flywheel/api/vhosts", `{"host": "*.pr.example.com", "endpoint": "pr-$1:80"}`, http.StatusOK},
+		{"POST", "/flywheel/api/vhosts", `{"host": "~(", "endpoint": "bad:80"}`, http.StatusBadRequest},
+		{"POST", "/flywheel/api/vhosts", `{"host": "empty.example.com"}`, http.StatusBadRequest},
+		{"DELETE", "/flywheel/api/vhosts?host=config.example.com", "", http.StatusConflict},
+		{"DELETE", "/flywheel/api/vhosts?host=new.example.com", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.url, strings.NewReader(test.body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Authorization", "Bearer admin")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("Expected %d for %s %s %s, but got %d", test.code, test.method, test.url, test.body, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/flywheel/api/vhosts", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected %d without a token, but got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	endpoints := map[string]string{
+		"new.example.com":    "default:80",
+		"a.pr.example.com":   "pr-a:80",
+		"config.example.com": "config:80",
+		"other.example.com":  "default:80",
+	}
+	for host, expected := range endpoints {
+		if endpoint := fw.ProxyEndpoint(host); endpoint != expected {
+			t.Errorf("Expected %s for %s, but got %s", expected, host, endpoint)
+		}
+	}
+
+	fw.vhosts, fw.vhostPatterns = nil, nil
+	fw.restore(fw.Snapshot())
+	fw.publish()
+	if endpoint := fw.ProxyEndpoint("b.pr.example.com"); endpoint != "pr-b:80" {
+		t.Errorf("Expected the restored vhost, but got %s", endpoint)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// wrappedError - an error wrapping another, like the TLS verification
+// errors of newer Go versions
+type wrappedError struct{ err error }
+
+func (e wrappedError) Error() string { return "wrapped: " + e.err.Error() }
+func (e wrappedError) Unwrap() error { return e.err }
+
+func TestProxyErrors(t *testing.T) {
+	kinds := []struct {
+		err  error
+		kind string
+	}{
+		{&url.Error{Op: "Get", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "backend"}}}, ProxyDNS},
+		{&url.Error{Op: "Get", Err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}, ProxyRefused},
+		{&url.Error{Op: "Get", Err: timeoutError{}}, ProxyTimeout},
+		{&url.Error{Op: "Get", Err: x509.UnknownAuthorityError{}}, ProxyTLS},
+		{&url.Error{Op: "Get", Err: wrappedError{x509.HostnameError{}}}, ProxyTLS},
+		{&url.Error{Op: "Get", Err: io.ErrUnexpectedEOF}, ProxyOther},
+	}
+	for _, test := range kinds {
+		if kind := classifyProxyError(test.err); kind != test.kind {
+			t.Errorf("Expected %s for %v, but got %s", test.kind, test.err, kind)
+		}
+	}
+
+	// Nothing listens on the port once the listener is closed
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := l.Addr().String()
+	l.Close()
+
+	config := &Config{Endpoint: endpoint, ProxyErrors: ProxyErrorsConfig{Threshold: 3}}
+	config.ProxyErrors.Validate()
+	fw := &Flywheel{config: config, status: STARTED, pings: make(chan Ping), refresh: make(chan struct{}, 1)}
+	fw.publish()
+	go func() {
+		for ping := range fw.pings {
+			fw.RecvPing(&ping)
+			fw.publish()
+		}
+	}()
+	defer close(fw.pings)
+	handler := NewHandler(fw)
+
+	tests := []struct {
+		startedAt time.Time
+		code      int
+		page      string
+		status    int
+	}{
+		{time.Now(), http.StatusServiceUnavailable, "starting.title", STARTED},
+		{time.Now().Add(-time.Hour), http.StatusServiceUnavailable, "proxy.refused.title", STARTED},
+		{time.Now().Add(-time.Hour), http.StatusServiceUnavailable, "proxy.refused.title", UNHEALTHY},
+	}
+	for i, test := range tests {
+		w := httptest.NewRecorder()
+		handler.proxy(w, httptest.NewRequest("GET", "/", nil), Pong{Status: STARTED, StartedAt: test.startedAt})
+		if w.Code != test.code || !strings.Contains(w.Body.String(), Catalogs["en"][test.page]) {
+			t.Errorf("Expected %d with %s for request %d, but got %d %s", test.code, test.page, i, w.Code, w.Body.String())
+		}
+		if status := fw.Snapshot().Status; status != test.status {
+			t.Errorf("Expected %s after request %d, but got %s", StatusString(test.status), i, StatusString(status))
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	received := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("X-Request-ID")
+	}))
+	defer backend.Close()
+
+	config := &Config{}
+	if err := config.RequestID.Validate(); err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	handler := NewHandler(&Flywheel{config: config})
+
+	tests := []struct {
+		incoming string
+		kept     bool
+	}{
+		{"", false},
+		{"lb-1234.abcd", true},
+		{"<script>", false},
+		{strings.Repeat("a", 200), false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if test.incoming != "" {
+			r.Header.Set("X-Request-ID", test.incoming)
+		}
+		w := httptest.NewRecorder()
+		id := config.RequestID.requestID(w, r)
+		if (id == test.incoming) != test.kept || id == "" {
+			t.Errorf("Expected kept %v for %q, but got %q", test.kept, test.incoming, id)
+		}
+		if header := w.Header().Get("X-Request-ID"); header != id {
+			t.Errorf("Expected the response header %s, but got %s", id, header)
+		}
+		if err := handler.forward(w, r, strings.TrimPrefix(backend.URL, "http://"), time.Time{}, 0); err != nil {
+			t.Fatalf("Expected no error, but got %s", err)
+		}
+		if upstream := <-received; upstream != id {
+			t.Errorf("Expected the backend to get %s, but got %s", id, upstream)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	config.RequestID.requestID(w, httptest.NewRequest("GET", "/", nil))
+	handler.page(w, http.StatusServiceUnavailable, HTMLSTOPPED, "en", "stopped", nil)
+	if !strings.Contains(w.Body.String(), "Request ID: "+w.Header().Get("X-Request-ID")) {
+		t.Errorf("Expected the request ID on the page, but got %s", w.Body.String())
+	}
+}
+
+func TestParked(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/snapshot/docs":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, "<html><body>Docs</body></html>")
+		case "/snapshot/demo.mp4":
+			w.Header().Set("Content-Type", "video/mp4")
+			fmt.Fprint(w, "video")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer site.Close()
+
+	config := &Config{Parked: ParkedConfig{URL: site.URL + "/snapshot/"}}
+	if err := config.Parked.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	fw := &Flywheel{config: config, status: STOPPED, pings: make(chan Ping)}
+	go func() {
+		for ping := range fw.pings {
+			fw.RecvPing(&ping)
+		}
+	}()
+	defer close(fw.pings)
+	handler := NewHandler(fw)
+
+	tests := []struct {
+		method string
+		path   string
+		code   int
+		body   string
+	}{
+		{"GET", "/docs", http.StatusOK, `<html><body>Docs<a href="/docs?flywheel=start"`},
+		{"GET", "/demo.mp4", http.StatusOK, "video"},
+		{"GET", "/missing", http.StatusNotFound, "404 page not found"},
+		// Not for the parked site, the stopped page is shown
+		{"POST", "/docs", http.StatusServiceUnavailable, Catalogs["en"]["stopped.title"]},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+		if w.Code != test.code || !strings.Contains(w.Body.String(), test.body) {
+			t.Errorf("Expected %d with %s for %s %s, but got %d %s", test.code, test.body, test.method, test.path, w.Code, w.Body.String())
+		}
+	}
+
+	config.Parked.Mode = ParkedRedirect
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/docs?page=2", nil))
+	if location := w.Header().Get("Location"); w.Code != http.StatusFound || location != site.URL+"/snapshot/docs?page=2" {
+		t.Errorf("Expected a redirect to the parked site, but got %d %s", w.Code, location)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	ssm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") != "AmazonSSM.GetParameters" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"Parameters": [{"Name": "/ready/i-2", "LastModifiedDate": %d}], "InvalidParameters": ["/ready/i-1", "/ready/i-3"]}`,
+			time.Now().Unix())
+	}))
+	defer ssm.Close()
+	sess := session.New(&aws.Config{
+		Endpoint:    aws.String(ssm.URL),
+		Region:      aws.String("ap-southeast-2"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	})
+
+	config := &Config{Readiness: ReadinessConfig{Secret: "s3cret", SSMParameter: "/ready/{instance-id}"}}
+	// Signatures are checked against flywheel's clock
+	clock := NewFakeClock(time.Now())
+	fw := &Flywheel{config: config, ssm: newJSONClient(sess, "ssm", "ssm", "AmazonSSM"), clock: clock}
+	handler := NewHandler(fw)
+
+	now := clock.Now().Unix()
+	tests := []struct {
+		instance  string
+		at        int64
+		signature string
+		code      int
+	}{
+		{"i-1", now, readinessSignature("s3cret", "i-1", now), http.StatusNoContent},
+		{"i-3", now, readinessSignature("s3cret", "i-1", now), http.StatusForbidden},
+		{"i-3", now - 3600, readinessSignature("s3cret", "i-3", now-3600), http.StatusForbidden},
+		{"", now, "", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		form := url.Values{"instance": {test.instance}, "time": {strconv.FormatInt(test.at, 10)}, "signature": {test.signature}}
+		r := httptest.NewRequest("POST", "/flywheel/api/ready", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("Expected %d for %s at %d, but got %d", test.code, test.instance, test.at, w.Code)
+		}
+	}
+
+	launched := aws.Time(time.Now().Add(-time.Hour))
+	running := &ec2.InstanceState{Name: aws.String("running")}
+	d := &described{instances: map[string]*ec2.Instance{
+		"i-1": {InstanceId: aws.String("i-1"), State: running, LaunchTime: launched},
+		"i-2": {InstanceId: aws.String("i-2"), State: running, LaunchTime: launched},
+		"i-3": {InstanceId: aws.String("i-3"), State: running, LaunchTime: launched},
+		"i-4": {InstanceId: aws.String("i-4"), State: &ec2.InstanceState{Name: aws.String("stopped")}},
+	}}
+	if waiting := fw.unready(d); fmt.Sprint(waiting) != "[i-3]" {
+		t.Errorf("Expected only i-3 to be waited for, but got %v", waiting)
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	entries := `[
+		{"Node": {"Address": "10.0.0.2"}, "Service": {"Address": "", "Port": 8080}},
+		{"Node": {"Address": "10.0.0.1"}, "Service": {"Address": "10.0.1.1", "Port": 8080}}
+	]`
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/web" || r.URL.Query().Get("passing") != "1" || r.Header.Get("X-Consul-Token") != "secret" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, entries)
+	}))
+	defer consul.Close()
+
+	config := &DiscoveryConfig{Type: DiscoveryConsul, Service: "web", Address: consul.URL, Token: "secret"}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	d := NewDiscovery(config, nil, SystemClock)
+	if err := d.Resolve(); err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	if endpoint := d.Endpoint(); endpoint != "10.0.0.2:8080" {
+		t.Errorf("Expected 10.0.0.2:8080, but got %s", endpoint)
+	}
+
+	// The endpoint sticks while it's registered
+	entries = `[
+		{"Node": {"Address": "10.0.0.0"}, "Service": {"Port": 8080}},
+		{"Node": {"Address": "10.0.0.2"}, "Service": {"Port": 8080}}
+	]`
+	d.Resolve()
+	if endpoint := d.Endpoint(); endpoint != "10.0.0.2:8080" {
+		t.Errorf("Expected 10.0.0.2:8080 to stick, but got %s", endpoint)
+	}
+
+	entries = `[]`
+	if err := d.Resolve(); err == nil {
+		t.Errorf("Expected an error without instances")
+	}
+	if endpoint := d.Endpoint(); endpoint != "10.0.0.2:8080" {
+		t.Errorf("Expected the last endpoint to be kept, but got %s", endpoint)
+	}
+
+	fw := &Flywheel{config: &Config{Endpoint: "static"}, discovery: d}
+	if endpoint := fw.proxyEndpoint("www.example.com", Pong{}); endpoint != "10.0.0.2:8080" {
+		t.Errorf("Expected the discovered endpoint, but got %s", endpoint)
+	}
+}
+
+func TestRampUp(t *testing.T) {
+	healthy := true
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+
+	config := &RampUpConfig{Enabled: true, Percent: 20, HealthyFor: Duration(10 * time.Minute), Canary: "/health"}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	fw := &Flywheel{config: &Config{Endpoint: strings.TrimPrefix(backend.URL, "http://")}}
+	r := NewRampUp(fw, config)
+
+	// Running since before flywheel started, nothing is held back
+	fw.snapshot = Pong{Status: STARTED}
+	now := time.Now()
+	r.check(now)
+	if p := r.Percent(); p != 100 {
+		t.Errorf("Expected 100%% when already running, but got %d", p)
+	}
+
+	fw.snapshot = Pong{Status: STOPPED}
+	r.check(now)
+	fw.snapshot = Pong{Status: STARTED}
+
+	tests := []struct {
+		after   time.Duration
+		healthy bool
+		percent int
+	}{
+		{0, true, 20},
+		{5 * time.Minute, true, 60},
+		{time.Minute, false, 20},
+		{time.Minute, true, 20},
+		{5 * time.Minute, true, 60},
+		{5 * time.Minute, true, 100},
+		{time.Minute, false, 100},
+	}
+	for _, test := range tests {
+		now = now.Add(test.after)
+		healthy = test.healthy
+		r.check(now)
+		if p := r.Percent(); p != test.percent {
+			t.Errorf("Expected %d%% after %v, but got %d", test.percent, test.after, p)
+		}
+	}
+
+	var nilRampUp *RampUp
+	if !nilRampUp.Admit(httptest.NewRequest("GET", "/", nil)) {
+		t.Errorf("Expected everyone to be let through without a ramp-up")
+	}
+}
+
+func TestStartupLimit(t *testing.T) {
+	c := &StartupLimitConfig{Duration: Duration(time.Minute), Global: 2, PerClient: 1, Burst: 2}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+
+	var l startupLimiter
+	started := time.Now()
+	tests := []struct {
+		after  time.Duration
+		client string
+		ok     bool
+	}{
+		{0, "a", true},
+		{0, "a", true},
+		{0, "a", false},
+		{0, "b", false},
+		{500 * time.Millisecond, "b", true},
+		{time.Second, "a", true},
+		{0, "c", true},
+		{0, "d", false},
+		{time.Minute, "d", true},
+		{0, "d", true},
+	}
+	now := started
+	for i, test := range tests {
+		now = now.Add(test.after)
+		ok, wait := l.allow(c, started, test.client, now)
+		if ok != test.ok {
+			t.Errorf("Expected %v for request %d by %s, but got %v", test.ok, i, test.client, ok)
+		}
+		if !ok && wait <= 0 {
+			t.Errorf("Expected a wait for request %d, but got %v", i, wait)
+		}
+	}
+
+	c.Burst = 1
+	handler := NewHandler(&Flywheel{config: &Config{StartupLimit: *c}})
+	pong := Pong{StartedAt: time.Now()}
+	w := httptest.NewRecorder()
+	handler.limitStartup(w, httptest.NewRequest("GET", "/", nil), pong)
+	w = httptest.NewRecorder()
+	if !handler.limitStartup(w, httptest.NewRequest("GET", "/", nil), pong) {
+		t.Fatalf("Expected the second request to be limited")
+	}
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 429 with Retry-After 1, but got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		addr, ip, network string
+	}{
+		{"10.1.2.3:5000", "10.1.2.3", "10.1.2.3"},
+		{"[::ffff:10.1.2.3]:5000", "10.1.2.3", "10.1.2.3"},
+		{"[2001:db8:1:2::10]:5000", "2001:db8:1:2::10", "2001:db8:1:2::/64"},
+		{"[fe80::1%eth0]:5000", "fe80::1", "fe80::/64"},
+		{"2001:db8::1", "2001:db8::1", "2001:db8::/64"},
+		{"@", "@", "@"},
+	}
+	for _, test := range tests {
+		ip := clientIP(test.addr)
+		if ip != test.ip {
+			t.Errorf("Expected %s for %s, but got %s", test.ip, test.addr, ip)
+		}
+		if network := clientNetwork(ip, 64); network != test.network {
+			t.Errorf("Expected network %s for %s, but got %s", test.network, test.addr, network)
+		}
+	}
+
+	// Addresses of the same /64 share the per-client limit
+	c := StartupLimitConfig{Duration: Duration(time.Minute), PerClient: 1}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	handler := NewHandler(&Flywheel{config: &Config{StartupLimit: c}})
+	pong := Pong{StartedAt: time.Now()}
+	for i, addr := range []string{"[2001:db8::1]:1000", "[2001:db8::2]:1000", "[2001:db8:0:1::1]:1000"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = addr
+		limited := handler.limitStartup(httptest.NewRecorder(), r, pong)
+		if limited != (i == 1) {
+			t.Errorf("Expected limited %v for %s, but got %v", i == 1, addr, limited)
+		}
+	}
+
+	if network := listenNetwork("[::]:80", false); network != "tcp6" {
+		t.Errorf("Expected tcp6 for an IPv6 address, but got %s", network)
+	}
+	if network := listenNetwork(":80", true); network != "tcp6" {
+		t.Errorf("Expected tcp6 for ipv6-only, but got %s", network)
+	}
+	if network := listenNetwork("0.0.0.0:80", false); network != "tcp4" {
+		t.Errorf("Expected tcp4 for an IPv4 address, but got %s", network)
+	}
+	if err := (&ListenConfig{Addresses: []string{"0.0.0.0:80"}, IPv6Only: true}).Validate(); err == nil {
+		t.Errorf("Expected an error for an IPv4 address with ipv6-only")
+	}
+}
+
+func TestMirror(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer backend.Close()
+
+	captured := make(chan MirroredRequest, 10)
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req MirroredRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Expected a mirrored request, but got %v", err)
+		}
+		captured <- req
+	}))
+	defer sink.Close()
+
+	config := &Config{Endpoint: strings.TrimPrefix(backend.URL, "http://"), Mirror: MirrorConfig{URL: sink.URL, MaxBody: 5}}
+	if err := config.Mirror.Validate(); err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	fw := &Flywheel{config: config, mirror: NewMirror(&config.Mirror, nil, "")}
+	handler := NewHandler(fw)
+
+	// Only requests within the duration after a start are mirrored
+	for _, pong := range []Pong{
+		{Status: STARTED, StartedAt: time.Now().Add(-time.Hour)},
+		{Status: STARTING},
+		{Status: STARTED, StartedAt: time.Now().Add(-time.Minute)},
+	} {
+		r := httptest.NewRequest("POST", "/orders?id=1", strings.NewReader("hello world"))
+		r.Header.Set("Authorization", "Bearer secret")
+		r.Header.Set("X-Trace", "abc")
+		w := httptest.NewRecorder()
+		handler.proxy(w, r, pong)
+		if w.Code != http.StatusCreated {
+			t.Errorf("Expected %d, but got %d", http.StatusCreated, w.Code)
+		}
+	}
+
+	select {
+	case req := <-captured:
+		if req.Method != "POST" || req.URL != "/orders?id=1" || req.Status != http.StatusCreated || req.SinceStart != "1m0s" {
+			t.Errorf("Expected POST /orders?id=1 201 a minute after start, but got %+v", req)
+		}
+		if string(req.Body) != "hello" || !req.BodyTruncated {
+			t.Errorf("Expected the body cut off at 5 bytes, but got %q %v", req.Body, req.BodyTruncated)
+		}
+		if req.Header.Get("Authorization") != "********" || req.Header.Get("X-Trace") != "abc" {
+			t.Errorf("Expected only the Authorization header redacted, but got %v", req.Header)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected a mirrored request")
+	}
+	select {
+	case req := <-captured:
+		t.Errorf("Expected a single mirrored request, but got %+v", req)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestProxyTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, "slow")
+	}))
+	defer backend.Close()
+
+	config := &Config{
+		Endpoint:     strings.TrimPrefix(backend.URL, "http://"),
+		ProxyErrors:  ProxyErrorsConfig{Threshold: -1},
+		ProxyTimeout: ProxyTimeoutConfig{Timeout: Duration(50 * time.Millisecond), Cold: Duration(time.Second)},
+	}
+	if err := config.ProxyTimeout.Validate(); err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	handler := NewHandler(&Flywheel{config: config})
+
+	tests := []struct {
+		startedAt time.Time
+		code      int
+	}{
+		{time.Now().Add(-time.Minute), http.StatusOK},
+		{time.Now().Add(-time.Hour), http.StatusGatewayTimeout},
+	}
+	for i, test := range tests {
+		w := httptest.NewRecorder()
+		handler.proxy(w, httptest.NewRequest("GET", "/", nil), Pong{Status: STARTED, StartedAt: test.startedAt})
+		if w.Code != test.code {
+			t.Errorf("Expected %d for request %d, but got %d", test.code, i, w.Code)
+		}
+	}
+
+	config.ProxyTimeout.Cold = Duration(10 * time.Millisecond)
+	if err := config.ProxyTimeout.Validate(); err == nil {
+		t.Errorf("Expected an error for a cold timeout shorter than the timeout")
+	}
+}
+
+func TestShortLinks(t *testing.T) {
+	config := &Config{ShortLinks: ShortLinksConfig{Enabled: true, Secret: "secret"}}
+	if err := config.ShortLinks.Validate(); err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	clock := NewFakeClock(time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC))
+	fw := &Flywheel{config: config, status: STOPPED, clock: clock, pings: make(chan Ping)}
+	go func() {
+		for ping := range fw.pings {
+			fw.RecvPing(&ping)
+		}
+	}()
+	defer close(fw.pings)
+	handler := NewHandler(fw)
+
+	// The stopped page links to the page with a short link and its QR code
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://demo.example.com/docs?page=2", nil))
+	body := w.Body.String()
+	start := strings.Index(body, "http://demo.example.com"+ShortLinkPrefix)
+	if w.Code != http.StatusServiceUnavailable || start < 0 || !strings.Contains(body, "<svg") {
+		t.Fatalf("Expected the stopped page with a short link and QR code, but got %d %s", w.Code, body)
+	}
+	link := body[start : start+strings.IndexByte(body[start:], '"')]
+	link = strings.Replace(link, "&amp;", "&", -1)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", link, nil))
+	if location := w.Header().Get("Location"); w.Code != http.StatusSeeOther || location != "/docs?flywheel=start&page=2" {
+		t.Errorf("Expected a redirect starting the environment, but got %d %s", w.Code, location)
+	}
+
+	// Tampered with, or expired
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", strings.Replace(link, "/docs", "/admin", 1), nil))
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), Catalogs["en"]["link.invalid.title"]) {
+		t.Errorf("Expected a tampered link to be refused, but got %d", w.Code)
+	}
+	clock.Advance(2 * time.Hour)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", link, nil))
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), Catalogs["en"]["link.expired.title"]) {
+		t.Errorf("Expected an expired link to be refused, but got %d", w.Code)
+	}
+
+	// Never to another site, even if signed
+	clock.Advance(-2 * time.Hour)
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://demo.example.com/", nil)
+	r.URL.Path = "//evil.example/"
+	handler.ServeHTTP(w, r)
+	if strings.Contains(w.Body.String(), ShortLinkPrefix) {
+		t.Errorf("Expected no short link to another site, but got %s", w.Body.String())
+	}
+	target := "//evil.example/"
+	expires := strconv.FormatInt(clock.Now().Add(time.Hour).Unix(), 36)
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "http://demo.example.com/", nil)
+	r.URL.Path = ShortLinkPrefix + expires + "." + shortLinkSignature(config.ShortLinks.Secret, expires, target) + target
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected a link to %s to be refused, but got %d %s", target, w.Code, w.Header().Get("Location"))
+	}
+	for target, expected := range map[string]bool{"/": true, "/docs?page=2": true, "//evil.example/": false, "/\\evil.example/": false, "evil.example": false} {
+		if localPath(target) != expected {
+			t.Errorf("Expected %q to be local: %v", target, expected)
+		}
+	}
+
+	if _, err := encodeQR(make([]byte, 214)); err == nil {
+		t.Errorf("Expected an error for data too long for a QR code")
+	}
+	if qr, err := encodeQR([]byte("HELLO")); err != nil || qr.size != 21 {
+		t.Errorf("Expected a version 1 QR code, but got %v", err)
+	}
+}
+
+func TestConditionalPages(t *testing.T) {
+	since := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(since.Add(time.Hour))
+	fw := &Flywheel{config: &Config{}, status: STOPPED, statusSince: since, clock: clock, pings: make(chan Ping)}
+	go func() {
+		for ping := range fw.pings {
+			fw.RecvPing(&ping)
+		}
+	}()
+	defer close(fw.pings)
+	handler := NewHandler(fw)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://demo.example.com/", nil))
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusServiceUnavailable || etag == "" || w.Header().Get("Last-Modified") != since.Format(http.TimeFormat) {
+		t.Fatalf("Expected the stopped page with an ETag and Last-Modified, but got %d %v", w.Code, w.Header())
+	}
+
+	// The request ID differs, the ETag doesn't
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://demo.example.com/", nil))
+	if w.Header().Get("ETag") != etag {
+		t.Errorf("Expected the same ETag %s but got %s", etag, w.Header().Get("ETag"))
+	}
+
+	conditions := []struct {
+		method, header, value string
+		code                  int
+	}{
+		{"GET", "If-None-Match", etag, http.StatusNotModified},
+		{"HEAD", "If-None-Match", `"other", ` + etag, http.StatusNotModified},
+		{"GET", "If-None-Match", `W/"other"`, http.StatusServiceUnavailable},
+		{"GET", "If-Modified-Since", since.Format(http.TimeFormat), http.StatusNotModified},
+		{"GET", "If-Modified-Since", since.Add(-time.Minute).Format(http.TimeFormat), http.StatusServiceUnavailable},
+		{"HEAD", "", "", http.StatusServiceUnavailable},
+	}
+	for _, c := range conditions {
+		r := httptest.NewRequest(c.method, "http://demo.example.com/", nil)
+		if c.header != "" {
+			r.Header.Set(c.header, c.value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("Expected %d for %s %s: %s but got %d", c.code, c.method, c.header, c.value, w.Code)
+		}
+		if (c.code == http.StatusNotModified || c.method == "HEAD") && w.Body.Len() > 0 {
+			t.Errorf("Expected no body for %s %s: %s but got %d bytes", c.method, c.header, c.value, w.Body.Len())
+		}
+	}
+
+	// Another status is another page
+	fw.status = STARTING
+	r := httptest.NewRequest("GET", "http://demo.example.com/", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), Catalogs["en"]["starting.title"]) {
+		t.Errorf("Expected the starting page but got %d", w.Code)
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	sent := &notifications{}
+	fw := &Flywheel{
+		config:   &Config{AdminTokens: []Secret{"admin"}, Owner: OwnerConfig{Team: "payments", Webhook: "http://hooks.example.com/payments"}},
+		status:   STOPPED,
+		pings:    make(chan Ping),
+		notifier: sent,
+		store:    &memStateStore{},
+	}
+	go func() {
+		for ping := range fw.pings {
+			fw.RecvPing(&ping)
+			fw.publish()
+		}
+	}()
+	defer close(fw.pings)
+	handler := NewHandler(fw)
+
+	tests := []struct {
+		token, body string
+		code        int
+	}{
+		{"", `{"notes": "x"}`, http.StatusUnauthorized},
+		{"admin", `{"links": [{"url": "javascript:alert(1)"}]}`, http.StatusBadRequest},
+		{"admin", `{"owner": {"team": "x", "webhook": "http://evil.example.com"}}`, http.StatusBadRequest},
+		{"admin", `{"owner": {"team": "checkout"}, "notes": "Do not stop before <Friday>'s audit", "links": [{"title": "Ticket", "url": "https://jira.example.com/AUD-1"}]}`, http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("PUT", "/flywheel/api/annotations", strings.NewReader(test.body))
+		r.Header.Set("Content-Type", "application/json")
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("Expected %d for token %q and %s, but got %d", test.code, test.token, test.body, w.Code)
+		}
+	}
+
+	a := fw.Snapshot().Annotations
+	if a == nil || a.Owner.Team != "checkout" || a.UpdatedBy == "" {
+		t.Fatalf("Expected the annotations in the status, but got %+v", a)
+	}
+	if owner := fw.ownerContact(); owner.Team != "checkout" || owner.Webhook != "http://hooks.example.com/payments" {
+		t.Errorf("Expected the owner transferred with the config's webhook, but got %+v", owner)
+	}
+	if len(*sent) != 1 || !strings.Contains((*sent)[0].Message, "from payments to checkout") {
+		t.Errorf("Expected an ownership transfer notification, but got %v", *sent)
+	}
+
+	// On the pages, and with the stop notification
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://demo.example.com/", nil))
+	body := w.Body.String()
+	if !strings.Contains(body, "checkout") || !strings.Contains(body, "&lt;Friday&gt;") || !strings.Contains(body, `href="https://jira.example.com/AUD-1"`) {
+		t.Errorf("Expected the owner, notes and links on the stopped page, but got %s", body)
+	}
+	fw.stopped(StopManual, "bob", time.Now())
+	last := (*sent)[len(*sent)-1]
+	if last.Event != NotifyStop || !strings.Contains(last.Message, "audit") || len(last.Links) != 1 {
+		t.Errorf("Expected the notes with the stop notification, but got %+v", last)
+	}
+
+	r := httptest.NewRequest("DELETE", "/flywheel/api/annotations", nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || fw.Snapshot().Annotations != nil || fw.ownerContact().Team != "payments" {
+		t.Errorf("Expected the annotations cleared, but got %d %+v", w.Code, fw.Snapshot().Annotations)
+	}
+}
+
+func TestWakeHooks(t *testing.T) {
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	config := &Config{WakeHooks: []WakeHook{
+		{Name: "sandbox", Secret: "s3cret"},
+		{Name: "stripe", Secret: "whsec", Scheme: WakeSchemeStripe},
+		{Name: "github", Secret: "gh", Scheme: WakeSchemeGitHub},
+	}}
+	for i := range config.WakeHooks {
+		if err := config.WakeHooks[i].Validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fw := &Flywheel{config: config, status: STARTED, clock: NewFakeClock(now), pings: make(chan Ping)}
+	go func() {
+		for ping := range fw.pings {
+			fw.RecvPing(&ping)
+		}
+	}()
+	defer close(fw.pings)
+	handler := NewHandler(fw)
+
+	body := `{"type": "checkout.session.completed"}`
+	ts := strconv.FormatInt(now.Unix(), 10)
+	old := strconv.FormatInt(now.Add(-10*time.Minute).Unix(), 10)
+	sign := func(secret Secret, prefix string) string {
+		return string(wakeHookMAC(secret, []byte(prefix+body)))
+	}
+	tests := []struct {
+		name    string
+		path    string
+		headers map[string]string
+		code    int
+	}{
+		{"valid", "sandbox", map[string]string{"X-Flywheel-Timestamp": ts, "X-Flywheel-Signature": "sha256=" + sign("s3cret", ts+".")}, http.StatusOK},
+		{"replayed", "sandbox", map[string]string{"X-Flywheel-Timestamp": ts, "X-Flywheel-Signature": "sha256=" + sign("s3cret", ts+".")}, http.StatusConflict},
+		{"wrong secret", "sandbox", map[string]string{"X-Flywheel-Timestamp": ts, "X-Flywheel-Signature": "sha256=" + sign("other", ts+".")}, http.StatusUnauthorized},
+		{"too old", "sandbox", map[string]string{"X-Flywheel-Timestamp": old, "X-Flywheel-Signature": "sha256=" + sign("s3cret", old+".")}, http.StatusUnauthorized},
+		{"unsigned", "sandbox", nil, http.StatusUnauthorized},
+		{"stripe", "stripe", map[string]string{"Stripe-Signature": "t=" + ts + ",v1=" + sign("whsec", ts+".") + ",v0=abc"}, http.StatusOK},
+		{"github", "github", map[string]string{"X-Hub-Signature-256": "sha256=" + sign("gh", ""), "X-GitHub-Delivery": "72d3162e"}, http.StatusOK},
+		{"github replayed", "github", map[string]string{"X-Hub-Signature-256": "sha256=" + sign("gh", ""), "X-GitHub-Delivery": "72d3162e"}, http.StatusConflict},
+		{"unknown hook", "other", nil, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", WakeHookPrefix+test.path, strings.NewReader(body))
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("Expected %d for %s but got %d %s", test.code, test.name, w.Code, w.Body.String())
+		}
+	}
+
+	bad := WakeHook{Name: "a/b", Secret: "x"}
+	if err := bad.Validate(); err == nil {
+		t.Errorf("Expected an error for an invalid name but got none")
+	}
+}
+
+func TestPools(t *testing.T) {
+	c := &Config{}
+	err := c.Parse(strings.NewReader(`{
+		"idle-timeout": "2h",
+		"pools": {
+			"dev": {"hosts": ["dev.example.com"], "endpoint": "10.0.0.1:80", "instances": ["i-dev"]},
+			"staging": {"path-prefix": "/staging", "strip-prefix": true, "endpoint": "10.0.0.2:80",
+				"autoscaling": {"stop": ["staging-web"]}, "idle-timeout": "30m"},
+			"qa": {"path-prefix": "/staging/qa", "endpoint": "10.0.0.3:80", "instances": ["i-qa"]}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("Expected valid pools but got %v", err)
+	}
+	if names := c.PoolNames(); fmt.Sprint(names) != "[dev qa staging]" {
+		t.Errorf("Expected pools dev, qa and staging, but got %v", names)
+	}
+	dev, staging := c.Pools["dev"].Config(), c.Pools["staging"].Config()
+	if dev.Endpoint != "10.0.0.1:80" || time.Duration(dev.IdleTimeout) != 2*time.Hour || len(dev.AutoScaling.Stop) != 0 {
+		t.Errorf("Expected dev with its endpoint and the top-level idle timeout, but got %+v", dev)
+	}
+	if time.Duration(staging.IdleTimeout) != 30*time.Minute || len(staging.Instances) != 0 {
+		t.Errorf("Expected staging with its own idle timeout and no instances, but got %+v", staging)
+	}
+
+	handlers := make(map[string]http.Handler)
+	for _, name := range c.PoolNames() {
+		name := name
+		handlers[name] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s", name, r.URL.RequestURI())
+		})
+	}
+	router := NewPoolRouter(c, handlers)
+	for _, test := range []struct {
+		host, path, expected string
+		code                 int
+	}{
+		{"dev.example.com", "/staging/page", "dev /staging/page", http.StatusOK},
+		{"DEV.example.com:8080", "/", "dev /", http.StatusOK},
+		{"example.com", "/staging/page?a=1", "staging /page?a=1", http.StatusOK},
+		{"example.com", "/staging", "staging /", http.StatusOK},
+		{"example.com", "/staging/qa/page", "qa /staging/qa/page", http.StatusOK},
+		{"example.com", "/stagingx", "", http.StatusNotFound},
+		{"example.com", "/", "", http.StatusNotFound},
+	} {
+		r := httptest.NewRequest("GET", test.path, nil)
+		r.Host = test.host
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != test.code || (test.code == http.StatusOK && w.Body.String() != test.expected) {
+			t.Errorf("Expected %d %q for %s%s, but got %d %q", test.code, test.expected, test.host, test.path, w.Code, w.Body.String())
+		}
+	}
+
+	for _, config := range []string{
+		`{"pools": {"dev": {"endpoint": "10.0.0.1:80", "instances": ["i-dev"]}}}`,
+		`{"pools": {"dev": {"hosts": ["a.example.com"], "instances": ["i-dev"]}, "qa": {"hosts": ["A.example.com"], "instances": ["i-qa"]}}}`,
+		`{"pools": {"dev": {"path-prefix": "/dev/", "instances": ["i-dev"]}}}`,
+		`{"pools": {"dev": {"hosts": ["a.example.com"]}}}`,
+		`{"pools": {"dev": {"hosts": ["a.example.com"], "instances": ["i-dev"]}, "qa": {"hosts": ["b.example.com"], "instances": ["i-qa"]}}, "history-file": "h.jsonl"}`,
+		`{"pools": {"dev": {"hosts": ["a.example.com"], "instances": ["i-dev"]}, "qa": {"hosts": ["b.example.com"], "instances": ["i-qa"]}}, "state-store": {"s3": {"bucket": "b", "key": "k"}}}`,
+		`{"pools": {"dev env": {"hosts": ["a.example.com"], "instances": ["i-dev"]}}}`,
+	} {
+		c := &Config{}
+		if err := c.Parse(strings.NewReader(config)); err == nil {
+			t.Errorf("Expected an error for %s", config)
+		}
+	}
+}
+
+func TestControlAPI(t *testing.T) {
+	fw := New(&Config{},
+		WithStateStore(&memStateStore{}),
+		WithClock(NewFakeClock(time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC))),
+		WithProvider(session.New(&aws.Config{
+			Region:      aws.String("us-east-1"),
+			Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		})),
+	)
+	go func() {
+		for ping := range fw.pings {
+			fw.RecvPing(&ping)
+			fw.publish()
+		}
+	}()
+	defer close(fw.pings)
+	fw.publish()
+	handler := NewHandler(fw)
+
+	tests := []struct {
+		method, path, contentType, body string
+		code                            int
+		status                          string
+	}{
+		{"GET", "/flywheel/api/v1/status", "", "", http.StatusOK, "STOPPED"},
+		{"POST", "/flywheel/api/v1/timeout", "application/json", `{"duration": "1h"}`, http.StatusConflict, ""},
+		{"GET", "/flywheel/api/v1/start", "", "", http.StatusMethodNotAllowed, ""},
+		{"POST", "/flywheel/api/v1/start", "", "", http.StatusAccepted, "STARTING"},
+		{"POST", "/flywheel/api/v1/stop", "application/json", "", http.StatusConflict, ""},
+		{"GET", "/flywheel/api/status", "", "", http.StatusOK, "STARTING"},
+		{"GET", "/flywheel/api/v2/status", "", "", http.StatusNotFound, ""},
+		// Started from here on
+		{"POST", "/flywheel/api/v1/timeout", "application/json", `{}`, http.StatusBadRequest, ""},
+		{"POST", "/flywheel/api/v1/timeout", "application/json", `{"stop-at": "tomorrow"}`, http.StatusBadRequest, ""},
+		{"POST", "/flywheel/api/v1/timeout", "application/x-www-form-urlencoded", "duration=3h", http.StatusOK, "STARTED"},
+		{"POST", "/flywheel/api/v1/stop", "application/json", "", http.StatusAccepted, "STOPPING"},
+	}
+	for i, test := range tests {
+		if i == 7 {
+			fw.status = STARTED
+		}
+		r := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		var pong struct {
+			Status string    `json:"status"`
+			StopAt time.Time `json:"stop-due-at"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &pong)
+		if w.Code != test.code || pong.Status != test.status {
+			t.Errorf("Expected %d %s for %s %s, but got %d %s", test.code, test.status, test.method, test.path, w.Code, w.Body.String())
+		}
+		if test.body == "duration=3h" && !pong.StopAt.Equal(fw.now().Add(3*time.Hour)) {
+			t.Errorf("Expected the stop in 3h, but got %v", pong.StopAt)
+		}
+	}
+}
+
+func TestWebhookReplay(t *testing.T) {
+	var received []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = append(received, fmt.Sprintf("%s %s %s %s", r.Method, r.URL.RequestURI(), body, r.Header.Get("X-Flywheel-Replayed-At")))
+	}))
+	defer backend.Close()
+
+	dir, err := ioutil.TempDir("", "flywheel-webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := &Config{
+		Endpoint:      strings.TrimPrefix(backend.URL, "http://"),
+		Instances:     []string{"i-app"},
+		WebhookReplay: WebhookReplayConfig{Paths: []string{"/hooks"}, Dir: dir},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	fw := New(config,
+		WithStateStore(&memStateStore{}),
+		WithClock(NewFakeClock(time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC))),
+	)
+	go func() {
+		for ping := range fw.pings {
+			fw.RecvPing(&ping)
+			fw.publish()
+		}
+	}()
+	defer close(fw.pings)
+	fw.publish()
+	handler := NewHandler(fw)
+
+	for _, test := range []struct {
+		method, path string
+		code         int
+	}{
+		{"POST", "/hooks/stripe?id=1", http.StatusAccepted},
+		{"POST", "/hooks/github", http.StatusAccepted},
+		{"GET", "/hooks/stripe", http.StatusServiceUnavailable},
+		{"POST", "/hooksy", http.StatusServiceUnavailable},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(test.method, test.path, strings.NewReader("payload "+test.path)))
+		if w.Code != test.code {
+			t.Errorf("Expected %d for %s %s but got %d", test.code, test.method, test.path, w.Code)
+		}
+	}
+
+	// Nothing is replayed until started
+	if err := fw.replayStored(); err != nil || len(received) != 0 {
+		t.Fatalf("Expected nothing replayed while stopped, but got %v, %v", received, err)
+	}
+	fw.status = STARTED
+	fw.publish()
+	if err := fw.replayStored(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"POST /hooks/stripe?id=1 payload /hooks/stripe?id=1 2024-03-04T09:00:00Z",
+		"POST /hooks/github payload /hooks/github 2024-03-04T09:00:00Z",
+	}
+	if strings.Join(received, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected the webhooks replayed in order %q but got %q", expected, received)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Expected the replayed webhooks removed, but %d are left", len(files))
+	}
+
+	// Once replayed, webhooks go straight to the backend
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/hooks/stripe", strings.NewReader("live")))
+	if w.Code != http.StatusOK || len(received) != 3 || received[2] != "POST /hooks/stripe live " {
+		t.Errorf("Expected the webhook proxied, but got %d and %q", w.Code, received)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	config := &Config{
+		Endpoint:  "10.0.0.1:80",
+		Instances: []string{"i-app"},
+		APITokens: map[string][]Secret{"dev": {"token"}},
+		CORS: CORSConfig{
+			Origins:     []string{"https://portal.example.com", "https://*.dev.example.com"},
+			Credentials: true,
+		},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	fw := New(config, WithStateStore(&memStateStore{}))
+	fw.publish()
+	handler := NewHandler(fw)
+
+	tests := []struct {
+		method, origin, requestMethod string
+		token                         bool
+		code                          int
+		allowOrigin                   string
+	}{
+		// Preflights don't need a token
+		{"OPTIONS", "https://portal.example.com", "POST", false, http.StatusNoContent, "https://portal.example.com"},
+		{"OPTIONS", "https://a.dev.example.com", "POST", false, http.StatusNoContent, "https://a.dev.example.com"},
+		{"OPTIONS", "https://a.dev.example.com", "DELETE", false, http.StatusForbidden, "https://a.dev.example.com"},
+		{"OPTIONS", "http://a.dev.example.com", "POST", false, http.StatusForbidden, ""},
+		{"OPTIONS", "https://dev.example.com", "POST", false, http.StatusForbidden, ""},
+		{"OPTIONS", "https://evil.example.net", "POST", false, http.StatusForbidden, ""},
+		{"GET", "https://portal.example.com", "", true, http.StatusOK, "https://portal.example.com"},
+		{"GET", "https://portal.example.com", "", false, http.StatusUnauthorized, "https://portal.example.com"},
+		{"GET", "https://evil.example.net", "", true, http.StatusOK, ""},
+		{"GET", "", "", true, http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/flywheel/api/v1/status", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if test.requestMethod != "" {
+			r.Header.Set("Access-Control-Request-Method", test.requestMethod)
+		}
+		if test.token {
+			r.Header.Set("Authorization", "Bearer token")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("Expected %d for %s from %q but got %d", test.code, test.method, test.origin, w.Code)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != test.allowOrigin {
+			t.Errorf("Expected origin %q allowed for %s from %q but got %q", test.allowOrigin, test.method, test.origin, got)
+		}
+		if test.allowOrigin != "" && w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+			t.Errorf("Expected credentials allowed for %s from %q", test.method, test.origin)
+		}
+	}
+
+	config.CORS = CORSConfig{Origins: []string{"*"}, Credentials: true}
+	if err := config.Validate(); err == nil {
+		t.Errorf("Expected an error for credentials from any origin")
+	}
+	config.CORS = CORSConfig{Origins: []string{"portal.example.com"}}
+	if err := config.Validate(); err == nil {
+		t.Errorf("Expected an error for an origin without a scheme")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var asked []AuthHookRequest
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req AuthHookRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		asked = append(asked, req)
+		if req.Headers["Authorization"] == "Bearer letmein" {
+			fmt.Fprint(w, `{"allow": true, "user": "bob"}`)
+			return
+		}
+		fmt.Fprint(w, `{"allow": false, "message": "Not on the list"}`)
+	}))
+	defer hook.Close()
+
+	config := &Config{
+		Endpoint:  "10.0.0.1:80",
+		Instances: []string{"i-app"},
+		Middleware: MiddlewareConfig{
+			Proxy: []Middleware{{Type: "hook", URL: hook.URL}},
+			API: []Middleware{
+				{Type: "ip_allowlist", Allow: []string{"192.0.2.0/24", "2001:db8::1"}},
+				{Type: "basic-auth", Users: map[string]Secret{"alice": "wonderland"}},
+				{Type: "rate-limit", Rate: 1, Burst: 2},
+			},
+		},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	fw := New(config, WithStateStore(&memStateStore{}), WithClock(NewFakeClock(time.Date(2026, 10, 15, 9, 0, 0, 0, time.UTC))))
+	fw.publish()
+	handler := NewHandler(fw)
+
+	api := func(remoteAddr, user, password string) int {
+		r := httptest.NewRequest("GET", "/flywheel/api/v1/status", nil)
+		r.RemoteAddr = remoteAddr
+		if user != "" {
+			r.SetBasicAuth(user, password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+	for _, test := range []struct {
+		remoteAddr, user, password string
+		code                       int
+	}{
+		{"203.0.113.7:1234", "alice", "wonderland", http.StatusForbidden},
+		{"192.0.2.10:1234", "", "", http.StatusUnauthorized},
+		{"192.0.2.10:1234", "alice", "looking-glass", http.StatusUnauthorized},
+		{"192.0.2.10:1234", "alice", "wonderland", http.StatusOK},
+		{"[2001:db8::1]:1234", "alice", "wonderland", http.StatusOK},
+		// Limited per user, so alice has used up the burst
+		{"192.0.2.10:1234", "alice", "wonderland", http.StatusTooManyRequests},
+	} {
+		if code := api(test.remoteAddr, test.user, test.password); code != test.code {
+			t.Errorf("Expected %d for %s from %s but got %d", test.code, test.user, test.remoteAddr, code)
+		}
+	}
+
+	// Readiness signals have their own checks
+	if code := api("203.0.113.7:1234", "", ""); code != http.StatusForbidden {
+		t.Errorf("Expected the status API to be refused, but got %d", code)
+	}
+	r := httptest.NewRequest("POST", "/flywheel/api/v1/ready", nil)
+	r.RemoteAddr = "203.0.113.7:1234"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code == http.StatusForbidden {
+		t.Errorf("Expected readiness signals to skip the chain")
+	}
+
+	// The hook decides for the proxied sites, and names the user
+	r = httptest.NewRequest("GET", "/app?x=1", nil)
+	r.Header.Set("X-Forwarded-User", "mallory")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "Not on the list") {
+		t.Errorf("Expected the hook to refuse, but got %d %s", w.Code, w.Body.String())
+	}
+	r = httptest.NewRequest("GET", "/app?x=1", nil)
+	r.Header.Set("Authorization", "Bearer letmein")
+	r.Header.Set("X-Forwarded-User", "mallory")
+	if !handler.guard(httptest.NewRecorder(), r) || requestUser(r) != "bob" {
+		t.Errorf("Expected the hook to allow bob, but got %q", requestUser(r))
+	}
+	if len(asked) != 2 || asked[1].Path != "/app?x=1" || asked[1].Client != "192.0.2.1" || asked[1].Action != ExecAuthorize {
+		t.Errorf("Expected the hook to be asked about the requests, but got %+v", asked)
+	}
+
+	// Without a middleware identifying users, clients are limited by
+	// address, whoever they claim to be
+	config.Middleware = MiddlewareConfig{Proxy: []Middleware{{Type: "rate-limit", Rate: 1, Burst: 1}}}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for i, user := range []string{"alice", "bob"} {
+		r = httptest.NewRequest("GET", "/favicon.ico", nil)
+		r.Header.Set("X-Forwarded-User", user)
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if limited := w.Code == http.StatusTooManyRequests; limited != (i > 0) {
+			t.Errorf("Expected request %d as %s to be limited: %v, but got %d", i, user, i > 0, w.Code)
+		}
+	}
+	if w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected Retry-After 1 but got %q", w.Header().Get("Retry-After"))
+	}
+
+	config.Middleware.API = []Middleware{{Type: "ldap"}}
+	if err := config.Validate(); err == nil {
+		t.Errorf("Expected an error for an unknown middleware")
+	}
+}
+
+func TestOIDC(t *testing.T) {
+	now := time.Date(2026, 10, 15, 9, 0, 0, 0, time.UTC)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segment := func(v interface{}) string {
+		buf, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(buf)
+	}
+	var issuer string
+	sign := func(email string, expiry time.Time, nonce string) string {
+		payload := segment(map[string]string{"alg": "RS256", "kid": "k1"}) + "." + segment(map[string]interface{}{
+			"iss": issuer, "aud": []string{"flywheel"}, "exp": expiry.Unix(), "sub": "1234", "email": email, "nonce": nonce,
+		})
+		hash := sha256.Sum256([]byte(payload))
+		signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+		return payload + "." + base64.RawURLEncoding.EncodeToString(signature)
+	}
+
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(oidcDiscovery{
+				AuthorizationEndpoint: issuer + "/authorize",
+				TokenEndpoint:         issuer + "/token",
+				JWKSURI:               issuer + "/keys",
+			})
+		case "/keys":
+			fmt.Fprintf(w, `{"keys": [{"kid": "k1", "kty": "RSA", "n": %q, "e": %q}]}`,
+				base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()))
+		case "/token":
+			if r.FormValue("client_secret") != "s3cret" {
+				http.Error(w, "invalid_client", http.StatusUnauthorized)
+				return
+			}
+			// The code is the nonce, for the test
+			fmt.Fprintf(w, `{"id_token": %q}`, sign("alice@Example.com", now.Add(time.Hour), r.FormValue("code")))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer provider.Close()
+	issuer = provider.URL
+
+	config := &Config{
+		Endpoint:  "10.0.0.1:80",
+		Instances: []string{"i-app"},
+		Middleware: MiddlewareConfig{
+			Proxy: []Middleware{{
+				Type:           "oidc",
+				Issuer:         issuer,
+				ClientID:       "flywheel",
+				ClientSecret:   "s3cret",
+				RedirectURL:    "https://app.example.com" + OIDCCallbackPath,
+				AllowedDomains: []string{"EXAMPLE.com"},
+			}},
+		},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	fw := New(config, WithStateStore(&memStateStore{}), WithClock(NewFakeClock(now)))
+	fw.publish()
+	handler := NewHandler(fw)
+
+	// A browser is sent to log in
+	r := httptest.NewRequest("GET", "/app?x=1", nil)
+	r.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	location, _ := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || location == nil || location.Path != "/authorize" {
+		t.Fatalf("Expected a redirect to log in, but got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	state := location.Query().Get("state")
+	if location.Query().Get("redirect_uri") != config.Middleware.Proxy[0].RedirectURL || state == "" {
+		t.Errorf("Expected the redirect-url and a state, but got %s", location)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcStateCookie {
+		t.Fatalf("Expected the state cookie, but got %v", cookies)
+	}
+
+	// It comes back with the code
+	r = httptest.NewRequest("GET", OIDCCallbackPath+"?state=wrong&code="+state, nil)
+	r.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a state mismatch to be refused, but got %d", w.Code)
+	}
+	r = httptest.NewRequest("GET", OIDCCallbackPath+"?state="+state+"&code="+state, nil)
+	r.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/app?x=1" {
+		t.Fatalf("Expected a redirect back to the site, but got %d %s %s", w.Code, w.Header().Get("Location"), w.Body.String())
+	}
+	var token *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == oidcCookie {
+			token = cookie
+		}
+	}
+	if token == nil {
+		t.Fatalf("Expected the ID token cookie")
+	}
+
+	// Never back to another site, whatever the state cookie says
+	for _, target := range []string{"//evil.example/", "/\\evil.example/", "https://evil.example/"} {
+		r = httptest.NewRequest("GET", OIDCCallbackPath+"?state=n1&code=n1", nil)
+		r.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: "n1." + base64.RawURLEncoding.EncodeToString([]byte(target))})
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusFound || w.Header().Get("Location") != "/" {
+			t.Errorf("Expected a redirect to / instead of %s, but got %d %s", target, w.Code, w.Header().Get("Location"))
+		}
+	}
+
+	// The cookie lets it in
+	r = httptest.NewRequest("GET", "/app?x=1", nil)
+	r.AddCookie(token)
+	if !handler.guard(httptest.NewRecorder(), r) || requestUser(r) != "alice@Example.com" {
+		t.Errorf("Expected alice to be let in, but got %q", requestUser(r))
+	}
+
+	for _, test := range []struct {
+		name, token string
+	}{
+		{"expired", sign("alice@example.com", now.Add(-time.Hour), "")},
+		{"other domain", sign("mallory@example.org", now.Add(time.Hour), "")},
+		// Alice's signature on mallory's claims
+		{"forged", strings.Join(append(strings.Split(sign("mallory@example.com", now.Add(time.Hour), ""), ".")[:2], strings.Split(token.Value, ".")[2]), ".")},
+	} {
+		r = httptest.NewRequest("GET", "/app", nil)
+		r.Header.Set("Authorization", "Bearer "+test.token)
+		w = httptest.NewRecorder()
+		if handler.guard(w, r) || w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected the %s token to be refused, but got %d", test.name, w.Code)
+		}
+	}
+}
+
+func TestPingMutates(t *testing.T) {
+	readOnly := true
+	for _, ping := range []Ping{
+		{requestStart: true},
+		{requestStop: true, confirmed: true},
+		{extend: time.Hour},
+		{stopAt: time.Now()},
+		{setTimeout: time.Hour},
+		{readOnly: &readOnly},
+		{vhost: &vhostChange{}},
+		{annotate: true, annotations: &Annotations{}},
+	} {
+		ping.user = "alice"
+		if !ping.mutates() {
+			t.Errorf("Expected %+v to be a change", ping)
+		}
+	}
+	for _, ping := range []Ping{{user: "alice"}, {noop: true}, {replyTo: make(chan Pong, 1)}} {
+		if ping.mutates() {
+			t.Errorf("Expected %+v to be only activity", ping)
+		}
+	}
+}
+
+func TestAbandonedPing(t *testing.T) {
+	now := time.Date(2026, 10, 15, 9, 0, 0, 0, time.UTC)
+	started := &Flywheel{config: &Config{}, status: STARTED, lastStarted: now, stopAt: now.Add(10 * time.Minute), clock: NewFakeClock(now), pings: make(chan Ping, 1)}
+	var calls []string
+	stopped := New(&Config{Endpoint: "10.0.0.1:80"}, WithStateStore(&memStateStore{}), WithClock(NewFakeClock(now)),
+		WithDriver(&fakeDriver{name: "app", state: "stopped", calls: &calls}))
+	stopped.status = STOPPED
+
+	// Neither goroutine answers in time
+	var wg sync.WaitGroup
+	var extend, start Pong
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		extend = NewHandler(started).ping(Ping{extend: time.Hour, user: "alice"})
+	}()
+	go func() {
+		defer wg.Done()
+		start = NewHandler(stopped).ping(Ping{requestStart: true, user: "alice"})
+	}()
+	wg.Wait()
+	if extend.Err != ErrBusy || start.Err != ErrBusy {
+		t.Fatalf("Expected ErrBusy, but got %v and %v", extend.Err, start.Err)
+	}
+
+	// Once they catch up, the abandoned requests aren't applied
+	ping := <-started.pings
+	started.RecvPing(&ping)
+	if _, ok := <-ping.replyTo; ok || started.deadline || !started.stopAt.Equal(now.Add(10*time.Minute)) || started.extensions["alice"] != 0 {
+		t.Errorf("Expected the abandoned extension to be dropped, but the stop is at %v", started.stopAt)
+	}
+	stopped.coalesceStart(<-stopped.pings)
+	if stopped.status != STOPPED || len(calls) != 0 {
+		t.Errorf("Expected the abandoned start to be dropped, but got %s %v", StatusString(stopped.status), calls)
+	}
+}
+
+func TestHaltedPing(t *testing.T) {
+	now := time.Date(2026, 10, 15, 9, 0, 0, 0, time.UTC)
+	fw := New(&Config{Endpoint: "10.0.0.1:80"}, WithStateStore(&memStateStore{}), WithClock(NewFakeClock(now)),
+		WithDriver(&fakeDriver{name: "app", state: "running"}))
+	fw.status = STARTED
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	fw.Run(ctx)
+
+	// Requests still being served, e.g. while draining for an upgrade,
+	// don't wait for the goroutine
+	handler := NewHandler(fw)
+	begin := time.Now()
+	activity := handler.ping(Ping{user: "alice"})
+	extend := handler.ping(Ping{extend: time.Hour, user: "alice"})
+	if elapsed := time.Since(begin); elapsed >= PingTimeout {
+		t.Errorf("Expected an answer without waiting, but took %v", elapsed)
+	}
+	if activity.Err != nil || activity.StatusName != "STARTED" {
+		t.Errorf("Expected the last status for activity, but got %s %v", activity.StatusName, activity.Err)
+	}
+	if extend.Err != ErrBusy {
+		t.Errorf("Expected ErrBusy for an extension, but got %v", extend.Err)
+	}
+}
+
+func TestForwardedUser(t *testing.T) {
+	now := time.Date(2026, 10, 15, 9, 0, 0, 0, time.UTC)
+	config := &Config{
+		Endpoint:            "10.0.0.1:80",
+		Instances:           []string{"i-app"},
+		MaxExtensionPerUser: Duration(time.Hour),
+		TrustedProxies:      []string{"10.1.0.0/16"},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	fw := New(config, WithStateStore(&memStateStore{}), WithClock(NewFakeClock(now)))
+	fw.status = STARTED
+	fw.stopAt = now.Add(time.Hour)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case ping := <-fw.pings:
+				fw.RecvPing(&ping)
+			case <-done:
+				return
+			}
+		}
+	}()
+	handler := NewHandler(fw)
+
+	extend := func(remoteAddr, user string) int {
+		r := httptest.NewRequest("POST", "/flywheel/api/v1/extend", strings.NewReader("duration=40m"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("X-Forwarded-User", user)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+	// A client can't get around its limit by claiming to be someone else
+	if code := extend("192.0.2.1:1234", "alice"); code != http.StatusOK {
+		t.Errorf("Expected the first extension, but got %d", code)
+	}
+	if code := extend("192.0.2.1:1234", "bob"); code != http.StatusConflict {
+		t.Errorf("Expected the per user limit for the client, but got %d", code)
+	}
+	// A trusted proxy can
+	if code := extend("10.1.2.3:1234", "alice"); code != http.StatusOK {
+		t.Errorf("Expected alice's extension through the proxy, but got %d", code)
+	}
+	if code := extend("10.1.2.3:1234", "alice"); code != http.StatusConflict {
+		t.Errorf("Expected the per user limit for alice, but got %d", code)
+	}
+
+	config.TrustedProxies = []string{"10.1.0.0/33"}
+	if err := config.Validate(); err == nil {
+		t.Errorf("Expected an error for an invalid trusted proxy")
+	}
+}
@@ -0,0 +1,263 @@
+package flywheel
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Catalog - the messages of the interstitial pages and the warning banner
+// in one language. Messages may contain HTML.
+type Catalog map[string]string
+
+// Catalogs - the built in languages. Custom catalogs from the config take
+// precedence, and missing messages fall back to English.
+var Catalogs = map[string]Catalog{
+	"en": {
+		"stopped.title":       "Your service is currently powered down",
+		"stopped.body":        `<a href="%s">Click here</a> to start.`,
+		"stopped.mobile":      "On your phone? Scan the code, or open %s",
+		"link.invalid.title":  "This link is invalid",
+		"link.invalid.body":   "Open the page again for a new link.",
+		"link.expired.title":  "This link has expired",
+		"link.expired.body":   "Open the page again for a new link.",
+		"stop.idle":           "It was powered down as it was idle.",
+		"stop.idle-timeout":   "It was powered down after no requests for a while.",
+		"stop.deadline":       "It was powered down at its stop time.",
+		"stop.manual":         "It was powered down by %s.",
+		"stop.external":       "It was powered down outside flywheel.",
+		"stop.schedule":       "It was powered down at a scheduled time.",
+		"parked.start":        "Start the full environment",
+		"starting.title":      "Your service is starting, please wait.",
+		"starting.body":       "Your site will be loaded once startup is complete.",
+		"stopping.title":      "Your service is being powered down.",
+		"stopping.body":       "Please wait for shutdown to complete before restarting.",
+		"unhealthy.title":     "Your service appears to be in an unhealthy or inconsistent state",
+		"unhealthy.body":      "This may be a temporary error, or may require manual intervention.",
+		"recovery.body":       `Restarting it failed %d times. <a href="%s">Click here</a> to try again.`,
+		"error.title":         "An error occured processing your request",
+		"error.permissions":   "This looks like a permissions problem: check the IAM policy of flywheel.",
+		"error.capacity":      "The AWS account or region is out of capacity or has hit a limit.",
+		"error.throttling":    "AWS is throttling requests, please try again in a minute.",
+		"error.not-found":     "A configured instance or group could not be found.",
+		"backend.title":       "Your service returned an error",
+		"backend.body":        "Please try again later, or contact the service owner if the problem persists.",
+		"proxy.refused.title": "Your service isn't accepting connections",
+		"proxy.refused.body":  "The servers are running, but the application isn't answering. It may have stopped or crashed.",
+		"proxy.timeout.title": "Your service took too long to respond",
+		"proxy.timeout.body":  "Please try again. If it keeps happening, the application may be overloaded.",
+		"proxy.dns.title":     "Your service's address could not be found",
+		"proxy.dns.body":      "The backend hostname doesn't resolve. Check the endpoint and vhosts of the flywheel configuration.",
+		"proxy.tls.title":     "A secure connection to your service failed",
+		"proxy.tls.body":      "The backend's certificate or TLS setup was rejected.",
+		"proxy.other.title":   "Your service could not be reached",
+		"proxy.other.body":    "Please try again later, or contact the service owner if the problem persists.",
+		"warning.countdown":   "This environment sleeps in {minutes} min - click to extend by {extend}",
+		"warning.failed":      "Unable to extend: ",
+		"owner.contact":       "Questions about this environment? Contact %s",
+		"request.id":          "Request ID: %s",
+	},
+	"de": {
+		"stopped.title":       "Ihr Dienst ist derzeit ausgeschaltet",
+		"stopped.body":        `<a href="%s">Hier klicken</a>, um ihn zu starten.`,
+		"stopped.mobile":      "Am Telefon? Scannen Sie den Code oder öffnen Sie %s",
+		"link.invalid.title":  "Dieser Link ist ungültig",
+		"link.invalid.body":   "Öffnen Sie die Seite erneut für einen neuen Link.",
+		"link.expired.title":  "Dieser Link ist abgelaufen",
+		"link.expired.body":   "Öffnen Sie die Seite erneut für einen neuen Link.",
+		"stop.idle":           "Er wurde wegen Inaktivität ausgeschaltet.",
+		"stop.idle-timeout":   "Er wurde ausgeschaltet, nachdem eine Weile keine Anfragen kamen.",
+		"stop.deadline":       "Er wurde zur geplanten Zeit ausgeschaltet.",
+		"stop.manual":         "Er wurde von %s ausgeschaltet.",
+		"stop.external":       "Er wurde außerhalb von flywheel ausgeschaltet.",
+		"stop.schedule":       "Er wurde zu einer geplanten Zeit ausgeschaltet.",
+		"parked.start":        "Vollständige Umgebung starten",
+		"starting.title":      "Ihr Dienst wird gestartet, bitte warten.",
+		"starting.body":       "Die Seite wird geladen, sobald der Start abgeschlossen ist.",
+		"stopping.title":      "Ihr Dienst wird heruntergefahren.",
+		"stopping.body":       "Bitte warten Sie, bis das Herunterfahren abgeschlossen ist, bevor Sie ihn neu starten.",
+		"unhealthy.title":     "Ihr Dienst scheint in einem fehlerhaften oder inkonsistenten Zustand zu sein",
+		"unhealthy.body":      "Das kann ein vorübergehender Fehler sein oder einen manuellen Eingriff erfordern.",
+		"recovery.body":       `Der Neustart ist %d-mal fehlgeschlagen. <a href="%s">Hier klicken</a>, um es erneut zu versuchen.`,
+		"error.title":         "Bei der Verarbeitung Ihrer Anfrage ist ein Fehler aufgetreten",
+		"error.permissions":   "Das sieht nach einem Berechtigungsproblem aus: Prüfen Sie die IAM-Richtlinie von flywheel.",
+		"error.capacity":      "Das AWS-Konto oder die Region hat keine Kapazität mehr oder ein Limit erreicht.",
+		"error.throttling":    "AWS drosselt Anfragen, bitte versuchen Sie es in einer Minute erneut.",
+		"error.not-found":     "Eine konfigurierte Instanz oder Gruppe wurde nicht gefunden.",
+		"backend.title":       "Ihr Dienst hat einen Fehler gemeldet",
+		"backend.body":        "Bitte versuchen Sie es später erneut oder wenden Sie sich an den Betreiber, falls das Problem bestehen bleibt.",
+		"proxy.refused.title": "Ihr Dienst nimmt keine Verbindungen an",
+		"proxy.refused.body":  "Die Server laufen, aber die Anwendung antwortet nicht. Sie wurde möglicherweise beendet oder ist abgestürzt.",
+		"proxy.timeout.title": "Ihr Dienst hat zu lange nicht geantwortet",
+		"proxy.timeout.body":  "Bitte versuchen Sie es erneut. Passiert das wiederholt, ist die Anwendung möglicherweise überlastet.",
+		"proxy.dns.title":     "Die Adresse Ihres Dienstes wurde nicht gefunden",
+		"proxy.dns.body":      "Der Hostname des Backends lässt sich nicht auflösen. Prüfen Sie endpoint und vhosts in der Flywheel-Konfiguration.",
+		"proxy.tls.title":     "Die sichere Verbindung zu Ihrem Dienst ist fehlgeschlagen",
+		"proxy.tls.body":      "Das Zertifikat oder die TLS-Konfiguration des Backends wurde abgelehnt.",
+		"proxy.other.title":   "Ihr Dienst ist nicht erreichbar",
+		"proxy.other.body":    "Bitte versuchen Sie es später erneut oder wenden Sie sich an den Betreiber, falls das Problem bestehen bleibt.",
+		"warning.countdown":   "Diese Umgebung schläft in {minutes} Min. ein - klicken, um um {extend} zu verlängern",
+		"warning.failed":      "Verlängern fehlgeschlagen: ",
+		"owner.contact":       "Fragen zu dieser Umgebung? Kontakt: %s",
+		"request.id":          "Anfrage-ID: %s",
+	},
+	"fr": {
+		"stopped.title":       "Votre service est actuellement arrêté",
+		"stopped.body":        `<a href="%s">Cliquez ici</a> pour le démarrer.`,
+		"stopped.mobile":      "Sur votre téléphone ? Scannez le code ou ouvrez %s",
+		"link.invalid.title":  "Ce lien n'est pas valide",
+		"link.invalid.body":   "Ouvrez à nouveau la page pour obtenir un nouveau lien.",
+		"link.expired.title":  "Ce lien a expiré",
+		"link.expired.body":   "Ouvrez à nouveau la page pour obtenir un nouveau lien.",
+		"stop.idle":           "Il a été arrêté car il était inactif.",
+		"stop.idle-timeout":   "Il a été arrêté faute de requêtes pendant un moment.",
+		"stop.deadline":       "Il a été arrêté à l'heure d'arrêt prévue.",
+		"stop.manual":         "Il a été arrêté par %s.",
+		"stop.external":       "Il a été arrêté en dehors de flywheel.",
+		"stop.schedule":       "Il a été arrêté à une heure programmée.",
+		"parked.start":        "Démarrer l'environnement complet",
+		"starting.title":      "Votre service démarre, veuillez patienter.",
+		"starting.body":       "Votre site sera chargé dès que le démarrage sera terminé.",
+		"stopping.title":      "Votre service est en cours d'arrêt.",
+		"stopping.body":       "Veuillez attendre la fin de l'arrêt avant de le redémarrer.",
+		"unhealthy.title":     "Votre service semble être dans un état défaillant ou incohérent",
+		"unhealthy.body":      "Il peut s'agir d'une erreur temporaire, ou une intervention manuelle peut être nécessaire.",
+		"recovery.body":       `Le redémarrage a échoué %d fois. <a href="%s">Cliquez ici</a> pour réessayer.`,
+		"error.title":         "Une erreur est survenue lors du traitement de votre requête",
+		"error.permissions":   "Il semble s'agir d'un problème de permissions : vérifiez la politique IAM de flywheel.",
+		"error.capacity":      "Le compte ou la région AWS manque de capacité ou a atteint une limite.",
+		"error.throttling":    "AWS limite le débit des requêtes, veuillez réessayer dans une minute.",
+		"error.not-found":     "Une instance ou un groupe configuré est introuvable.",
+		"backend.title":       "Votre service a renvoyé une erreur",
+		"backend.body":        "Veuillez réessayer plus tard, ou contacter le responsable du service si le problème persiste.",
+		"proxy.refused.title": "Votre service n'accepte pas de connexions",
+		"proxy.refused.body":  "Les serveurs fonctionnent, mais l'application ne répond pas. Elle s'est peut-être arrêtée ou a planté.",
+		"proxy.timeout.title": "Votre service a mis trop de temps à répondre",
+		"proxy.timeout.body":  "Veuillez réessayer. Si cela se reproduit, l'application est peut-être surchargée.",
+		"proxy.dns.title":     "L'adresse de votre service est introuvable",
+		"proxy.dns.body":      "Le nom d'hôte du backend ne se résout pas. Vérifiez endpoint et vhosts dans la configuration de flywheel.",
+		"proxy.tls.title":     "La connexion sécurisée à votre service a échoué",
+		"proxy.tls.body":      "Le certificat ou la configuration TLS du backend a été rejeté.",
+		"proxy.other.title":   "Votre service est injoignable",
+		"proxy.other.body":    "Veuillez réessayer plus tard, ou contacter le responsable du service si le problème persiste.",
+		"warning.countdown":   "Cet environnement s'endort dans {minutes} min - cliquez pour prolonger de {extend}",
+		"warning.failed":      "Impossible de prolonger : ",
+		"owner.contact":       "Des questions sur cet environnement ? Contactez %s",
+		"request.id":          "ID de requête : %s",
+	},
+	"ja": {
+		"stopped.title":       "サービスは現在停止しています",
+		"stopped.body":        `起動するには<a href="%s">ここをクリック</a>してください。`,
+		"stopped.mobile":      "スマートフォンからはコードをスキャンするか、%sを開いてください。",
+		"link.invalid.title":  "このリンクは無効です",
+		"link.invalid.body":   "ページをもう一度開いて新しいリンクを取得してください。",
+		"link.expired.title":  "このリンクは期限切れです",
+		"link.expired.body":   "ページをもう一度開いて新しいリンクを取得してください。",
+		"stop.idle":           "アイドル状態のため停止されました。",
+		"stop.idle-timeout":   "しばらくリクエストがなかったため停止されました。",
+		"stop.deadline":       "予定された停止時刻に停止されました。",
+		"stop.manual":         "%sによって停止されました。",
+		"stop.external":       "flywheelの外部で停止されました。",
+		"stop.schedule":       "スケジュールされた時刻に停止されました。",
+		"parked.start":        "環境を起動する",
+		"starting.title":      "サービスを起動しています。しばらくお待ちください。",
+		"starting.body":       "起動が完了するとサイトが読み込まれます。",
+		"stopping.title":      "サービスを停止しています。",
+		"stopping.body":       "再起動する前に停止の完了をお待ちください。",
+		"unhealthy.title":     "サービスが異常または不整合な状態にあるようです",
+		"unhealthy.body":      "一時的なエラーの可能性があります。手動での対応が必要な場合もあります。",
+		"recovery.body":       `再起動に%d回失敗しました。<a href="%s">ここをクリック</a>して再試行してください。`,
+		"error.title":         "リクエストの処理中にエラーが発生しました",
+		"error.permissions":   "権限の問題のようです。flywheelのIAMポリシーを確認してください。",
+		"error.capacity":      "AWSアカウントまたはリージョンの容量が不足しているか、上限に達しています。",
+		"error.throttling":    "AWSがリクエストを制限しています。1分後に再度お試しください。",
+		"error.not-found":     "設定されたインスタンスまたはグループが見つかりません。",
+		"backend.title":       "サービスがエラーを返しました",
+		"backend.body":        "しばらくしてから再度お試しください。問題が解決しない場合はサービスの管理者にお問い合わせください。",
+		"proxy.refused.title": "サービスが接続を受け付けていません",
+		"proxy.refused.body":  "サーバーは起動していますが、アプリケーションが応答しません。停止またはクラッシュした可能性があります。",
+		"proxy.timeout.title": "サービスの応答に時間がかかりすぎました",
+		"proxy.timeout.body":  "もう一度お試しください。繰り返し発生する場合は、アプリケーションが過負荷の可能性があります。",
+		"proxy.dns.title":     "サービスのアドレスが見つかりません",
+		"proxy.dns.body":      "バックエンドのホスト名を解決できません。flywheelの設定のendpointとvhostsを確認してください。",
+		"proxy.tls.title":     "サービスへの安全な接続に失敗しました",
+		"proxy.tls.body":      "バックエンドの証明書またはTLS設定が拒否されました。",
+		"proxy.other.title":   "サービスに接続できません",
+		"proxy.other.body":    "しばらくしてから再度お試しください。問題が解決しない場合はサービスの管理者にお問い合わせください。",
+		"warning.countdown":   "この環境はあと{minutes}分で停止します - クリックすると{extend}延長します",
+		"warning.failed":      "延長できませんでした: ",
+		"owner.contact":       "この環境についてのお問い合わせ: %s",
+		"request.id":          "リクエストID: %s",
+	},
+}
+
+// Message - a message in the given language
+func (c *Config) Message(lang, key string) string {
+	if msg, ok := c.Catalogs[lang][key]; ok {
+		return msg
+	}
+	if msg, ok := Catalogs[lang][key]; ok {
+		return msg
+	}
+	return Catalogs["en"][key]
+}
+
+// hasLanguage - true if there is a built in or custom catalog
+func (c *Config) hasLanguage(lang string) bool {
+	_, builtin := Catalogs[lang]
+	_, custom := c.Catalogs[lang]
+	return builtin || custom
+}
+
+// Language - pick the language for a request from its Accept-Language
+// header, falling back to the configured default
+func (c *Config) Language(r *http.Request) string {
+	var prefs languagePreferences
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		lang := strings.ToLower(strings.TrimSpace(fields[0]))
+		if lang == "" || lang == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			prefs = append(prefs, languagePreference{lang, q})
+		}
+	}
+	sort.Stable(prefs)
+
+	for _, pref := range prefs {
+		if c.hasLanguage(pref.lang) {
+			return pref.lang
+		}
+		// "de-AT" falls back to "de"
+		if i := strings.Index(pref.lang, "-"); i > 0 && c.hasLanguage(pref.lang[:i]) {
+			return pref.lang[:i]
+		}
+	}
+	if c.DefaultLanguage != "" {
+		return c.DefaultLanguage
+	}
+	return "en"
+}
+
+type languagePreference struct {
+	lang string
+	q    float64
+}
+
+// languagePreferences - sorts by descending quality
+type languagePreferences []languagePreference
+
+func (p languagePreferences) Len() int           { return len(p) }
+func (p languagePreferences) Less(i, j int) bool { return p[i].q > p[j].q }
+func (p languagePreferences) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
@@ -0,0 +1,279 @@
+package flywheel
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// IdleStrategy - decides if the environment is idle and may be stopped.
+// Strategies are evaluated in the health check goroutine, so they may call
+// out to AWS.
+type IdleStrategy interface {
+	Idle(now time.Time) (bool, error)
+}
+
+// Idle strategy types
+const (
+	IdleLastRequest = "last-request"
+	IdleConnections = "connections"
+	IdleCloudWatch  = "cloudwatch"
+	IdleHeartbeat   = "heartbeat"
+	IdleAll         = "all"
+	IdleAny         = "any"
+)
+
+// IdleConfig - an idle strategy. "all" and "any" combine other strategies;
+// the environment is idle when all, or any, of them say so.
+type IdleConfig struct {
+	Type       string       `json:"type"`
+	Strategies []IdleConfig `json:"strategies"`
+
+	// How long connections or heartbeats have to be absent
+	Timeout Duration `json:"timeout"`
+
+	// CloudWatch metric, idle while its statistic stays below the threshold
+	Namespace  string            `json:"namespace"`
+	Metric     string            `json:"metric"`
+	Dimensions map[string]string `json:"dimensions"`
+	Statistic  string            `json:"statistic"`
+	Threshold  float64           `json:"threshold"`
+	Period     Duration          `json:"period"`
+}
+
+// Validate - check the strategy and set defaults
+func (c *IdleConfig) Validate() error {
+	switch c.Type {
+	case IdleLastRequest:
+	case IdleConnections, IdleHeartbeat:
+		if c.Timeout <= 0 {
+			c.Timeout = Duration(15 * time.Minute)
+		}
+	case IdleCloudWatch:
+		if c.Namespace == "" || c.Metric == "" {
+			return fmt.Errorf("CloudWatch idle strategy needs a namespace and metric")
+		}
+		if c.Statistic == "" {
+			c.Statistic = "Maximum"
+		}
+		if c.Period <= 0 {
+			c.Period = Duration(15 * time.Minute)
+		}
+	case IdleAll, IdleAny:
+		if len(c.Strategies) == 0 {
+			return fmt.Errorf("Idle strategy %s needs strategies", c.Type)
+		}
+		for i := range c.Strategies {
+			if err := c.Strategies[i].Validate(); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("Unknown idle strategy %q", c.Type)
+	}
+	return nil
+}
+
+// newIdleStrategy - build the configured strategy, nil when there is none
+// and the idle timeout alone applies
+func (fw *Flywheel) newIdleStrategy(c *IdleConfig) IdleStrategy {
+	switch c.Type {
+	case IdleLastRequest:
+		return lastRequestIdle{fw}
+	case IdleConnections:
+		return connectionsIdle{fw.activity, time.Duration(c.Timeout)}
+	case IdleHeartbeat:
+		return heartbeatIdle{fw.activity, time.Duration(c.Timeout)}
+	case IdleCloudWatch:
+		return cloudWatchIdle{fw, c}
+	case IdleAll, IdleAny:
+		var strategies []IdleStrategy
+		for i := range c.Strategies {
+			strategies = append(strategies, fw.newIdleStrategy(&c.Strategies[i]))
+		}
+		return compositeIdle{all: c.Type == IdleAll, strategies: strategies}
+	}
+	return nil
+}
+
+// lastRequestIdle - the idle timeout, reset by requests. Extensions and
+// explicit stop times apply to it.
+type lastRequestIdle struct {
+	fw *Flywheel
+}
+
+func (s lastRequestIdle) Idle(now time.Time) (bool, error) {
+	return now.After(s.fw.Snapshot().StopAt), nil
+}
+
+// connectionsIdle - no proxied requests in flight for the timeout
+type connectionsIdle struct {
+	activity *Activity
+	timeout  time.Duration
+}
+
+func (s connectionsIdle) Idle(now time.Time) (bool, error) {
+	active, since := s.activity.Connections()
+	return active == 0 && now.Sub(since) >= s.timeout, nil
+}
+
+// heartbeatIdle - no agent heartbeat for the timeout
+type heartbeatIdle struct {
+	activity *Activity
+	timeout  time.Duration
+}
+
+func (s heartbeatIdle) Idle(now time.Time) (bool, error) {
+	return now.Sub(s.activity.LastHeartbeat()) >= s.timeout, nil
+}
+
+// cloudWatchIdle - a metric stayed below the threshold for the period
+type cloudWatchIdle struct {
+	fw     *Flywheel
+	config *IdleConfig
+}
+
+func (s cloudWatchIdle) Idle(now time.Time) (bool, error) {
+	start := now.Add(-time.Duration(s.config.Period))
+	var dimensions []*metricDimension
+	for name, value := range s.config.Dimensions {
+		dimensions = append(dimensions, &metricDimension{Name: aws.String(name), Value: aws.String(value)})
+	}
+
+	var out struct {
+		_ struct{} `type:"structure"`
+
+		Datapoints []*struct {
+			Average *float64 `type:"double"`
+			Maximum *float64 `type:"double"`
+			Minimum *float64 `type:"double"`
+			Sum     *float64 `type:"double"`
+		} `type:"list"`
+	}
+	err := awsCall(s.fw.cloudwatch, "GetMetricStatistics", &getMetricStatisticsInput{
+		Namespace:  aws.String(s.config.Namespace),
+		MetricName: aws.String(s.config.Metric),
+		Dimensions: dimensions,
+		StartTime:  &start,
+		EndTime:    &now,
+		Period:     aws.Int64(60),
+		Statistics: []*string{aws.String(s.config.Statistic)},
+	}, &out)
+	if err != nil {
+		return false, err
+	}
+
+	for _, point := range out.Datapoints {
+		var value *float64
+		switch s.config.Statistic {
+		case "Average":
+			value = point.Average
+		case "Minimum":
+			value = point.Minimum
+		case "Sum":
+			value = point.Sum
+		default:
+			value = point.Maximum
+		}
+		if aws.Float64Value(value) >= s.config.Threshold {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// compositeIdle - idle when all, or any, of the strategies are idle
+type compositeIdle struct {
+	all        bool
+	strategies []IdleStrategy
+}
+
+func (s compositeIdle) Idle(now time.Time) (bool, error) {
+	for _, strategy := range s.strategies {
+		idle, err := strategy.Idle(now)
+		if err != nil {
+			return false, err
+		}
+		if idle != s.all {
+			return idle, nil
+		}
+	}
+	return s.all, nil
+}
+
+// Activity - activity signals collected outside the flywheel goroutine.
+// A nil Activity ignores everything.
+type Activity struct {
+	connections int64
+
+	// Since start, so the time keeps its monotonic reading
+	lastActive int64
+	start      time.Time
+
+	mu        sync.Mutex
+	heartbeat time.Time
+
+	clock Clock
+}
+
+// NewActivity - create an Activity, idle since now
+func NewActivity(clock Clock) *Activity {
+	return &Activity{start: clock.Now(), clock: clock}
+}
+
+// Reset - start over as if there was activity now, e.g. after starting
+func (a *Activity) Reset(now time.Time) {
+	if a == nil {
+		return
+	}
+	atomic.StoreInt64(&a.lastActive, int64(now.Sub(a.start)))
+	a.Heartbeat(now)
+}
+
+// Begin - a proxied request started
+func (a *Activity) Begin() {
+	if a == nil {
+		return
+	}
+	atomic.AddInt64(&a.connections, 1)
+}
+
+// End - a proxied request finished
+func (a *Activity) End() {
+	if a == nil {
+		return
+	}
+	atomic.StoreInt64(&a.lastActive, int64(a.clock.Now().Sub(a.start)))
+	atomic.AddInt64(&a.connections, -1)
+}
+
+// Connections - requests in flight, and when the last one finished
+func (a *Activity) Connections() (int64, time.Time) {
+	if a == nil {
+		return 0, time.Time{}
+	}
+	return atomic.LoadInt64(&a.connections), a.start.Add(time.Duration(atomic.LoadInt64(&a.lastActive)))
+}
+
+// Heartbeat - an agent reported activity
+func (a *Activity) Heartbeat(now time.Time) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	a.heartbeat = now
+	a.mu.Unlock()
+}
+
+// LastHeartbeat - when an agent last reported activity
+func (a *Activity) LastHeartbeat() time.Time {
+	if a == nil {
+		return time.Time{}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.heartbeat
+}
@@ -0,0 +1,54 @@
+package flywheel
+
+import (
+	"fmt"
+	"time"
+)
+
+// IdleTimeoutWindow - an idle timeout for a daily window, e.g. 15m from
+// 19:00 to 07:00, so the environment sleeps early at night but not during
+// the workday
+type IdleTimeoutWindow struct {
+	ClockWindow
+	Timeout Duration `json:"timeout"`
+}
+
+// Validate - check the window has a timeout
+func (w *IdleTimeoutWindow) Validate() error {
+	if w.Timeout <= 0 {
+		return fmt.Errorf("Idle timeout window %s-%s needs a timeout", w.From, w.To)
+	}
+	return w.ClockWindow.Validate()
+}
+
+// idleTimeoutAt - the idle timeout of the first window the time is in, or
+// idle-timeout outside them
+func (fw *Flywheel) idleTimeoutAt(now time.Time) time.Duration {
+	for i := range fw.config.IdleTimeouts {
+		if w := &fw.config.IdleTimeouts[i]; w.Contains(now) {
+			return time.Duration(w.Timeout)
+		}
+	}
+	return fw.idleTimeout
+}
+
+// restartIdleTimer - schedule the stop after the idle timeout, from now
+func (fw *Flywheel) restartIdleTimer() {
+	now := fw.now()
+	fw.idleSince = now
+	fw.stopAt = now.Add(fw.idleTimeoutAt(now))
+}
+
+// pollIdleTimeouts - when a window starts or ends, reschedule the stop as
+// if the last request had come with the new timeout. Going into a shorter
+// window may stop the environment right away. Deadlines stay.
+func (fw *Flywheel) pollIdleTimeouts() {
+	if len(fw.config.IdleTimeouts) == 0 || fw.deadline || fw.idleSince.IsZero() {
+		return
+	}
+	timeout := fw.idleTimeoutAt(fw.now())
+	if stopAt := fw.idleSince.Add(timeout); !stopAt.Equal(fw.stopAt) {
+		fw.stopAt = stopAt
+		fw.logf("Idle timeout is now %v. Stop scheduled for %v", timeout, fw.stopAt)
+	}
+}
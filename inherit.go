@@ -0,0 +1,113 @@
+package flywheel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// Bases may extend other bases, up to this deep
+const maxExtendsDepth = 10
+
+// readConfigJSON - a config file as a JSON object, on top of the base
+// policies it extends. Objects are merged key by key, anything else in the
+// file replaces the base's value, and null removes it.
+func readConfigJSON(filename string, chain []string) (map[string]interface{}, error) {
+	for _, f := range chain {
+		if f == filename {
+			return nil, fmt.Errorf("Config %s extends itself", filename)
+		}
+	}
+	if len(chain) > maxExtendsDepth {
+		return nil, fmt.Errorf("Config %s extends more than %d levels deep", chain[0], maxExtendsDepth)
+	}
+	chain = append(chain, filename)
+
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var own map[string]interface{}
+	if err := json.Unmarshal(buf, &own); err != nil {
+		return nil, fmt.Errorf("Could not decode json in %s: %v", filename, err)
+	}
+
+	bases, err := extendsList(own["extends"])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid extends in %s: %v", filename, err)
+	}
+	delete(own, "extends")
+
+	merged := make(map[string]interface{})
+	for _, base := range bases {
+		if !filepath.IsAbs(base) {
+			base = filepath.Join(filepath.Dir(filename), base)
+		}
+		inherited, err := readConfigJSON(base, chain)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkBaseKeys(base, inherited); err != nil {
+			return nil, err
+		}
+		merged = mergeJSON(merged, inherited)
+	}
+	return mergeJSON(merged, own), nil
+}
+
+// extendsList - the base files, from a file name or a list of them
+func extendsList(extends interface{}) ([]string, error) {
+	switch v := extends.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		var files []string
+		for _, f := range v {
+			s, ok := f.(string)
+			if !ok {
+				return nil, fmt.Errorf("Expected file names, got %v", f)
+			}
+			files = append(files, s)
+		}
+		return files, nil
+	}
+	return nil, fmt.Errorf("Expected a file name or a list of them, got %v", extends)
+}
+
+// mergeJSON - override on top of base. Objects are merged recursively.
+func mergeJSON(base, override map[string]interface{}) map[string]interface{} {
+	for key, value := range override {
+		if value == nil {
+			delete(base, key)
+			continue
+		}
+		from, ok := base[key].(map[string]interface{})
+		to, isObject := value.(map[string]interface{})
+		if ok && isObject {
+			base[key] = mergeJSON(from, to)
+		} else {
+			base[key] = value
+		}
+	}
+	return base
+}
+
+// checkBaseKeys - a base policy is incomplete on its own, so it can't be
+// validated like a config, but its keys must all be known. A typo would
+// otherwise go unnoticed in every environment extending it.
+func checkBaseKeys(filename string, base map[string]interface{}) error {
+	buf, err := json.Marshal(base)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&Config{}); err != nil {
+		return fmt.Errorf("Invalid base config %s: %v", filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package flywheel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WarningBannerConfig - settings for the shutdown warning injected into
+// proxied HTML pages
+type WarningBannerConfig struct {
+	Enabled    bool     `json:"enabled"`
+	WarnBefore Duration `json:"warn-before"`
+	Extend     Duration `json:"extend"`
+}
+
+// Largest page the banner is injected into. Larger responses are streamed
+// through as they are, rather than held in memory.
+const maxInjectedPage = 4 << 20
+
+// prepareInjection - ask the backend for an uncompressed response when the
+// browser is loading a page, so the banner can be injected into it.
+func (handler *Handler) prepareInjection(r *http.Request) {
+	if !handler.Flywheel.config.WarningBanner.Enabled {
+		return
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		r.Header.Del("Accept-Encoding")
+	}
+}
+
+// injectWarning - add the shutdown warning script to a proxied HTML page
+func (handler *Handler) injectWarning(resp *http.Response, stopAt time.Time, lang string) error {
+	config := handler.Flywheel.config
+	banner := config.WarningBanner
+	if !banner.Enabled || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") || resp.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxInjectedPage+1))
+	if err != nil {
+		resp.Body.Close()
+		return err
+	}
+	if len(body) > maxInjectedPage {
+		// The part read already, then the rest as it comes
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+
+	countdown, _ := json.Marshal(config.Message(lang, "warning.countdown"))
+	failed, _ := json.Marshal(config.Message(lang, "warning.failed"))
+	script := fmt.Sprintf(HTMLWARNING,
+		stopAt.Sub(handler.Flywheel.now())/time.Millisecond,
+		time.Duration(banner.WarnBefore)/time.Millisecond,
+		time.Duration(banner.Extend),
+		countdown,
+		failed,
+	)
+	body = injectBeforeBody(body, script)
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return nil
+}
+
+// injectBeforeBody - add the snippet before the closing body tag. Pages
+// without one are left alone.
+func injectBeforeBody(body []byte, snippet string) []byte {
+	index := bytes.LastIndex(bytes.ToLower(body), []byte("</body>"))
+	if index == -1 {
+		return body
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(body) + len(snippet))
+	buf.Write(body[:index])
+	buf.WriteString(snippet)
+	buf.Write(body[index:])
+	return buf.Bytes()
+}
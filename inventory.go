@@ -0,0 +1,441 @@
+package flywheel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// InventoryConfig - where to look for resources that flywheel could manage,
+// across the accounts of an AWS Organization, for rolling it out. Read
+// from its own file, as it isn't about one environment.
+type InventoryConfig struct {
+	// The role assumed in each account, default the role Organizations
+	// creates in new accounts
+	RoleName string `json:"role-name"`
+
+	// Only these accounts, default all active accounts
+	Accounts []string `json:"accounts"`
+	Regions  []string `json:"regions"`
+
+	// Resources with this tag are candidates, with any value unless
+	// tag-value is given. Default flywheel.
+	Tag      string `json:"tag"`
+	TagValue string `json:"tag-value"`
+
+	// Flywheel configs of the environments already managed, relative to
+	// this file, with wildcards
+	Configs []string `json:"configs"`
+
+	// Price per hour of instance types, e.g. {"m5.large": 0.096}
+	Prices map[string]float64 `json:"prices"`
+
+	// Hours a week the resources are actually needed, default 50. The rest
+	// is the idle cost.
+	WorkingHours float64 `json:"working-hours"`
+
+	dir string
+}
+
+// Validate - check the regions, and fill in the defaults
+func (c *InventoryConfig) Validate() error {
+	if len(c.Regions) == 0 {
+		return fmt.Errorf("Inventory needs regions")
+	}
+	if c.RoleName == "" {
+		c.RoleName = "OrganizationAccountAccessRole"
+	}
+	if c.Tag == "" {
+		c.Tag = "flywheel"
+	}
+	if c.WorkingHours == 0 {
+		c.WorkingHours = 50
+	}
+	if c.WorkingHours < 0 || c.WorkingHours > 168 {
+		return fmt.Errorf("Inventory working hours must be between 0 and 168 a week, got %v", c.WorkingHours)
+	}
+	for instanceType, price := range c.Prices {
+		if price < 0 {
+			return fmt.Errorf("Price of %s can't be negative", instanceType)
+		}
+	}
+	return nil
+}
+
+// ReadInventoryConfig - read an inventory config file
+func ReadInventoryConfig(filename string) (*InventoryConfig, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	c := &InventoryConfig{dir: filepath.Dir(filename)}
+	if err := json.Unmarshal(buf, c); err != nil {
+		return nil, fmt.Errorf("Could not decode json: %v", err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid inventory: %v", err)
+	}
+	return c, nil
+}
+
+// idleHours - the hours a month the resources aren't needed
+func (c *InventoryConfig) idleHours() float64 {
+	return (168 - c.WorkingHours) * 52 / 12
+}
+
+// InventoryResource - a tagged instance, or autoscaling group
+type InventoryResource struct {
+	Account string `json:"account"`
+	Region  string `json:"region"`
+	Type    string `json:"type"`
+	ID      string `json:"id"`
+	Name    string `json:"name,omitempty"`
+
+	// The instance state, or the running instances of a group
+	State         string   `json:"state,omitempty"`
+	InstanceTypes []string `json:"instance-types"`
+	Running       int      `json:"running"`
+
+	Managed bool `json:"managed"`
+
+	// Estimated cost of running outside the working hours, per month.
+	// Zero for managed resources, and when the price of a type isn't
+	// known, which is then listed in the report.
+	IdleCost float64 `json:"idle-cost"`
+}
+
+// InventoryReport - the tagged resources of all accounts, and what could
+// be saved by managing those that aren't
+type InventoryReport struct {
+	Time      time.Time           `json:"time"`
+	Accounts  int                 `json:"accounts"`
+	Resources []InventoryResource `json:"resources"`
+	Unmanaged int                 `json:"unmanaged"`
+	IdleCost  float64             `json:"idle-cost"`
+
+	// Instance types without a price, so their idle cost isn't counted
+	Unpriced []string `json:"unpriced,omitempty"`
+
+	// Accounts and regions that couldn't be inventoried, e.g. no role
+	Errors []string `json:"errors,omitempty"`
+}
+
+type listAccountsInput struct {
+	NextToken *string `json:",omitempty"`
+}
+
+type listAccountsOutput struct {
+	Accounts []struct {
+		Id     string
+		Name   string
+		Status string
+	}
+	NextToken *string
+}
+
+type getCallerIdentityOutput struct {
+	_ struct{} `type:"structure"`
+
+	Account *string `type:"string"`
+}
+
+type assumeRoleInput struct {
+	_ struct{} `type:"structure"`
+
+	RoleArn         *string `type:"string"`
+	RoleSessionName *string `type:"string"`
+}
+
+type assumeRoleOutput struct {
+	_ struct{} `type:"structure"`
+
+	Credentials *struct {
+		_ struct{} `type:"structure"`
+
+		AccessKeyId     *string `type:"string"`
+		SecretAccessKey *string `type:"string"`
+		SessionToken    *string `type:"string"`
+	} `type:"structure"`
+}
+
+// Inventory - find the tagged resources in the accounts of the
+// Organization of the session, which has to be allowed to list them, and
+// to assume the role in them
+func Inventory(sess *session.Session, c *InventoryConfig) (*InventoryReport, error) {
+	managed, err := c.managed()
+	if err != nil {
+		return nil, err
+	}
+	home := sess.Copy(&aws.Config{Region: aws.String("us-east-1")})
+
+	var caller getCallerIdentityOutput
+	if err := awsCall(newQueryClient(home, "sts", "2011-06-15"), "GetCallerIdentity", &struct {
+		_ struct{} `type:"structure"`
+	}{}, &caller); err != nil {
+		return nil, err
+	}
+	accounts, err := c.accounts(home)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &InventoryReport{Time: time.Now(), Accounts: len(accounts), Resources: []InventoryResource{}}
+	unpriced := make(map[string]bool)
+	for _, account := range accounts {
+		accountSess := sess
+		if account != aws.StringValue(caller.Account) {
+			if accountSess, err = c.assume(home, account); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", account, err))
+				continue
+			}
+		}
+		for _, region := range c.Regions {
+			regionSess := accountSess.Copy(&aws.Config{Region: aws.String(region)})
+			resources, err := c.inventoryRegion(regionSess, account, region)
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s %s: %v", account, region, err))
+				continue
+			}
+			for _, r := range resources {
+				r.Managed = managed[r.Type+":"+r.ID]
+				if !r.Managed {
+					report.Unmanaged++
+					for _, instanceType := range r.InstanceTypes {
+						if _, ok := c.Prices[instanceType]; !ok {
+							unpriced[instanceType] = true
+						}
+					}
+					r.IdleCost = c.idleCost(r)
+					report.IdleCost += r.IdleCost
+				}
+				report.Resources = append(report.Resources, r)
+			}
+		}
+	}
+	for instanceType := range unpriced {
+		report.Unpriced = append(report.Unpriced, instanceType)
+	}
+	sort.Strings(report.Unpriced)
+	return report, nil
+}
+
+// managed - the instances and groups of the flywheel configs, by type and
+// ID
+func (c *InventoryConfig) managed() (map[string]bool, error) {
+	managed := make(map[string]bool)
+	for _, pattern := range c.Configs {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(c.dir, pattern)
+		}
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			config, err := ReadConfig(file)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+			configs := []*Config{config}
+			for _, name := range config.PoolNames() {
+				configs = append(configs, config.Pools[name].Config())
+			}
+			for _, config := range configs {
+				for _, id := range config.Instances {
+					managed[ResourceInstance+":"+id] = true
+				}
+				for _, name := range config.AutoScaling.groupNames() {
+					managed[ResourceAutoScalingGroup+":"+name] = true
+				}
+			}
+		}
+	}
+	return managed, nil
+}
+
+// accounts - the active accounts of the Organization, or those configured
+func (c *InventoryConfig) accounts(sess *session.Session) ([]string, error) {
+	if len(c.Accounts) > 0 {
+		return c.Accounts, nil
+	}
+	org := newJSONClient(sess, "organizations", "organizations", "AWSOrganizationsV20161128")
+	var accounts []string
+	input := &listAccountsInput{}
+	for {
+		var page listAccountsOutput
+		if err := awsCall(org, "ListAccounts", input, &page); err != nil {
+			return nil, err
+		}
+		for _, account := range page.Accounts {
+			if account.Status == "ACTIVE" {
+				accounts = append(accounts, account.Id)
+			}
+		}
+		if page.NextToken == nil {
+			return accounts, nil
+		}
+		input.NextToken = page.NextToken
+	}
+}
+
+// assume - a session with the role of the account
+func (c *InventoryConfig) assume(sess *session.Session, account string) (*session.Session, error) {
+	var resp assumeRoleOutput
+	err := awsCall(newQueryClient(sess, "sts", "2011-06-15"), "AssumeRole", &assumeRoleInput{
+		RoleArn:         aws.String(fmt.Sprintf("arn:aws:iam::%s:role/%s", account, c.RoleName)),
+		RoleSessionName: aws.String("flywheel-inventory"),
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Credentials == nil {
+		return nil, fmt.Errorf("No credentials for role %s", c.RoleName)
+	}
+	creds := credentials.NewStaticCredentials(
+		aws.StringValue(resp.Credentials.AccessKeyId),
+		aws.StringValue(resp.Credentials.SecretAccessKey),
+		aws.StringValue(resp.Credentials.SessionToken),
+	)
+	return sess.Copy(&aws.Config{Credentials: creds}), nil
+}
+
+// inventoryRegion - the tagged groups, and the tagged instances that
+// aren't in a group
+func (c *InventoryConfig) inventoryRegion(sess *session.Session, account, region string) ([]InventoryResource, error) {
+	ec2Client := ec2.New(sess)
+	var resources []InventoryResource
+
+	instances := make(map[string]*ec2.Instance)
+	filter := &ec2.Filter{Name: aws.String("tag-key"), Values: aws.StringSlice([]string{c.Tag})}
+	if c.TagValue != "" {
+		filter = &ec2.Filter{Name: aws.String("tag:" + c.Tag), Values: aws.StringSlice([]string{c.TagValue})}
+	}
+	err := ec2Client.DescribeInstancesPages(&ec2.DescribeInstancesInput{Filters: []*ec2.Filter{filter}},
+		func(page *ec2.DescribeInstancesOutput, last bool) bool {
+			for _, reservation := range page.Reservations {
+				for _, instance := range reservation.Instances {
+					instances[aws.StringValue(instance.InstanceId)] = instance
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []*autoscaling.Group
+	err = autoscaling.New(sess).DescribeAutoScalingGroupsPages(&autoscaling.DescribeAutoScalingGroupsInput{},
+		func(page *autoscaling.DescribeAutoScalingGroupsOutput, last bool) bool {
+			for _, group := range page.AutoScalingGroups {
+				for _, tag := range group.Tags {
+					if aws.StringValue(tag.Key) == c.Tag && (c.TagValue == "" || aws.StringValue(tag.Value) == c.TagValue) {
+						groups = append(groups, group)
+						break
+					}
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	// The instance types of groups are those of their instances
+	inGroups := make(map[string]bool)
+	var members []string
+	for _, group := range groups {
+		for _, instance := range group.Instances {
+			id := aws.StringValue(instance.InstanceId)
+			inGroups[id] = true
+			if _, ok := instances[id]; !ok {
+				members = append(members, id)
+			}
+		}
+	}
+	err = batches(members, func(ids []string) error {
+		return ec2Client.DescribeInstancesPages(&ec2.DescribeInstancesInput{InstanceIds: aws.StringSlice(ids)},
+			func(page *ec2.DescribeInstancesOutput, last bool) bool {
+				for _, reservation := range page.Reservations {
+					for _, instance := range reservation.Instances {
+						instances[aws.StringValue(instance.InstanceId)] = instance
+					}
+				}
+				return true
+			})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, group := range groups {
+		r := InventoryResource{Account: account, Region: region, Type: ResourceAutoScalingGroup, ID: aws.StringValue(group.AutoScalingGroupName), InstanceTypes: []string{}}
+		for _, member := range group.Instances {
+			instance, ok := instances[aws.StringValue(member.InstanceId)]
+			if !ok || aws.StringValue(instance.State.Name) != "running" {
+				continue
+			}
+			r.Running++
+			r.InstanceTypes = append(r.InstanceTypes, aws.StringValue(instance.InstanceType))
+		}
+		r.State = fmt.Sprintf("%d/%d running", r.Running, aws.Int64Value(group.DesiredCapacity))
+		resources = append(resources, r)
+	}
+
+	var ids []string
+	for id := range instances {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		instance := instances[id]
+		if inGroups[id] {
+			continue
+		}
+		r := InventoryResource{
+			Account:       account,
+			Region:        region,
+			Type:          ResourceInstance,
+			ID:            id,
+			State:         aws.StringValue(instance.State.Name),
+			InstanceTypes: []string{aws.StringValue(instance.InstanceType)},
+		}
+		if r.State == "running" {
+			r.Running = 1
+		}
+		for _, tag := range instance.Tags {
+			if aws.StringValue(tag.Key) == "Name" {
+				r.Name = aws.StringValue(tag.Value)
+			}
+		}
+		resources = append(resources, r)
+	}
+	log.Printf("Inventory of %s %s: %d resources", account, region, len(resources))
+	return resources, nil
+}
+
+// idleCost - the monthly cost of the running instances of a resource
+// outside the working hours
+func (c *InventoryConfig) idleCost(r InventoryResource) float64 {
+	if r.Running == 0 {
+		return 0
+	}
+	var hourly float64
+	if r.Type == ResourceInstance {
+		hourly = c.Prices[r.InstanceTypes[0]]
+	} else {
+		for _, instanceType := range r.InstanceTypes {
+			hourly += c.Prices[instanceType]
+		}
+	}
+	return hourly * c.idleHours()
+}
@@ -0,0 +1,587 @@
+package flywheel
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The service account of the pod flywheel runs in
+const kubeServiceAccount = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeconfig - the parts of a kubeconfig file flywheel uses
+type kubeconfig struct {
+	CurrentContext string `json:"current-context"`
+	Clusters       []struct {
+		Name    string      `json:"name"`
+		Cluster kubeCluster `json:"cluster"`
+	} `json:"clusters"`
+	Contexts []struct {
+		Name    string `json:"name"`
+		Context struct {
+			Cluster string `json:"cluster"`
+			User    string `json:"user"`
+		} `json:"context"`
+	} `json:"contexts"`
+	Users []struct {
+		Name string   `json:"name"`
+		User kubeUser `json:"user"`
+	} `json:"users"`
+}
+
+type kubeCluster struct {
+	Server   string `json:"server"`
+	CA       string `json:"certificate-authority"`
+	CAData   string `json:"certificate-authority-data"`
+	Insecure bool   `json:"insecure-skip-tls-verify"`
+}
+
+type kubeUser struct {
+	Token                 string    `json:"token"`
+	TokenFile             string    `json:"tokenFile"`
+	ClientCertificate     string    `json:"client-certificate"`
+	ClientCertificateData string    `json:"client-certificate-data"`
+	ClientKey             string    `json:"client-key"`
+	ClientKeyData         string    `json:"client-key-data"`
+	Exec                  *kubeExec `json:"exec"`
+}
+
+// kubeExec - a credential plugin, like aws eks get-token
+type kubeExec struct {
+	APIVersion string   `json:"apiVersion"`
+	Command    string   `json:"command"`
+	Args       []string `json:"args"`
+	Env        []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"env"`
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// kubeClient - calls the Kubernetes API, with the credentials of the
+// kubeconfig or of the pod's service account. They're loaded on first use,
+// so a broken kubeconfig shows as an error of the health check.
+type kubeClient struct {
+	kubeconfig string
+	context    string
+
+	once   sync.Once
+	err    error
+	server string
+	http   *http.Client
+	token  func() (string, error)
+}
+
+// newKubeClient - a client for the configured cluster, nil without workloads
+func newKubeClient(c *KubernetesConfig) *kubeClient {
+	if len(c.Workloads) == 0 {
+		return nil
+	}
+	return &kubeClient{kubeconfig: c.Kubeconfig, context: c.Context}
+}
+
+// load - read the kubeconfig, or the service account
+func (k *kubeClient) load() error {
+	k.once.Do(func() {
+		if k.kubeconfig == "" {
+			k.err = k.loadInCluster()
+		} else {
+			k.err = k.loadKubeconfig()
+		}
+		if k.err != nil {
+			k.err = fmt.Errorf("Unable to load the Kubernetes credentials: %v", k.err)
+		}
+	})
+	return k.err
+}
+
+// loadInCluster - the API server and token of the pod's service account.
+// The token is read for every call, as the kubelet rotates it.
+func (k *kubeClient) loadInCluster() error {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return fmt.Errorf("Not running in a cluster, configure a kubeconfig")
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(kubeServiceAccount, "ca.crt"))
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := kubeTLS(ca, false)
+	if err != nil {
+		return err
+	}
+	k.server = "https://" + net.JoinHostPort(host, port)
+	k.http = &http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	k.token = tokenFile(filepath.Join(kubeServiceAccount, "token"))
+	return nil
+}
+
+// loadKubeconfig - the cluster and user of the context
+func (k *kubeClient) loadKubeconfig() error {
+	buf, err := ioutil.ReadFile(k.kubeconfig)
+	if err != nil {
+		return err
+	}
+	config, err := parseKubeconfig(buf)
+	if err != nil {
+		return fmt.Errorf("%s: %v", k.kubeconfig, err)
+	}
+	name := k.context
+	if name == "" {
+		name = config.CurrentContext
+	}
+	var clusterName, userName string
+	found := false
+	for _, c := range config.Contexts {
+		if c.Name == name {
+			clusterName, userName, found = c.Context.Cluster, c.Context.User, true
+		}
+	}
+	if !found {
+		return fmt.Errorf("No context %q in %s", name, k.kubeconfig)
+	}
+	var cluster *kubeCluster
+	for i := range config.Clusters {
+		if config.Clusters[i].Name == clusterName {
+			cluster = &config.Clusters[i].Cluster
+		}
+	}
+	if cluster == nil || cluster.Server == "" {
+		return fmt.Errorf("No cluster %q in %s", clusterName, k.kubeconfig)
+	}
+	var user kubeUser
+	for _, u := range config.Users {
+		if u.Name == userName {
+			user = u.User
+		}
+	}
+
+	// Files are relative to the kubeconfig
+	dir := filepath.Dir(k.kubeconfig)
+	ca, err := fileOrData(dir, cluster.CA, cluster.CAData)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := kubeTLS(ca, cluster.Insecure)
+	if err != nil {
+		return err
+	}
+	cert, err := fileOrData(dir, user.ClientCertificate, user.ClientCertificateData)
+	if err != nil {
+		return err
+	}
+	if cert != nil {
+		key, err := fileOrData(dir, user.ClientKey, user.ClientKeyData)
+		if err != nil {
+			return err
+		}
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return err
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+
+	switch {
+	case user.Token != "":
+		token := user.Token
+		k.token = func() (string, error) { return token, nil }
+	case user.TokenFile != "":
+		k.token = tokenFile(resolvePath(dir, user.TokenFile))
+	case user.Exec != nil:
+		k.token = user.Exec.credential
+	}
+	k.server = strings.TrimSuffix(cluster.Server, "/")
+	k.http = &http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	return nil
+}
+
+// kubeTLS - trust the cluster's CA, the system's without one
+func kubeTLS(ca []byte, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if ca != nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("Invalid certificate authority")
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// fileOrData - the contents of the file, or the base64 encoded data. Nil if
+// neither is set.
+func fileOrData(dir, file, data string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if file != "" {
+		return ioutil.ReadFile(resolvePath(dir, file))
+	}
+	return nil, nil
+}
+
+// resolvePath - a path relative to dir, unless it's absolute
+func resolvePath(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// tokenFile - read the token from the file on every call
+func tokenFile(path string) func() (string, error) {
+	return func() (string, error) {
+		buf, err := ioutil.ReadFile(path)
+		return strings.TrimSpace(string(buf)), err
+	}
+}
+
+// credential - run the plugin for a token, kept until it expires
+func (e *kubeExec) credential() (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.token != "" && (e.expires.IsZero() || time.Now().Before(e.expires.Add(-time.Minute))) {
+		return e.token, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, e.Command, e.Args...)
+	info, _ := json.Marshal(map[string]interface{}{
+		"apiVersion": e.APIVersion,
+		"kind":       "ExecCredential",
+		"spec":       map[string]bool{"interactive": false},
+	})
+	cmd.Env = append(os.Environ(), "KUBERNETES_EXEC_INFO="+string(info))
+	for _, env := range e.Env {
+		cmd.Env = append(cmd.Env, env.Name+"="+env.Value)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Credential plugin %s failed: %v %s", e.Command, err, strings.TrimSpace(stderr.String()))
+	}
+	var cred struct {
+		Status struct {
+			Token               string    `json:"token"`
+			ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+		} `json:"status"`
+	}
+	if err = json.Unmarshal(out, &cred); err != nil || cred.Status.Token == "" {
+		return "", fmt.Errorf("Credential plugin %s returned no token", e.Command)
+	}
+	e.token, e.expires = cred.Status.Token, cred.Status.ExpirationTimestamp
+	return e.token, nil
+}
+
+// kubeError - an error status of the Kubernetes API
+type kubeError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *kubeError) Error() string {
+	return fmt.Sprintf("Kubernetes API %d: %s", e.StatusCode, e.Message)
+}
+
+// call - call the API, with the body as JSON, decoding the answer into out
+func (k *kubeClient) call(method, path, contentType string, body, out interface{}) error {
+	if err := k.load(); err != nil {
+		return err
+	}
+	var reader io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, k.server+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if k.token != nil {
+		token, err := k.token()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := k.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		// The API answers with a Status
+		var status struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(buf, &status) != nil || status.Message == "" {
+			status.Message = http.StatusText(resp.StatusCode)
+		}
+		return &kubeError{StatusCode: resp.StatusCode, Message: status.Message}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(buf, out)
+}
+
+// parseKubeconfig - read a kubeconfig, as JSON or YAML. Only the YAML
+// kubectl and the cloud CLIs write is understood: block mappings and
+// sequences of scalars, without anchors or multi-line strings.
+func parseKubeconfig(buf []byte) (*kubeconfig, error) {
+	var config kubeconfig
+	if trimmed := bytes.TrimSpace(buf); len(trimmed) > 0 && trimmed[0] == '{' {
+		err := json.Unmarshal(trimmed, &config)
+		return &config, err
+	}
+
+	var lines []yamlLine
+	for i, text := range strings.Split(string(buf), "\n") {
+		text = strings.TrimRight(text, " \t\r")
+		content := strings.TrimLeft(text, " ")
+		if content == "" || content[0] == '#' || content == "---" {
+			continue
+		}
+		if strings.HasPrefix(content, "\t") {
+			return nil, fmt.Errorf("line %d: tabs aren't allowed for indentation", i+1)
+		}
+		lines = append(lines, yamlLine{i + 1, len(text) - len(content), content})
+	}
+	if len(lines) == 0 {
+		return &config, nil
+	}
+	p := &yamlParser{lines: lines}
+	tree, err := p.node(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", lines[p.pos].number)
+	}
+	buf, err = json.Marshal(tree)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(buf, &config)
+	return &config, err
+}
+
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// node - the mapping or sequence at the indent
+func (p *yamlParser) node(indent int) (interface{}, error) {
+	if p.pos < len(p.lines) && isYAMLItem(p.lines[p.pos].text) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func isYAMLItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// sequence - items at the indent
+func (p *yamlParser) sequence(indent int) (interface{}, error) {
+	items := []interface{}{}
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isYAMLItem(p.lines[p.pos].text) {
+		line := &p.lines[p.pos]
+		rest := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+		if rest == "" {
+			// The item is on the following lines
+			p.pos++
+			if p.pos >= len(p.lines) || p.lines[p.pos].indent <= indent {
+				items = append(items, nil)
+				continue
+			}
+			item, err := p.node(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+			continue
+		}
+		if _, _, ok := yamlKey(rest); ok {
+			// A mapping starting on the item's line continues at the
+			// indent of its first key
+			line.indent += len(line.text) - len(rest)
+			line.text = rest
+			item, err := p.mapping(line.indent)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+			continue
+		}
+		value, err := yamlScalar(rest, line.number)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, value)
+		p.pos++
+	}
+	return items, nil
+}
+
+// mapping - keys at the indent
+func (p *yamlParser) mapping(indent int) (interface{}, error) {
+	values := map[string]interface{}{}
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent {
+		line := p.lines[p.pos]
+		key, rest, ok := yamlKey(line.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected a key", line.number)
+		}
+		p.pos++
+		if rest != "" {
+			value, err := yamlScalar(rest, line.number)
+			if err != nil {
+				return nil, err
+			}
+			values[key] = value
+			continue
+		}
+		// Sequences may be at the indent of their key
+		next := p.pos < len(p.lines)
+		switch {
+		case next && p.lines[p.pos].indent > indent:
+			value, err := p.node(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			values[key] = value
+		case next && p.lines[p.pos].indent == indent && isYAMLItem(p.lines[p.pos].text):
+			value, err := p.sequence(indent)
+			if err != nil {
+				return nil, err
+			}
+			values[key] = value
+		default:
+			values[key] = nil
+		}
+	}
+	return values, nil
+}
+
+// yamlKey - the key of a mapping line, and the rest of it
+func yamlKey(text string) (string, string, bool) {
+	if text[0] == '"' || text[0] == '\'' {
+		end := strings.IndexByte(text[1:], text[0])
+		if end < 0 || !strings.HasPrefix(text[end+2:], ":") {
+			return "", "", false
+		}
+		key, err := yamlScalar(text[:end+2], 0)
+		if err != nil {
+			return "", "", false
+		}
+		return fmt.Sprint(key), strings.TrimSpace(text[end+3:]), true
+	}
+	i := strings.Index(text, ": ")
+	if i < 0 {
+		if !strings.HasSuffix(text, ":") {
+			return "", "", false
+		}
+		i = len(text) - 1
+	}
+	return text[:i], strings.TrimSpace(text[i+1:]), true
+}
+
+// yamlScalar - a quoted or plain scalar, or a flow sequence of them
+func yamlScalar(text string, number int) (interface{}, error) {
+	switch {
+	case text[0] == '"':
+		end := strings.LastIndexByte(text, '"')
+		if end == 0 {
+			return nil, fmt.Errorf("line %d: unterminated string", number)
+		}
+		s, err := strconv.Unquote(text[:end+1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", number, err)
+		}
+		return s, nil
+	case text[0] == '\'':
+		end := strings.LastIndexByte(text, '\'')
+		if end == 0 {
+			return nil, fmt.Errorf("line %d: unterminated string", number)
+		}
+		return strings.Replace(text[1:end], "''", "'", -1), nil
+	case text[0] == '|' || text[0] == '>':
+		return nil, fmt.Errorf("line %d: multi-line strings aren't supported", number)
+	case text[0] == '&' || text[0] == '*':
+		return nil, fmt.Errorf("line %d: anchors aren't supported", number)
+	case text[0] == '{':
+		if strings.TrimSpace(text) != "{}" {
+			return nil, fmt.Errorf("line %d: flow mappings aren't supported", number)
+		}
+		return map[string]interface{}{}, nil
+	case text[0] == '[':
+		end := strings.LastIndexByte(text, ']')
+		if end < 0 {
+			return nil, fmt.Errorf("line %d: unterminated sequence", number)
+		}
+		items := []interface{}{}
+		for _, item := range strings.Split(text[1:end], ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			value, err := yamlScalar(item, number)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, value)
+		}
+		return items, nil
+	}
+	if i := strings.Index(text, " #"); i >= 0 {
+		text = strings.TrimSpace(text[:i])
+	}
+	switch text {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null", "~":
+		return nil, nil
+	}
+	return text, nil
+}
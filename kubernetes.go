@@ -0,0 +1,194 @@
+package flywheel
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Kubernetes resource types
+const (
+	ResourceDeployment  = "deployment"
+	ResourceStatefulSet = "statefulset"
+)
+
+// KubernetesConfig - Deployments and StatefulSets scaled to zero replicas
+// when powered down, and back when started
+type KubernetesConfig struct {
+	// Kubeconfig file, default the service account of the pod flywheel
+	// runs in
+	Kubeconfig string `json:"kubeconfig"`
+
+	// Context of the kubeconfig, default its current-context
+	Context string `json:"context"`
+
+	Workloads []KubernetesWorkload `json:"workloads"`
+}
+
+// KubernetesWorkload - a Deployment or StatefulSet
+type KubernetesWorkload struct {
+	// deployment (default) or statefulset
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+
+	// Replicas restored when started
+	Replicas int64 `json:"replicas"`
+}
+
+// ID - namespace/name, as in observe-only and the status
+func (w *KubernetesWorkload) ID() string {
+	return w.Namespace + "/" + w.Name
+}
+
+// describe - how the workload is named in logs and errors
+func (w *KubernetesWorkload) describe() string {
+	return "Kubernetes " + w.Kind + " " + w.ID()
+}
+
+// path - the API path of the workload
+func (w *KubernetesWorkload) path() string {
+	return fmt.Sprintf("/apis/apps/v1/namespaces/%s/%ss/%s", url.PathEscape(w.Namespace), w.Kind, url.PathEscape(w.Name))
+}
+
+// Validate - check each workload is configured once, with replicas to
+// restore, and fill in the defaults
+func (c *KubernetesConfig) Validate() error {
+	seen := make(map[string]bool)
+	for i := range c.Workloads {
+		w := &c.Workloads[i]
+		if w.Kind == "" {
+			w.Kind = ResourceDeployment
+		}
+		w.Kind = strings.ToLower(w.Kind)
+		if w.Kind != ResourceDeployment && w.Kind != ResourceStatefulSet {
+			return fmt.Errorf("Unknown Kubernetes workload kind %q, expected deployment or statefulset", w.Kind)
+		}
+		if w.Namespace == "" {
+			w.Namespace = "default"
+		}
+		if w.Name == "" {
+			return fmt.Errorf("Kubernetes workload %d has no name", i)
+		}
+		if w.Replicas <= 0 {
+			return fmt.Errorf("%s needs replicas above 0", w.describe())
+		}
+		if seen[w.ID()] {
+			return fmt.Errorf("Kubernetes workload %s configured more than once", w.ID())
+		}
+		seen[w.ID()] = true
+	}
+	return nil
+}
+
+// configured - true if the name is a configured workload
+func (c *KubernetesConfig) configured(name string) bool {
+	for i := range c.Workloads {
+		if c.Workloads[i].ID() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// kubeWorkload - the replicas of a Deployment or StatefulSet
+type kubeWorkload struct {
+	Spec struct {
+		Replicas *int64 `json:"replicas"`
+	} `json:"spec"`
+	Status struct {
+		Replicas      int64 `json:"replicas"`
+		ReadyReplicas int64 `json:"readyReplicas"`
+	} `json:"status"`
+}
+
+// desired - the replicas of the spec, which defaults to 1
+func (w *kubeWorkload) desired() int64 {
+	if w.Spec.Replicas == nil {
+		return 1
+	}
+	return *w.Spec.Replicas
+}
+
+// kubeState - the state of the workload, as the health check counts them.
+// Pods that are still starting or terminating keep the environment STARTING
+// or STOPPING.
+func kubeState(w *kubeWorkload) string {
+	desired := w.desired()
+	switch {
+	case desired == 0 && w.Status.Replicas == 0:
+		return "stopped"
+	case desired == 0:
+		return "stopping"
+	case w.Status.ReadyReplicas >= desired:
+		return "running"
+	}
+	return "pending"
+}
+
+// scaleKubernetes - set the replicas of the workloads, zero to stop them
+func (fw *Flywheel) scaleKubernetes(start bool) error {
+	for i := range fw.config.Kubernetes.Workloads {
+		w := &fw.config.Kubernetes.Workloads[i]
+		if fw.config.Observed(w.ID()) {
+			continue
+		}
+		replicas := int64(0)
+		if start {
+			replicas = w.Replicas
+			fw.logf("Starting %s with %d replicas", w.describe(), replicas)
+		} else {
+			fw.logf("Stopping %s", w.describe())
+		}
+		patch := map[string]interface{}{"spec": map[string]int64{"replicas": replicas}}
+		if err := fw.kube.call("PATCH", w.path()+"/scale", "application/merge-patch+json", patch, nil); err != nil {
+			err = fmt.Errorf("Unable to scale %s: %v", w.describe(), err)
+			fw.resources.fail(w.Kind, w.ID(), err, fw.now())
+			return err
+		}
+	}
+	return nil
+}
+
+// startKubernetes - scale the workloads back up
+func (fw *Flywheel) startKubernetes() error {
+	return fw.scaleKubernetes(true)
+}
+
+// stopKubernetes - scale the workloads to zero
+func (fw *Flywheel) stopKubernetes() error {
+	return fw.scaleKubernetes(false)
+}
+
+// checkKubernetes - add the states of the workloads to the health. A
+// workload is only running once as many replicas are ready as it desires.
+// One that is missing makes the environment UNHEALTHY.
+func (fw *Flywheel) checkKubernetes(health *healthStates) error {
+	now := fw.now()
+	var problems []string
+	for i := range fw.config.Kubernetes.Workloads {
+		w := &fw.config.Kubernetes.Workloads[i]
+		var described kubeWorkload
+		err := fw.kube.call("GET", w.path(), "", nil, &described)
+		if kerr, ok := err.(*kubeError); ok && kerr.StatusCode == http.StatusNotFound {
+			fw.resources.set(w.Kind, w.ID(), "not-found", nil, now)
+			problems = append(problems, fmt.Sprintf("%s not found", w.describe()))
+			continue
+		}
+		if err != nil {
+			fw.resources.set(w.Kind, w.ID(), "unknown", err, now)
+			return err
+		}
+		state := kubeState(&described)
+		fw.resources.set(w.Kind, w.ID(), fmt.Sprintf("%s: %d/%d ready", state, described.Status.ReadyReplicas, described.desired()), nil, now)
+		if state == "running" && fw.config.Observed(w.ID()) {
+			state = runningUncontrolled
+		}
+		health.add(w.ID(), state, 1)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, ", "))
+	}
+	return nil
+}
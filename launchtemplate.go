@@ -0,0 +1,192 @@
+package flywheel
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// Notification event for launch template drift
+const NotifyDrift = "drift"
+
+type describeGroupTemplatesInput struct {
+	_ struct{} `type:"structure"`
+
+	AutoScalingGroupNames []*string `type:"list"`
+}
+
+type describeGroupTemplatesOutput struct {
+	_ struct{} `type:"structure"`
+
+	AutoScalingGroups []*groupTemplate `type:"list"`
+}
+
+type groupTemplate struct {
+	_ struct{} `type:"structure"`
+
+	AutoScalingGroupName *string                      `type:"string"`
+	LaunchTemplate       *launchTemplateSpecification `type:"structure"`
+}
+
+type launchTemplateSpecification struct {
+	_ struct{} `type:"structure"`
+
+	LaunchTemplateId   *string `type:"string"`
+	LaunchTemplateName *string `type:"string"`
+	Version            *string `type:"string"`
+}
+
+type describeLaunchTemplatesInput struct {
+	_ struct{} `type:"structure"`
+
+	LaunchTemplateIds []*string `locationName:"LaunchTemplateId" type:"list" flattened:"true"`
+}
+
+type describeLaunchTemplatesOutput struct {
+	_ struct{} `type:"structure"`
+
+	LaunchTemplates []*launchTemplate `locationName:"launchTemplates" locationNameList:"item" type:"list"`
+}
+
+type launchTemplate struct {
+	_ struct{} `type:"structure"`
+
+	DefaultVersionNumber *int64 `locationName:"defaultVersionNumber" type:"long"`
+	LatestVersionNumber  *int64 `locationName:"latestVersionNumber" type:"long"`
+}
+
+type updateGroupTemplateInput struct {
+	_ struct{} `type:"structure"`
+
+	AutoScalingGroupName *string                      `type:"string"`
+	LaunchTemplate       *launchTemplateSpecification `type:"structure"`
+}
+
+// groupLaunchTemplates - the launch template, and the version it resolves
+// to, for each group. Groups using launch configurations are left out.
+func (fw *Flywheel) groupLaunchTemplates(groupNames []string) (map[string]*launchTemplateSpecification, map[string]string, error) {
+	var resp describeGroupTemplatesOutput
+	err := awsCall(fw.autoscaling.Client, "DescribeAutoScalingGroups", &describeGroupTemplatesInput{
+		AutoScalingGroupNames: aws.StringSlice(groupNames),
+	}, &resp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	templates := make(map[string]*launchTemplateSpecification)
+	versions := make(map[string]string)
+	for _, group := range resp.AutoScalingGroups {
+		spec := group.LaunchTemplate
+		if spec == nil || spec.LaunchTemplateId == nil {
+			continue
+		}
+		version, err := fw.resolveTemplateVersion(spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		name := aws.StringValue(group.AutoScalingGroupName)
+		templates[name] = spec
+		versions[name] = version
+	}
+	return templates, versions, nil
+}
+
+// resolveTemplateVersion - turn $Latest and $Default into a version number
+func (fw *Flywheel) resolveTemplateVersion(spec *launchTemplateSpecification) (string, error) {
+	version := aws.StringValue(spec.Version)
+	if version != "" && version != "$Latest" && version != "$Default" {
+		return version, nil
+	}
+
+	var resp describeLaunchTemplatesOutput
+	err := awsCall(fw.ec2.Client, "DescribeLaunchTemplates", &describeLaunchTemplatesInput{
+		LaunchTemplateIds: []*string{spec.LaunchTemplateId},
+	}, &resp)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.LaunchTemplates) == 0 {
+		return "", fmt.Errorf("Launch template %s not found", aws.StringValue(spec.LaunchTemplateId))
+	}
+
+	number := resp.LaunchTemplates[0].LatestVersionNumber
+	if version == "$Default" || version == "" {
+		number = resp.LaunchTemplates[0].DefaultVersionNumber
+	}
+	return strconv.FormatInt(aws.Int64Value(number), 10), nil
+}
+
+// recordLaunchTemplates - remember which launch template version each
+// terminated group launches, so drift can be detected when restoring it
+func (fw *Flywheel) recordLaunchTemplates() {
+	groupNames := fw.terminateGroupNames()
+	if len(groupNames) == 0 {
+		return
+	}
+	_, versions, err := fw.groupLaunchTemplates(groupNames)
+	if err != nil {
+		fw.logf("Unable to record launch template versions: %v", err)
+		return
+	}
+	fw.launchTemplates = versions
+}
+
+// checkLaunchTemplates - before restoring terminated groups, compare their
+// launch template versions with the ones recorded at stop time. Drifted
+// groups are pinned back to the recorded version if configured.
+func (fw *Flywheel) checkLaunchTemplates() error {
+	if len(fw.launchTemplates) == 0 {
+		return nil
+	}
+	templates, versions, err := fw.groupLaunchTemplates(fw.terminateGroupNames())
+	if err != nil {
+		fw.logf("Unable to check launch template versions: %v", err)
+		return nil
+	}
+
+	for groupName, recorded := range fw.launchTemplates {
+		current, ok := versions[groupName]
+		if !ok || current == recorded {
+			continue
+		}
+
+		if !fw.config.AutoScaling.PinLaunchTemplates {
+			fw.warn(NotifyDrift, "Autoscaling group %s will launch template version %s, but version %s was in use when it was stopped",
+				groupName, current, recorded)
+			continue
+		}
+
+		spec := templates[groupName]
+		err = awsCall(fw.autoscaling.Client, "UpdateAutoScalingGroup", &updateGroupTemplateInput{
+			AutoScalingGroupName: aws.String(groupName),
+			LaunchTemplate: &launchTemplateSpecification{
+				LaunchTemplateId: spec.LaunchTemplateId,
+				Version:          aws.String(recorded),
+			},
+		}, nil)
+		if err != nil {
+			return err
+		}
+		fw.warn(NotifyDrift, "Autoscaling group %s pinned to launch template version %s, as in use when it was stopped (it would have launched version %s)",
+			groupName, recorded, current)
+	}
+	return nil
+}
+
+func (fw *Flywheel) terminateGroupNames() []string {
+	var groupNames []string
+	for groupName := range fw.config.AutoScaling.TerminateGroups() {
+		if fw.config.Observed(groupName) {
+			continue
+		}
+		groupNames = append(groupNames, groupName)
+	}
+	return groupNames
+}
+
+// warn - add a warning to the status and send it as a notification
+func (fw *Flywheel) warn(event, format string, args ...interface{}) {
+	fw.warnings = append(fw.warnings, fmt.Sprintf(format, args...))
+	fw.notify(event, format, args...)
+}
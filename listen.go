@@ -0,0 +1,110 @@
+package flywheel
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ListenConfig - the addresses the proxy listens on, for dual-stack or
+// IPv6-only hosts. The -listen flag overrides them.
+type ListenConfig struct {
+	// Addresses as host:port. An IPv4 host only listens on IPv4, an IPv6
+	// host only on IPv6, and no host, e.g. ":80", on both.
+	Addresses []string `json:"addresses"`
+
+	// Addresses without a host only listen on IPv6
+	IPv6Only bool `json:"ipv6-only"`
+}
+
+// Validate - check the addresses
+func (c *ListenConfig) Validate() error {
+	for _, addr := range c.Addresses {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("Invalid listen address %s: %v", addr, err)
+		}
+		if c.IPv6Only && host != "" {
+			if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+				return fmt.Errorf("Listen address %s is IPv4, but ipv6-only is set", addr)
+			}
+		}
+	}
+	return nil
+}
+
+// listenNetwork - the network to listen on an address with. Go listens on
+// both IPv4 and IPv6 for "tcp" without a host, and sets IPV6_V6ONLY for
+// "tcp6", so an IPv4 and an IPv6 address can share a port.
+func listenNetwork(addr string, ipv6Only bool) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "tcp"
+	}
+	if host == "" {
+		if ipv6Only {
+			return "tcp6"
+		}
+		return "tcp"
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		// A hostname, whatever it resolves to
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
+}
+
+// Listen - open a listener for each address. The ones already opened are
+// closed if one fails.
+func Listen(addresses []string, ipv6Only bool) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, addr := range addresses {
+		l, err := net.Listen(listenNetwork(addr, ipv6Only), addr)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// clientIP - the IP of a client address, without the port or zone, and
+// IPv4-mapped IPv6 addresses as plain IPv4, so a client is known by the same
+// name whichever socket it connected to
+func clientIP(addr string) string {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return ip.String()
+}
+
+// clientNetwork - the client's IPv6 network of the prefix length, since a
+// single IPv6 client often uses many addresses of its network. IPv4 clients
+// and names are returned as they are.
+func clientNetwork(client string, prefix int) string {
+	ip := net.ParseIP(client)
+	if ip == nil || ip.To4() != nil || prefix <= 0 || prefix >= 128 {
+		return client
+	}
+	network := net.IPNet{IP: ip.Mask(net.CIDRMask(prefix, 128)), Mask: net.CIDRMask(prefix, 128)}
+	return network.String()
+}
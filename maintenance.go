@@ -0,0 +1,214 @@
+package flywheel
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// NotifyMaintenance - AWS scheduled maintenance or a retirement for an
+// instance, or its migration
+const NotifyMaintenance = "maintenance"
+
+// MaintenanceConfig - watch the EC2 scheduled events of the instances, such
+// as retirements of instances on degraded hardware
+type MaintenanceConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// How often the events are checked, default 1h
+	Interval Duration `json:"interval"`
+
+	// Stop and start instances with an event that a stop and start moves
+	// off the hardware, while the window lasts. Only the instances of
+	// instances are migrated, autoscaling groups replace their own.
+	Migrate bool        `json:"migrate"`
+	Window  ClockWindow `json:"window"`
+}
+
+// Validate - check the window, and fill in the defaults
+func (c *MaintenanceConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Interval <= 0 {
+		c.Interval = Duration(time.Hour)
+	}
+	if c.Migrate {
+		if c.Window.From == "" || c.Window.To == "" {
+			return fmt.Errorf("Maintenance migrations need a window")
+		}
+		return c.Window.Validate()
+	}
+	return nil
+}
+
+// MaintenanceEvent - an upcoming EC2 scheduled event of an instance
+type MaintenanceEvent struct {
+	InstanceID  string    `json:"instance-id"`
+	Group       string    `json:"group,omitempty"`
+	Code        string    `json:"code"`
+	Description string    `json:"description"`
+	NotBefore   time.Time `json:"not-before"`
+	NotAfter    time.Time `json:"not-after,omitempty"`
+}
+
+// key - what identifies the event, for notifying it once
+func (e MaintenanceEvent) key() string {
+	return e.InstanceID + ":" + e.Code + ":" + e.NotBefore.Format(time.RFC3339)
+}
+
+// migratable - true if a stop and start moves the instance off the
+// hardware the event is for. Reboots and other events stay.
+func (e MaintenanceEvent) migratable() bool {
+	switch e.Code {
+	case "instance-retirement", "instance-stop", "system-maintenance", "system-reboot":
+		return true
+	}
+	return false
+}
+
+// maintenanceCheck - the events found, and the migrations done, by a check
+// in the health check goroutine
+type maintenanceCheck struct {
+	events   []MaintenanceEvent
+	migrated []string
+	failed   map[string]error
+}
+
+// checkMaintenance - describe the scheduled events of the instances when
+// due, and migrate those that may be. Nil when not due. This runs in the
+// health check goroutine.
+func (fw *Flywheel) checkMaintenance(d *described) *maintenanceCheck {
+	c := &fw.config.Maintenance
+	now := fw.now()
+	if !c.Enabled || d == nil || now.Before(fw.maintenanceDue) {
+		return nil
+	}
+	events, err := fw.describeMaintenance(d)
+	if err != nil {
+		fw.logf("Unable to check scheduled events: %v", err)
+		fw.maintenanceDue = now.Add(time.Duration(c.Interval) / 4)
+		return nil
+	}
+	fw.maintenanceDue = now.Add(time.Duration(c.Interval))
+	check := &maintenanceCheck{events: events}
+
+	if !c.Migrate || !c.Window.Contains(now) || fw.Snapshot().Status != STARTED || fw.Snapshot().ReadOnly {
+		return check
+	}
+	for _, event := range events {
+		id := event.InstanceID
+		if !event.migratable() || !contains(fw.config.Instances, id) || fw.config.uncontrolled(id) || contains(check.migrated, id) {
+			continue
+		}
+		if err := fw.migrateInstance(id); err != nil {
+			fw.logf("Unable to migrate %s: %v", id, err)
+			if check.failed == nil {
+				check.failed = make(map[string]error)
+			}
+			check.failed[id] = err
+			continue
+		}
+		check.migrated = append(check.migrated, id)
+	}
+	if len(check.migrated) > 0 {
+		// Events of migrated instances are gone, or moved
+		fw.maintenanceDue = now
+	}
+	return check
+}
+
+// describeMaintenance - the upcoming scheduled events of the described
+// instances
+func (fw *Flywheel) describeMaintenance(d *described) ([]MaintenanceEvent, error) {
+	groups := make(map[string]string)
+	for name, group := range d.groups {
+		for _, instance := range group.Instances {
+			groups[aws.StringValue(instance.InstanceId)] = name
+		}
+	}
+	var ids []string
+	for id := range d.instances {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var events []MaintenanceEvent
+	err := batches(ids, func(ids []string) error {
+		return fw.ec2.DescribeInstanceStatusPages(
+			&ec2.DescribeInstanceStatusInput{
+				InstanceIds:         aws.StringSlice(ids),
+				IncludeAllInstances: aws.Bool(true),
+			},
+			func(page *ec2.DescribeInstanceStatusOutput, last bool) bool {
+				for _, status := range page.InstanceStatuses {
+					id := aws.StringValue(status.InstanceId)
+					for _, event := range status.Events {
+						description := aws.StringValue(event.Description)
+						// Past events stay listed for a while
+						if strings.HasPrefix(description, "[Completed]") || strings.HasPrefix(description, "[Canceled]") {
+							continue
+						}
+						events = append(events, MaintenanceEvent{
+							InstanceID:  id,
+							Group:       groups[id],
+							Code:        aws.StringValue(event.Code),
+							Description: description,
+							NotBefore:   aws.TimeValue(event.NotBefore),
+							NotAfter:    aws.TimeValue(event.NotAfter),
+						})
+					}
+				}
+				return true
+			},
+		)
+	})
+	return events, err
+}
+
+// migrateInstance - stop and start the instance, which moves it to other
+// hardware
+func (fw *Flywheel) migrateInstance(id string) error {
+	fw.logf("Migrating %s off hardware with scheduled maintenance", id)
+	if _, err := fw.ec2.StopInstances(&ec2.StopInstancesInput{InstanceIds: aws.StringSlice([]string{id})}); err != nil {
+		return err
+	}
+	input := &ec2.DescribeInstancesInput{InstanceIds: aws.StringSlice([]string{id})}
+	if err := fw.ec2.WaitUntilInstanceStopped(input); err != nil {
+		return err
+	}
+	if _, err := fw.ec2.StartInstances(&ec2.StartInstancesInput{InstanceIds: aws.StringSlice([]string{id})}); err != nil {
+		return err
+	}
+	return fw.ec2.WaitUntilInstanceRunning(input)
+}
+
+// applyMaintenance - publish the events, and notify new ones and the
+// migrations. This runs in the flywheel goroutine.
+func (fw *Flywheel) applyMaintenance(check *maintenanceCheck) {
+	if check == nil {
+		return
+	}
+	known := make(map[string]bool)
+	for _, event := range fw.maintenance {
+		known[event.key()] = true
+	}
+	for _, event := range check.events {
+		if known[event.key()] {
+			continue
+		}
+		fw.notify(NotifyMaintenance, "Instance %s has %s scheduled from %s: %s",
+			event.InstanceID, event.Code, event.NotBefore.Format(time.RFC1123), event.Description)
+	}
+	for _, id := range check.migrated {
+		fw.notify(NotifyMaintenance, "Instance %s was stopped and started to move it off hardware with scheduled maintenance", id)
+	}
+	for id, err := range check.failed {
+		fw.notify(NotifyMaintenance, "Unable to migrate instance %s off hardware with scheduled maintenance: %v", id, err)
+	}
+	fw.maintenance = check.events
+}
@@ -0,0 +1,381 @@
+package flywheel
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Middleware types
+const (
+	MiddlewareIPAllowlist = "ip-allowlist"
+	MiddlewareBasicAuth   = "basic-auth"
+	MiddlewareOIDC        = "oidc"
+	MiddlewareRateLimit   = "rate-limit"
+	MiddlewareHook        = "hook"
+)
+
+// ExecAuthorize - the action an auth hook command is run with
+const ExecAuthorize = "authorize"
+
+// MiddlewareConfig - checks requests go through before they are served, in
+// order. The proxy chain applies to the proxied sites and flywheel's pages
+// and controls on them, the api chain to the API. Readiness signals, wake
+// hooks and the OIDC callback have their own checks and skip the chains.
+type MiddlewareConfig struct {
+	Proxy []Middleware `json:"proxy"`
+	API   []Middleware `json:"api"`
+}
+
+// Middleware - one check of a chain
+type Middleware struct {
+	// ip-allowlist, basic-auth, oidc, rate-limit or hook
+	Type string `json:"type"`
+
+	// ip-allowlist: addresses and CIDR ranges of the clients allowed
+	Allow []string `json:"allow"`
+
+	// basic-auth: the password of each user
+	Users map[string]Secret `json:"users"`
+	Realm string            `json:"realm"`
+
+	// oidc: the provider, and the client registered with it
+	Issuer         string   `json:"issuer"`
+	ClientID       string   `json:"client-id"`
+	ClientSecret   Secret   `json:"client-secret"`
+	RedirectURL    string   `json:"redirect-url"`
+	AllowedDomains []string `json:"allowed-domains"`
+
+	// rate-limit: requests per second per client, and at once
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+
+	// hook: a command or an endpoint asked with an AuthHookRequest, as for
+	// exec resources. Default timeout 5s.
+	Command []string          `json:"command"`
+	URL     string            `json:"url"`
+	Headers map[string]Secret `json:"headers"`
+	Timeout Duration          `json:"timeout"`
+
+	networks []*net.IPNet
+	limiter  *rateLimiter
+	oidc     *oidcProvider
+	hook     *ExecResource
+}
+
+// AuthHookRequest - what an auth hook is asked about
+type AuthHookRequest struct {
+	Action string `json:"action"`
+	Method string `json:"method"`
+	Host   string `json:"host"`
+	Path   string `json:"path"`
+	Client string `json:"client"`
+
+	// The Authorization and Cookie headers, if any
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// AuthHookResponse - the answer of an auth hook. The user, if any, is
+// passed on as X-Forwarded-User.
+type AuthHookResponse struct {
+	Allow   bool   `json:"allow"`
+	User    string `json:"user,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// Validate - check each middleware of both chains
+func (c *MiddlewareConfig) Validate() error {
+	for _, chain := range [][]Middleware{c.Proxy, c.API} {
+		for i := range chain {
+			if err := chain[i].Validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Validate - check the settings of the type, and fill in the defaults
+func (m *Middleware) Validate() error {
+	m.Type = strings.Replace(strings.ToLower(m.Type), "_", "-", -1)
+	switch m.Type {
+	case MiddlewareIPAllowlist:
+		if len(m.Allow) == 0 {
+			return fmt.Errorf("ip-allowlist middleware needs addresses to allow")
+		}
+		m.networks = nil
+		for _, allow := range m.Allow {
+			network, err := parseNetwork(allow)
+			if err != nil {
+				return err
+			}
+			m.networks = append(m.networks, network)
+		}
+	case MiddlewareBasicAuth:
+		if len(m.Users) == 0 {
+			return fmt.Errorf("basic-auth middleware needs users")
+		}
+		if m.Realm == "" {
+			m.Realm = "flywheel"
+		}
+	case MiddlewareOIDC:
+		if m.Issuer == "" || m.ClientID == "" || m.ClientSecret == "" || m.RedirectURL == "" {
+			return fmt.Errorf("oidc middleware needs an issuer, client-id, client-secret and redirect-url")
+		}
+		if !strings.HasSuffix(m.RedirectURL, OIDCCallbackPath) {
+			return fmt.Errorf("oidc middleware redirect-url must end with %s", OIDCCallbackPath)
+		}
+		for i, domain := range m.AllowedDomains {
+			m.AllowedDomains[i] = strings.ToLower(domain)
+		}
+		m.oidc = &oidcProvider{}
+	case MiddlewareRateLimit:
+		if m.Rate <= 0 {
+			return fmt.Errorf("rate-limit middleware needs a rate above 0")
+		}
+		if m.Burst < 0 {
+			return fmt.Errorf("rate-limit middleware burst can't be negative")
+		}
+		if m.Burst == 0 {
+			m.Burst = int(math.Max(1, math.Ceil(m.Rate)))
+		}
+		m.limiter = &rateLimiter{}
+	case MiddlewareHook:
+		if (len(m.Command) == 0) == (m.URL == "") {
+			return fmt.Errorf("hook middleware needs a command or a url")
+		}
+		if m.Timeout <= 0 {
+			m.Timeout = Duration(5 * time.Second)
+		}
+		m.hook = &ExecResource{Name: "auth hook", Command: m.Command, URL: m.URL, Headers: m.Headers, Timeout: m.Timeout}
+	default:
+		return fmt.Errorf("Unknown middleware type %q", m.Type)
+	}
+	return nil
+}
+
+// parseNetwork - a CIDR range, or a single address
+func parseNetwork(value string) (*net.IPNet, error) {
+	if _, network, err := net.ParseCIDR(value); err == nil {
+		return network, nil
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid address or CIDR range %q", value)
+	}
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// inNetworks - true if the client address is in one of the networks
+func inNetworks(networks []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(clientIP(addr))
+	for _, network := range networks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticates - true for the middlewares that identify the user
+func (m *Middleware) authenticates() bool {
+	return m.Type == MiddlewareBasicAuth || m.Type == MiddlewareOIDC || m.Type == MiddlewareHook
+}
+
+// oidcMiddleware - the first oidc middleware of the chains, which the
+// callback belongs to
+func (c *MiddlewareConfig) oidcMiddleware() *Middleware {
+	for _, chain := range [][]Middleware{c.Proxy, c.API} {
+		for i := range chain {
+			if chain[i].Type == MiddlewareOIDC {
+				return &chain[i]
+			}
+		}
+	}
+	return nil
+}
+
+// guard - run the request through the chain it belongs to. Returns false
+// if a middleware answered it instead.
+func (handler *Handler) guard(w http.ResponseWriter, r *http.Request) bool {
+	c := &handler.Flywheel.config.Middleware
+	chain := c.Proxy
+	switch {
+	case r.URL.Path == OIDCCallbackPath, strings.HasPrefix(r.URL.Path, WakeHookPrefix):
+		return true
+	case strings.HasPrefix(r.URL.Path, APIPrefix):
+		path := strings.TrimPrefix(r.URL.Path, APIPrefix)
+		if strings.TrimPrefix(path, APIVersion+"/") == "ready" {
+			return true
+		}
+		chain = c.API
+	}
+	if len(chain) == 0 {
+		return true
+	}
+
+	// Only the chain says who the user is, if it can
+	for i := range chain {
+		if chain[i].authenticates() {
+			r.Header.Del("X-Forwarded-User")
+			break
+		}
+	}
+	// Browsers ask before cross-origin API calls, without credentials
+	preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+	authenticated := false
+	for i := range chain {
+		m := &chain[i]
+		if preflight && m.authenticates() {
+			continue
+		}
+		if !m.serve(handler, w, r, authenticated) {
+			return false
+		}
+		authenticated = authenticated || m.authenticates()
+	}
+	return true
+}
+
+// serve - check the request, writing a response if it's refused. An earlier
+// middleware of the chain may have identified the user.
+func (m *Middleware) serve(handler *Handler, w http.ResponseWriter, r *http.Request, authenticated bool) bool {
+	switch m.Type {
+	case MiddlewareIPAllowlist:
+		if inNetworks(m.networks, r.RemoteAddr) {
+			return true
+		}
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+
+	case MiddlewareBasicAuth:
+		user, password, ok := r.BasicAuth()
+		if expected, known := m.Users[user]; ok && known && subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1 {
+			r.Header.Set("X-Forwarded-User", user)
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", m.Realm))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+
+	case MiddlewareOIDC:
+		return m.serveOIDC(handler, w, r)
+
+	case MiddlewareRateLimit:
+		// By the user an earlier middleware or a trusted proxy identified,
+		// never one the client claims to be
+		client := clientNetwork(clientIP(r.RemoteAddr), 64)
+		if user := r.Header.Get("X-Forwarded-User"); user != "" && (authenticated || handler.Flywheel.config.trustsProxy(r)) {
+			client = user
+		}
+		ok, wait := m.limiter.allow(client, m.Rate, m.Burst, handler.Flywheel.now())
+		if ok {
+			return true
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Too many requests. Please retry shortly.", http.StatusTooManyRequests)
+		return false
+
+	case MiddlewareHook:
+		resp, err := m.askHook(r)
+		if err != nil {
+			handler.Flywheel.logf("%v", err)
+		}
+		if err != nil || !resp.Allow {
+			message := resp.Message
+			if message == "" {
+				message = "Forbidden"
+			}
+			http.Error(w, message, http.StatusForbidden)
+			return false
+		}
+		if resp.User != "" {
+			r.Header.Set("X-Forwarded-User", resp.User)
+		}
+		return true
+	}
+	return true
+}
+
+// askHook - ask the hook whether the request is allowed
+func (m *Middleware) askHook(r *http.Request) (AuthHookResponse, error) {
+	var resp AuthHookResponse
+	hr := AuthHookRequest{
+		Action: ExecAuthorize,
+		Method: r.Method,
+		Host:   r.Host,
+		Path:   r.URL.RequestURI(),
+		Client: clientIP(r.RemoteAddr),
+	}
+	for _, name := range []string{"Authorization", "Cookie"} {
+		if value := r.Header.Get(name); value != "" {
+			if hr.Headers == nil {
+				hr.Headers = make(map[string]string)
+			}
+			hr.Headers[name] = value
+		}
+	}
+	req, err := json.Marshal(hr)
+	if err != nil {
+		return resp, err
+	}
+	out, err := m.hook.invoke(ExecAuthorize, req)
+	if err != nil {
+		return resp, fmt.Errorf("Auth hook failed: %v", err)
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return resp, fmt.Errorf("Auth hook answered with invalid JSON: %v", err)
+	}
+	return resp, nil
+}
+
+// Clients whose buckets have been full this long are forgotten
+const rateLimiterIdle = 10 * time.Minute
+
+// rateLimiter - a token bucket for each client
+type rateLimiter struct {
+	mu      sync.Mutex
+	clients map[string]*tokenBucket
+	pruned  time.Time
+}
+
+// allow - true if the client is within the rate. Otherwise, how long it
+// should wait.
+func (l *rateLimiter) allow(client string, rate float64, burst int, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.clients == nil {
+		l.clients = make(map[string]*tokenBucket)
+	}
+	if now.Sub(l.pruned) >= rateLimiterIdle {
+		for name, b := range l.clients {
+			if now.Sub(b.last) >= rateLimiterIdle {
+				delete(l.clients, name)
+			}
+		}
+		l.pruned = now
+	}
+
+	b := l.clients[client]
+	if b == nil {
+		b = &tokenBucket{}
+		l.clients[client] = b
+	}
+	b.refill(rate, burst, now)
+	if wait := b.wait(rate); wait > 0 {
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
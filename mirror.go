@@ -0,0 +1,409 @@
+package flywheel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// MirrorConfig - copy a sample of the proxied requests, with the response
+// status, to a capture sink for the first minutes after a start. Helps
+// debug failures that only happen on a cold backend, without instrumenting
+// it.
+type MirrorConfig struct {
+	// The sink: a file to append to, an HTTP endpoint to POST each request
+	// to, or an S3 location to upload batches to. Only one may be set.
+	File string          `json:"file"`
+	URL  string          `json:"url"`
+	S3   *S3MirrorConfig `json:"s3"`
+
+	// Percentage of the requests mirrored, default 100
+	Sample float64 `json:"sample"`
+
+	// Mirror for this long after a start, default 10m
+	Duration Duration `json:"duration"`
+
+	// Request bodies are cut off after this many bytes, default 64KiB
+	MaxBody int `json:"max-body"`
+
+	// Headers whose values aren't captured. Defaults to Authorization,
+	// Proxy-Authorization and Cookie.
+	RedactHeaders []string `json:"redact-headers"`
+}
+
+// S3MirrorConfig - where batches of mirrored requests are uploaded
+type S3MirrorConfig struct {
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix"`
+	Region string `json:"region"`
+}
+
+// Enabled - true if a sink is configured
+func (c *MirrorConfig) Enabled() bool {
+	return c.File != "" || c.URL != "" || c.S3 != nil
+}
+
+// Validate - check a single sink is configured, and fill in the defaults
+func (c *MirrorConfig) Validate() error {
+	count := 0
+	for _, set := range []bool{c.File != "", c.URL != "", c.S3 != nil} {
+		if set {
+			count++
+		}
+	}
+	if count > 1 {
+		return fmt.Errorf("Mirror to a file, url or s3, not more than one")
+	}
+	if count == 0 {
+		return nil
+	}
+	if c.S3 != nil && c.S3.Bucket == "" {
+		return fmt.Errorf("Mirror to s3 needs a bucket")
+	}
+	if c.Sample < 0 || c.Sample > 100 {
+		return fmt.Errorf("Mirror sample must be between 0 and 100, got %v", c.Sample)
+	}
+	if c.Sample == 0 {
+		c.Sample = 100
+	}
+	if c.Duration <= 0 {
+		c.Duration = Duration(10 * time.Minute)
+	}
+	if c.MaxBody <= 0 {
+		c.MaxBody = 64 * 1024
+	}
+	if c.RedactHeaders == nil {
+		c.RedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+	}
+	return nil
+}
+
+// MirroredRequest - a captured request, one JSON object per line in the
+// sinks
+type MirroredRequest struct {
+	Time          time.Time   `json:"time"`
+	SinceStart    string      `json:"since-start"`
+	Method        string      `json:"method"`
+	Host          string      `json:"host"`
+	URL           string      `json:"url"`
+	Header        http.Header `json:"header"`
+	Body          []byte      `json:"body,omitempty"`
+	BodyTruncated bool        `json:"body-truncated,omitempty"`
+	Status        int         `json:"status,omitempty"`
+	Error         string      `json:"error,omitempty"`
+	LatencyMs     float64     `json:"latency-ms"`
+}
+
+// How many captured requests wait for the sink before more are dropped
+const mirrorQueueSize = 1000
+
+// S3 batches are uploaded this often, or when this big
+const (
+	mirrorBatchInterval = time.Minute
+	mirrorBatchSize     = 1000
+)
+
+// Mirror - captures requests and writes them to the sink in the background,
+// so proxying never waits for it. A nil Mirror captures nothing.
+type Mirror struct {
+	config *MirrorConfig
+	queue  chan *MirroredRequest
+	sink   mirrorSink
+
+	mu      sync.Mutex
+	dropped int
+}
+
+// mirrorSink - writes batches of captured requests
+type mirrorSink interface {
+	write(batch []*MirroredRequest) error
+}
+
+// NewMirror - create the mirror and start writing to its sink, nil if not
+// configured
+func NewMirror(config *MirrorConfig, sess *session.Session, region string) *Mirror {
+	if !config.Enabled() {
+		return nil
+	}
+	m := &Mirror{config: config, queue: make(chan *MirroredRequest, mirrorQueueSize)}
+	batch := 1
+	switch {
+	case config.File != "":
+		m.sink = fileMirrorSink(config.File)
+	case config.URL != "":
+		m.sink = &httpMirrorSink{url: config.URL, client: &http.Client{Timeout: 10 * time.Second}}
+	case config.S3 != nil:
+		m.sink = newS3MirrorSink(sess, config.S3, region)
+		batch = mirrorBatchSize
+	}
+	go m.run(batch)
+	return m
+}
+
+// run - write the captured requests in batches of up to size
+func (m *Mirror) run(size int) {
+	ticker := time.NewTicker(mirrorBatchInterval)
+	defer ticker.Stop()
+	var batch []*MirroredRequest
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := m.sink.write(batch); err != nil {
+			log.Printf("Unable to write mirrored requests: %v", err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case req := <-m.queue:
+			batch = append(batch, req)
+			if len(batch) >= size {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+			m.mu.Lock()
+			if m.dropped > 0 {
+				log.Printf("Dropped %d mirrored requests, the sink is too slow", m.dropped)
+				m.dropped = 0
+			}
+			m.mu.Unlock()
+		}
+	}
+}
+
+// capture - start capturing a request, if it's sampled within the time
+// after a start. Returns nil otherwise.
+func (m *Mirror) capture(r *http.Request, pong Pong, now time.Time) *mirrorCapture {
+	if m == nil || pong.Status != STARTED || pong.StartedAt.IsZero() {
+		return nil
+	}
+	since := now.Sub(pong.StartedAt)
+	if since >= time.Duration(m.config.Duration) || rand.Float64()*100 >= m.config.Sample {
+		return nil
+	}
+
+	header := make(http.Header, len(r.Header))
+	for key, values := range r.Header {
+		header[key] = append([]string{}, values...)
+	}
+	for _, key := range m.config.RedactHeaders {
+		if header.Get(key) != "" {
+			header.Set(key, "********")
+		}
+	}
+	c := &mirrorCapture{
+		mirror: m,
+		start:  now,
+		req: &MirroredRequest{
+			Time:       now,
+			SinceStart: since.Round(time.Second).String(),
+			Method:     r.Method,
+			Host:       r.Host,
+			URL:        r.URL.RequestURI(),
+			Header:     header,
+		},
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		c.body = &captureReader{ReadCloser: r.Body, max: m.config.MaxBody}
+		r.Body = c.body
+	}
+	return c
+}
+
+// mirrorCapture - a request being captured
+type mirrorCapture struct {
+	mirror *Mirror
+	start  time.Time
+	req    *MirroredRequest
+	body   *captureReader
+	writer *statusWriter
+}
+
+// wrap - the response writer, recording the status of the response
+func (c *mirrorCapture) wrap(w http.ResponseWriter) http.ResponseWriter {
+	c.writer = &statusWriter{ResponseWriter: w}
+	return c.writer
+}
+
+// finish - add the response, or the error, and queue the request for the
+// sink. Dropped if the sink is behind.
+func (c *mirrorCapture) finish(err error, now time.Time) {
+	if c == nil {
+		return
+	}
+	if c.writer != nil {
+		c.req.Status = c.writer.status
+	}
+	if err != nil {
+		c.req.Error = err.Error()
+	}
+	c.req.LatencyMs = float64(now.Sub(c.start)) / float64(time.Millisecond)
+	if c.body != nil {
+		c.req.Body, c.req.BodyTruncated = c.body.buf.Bytes(), c.body.truncated
+	}
+	select {
+	case c.mirror.queue <- c.req:
+	default:
+		c.mirror.mu.Lock()
+		c.mirror.dropped++
+		c.mirror.mu.Unlock()
+	}
+}
+
+// captureReader - keeps the start of a body as it's read
+type captureReader struct {
+	io.ReadCloser
+	max       int
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (r *captureReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if keep := r.max - r.buf.Len(); keep > 0 {
+		if keep > n {
+			keep = n
+		}
+		r.buf.Write(p[:keep])
+		r.truncated = r.truncated || keep < n
+	} else if n > 0 {
+		r.truncated = true
+	}
+	return n, err
+}
+
+// statusWriter - remembers the status written to a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// marshalLines - the requests as JSON lines
+func marshalLines(batch []*MirroredRequest) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, req := range batch {
+		if err := enc.Encode(req); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// fileMirrorSink - appends to a file
+type fileMirrorSink string
+
+func (f fileMirrorSink) write(batch []*MirroredRequest) error {
+	buf, err := marshalLines(batch)
+	if err != nil {
+		return err
+	}
+	fd, err := os.OpenFile(string(f), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fd.Write(buf); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+// httpMirrorSink - POSTs each request as JSON
+type httpMirrorSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpMirrorSink) write(batch []*MirroredRequest) error {
+	for _, req := range batch {
+		buf, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(buf))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("Mirror endpoint returned %s", resp.Status)
+		}
+	}
+	return nil
+}
+
+// s3MirrorSink - uploads each batch as a JSON lines object, named by the
+// time of its first request
+type s3MirrorSink struct {
+	config *S3MirrorConfig
+	region string
+	aws    *aws.Config
+	signer *v4.Signer
+	client *http.Client
+}
+
+func newS3MirrorSink(sess *session.Session, config *S3MirrorConfig, region string) *s3MirrorSink {
+	if config.Region != "" {
+		region = config.Region
+	}
+	return &s3MirrorSink{
+		config: config,
+		region: region,
+		aws:    sess.Config,
+		signer: v4.NewSigner(sess.Config.Credentials),
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *s3MirrorSink) write(batch []*MirroredRequest) error {
+	buf, err := marshalLines(batch)
+	if err != nil {
+		return err
+	}
+	key := s.config.Prefix + batch[0].Time.UTC().Format("20060102T150405.000000000Z") + ".jsonl"
+	req, err := http.NewRequest("PUT", s3URL(s.aws, s.config.Bucket, key, s.region), bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if _, err = s.signer.Sign(req, bytes.NewReader(buf), "s3", s.region, time.Now()); err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
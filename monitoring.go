@@ -0,0 +1,276 @@
+package flywheel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MonitoringConfig - how the generated Prometheus alerting rules and
+// Grafana dashboard find and judge this environment's metrics
+type MonitoringConfig struct {
+	// Name in alerts and the dashboard title, default the team or endpoint
+	Environment string `json:"environment"`
+
+	// Label matchers selecting this flywheel's metrics, e.g.
+	// `instance="flywheel-staging:9100"`
+	Selector string `json:"selector"`
+
+	// Alert when STARTING or UNHEALTHY for longer, default 15m and 5m
+	StuckStarting Duration `json:"stuck-starting"`
+	UnhealthyFor  Duration `json:"unhealthy-for"`
+
+	// Alert when still STARTED this long after the stop was due, default 10m
+	StopOverdue Duration `json:"stop-overdue"`
+}
+
+// Validate - fill in the defaults
+func (c *MonitoringConfig) Validate() error {
+	if c.StuckStarting <= 0 {
+		c.StuckStarting = Duration(15 * time.Minute)
+	}
+	if c.UnhealthyFor <= 0 {
+		c.UnhealthyFor = Duration(5 * time.Minute)
+	}
+	if c.StopOverdue <= 0 {
+		c.StopOverdue = Duration(10 * time.Minute)
+	}
+	return nil
+}
+
+// environmentName - the name of the environment in monitoring
+func (c *Config) environmentName() string {
+	return firstNonEmpty(c.Monitoring.Environment, c.Team, c.Endpoint, "flywheel")
+}
+
+// metric - a metric with the selector, and more matchers if any
+func (c *MonitoringConfig) metric(name string, matchers ...string) string {
+	if c.Selector != "" {
+		matchers = append(matchers, c.Selector)
+	}
+	if len(matchers) == 0 {
+		return name
+	}
+	return name + "{" + strings.Join(matchers, ", ") + "}"
+}
+
+// promDuration - a duration in the Prometheus format, e.g. 1h30m
+func promDuration(d Duration) string {
+	s := time.Duration(d).String()
+	s = strings.Replace(s, "m0s", "m", 1)
+	return strings.Replace(s, "h0m", "h", 1)
+}
+
+// alertRule - a Prometheus alerting rule
+type alertRule struct {
+	name, expr, summary string
+	wait                Duration
+	severity            string
+}
+
+// alertRules - the alerts for the environment
+func (c *Config) alertRules() []alertRule {
+	m := &c.Monitoring
+	name := c.environmentName()
+	status := func(s string) string {
+		return m.metric("flywheel_status", fmt.Sprintf("status=%q", s))
+	}
+	rules := []alertRule{
+		{
+			name:     "FlywheelUnhealthy",
+			expr:     status("UNHEALTHY") + " == 1",
+			summary:  fmt.Sprintf("%s has been UNHEALTHY for %v", name, time.Duration(m.UnhealthyFor)),
+			wait:     m.UnhealthyFor,
+			severity: "critical",
+		},
+		{
+			name:     "FlywheelStuckStarting",
+			expr:     status("STARTING") + " == 1",
+			summary:  fmt.Sprintf("%s has been STARTING for %v", name, time.Duration(m.StuckStarting)),
+			wait:     m.StuckStarting,
+			severity: "warning",
+		},
+		{
+			name: "FlywheelStopOverdue",
+			expr: fmt.Sprintf("%s == 1 and on() time() - %s > %d", status("STARTED"),
+				m.metric("flywheel_stop_due_timestamp_seconds"), int64(time.Duration(m.StopOverdue).Seconds())),
+			summary:  fmt.Sprintf("%s is still running %v after it was due to stop", name, time.Duration(m.StopOverdue)),
+			severity: "warning",
+		},
+		{
+			name:     "FlywheelMetricsMissing",
+			expr:     "absent(" + m.metric("flywheel_status") + ")",
+			summary:  fmt.Sprintf("No flywheel metrics for %s", name),
+			wait:     Duration(10 * time.Minute),
+			severity: "warning",
+		},
+	}
+	if slo := &c.ColdStartSLO; slo.Target > 0 {
+		rules = append(rules, alertRule{
+			name:     "FlywheelColdStartSLOMissed",
+			expr:     m.metric("flywheel_cold_start_slo_met") + " == 0",
+			summary:  fmt.Sprintf("%s misses its cold start target of p%g under %v", name, slo.Percentile, time.Duration(slo.Target)),
+			severity: "warning",
+		})
+	}
+	if c.MaxLifetime > 0 {
+		rules = append(rules, alertRule{
+			name: "FlywheelMaxLifetimeExceeded",
+			expr: fmt.Sprintf("%s == 1 and on() time() - %s > %d", status("STARTED"),
+				m.metric("flywheel_last_started_timestamp_seconds"), int64(time.Duration(c.MaxLifetime).Seconds())),
+			summary:  fmt.Sprintf("%s has been running longer than its maximum lifetime of %v", name, time.Duration(c.MaxLifetime)),
+			severity: "warning",
+		})
+	}
+	return rules
+}
+
+// PrometheusRules - ready-made alerting rules for the environment, as a
+// Prometheus rule file
+func (c *Config) PrometheusRules() []byte {
+	var buf bytes.Buffer
+	name := c.environmentName()
+	owner := c.OwnerContact()
+	fmt.Fprintln(&buf, "groups:")
+	fmt.Fprintf(&buf, "  - name: %s\n", strconv.Quote("flywheel-"+name))
+	fmt.Fprintln(&buf, "    rules:")
+	for _, rule := range c.alertRules() {
+		fmt.Fprintf(&buf, "      - alert: %s\n", rule.name)
+		fmt.Fprintf(&buf, "        expr: %s\n", strconv.Quote(rule.expr))
+		if rule.wait > 0 {
+			fmt.Fprintf(&buf, "        for: %s\n", promDuration(rule.wait))
+		}
+		fmt.Fprintln(&buf, "        labels:")
+		fmt.Fprintf(&buf, "          severity: %s\n", rule.severity)
+		fmt.Fprintf(&buf, "          environment: %s\n", strconv.Quote(name))
+		if owner.Team != "" {
+			fmt.Fprintf(&buf, "          team: %s\n", strconv.Quote(owner.Team))
+		}
+		fmt.Fprintln(&buf, "        annotations:")
+		fmt.Fprintf(&buf, "          summary: %s\n", strconv.Quote(rule.summary))
+		if contact := firstNonEmpty(owner.Email, owner.Slack); contact != "" {
+			fmt.Fprintf(&buf, "          contact: %s\n", strconv.Quote(contact))
+		}
+	}
+	return buf.Bytes()
+}
+
+type grafanaTarget struct {
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat,omitempty"`
+	RefID        string `json:"refId"`
+}
+
+type grafanaPanel struct {
+	ID          int                    `json:"id"`
+	Type        string                 `json:"type"`
+	Title       string                 `json:"title"`
+	GridPos     map[string]int         `json:"gridPos"`
+	Targets     []grafanaTarget        `json:"targets"`
+	FieldConfig map[string]interface{} `json:"fieldConfig,omitempty"`
+	Options     map[string]interface{} `json:"options,omitempty"`
+}
+
+// GrafanaDashboard - a dashboard for the environment, for importing into
+// Grafana
+func (c *Config) GrafanaDashboard() ([]byte, error) {
+	m := &c.Monitoring
+	name := c.environmentName()
+
+	// The statuses, in the order of the status constants
+	var mappings []map[string]interface{}
+	colors := []string{"blue", "yellow", "green", "orange", "red"}
+	statusExpr := make([]string, 0, UNHEALTHY+1)
+	for status := STOPPED; status <= UNHEALTHY; status++ {
+		mappings = append(mappings, map[string]interface{}{
+			"type": "value",
+			"options": map[string]interface{}{
+				strconv.Itoa(status): map[string]string{"text": StatusString(status), "color": colors[status]},
+			},
+		})
+		statusExpr = append(statusExpr, fmt.Sprintf("%d * %s", status,
+			m.metric("flywheel_status", fmt.Sprintf("status=%q", StatusString(status)))))
+	}
+	current := "max(" + strings.Join(statusExpr, " or ") + ")"
+	statusField := map[string]interface{}{"defaults": map[string]interface{}{"mappings": mappings}}
+
+	panels := []grafanaPanel{
+		{
+			Type: "stat", Title: "Status",
+			GridPos:     map[string]int{"x": 0, "y": 0, "w": 6, "h": 6},
+			Targets:     []grafanaTarget{{Expr: current, RefID: "A"}},
+			FieldConfig: statusField,
+			Options:     map[string]interface{}{"colorMode": "background"},
+		},
+		{
+			Type: "stat", Title: "Running for",
+			GridPos: map[string]int{"x": 6, "y": 0, "w": 6, "h": 6},
+			Targets: []grafanaTarget{{
+				Expr:  fmt.Sprintf("(time() - %s) * on() %s", m.metric("flywheel_last_started_timestamp_seconds"), m.metric("flywheel_status", `status="STARTED"`)),
+				RefID: "A",
+			}},
+			FieldConfig: map[string]interface{}{"defaults": map[string]interface{}{"unit": "s"}},
+		},
+		{
+			Type: "stat", Title: "Stops in",
+			GridPos: map[string]int{"x": 12, "y": 0, "w": 6, "h": 6},
+			Targets: []grafanaTarget{{
+				Expr:  fmt.Sprintf("(%s - time()) * on() %s", m.metric("flywheel_stop_due_timestamp_seconds"), m.metric("flywheel_status", `status="STARTED"`)),
+				RefID: "A",
+			}},
+			FieldConfig: map[string]interface{}{"defaults": map[string]interface{}{"unit": "s"}},
+		},
+		{
+			Type: "state-timeline", Title: "Status over time",
+			GridPos:     map[string]int{"x": 0, "y": 6, "w": 24, "h": 8},
+			Targets:     []grafanaTarget{{Expr: current, LegendFormat: name, RefID: "A"}},
+			FieldConfig: statusField,
+		},
+	}
+	for i := range panels {
+		panels[i].ID = i + 1
+	}
+
+	dashboard := map[string]interface{}{
+		"title":         "Flywheel - " + name,
+		"uid":           dashboardUID(name),
+		"tags":          []string{"flywheel"},
+		"timezone":      "browser",
+		"schemaVersion": 36,
+		"time":          map[string]string{"from": "now-7d", "to": "now"},
+		"refresh":       "1m",
+		"panels":        panels,
+	}
+	return json.MarshalIndent(dashboard, "", "  ")
+}
+
+// dashboardUID - a stable dashboard ID for the environment, so imports
+// replace the previous one. Grafana allows 40 characters.
+func dashboardUID(name string) string {
+	uid := "flywheel-" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '-'
+	}, name)
+	if len(uid) > 40 {
+		uid = uid[:40]
+	}
+	return uid
+}
+
+// apiGrafanaDashboard - the generated dashboard
+func (handler *Handler) apiGrafanaDashboard(w http.ResponseWriter, r *http.Request) {
+	buf, err := handler.Flywheel.config.GrafanaDashboard()
+	if err != nil {
+		handler.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
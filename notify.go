@@ -0,0 +1,112 @@
+package flywheel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Notification events
+const (
+	NotifyDigest   = "digest"
+	NotifyError    = "error"
+	NotifyPanic    = "panic"
+	NotifyReadOnly = "read-only"
+)
+
+// NotifyConfig - where notifications are sent
+type NotifyConfig struct {
+	Webhook        string   `json:"webhook"`
+	DigestInterval Duration `json:"digest-interval"`
+}
+
+// Notification - the JSON payload posted to the webhook
+type Notification struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Status  string    `json:"status"`
+	Message string    `json:"message"`
+
+	// Who owns the environment, for routing the notification
+	Owner OwnerConfig `json:"owner"`
+
+	// Notes and links set with the API, so context travels with the
+	// environment
+	Notes string           `json:"notes,omitempty"`
+	Links []AnnotationLink `json:"links,omitempty"`
+}
+
+// notify - log a notification and post it to the webhook, if configured.
+// Delivery happens in the background so the flywheel goroutine never waits.
+func (fw *Flywheel) notify(event, format string, args ...interface{}) {
+	n := Notification{
+		Time:    fw.now(),
+		Event:   event,
+		Status:  StatusString(fw.status),
+		Message: fmt.Sprintf(format, args...),
+		Owner:   fw.ownerContact(),
+	}
+	if fw.annotations != nil {
+		n.Notes = fw.annotations.Notes
+		n.Links = fw.annotations.Links
+	}
+	fw.logf("Notification (%s): %s", event, n.Message)
+	if fw.notifier != nil {
+		fw.notifier.Notify(n)
+		return
+	}
+
+	// The owner's webhook gets them as well, but not twice
+	urls := []string{fw.config.Notify.Webhook}
+	if owner := n.Owner.Webhook; owner != "" && owner != urls[0] {
+		urls = append(urls, owner)
+	}
+	// Webhook URLs may contain secrets
+	n.Owner.Webhook = ""
+
+	for _, url := range urls {
+		if url != "" {
+			go postNotification(url, n)
+		}
+	}
+}
+
+// postNotification - post the notification to a webhook
+func postNotification(url string, n Notification) {
+	buf, err := json.Marshal(n)
+	if err != nil {
+		log.Printf("Unable to send notification: %v", err)
+		return
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		log.Printf("Unable to send notification: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Unable to send notification: webhook returned %s", resp.Status)
+	}
+}
+
+// Digest - send the periodic summary notification
+func (fw *Flywheel) Digest() {
+	since := fw.now().Add(-time.Duration(fw.config.Notify.DigestInterval))
+	rec := fw.history.RecommendIdleTimeout(fw.idleTimeout, 95, since.Add(-28*24*time.Hour))
+	startups := fw.history.Events(HistoryStartup, since)
+	message := fmt.Sprintf("%d startups since %s. Idle timeout: %s",
+		len(startups), since.Format(time.RFC1123), rec.Message)
+	if fw.history != nil {
+		message += ". " + fw.coldStarts().summary(&fw.config.ColdStartSLO)
+	}
+	if flagged := fw.flaggedClients(); flagged != "" {
+		message += ". Waking the environment at odd hours: " + flagged
+	}
+	for _, anomaly := range fw.anomalies.list() {
+		message += ". Anomaly since " + anomaly.Since.Format(time.RFC1123) + ": " + anomaly.Message
+	}
+	fw.notify(NotifyDigest, "%s", message)
+}
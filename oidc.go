@@ -0,0 +1,369 @@
+package flywheel
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDCCallbackPath - where the OIDC provider sends users back to after they
+// logged in. The redirect-url of the oidc middleware ends with it.
+const OIDCCallbackPath = "/flywheel/oidc/callback"
+
+// Cookies of the ID token, and of the login in progress
+const (
+	oidcCookie      = "flywheel_oidc"
+	oidcStateCookie = "flywheel_oidc_state"
+)
+
+// The signing keys are fetched again for an unknown key ID at most this
+// often, as providers rotate them
+const oidcKeysRefresh = time.Minute
+
+// Tokens are accepted this long past their expiry, for clock skew
+const oidcLeeway = time.Minute
+
+// oidcProvider - the endpoints and signing keys of the provider, fetched
+// when first needed
+type oidcProvider struct {
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+	fetched   time.Time
+}
+
+// oidcDiscovery - the provider configuration, as published at
+// /.well-known/openid-configuration
+type oidcDiscovery struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcClaims - the claims of an ID token that are checked
+type oidcClaims struct {
+	Issuer   string          `json:"iss"`
+	Audience json.RawMessage `json:"aud"`
+	Expiry   float64         `json:"exp"`
+	Subject  string          `json:"sub"`
+	Email    string          `json:"email"`
+	Nonce    string          `json:"nonce"`
+}
+
+// getJSON - GET a JSON document
+func getJSON(address string, out interface{}) error {
+	resp, err := http.Get(address)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", address, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// endpoints - the provider configuration of the issuer
+func (p *oidcProvider) endpoints(issuer string) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	var d oidcDiscovery
+	if err := getJSON(strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, fmt.Errorf("Unable to discover OIDC provider %s: %v", issuer, err)
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// key - the RSA signing key with the ID
+func (p *oidcProvider) key(issuer, kid string, now time.Time) (*rsa.PublicKey, error) {
+	d, err := p.endpoints(issuer)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if !p.fetched.IsZero() && now.Sub(p.fetched) < oidcKeysRefresh {
+		return nil, fmt.Errorf("Unknown OIDC signing key %q", kid)
+	}
+	p.fetched = now
+
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJSON(d.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("Unable to fetch OIDC signing keys: %v", err)
+	}
+	p.keys = make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		p.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("Unknown OIDC signing key %q", kid)
+}
+
+// verifyToken - check the signature and claims of an ID token. Returns the
+// claims.
+func (m *Middleware) verifyToken(token string, now time.Time) (*oidcClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("Unsupported ID token algorithm %q", header.Alg)
+	}
+	key, err := m.oidc.key(m.Issuer, header.Kid, now)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Malformed ID token signature")
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+		return nil, fmt.Errorf("Invalid ID token signature")
+	}
+
+	var claims oidcClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(claims.Issuer, "/") != strings.TrimSuffix(m.Issuer, "/") {
+		return nil, fmt.Errorf("ID token issued by %s", claims.Issuer)
+	}
+	if !audienceContains(claims.Audience, m.ClientID) {
+		return nil, fmt.Errorf("ID token isn't for client %s", m.ClientID)
+	}
+	if expiry := time.Unix(int64(claims.Expiry), 0); now.After(expiry.Add(oidcLeeway)) {
+		return nil, fmt.Errorf("ID token expired at %v", expiry)
+	}
+	if len(m.AllowedDomains) > 0 {
+		at := strings.LastIndex(claims.Email, "@")
+		if at < 0 || !contains(m.AllowedDomains, strings.ToLower(claims.Email[at+1:])) {
+			return nil, fmt.Errorf("%s isn't in an allowed domain", firstNonEmpty(claims.Email, claims.Subject))
+		}
+	}
+	return &claims, nil
+}
+
+// decodeSegment - decode a base64url JSON segment of a token
+func decodeSegment(segment string, out interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("Malformed ID token")
+	}
+	if err := json.Unmarshal(buf, out); err != nil {
+		return fmt.Errorf("Malformed ID token: %v", err)
+	}
+	return nil
+}
+
+// audienceContains - true if the aud claim, a string or an array, has the
+// client
+func audienceContains(aud json.RawMessage, client string) bool {
+	var one string
+	if json.Unmarshal(aud, &one) == nil {
+		return one == client
+	}
+	var many []string
+	if json.Unmarshal(aud, &many) == nil {
+		return contains(many, client)
+	}
+	return false
+}
+
+// serveOIDC - allow requests with a valid ID token, as a bearer token or
+// the cookie set after logging in. Browsers without one are sent to log in.
+func (m *Middleware) serveOIDC(handler *Handler, w http.ResponseWriter, r *http.Request) bool {
+	token := requestToken(r)
+	if strings.Count(token, ".") != 2 {
+		token = ""
+		if cookie, err := r.Cookie(oidcCookie); err == nil {
+			token = cookie.Value
+		}
+	}
+	if token != "" {
+		claims, err := m.verifyToken(token, handler.Flywheel.now())
+		if err == nil {
+			r.Header.Set("X-Forwarded-User", firstNonEmpty(claims.Email, claims.Subject))
+			return true
+		}
+		handler.Flywheel.logf("OIDC: %v", err)
+	}
+
+	if r.Method != "GET" || !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="flywheel"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	d, err := m.oidc.endpoints(m.Issuer)
+	if err != nil {
+		handler.Flywheel.logf("%v", err)
+		http.Error(w, "Login unavailable", http.StatusBadGateway)
+		return false
+	}
+	nonce := newRequestID()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    nonce + "." + base64.RawURLEncoding.EncodeToString([]byte(r.URL.RequestURI())),
+		Path:     OIDCCallbackPath,
+		MaxAge:   int((10 * time.Minute).Seconds()),
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {m.ClientID},
+		"redirect_uri":  {m.RedirectURL},
+		"scope":         {"openid email"},
+		"state":         {nonce},
+		"nonce":         {nonce},
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+"?"+query.Encode(), http.StatusFound)
+	return false
+}
+
+// serveOIDCCallback - exchange the code the provider sent the user back
+// with for an ID token, keep it in a cookie, and return to where the user
+// was going
+func (handler *Handler) serveOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	fw := handler.Flywheel
+	m := fw.config.Middleware.oidcMiddleware()
+	if m == nil {
+		http.NotFound(w, r)
+		return
+	}
+	state, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	parts := strings.SplitN(state.Value, ".", 2)
+	if len(parts) != 2 || subtle.ConstantTimeCompare([]byte(parts[0]), []byte(r.URL.Query().Get("state"))) != 1 {
+		http.Error(w, "Login state mismatch, please try again", http.StatusBadRequest)
+		return
+	}
+	nonce := parts[0]
+	target, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	if e := r.URL.Query().Get("error"); e != "" {
+		http.Error(w, "Login failed: "+e, http.StatusUnauthorized)
+		return
+	}
+
+	token, err := m.exchange(r.URL.Query().Get("code"))
+	if err != nil {
+		fw.logf("OIDC: %v", err)
+		http.Error(w, "Login failed", http.StatusBadGateway)
+		return
+	}
+	claims, err := m.verifyToken(token, fw.now())
+	if err == nil && claims.Nonce != nonce {
+		err = fmt.Errorf("ID token nonce mismatch")
+	}
+	if err != nil {
+		fw.logf("OIDC: %v", err)
+		http.Error(w, "Login failed", http.StatusForbidden)
+		return
+	}
+	fw.logf("OIDC: %s logged in", firstNonEmpty(claims.Email, claims.Subject))
+
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: OIDCCallbackPath, MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Unix(int64(claims.Expiry), 0),
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	// Only back to this site, not anywhere the state says
+	location := string(target)
+	if !localPath(location) {
+		location = "/"
+	}
+	http.Redirect(w, r, location, http.StatusFound)
+}
+
+// exchange - trade the authorization code for an ID token
+func (m *Middleware) exchange(code string) (string, error) {
+	if code == "" {
+		return "", fmt.Errorf("No authorization code")
+	}
+	d, err := m.oidc.endpoints(m.Issuer)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.PostForm(d.TokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {m.RedirectURL},
+		"client_id":     {m.ClientID},
+		"client_secret": {string(m.ClientSecret)},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("Token endpoint returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil || tokens.IDToken == "" {
+		return "", fmt.Errorf("Token endpoint returned no ID token")
+	}
+	return tokens.IDToken, nil
+}
+
+// isHTTPS - true if the client connected with TLS, to flywheel or to a
+// proxy in front of it
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
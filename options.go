@@ -0,0 +1,92 @@
+package flywheel
+
+import (
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// Logger - where flywheel logs to, e.g. a *log.Logger
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Notifier - delivers notifications
+type Notifier interface {
+	Notify(Notification)
+}
+
+// Option - changes how New builds a Flywheel, for embedding it in another
+// program or injecting test doubles
+type Option func(*options)
+
+type options struct {
+	logger   Logger
+	clock    Clock
+	store    StateStore
+	sess     *session.Session
+	notifier Notifier
+	drivers  []ResourceDriver
+}
+
+// WithLogger - log to logger instead of the standard logger
+func WithLogger(logger Logger) Option {
+	return func(o *options) { o.logger = logger }
+}
+
+// WithClock - take the time, and timers, from clock instead of the system
+// clock, e.g. a FakeClock
+func WithClock(clock Clock) Option {
+	return func(o *options) { o.clock = clock }
+}
+
+// WithStateStore - keep the state in store instead of the configured one
+func WithStateStore(store StateStore) Option {
+	return func(o *options) { o.store = store }
+}
+
+// WithProvider - create the AWS clients from sess instead of a session for
+// the configured region, e.g. with other credentials or endpoints
+func WithProvider(sess *session.Session) Option {
+	return func(o *options) { o.sess = sess }
+}
+
+// WithNotifier - deliver notifications to notifier instead of the
+// configured webhooks
+func WithNotifier(notifier Notifier) Option {
+	return func(o *options) { o.notifier = notifier }
+}
+
+// WithDriver - start, stop and check the resources of driver with the
+// environment, after the built-in ones. May be given more than once.
+func WithDriver(driver ResourceDriver) Option {
+	return func(o *options) { o.drivers = append(o.drivers, driver) }
+}
+
+// newOptions - the options, with the defaults for those not given
+func newOptions(config *Config, opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.clock == nil {
+		o.clock = SystemClock
+	}
+	if o.sess == nil {
+		o.sess = session.New(&aws.Config{Region: &config.Region})
+	}
+	if o.store == nil {
+		o.store = newStateStore(config, config.AWS.session(o.sess, "s3"))
+	}
+	return o
+}
+
+// logf - log to the logger given to New, else the standard logger
+func (fw *Flywheel) logf(format string, args ...interface{}) {
+	if fw.logger != nil {
+		fw.logger.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
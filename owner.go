@@ -0,0 +1,50 @@
+package flywheel
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+// OwnerConfig - who to contact about the environment. Shown on the status
+// pages and included in notifications.
+type OwnerConfig struct {
+	Team  string `json:"team"`
+	Email string `json:"email"`
+	Slack string `json:"slack"`
+
+	// Notifications are also sent here, e.g. the owner's Slack webhook
+	Webhook string `json:"webhook"`
+}
+
+// OwnerContact - the owner, with the team defaulting to the environment's
+// team
+func (c *Config) OwnerContact() OwnerConfig {
+	owner := c.Owner
+	if owner.Team == "" {
+		owner.Team = c.Team
+	}
+	return owner
+}
+
+// contact - the owner contact line of the status pages, with the notes and
+// links of the annotations. Empty if there is nothing to show.
+func (c *Config) contact(lang string, a *Annotations) string {
+	owner := c.annotatedOwner(a)
+	var parts []string
+	if owner.Team != "" {
+		parts = append(parts, html.EscapeString(owner.Team))
+	}
+	if owner.Email != "" {
+		email := html.EscapeString(owner.Email)
+		parts = append(parts, fmt.Sprintf(`<a href="mailto:%s">%s</a>`, email, email))
+	}
+	if owner.Slack != "" {
+		parts = append(parts, html.EscapeString(owner.Slack))
+	}
+	if len(parts) == 0 {
+		return a.notesFooter()
+	}
+	return fmt.Sprintf(`<p style="text-align: center; font-size: smaller;">%s</p>`,
+		fmt.Sprintf(c.Message(lang, "owner.contact"), strings.Join(parts, " &middot; "))) + a.notesFooter()
+}
@@ -0,0 +1,121 @@
+package flywheel
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Ways to send traffic to the parked site
+const (
+	ParkedProxy    = "proxy"
+	ParkedRedirect = "redirect"
+)
+
+// ParkedConfig - a static site, e.g. on S3 or CloudFront, shown instead of
+// the stopped page: a read-only snapshot of the docs, or a demo video
+type ParkedConfig struct {
+	// Base URL of the site
+	URL string `json:"url"`
+
+	// Proxy the site with a start button overlaid (the default), or redirect
+	// to it
+	Mode string `json:"mode"`
+
+	target *url.URL
+}
+
+// Enabled - true if stopped environments show the parked site
+func (c *ParkedConfig) Enabled() bool {
+	return c.URL != ""
+}
+
+// Validate - check the URL and mode
+func (c *ParkedConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	target, err := url.Parse(c.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return fmt.Errorf("Parked site URL %s must be an http or https URL", c.URL)
+	}
+	c.target = target
+	switch c.Mode {
+	case "":
+		c.Mode = ParkedProxy
+	case ParkedProxy, ParkedRedirect:
+	default:
+		return fmt.Errorf("Unknown parked site mode %s", c.Mode)
+	}
+	return nil
+}
+
+// location - the parked site's URL for the request
+func (c *ParkedConfig) location(r *http.Request) string {
+	u := *c.target
+	u.Path = strings.TrimSuffix(u.Path, "/") + r.URL.Path
+	u.RawQuery = r.URL.RawQuery
+	return u.String()
+}
+
+// serveParked - the parked site, for a stopped environment. Returns false
+// if it couldn't be served, so the stopped page is shown instead.
+func (handler *Handler) serveParked(w http.ResponseWriter, r *http.Request, startURL, lang string) bool {
+	c := &handler.Flywheel.config.Parked
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	location := c.location(r)
+	if c.Mode == ParkedRedirect {
+		http.Redirect(w, r, location, http.StatusFound)
+		return true
+	}
+
+	req, err := http.NewRequest(r.Method, location, nil)
+	if err != nil {
+		handler.Flywheel.logf("%v", err)
+		return false
+	}
+	for _, key := range []string{"Accept", "Accept-Language", "If-None-Match", "If-Modified-Since", "User-Agent"} {
+		if value := r.Header.Get(key); value != "" {
+			req.Header.Set(key, value)
+		}
+	}
+	resp, err := handler.HTTPClient.Do(req)
+	if err != nil {
+		if urlError, ok := err.(*url.Error); !ok || urlError.Err != ErrIgnoreRedirects {
+			handler.Flywheel.logf("Unable to reach the parked site: %v", err)
+			return false
+		}
+	}
+	defer resp.Body.Close()
+
+	var body io.Reader = resp.Body
+	if resp.StatusCode == http.StatusOK && strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		page, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			handler.Flywheel.logf("Unable to read the parked site: %v", err)
+			return false
+		}
+		button := fmt.Sprintf(HTMLPARKED, html.EscapeString(startURL), handler.Flywheel.config.Message(lang, "parked.start"))
+		page = injectBeforeBody(page, button)
+		resp.Header.Set("Content-Length", strconv.Itoa(len(page)))
+		body = bytes.NewReader(page)
+	}
+
+	for key, value := range resp.Header {
+		w.Header()[key] = value
+	}
+	w.Header().Set("X-Flywheel-Parked", "true")
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, body); err != nil {
+		handler.Flywheel.logf("%v", err)
+	}
+	return true
+}
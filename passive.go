@@ -0,0 +1,46 @@
+package flywheel
+
+import (
+	"net/http"
+	"strings"
+)
+
+// isPassive - requests browsers and crawlers make on their own. These must
+// neither wake the environment nor keep it awake.
+func isPassive(path string) bool {
+	return path == "/favicon.ico" || path == "/robots.txt" || strings.HasPrefix(path, "/.well-known/")
+}
+
+// Served for /robots.txt while the environment isn't running, unless
+// configured otherwise
+const defaultRobotsTxt = "User-agent: *\nDisallow: /\n"
+
+// servePassive - answer passive requests without touching the idle timer.
+// They are proxied while the environment is running, and get a 404 otherwise.
+func (handler *Handler) servePassive(w http.ResponseWriter, r *http.Request) {
+	config := handler.Flywheel.config
+	if r.URL.Path == "/favicon.ico" && config.Favicon != "" {
+		http.ServeFile(w, r, config.Favicon)
+		return
+	}
+	if r.URL.Path == "/robots.txt" && config.RobotsTxt != "" {
+		serveRobotsTxt(w, config.RobotsTxt)
+		return
+	}
+
+	pong := handler.sendPing("status", "")
+	if pong.Status == STARTED {
+		handler.proxy(w, r, pong)
+		return
+	}
+	if r.URL.Path == "/robots.txt" {
+		serveRobotsTxt(w, defaultRobotsTxt)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func serveRobotsTxt(w http.ResponseWriter, body string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(body))
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+
+package flywheel
+
+import (
+	"os"
+	"syscall"
+)
+
+// errConnRefused - the error of a backend that isn't listening
+var errConnRefused error = syscall.ECONNREFUSED
+
+// replaceFile - move a file into place, replacing the previous one
+func replaceFile(from, to string) error {
+	return os.Rename(from, to)
+}
@@ -0,0 +1,37 @@
+package flywheel
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// errConnRefused - the error of a backend that isn't listening. Winsock has
+// its own, syscall.ECONNREFUSED is never returned.
+var errConnRefused error = syscall.Errno(10061)
+
+// ERROR_SHARING_VIOLATION, not in syscall
+const errSharingViolation = syscall.Errno(32)
+
+// replaceFile - move a file into place, replacing the previous one. Windows
+// refuses while another process has the previous one open, like an agent
+// reading the status file, so it's retried for a moment.
+func replaceFile(from, to string) error {
+	var err error
+	for i := 0; i < 20; i++ {
+		err = os.Rename(from, to)
+		if !sharingViolation(err) {
+			return err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return err
+}
+
+// sharingViolation - true if the rename failed because the file is in use
+func sharingViolation(err error) bool {
+	if e, ok := err.(*os.LinkError); ok {
+		err = e.Err
+	}
+	return err == errSharingViolation || err == syscall.ERROR_ACCESS_DENIED
+}
@@ -0,0 +1,210 @@
+package flywheel
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var poolName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// PoolConfig - a named environment managed by the same process. Everything
+// but the routing is a config of its own, on top of the top-level settings,
+// like a config on top of the bases it extends.
+type PoolConfig struct {
+	// Requests for these hostnames go to the pool
+	Hosts []string `json:"hosts"`
+
+	// Or requests below this path, e.g. /staging. Hosts win over paths.
+	PathPrefix string `json:"path-prefix"`
+
+	// Remove the path prefix before the request reaches the pool, and its
+	// backend
+	StripPrefix bool `json:"strip-prefix"`
+
+	config *Config
+}
+
+// Keys of a pool that are about routing, not its config
+var poolRoutingKeys = []string{"hosts", "path-prefix", "strip-prefix"}
+
+// Config - the config of the pool
+func (p *PoolConfig) Config() *Config {
+	return p.config
+}
+
+// PoolNames - the names of the pools, sorted. None for a single
+// environment.
+func (c *Config) PoolNames() []string {
+	var names []string
+	for name := range c.Pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parsePools - build the config of each pool from the top-level settings
+// and its own, from the config file as read
+func (c *Config) parsePools(in []byte) error {
+	for _, name := range c.PoolNames() {
+		var top map[string]interface{}
+		if err := json.Unmarshal(in, &top); err != nil {
+			return err
+		}
+		own, ok := top["pools"].(map[string]interface{})[name].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Pool %s isn't an object", name)
+		}
+		delete(top, "pools")
+		for _, key := range poolRoutingKeys {
+			delete(own, key)
+		}
+		buf, err := json.Marshal(mergeJSON(top, own))
+		if err != nil {
+			return err
+		}
+		config := &Config{}
+		if err := json.Unmarshal(buf, config); err != nil {
+			return fmt.Errorf("Pool %s: %v", name, err)
+		}
+		c.Pools[name].config = config
+	}
+	return c.validatePools()
+}
+
+// validatePools - check each pool's config, and that every request is
+// routed to one pool at most
+func (c *Config) validatePools() error {
+	hosts := make(map[string]string)
+	prefixes := make(map[string]string)
+	files := make(map[string]string)
+	for _, name := range c.PoolNames() {
+		pool := c.Pools[name]
+		if !poolName.MatchString(name) {
+			return fmt.Errorf("Invalid pool name %q, expected letters, digits, - and _", name)
+		}
+		if len(pool.Hosts) == 0 && pool.PathPrefix == "" {
+			return fmt.Errorf("Pool %s needs hosts or a path-prefix", name)
+		}
+		for _, host := range pool.Hosts {
+			host = strings.ToLower(host)
+			if other, ok := hosts[host]; ok {
+				return fmt.Errorf("Host %s is routed to pools %s and %s", host, other, name)
+			}
+			hosts[host] = name
+		}
+		if prefix := pool.PathPrefix; prefix != "" {
+			if !strings.HasPrefix(prefix, "/") || strings.HasSuffix(prefix, "/") {
+				return fmt.Errorf("Path prefix %q of pool %s must start with / and not end with it", prefix, name)
+			}
+			if other, ok := prefixes[prefix]; ok {
+				return fmt.Errorf("Path prefix %s is routed to pools %s and %s", prefix, other, name)
+			}
+			prefixes[prefix] = name
+		}
+
+		config := pool.config
+		if config == nil {
+			return fmt.Errorf("Pool %s has no config", name)
+		}
+		if err := config.Validate(); err != nil {
+			return fmt.Errorf("Pool %s: %v", name, err)
+		}
+		if len(config.Pools) > 0 {
+			return fmt.Errorf("Pool %s can't have pools", name)
+		}
+		if config.WakeDNS.Listen != "" {
+			return fmt.Errorf("Pool %s: wake DNS isn't supported with pools", name)
+		}
+
+		// Pools sharing these would overwrite each other's state
+		var store []byte
+		if s := config.StateStore; s.S3 != nil || s.Redis != nil || s.Etcd != nil {
+			store, _ = json.Marshal(s)
+		}
+		for kind, file := range map[string]string{
+			"history-file":   config.HistoryFile,
+			"record-file":    config.RecordFile,
+			"state-store":    string(store),
+			"webhook-replay": config.WebhookReplay.Dir + config.WebhookReplay.SQSQueueURL,
+		} {
+			if file == "" {
+				continue
+			}
+			if other, ok := files[kind+":"+file]; ok {
+				return fmt.Errorf("Pools %s and %s have the same %s", other, name, kind)
+			}
+			files[kind+":"+file] = name
+		}
+	}
+	return nil
+}
+
+// PoolRouter - route requests to the handlers of the pools, by hostname or
+// path prefix
+type PoolRouter struct {
+	config   *Config
+	handlers map[string]http.Handler
+}
+
+// NewPoolRouter - route to the handler of each pool, by its name
+func NewPoolRouter(config *Config, handlers map[string]http.Handler) *PoolRouter {
+	return &PoolRouter{config: config, handlers: handlers}
+}
+
+// route - the pool of a request, and the path prefix to strip if any
+func (router *PoolRouter) route(r *http.Request) (string, string) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	match, prefix := "", ""
+	for _, name := range router.config.PoolNames() {
+		pool := router.config.Pools[name]
+		for _, h := range pool.Hosts {
+			if strings.ToLower(h) == host {
+				return name, ""
+			}
+		}
+		p := pool.PathPrefix
+		if p == "" || len(p) <= len(prefix) || (r.URL.Path != p && !strings.HasPrefix(r.URL.Path, p+"/")) {
+			continue
+		}
+		match, prefix = name, p
+	}
+	if match != "" && !router.config.Pools[match].StripPrefix {
+		prefix = ""
+	}
+	return match, prefix
+}
+
+func (router *PoolRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, prefix := router.route(r)
+	handler, ok := router.handlers[name]
+	if name == "" || !ok {
+		http.Error(w, "No environment for "+r.Host+r.URL.Path, http.StatusNotFound)
+		return
+	}
+	if prefix != "" {
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+		if r2.URL.Path == "" {
+			r2.URL.Path = "/"
+		}
+		r2.URL.RawPath = ""
+		r2.RequestURI = r2.URL.RequestURI()
+		r = r2
+	}
+	handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,108 @@
+package flywheel
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Protections that keep flywheel from powering down a resource
+const (
+	// EC2 stop protection, StopInstances is refused
+	ProtectionStop = "stop"
+	// Autoscaling instance scale-in protection, the group keeps it running
+	ProtectionScaleIn = "scale-in"
+)
+
+// ProtectedResource - a resource left running by the last stop, because
+// it's protected
+type ProtectedResource struct {
+	Type       string `json:"type"`
+	ID         string `json:"id"`
+	Protection string `json:"protection"`
+	// The autoscaling group of the instance, if any
+	Group string `json:"group,omitempty"`
+}
+
+type describeStopProtectionInput struct {
+	_ struct{} `type:"structure"`
+
+	InstanceId *string `type:"string"`
+	Attribute  *string `type:"string"`
+}
+
+type describeStopProtectionOutput struct {
+	_ struct{} `type:"structure"`
+
+	DisableApiStop *attributeBoolean `locationName:"disableApiStop" type:"structure"`
+}
+
+type attributeBoolean struct {
+	_ struct{} `type:"structure"`
+
+	Value *bool `locationName:"value" type:"boolean"`
+}
+
+// protect - leave a resource running, with a warning in the status and a
+// drift notification
+func (fw *Flywheel) protect(r ProtectedResource) {
+	fw.protected = append(fw.protected, r)
+	if r.Group != "" {
+		fw.warn(NotifyDrift, "Instance %s of autoscaling group %s has %s protection, it was left running", r.ID, r.Group, r.Protection)
+	} else {
+		fw.warn(NotifyDrift, "Instance %s has %s protection, it was left running", r.ID, r.Protection)
+	}
+}
+
+// stopUnprotected - stop the instances. If EC2 refuses because some have
+// stop protection, those are left running and the others are stopped.
+func (fw *Flywheel) stopUnprotected(ids []string, group string) error {
+	_, err := fw.ec2.StopInstances(&ec2.StopInstancesInput{InstanceIds: aws.StringSlice(ids)})
+	if detail := errorDetail(err); detail == nil || detail.Code != "OperationNotPermitted" {
+		return err
+	}
+
+	var rest []string
+	for _, id := range ids {
+		var resp describeStopProtectionOutput
+		perr := awsCall(fw.ec2.Client, "DescribeInstanceAttribute", &describeStopProtectionInput{
+			InstanceId: aws.String(id),
+			Attribute:  aws.String("disableApiStop"),
+		}, &resp)
+		if perr != nil {
+			fw.logf("Unable to check the stop protection of %s: %v", id, perr)
+			return err
+		}
+		if resp.DisableApiStop != nil && aws.BoolValue(resp.DisableApiStop.Value) {
+			fw.protect(ProtectedResource{Type: ResourceInstance, ID: id, Protection: ProtectionStop, Group: group})
+		} else {
+			rest = append(rest, id)
+		}
+	}
+	if len(rest) == len(ids) {
+		return err
+	}
+	if len(rest) == 0 {
+		return nil
+	}
+	_, err = fw.ec2.StopInstances(&ec2.StopInstancesInput{InstanceIds: aws.StringSlice(rest)})
+	return err
+}
+
+// checkScaleInProtection - report the instances of a group to be scaled
+// down to size that the group can't terminate
+func (fw *Flywheel) checkScaleInProtection(groupName string, group *autoscaling.Group, size int64) {
+	var protected []string
+	for _, instance := range group.Instances {
+		if aws.BoolValue(instance.ProtectedFromScaleIn) {
+			protected = append(protected, aws.StringValue(instance.InstanceId))
+		}
+	}
+	// Protected instances count towards the warm standby size
+	if int64(len(protected)) <= size {
+		return
+	}
+	for _, id := range protected {
+		fw.protect(ProtectedResource{Type: ResourceInstance, ID: id, Protection: ProtectionScaleIn, Group: groupName})
+	}
+}
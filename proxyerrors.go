@@ -0,0 +1,167 @@
+package flywheel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Kinds of proxy errors
+const (
+	ProxyRefused = "refused"
+	ProxyTimeout = "timeout"
+	ProxyDNS     = "dns"
+	ProxyTLS     = "tls"
+	ProxyOther   = "other"
+)
+
+// ProxyErrorsConfig - when failing to reach the backend while STARTED looks
+// like it is down, rather than a one-off
+type ProxyErrorsConfig struct {
+	// Failures within the window that mark the environment UNHEALTHY until
+	// the next health check, default 5. Negative never does.
+	Threshold int      `json:"threshold"`
+	Window    Duration `json:"window"`
+
+	// For this long after starting, refused connections and timeouts show
+	// the starting page, as the application may still be booting. Default 2m.
+	StartupGrace Duration `json:"startup-grace"`
+}
+
+// Validate - fill in the defaults
+func (c *ProxyErrorsConfig) Validate() error {
+	if c.Threshold == 0 {
+		c.Threshold = 5
+	}
+	if c.Window <= 0 {
+		c.Window = Duration(time.Minute)
+	}
+	if c.StartupGrace < 0 {
+		return fmt.Errorf("Proxy errors startup grace can't be negative")
+	}
+	if c.StartupGrace == 0 {
+		c.StartupGrace = Duration(2 * time.Minute)
+	}
+	return nil
+}
+
+// classifyProxyError - what kind of failure the error of a proxied request
+// is. The transport wraps the cause, e.g. in *url.Error and *net.OpError,
+// so the wrappers are taken off one by one.
+func classifyProxyError(err error) string {
+	timeout := false
+	if e, ok := err.(net.Error); ok {
+		timeout = e.Timeout()
+	}
+	for err != nil {
+		switch e := err.(type) {
+		case *net.DNSError:
+			return ProxyDNS
+		case tls.RecordHeaderError, x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError:
+			return ProxyTLS
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		case interface {
+			Unwrap() error
+		}:
+			// e.g. the *tls.CertificateVerificationError of newer Go versions
+			err = e.Unwrap()
+		default:
+			if err == errConnRefused {
+				return ProxyRefused
+			}
+			err = nil
+		}
+	}
+	if timeout {
+		return ProxyTimeout
+	}
+	return ProxyOther
+}
+
+// proxyErrorCode - the status code for a kind of proxy error
+func proxyErrorCode(kind string) int {
+	switch kind {
+	case ProxyRefused:
+		return http.StatusServiceUnavailable
+	case ProxyTimeout:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// proxyFailures - recent failures to reach the backend
+type proxyFailures struct {
+	mu    sync.Mutex
+	times []time.Time
+}
+
+// failed - record a failure. Returns true when there were enough within the
+// window, and starts counting over.
+func (f *proxyFailures) failed(c *ProxyErrorsConfig, now time.Time) bool {
+	if c.Threshold < 0 {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.times = append(since(f.times, now.Add(-time.Duration(c.Window))), now)
+	if len(f.times) < c.Threshold {
+		return false
+	}
+	f.times = nil
+	return true
+}
+
+// succeeded - the backend answered, start counting over
+func (f *proxyFailures) succeeded() {
+	f.mu.Lock()
+	f.times = nil
+	f.mu.Unlock()
+}
+
+// proxyError - show what went wrong reaching the backend. While the
+// environment has just started, the application may still be booting.
+func (handler *Handler) proxyError(w http.ResponseWriter, r *http.Request, err error, pong Pong) {
+	config := handler.Flywheel.config
+	kind := classifyProxyError(err)
+	lang := config.Language(r)
+	w.Header().Set("Content-Language", lang)
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+
+	if handler.failures.failed(&config.ProxyErrors, handler.Flywheel.now()) {
+		handler.ping(Ping{backendDown: kind})
+	}
+
+	booting := !pong.StartedAt.IsZero() && handler.Flywheel.now().Sub(pong.StartedAt) < time.Duration(config.ProxyErrors.StartupGrace)
+	if booting && (kind == ProxyRefused || kind == ProxyTimeout) {
+		handler.page(w, http.StatusServiceUnavailable, HTMLSTARTING, lang, "starting", nil)
+		return
+	}
+	if kind == ProxyRefused {
+		w.Header().Set("Retry-After", "30")
+	}
+	handler.page(w, proxyErrorCode(kind), HTMLERROR, lang, "proxy."+kind, nil)
+}
+
+// backendDown - the backend keeps failing while STARTED. It's UNHEALTHY
+// until the health check says otherwise.
+func (fw *Flywheel) backendDown(kind string) {
+	if fw.status != STARTED {
+		return
+	}
+	fw.logf("Repeated %s errors reaching the backend, checking health again", kind)
+	fw.setHealth(&fw.health.Application, NotifyApplication, HealthUnhealthy,
+		fmt.Sprintf("Repeated %s errors reaching the backend", kind))
+	fw.setStatus(UNHEALTHY)
+	fw.refreshHealth()
+}
@@ -0,0 +1,53 @@
+package flywheel
+
+import (
+	"fmt"
+	"time"
+)
+
+// ProxyTimeoutConfig - how long the backend may take to answer a proxied
+// request. Cold JIT compilers and caches make the first responses after a
+// start slow, so they may take longer than the rest.
+type ProxyTimeoutConfig struct {
+	// Until the response headers arrive. Zero waits as long as the client
+	// does.
+	Timeout Duration `json:"timeout"`
+
+	// The timeout for the cold window after STARTED, default 10m. Zero
+	// uses the normal timeout throughout.
+	Cold       Duration `json:"cold"`
+	ColdWindow Duration `json:"cold-window"`
+}
+
+// Validate - check the cold timeout isn't shorter, and fill in the defaults
+func (c *ProxyTimeoutConfig) Validate() error {
+	if c.Timeout < 0 || c.Cold < 0 || c.ColdWindow < 0 {
+		return fmt.Errorf("Proxy timeouts can't be negative")
+	}
+	if c.Cold > 0 && c.Timeout > 0 && c.Cold < c.Timeout {
+		return fmt.Errorf("Proxy cold timeout %v is shorter than the timeout %v", time.Duration(c.Cold), time.Duration(c.Timeout))
+	}
+	if c.Cold > 0 && c.ColdWindow == 0 {
+		c.ColdWindow = Duration(10 * time.Minute)
+	}
+	return nil
+}
+
+// timeout - the timeout for a request at now, for an environment started
+// at startedAt. Zero is no timeout.
+func (c *ProxyTimeoutConfig) timeout(startedAt, now time.Time) time.Duration {
+	if c.Cold > 0 && !startedAt.IsZero() && now.Sub(startedAt) < time.Duration(c.ColdWindow) {
+		return time.Duration(c.Cold)
+	}
+	return time.Duration(c.Timeout)
+}
+
+// proxyTimeoutError - the backend didn't answer in time. It's a timeout
+// like any other network timeout.
+type proxyTimeoutError time.Duration
+
+func (e proxyTimeoutError) Error() string {
+	return fmt.Sprintf("Backend didn't answer within %v", time.Duration(e))
+}
+func (e proxyTimeoutError) Timeout() bool   { return true }
+func (e proxyTimeoutError) Temporary() bool { return true }
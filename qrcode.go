@@ -0,0 +1,428 @@
+package flywheel
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// A QR code encoder for the short links on the stopped page: byte mode,
+// error correction level M, versions 1 to 10, so up to 213 bytes.
+
+// qrVersion - the error correction blocks of a version at level M
+type qrVersion struct {
+	ecPerBlock int
+	// The number of blocks with dataPerBlock data codewords, followed by
+	// the number of blocks with one more
+	blocks, dataPerBlock, longBlocks int
+	alignment                        []int
+}
+
+var qrVersions = []qrVersion{
+	{10, 1, 16, 0, nil},
+	{16, 1, 28, 0, []int{6, 18}},
+	{26, 1, 44, 0, []int{6, 22}},
+	{18, 2, 32, 0, []int{6, 26}},
+	{24, 2, 43, 0, []int{6, 30}},
+	{16, 4, 27, 0, []int{6, 34}},
+	{18, 4, 31, 0, []int{6, 22, 38}},
+	{22, 2, 38, 2, []int{6, 24, 42}},
+	{22, 3, 36, 2, []int{6, 26, 46}},
+	{26, 4, 43, 1, []int{6, 28, 50}},
+}
+
+// dataCodewords - how many data codewords the version holds
+func (v qrVersion) dataCodewords() int {
+	return (v.blocks+v.longBlocks)*v.dataPerBlock + v.longBlocks
+}
+
+// qrCode - the modules of a QR code, true is dark
+type qrCode struct {
+	size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+// encodeQR - the QR code of the data, in the smallest version it fits in
+func encodeQR(data []byte) (*qrCode, error) {
+	for i, v := range qrVersions {
+		number := i + 1
+		countBits := 8
+		if number >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) > 8*v.dataCodewords() {
+			continue
+		}
+
+		var bits qrBits
+		bits.append(0x4, 4)
+		bits.append(len(data), countBits)
+		for _, b := range data {
+			bits.append(int(b), 8)
+		}
+		capacity := 8 * v.dataCodewords()
+		for i := 0; i < 4 && len(bits) < capacity; i++ {
+			bits = append(bits, false)
+		}
+		for len(bits)%8 != 0 {
+			bits = append(bits, false)
+		}
+		for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+			bits.append(pad, 8)
+		}
+
+		q := newQRCode(number, v)
+		q.place(v.interleave(bits.bytes()))
+		q.applyBestMask()
+		return q, nil
+	}
+	return nil, fmt.Errorf("Too long for a QR code: %d bytes", len(data))
+}
+
+// qrBits - a bit stream, most significant bit first
+type qrBits []bool
+
+func (b *qrBits) append(value, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, (value>>uint(i))&1 != 0)
+	}
+}
+
+func (b qrBits) bytes() []byte {
+	result := make([]byte, len(b)/8)
+	for i, bit := range b {
+		if bit {
+			result[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return result
+}
+
+// interleave - split the data into blocks, add the error correction of
+// each, and interleave the blocks
+func (v qrVersion) interleave(data []byte) []byte {
+	divisor := rsDivisor(v.ecPerBlock)
+	var blocks, ecs [][]byte
+	for i, offset := 0, 0; i < v.blocks+v.longBlocks; i++ {
+		n := v.dataPerBlock
+		if i >= v.blocks {
+			n++
+		}
+		block := data[offset : offset+n]
+		offset += n
+		blocks = append(blocks, block)
+		ecs = append(ecs, rsRemainder(block, divisor))
+	}
+
+	var result []byte
+	for i := 0; i <= v.dataPerBlock; i++ {
+		for _, block := range blocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < v.ecPerBlock; i++ {
+		for _, ec := range ecs {
+			result = append(result, ec[i])
+		}
+	}
+	return result
+}
+
+// gfMultiply - multiply in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+func gfMultiply(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+// rsDivisor - the Reed-Solomon generator polynomial of the degree, highest
+// coefficient first, without the leading 1
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+// rsRemainder - the error correction codewords of the data
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coef := range divisor {
+			result[i] ^= gfMultiply(coef, factor)
+		}
+	}
+	return result
+}
+
+// newQRCode - a QR code with the function patterns of the version drawn
+func newQRCode(number int, v qrVersion) *qrCode {
+	size := 17 + 4*number
+	q := &qrCode{size: size}
+	for i := 0; i < size; i++ {
+		q.modules = append(q.modules, make([]bool, size))
+		q.function = append(q.function, make([]bool, size))
+	}
+
+	for i := 0; i < size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+	q.finder(3, 3)
+	q.finder(size-4, 3)
+	q.finder(3, size-4)
+
+	last := len(v.alignment) - 1
+	for i, x := range v.alignment {
+		for j, y := range v.alignment {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(x+dx, y+dy, abs(dx) == 2 || abs(dy) == 2 || (dx == 0 && dy == 0))
+				}
+			}
+		}
+	}
+
+	// Reserve the format bits, drawn once the mask is known
+	q.format(0)
+
+	if number >= 7 {
+		rem := number
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+		}
+		bits := number<<12 | rem
+		for i := 0; i < 18; i++ {
+			bit := (bits>>uint(i))&1 != 0
+			a, b := size-11+i%3, i/3
+			q.set(a, b, bit)
+			q.set(b, a, bit)
+		}
+	}
+	return q
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// set - draw a function module at column x, row y
+func (q *qrCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+// finder - draw a finder pattern and its separator around the center
+func (q *qrCode) finder(cx, cy int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			x, y := cx+dx, cy+dy
+			if x < 0 || x >= q.size || y < 0 || y >= q.size {
+				continue
+			}
+			d := abs(dx)
+			if abs(dy) > d {
+				d = abs(dy)
+			}
+			q.set(x, y, d != 2 && d != 4)
+		}
+	}
+}
+
+// format - draw the format bits for level M and the mask
+func (q *qrCode) format(mask int) {
+	data := 0<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>uint(i))&1 != 0 }
+
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true)
+}
+
+// place - fill the codewords into the data modules, in the zigzag order
+func (q *qrCode) place(codewords []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if !q.function[y][x] && i < len(codewords)*8 {
+					q.modules[y][x] = (codewords[i/8]>>uint(7-i%8))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+// mask - invert the data modules selected by the mask pattern. Masking
+// twice undoes it.
+func (q *qrCode) mask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// applyBestMask - apply the mask that makes the code easiest to scan
+func (q *qrCode) applyBestMask() {
+	best, lowest := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.mask(mask)
+		q.format(mask)
+		if penalty := q.penalty(); lowest < 0 || penalty < lowest {
+			best, lowest = mask, penalty
+		}
+		q.mask(mask)
+	}
+	q.mask(best)
+	q.format(best)
+}
+
+// penalty - how hard the code is to scan: long runs, blocks, patterns
+// that look like finders, and an imbalance of dark and light
+func (q *qrCode) penalty() int {
+	penalty, dark := 0, 0
+	finderLike := []bool{true, false, true, true, true, false, true}
+	line := func(get func(i int) bool) {
+		run := 1
+		for i := 1; i <= q.size; i++ {
+			if i < q.size && get(i) == get(i-1) {
+				run++
+				continue
+			}
+			if run >= 5 {
+				penalty += 3 + run - 5
+			}
+			run = 1
+		}
+		for i := 0; i+7 <= q.size; i++ {
+			match := true
+			for j, d := range finderLike {
+				match = match && get(i+j) == d
+			}
+			if !match {
+				continue
+			}
+			light := func(from, to int) bool {
+				for k := from; k < to; k++ {
+					if k >= 0 && k < q.size && get(k) {
+						return false
+					}
+				}
+				return true
+			}
+			if light(i-4, i) || light(i+7, i+11) {
+				penalty += 40
+			}
+		}
+	}
+	for y := 0; y < q.size; y++ {
+		line(func(i int) bool { return q.modules[y][i] })
+	}
+	for x := 0; x < q.size; x++ {
+		line(func(i int) bool { return q.modules[i][x] })
+	}
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < q.size && y+1 < q.size {
+				c := q.modules[y][x]
+				if q.modules[y][x+1] == c && q.modules[y+1][x] == c && q.modules[y+1][x+1] == c {
+					penalty += 3
+				}
+			}
+		}
+	}
+	total := q.size * q.size
+	return penalty + abs(dark*100/total-50)/5*10
+}
+
+// svg - the code as an SVG image, with the quiet zone around it
+func (q *qrCode) svg(pixels int) string {
+	var buf bytes.Buffer
+	size := q.size + 8
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, pixels, pixels, size, size)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, size, size)
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x+4, y+4)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.String()
+}
@@ -0,0 +1,180 @@
+package flywheel
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RampUpConfig - after starting, send only part of the users to the
+// backends, and the rest the starting page, until a canary has passed for
+// a while. Protects just started backends from the whole load at once.
+type RampUpConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// Percentage of users let through at first, default 10
+	Percent int `json:"percent"`
+
+	// The share grows to 100% over this time, as long as the canary keeps
+	// passing. A failure starts over. Default 5m.
+	HealthyFor Duration `json:"healthy-for"`
+
+	// Path on the backend, or a full URL, that answers 200 when it can take
+	// load. Without one, only time counts.
+	Canary string `json:"canary"`
+
+	// How often the canary is checked, default 10s
+	Interval Duration `json:"interval"`
+}
+
+// Validate - check the percentage and fill in the defaults
+func (c *RampUpConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Percent < 0 || c.Percent > 100 {
+		return fmt.Errorf("Ramp-up percent must be between 0 and 100, got %d", c.Percent)
+	}
+	if c.Percent == 0 {
+		c.Percent = 10
+	}
+	if c.HealthyFor <= 0 {
+		c.HealthyFor = Duration(5 * time.Minute)
+	}
+	if c.Interval <= 0 {
+		c.Interval = Duration(10 * time.Second)
+	}
+	return nil
+}
+
+// RampUp - tracks how much traffic the backends get after a start. A nil
+// RampUp lets everything through.
+type RampUp struct {
+	fw     *Flywheel
+	config *RampUpConfig
+	client *http.Client
+
+	mu sync.Mutex
+	// Set once the environment was seen not running, so a flywheel restart
+	// doesn't hold back traffic to a running environment
+	ramping      bool
+	passingSince time.Time
+	percent      int
+}
+
+// NewRampUp - create the ramp-up, nil if disabled
+func NewRampUp(fw *Flywheel, config *RampUpConfig) *RampUp {
+	if !config.Enabled {
+		return nil
+	}
+	return &RampUp{
+		fw:      fw,
+		config:  config,
+		client:  &http.Client{Timeout: 5 * time.Second},
+		percent: 100,
+	}
+}
+
+// Run - check the status and the canary every interval
+func (r *RampUp) Run() {
+	for {
+		r.check(r.fw.now())
+		sleep(r.fw.timeSource(), time.Duration(r.config.Interval))
+	}
+}
+
+// check - start over when the environment isn't running, and check the
+// canary while ramping up
+func (r *RampUp) check(now time.Time) {
+	if r.fw.Snapshot().Status != STARTED {
+		r.mu.Lock()
+		r.ramping, r.passingSince, r.percent = true, time.Time{}, r.config.Percent
+		r.mu.Unlock()
+		return
+	}
+
+	r.mu.Lock()
+	ramping := r.ramping
+	r.mu.Unlock()
+	if !ramping {
+		return
+	}
+
+	err := r.canary()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		if !r.passingSince.IsZero() {
+			log.Printf("Ramp-up canary failed, back to %d%%: %v", r.config.Percent, err)
+		}
+		r.passingSince, r.percent = time.Time{}, r.config.Percent
+		return
+	}
+	if r.passingSince.IsZero() {
+		r.passingSince = now
+	}
+	percent := rampPercent(r.config.Percent, time.Duration(r.config.HealthyFor), now.Sub(r.passingSince))
+	if percent != r.percent {
+		log.Printf("Ramp-up: %d%% of users let through", percent)
+	}
+	r.percent = percent
+	if percent == 100 {
+		r.ramping = false
+	}
+}
+
+// rampPercent - the share after the canary has passed for some time
+func rampPercent(start int, healthyFor, passing time.Duration) int {
+	if passing >= healthyFor {
+		return 100
+	}
+	return start + int(int64(100-start)*int64(passing)/int64(healthyFor))
+}
+
+// canary - check the canary answers 200
+func (r *RampUp) canary() error {
+	if r.config.Canary == "" {
+		return nil
+	}
+	url := r.fw.backendURL(r.config.Canary)
+	resp, err := r.client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Canary %s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// Percent - the share of users let through
+func (r *RampUp) Percent() int {
+	if r == nil {
+		return 100
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.percent
+}
+
+// Admit - true if the request's user is let through. Users are bucketed by
+// who they are, so the same users get through as the share grows.
+func (r *RampUp) Admit(req *http.Request) bool {
+	percent := r.Percent()
+	if percent >= 100 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(requestUser(req)))
+	return int(h.Sum32()%100) < percent
+}
+
+// RampUp - the traffic ramp-up, nil if not enabled
+func (fw *Flywheel) RampUp() *RampUp {
+	return fw.rampUp
+}
@@ -0,0 +1,290 @@
+package flywheel
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// RDS resource types
+const (
+	ResourceDBInstance = "db-instance"
+	ResourceDBCluster  = "db-cluster"
+)
+
+// RDSConfig - RDS databases stopped and started with the environment
+type RDSConfig struct {
+	// DB instance identifiers
+	Instances []string `json:"instances"`
+
+	// Aurora DB cluster identifiers. Their instances are stopped and
+	// started with them, so they aren't listed in instances.
+	Clusters []string `json:"clusters"`
+}
+
+// Validate - check each database is configured once
+func (c *RDSConfig) Validate() error {
+	seen := make(map[string]bool)
+	for _, id := range append(append([]string{}, c.Instances...), c.Clusters...) {
+		if id == "" {
+			return fmt.Errorf("Empty RDS identifier")
+		}
+		if seen[id] {
+			return fmt.Errorf("RDS database %s configured more than once", id)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// configured - true if the identifier is a configured DB instance or cluster
+func (c *RDSConfig) configured(id string) bool {
+	return contains(c.Instances, id) || contains(c.Clusters, id)
+}
+
+// States of RDS databases, as the health check counts them. Databases that
+// are backed up or modified still serve. States not listed here make the
+// environment UNHEALTHY.
+var rdsStates = map[string]string{
+	"available":                       "running",
+	"backing-up":                      "running",
+	"modifying":                       "running",
+	"storage-optimization":            "running",
+	"configuring-enhanced-monitoring": "running",
+	"configuring-iam-database-auth":   "running",
+	"configuring-log-exports":         "running",
+	"converting-to-vpc":               "running",
+	"starting":                        "pending",
+	"rebooting":                       "pending",
+	"upgrading":                       "pending",
+	"maintenance":                     "pending",
+	"renaming":                        "pending",
+	"resetting-master-credentials":    "pending",
+	"stopping":                        "stopping",
+	"stopped":                         "stopped",
+}
+
+// rdsFilter - a filter of the describe calls. The vendored SDK only
+// serializes lists with member, so the names of the list and its items are
+// spelled out.
+type rdsFilter struct {
+	_ struct{} `type:"structure"`
+
+	Name   *string   `type:"string"`
+	Values []*string `locationName:"Values.Value" type:"list" flattened:"true"`
+}
+
+type describeDBInstancesInput struct {
+	_ struct{} `type:"structure"`
+
+	Filters []*rdsFilter `locationName:"Filters.Filter" type:"list" flattened:"true"`
+}
+
+type describeDBInstancesOutput struct {
+	_ struct{} `type:"structure"`
+
+	DBInstances []*struct {
+		_ struct{} `type:"structure"`
+
+		DBInstanceIdentifier *string `type:"string"`
+		DBInstanceStatus     *string `type:"string"`
+	} `locationNameList:"DBInstance" type:"list"`
+}
+
+type describeDBClustersInput struct {
+	_ struct{} `type:"structure"`
+
+	Filters []*rdsFilter `locationName:"Filters.Filter" type:"list" flattened:"true"`
+}
+
+type describeDBClustersOutput struct {
+	_ struct{} `type:"structure"`
+
+	DBClusters []*struct {
+		_ struct{} `type:"structure"`
+
+		DBClusterIdentifier *string `type:"string"`
+		Status              *string `type:"string"`
+	} `locationNameList:"DBCluster" type:"list"`
+}
+
+type dbInstanceInput struct {
+	_ struct{} `type:"structure"`
+
+	DBInstanceIdentifier *string `type:"string"`
+}
+
+type dbClusterInput struct {
+	_ struct{} `type:"structure"`
+
+	DBClusterIdentifier *string `type:"string"`
+}
+
+// describeRDS - the RDS status of each configured DB instance and cluster,
+// by type and identifier, in one call for each. Databases that don't exist
+// are left out.
+func (fw *Flywheel) describeRDS() (map[string]string, error) {
+	states := make(map[string]string)
+	if ids := fw.config.RDS.Instances; len(ids) > 0 {
+		var resp describeDBInstancesOutput
+		err := awsCall(fw.rds, "DescribeDBInstances", &describeDBInstancesInput{
+			Filters: []*rdsFilter{{Name: aws.String("db-instance-id"), Values: aws.StringSlice(ids)}},
+		}, &resp)
+		if err != nil {
+			return nil, err
+		}
+		for _, db := range resp.DBInstances {
+			states[ResourceDBInstance+"/"+aws.StringValue(db.DBInstanceIdentifier)] = aws.StringValue(db.DBInstanceStatus)
+		}
+	}
+	if ids := fw.config.RDS.Clusters; len(ids) > 0 {
+		var resp describeDBClustersOutput
+		err := awsCall(fw.rds, "DescribeDBClusters", &describeDBClustersInput{
+			Filters: []*rdsFilter{{Name: aws.String("db-cluster-id"), Values: aws.StringSlice(ids)}},
+		}, &resp)
+		if err != nil {
+			return nil, err
+		}
+		for _, db := range resp.DBClusters {
+			states[ResourceDBCluster+"/"+aws.StringValue(db.DBClusterIdentifier)] = aws.StringValue(db.Status)
+		}
+	}
+	return states, nil
+}
+
+// rdsDatabase - a configured database, and what starts and stops it
+type rdsDatabase struct {
+	kind, id    string
+	start, stop string
+	input       interface{}
+}
+
+// databases - the configured databases, clusters first
+func (c *RDSConfig) databases() []rdsDatabase {
+	var dbs []rdsDatabase
+	for _, id := range c.Clusters {
+		dbs = append(dbs, rdsDatabase{ResourceDBCluster, id, "StartDBCluster", "StopDBCluster",
+			&dbClusterInput{DBClusterIdentifier: aws.String(id)}})
+	}
+	for _, id := range c.Instances {
+		dbs = append(dbs, rdsDatabase{ResourceDBInstance, id, "StartDBInstance", "StopDBInstance",
+			&dbInstanceInput{DBInstanceIdentifier: aws.String(id)}})
+	}
+	return dbs
+}
+
+// name - how the database is named in logs and errors
+func (db rdsDatabase) name() string {
+	if db.kind == ResourceDBCluster {
+		return "DB cluster " + db.id
+	}
+	return "DB instance " + db.id
+}
+
+// startRDS - start the stopped databases. Those already available or
+// starting are left alone. A database that is stopping can't be started
+// until it has stopped.
+func (fw *Flywheel) startRDS() error {
+	if len(fw.config.RDS.Instances)+len(fw.config.RDS.Clusters) == 0 {
+		return nil
+	}
+	states, err := fw.describeRDS()
+	if err != nil {
+		return err
+	}
+	for _, db := range fw.config.RDS.databases() {
+		if fw.config.Observed(db.id) {
+			continue
+		}
+		state, ok := states[db.kind+"/"+db.id]
+		switch {
+		case !ok:
+			return fmt.Errorf("%s not found", db.name())
+		case state != "stopped" && rdsStates[state] != "stopping":
+			continue
+		case state != "stopped":
+			return fmt.Errorf("%s is %s, it can be started once it has stopped", db.name(), state)
+		}
+		fw.logf("Starting %s", db.name())
+		if err := awsCall(fw.rds, db.start, db.input, nil); err != nil {
+			fw.resources.fail(db.kind, db.id, err, fw.now())
+			return err
+		}
+	}
+	return nil
+}
+
+// stopRDS - stop the available databases. Those already stopped or
+// stopping are left alone. A database that is starting can't be stopped
+// until it's available.
+func (fw *Flywheel) stopRDS() error {
+	if len(fw.config.RDS.Instances)+len(fw.config.RDS.Clusters) == 0 {
+		return nil
+	}
+	states, err := fw.describeRDS()
+	if err != nil {
+		return err
+	}
+	for _, db := range fw.config.RDS.databases() {
+		if fw.config.Observed(db.id) {
+			continue
+		}
+		state, ok := states[db.kind+"/"+db.id]
+		switch {
+		case !ok:
+			return fmt.Errorf("%s not found", db.name())
+		case rdsStates[state] == "stopped" || rdsStates[state] == "stopping":
+			continue
+		case state != "available":
+			return fmt.Errorf("%s is %s, it can be stopped once it's available", db.name(), state)
+		}
+		fw.logf("Stopping %s", db.name())
+		if err := awsCall(fw.rds, db.stop, db.input, nil); err != nil {
+			fw.resources.fail(db.kind, db.id, err, fw.now())
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRDS - add the states of the databases to the health. A database
+// that is only available once it's done starting keeps the environment
+// STARTING. One that is missing, or in a state it can't serve or recover
+// from by itself, makes the environment UNHEALTHY.
+func (fw *Flywheel) checkRDS(health *healthStates) error {
+	if len(fw.config.RDS.Instances)+len(fw.config.RDS.Clusters) == 0 {
+		return nil
+	}
+	now := fw.now()
+	states, err := fw.describeRDS()
+	for _, db := range fw.config.RDS.databases() {
+		if err != nil {
+			fw.resources.set(db.kind, db.id, "unknown", err, now)
+			continue
+		}
+		state, ok := states[db.kind+"/"+db.id]
+		if !ok {
+			state = "not-found"
+		}
+		fw.resources.set(db.kind, db.id, state, nil, now)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, db := range fw.config.RDS.databases() {
+		state, ok := states[db.kind+"/"+db.id]
+		if !ok {
+			return fmt.Errorf("%s not found", db.name())
+		}
+		counted := rdsStates[state]
+		if counted == "" {
+			return fmt.Errorf("%s is %s", db.name(), state)
+		}
+		if counted == "running" && fw.config.Observed(db.id) {
+			counted = runningUncontrolled
+		}
+		health.add(db.id, counted, 1)
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package flywheel
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Signed readiness calls older or newer than this are refused, so they
+// can't be replayed
+const readinessSkew = 5 * time.Minute
+
+// GetParameters takes at most this many names
+const ssmBatchSize = 10
+
+// ReadinessConfig - instances signal when they are ready, from userdata,
+// and the environment is only STARTED once they all have. More reliable
+// than probing a port for applications with long warmups.
+type ReadinessConfig struct {
+	// Instances that must signal, default all the running instances
+	Instances []string `json:"instances"`
+
+	// SSM parameter written by an instance when it's ready, with
+	// {instance-id} replaced, e.g. "/flywheel/ready/{instance-id}"
+	SSMParameter string `json:"ssm-parameter"`
+
+	// Secret for signing calls to the ready API
+	Secret Secret `json:"secret"`
+}
+
+// Enabled - true if readiness signals are required
+func (c *ReadinessConfig) Enabled() bool {
+	return c.SSMParameter != "" || c.Secret != ""
+}
+
+// Validate - check the parameter names an instance
+func (c *ReadinessConfig) Validate() error {
+	if c.SSMParameter != "" && !strings.Contains(c.SSMParameter, "{instance-id}") {
+		return fmt.Errorf("Readiness SSM parameter %s must contain {instance-id}", c.SSMParameter)
+	}
+	return nil
+}
+
+// readinessSignature - the signature of a ready call, hex encoded
+func readinessSignature(secret Secret, instanceID string, at int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s:%d", instanceID, at)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// readinessSignals - when each instance last signaled it was ready through
+// the API. Written by the HTTP handlers, read by the health check.
+type readinessSignals struct {
+	mu      sync.Mutex
+	signals map[string]time.Time
+}
+
+func (s *readinessSignals) signal(instanceID string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.signals == nil {
+		s.signals = make(map[string]time.Time)
+	}
+	s.signals[instanceID] = at
+}
+
+func (s *readinessSignals) get(instanceID string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.signals[instanceID]
+}
+
+// apiReady - an instance signals it's ready, with instance, time (Unix
+// seconds) and signature form values. The signature authenticates the call,
+// so it needs no API token.
+func (handler *Handler) apiReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		handler.apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+		return
+	}
+	c := &handler.Flywheel.config.Readiness
+	if c.Secret == "" {
+		handler.apiError(w, http.StatusNotFound, fmt.Errorf("Readiness signals aren't enabled"))
+		return
+	}
+
+	instanceID := r.FormValue("instance")
+	at, err := strconv.ParseInt(r.FormValue("time"), 10, 64)
+	if instanceID == "" || err != nil {
+		handler.apiError(w, http.StatusBadRequest, fmt.Errorf("An instance and a time are required"))
+		return
+	}
+	expected := readinessSignature(c.Secret, instanceID, at)
+	if !hmac.Equal([]byte(expected), []byte(r.FormValue("signature"))) {
+		handler.apiError(w, http.StatusForbidden, fmt.Errorf("Invalid signature"))
+		return
+	}
+	now := handler.Flywheel.now()
+	if skew := now.Sub(time.Unix(at, 0)); skew > readinessSkew || skew < -readinessSkew {
+		handler.apiError(w, http.StatusForbidden, fmt.Errorf("Signature time is off by %v", skew.Truncate(time.Second)))
+		return
+	}
+
+	handler.Flywheel.readiness.signal(instanceID, now)
+	handler.Flywheel.logf("Instance %s signaled it's ready", instanceID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type getParametersInput struct {
+	Names []string `json:"Names"`
+}
+
+type getParametersOutput struct {
+	Parameters []struct {
+		Name             string  `json:"Name"`
+		LastModifiedDate float64 `json:"LastModifiedDate"`
+	} `json:"Parameters"`
+}
+
+// ssmSignals - when each instance last wrote its SSM parameter
+func (fw *Flywheel) ssmSignals(ids []string) (map[string]time.Time, error) {
+	c := &fw.config.Readiness
+	names := make(map[string]string)
+	var all []string
+	for _, id := range ids {
+		name := strings.Replace(c.SSMParameter, "{instance-id}", id, -1)
+		names[name] = id
+		all = append(all, name)
+	}
+
+	signals := make(map[string]time.Time)
+	for len(all) > 0 {
+		n := ssmBatchSize
+		if len(all) < n {
+			n = len(all)
+		}
+		var out getParametersOutput
+		if err := awsCall(fw.ssm, "GetParameters", &getParametersInput{Names: all[:n]}, &out); err != nil {
+			return nil, err
+		}
+		for _, p := range out.Parameters {
+			sec := int64(p.LastModifiedDate)
+			nsec := int64((p.LastModifiedDate - float64(sec)) * 1e9)
+			signals[names[p.Name]] = time.Unix(sec, nsec)
+		}
+		all = all[n:]
+	}
+	return signals, nil
+}
+
+// unready - the running instances that haven't signaled they are ready
+// since they were started. This runs in the health check goroutine.
+func (fw *Flywheel) unready(d *described) []string {
+	c := &fw.config.Readiness
+	var ids []string
+	for id, instance := range d.instances {
+		if instance.State == nil || aws.StringValue(instance.State.Name) != "running" {
+			continue
+		}
+		if len(c.Instances) == 0 || contains(c.Instances, id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	var ssm map[string]time.Time
+	if c.SSMParameter != "" {
+		var err error
+		if ssm, err = fw.ssmSignals(ids); err != nil {
+			fw.logf("Unable to read readiness parameters: %v", err)
+			return ids
+		}
+	}
+
+	var waiting []string
+	for _, id := range ids {
+		if !signaledSince(d.instances[id], fw.readiness.get(id), ssm[id]) {
+			waiting = append(waiting, id)
+		}
+	}
+	return waiting
+}
+
+// signaledSince - true if either signal came after the instance started
+func signaledSince(instance *ec2.Instance, signals ...time.Time) bool {
+	launched := aws.TimeValue(instance.LaunchTime)
+	for _, at := range signals {
+		if !at.IsZero() && at.After(launched) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package flywheel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrReadOnly - a start, stop or scaling change was refused
+var ErrReadOnly = errors.New("Flywheel is read-only during a change freeze, no resources may be started or stopped")
+
+// isReadOnly - true if AWS resources must not be changed. The config
+// switch can't be turned off with the API.
+func (fw *Flywheel) isReadOnly() bool {
+	return fw.config.ReadOnly || fw.readOnly
+}
+
+// setReadOnly - switch read-only mode, from a ping
+func (fw *Flywheel) setReadOnly(readOnly bool, user string) {
+	if fw.readOnly == readOnly {
+		return
+	}
+	fw.readOnly = readOnly
+	fw.SaveState()
+	if readOnly {
+		fw.notify(NotifyReadOnly, "Read-only mode enabled by %s", user)
+	} else {
+		fw.notify(NotifyReadOnly, "Read-only mode disabled by %s", user)
+	}
+}
+
+// authorizeAdmin - check the request has an admin token, writing an error
+// response if not
+func (handler *Handler) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	config := handler.Flywheel.config
+	if len(config.AdminTokens) == 0 {
+		handler.apiError(w, http.StatusForbidden, fmt.Errorf("No admin tokens configured"))
+		return false
+	}
+	token := requestToken(r)
+	for _, t := range config.AdminTokens {
+		if token != "" && string(t) == token {
+			return true
+		}
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="flywheel-admin"`)
+	handler.apiError(w, http.StatusUnauthorized, fmt.Errorf("Admin token required"))
+	return false
+}
+
+// apiReadOnly - switch read-only mode, for admins
+func (handler *Handler) apiReadOnly(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		handler.apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+		return
+	}
+	if !handler.authorizeAdmin(w, r) {
+		return
+	}
+
+	var req struct {
+		ReadOnly bool `json:"read-only"`
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			handler.apiError(w, http.StatusBadRequest, err)
+			return
+		}
+	} else {
+		v, err := strconv.ParseBool(r.FormValue("read-only"))
+		if err != nil {
+			handler.apiError(w, http.StatusBadRequest, fmt.Errorf("Invalid read-only value %q", r.FormValue("read-only")))
+			return
+		}
+		req.ReadOnly = v
+	}
+
+	pong := handler.ping(Ping{readOnly: &req.ReadOnly, user: requestUser(r)})
+	if pong.Err != nil {
+		handler.apiError(w, http.StatusConflict, pong.Err)
+		return
+	}
+	handler.writeJSON(w, http.StatusOK, pong)
+}
@@ -0,0 +1,120 @@
+package flywheel
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Recommendations need at least this many idle gaps to be meaningful
+const minRecommendationSamples = 20
+
+// Recommendation - suggested idle timeout based on the gaps between requests
+type Recommendation struct {
+	Samples     int     `json:"samples"`
+	Percentile  float64 `json:"percentile"`
+	Gap         string  `json:"gap,omitempty"`
+	Current     string  `json:"current"`
+	Recommended string  `json:"recommended,omitempty"`
+	Message     string  `json:"message"`
+}
+
+// RecommendIdleTimeout - look at the gaps between requests since a point in
+// time, and suggest an idle timeout covering the given percentile of them.
+// Only gaps while the environment was STARTED count; the time it was
+// stopped, e.g. overnight, says nothing about the idle timeout.
+func (h *History) RecommendIdleTimeout(current time.Duration, percentile float64, since time.Time) Recommendation {
+	rec := Recommendation{
+		Percentile: percentile,
+		Current:    current.String(),
+	}
+
+	started := startedIntervals(h.Events(HistoryTransition, time.Time{}))
+	var gaps []time.Duration
+	for _, event := range h.Events(HistoryGap, since) {
+		if started.contain(event.Time.Add(-event.Duration), event.Time) {
+			gaps = append(gaps, event.Duration)
+		}
+	}
+	rec.Samples = len(gaps)
+	if len(gaps) < minRecommendationSamples {
+		rec.Message = fmt.Sprintf("Not enough data: %d idle gaps recorded, %d needed", len(gaps), minRecommendationSamples)
+		return rec
+	}
+
+	sort.Sort(durations(gaps))
+	gap := nearestRank(gaps, percentile)
+	rec.Gap = gap.String()
+
+	// Round up to 5 minutes, so there is a margin above the observed gap
+	recommended := (gap/(5*time.Minute) + 1) * 5 * time.Minute
+	rec.Recommended = recommended.String()
+
+	summary := fmt.Sprintf("%g%% of gaps between requests are under %v", percentile, (gap+30*time.Second)/time.Minute*time.Minute)
+	switch {
+	case recommended < current:
+		rec.Message = fmt.Sprintf("%s; consider lowering the idle timeout from %v to %v", summary, current, recommended)
+	case recommended > current:
+		rec.Message = fmt.Sprintf("%s; consider raising the idle timeout from %v to %v", summary, current, recommended)
+	default:
+		rec.Message = fmt.Sprintf("%s; the idle timeout of %v is about right", summary, current)
+	}
+	return rec
+}
+
+// interval - a period of time. A zero end is still open.
+type interval struct {
+	from, to time.Time
+}
+
+type intervals []interval
+
+// startedIntervals - the periods the environment was STARTED, from its
+// transitions. A first transition out of STARTED began at the start of the
+// history.
+func startedIntervals(transitions []HistoryEvent) intervals {
+	var started intervals
+	open := false
+	for i, event := range transitions {
+		switch {
+		case event.To == "STARTED" && !open:
+			started = append(started, interval{from: event.Time})
+			open = true
+		case event.From == "STARTED" && event.To != "STARTED" && (open || i == 0):
+			if !open {
+				started = append(started, interval{})
+			}
+			started[len(started)-1].to = event.Time
+			open = false
+		}
+	}
+	return started
+}
+
+// contain - true if one of the intervals covers from to to
+func (is intervals) contain(from, to time.Time) bool {
+	for _, i := range is {
+		if !from.Before(i.from) && (i.to.IsZero() || !to.After(i.to)) {
+			return true
+		}
+	}
+	return false
+}
+
+// nearestRank - the percentile of sorted durations, by the nearest rank
+func nearestRank(sorted []time.Duration, percentile float64) time.Duration {
+	index := int(float64(len(sorted))*percentile/100+0.5) - 1
+	if index < 0 {
+		index = 0
+	}
+	if index >= len(sorted) {
+		index = len(sorted) - 1
+	}
+	return sorted[index]
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
@@ -0,0 +1,265 @@
+package flywheel
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Kinds of recorded events
+const (
+	RecordState      = "state"
+	RecordPing       = "ping"
+	RecordHealth     = "health"
+	RecordTransition = "transition"
+)
+
+// Recorded ping operations
+const (
+	PingRequest = "request"
+	PingStart   = "start"
+	PingStop    = "stop"
+	PingConfirm = "confirm-stop"
+	PingIdle    = "idle"
+	PingExtend  = "extend"
+	PingStopAt  = "stop-at"
+	PingStopIn  = "stop-in"
+)
+
+// RecordedEvent - an input to, or a transition of, the flywheel goroutine
+type RecordedEvent struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+
+	// Pings
+	Op       string    `json:"op,omitempty"`
+	User     string    `json:"user,omitempty"`
+	Duration Duration  `json:"duration,omitempty"`
+	StopAt   time.Time `json:"stop-at,omitempty"`
+
+	// Health check results, transitions and the initial state
+	From   string `json:"from,omitempty"`
+	Status string `json:"status,omitempty"`
+}
+
+// Recorder - appends everything that changes the state to a file, one JSON
+// object per line, so incidents can be replayed. A nil Recorder records
+// nothing.
+type Recorder struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	closer io.Closer
+}
+
+// OpenRecorder - append to the recording file, creating it if needed
+func OpenRecorder(filename string) (*Recorder, error) {
+	fd, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{enc: json.NewEncoder(fd), closer: fd}, nil
+}
+
+// Record - append an event
+func (r *Recorder) Record(event RecordedEvent) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.enc.Encode(event)
+}
+
+// Close - close the file
+func (r *Recorder) Close() error {
+	if r == nil || r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+// recordPing - a ping as an event. Status requests change nothing and
+// aren't recorded, nor are read-only switches and vhost changes. Backend
+// failures aren't either; the transition they cause is.
+func recordPing(now time.Time, ping Ping) (RecordedEvent, bool) {
+	event := RecordedEvent{Time: now, Kind: RecordPing, User: ping.user}
+	switch {
+	case ping.noop, ping.readOnly != nil, ping.vhost != nil, ping.backendDown != "", ping.annotate:
+		return event, false
+	case ping.requestStart:
+		event.Op = PingStart
+	case ping.requestStop && ping.confirmed:
+		event.Op = PingConfirm
+	case ping.requestStop:
+		event.Op = PingStop
+	case ping.idle:
+		event.Op = PingIdle
+	case ping.extend != 0:
+		event.Op = PingExtend
+		event.Duration = Duration(ping.extend)
+	case !ping.stopAt.IsZero():
+		event.Op = PingStopAt
+		event.StopAt = ping.stopAt
+	case ping.setTimeout != 0:
+		event.Op = PingStopIn
+		event.Duration = Duration(ping.setTimeout)
+	default:
+		event.Op = PingRequest
+	}
+	return event, true
+}
+
+// ping - the recorded ping
+func (e RecordedEvent) ping() Ping {
+	ping := Ping{user: e.User, replyTo: make(chan Pong, 1)}
+	switch e.Op {
+	case PingStart:
+		ping.requestStart = true
+	case PingStop:
+		ping.requestStop = true
+	case PingConfirm:
+		ping.requestStop = true
+		ping.confirmed = true
+	case PingIdle:
+		ping.idle = true
+	case PingExtend:
+		ping.extend = time.Duration(e.Duration)
+	case PingStopAt:
+		ping.stopAt = e.StopAt
+	case PingStopIn:
+		ping.setTimeout = time.Duration(e.Duration)
+	}
+	return ping
+}
+
+// ReadRecording - parse a recording file
+func ReadRecording(r io.Reader) ([]RecordedEvent, error) {
+	var events []RecordedEvent
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		var event RecordedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("Invalid event on line %d: %v", line, err)
+		}
+		events = append(events, event)
+	}
+	return events, scanner.Err()
+}
+
+// neverIdle - stands in for the idle strategy during replays; its decisions
+// were recorded as idle pings
+type neverIdle struct{}
+
+func (neverIdle) Idle(time.Time) (bool, error) { return false, nil }
+
+// Replay - feed recorded events through the state machine, without calling
+// AWS, and print what happens. The idle timeout is checked when it would
+// have expired. Returns the number of transitions that differ from the
+// recording.
+func Replay(config *Config, events []RecordedEvent, out io.Writer) int {
+	// Only the timing settings apply, there are no resources to manage
+	c := &Config{
+		IdleTimeout:         config.IdleTimeout,
+		HcInterval:          config.HcInterval,
+		PollInterval:        config.PollInterval,
+		MaxLifetime:         config.MaxLifetime,
+		MaxExtensionPerDay:  config.MaxExtensionPerDay,
+		MaxExtensionPerUser: config.MaxExtensionPerUser,
+	}
+	// The replay records its transitions, to compare with the recorded ones
+	var replayed bytes.Buffer
+	clock := NewFakeClock(time.Time{})
+	fw := &Flywheel{
+		config:      c,
+		idleTimeout: time.Duration(c.IdleTimeout),
+		hcInterval:  time.Duration(c.HcInterval),
+		clock:       clock,
+		recorder:    &Recorder{enc: json.NewEncoder(&replayed)},
+	}
+	if config.Idle.Type != "" {
+		fw.idle = neverIdle{}
+	}
+	var transitions []RecordedEvent
+	collect := func() {
+		dec := json.NewDecoder(&replayed)
+		for {
+			var t RecordedEvent
+			if dec.Decode(&t) != nil {
+				break
+			}
+			if t.Kind != RecordTransition {
+				continue
+			}
+			fmt.Fprintf(out, "%s   -> %s\n", t.Time.Format(time.RFC3339), t.Status)
+			transitions = append(transitions, t)
+		}
+		replayed.Reset()
+	}
+
+	mismatches := 0
+	for _, event := range events {
+		// Let the idle timeout expire where it would have, between events
+		if fw.status == STARTED && fw.idle == nil && fw.stopAt.Before(event.Time) && !fw.stopAt.IsZero() {
+			clock.Set(fw.stopAt.Add(time.Duration(c.PollInterval)))
+			fmt.Fprintf(out, "%s idle timeout\n", clock.Now().Format(time.RFC3339))
+			fw.Poll()
+			collect()
+		}
+		clock.Set(event.Time)
+		now := event.Time
+
+		switch event.Kind {
+		case RecordState:
+			fw.status, _ = StatusFromString(event.Status)
+			fw.stopAt = event.StopAt
+			fmt.Fprintf(out, "%s state %s, stop at %s\n", now.Format(time.RFC3339), event.Status, event.StopAt.Format(time.RFC3339))
+		case RecordPing:
+			fmt.Fprintf(out, "%s ping %s %s%s\n", now.Format(time.RFC3339), event.Op, event.User, pingArgs(event))
+			ping := event.ping()
+			if ping.requestStart && fw.status == STOPPED {
+				fw.coalesceStart(ping)
+			} else {
+				fw.RecvPing(&ping)
+			}
+		case RecordHealth:
+			fmt.Fprintf(out, "%s health %s\n", now.Format(time.RFC3339), event.Status)
+			status, _ := StatusFromString(event.Status)
+			fw.applyHealth(status)
+		case RecordTransition:
+			switch {
+			case len(transitions) == 0:
+				mismatches++
+				fmt.Fprintf(out, "%s   MISMATCH: recorded %s -> %s, replay stayed %s\n",
+					now.Format(time.RFC3339), event.From, event.Status, StatusString(fw.status))
+			case transitions[0].Status != event.Status:
+				mismatches++
+				fmt.Fprintf(out, "%s   MISMATCH: recorded %s -> %s, replay went to %s\n",
+					now.Format(time.RFC3339), event.From, event.Status, transitions[0].Status)
+				transitions = transitions[1:]
+			default:
+				transitions = transitions[1:]
+			}
+		}
+		collect()
+	}
+	for _, t := range transitions {
+		mismatches++
+		fmt.Fprintf(out, "%s   MISMATCH: not recorded %s -> %s\n", t.Time.Format(time.RFC3339), t.From, t.Status)
+	}
+	return mismatches
+}
+
+func pingArgs(event RecordedEvent) string {
+	switch event.Op {
+	case PingExtend, PingStopIn:
+		return " " + time.Duration(event.Duration).String()
+	case PingStopAt:
+		return " " + event.StopAt.Format(time.RFC3339)
+	}
+	return ""
+}
@@ -0,0 +1,97 @@
+package flywheel
+
+import (
+	"fmt"
+	"time"
+)
+
+// NotifyRecovery - the environment broke while STARTED, and is being
+// restarted
+const NotifyRecovery = "recovery"
+
+// RecoveryConfig - restart the environment when it stops or breaks by
+// itself while STARTED, e.g. an instance shut itself down or crashed
+type RecoveryConfig struct {
+	// Restart attempts before settling into UNHEALTHY. Zero disables.
+	Attempts int `json:"attempts"`
+
+	// Wait between attempts, doubled each time. The first is right away.
+	// Default 1m.
+	Backoff Duration `json:"backoff"`
+}
+
+// Validate - check the attempts and fill in the defaults
+func (c *RecoveryConfig) Validate() error {
+	if c.Attempts < 0 {
+		return fmt.Errorf("Recovery attempts can't be negative, got %d", c.Attempts)
+	}
+	if c.Backoff <= 0 {
+		c.Backoff = Duration(time.Minute)
+	}
+	return nil
+}
+
+// recoveryState - restarts of an environment that broke by itself
+type recoveryState struct {
+	crashed  bool
+	attempts int
+	next     time.Time
+	failed   bool
+}
+
+// recover - restart the environment if it stopped by itself, given the
+// status of a health check. Returns true if the status was handled.
+func (fw *Flywheel) recover(status int) bool {
+	c := &fw.config.Recovery
+	r := &fw.recovery
+	if c.Attempts == 0 || fw.isReadOnly() {
+		return false
+	}
+
+	switch {
+	case status == STARTED:
+		if r.attempts > 0 {
+			fw.notify(NotifyRecovery, "Recovered after %d restart attempts", r.attempts)
+		}
+		*r = recoveryState{}
+		return false
+	case status == STARTING:
+		return false
+	case fw.status == STARTED && status != UNHEALTHY:
+		// UNHEALTHY may only be AWS throttling describe calls, stopped
+		// resources are certain
+		fw.logf("Environment is %s while STARTED, restarting", StatusString(status))
+		r.crashed = true
+	case !r.crashed:
+		return false
+	}
+
+	// Let the resources finish stopping before starting them again
+	if status == STOPPING {
+		return false
+	}
+	if r.failed {
+		fw.setStatus(UNHEALTHY)
+		return true
+	}
+	if r.attempts >= c.Attempts {
+		r.failed = true
+		fw.notify(NotifyRecovery, "Gave up restarting the environment after %d attempts", r.attempts)
+		fw.setStatus(UNHEALTHY)
+		return true
+	}
+
+	now := fw.now()
+	if now.Before(r.next) {
+		fw.setStatus(UNHEALTHY)
+		return true
+	}
+	r.attempts++
+	r.next = now.Add(time.Duration(c.Backoff) << uint(r.attempts-1))
+	fw.notify(NotifyRecovery, "Environment is %s, restart attempt %d of %d", StatusString(status), r.attempts, c.Attempts)
+	fw.because(TriggerRecovery, "")
+	if err := fw.Start(); err != nil {
+		fw.setStatus(UNHEALTHY)
+	}
+	return true
+}
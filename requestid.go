@@ -0,0 +1,79 @@
+package flywheel
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// RequestIDConfig - every request gets an ID, sent to the backend and back
+// to the client, and shown in the logs and on the pages, so the logs of
+// flywheel and the backend can be matched up
+type RequestIDConfig struct {
+	// The header of the ID, default X-Request-ID. An ID in the request is
+	// kept, e.g. from a load balancer in front of flywheel.
+	Header string `json:"header"`
+}
+
+// Validate - fill in the defaults
+func (c *RequestIDConfig) Validate() error {
+	if c.Header == "" {
+		c.Header = "X-Request-ID"
+	}
+	if strings.ContainsAny(c.Header, " :\r\n") {
+		return fmt.Errorf("Invalid request-id header %q", c.Header)
+	}
+	return nil
+}
+
+// Incoming IDs longer than this, or with other characters than these, are
+// replaced, since they end up in logs and pages
+const (
+	maxRequestID   = 128
+	requestIDChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.:/+="
+)
+
+// newRequestID - a random ID
+func newRequestID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// validRequestID - true if an incoming ID can be kept
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestID {
+		return false
+	}
+	for _, c := range id {
+		if !strings.ContainsRune(requestIDChars, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// header - the header of the ID
+func (c *RequestIDConfig) header() string {
+	if c.Header == "" {
+		return "X-Request-ID"
+	}
+	return c.Header
+}
+
+// requestID - give the request an ID, or keep the one it has, and set it
+// on the request and the response
+func (c *RequestIDConfig) requestID(w http.ResponseWriter, r *http.Request) string {
+	header := c.header()
+	id := r.Header.Get(header)
+	if !validRequestID(id) {
+		id = newRequestID()
+		r.Header.Set(header, id)
+	}
+	w.Header().Set(header, id)
+	return id
+}
@@ -0,0 +1,194 @@
+package flywheel
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// Managed resource types
+const (
+	ResourceInstance         = "instance"
+	ResourceAutoScalingGroup = "autoscaling-group"
+)
+
+// ResourceHealth - the health of one managed resource, as of the last
+// health check
+type ResourceHealth struct {
+	Type        string    `json:"type"`
+	ID          string    `json:"id"`
+	State       string    `json:"state"`
+	CheckedAt   time.Time `json:"checked-at"`
+	LastError   string    `json:"last-error,omitempty"`
+	LastErrorAt time.Time `json:"last-error-at,omitempty"`
+
+	// Tagged as stateful, stopping it has to be confirmed
+	Stateful bool `json:"stateful,omitempty"`
+
+	// The Instance Scheduler schedule, other than flywheel's own
+	Schedule string `json:"schedule,omitempty"`
+}
+
+// resourceHealth - the health of all resources. It is written by the health
+// check goroutine and read for the status.
+type resourceHealth struct {
+	mu        sync.Mutex
+	resources map[string]*ResourceHealth
+}
+
+func (h *resourceHealth) get(kind, id string) *ResourceHealth {
+	if h.resources == nil {
+		h.resources = make(map[string]*ResourceHealth)
+	}
+	key := kind + "/" + id
+	r, ok := h.resources[key]
+	if !ok {
+		r = &ResourceHealth{Type: kind, ID: id}
+		h.resources[key] = r
+	}
+	return r
+}
+
+// record - update the states of the described resources. If describing
+// failed, all resources get the error.
+func (h *resourceHealth) record(c *Config, d *described, err error, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, id := range c.Instances {
+		r := h.get(ResourceInstance, id)
+		r.CheckedAt = now
+		if err != nil {
+			r.State = "unknown"
+			r.LastError, r.LastErrorAt = err.Error(), now
+		} else if instance, ok := d.instances[id]; ok {
+			r.State = aws.StringValue(instance.State.Name)
+			r.Stateful = c.StopConfirmation.instanceStateful(instance)
+			r.Schedule = c.InstanceScheduler.foreignSchedule(instanceTags(instance))
+		} else {
+			r.State = "not-found"
+		}
+	}
+
+	groups := append([]string{}, c.AutoScaling.StopGroups()...)
+	for name := range c.AutoScaling.WarmPool {
+		groups = append(groups, name)
+	}
+	for _, name := range groups {
+		r := h.get(ResourceAutoScalingGroup, name)
+		r.CheckedAt = now
+		if err != nil {
+			r.State = "unknown"
+			r.LastError, r.LastErrorAt = err.Error(), now
+		} else if group, ok := d.groups[name]; ok {
+			states := make(map[string]bool)
+			for _, instance := range group.Instances {
+				state := aws.StringValue(instance.LifecycleState)
+				if described, ok := d.instances[aws.StringValue(instance.InstanceId)]; ok {
+					state = aws.StringValue(described.State.Name)
+				}
+				states[state] = true
+			}
+			r.State = groupState(states, aws.Int64Value(group.DesiredCapacity))
+			r.Stateful = c.StopConfirmation.groupStateful(group)
+			r.Schedule = c.InstanceScheduler.foreignSchedule(groupTags(group))
+		} else {
+			r.State = "not-found"
+		}
+	}
+}
+
+// groupState - the common state of the group's instances
+func groupState(states map[string]bool, desired int64) string {
+	switch len(states) {
+	case 0:
+		if desired == 0 {
+			return "empty"
+		}
+		return "pending"
+	case 1:
+		for state := range states {
+			return state
+		}
+	}
+	var list []string
+	for state := range states {
+		list = append(list, state)
+	}
+	sort.Strings(list)
+	return "mixed: " + strings.Join(list, ", ")
+}
+
+// fail - record an error for a single resource
+func (h *resourceHealth) fail(kind, id string, err error, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r := h.get(kind, id)
+	r.LastError, r.LastErrorAt = err.Error(), now
+}
+
+// set - record the state of a resource checked on its own, or the error
+// checking it
+func (h *resourceHealth) set(kind, id, state string, err error, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r := h.get(kind, id)
+	r.CheckedAt = now
+	if err != nil {
+		r.State = "unknown"
+		r.LastError, r.LastErrorAt = err.Error(), now
+		return
+	}
+	r.State = state
+}
+
+// schedule - the foreign Instance Scheduler schedule of a resource, as of
+// the last health check
+func (h *resourceHealth) schedule(kind, id string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if r, ok := h.resources[kind+"/"+id]; ok {
+		return r.Schedule
+	}
+	return ""
+}
+
+// list - the resources, sorted by type and ID
+func (h *resourceHealth) list() []ResourceHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var list []ResourceHealth
+	for _, r := range h.resources {
+		list = append(list, *r)
+	}
+	sort.Sort(resourceList(list))
+	return list
+}
+
+// kinds - the resources of the given types, sorted
+func (h *resourceHealth) kinds(kinds ...string) []ResourceHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var list []ResourceHealth
+	for _, r := range h.resources {
+		if contains(kinds, r.Type) {
+			list = append(list, *r)
+		}
+	}
+	sort.Sort(resourceList(list))
+	return list
+}
+
+type resourceList []ResourceHealth
+
+func (l resourceList) Len() int      { return len(l) }
+func (l resourceList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l resourceList) Less(i, j int) bool {
+	if l[i].Type != l[j].Type {
+		return l[i].Type < l[j].Type
+	}
+	return l[i].ID < l[j].ID
+}
@@ -0,0 +1,370 @@
+package flywheel
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TriggerSchedule - started or stopped at a scheduled time
+const TriggerSchedule = "schedule"
+
+// StopSchedule - stopped at a scheduled time
+const StopSchedule = "schedule"
+
+// Scheduled times are caught up with for this long, e.g. after the host
+// was suspended
+const scheduleCatchUp = 24 * time.Hour
+
+// The next scheduled stop is looked for this far ahead
+const scheduleHorizon = 8 * 24 * time.Hour
+
+// ScheduleConfig - starts and stops at set times, on top of waking on
+// demand, e.g. a warm-up before the workday and a forced stop in the
+// evening. A scheduled start holds the environment up until the next
+// scheduled stop, which stops it even if it's still in use.
+type ScheduleConfig struct {
+	// Cron expressions of the start and stop times: minute, hour, day of
+	// the month, month and day of the week, e.g. "0 8 * * mon-fri"
+	Start []string `json:"start"`
+	Stop  []string `json:"stop"`
+
+	// Weekly windows, as a start and a stop
+	Windows []ScheduleWindow `json:"windows"`
+
+	// Time zone of the times, default local
+	Timezone string `json:"timezone"`
+
+	location      *time.Location
+	starts, stops []cronExpr
+}
+
+// ScheduleWindow - a start and a stop on some days of the week. A stop
+// before the start is on the next day.
+type ScheduleWindow struct {
+	// e.g. "mon-fri" or "sat,sun", default every day
+	Days string `json:"days"`
+
+	// HH:MM, either may be left out
+	Start string `json:"start"`
+	Stop  string `json:"stop"`
+}
+
+// Validate - parse the expressions, windows and time zone
+func (c *ScheduleConfig) Validate() error {
+	c.starts, c.stops = nil, nil
+	for _, expr := range c.Start {
+		cron, err := parseCron(expr)
+		if err != nil {
+			return err
+		}
+		c.starts = append(c.starts, cron)
+	}
+	for _, expr := range c.Stop {
+		cron, err := parseCron(expr)
+		if err != nil {
+			return err
+		}
+		c.stops = append(c.stops, cron)
+	}
+	for _, w := range c.Windows {
+		if err := c.addWindow(w); err != nil {
+			return err
+		}
+	}
+	c.location = time.Local
+	if c.Timezone != "" {
+		loc, err := time.LoadLocation(c.Timezone)
+		if err != nil {
+			return fmt.Errorf("Invalid schedule timezone %s: %v", c.Timezone, err)
+		}
+		c.location = loc
+	}
+	return nil
+}
+
+// addWindow - add the start and stop of a window
+func (c *ScheduleConfig) addWindow(w ScheduleWindow) error {
+	if w.Start == "" && w.Stop == "" {
+		return fmt.Errorf("Schedule window needs a start or a stop")
+	}
+	days := w.Days
+	if days == "" {
+		days = "*"
+	}
+	dow, err := parseCronField(days, 0, 7, cronWeekdays)
+	if err != nil {
+		return fmt.Errorf("Invalid schedule window days %q: %v", w.Days, err)
+	}
+	dow = sundays(dow)
+
+	start := -1
+	if w.Start != "" {
+		if start, err = parseClock(w.Start); err != nil {
+			return err
+		}
+		c.starts = append(c.starts, dailyCron(start, dow))
+	}
+	if w.Stop != "" {
+		stop, err := parseClock(w.Stop)
+		if err != nil {
+			return err
+		}
+		if stop <= start {
+			// Overnight, the stop is on the days after
+			dow = (dow<<1 | dow>>6) & 0x7f
+		}
+		c.stops = append(c.stops, dailyCron(stop, dow))
+	}
+	return nil
+}
+
+// configured - true if anything is scheduled
+func (c *ScheduleConfig) configured() bool {
+	return len(c.starts)+len(c.stops) > 0
+}
+
+// due - the last scheduled start or stop after the last check, up to now.
+// A stop wins over a start at the same minute.
+func (c *ScheduleConfig) due(last, now time.Time) (start bool, at time.Time, ok bool) {
+	if limit := now.Add(-scheduleCatchUp); last.Before(limit) {
+		last = limit
+	}
+	for t := last.Truncate(time.Minute).Add(time.Minute); !t.After(now); t = t.Add(time.Minute) {
+		local := t.In(c.location)
+		if matchesAny(c.stops, local) {
+			start, at, ok = false, t, true
+		} else if matchesAny(c.starts, local) {
+			start, at, ok = true, t, true
+		}
+	}
+	return start, at, ok
+}
+
+// nextStop - the first scheduled stop after a time, if there is one within
+// the horizon
+func (c *ScheduleConfig) nextStop(after time.Time) (time.Time, bool) {
+	if len(c.stops) == 0 {
+		return time.Time{}, false
+	}
+	for t := after.Truncate(time.Minute).Add(time.Minute); t.Before(after.Add(scheduleHorizon)); t = t.Add(time.Minute) {
+		if matchesAny(c.stops, t.In(c.location)) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// pollSchedule - start or stop the environment when a scheduled time has
+// come, and hold it up after a scheduled start
+func (fw *Flywheel) pollSchedule() {
+	s := &fw.config.Schedule
+	if !s.configured() {
+		return
+	}
+	now := fw.now()
+	last := fw.scheduleChecked
+	fw.scheduleChecked = now
+	if last.IsZero() {
+		return
+	}
+	if start, at, ok := s.due(last, now); ok && !fw.isReadOnly() {
+		if start {
+			fw.scheduledStart(at)
+		} else {
+			fw.scheduledStop()
+		}
+	}
+
+	hold := fw.scheduleHold
+	switch {
+	case hold.IsZero():
+	case !now.Before(hold):
+		fw.scheduleHold = time.Time{}
+	case (fw.status == STARTING || fw.status == STARTED) && fw.stopAt.Before(hold):
+		if err := fw.setDeadline(hold); err != nil {
+			// Held as long as it's allowed to run
+			fw.logf("Unable to hold until the scheduled stop: %v", err)
+			fw.scheduleHold = time.Time{}
+		}
+	}
+}
+
+// scheduledStart - start the environment, and hold it up until the next
+// scheduled stop
+func (fw *Flywheel) scheduledStart(at time.Time) {
+	fw.scheduleHold, _ = fw.config.Schedule.nextStop(at)
+	if fw.status != STOPPED {
+		return
+	}
+	fw.logf("Scheduled start")
+	fw.because(TriggerSchedule, "")
+	if err := fw.Start(); err != nil {
+		fw.logf("Unable to start on schedule: %v", err)
+	}
+}
+
+// scheduledStop - stop the environment, whether it's in use or not, unless
+// it's in a blackout window
+func (fw *Flywheel) scheduledStop() {
+	fw.scheduleHold = time.Time{}
+	if fw.status != STARTING && fw.status != STARTED {
+		return
+	}
+	if w := fw.blackout(); w != nil {
+		fw.logf("Scheduled stop skipped for blackout window %s", w.Name)
+		return
+	}
+	fw.logf("Scheduled stop - shutting down")
+	fw.because(TriggerSchedule, "")
+	if err := fw.Stop(); err != nil {
+		fw.logf("Unable to stop on schedule: %v", err)
+	}
+}
+
+// scheduleHeld - true while the environment is held after a scheduled
+// start, so the idle strategy can't stop it
+func (fw *Flywheel) scheduleHeld() bool {
+	return !fw.scheduleHold.IsZero() && fw.now().Before(fw.scheduleHold)
+}
+
+// cronExpr - the minutes, hours, days of the month, months and days of the
+// week a cron expression matches, as bit sets
+type cronExpr struct {
+	minute, hour, dom, month, dow uint64
+
+	// Restricted days of the month and of the week match either, as in cron
+	anyDom, anyDow bool
+}
+
+var cronMonths = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var cronWeekdays = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// parseCron - parse a cron expression of five fields
+func parseCron(expr string) (cronExpr, error) {
+	var c cronExpr
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return c, fmt.Errorf("Invalid cron expression %q: expected 5 fields", expr)
+	}
+	var err error
+	parse := func(field string, min, max int, names map[string]int) uint64 {
+		var bits uint64
+		if err == nil {
+			bits, err = parseCronField(field, min, max, names)
+		}
+		return bits
+	}
+	c.minute = parse(fields[0], 0, 59, nil)
+	c.hour = parse(fields[1], 0, 23, nil)
+	c.dom = parse(fields[2], 1, 31, nil)
+	c.month = parse(fields[3], 1, 12, cronMonths)
+	c.dow = sundays(parse(fields[4], 0, 7, cronWeekdays))
+	if err != nil {
+		return c, fmt.Errorf("Invalid cron expression %q: %v", expr, err)
+	}
+	c.anyDom = fields[2] == "*"
+	c.anyDow = fields[4] == "*"
+	return c, nil
+}
+
+// parseCronField - parse a comma separated list of values, ranges and
+// steps, e.g. "*/15", "mon-fri" or "1,15"
+func parseCronField(field string, min, max int, names map[string]int) (uint64, error) {
+	value := func(s string) (int, error) {
+		if n, ok := names[strings.ToLower(s)]; ok {
+			return n, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("%q is not between %d and %d", s, min, max)
+		}
+		return n, nil
+	}
+
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("Invalid step %q", part[i+1:])
+			}
+			step = n
+			part = part[:i]
+		}
+		from, to := min, max
+		if part != "*" {
+			var err error
+			bounds := strings.SplitN(part, "-", 2)
+			if from, err = value(bounds[0]); err != nil {
+				return 0, err
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = value(bounds[1]); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				to = max
+			}
+			if to < from {
+				return 0, fmt.Errorf("Invalid range %q", part)
+			}
+		}
+		for n := from; n <= to; n += step {
+			bits |= 1 << uint(n)
+		}
+	}
+	return bits, nil
+}
+
+// sundays - 7 is Sunday as well as 0
+func sundays(dow uint64) uint64 {
+	if dow&(1<<7) != 0 {
+		dow |= 1
+	}
+	return dow & 0x7f
+}
+
+// dailyCron - the minute of the day on the days of the week
+func dailyCron(minute int, dow uint64) cronExpr {
+	return cronExpr{
+		minute: 1 << uint(minute%60),
+		hour:   1 << uint(minute/60),
+		dom:    ^uint64(0),
+		month:  ^uint64(0),
+		dow:    dow,
+		anyDom: true,
+	}
+}
+
+// matches - true if the expression matches the minute of the time
+func (c *cronExpr) matches(t time.Time) bool {
+	has := func(bits uint64, n int) bool { return bits&(1<<uint(n)) != 0 }
+	if !has(c.minute, t.Minute()) || !has(c.hour, t.Hour()) || !has(c.month, int(t.Month())) {
+		return false
+	}
+	dom, dow := has(c.dom, t.Day()), has(c.dow, int(t.Weekday()))
+	if c.anyDom || c.anyDow {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// matchesAny - true if any of the expressions matches
+func matchesAny(exprs []cronExpr, t time.Time) bool {
+	for i := range exprs {
+		if exprs[i].matches(t) {
+			return true
+		}
+	}
+	return false
+}
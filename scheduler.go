@@ -0,0 +1,198 @@
+package flywheel
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// DefaultScheduleTag - the tag AWS Instance Scheduler reads the schedule of
+// a resource from
+const DefaultScheduleTag = "Schedule"
+
+// PreviousScheduleTag - the schedule of a resource before flywheel took it
+// over, so it can be given back
+const PreviousScheduleTag = "flywheel:previous-schedule"
+
+// Instance Scheduler modes
+const (
+	SchedulerDefer = "defer"
+	SchedulerOwn   = "own"
+)
+
+// InstanceSchedulerConfig - coexisting with AWS Instance Scheduler, which
+// starts and stops the resources tagged with the name of a schedule
+type InstanceSchedulerConfig struct {
+	// "defer" leaves resources with a schedule to Instance Scheduler, "own"
+	// tags all resources with flywheel's schedule, taking over any with
+	// another. Empty ignores the tags.
+	Mode string `json:"mode"`
+
+	// The tag holding the schedule. Defaults to "Schedule".
+	Tag string `json:"tag"`
+
+	// The schedule resources owned by flywheel are tagged with. Instance
+	// Scheduler leaves resources with schedules it doesn't know alone.
+	// Defaults to "flywheel".
+	Schedule string `json:"schedule"`
+}
+
+// Validate - check the mode and fill in the defaults
+func (c *InstanceSchedulerConfig) Validate() error {
+	switch c.Mode {
+	case "", SchedulerDefer, SchedulerOwn:
+	default:
+		return fmt.Errorf("Unknown instance scheduler mode %s: expected %s or %s", c.Mode, SchedulerDefer, SchedulerOwn)
+	}
+	if c.Tag == "" {
+		c.Tag = DefaultScheduleTag
+	}
+	if c.Schedule == "" {
+		c.Schedule = "flywheel"
+	}
+	return nil
+}
+
+// SchedulerConflict - a resource Instance Scheduler also has a schedule for
+type SchedulerConflict struct {
+	Type     string `json:"type"`
+	ID       string `json:"id"`
+	Schedule string `json:"schedule"`
+
+	// "defer" when flywheel leaves the resource alone, "own" when it took
+	// the resource over
+	Action string `json:"action"`
+}
+
+// foreignSchedule - the Instance Scheduler schedule of a resource with the
+// tags, other than flywheel's own. Once taken over, it's the previous one.
+func (c *InstanceSchedulerConfig) foreignSchedule(tags map[string]string) string {
+	if c.Mode == "" {
+		return ""
+	}
+	if previous := tags[PreviousScheduleTag]; previous != "" && c.Mode == SchedulerOwn {
+		return previous
+	}
+	if schedule := tags[c.Tag]; schedule != c.Schedule {
+		return schedule
+	}
+	return ""
+}
+
+// instanceTags - the tags of the described instance
+func instanceTags(instance *ec2.Instance) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range instance.Tags {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return tags
+}
+
+// groupTags - the tags of the described group
+func groupTags(group *autoscaling.Group) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range group.Tags {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return tags
+}
+
+// deferred - true if the resource is left to Instance Scheduler. Tags are
+// known from the last health check, so groups in `autoscaling`/`terminate`
+// are never deferred.
+func (fw *Flywheel) deferred(kind, id string) bool {
+	return fw.config.InstanceScheduler.Mode == SchedulerDefer && fw.resources.schedule(kind, id) != ""
+}
+
+// undeferred - the instances not left to Instance Scheduler
+func (fw *Flywheel) undeferred(ids []string) []string {
+	var result []string
+	for _, id := range ids {
+		if !fw.deferred(ResourceInstance, id) {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// schedulerConflicts - the resources Instance Scheduler also has a schedule
+// for, and what flywheel does about it
+func (fw *Flywheel) schedulerConflicts() []SchedulerConflict {
+	c := fw.config
+	var conflicts []SchedulerConflict
+	for _, r := range fw.resources.list() {
+		if r.Schedule == "" || c.Observed(r.ID) {
+			continue
+		}
+		conflicts = append(conflicts, SchedulerConflict{Type: r.Type, ID: r.ID, Schedule: r.Schedule, Action: c.InstanceScheduler.Mode})
+	}
+	return conflicts
+}
+
+// ownSchedules - tag the described resources with flywheel's schedule,
+// keeping any other schedule in the previous schedule tag
+func (fw *Flywheel) ownSchedules(d *described) {
+	c := &fw.config.InstanceScheduler
+	if c.Mode != SchedulerOwn || fw.Snapshot().ReadOnly {
+		return
+	}
+
+	// The tags to set, if the resource isn't tagged with them yet
+	retag := func(kind, id string, tags map[string]string) map[string]string {
+		current := tags[c.Tag]
+		if current == c.Schedule {
+			return nil
+		}
+		set := map[string]string{c.Tag: c.Schedule}
+		if current != "" {
+			fw.logf("Taking over %s %s from Instance Scheduler schedule %s", kind, id, current)
+			set[PreviousScheduleTag] = current
+		}
+		return set
+	}
+
+	for _, id := range fw.config.Instances {
+		instance, ok := d.instances[id]
+		if !ok || fw.config.Observed(id) {
+			continue
+		}
+		set := retag(ResourceInstance, id, instanceTags(instance))
+		if set == nil {
+			continue
+		}
+		input := &ec2.CreateTagsInput{Resources: aws.StringSlice([]string{id})}
+		for key, value := range set {
+			input.Tags = append(input.Tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(value)})
+		}
+		if _, err := fw.ec2.CreateTags(input); err != nil {
+			fw.logf("Unable to tag instance %s: %v", id, err)
+			fw.resources.fail(ResourceInstance, id, err, fw.now())
+		}
+	}
+
+	for name, group := range d.groups {
+		if fw.config.Observed(name) {
+			continue
+		}
+		set := retag(ResourceAutoScalingGroup, name, groupTags(group))
+		if set == nil {
+			continue
+		}
+		input := &autoscaling.CreateOrUpdateTagsInput{}
+		for key, value := range set {
+			input.Tags = append(input.Tags, &autoscaling.Tag{
+				ResourceId:        aws.String(name),
+				ResourceType:      aws.String("auto-scaling-group"),
+				Key:               aws.String(key),
+				Value:             aws.String(value),
+				PropagateAtLaunch: aws.Bool(true),
+			})
+		}
+		if _, err := fw.autoscaling.CreateOrUpdateTags(input); err != nil {
+			fw.logf("Unable to tag autoscaling group %s: %v", name, err)
+			fw.resources.fail(ResourceAutoScalingGroup, name, err, fw.now())
+		}
+	}
+}
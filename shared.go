@@ -0,0 +1,179 @@
+package flywheel
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// SharedConfig - instances shared with other environments. Each environment
+// holds a reference to the shared instances while it's running; they're
+// stopped when the last reference is released.
+type SharedConfig struct {
+	// Name of this environment, unique among the environments sharing
+	Holder    string            `json:"holder"`
+	Instances []string          `json:"instances"`
+	Directory string            `json:"directory"`
+	Redis     *RedisStateConfig `json:"redis"`
+}
+
+// Validate - check the shared instances are configured instances, and there
+// is exactly one place to keep the references
+func (c *SharedConfig) Validate(instances []string) error {
+	if len(c.Instances) == 0 {
+		return nil
+	}
+	if c.Holder == "" {
+		return fmt.Errorf("Shared instances need a holder name")
+	}
+	if (c.Directory == "") == (c.Redis == nil) {
+		return fmt.Errorf("Shared instances need either a directory or redis")
+	}
+	if c.Redis != nil && c.Redis.Address == "" {
+		return fmt.Errorf("Shared instances need a redis address")
+	}
+	for _, id := range c.Instances {
+		if !contains(instances, id) {
+			return fmt.Errorf("Shared instance %s isn't in instances", id)
+		}
+	}
+	return nil
+}
+
+// RefCounter - tracks which environments hold a shared resource. Holding is
+// idempotent, so a restarted flywheel doesn't count twice.
+type RefCounter interface {
+	// Acquire - add a holder, returning the number of holders
+	Acquire(resource, holder string) (int, error)
+	// Release - remove a holder, returning the number of remaining holders
+	Release(resource, holder string) (int, error)
+}
+
+func newRefCounter(c *SharedConfig) RefCounter {
+	switch {
+	case len(c.Instances) == 0:
+		return nil
+	case c.Redis != nil:
+		return &RedisRefCounter{store: NewRedisStateStore(c.Redis)}
+	default:
+		return DirRefCounter(c.Directory)
+	}
+}
+
+// DirRefCounter - keeps holders as files in a directory per resource. The
+// directory must be shared between the environments, e.g. on NFS.
+type DirRefCounter string
+
+// Acquire - create the holder's file
+func (d DirRefCounter) Acquire(resource, holder string) (int, error) {
+	dir := filepath.Join(string(d), resource)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, holder), nil, 0644); err != nil {
+		return 0, err
+	}
+	return d.count(dir)
+}
+
+// Release - remove the holder's file
+func (d DirRefCounter) Release(resource, holder string) (int, error) {
+	dir := filepath.Join(string(d), resource)
+	err := os.Remove(filepath.Join(dir, holder))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	return d.count(dir)
+}
+
+func (d DirRefCounter) count(dir string) (int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	return len(files), err
+}
+
+// Add or remove a holder and count the remaining ones in one step
+const (
+	redisAcquireScript = `redis.call("sadd", KEYS[1], ARGV[1]) return redis.call("scard", KEYS[1])`
+	redisReleaseScript = `redis.call("srem", KEYS[1], ARGV[1]) return redis.call("scard", KEYS[1])`
+)
+
+// RedisRefCounter - keeps holders in a Redis set per resource. The key is
+// used as a prefix for the sets.
+type RedisRefCounter struct {
+	store *RedisStateStore
+}
+
+// Acquire - add the holder to the resource's set
+func (r *RedisRefCounter) Acquire(resource, holder string) (int, error) {
+	return r.eval(redisAcquireScript, resource, holder)
+}
+
+// Release - remove the holder from the resource's set
+func (r *RedisRefCounter) Release(resource, holder string) (int, error) {
+	return r.eval(redisReleaseScript, resource, holder)
+}
+
+func (r *RedisRefCounter) eval(script, resource, holder string) (int, error) {
+	key := r.store.config.Key + resource
+	reply, err := r.store.command("EVAL", script, "1", key, holder)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("Unexpected Redis reply %v", reply)
+	}
+	return int(n), nil
+}
+
+// acquireShared - take a reference to every shared instance. The instances
+// are started along with the others.
+func (fw *Flywheel) acquireShared() error {
+	shared := fw.config.Shared
+	for _, id := range shared.Instances {
+		count, err := fw.refs.Acquire(id, shared.Holder)
+		if err != nil {
+			return err
+		}
+		fw.logf("Shared instance %s held by %d environments", id, count)
+	}
+	return nil
+}
+
+// releaseShared - drop the references to the shared instances, stopping
+// the ones nobody else holds
+func (fw *Flywheel) releaseShared() error {
+	shared := fw.config.Shared
+	var ids []string
+	for _, id := range shared.Instances {
+		count, err := fw.refs.Release(id, shared.Holder)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			fw.logf("Shared instance %s still held by %d environments", id, count)
+			continue
+		}
+		if !fw.config.Observed(id) {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	fw.logf("Stopping shared instances %v", ids)
+	_, err := fw.ec2.StopInstances(
+		&ec2.StopInstancesInput{
+			InstanceIds: aws.StringSlice(ids),
+		},
+	)
+	return err
+}
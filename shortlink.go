@@ -0,0 +1,131 @@
+package flywheel
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ShortLinkPrefix - the path of short links
+const ShortLinkPrefix = "/flywheel/m/"
+
+// ShortLinksConfig - the stopped page shows a short link to start the
+// environment, and a QR code of it, so someone can start it and follow the
+// startup from their phone. Links are signed and expire.
+type ShortLinksConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// Secret for signing the links. Without one a random secret is used,
+	// and links stop working when flywheel restarts.
+	Secret Secret `json:"secret"`
+
+	// Links expire after this long, default 1h
+	TTL Duration `json:"ttl"`
+}
+
+// Validate - fill in the defaults
+func (c *ShortLinksConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Secret == "" {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			return fmt.Errorf("Unable to generate a short link secret: %v", err)
+		}
+		c.Secret = Secret(hex.EncodeToString(buf))
+	}
+	if c.TTL <= 0 {
+		c.TTL = Duration(time.Hour)
+	}
+	return nil
+}
+
+// shortLinkSignature - the signature of a link to the target, expiring at
+// the time in base 36
+func shortLinkSignature(secret Secret, expires, target string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s:%s", expires, target)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// localPath - true for a path on this site. Browsers take "//host" and
+// "/\host" as another site.
+func localPath(target string) bool {
+	return strings.HasPrefix(target, "/") && (len(target) == 1 || (target[1] != '/' && target[1] != '\\'))
+}
+
+// shortLink - a signed link that starts the environment and then shows the
+// target, the path and query of the request
+func (handler *Handler) shortLink(r *http.Request, target string) string {
+	c := &handler.Flywheel.config.ShortLinks
+	expires := strconv.FormatInt(handler.Flywheel.now().Add(time.Duration(c.TTL)).Unix(), 36)
+	scheme := "http"
+	if isHTTPS(r) {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s%s.%s%s", scheme, r.Host, ShortLinkPrefix, expires, shortLinkSignature(c.Secret, expires, target), target)
+}
+
+// serveShortLink - check the link, and redirect to its target with a start
+// request. The start goes through the same checks as the stopped page's
+// link.
+func (handler *Handler) serveShortLink(w http.ResponseWriter, r *http.Request) {
+	c := &handler.Flywheel.config.ShortLinks
+	lang := handler.Flywheel.config.Language(r)
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	if !c.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+
+	token := strings.TrimPrefix(r.URL.RequestURI(), ShortLinkPrefix)
+	target := "/"
+	if i := strings.IndexByte(token, '/'); i >= 0 {
+		token, target = token[:i], token[i:]
+	}
+	parts := strings.SplitN(token, ".", 2)
+	expires, err := strconv.ParseInt(parts[0], 36, 64)
+	if len(parts) != 2 || err != nil || !localPath(target) || !hmac.Equal([]byte(parts[1]), []byte(shortLinkSignature(c.Secret, parts[0], target))) {
+		handler.page(w, http.StatusForbidden, HTMLERROR, lang, "link.invalid", nil)
+		return
+	}
+	if handler.Flywheel.now().After(time.Unix(expires, 0)) {
+		handler.page(w, http.StatusForbidden, HTMLERROR, lang, "link.expired", nil)
+		return
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		handler.page(w, http.StatusBadRequest, HTMLERROR, lang, "link.invalid", nil)
+		return
+	}
+	query := u.Query()
+	query.Set("flywheel", "start")
+	u.RawQuery = query.Encode()
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
+
+// shortLinkBody - the short link to the target and its QR code, for the
+// stopped page
+func (handler *Handler) shortLinkBody(r *http.Request, target, lang string) string {
+	link := handler.shortLink(r, target)
+	escaped := html.EscapeString(link)
+	body := fmt.Sprintf(handler.Flywheel.config.Message(lang, "stopped.mobile"), `<a href="`+escaped+`">`+escaped+`</a>`)
+	qr, err := encodeQR([]byte(link))
+	if err != nil {
+		// Too long a path for a QR code, the link still works
+		handler.Flywheel.logf("%v", err)
+		return body
+	}
+	return body + "<br><br>" + qr.svg(200)
+}
@@ -0,0 +1,63 @@
+package flywheel
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// startStage - instances started together, a delay after the previous stage
+type startStage struct {
+	delay     time.Duration
+	instances []string
+}
+
+// startStages - split the instances into stages. Instances are started in
+// the configured order; one with a delay begins a new stage that long after
+// the previous one, the others join the current stage.
+func (c *Config) startStages() []startStage {
+	var stages []startStage
+	for _, id := range c.controlledInstances() {
+		delay, ok := c.InstanceDelays[id]
+		if len(stages) == 0 || ok {
+			stages = append(stages, startStage{delay: time.Duration(delay)})
+		}
+		stage := &stages[len(stages)-1]
+		stage.instances = append(stage.instances, id)
+	}
+	return stages
+}
+
+// startStage - start the instances of one stage
+func (fw *Flywheel) startStage(stage startStage) error {
+	ids := fw.undeferred(stage.instances)
+	if len(ids) == 0 {
+		return nil
+	}
+	fw.logf("Starting instances %v", ids)
+	_, err := fw.ec2.StartInstances(
+		&ec2.StartInstancesInput{
+			InstanceIds: aws.StringSlice(ids),
+		},
+	)
+	return err
+}
+
+// startPendingStage - start the next stage once its delay has passed
+func (fw *Flywheel) startPendingStage() {
+	if len(fw.pendingStages) == 0 || fw.now().Before(fw.nextStageAt) || fw.isReadOnly() {
+		return
+	}
+
+	stage := fw.pendingStages[0]
+	fw.pendingStages = fw.pendingStages[1:]
+	if err := fw.startStage(stage); err != nil {
+		fw.logf("Error starting: %v", err)
+		fw.pendingStages = nil
+		return
+	}
+	if len(fw.pendingStages) > 0 {
+		fw.nextStageAt = fw.now().Add(fw.pendingStages[0].delay)
+	}
+}
@@ -0,0 +1,140 @@
+package flywheel
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StartupLimitConfig - limit the request rate right after the environment
+// has started, when many waiting browsers reload at once
+type StartupLimitConfig struct {
+	// How long after STARTED the limits apply
+	Duration Duration `json:"duration"`
+
+	// Requests per second, in total and per client. Zero is unlimited.
+	Global    float64 `json:"global"`
+	PerClient float64 `json:"per-client"`
+
+	// Requests allowed at once before the rates apply, default 1
+	Burst int `json:"burst"`
+
+	// IPv6 clients are limited per network of this prefix length, default
+	// 64. 128 limits each address.
+	IPv6Prefix int `json:"ipv6-prefix"`
+}
+
+// Enabled - true if requests are limited after starting
+func (c *StartupLimitConfig) Enabled() bool {
+	return c.Duration > 0 && (c.Global > 0 || c.PerClient > 0)
+}
+
+// Validate - check the rates and fill in the defaults
+func (c *StartupLimitConfig) Validate() error {
+	if c.Global < 0 || c.PerClient < 0 || c.Burst < 0 {
+		return fmt.Errorf("Startup limit rates and burst can't be negative")
+	}
+	if c.IPv6Prefix < 0 || c.IPv6Prefix > 128 {
+		return fmt.Errorf("Startup limit ipv6-prefix must be between 0 and 128, got %d", c.IPv6Prefix)
+	}
+	if c.Burst == 0 {
+		c.Burst = 1
+	}
+	if c.IPv6Prefix == 0 {
+		c.IPv6Prefix = 64
+	}
+	return nil
+}
+
+// tokenBucket - allows rate requests per second, and burst at once
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill - add the tokens earned since the last request
+func (b *tokenBucket) refill(rate float64, burst int, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+}
+
+// wait - how long until there is a token, zero if there is one
+func (b *tokenBucket) wait(rate float64) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// startupLimiter - the buckets for the current start
+type startupLimiter struct {
+	mu        sync.Mutex
+	startedAt time.Time
+	global    tokenBucket
+	clients   map[string]*tokenBucket
+}
+
+// allow - true if the request is within the limits. Otherwise, how long the
+// client should wait.
+func (l *startupLimiter) allow(c *StartupLimitConfig, startedAt time.Time, name string, now time.Time) (bool, time.Duration) {
+	if !c.Enabled() || startedAt.IsZero() || now.Sub(startedAt) >= time.Duration(c.Duration) {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.startedAt.Equal(startedAt) {
+		l.startedAt = startedAt
+		l.global = tokenBucket{}
+		l.clients = make(map[string]*tokenBucket)
+	}
+
+	// A token is only taken if both limits allow the request
+	var client *tokenBucket
+	var wait time.Duration
+	if c.PerClient > 0 {
+		client = l.clients[name]
+		if client == nil {
+			client = &tokenBucket{}
+			l.clients[name] = client
+		}
+		client.refill(c.PerClient, c.Burst, now)
+		wait = client.wait(c.PerClient)
+	}
+	if c.Global > 0 {
+		l.global.refill(c.Global, c.Burst, now)
+		if w := l.global.wait(c.Global); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	if client != nil {
+		client.tokens--
+	}
+	if c.Global > 0 {
+		l.global.tokens--
+	}
+	return true, 0
+}
+
+// limitStartup - answer 429 with Retry-After if the request is over the
+// startup limits. Returns true if it was.
+func (handler *Handler) limitStartup(w http.ResponseWriter, r *http.Request, pong Pong) bool {
+	c := &handler.Flywheel.config.StartupLimit
+	ok, wait := handler.startup.allow(c, pong.StartedAt, clientNetwork(requestUser(r), c.IPv6Prefix), handler.Flywheel.now())
+	if ok {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Just started, too many requests. Please retry shortly.", http.StatusTooManyRequests)
+	return true
+}
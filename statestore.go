@@ -0,0 +1,268 @@
+package flywheel
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// ErrNoState - nothing has been saved to the state store yet
+var ErrNoState = errors.New("No saved state")
+
+// ErrStateConflict - the saved state was changed by another writer
+var ErrStateConflict = errors.New("Saved state was changed by another writer")
+
+// ErrDeferred - another flywheel process changed the state first, e.g. the
+// old one during a deploy, so this one leaves the transition to it
+var ErrDeferred = errors.New("Another flywheel changed the state first, deferring to it")
+
+// StateStore - where the runtime status is kept between restarts
+type StateStore interface {
+	Load() (Pong, error)
+	Save(Pong) error
+}
+
+// StateStoreConfig - which state store to use. The status file is used when
+// none is configured.
+type StateStoreConfig struct {
+	S3    *S3StateConfig    `json:"s3"`
+	Redis *RedisStateConfig `json:"redis"`
+	Etcd  *EtcdStateConfig  `json:"etcd"`
+}
+
+// S3StateConfig - location of the state object in S3
+type S3StateConfig struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Region string `json:"region"`
+}
+
+// Validate - check only one state store is configured, and it's complete
+func (c *StateStoreConfig) Validate() error {
+	count := 0
+	if s3 := c.S3; s3 != nil {
+		count++
+		if s3.Bucket == "" || s3.Key == "" {
+			return fmt.Errorf("S3 state store needs a bucket and key")
+		}
+	}
+	if redis := c.Redis; redis != nil {
+		count++
+		if redis.Address == "" || redis.Key == "" {
+			return fmt.Errorf("Redis state store needs an address and key")
+		}
+	}
+	if etcd := c.Etcd; etcd != nil {
+		count++
+		if etcd.Endpoint == "" || etcd.Key == "" {
+			return fmt.Errorf("etcd state store needs an endpoint and key")
+		}
+	}
+	if count > 1 {
+		return fmt.Errorf("Only one state store may be configured")
+	}
+	return nil
+}
+
+func newStateStore(config *Config, sess *session.Session) StateStore {
+	switch {
+	case config.StateStore.S3 != nil:
+		return NewS3StateStore(sess, config.StateStore.S3, config.Region)
+	case config.StateStore.Redis != nil:
+		return NewRedisStateStore(config.StateStore.Redis)
+	case config.StateStore.Etcd != nil:
+		return NewEtcdStateStore(config.StateStore.Etcd)
+	}
+	return nil
+}
+
+// LoadState - restore the state from the state store, if there is one
+func (fw *Flywheel) LoadState() {
+	if fw.store == nil {
+		return
+	}
+	status, err := fw.store.Load()
+	if err == ErrNoState {
+		return
+	}
+	if err != nil {
+		fw.logf("Unable to load state: %v", err)
+		return
+	}
+	fw.restore(status)
+}
+
+// SaveState - save the current state to the state store, if there is one
+func (fw *Flywheel) SaveState() {
+	if fw.store == nil {
+		return
+	}
+	if err := fw.store.Save(fw.statusPong()); err != nil {
+		fw.logf("Unable to save state: %v", err)
+	}
+}
+
+// claim - save the state with the transition about to be made, before
+// calling AWS. With a shared state store, of two flywheels making a
+// transition at once only the first to save goes ahead; the other picks up
+// its state and defers.
+func (fw *Flywheel) claim(status int) error {
+	if fw.store == nil {
+		return nil
+	}
+	pong := fw.statusPong()
+	pong.Status = status
+	pong.StatusName = StatusString(status)
+	err := fw.store.Save(pong)
+	if err == ErrStateConflict {
+		fw.logf("State changed by another flywheel, deferring %s to it", StatusString(status))
+		fw.LoadState()
+		return ErrDeferred
+	}
+	if err != nil {
+		// Without the store there's nobody to coordinate with
+		fw.logf("Unable to save state: %v", err)
+	}
+	return nil
+}
+
+// FileStateStore - keeps the state in a local JSON file
+type FileStateStore string
+
+// Load - read the state file
+func (f FileStateStore) Load() (Pong, error) {
+	var status Pong
+	buf, err := ioutil.ReadFile(string(f))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return status, ErrNoState
+		}
+		return status, err
+	}
+	err = json.Unmarshal(buf, &status)
+	return status, err
+}
+
+// Save - replace the state file
+func (f FileStateStore) Save(status Pong) error {
+	buf, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(string(f), buf)
+}
+
+// S3StateStore - keeps the state in an S3 object. Writes are conditional on
+// the object's ETag, so a second writer is detected instead of silently
+// overwritten. Enable versioning on the bucket to keep old states.
+type S3StateStore struct {
+	url    string
+	region string
+	signer *v4.Signer
+	client *http.Client
+	etag   string
+}
+
+// NewS3StateStore - create a state store for an S3 object
+func NewS3StateStore(sess *session.Session, config *S3StateConfig, region string) *S3StateStore {
+	if config.Region != "" {
+		region = config.Region
+	}
+	return &S3StateStore{
+		url:    s3URL(sess.Config, config.Bucket, config.Key, region),
+		region: region,
+		signer: v4.NewSigner(sess.Config.Credentials),
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Load - fetch the state object
+func (s *S3StateStore) Load() (Pong, error) {
+	var status Pong
+
+	resp, err := s.do("GET", nil, nil)
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		s.etag = ""
+		return status, ErrNoState
+	default:
+		return status, s3Error(resp)
+	}
+
+	s.etag = resp.Header.Get("ETag")
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	return status, err
+}
+
+// Save - replace the state object, if nobody else has changed it since it
+// was last read or written
+func (s *S3StateStore) Save(status Pong) error {
+	buf, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{"Content-Type": {"application/json"}}
+	if s.etag != "" {
+		header.Set("If-Match", s.etag)
+	} else {
+		header.Set("If-None-Match", "*")
+	}
+
+	resp, err := s.do("PUT", header, buf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		s.etag = resp.Header.Get("ETag")
+		return nil
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		// Pick up the other writer's version, so the next save isn't
+		// refused as well
+		if head, err := s.do("HEAD", nil, nil); err == nil {
+			head.Body.Close()
+			if head.StatusCode == http.StatusOK {
+				s.etag = head.Header.Get("ETag")
+			}
+		}
+		return ErrStateConflict
+	default:
+		return s3Error(resp)
+	}
+}
+
+func (s *S3StateStore) do(method string, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range header {
+		req.Header[key] = value
+	}
+	if _, err = s.signer.Sign(req, bytes.NewReader(body), "s3", s.region, time.Now()); err != nil {
+		return nil, err
+	}
+	return s.client.Do(req)
+}
+
+func s3Error(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("S3 %s: %s", resp.Status, bytes.TrimSpace(body))
+}
@@ -0,0 +1,241 @@
+package flywheel
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EtcdStateConfig - location of the state in etcd. The v3 JSON gateway is
+// used, so no client library is needed.
+type EtcdStateConfig struct {
+	Endpoint string `json:"endpoint"`
+	Key      string `json:"key"`
+}
+
+// EtcdStateStore - keeps the state in an etcd key. Saves are transactions
+// on the key's revision, so a second writer is detected instead of silently
+// overwritten. Locks are keys attached to a lease, so they disappear when
+// the lease isn't kept alive.
+type EtcdStateStore struct {
+	config *EtcdStateConfig
+	client *http.Client
+
+	mu    sync.Mutex
+	lease string
+
+	// Revision of the state last read or written, empty if there was none
+	revision string
+}
+
+// NewEtcdStateStore - create a state store for an etcd key
+func NewEtcdStateStore(config *EtcdStateConfig) *EtcdStateStore {
+	return &EtcdStateStore{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type etcdKeyValue struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	ModRevision string `json:"mod_revision"`
+}
+
+// Load - read the state key
+func (s *EtcdStateStore) Load() (Pong, error) {
+	var status Pong
+	kv, err := s.rangeKey(s.config.Key)
+	if err != nil {
+		return status, err
+	}
+	if kv == nil {
+		s.revision = ""
+		return status, ErrNoState
+	}
+	s.revision = kv.ModRevision
+	value, err := base64.StdEncoding.DecodeString(kv.Value)
+	if err != nil {
+		return status, err
+	}
+	err = json.Unmarshal(value, &status)
+	return status, err
+}
+
+// Save - replace the state key, if nobody else has changed it since it was
+// last read or written
+func (s *EtcdStateStore) Save(status Pong) error {
+	buf, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	key := etcdEncode(s.config.Key)
+	compare := map[string]interface{}{"key": key, "target": "MOD", "mod_revision": s.revision}
+	if s.revision == "" {
+		compare = map[string]interface{}{"key": key, "target": "CREATE", "create_revision": "0"}
+	}
+	txn := map[string]interface{}{
+		"compare": []map[string]interface{}{compare},
+		"success": []map[string]interface{}{
+			{"request_put": map[string]string{"key": key, "value": etcdEncode(string(buf))}},
+		},
+	}
+	var result struct {
+		Header struct {
+			Revision string `json:"revision"`
+		} `json:"header"`
+		Succeeded bool `json:"succeeded"`
+	}
+	if err := s.call("/v3/kv/txn", txn, &result); err != nil {
+		return err
+	}
+	if result.Succeeded {
+		s.revision = result.Header.Revision
+		return nil
+	}
+
+	// Pick up the other writer's revision, so the next save isn't refused
+	// as well
+	kv, err := s.rangeKey(s.config.Key)
+	if err != nil {
+		return err
+	}
+	s.revision = ""
+	if kv != nil {
+		s.revision = kv.ModRevision
+	}
+	return ErrStateConflict
+}
+
+// TryLock - take or refresh the lock. The lock key only gets created if it
+// doesn't exist yet.
+func (s *EtcdStateStore) TryLock(owner string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lease != "" {
+		var keepalive struct {
+			Result struct {
+				TTL string `json:"TTL"`
+			} `json:"result"`
+		}
+		err := s.call("/v3/lease/keepalive", map[string]string{"ID": s.lease}, &keepalive)
+		if err != nil || keepalive.Result.TTL == "" || keepalive.Result.TTL == "0" {
+			// Expired, so the lock is gone as well
+			s.lease = ""
+		}
+	}
+
+	if s.lease == "" {
+		var grant struct {
+			ID string `json:"ID"`
+		}
+		seconds := int64(ttl / time.Second)
+		if seconds < 1 {
+			seconds = 1
+		}
+		err := s.call("/v3/lease/grant", map[string]int64{"TTL": seconds}, &grant)
+		if err != nil {
+			return false, err
+		}
+		s.lease = grant.ID
+	}
+
+	key := etcdEncode(s.lockKey())
+	txn := map[string]interface{}{
+		"compare": []map[string]interface{}{
+			{"key": key, "target": "CREATE", "create_revision": "0"},
+		},
+		"success": []map[string]interface{}{
+			{"request_put": map[string]string{"key": key, "value": etcdEncode(owner), "lease": s.lease}},
+		},
+	}
+	var result struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	if err := s.call("/v3/kv/txn", txn, &result); err != nil {
+		return false, err
+	}
+	if result.Succeeded {
+		return true, nil
+	}
+
+	// Already there; it might be ours from an earlier call
+	value, ok, err := s.get(s.lockKey())
+	if err != nil {
+		return false, err
+	}
+	return ok && string(value) == owner, nil
+}
+
+// Unlock - release the lock by revoking its lease
+func (s *EtcdStateStore) Unlock(owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lease == "" {
+		return nil
+	}
+	err := s.call("/v3/lease/revoke", map[string]string{"ID": s.lease}, nil)
+	s.lease = ""
+	return err
+}
+
+func (s *EtcdStateStore) lockKey() string {
+	return s.config.Key + ".lock"
+}
+
+func (s *EtcdStateStore) get(key string) ([]byte, bool, error) {
+	kv, err := s.rangeKey(key)
+	if err != nil || kv == nil {
+		return nil, false, err
+	}
+	value, err := base64.StdEncoding.DecodeString(kv.Value)
+	return value, err == nil, err
+}
+
+// rangeKey - the key and its revision, nil if it doesn't exist
+func (s *EtcdStateStore) rangeKey(key string) (*etcdKeyValue, error) {
+	var result struct {
+		Kvs []etcdKeyValue `json:"kvs"`
+	}
+	err := s.call("/v3/kv/range", map[string]string{"key": etcdEncode(key)}, &result)
+	if err != nil || len(result.Kvs) == 0 {
+		return nil, err
+	}
+	return &result.Kvs[0], nil
+}
+
+func (s *EtcdStateStore) call(path string, req interface{}, result interface{}) error {
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	endpoint := strings.TrimRight(s.config.Endpoint, "/")
+	resp, err := s.client.Post(endpoint+path, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("etcd %s: %s", resp.Status, e.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func etcdEncode(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
@@ -0,0 +1,256 @@
+package flywheel
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RedisStateConfig - location of the state in Redis
+type RedisStateConfig struct {
+	Address  string `json:"address"`
+	Password Secret `json:"password"`
+	DB       int    `json:"db"`
+	Key      string `json:"key"`
+}
+
+// Locker - TTL based locks, so several flywheel processes can agree on which
+// of them is in charge. Locks expire unless refreshed by calling TryLock
+// again before the TTL runs out.
+type Locker interface {
+	TryLock(owner string, ttl time.Duration) (bool, error)
+	Unlock(owner string) error
+}
+
+// Deletes or refreshes the lock only if it's still held by the owner
+const (
+	redisUnlockScript  = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+	redisRefreshScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+)
+
+// Replaces the state only if its version is still the one last seen, and
+// returns the new version, else -1
+const redisSaveScript = `if (redis.call("get", KEYS[2]) or "") == ARGV[1] then redis.call("set", KEYS[1], ARGV[2]) return redis.call("incr", KEYS[2]) else return -1 end`
+
+// errRedisNil - the reply was a nil bulk string, e.g. GET of a missing key
+var errRedisNil = errors.New("Redis nil reply")
+
+// RedisStateStore - keeps the state in a Redis key, with its version and
+// locks in keys next to it. Saves are conditional on the version, so a
+// second writer is detected instead of silently overwritten.
+type RedisStateStore struct {
+	config  *RedisStateConfig
+	mu      sync.Mutex
+	conn    net.Conn
+	rd      *bufio.Reader
+	version string
+}
+
+// NewRedisStateStore - create a state store for a Redis key. The connection
+// is made on first use.
+func NewRedisStateStore(config *RedisStateConfig) *RedisStateStore {
+	return &RedisStateStore{config: config}
+}
+
+// Load - read the state key. The version is read first, so a save in
+// between makes the next save conflict rather than overwrite it.
+func (s *RedisStateStore) Load() (Pong, error) {
+	var status Pong
+	if err := s.readVersion(); err != nil {
+		return status, err
+	}
+	reply, err := s.command("GET", s.config.Key)
+	if err == errRedisNil {
+		return status, ErrNoState
+	}
+	if err != nil {
+		return status, err
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return status, fmt.Errorf("Unexpected Redis reply %v", reply)
+	}
+	err = json.Unmarshal([]byte(value), &status)
+	return status, err
+}
+
+// Save - replace the state key, if nobody else has changed it since it was
+// last read or written
+func (s *RedisStateStore) Save(status Pong) error {
+	buf, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	reply, err := s.command("EVAL", redisSaveScript, "2", s.config.Key, s.versionKey(), s.version, string(buf))
+	if err != nil {
+		return err
+	}
+	version, ok := reply.(int64)
+	if !ok {
+		return fmt.Errorf("Unexpected Redis reply %v", reply)
+	}
+	if version < 0 {
+		// Pick up the other writer's version, so the next save isn't
+		// refused as well
+		if err := s.readVersion(); err != nil {
+			return err
+		}
+		return ErrStateConflict
+	}
+	s.version = strconv.FormatInt(version, 10)
+	return nil
+}
+
+// readVersion - the current version of the state, empty if it has none yet
+func (s *RedisStateStore) readVersion() error {
+	reply, err := s.command("GET", s.versionKey())
+	switch {
+	case err == errRedisNil:
+		s.version = ""
+	case err != nil:
+		return err
+	default:
+		s.version, _ = reply.(string)
+	}
+	return nil
+}
+
+func (s *RedisStateStore) versionKey() string {
+	return s.config.Key + ".version"
+}
+
+// TryLock - take or refresh the lock
+func (s *RedisStateStore) TryLock(owner string, ttl time.Duration) (bool, error) {
+	ms := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	reply, err := s.command("EVAL", redisRefreshScript, "1", s.lockKey(), owner, ms)
+	if err != nil {
+		return false, err
+	}
+	if n, ok := reply.(int64); ok && n == 1 {
+		return true, nil
+	}
+
+	_, err = s.command("SET", s.lockKey(), owner, "NX", "PX", ms)
+	if err == errRedisNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Unlock - release the lock, if it's held by the owner
+func (s *RedisStateStore) Unlock(owner string) error {
+	_, err := s.command("EVAL", redisUnlockScript, "1", s.lockKey(), owner)
+	return err
+}
+
+func (s *RedisStateStore) lockKey() string {
+	return s.config.Key + ".lock"
+}
+
+// command - send a command, reconnecting if needed, and read the reply
+func (s *RedisStateStore) command(args ...string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := s.roundTrip(args...)
+	if _, ok := err.(redisError); err != nil && err != errRedisNil && !ok {
+		// The connection is in an unknown state
+		s.conn.Close()
+		s.conn = nil
+	}
+	return reply, err
+}
+
+func (s *RedisStateStore) connect() error {
+	conn, err := net.DialTimeout("tcp", s.config.Address, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	s.rd = bufio.NewReader(conn)
+
+	if s.config.Password != "" {
+		if _, err = s.roundTrip("AUTH", string(s.config.Password)); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	if s.config.DB != 0 {
+		if _, err = s.roundTrip("SELECT", strconv.Itoa(s.config.DB)); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *RedisStateStore) roundTrip(args ...string) (interface{}, error) {
+	s.conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	buf := []byte(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		buf = append(buf, fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)...)
+	}
+	if _, err := s.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return readRedisReply(s.rd)
+}
+
+// redisError - an error reply from the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "Redis: " + string(e)
+}
+
+// readRedisReply - parse a RESP reply. Only the types returned by the
+// commands above are supported.
+func readRedisReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("Invalid Redis reply %q", line)
+	}
+	payload := line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, errRedisNil
+		}
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	default:
+		return nil, fmt.Errorf("Unsupported Redis reply %q", line)
+	}
+}
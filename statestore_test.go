@@ -0,0 +1,409 @@
+package flywheel
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis - answers GET and SET from a map, with expiry, and runs the
+// save and lock scripts, enough for Load, Save and the locks
+func fakeRedis(t *testing.T) (string, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	data := make(map[string]string)
+	expires := make(map[string]time.Time)
+	get := func(key string) (string, bool) {
+		if at, ok := expires[key]; ok && time.Now().After(at) {
+			delete(data, key)
+			delete(expires, key)
+		}
+		value, ok := data[key]
+		return value, ok
+	}
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		rd := bufio.NewReader(conn)
+		for {
+			var n int
+			if _, err := fmt.Fscanf(rd, "*%d\r\n", &n); err != nil {
+				return
+			}
+			args := make([]string, n)
+			for i := range args {
+				var size int
+				fmt.Fscanf(rd, "$%d\r\n", &size)
+				buf := make([]byte, size+2)
+				io.ReadFull(rd, buf)
+				args[i] = string(buf[:size])
+			}
+			mu.Lock()
+			switch {
+			case strings.ToUpper(args[0]) == "GET":
+				if value, ok := get(args[1]); ok {
+					fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
+				} else {
+					fmt.Fprint(conn, "$-1\r\n")
+				}
+			case strings.ToUpper(args[0]) == "SET" && len(args) == 6:
+				// SET key value NX PX ms
+				if _, ok := get(args[1]); ok {
+					fmt.Fprint(conn, "$-1\r\n")
+					break
+				}
+				ms, _ := strconv.Atoi(args[5])
+				data[args[1]] = args[2]
+				expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+				fmt.Fprint(conn, "+OK\r\n")
+			case strings.ToUpper(args[0]) == "SET":
+				data[args[1]] = args[2]
+				delete(expires, args[1])
+				fmt.Fprint(conn, "+OK\r\n")
+			case strings.ToUpper(args[0]) == "EVAL" && args[1] == redisRefreshScript:
+				if value, ok := get(args[3]); !ok || value != args[4] {
+					fmt.Fprint(conn, ":0\r\n")
+					break
+				}
+				ms, _ := strconv.Atoi(args[5])
+				expires[args[3]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+				fmt.Fprint(conn, ":1\r\n")
+			case strings.ToUpper(args[0]) == "EVAL" && args[1] == redisUnlockScript:
+				if value, ok := get(args[3]); !ok || value != args[4] {
+					fmt.Fprint(conn, ":0\r\n")
+					break
+				}
+				delete(data, args[3])
+				delete(expires, args[3])
+				fmt.Fprint(conn, ":1\r\n")
+			case strings.ToUpper(args[0]) == "EVAL" && args[1] == redisSaveScript:
+				key, versionKey, expected, value := args[3], args[4], args[5], args[6]
+				if data[versionKey] != expected {
+					fmt.Fprint(conn, ":-1\r\n")
+					break
+				}
+				version, _ := strconv.Atoi(data[versionKey])
+				data[key], data[versionKey] = value, strconv.Itoa(version+1)
+				fmt.Fprintf(conn, ":%d\r\n", version+1)
+			default:
+				fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+			}
+			mu.Unlock()
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+
+	return ln.Addr().String(), func() { ln.Close() }
+}
+
+func TestRedisStateStore(t *testing.T) {
+	addr, stop := fakeRedis(t)
+	defer stop()
+
+	store := NewRedisStateStore(&RedisStateConfig{Address: addr, Key: "flywheel"})
+
+	if _, err := store.Load(); err != ErrNoState {
+		t.Errorf("Expected ErrNoState, but got %v", err)
+	}
+
+	stopAt := time.Date(2016, 6, 6, 18, 30, 0, 0, time.UTC)
+	if err := store.Save(Pong{StatusName: "STARTED", StopAt: stopAt}); err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+
+	status, err := store.Load()
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	if status.StatusName != "STARTED" || !status.StopAt.Equal(stopAt) {
+		t.Errorf("Expected saved state, but got %+v", status)
+	}
+
+	// A second writer, e.g. the new process during a deploy
+	other := NewRedisStateStore(&RedisStateConfig{Address: addr, Key: "flywheel"})
+	if _, err := other.Load(); err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	if err := other.Save(Pong{StatusName: "STOPPING"}); err != nil {
+		t.Fatalf("Expected the second writer to save, but got %v", err)
+	}
+	if err := store.Save(Pong{StatusName: "STARTED"}); err != ErrStateConflict {
+		t.Errorf("Expected ErrStateConflict for the first writer, but got %v", err)
+	}
+	if status, _ := store.Load(); status.StatusName != "STOPPING" {
+		t.Errorf("Expected the second writer's state, but got %s", status.StatusName)
+	}
+	if err := store.Save(Pong{StatusName: "STOPPED"}); err != nil {
+		t.Errorf("Expected a save after loading to succeed, but got %v", err)
+	}
+
+	if _, err := store.command("PING"); err == nil {
+		t.Errorf("Expected error reply to be returned")
+	} else if _, ok := err.(redisError); !ok || store.conn == nil {
+		t.Errorf("Expected a Redis error reply on the same connection, but got %v", err)
+	}
+	testLocker(t, store, other, func() { time.Sleep(150 * time.Millisecond) })
+}
+
+// fakeEtcd - the parts of the etcd v3 JSON gateway used by the etcd state
+// store: range, transactions comparing one key's revisions, and leases.
+// expire drops every lease and the keys attached to it.
+func fakeEtcd(t *testing.T) (*httptest.Server, func()) {
+	type kv struct {
+		value       string
+		create, mod int64
+		lease       string
+	}
+	var mu sync.Mutex
+	var revision, leases int64
+	data := make(map[string]kv)
+	live := make(map[string]bool)
+	revoke := func(id string) {
+		delete(live, id)
+		for key, v := range data {
+			if v.lease == id {
+				delete(data, key)
+			}
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var req struct {
+			Key     string `json:"key"`
+			ID      string `json:"ID"`
+			TTL     int64  `json:"TTL"`
+			Compare []struct {
+				Key            string `json:"key"`
+				Target         string `json:"target"`
+				ModRevision    string `json:"mod_revision"`
+				CreateRevision string `json:"create_revision"`
+			} `json:"compare"`
+			Success []struct {
+				Put struct {
+					Key   string `json:"key"`
+					Value string `json:"value"`
+					Lease string `json:"lease"`
+				} `json:"request_put"`
+			} `json:"success"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error": "bad request"}`, http.StatusBadRequest)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/v3/kv/range":
+			result := map[string]interface{}{}
+			if v, ok := data[req.Key]; ok {
+				result["kvs"] = []etcdKeyValue{{Key: req.Key, Value: v.value, ModRevision: strconv.FormatInt(v.mod, 10)}}
+			}
+			json.NewEncoder(w).Encode(result)
+		case "/v3/kv/txn":
+			succeeded := true
+			for _, c := range req.Compare {
+				v := data[c.Key]
+				switch c.Target {
+				case "MOD":
+					succeeded = succeeded && strconv.FormatInt(v.mod, 10) == c.ModRevision
+				case "CREATE":
+					succeeded = succeeded && strconv.FormatInt(v.create, 10) == c.CreateRevision
+				}
+			}
+			if succeeded {
+				revision++
+				for _, op := range req.Success {
+					if op.Put.Lease != "" && !live[op.Put.Lease] {
+						http.Error(w, `{"error": "requested lease not found"}`, http.StatusNotFound)
+						return
+					}
+					v, ok := data[op.Put.Key]
+					if !ok {
+						v.create = revision
+					}
+					v.value, v.mod, v.lease = op.Put.Value, revision, op.Put.Lease
+					data[op.Put.Key] = v
+				}
+			}
+			fmt.Fprintf(w, `{"header": {"revision": "%d"}, "succeeded": %v}`, revision, succeeded)
+		case "/v3/lease/grant":
+			leases++
+			id := strconv.FormatInt(leases, 10)
+			live[id] = true
+			fmt.Fprintf(w, `{"ID": "%s", "TTL": "%d"}`, id, req.TTL)
+		case "/v3/lease/keepalive":
+			if live[req.ID] {
+				fmt.Fprintf(w, `{"result": {"ID": "%s", "TTL": "60"}}`, req.ID)
+			} else {
+				fmt.Fprintf(w, `{"result": {"ID": "%s"}}`, req.ID)
+			}
+		case "/v3/lease/revoke":
+			revoke(req.ID)
+			fmt.Fprint(w, `{}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	return server, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for id := range live {
+			revoke(id)
+		}
+	}
+}
+
+func TestEtcdStateStore(t *testing.T) {
+	server, expire := fakeEtcd(t)
+	defer server.Close()
+
+	store := NewEtcdStateStore(&EtcdStateConfig{Endpoint: server.URL + "/", Key: "/flywheel/dev"})
+	if _, err := store.Load(); err != ErrNoState {
+		t.Errorf("Expected ErrNoState, but got %v", err)
+	}
+
+	stopAt := time.Date(2016, 6, 6, 18, 30, 0, 0, time.UTC)
+	if err := store.Save(Pong{StatusName: "STARTED", StopAt: stopAt}); err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	status, err := store.Load()
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	if status.StatusName != "STARTED" || !status.StopAt.Equal(stopAt) {
+		t.Errorf("Expected saved state, but got %+v", status)
+	}
+
+	// A second writer, e.g. the new process during a deploy
+	other := NewEtcdStateStore(&EtcdStateConfig{Endpoint: server.URL, Key: "/flywheel/dev"})
+	if _, err := other.Load(); err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	if err := other.Save(Pong{StatusName: "STOPPING"}); err != nil {
+		t.Fatalf("Expected the second writer to save, but got %v", err)
+	}
+	if err := store.Save(Pong{StatusName: "STARTED"}); err != ErrStateConflict {
+		t.Errorf("Expected ErrStateConflict for the first writer, but got %v", err)
+	}
+	// The conflict picked up the other writer's revision
+	if err := store.Save(Pong{StatusName: "STOPPED"}); err != nil {
+		t.Errorf("Expected a save after a conflict to succeed, but got %v", err)
+	}
+	if err := other.Save(Pong{StatusName: "STARTING"}); err != ErrStateConflict {
+		t.Errorf("Expected ErrStateConflict for the second writer, but got %v", err)
+	}
+
+	// Neither writer may create the state once it exists
+	fresh := NewEtcdStateStore(&EtcdStateConfig{Endpoint: server.URL, Key: "/flywheel/dev"})
+	if err := fresh.Save(Pong{StatusName: "STARTED"}); err != ErrStateConflict {
+		t.Errorf("Expected ErrStateConflict creating an existing state, but got %v", err)
+	}
+	if status, _ := fresh.Load(); status.StatusName != "STOPPED" {
+		t.Errorf("Expected the last saved state, but got %s", status.StatusName)
+	}
+
+	bad := NewEtcdStateStore(&EtcdStateConfig{Endpoint: server.URL + "/missing", Key: "/flywheel/dev"})
+	if _, err := bad.Load(); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected an error for a bad endpoint, but got %v", err)
+	}
+
+	testLocker(t, store, other, expire)
+}
+
+// testLocker - two lockers sharing a lock. expire makes a lock taken with
+// a 100ms TTL expire.
+func testLocker(t *testing.T, a, b Locker, expire func()) {
+	if ok, err := a.TryLock("a", time.Minute); !ok || err != nil {
+		t.Fatalf("Expected the lock to be taken, but got %v %v", ok, err)
+	}
+	if ok, err := b.TryLock("b", time.Minute); ok || err != nil {
+		t.Errorf("Expected the lock to be held by a, but got %v %v", ok, err)
+	}
+	if ok, err := a.TryLock("a", time.Minute); !ok || err != nil {
+		t.Errorf("Expected the lock to be refreshed by its owner, but got %v %v", ok, err)
+	}
+
+	// Released by its owner only
+	if err := b.Unlock("b"); err != nil {
+		t.Errorf("Expected no error unlocking, but got %v", err)
+	}
+	if ok, _ := b.TryLock("b", time.Minute); ok {
+		t.Errorf("Expected the lock to still be held by a")
+	}
+	if err := a.Unlock("a"); err != nil {
+		t.Errorf("Expected no error unlocking, but got %v", err)
+	}
+	if ok, err := b.TryLock("b", 100*time.Millisecond); !ok || err != nil {
+		t.Fatalf("Expected the released lock to be taken, but got %v %v", ok, err)
+	}
+
+	// Gone once it expires
+	expire()
+	if ok, err := a.TryLock("a", time.Minute); !ok || err != nil {
+		t.Errorf("Expected the expired lock to be taken, but got %v %v", ok, err)
+	}
+	if ok, _ := b.TryLock("b", time.Minute); ok {
+		t.Errorf("Expected the lock to be lost once it expired")
+	}
+}
+
+func TestDirRefCounter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flywheel-refs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	refs := DirRefCounter(dir)
+	steps := []struct {
+		acquire bool
+		holder  string
+		count   int
+	}{
+		{true, "staging-a", 1},
+		{true, "staging-b", 2},
+		{true, "staging-a", 2},
+		{false, "staging-a", 1},
+		{false, "staging-a", 1},
+		{false, "staging-b", 0},
+	}
+	for i, step := range steps {
+		var count int
+		if step.acquire {
+			count, err = refs.Acquire("i-bastion", step.holder)
+		} else {
+			count, err = refs.Release("i-bastion", step.holder)
+		}
+		if err != nil {
+			t.Fatalf("Step %d: %v", i, err)
+		}
+		if count != step.count {
+			t.Errorf("Step %d: Expected %d holders but got %d", i, step.count, count)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package flywheel
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// DefaultStatefulTag - resources with this tag need a confirmed stop
+const DefaultStatefulTag = "flywheel:stateful"
+
+// StopConfirmationConfig - stops affecting stateful resources, e.g. database
+// instances with large EBS volumes, have to be confirmed
+type StopConfirmationConfig struct {
+	// Instances and groups tagged with this key are stateful, unless the
+	// value is "false". Defaults to "flywheel:stateful".
+	Tag string `json:"tag"`
+
+	// Instances and autoscaling groups that are stateful regardless of tags.
+	// Terminated groups aren't described, so they can only be listed here.
+	Stateful []string `json:"stateful"`
+
+	// A second stop request by the same user within this time confirms the
+	// first. Defaults to 1m.
+	Window Duration `json:"window"`
+}
+
+// Validate - fill in the defaults
+func (c *StopConfirmationConfig) Validate() error {
+	if c.Tag == "" {
+		c.Tag = DefaultStatefulTag
+	}
+	if c.Window <= 0 {
+		c.Window = Duration(time.Minute)
+	}
+	return nil
+}
+
+// Stop actions, by how much data is at risk
+const (
+	StopActionStop      = "stop"
+	StopActionWarmPool  = "warm-pool"
+	StopActionTerminate = "terminate"
+)
+
+// StopRisk - what a stop does to a stateful resource
+type StopRisk struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Action string `json:"action"`
+	Risk   string `json:"risk"`
+}
+
+// stopRisks - describes the data loss risk of each action
+var stopRisks = map[string]string{
+	StopActionStop:      "Stopped: EBS volumes are kept, data on instance store volumes is lost",
+	StopActionWarmPool:  "Moved to the warm pool: EBS volumes are kept, instances beyond the warm pool size are terminated",
+	StopActionTerminate: "Terminated: instances are replaced on start, volumes deleted on termination are lost",
+}
+
+// ConfirmStopError - the stop affects stateful resources and wasn't
+// confirmed
+type ConfirmStopError struct {
+	Risks  []StopRisk
+	Window time.Duration
+}
+
+func (e *ConfirmStopError) Error() string {
+	var ids []string
+	for _, risk := range e.Risks {
+		ids = append(ids, risk.ID)
+	}
+	return fmt.Sprintf("Stop affects stateful resources (%s): confirm with confirm=true, or stop again within %v",
+		strings.Join(ids, ", "), e.Window)
+}
+
+// pendingStop - an unconfirmed stop request
+type pendingStop struct {
+	user string
+	at   time.Time
+}
+
+// isStateful - true if the tag marks a resource as stateful
+func (c *StopConfirmationConfig) isStateful(key, value *string) bool {
+	return aws.StringValue(key) == c.Tag && aws.StringValue(value) != "false"
+}
+
+// instanceStateful - true if the described instance is tagged as stateful
+func (c *StopConfirmationConfig) instanceStateful(instance *ec2.Instance) bool {
+	for _, tag := range instance.Tags {
+		if c.isStateful(tag.Key, tag.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// groupStateful - true if the described group is tagged as stateful
+func (c *StopConfirmationConfig) groupStateful(group *autoscaling.Group) bool {
+	for _, tag := range group.Tags {
+		if c.isStateful(tag.Key, tag.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// statefulRisks - the stateful resources a stop would affect. Tags are
+// known from the last health check.
+func (fw *Flywheel) statefulRisks() []StopRisk {
+	c := fw.config
+	tagged := make(map[string]bool)
+	for _, r := range fw.resources.list() {
+		if r.Stateful {
+			tagged[r.Type+"/"+r.ID] = true
+		}
+	}
+	stateful := func(kind, id string) bool {
+		return !c.Observed(id) && (tagged[kind+"/"+id] || contains(c.StopConfirmation.Stateful, id))
+	}
+
+	var risks []StopRisk
+	add := func(kind, id, action string) {
+		if stateful(kind, id) {
+			risks = append(risks, StopRisk{Type: kind, ID: id, Action: action, Risk: stopRisks[action]})
+		}
+	}
+	for _, id := range c.controlledInstances() {
+		add(ResourceInstance, id, StopActionStop)
+	}
+	for _, name := range c.AutoScaling.StopGroups() {
+		add(ResourceAutoScalingGroup, name, StopActionStop)
+	}
+	for name := range c.AutoScaling.WarmPool {
+		add(ResourceAutoScalingGroup, name, StopActionWarmPool)
+	}
+	for name := range c.AutoScaling.TerminateGroups() {
+		add(ResourceAutoScalingGroup, name, StopActionTerminate)
+	}
+	sort.Sort(stopRiskList(risks))
+	return risks
+}
+
+// confirmStop - check a stop request is confirmed if it affects stateful
+// resources. An unconfirmed request is remembered, so the same user can
+// confirm by stopping again within the window.
+func (fw *Flywheel) confirmStop(ping *Ping) error {
+	risks := fw.statefulRisks()
+	if len(risks) == 0 || ping.confirmed {
+		fw.pendingStop = nil
+		return nil
+	}
+
+	now := fw.now()
+	window := time.Duration(fw.config.StopConfirmation.Window)
+	if p := fw.pendingStop; p != nil && p.user == ping.user && now.Sub(p.at) <= window {
+		fw.pendingStop = nil
+		return nil
+	}
+	fw.pendingStop = &pendingStop{user: ping.user, at: now}
+	return &ConfirmStopError{Risks: risks, Window: window}
+}
+
+// stopRiskList - sorted from the most to the least data at risk
+type stopRiskList []StopRisk
+
+func (l stopRiskList) Len() int      { return len(l) }
+func (l stopRiskList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l stopRiskList) Less(i, j int) bool {
+	if l[i].Action != l[j].Action {
+		return stopActionRank[l[i].Action] > stopActionRank[l[j].Action]
+	}
+	return l[i].ID < l[j].ID
+}
+
+var stopActionRank = map[string]int{
+	StopActionStop:      0,
+	StopActionWarmPool:  1,
+	StopActionTerminate: 2,
+}
@@ -0,0 +1,96 @@
+package flywheel
+
+import (
+	"fmt"
+	"html"
+	"time"
+)
+
+// NotifyStop - the environment was powered down, and why
+const NotifyStop = "stop"
+
+// Why the environment was stopped
+const (
+	// The idle strategy found it idle
+	StopIdle = "idle"
+	// No requests within the idle timeout
+	StopIdleTimeout = "idle-timeout"
+	// The stop time set through the API, or extended to, was reached
+	StopDeadline = "deadline"
+	// Stopped through the API
+	StopManual = "manual"
+	// Stopped outside flywheel, e.g. in the AWS console, as found by the
+	// health check
+	StopExternal = "external"
+)
+
+// StopReason - why the environment was last stopped, and by whom
+type StopReason struct {
+	Reason  string    `json:"reason"`
+	User    string    `json:"user,omitempty"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// stopReason - the reason for a transition, if it's a stop. Stops by
+// flywheel go through STOPPING; getting to STOPPED any other way means the
+// resources were stopped by something else.
+func stopReason(from, to int, trigger string) string {
+	if to != STOPPING && (to != STOPPED || from == STOPPING) {
+		return ""
+	}
+	switch trigger {
+	case TriggerIdle:
+		return StopIdle
+	case TriggerIdleTimeout:
+		return StopIdleTimeout
+	case TriggerDeadline:
+		return StopDeadline
+	case TriggerStop:
+		return StopManual
+	case TriggerHealth:
+		return StopExternal
+	}
+	return trigger
+}
+
+// stopped - remember and announce why the environment is being stopped
+func (fw *Flywheel) stopped(reason, user string, now time.Time) {
+	var message string
+	switch reason {
+	case StopIdle:
+		message = "Powered down as it was idle"
+	case StopIdleTimeout:
+		message = fmt.Sprintf("Powered down after no requests for %v", fw.idleTimeoutAt(now))
+	case StopDeadline:
+		message = "Powered down at the stop time"
+	case StopManual:
+		message = fmt.Sprintf("Powered down by %s", user)
+	case StopExternal:
+		message = "Powered down outside flywheel"
+	case StopSchedule:
+		message = "Powered down at a scheduled time"
+	default:
+		message = fmt.Sprintf("Powered down (%s)", reason)
+	}
+	fw.lastStop = &StopReason{Reason: reason, User: user, Message: message, Time: now}
+	if fw.annotations != nil && fw.annotations.Notes != "" {
+		fw.notify(NotifyStop, "%s. Notes: %s", message, fw.annotations.Notes)
+		return
+	}
+	fw.notify(NotifyStop, "%s", message)
+}
+
+// stopMessage - why the environment was stopped, for the stopped page
+func (c *Config) stopMessage(lang string, stop *StopReason) string {
+	if stop == nil {
+		return ""
+	}
+	switch stop.Reason {
+	case StopIdle, StopIdleTimeout, StopDeadline, StopExternal, StopSchedule:
+		return c.Message(lang, "stop."+stop.Reason)
+	case StopManual:
+		return fmt.Sprintf(c.Message(lang, "stop.manual"), html.EscapeString(stop.User))
+	}
+	return ""
+}
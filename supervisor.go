@@ -0,0 +1,55 @@
+package flywheel
+
+import (
+	"context"
+	"runtime/debug"
+	"time"
+)
+
+// How long to wait before restarting a loop after a panic. The delay
+// doubles with every panic in a row, up to the maximum.
+const (
+	RestartDelay    = time.Second
+	MaxRestartDelay = time.Minute
+)
+
+// supervise - run a loop, restarting it when it panics. The flywheel state
+// lives in the Flywheel struct, so it survives the restart. A loop that
+// returns normally, or once ctx is done, is not restarted.
+func (fw *Flywheel) supervise(ctx context.Context, name string, loop func()) {
+	delay := RestartDelay
+	for {
+		started := fw.now()
+		if !fw.recovered(name, loop) || ctx.Err() != nil {
+			return
+		}
+		// Reset the backoff after a good run
+		if fw.now().Sub(started) > MaxRestartDelay {
+			delay = RestartDelay
+		}
+		fw.logf("Restarting %s in %v", name, delay)
+		timer := fw.timeSource().NewTimer(delay)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		if delay *= 2; delay > MaxRestartDelay {
+			delay = MaxRestartDelay
+		}
+	}
+}
+
+// recovered - run the loop, true if it panicked
+func (fw *Flywheel) recovered(name string, loop func()) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			fw.logf("Panic in %s: %v\n%s", name, r, debug.Stack())
+			fw.notify(NotifyPanic, "Panic in %s: %v", name, r)
+		}
+	}()
+	loop()
+	return false
+}
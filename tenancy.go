@@ -0,0 +1,88 @@
+package flywheel
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Secret - a string that is never written back out when the config is
+// displayed.
+type Secret string
+
+// MarshalJSON - hide the secret value
+func (s Secret) MarshalJSON() ([]byte, error) {
+	if s == "" {
+		return json.Marshal("")
+	}
+	return json.Marshal("********")
+}
+
+// Access levels returned by Config.Authorize
+const (
+	AccessGranted = iota
+	AccessDenied
+	AccessHidden
+)
+
+// TenancyEnabled - true when API tokens are configured. Without tokens the
+// API is open, as it always was.
+func (c *Config) TenancyEnabled() bool {
+	return len(c.APITokens) > 0
+}
+
+// TokenTeam - find the team an API token belongs to
+func (c *Config) TokenTeam(token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	for team, tokens := range c.APITokens {
+		for _, t := range tokens {
+			if string(t) == token {
+				return team, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Authorize - check if a token may see and control this environment.
+// Tokens of another team get AccessHidden, so the environment looks like it
+// doesn't exist to them.
+func (c *Config) Authorize(token string) int {
+	if !c.TenancyEnabled() {
+		return AccessGranted
+	}
+	team, ok := c.TokenTeam(token)
+	if !ok {
+		return AccessDenied
+	}
+	if c.Team != "" && team != c.Team {
+		return AccessHidden
+	}
+	return AccessGranted
+}
+
+// requestToken - extract the API token from the Authorization header
+func requestToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// authorize - check the request token, writing an error response if access
+// is refused.
+func (handler *Handler) authorize(w http.ResponseWriter, r *http.Request) bool {
+	switch handler.Flywheel.config.Authorize(requestToken(r)) {
+	case AccessDenied:
+		w.Header().Set("WWW-Authenticate", `Bearer realm="flywheel"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	case AccessHidden:
+		w.WriteHeader(http.StatusNotFound)
+		return false
+	}
+	return true
+}
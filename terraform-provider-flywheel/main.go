@@ -0,0 +1,16 @@
+// terraform-provider-flywheel - manages the vhosts and annotations of
+// flywheel environments through their admin API, so what flywheel serves and
+// who owns it can live next to the infrastructure code that creates the
+// resources.
+//
+// It's a module of its own, so the daemon doesn't pick up the dependencies
+// of the Terraform plugin SDK.
+package main
+
+import (
+	"github.com/hashicorp/terraform-plugin-sdk/v2/plugin"
+)
+
+func main() {
+	plugin.Serve(&plugin.ServeOpts{ProviderFunc: Provider})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+
+	"github.com/fairfaxmedia/flywheel/flywheelclient"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+// Provider - the flywheel provider, for the vhosts and annotations of an
+// environment. It talks to one environment; use a provider alias per
+// environment, or per pool.
+func Provider() *schema.Provider {
+	return &schema.Provider{
+		Schema: map[string]*schema.Schema{
+			"url": {
+				Type:        schema.TypeString,
+				Required:    true,
+				DefaultFunc: schema.EnvDefaultFunc("FLYWHEEL_URL", nil),
+				Description: "Any URL of the environment, e.g. https://staging.example.com, with the path prefix of a pool if it has one.",
+			},
+			"token": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Sensitive:   true,
+				DefaultFunc: schema.EnvDefaultFunc("FLYWHEEL_ADMIN_TOKEN", nil),
+				Description: "One of the admin-tokens of the environment.",
+			},
+		},
+		ResourcesMap: map[string]*schema.Resource{
+			"flywheel_annotations": resourceAnnotations(),
+			"flywheel_vhost":       resourceVhost(),
+		},
+		ConfigureContextFunc: func(ctx context.Context, d *schema.ResourceData) (interface{}, diag.Diagnostics) {
+			return flywheelclient.New(d.Get("url").(string), d.Get("token").(string)), nil
+		},
+	}
+}
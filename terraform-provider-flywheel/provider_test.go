@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/fairfaxmedia/flywheel/flywheelclient"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+// fakeFlywheel - the vhosts and annotations endpoints of the admin API,
+// kept in memory. Changes need the admin token "secret".
+func fakeFlywheel(t *testing.T) *httptest.Server {
+	var mu sync.Mutex
+	vhosts := map[string]string{}
+	var current *flywheelclient.Annotations
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		reply := func(code int, v interface{}) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(code)
+			json.NewEncoder(w).Encode(v)
+		}
+		if r.Method != "GET" && r.Header.Get("Authorization") != "Bearer secret" {
+			reply(http.StatusUnauthorized, map[string]string{"error": "Admin token required"})
+			return
+		}
+
+		switch r.URL.Path {
+		case "/staging/flywheel/api/v1/vhosts":
+			switch r.Method {
+			case "POST":
+				var v flywheelclient.Vhost
+				json.NewDecoder(r.Body).Decode(&v)
+				vhosts[v.Host] = v.Endpoint
+			case "DELETE":
+				host := r.FormValue("host")
+				if _, ok := vhosts[host]; !ok {
+					reply(http.StatusConflict, map[string]string{"error": "No runtime vhost " + host})
+					return
+				}
+				delete(vhosts, host)
+			}
+			list := []flywheelclient.Vhost{{Host: "app.example.com", Endpoint: "10.0.0.1:80"}}
+			for host, endpoint := range vhosts {
+				list = append(list, flywheelclient.Vhost{Host: host, Endpoint: endpoint, Runtime: true})
+			}
+			reply(http.StatusOK, list)
+		case "/staging/flywheel/api/v1/annotations":
+			switch r.Method {
+			case "PUT":
+				current = &flywheelclient.Annotations{}
+				json.NewDecoder(r.Body).Decode(current)
+				current.UpdatedBy = "terraform"
+			case "DELETE":
+				current = nil
+			}
+			reply(http.StatusOK, current)
+		default:
+			reply(http.StatusNotFound, map[string]string{"error": "Unknown API endpoint " + r.URL.Path})
+		}
+	}))
+}
+
+func TestProvider(t *testing.T) {
+	if err := Provider().InternalValidate(); err != nil {
+		t.Fatalf("Expected a valid provider, but got %v", err)
+	}
+}
+
+func TestVhost(t *testing.T) {
+	server := fakeFlywheel(t)
+	defer server.Close()
+	ctx := context.Background()
+	c := flywheelclient.New(server.URL+"/staging/", "secret")
+	resource := resourceVhost()
+
+	d := schema.TestResourceDataRaw(t, resource.Schema, map[string]interface{}{
+		"host":     "new.example.com",
+		"endpoint": "10.0.0.5:8080",
+	})
+	if diags := resource.CreateContext(ctx, d, c); diags.HasError() {
+		t.Fatalf("Expected no error creating, but got %v", diags)
+	}
+	if d.Id() != "new.example.com" {
+		t.Errorf("Expected the host as the ID, but got %q", d.Id())
+	}
+
+	d.Set("endpoint", "10.0.0.6:8080")
+	if diags := resource.UpdateContext(ctx, d, c); diags.HasError() {
+		t.Fatalf("Expected no error updating, but got %v", diags)
+	}
+	if v, _ := runtimeVhost(ctx, c, "new.example.com"); v == nil || v.Endpoint != "10.0.0.6:8080" {
+		t.Errorf("Expected the endpoint to be replaced, but got %+v", v)
+	}
+
+	if diags := resource.DeleteContext(ctx, d, c); diags.HasError() {
+		t.Fatalf("Expected no error deleting, but got %v", diags)
+	}
+	// Deleting again is fine, and a removed vhost drops out of the state
+	if diags := resource.DeleteContext(ctx, d, c); diags.HasError() {
+		t.Errorf("Expected no error deleting a removed vhost, but got %v", diags)
+	}
+	if diags := resource.ReadContext(ctx, d, c); diags.HasError() || d.Id() != "" {
+		t.Errorf("Expected the removed vhost to be gone, but got %q %v", d.Id(), diags)
+	}
+
+	// Only vhosts added with the API are managed
+	d.SetId("app.example.com")
+	if resource.ReadContext(ctx, d, c); d.Id() != "" {
+		t.Errorf("Expected a vhost of the config not to be found, but got %q", d.Id())
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	server := fakeFlywheel(t)
+	defer server.Close()
+	ctx := context.Background()
+	c := flywheelclient.New(server.URL+"/staging", "secret")
+	resource := resourceAnnotations()
+
+	d := schema.TestResourceDataRaw(t, resource.Schema, map[string]interface{}{
+		"owner": []interface{}{map[string]interface{}{"team": "checkout", "email": "checkout@example.com"}},
+		"notes": "Do not stop before Friday's audit",
+		"link":  []interface{}{map[string]interface{}{"title": "AUD-12", "url": "https://jira.example.com/browse/AUD-12"}},
+	})
+	if diags := resource.CreateContext(ctx, d, c); diags.HasError() {
+		t.Fatalf("Expected no error creating, but got %v", diags)
+	}
+	a, err := c.Annotations(ctx)
+	if err != nil || a == nil {
+		t.Fatalf("Expected annotations, but got %v %v", a, err)
+	}
+	if a.Owner == nil || a.Owner.Team != "checkout" || a.Notes != "Do not stop before Friday's audit" || len(a.Links) != 1 || a.Links[0].Title != "AUD-12" {
+		t.Errorf("Expected the annotations to be set, but got %+v", a)
+	}
+	if d.Get("updated_by") != "terraform" || d.Get("owner.0.email") != "checkout@example.com" {
+		t.Errorf("Expected the annotations to be read back, but got %v %v", d.Get("updated_by"), d.Get("owner"))
+	}
+
+	if diags := resource.DeleteContext(ctx, d, c); diags.HasError() {
+		t.Fatalf("Expected no error deleting, but got %v", diags)
+	}
+	if a, _ := c.Annotations(ctx); a != nil {
+		t.Errorf("Expected the annotations to be cleared, but got %+v", a)
+	}
+	if diags := resource.ReadContext(ctx, d, c); diags.HasError() || d.Id() != "" {
+		t.Errorf("Expected cleared annotations to be gone, but got %q %v", d.Id(), diags)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	server := fakeFlywheel(t)
+	defer server.Close()
+
+	err := flywheelclient.New(server.URL+"/staging", "wrong").SetVhost(context.Background(), "new.example.com", "10.0.0.5:8080")
+	if err != flywheelclient.ErrUnauthorized {
+		t.Errorf("Expected the API error, but got %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+
+	"github.com/fairfaxmedia/flywheel/flywheelclient"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+// resourceAnnotations - the owner, notes and links of an environment, its
+// annotations in the admin API. There is one per environment, so its ID is
+// the URL of the provider.
+func resourceAnnotations() *schema.Resource {
+	return &schema.Resource{
+		Description:   "The owner, notes and links of a flywheel environment, shown on its status pages and sent with its notifications.",
+		CreateContext: annotationsUpdate,
+		ReadContext:   annotationsRead,
+		UpdateContext: annotationsUpdate,
+		DeleteContext: annotationsDelete,
+		Importer: &schema.ResourceImporter{
+			StateContext: schema.ImportStatePassthroughContext,
+		},
+		Schema: map[string]*schema.Schema{
+			"owner": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				MaxItems:    1,
+				Description: "Replaces the owner of the config, apart from its webhook.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"team":  {Type: schema.TypeString, Optional: true},
+						"email": {Type: schema.TypeString, Optional: true},
+						"slack": {Type: schema.TypeString, Optional: true},
+					},
+				},
+			},
+			"notes": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "e.g. \"Do not stop before Friday's audit\". At most 2000 characters.",
+			},
+			"link": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				MaxItems:    10,
+				Description: "Links, e.g. to a ticket or a runbook.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"title": {Type: schema.TypeString, Optional: true},
+						"url":   {Type: schema.TypeString, Required: true},
+					},
+				},
+			},
+			"updated_by": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Who last changed the annotations.",
+			},
+		},
+	}
+}
+
+func annotationsUpdate(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	c := meta.(*flywheelclient.Client)
+	a := &flywheelclient.Annotations{Notes: d.Get("notes").(string)}
+	if owners := d.Get("owner").([]interface{}); len(owners) > 0 && owners[0] != nil {
+		o := owners[0].(map[string]interface{})
+		a.Owner = &flywheelclient.Owner{Team: o["team"].(string), Email: o["email"].(string), Slack: o["slack"].(string)}
+	}
+	for _, l := range d.Get("link").([]interface{}) {
+		l := l.(map[string]interface{})
+		a.Links = append(a.Links, flywheelclient.Link{Title: l["title"].(string), URL: l["url"].(string)})
+	}
+
+	if _, err := c.SetAnnotations(ctx, a); err != nil {
+		return diag.FromErr(err)
+	}
+	d.SetId(c.BaseURL)
+	return annotationsRead(ctx, d, meta)
+}
+
+func annotationsRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	a, err := meta.(*flywheelclient.Client).Annotations(ctx)
+	if err != nil {
+		return diag.FromErr(err)
+	}
+	if a == nil {
+		// Cleared outside Terraform
+		d.SetId("")
+		return nil
+	}
+
+	var owners []interface{}
+	if a.Owner != nil {
+		owners = append(owners, map[string]interface{}{"team": a.Owner.Team, "email": a.Owner.Email, "slack": a.Owner.Slack})
+	}
+	var links []interface{}
+	for _, l := range a.Links {
+		links = append(links, map[string]interface{}{"title": l.Title, "url": l.URL})
+	}
+	d.Set("owner", owners)
+	d.Set("notes", a.Notes)
+	d.Set("link", links)
+	d.Set("updated_by", a.UpdatedBy)
+	return nil
+}
+
+func annotationsDelete(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	return diag.FromErr(meta.(*flywheelclient.Client).ClearAnnotations(ctx))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+
+	"github.com/fairfaxmedia/flywheel/flywheelclient"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+// resourceVhost - a vhost added with the admin API. It's kept in the state
+// store of the environment and takes precedence over the config.
+func resourceVhost() *schema.Resource {
+	return &schema.Resource{
+		Description:   "A vhost served by a flywheel environment, mapping a hostname, wildcard or ~ pattern to an endpoint.",
+		CreateContext: vhostCreate,
+		ReadContext:   vhostRead,
+		UpdateContext: vhostUpdate,
+		DeleteContext: vhostDelete,
+		Importer: &schema.ResourceImporter{
+			StateContext: schema.ImportStatePassthroughContext,
+		},
+		Schema: map[string]*schema.Schema{
+			"host": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "The hostname, e.g. new.example.com, or a pattern as in the vhosts of the config.",
+			},
+			"endpoint": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The endpoint requests for the host are proxied to, e.g. 10.0.0.5:8080.",
+			},
+		},
+	}
+}
+
+func vhostCreate(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	c := meta.(*flywheelclient.Client)
+	host := d.Get("host").(string)
+	if err := c.SetVhost(ctx, host, d.Get("endpoint").(string)); err != nil {
+		return diag.FromErr(err)
+	}
+	d.SetId(host)
+	return vhostRead(ctx, d, meta)
+}
+
+func vhostRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	v, err := runtimeVhost(ctx, meta.(*flywheelclient.Client), d.Id())
+	if err != nil {
+		return diag.FromErr(err)
+	}
+	if v == nil {
+		// Removed outside Terraform
+		d.SetId("")
+		return nil
+	}
+	d.Set("host", v.Host)
+	d.Set("endpoint", v.Endpoint)
+	return nil
+}
+
+func vhostUpdate(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	if err := meta.(*flywheelclient.Client).SetVhost(ctx, d.Id(), d.Get("endpoint").(string)); err != nil {
+		return diag.FromErr(err)
+	}
+	return vhostRead(ctx, d, meta)
+}
+
+func vhostDelete(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	c := meta.(*flywheelclient.Client)
+	err := c.DeleteVhost(ctx, d.Id())
+	if e, ok := err.(*flywheelclient.APIError); ok && e.StatusCode == 409 {
+		// Fine if it was already removed, not if flywheel was busy
+		if v, rerr := runtimeVhost(ctx, c, d.Id()); rerr == nil && v == nil {
+			err = nil
+		}
+	}
+	return diag.FromErr(err)
+}
+
+// runtimeVhost - the vhost added with the API for a host, nil if there is
+// none. Vhosts of the config aren't managed.
+func runtimeVhost(ctx context.Context, c *flywheelclient.Client, host string) (*flywheelclient.Vhost, error) {
+	vhosts, err := c.Vhosts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range vhosts {
+		if vhosts[i].Host == host && vhosts[i].Runtime {
+			return &vhosts[i], nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,283 @@
+package flywheel
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Usage export formats
+const (
+	UsageCSV  = "csv"
+	UsageJSON = "json"
+)
+
+// UsageTransition - a transition in a usage report
+type UsageTransition struct {
+	Time    time.Time `json:"time"`
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Trigger string    `json:"trigger,omitempty"`
+	User    string    `json:"user,omitempty"`
+
+	StopReason string `json:"stop-reason,omitempty"`
+}
+
+// UsageDay - how long the environment was up on a day, and who and what
+// started and stopped it. Up is anything but STOPPED.
+type UsageDay struct {
+	Date        string         `json:"date"`
+	UptimeHours float64        `json:"uptime-hours"`
+	Starts      int            `json:"starts"`
+	Stops       int            `json:"stops"`
+	Requests    int            `json:"requests"`
+	Triggers    map[string]int `json:"triggers"`
+	Users       []string       `json:"users"`
+}
+
+// UsageReport - the usage over a date range, for spreadsheets
+type UsageReport struct {
+	From        time.Time         `json:"from"`
+	To          time.Time         `json:"to"`
+	Timezone    string            `json:"timezone"`
+	Transitions []UsageTransition `json:"transitions"`
+	Days        []UsageDay        `json:"days"`
+}
+
+// Usage - the transitions and daily usage from from until to, in days of
+// the location. Uptime is counted until now at most.
+func (h *History) Usage(from, to time.Time, loc *time.Location, now time.Time) UsageReport {
+	report := UsageReport{From: from, To: to, Timezone: loc.String(), Transitions: []UsageTransition{}, Days: []UsageDay{}}
+	if h == nil {
+		return report
+	}
+	h.mu.Lock()
+	events := h.pending()
+	h.mu.Unlock()
+
+	end := to
+	if now.Before(end) {
+		end = now
+	}
+
+	// Days, and the one each event falls on
+	days := make(map[string]*UsageDay)
+	for day := startOfDay(from, loc); day.Before(to); day = day.AddDate(0, 0, 1) {
+		date := day.Format("2006-01-02")
+		report.Days = append(report.Days, UsageDay{Date: date, Triggers: make(map[string]int), Users: []string{}})
+	}
+	for i := range report.Days {
+		days[report.Days[i].Date] = &report.Days[i]
+	}
+	dayOf := func(t time.Time) *UsageDay {
+		if t.Before(from) || !t.Before(to) {
+			return nil
+		}
+		return days[t.In(loc).Format("2006-01-02")]
+	}
+
+	// Whether it was up at the start of the range, from the transition
+	// before it, else the first one in it
+	up, known, upSince := false, false, from
+	addUptime := func(until time.Time) {
+		if up && until.After(upSince) {
+			addUptimeByDay(days, upSince, until, loc)
+		}
+	}
+	for _, event := range events {
+		switch event.Type {
+		case HistoryRequests:
+			if day := dayOf(event.Time); day != nil {
+				day.Requests += event.Count
+			}
+			continue
+		case HistoryTransition:
+		default:
+			continue
+		}
+
+		isUp := event.To != "STOPPED"
+		if event.Time.Before(from) {
+			up, known = isUp, true
+			continue
+		}
+		if !event.Time.Before(to) {
+			continue
+		}
+		if !known {
+			up, known = event.From != "STOPPED", true
+		}
+		until := event.Time
+		if until.After(end) {
+			until = end
+		}
+		addUptime(until)
+		up, upSince = isUp, until
+
+		report.Transitions = append(report.Transitions, UsageTransition{
+			Time:    event.Time,
+			From:    event.From,
+			To:      event.To,
+			Trigger: event.Trigger,
+			User:    event.User,
+
+			StopReason: event.StopReason,
+		})
+		day := dayOf(event.Time)
+		if day == nil {
+			continue
+		}
+		switch event.To {
+		case "STARTING":
+			day.Starts++
+		case "STOPPING":
+			day.Stops++
+		}
+		if event.Trigger != "" && event.Trigger != TriggerHealth {
+			day.Triggers[event.Trigger]++
+		}
+		if event.User != "" && !contains(day.Users, event.User) {
+			day.Users = append(day.Users, event.User)
+		}
+	}
+	addUptime(end)
+
+	for i := range report.Days {
+		sort.Strings(report.Days[i].Users)
+	}
+	return report
+}
+
+// startOfDay - midnight of the day of t, in the location
+func startOfDay(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+// addUptimeByDay - split an up period between the days it spans
+func addUptimeByDay(days map[string]*UsageDay, from, to time.Time, loc *time.Location) {
+	for start := from; start.Before(to); {
+		next := startOfDay(start, loc).AddDate(0, 0, 1)
+		if next.After(to) {
+			next = to
+		}
+		if day := days[start.In(loc).Format("2006-01-02")]; day != nil {
+			day.UptimeHours += next.Sub(start).Hours()
+		}
+		start = next
+	}
+}
+
+// parseDate - a date (the start of the day) or an RFC3339 time
+func parseDate(value string, loc *time.Location) (time.Time, bool, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, loc); err == nil {
+		return t, true, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, false, nil
+	}
+	return time.Time{}, false, fmt.Errorf("Invalid date %q: expected YYYY-MM-DD or an RFC3339 time", value)
+}
+
+// apiHistoryExport - the usage over a date range as JSON, or as CSV with
+// a report of either the transitions or the days
+func (handler *Handler) apiHistoryExport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	loc := time.Local
+	if tz := query.Get("tz"); tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			handler.apiError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	now := handler.Flywheel.now()
+	to := startOfDay(now, loc).AddDate(0, 0, 1)
+	if value := query.Get("to"); value != "" {
+		t, date, err := parseDate(value, loc)
+		if err != nil {
+			handler.apiError(w, http.StatusBadRequest, err)
+			return
+		}
+		// The whole day is included
+		if to = t; date {
+			to = t.AddDate(0, 0, 1)
+		}
+	}
+	from := to.AddDate(0, 0, -30)
+	if value := query.Get("from"); value != "" {
+		var err error
+		if from, _, err = parseDate(value, loc); err != nil {
+			handler.apiError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if !from.Before(to) {
+		handler.apiError(w, http.StatusBadRequest, fmt.Errorf("from must be before to"))
+		return
+	}
+
+	report := handler.Flywheel.History().Usage(from, to, loc, now)
+	switch format := query.Get("format"); format {
+	case "", UsageJSON:
+		handler.writeJSON(w, http.StatusOK, report)
+	case UsageCSV:
+		kind := query.Get("report")
+		if kind == "" {
+			kind = "transitions"
+		}
+		var rows [][]string
+		switch kind {
+		case "transitions":
+			rows = report.transitionRows()
+		case "days":
+			rows = report.dayRows()
+		default:
+			handler.apiError(w, http.StatusBadRequest, fmt.Errorf("Unknown report %s: expected transitions or days", kind))
+			return
+		}
+		filename := fmt.Sprintf("flywheel-%s-%s-%s.csv", kind, from.In(loc).Format("20060102"), to.In(loc).Format("20060102"))
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		csv.NewWriter(w).WriteAll(rows)
+	default:
+		handler.apiError(w, http.StatusBadRequest, fmt.Errorf("Unknown format %s: expected csv or json", format))
+	}
+}
+
+// transitionRows - the transitions as CSV, with a header
+func (report *UsageReport) transitionRows() [][]string {
+	rows := [][]string{{"time", "from", "to", "trigger", "user", "stop-reason"}}
+	for _, t := range report.Transitions {
+		rows = append(rows, []string{t.Time.Format(time.RFC3339), t.From, t.To, t.Trigger, t.User, t.StopReason})
+	}
+	return rows
+}
+
+// dayRows - the days as CSV, with a header. Triggers are counted as
+// trigger:count, separated by spaces, as are the users.
+func (report *UsageReport) dayRows() [][]string {
+	rows := [][]string{{"date", "uptime-hours", "starts", "stops", "requests", "triggers", "users"}}
+	for _, day := range report.Days {
+		var triggers []string
+		for trigger, count := range day.Triggers {
+			triggers = append(triggers, fmt.Sprintf("%s:%d", trigger, count))
+		}
+		sort.Strings(triggers)
+		rows = append(rows, []string{
+			day.Date,
+			strconv.FormatFloat(day.UptimeHours, 'f', 2, 64),
+			strconv.Itoa(day.Starts),
+			strconv.Itoa(day.Stops),
+			strconv.Itoa(day.Requests),
+			strings.Join(triggers, " "),
+			strings.Join(day.Users, " "),
+		})
+	}
+	return rows
+}
@@ -0,0 +1,173 @@
+package flywheel
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Build info, set at build time with e.g.
+//
+//	go build -ldflags "-X github.com/fairfaxmedia/flywheel.Version=1.2.0 -X github.com/fairfaxmedia/flywheel.Commit=$(git rev-parse HEAD) -X github.com/fairfaxmedia/flywheel.BuildDate=$(date -u +%FT%TZ)"
+var (
+	Version   = "dev"
+	Commit    = ""
+	BuildDate = ""
+)
+
+// BuildInfo - the version of this binary
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build-date,omitempty"`
+	GoVersion string `json:"go-version"`
+
+	// Filled in by the update check
+	Latest          string `json:"latest,omitempty"`
+	UpdateAvailable bool   `json:"update-available"`
+}
+
+// GetBuildInfo - the build info, falling back to what the Go toolchain
+// recorded when there are no ldflags
+func GetBuildInfo() BuildInfo {
+	info := BuildInfo{Version: Version, Commit: Commit, BuildDate: BuildDate, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	return info
+}
+
+// String - e.g. "flywheel 1.2.0 (commit abc123, built 2016-06-06T09:00:00Z)"
+func (info BuildInfo) String() string {
+	var details []string
+	if info.Commit != "" {
+		details = append(details, "commit "+info.Commit)
+	}
+	if info.BuildDate != "" {
+		details = append(details, "built "+info.BuildDate)
+	}
+	details = append(details, info.GoVersion)
+	return fmt.Sprintf("flywheel %s (%s)", info.Version, strings.Join(details, ", "))
+}
+
+// UpdateCheckConfig - look for new releases on GitHub
+type UpdateCheckConfig struct {
+	Enabled    bool     `json:"enabled"`
+	Repository string   `json:"repository"`
+	Interval   Duration `json:"interval"`
+}
+
+// UpdateChecker - polls the latest GitHub release
+type UpdateChecker struct {
+	config *UpdateCheckConfig
+	client *http.Client
+	url    string
+
+	mu     sync.Mutex
+	latest string
+}
+
+// NewUpdateChecker - create a checker, nil if disabled
+func NewUpdateChecker(config *UpdateCheckConfig) *UpdateChecker {
+	if !config.Enabled {
+		return nil
+	}
+	if config.Repository == "" {
+		config.Repository = "fairfaxmedia/flywheel"
+	}
+	if config.Interval <= 0 {
+		config.Interval = Duration(24 * time.Hour)
+	}
+	return &UpdateChecker{
+		config: config,
+		client: &http.Client{Timeout: 30 * time.Second},
+		url:    "https://api.github.com/repos/" + config.Repository + "/releases/latest",
+	}
+}
+
+// Run - check now and then every interval
+func (u *UpdateChecker) Run() {
+	for {
+		if err := u.Check(); err != nil {
+			log.Printf("Unable to check for updates: %v", err)
+		}
+		time.Sleep(time.Duration(u.config.Interval))
+	}
+}
+
+// Check - fetch the latest release, and log it if it's newer
+func (u *UpdateChecker) Check() error {
+	resp, err := u.client.Get(u.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GitHub returned %s", resp.Status)
+	}
+
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	changed := u.latest != release.TagName
+	u.latest = release.TagName
+	u.mu.Unlock()
+
+	if changed && newerVersion(release.TagName, Version) {
+		log.Printf("New version available: %s (running %s)", release.TagName, Version)
+	}
+	return nil
+}
+
+// Latest - the latest release, empty if unknown. A nil checker knows none.
+func (u *UpdateChecker) Latest() string {
+	if u == nil {
+		return ""
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.latest
+}
+
+// newerVersion - true if version a is newer than b, comparing the dotted
+// numbers of e.g. "v1.10.0" and "1.9.2". Development builds are never
+// outdated.
+func newerVersion(a, b string) bool {
+	if a == "" || b == "" || b == "dev" {
+		return false
+	}
+	pa := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	pb := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var na, nb int
+		if i < len(pa) {
+			na, _ = strconv.Atoi(pa[i])
+		}
+		if i < len(pb) {
+			nb, _ = strconv.Atoi(pb[i])
+		}
+		if na != nb {
+			return na > nb
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+package flywheel
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// vhostPattern - a wildcard or regular expression vhost. The endpoint is a
+// template that can use the captured parts, e.g. "$1.backend:8080" or
+// "${branch}.backend".
+type vhostPattern struct {
+	pattern  string
+	re       *regexp.Regexp
+	endpoint string
+}
+
+// compileVhosts - compile the vhosts that aren't plain hostnames. Patterns
+// starting with "~" are regular expressions; others may contain "*"
+// wildcards, each matching one DNS label. Wildcards are tried from the most
+// to the least specific, then the regular expressions in order.
+func compileVhosts(vhosts map[string]string) ([]vhostPattern, error) {
+	var patterns []vhostPattern
+	for pattern, endpoint := range vhosts {
+		switch {
+		case strings.HasPrefix(pattern, "~"):
+			re, err := regexp.Compile(pattern[1:])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid vhost pattern %s: %v", pattern, err)
+			}
+			patterns = append(patterns, vhostPattern{pattern, re, endpoint})
+		case strings.Contains(pattern, "*"):
+			parts := strings.Split(pattern, "*")
+			for i, part := range parts {
+				parts[i] = regexp.QuoteMeta(part)
+			}
+			re := regexp.MustCompile("^(?i)" + strings.Join(parts, "([^.]+)") + "$")
+			patterns = append(patterns, vhostPattern{pattern, re, endpoint})
+		}
+	}
+	sort.Sort(vhostPatternList(patterns))
+	return patterns, nil
+}
+
+// match - the endpoint for the hostname, with the captured parts filled in
+func (p *vhostPattern) match(hostname string) (string, bool) {
+	m := p.re.FindStringSubmatchIndex(hostname)
+	if m == nil {
+		return "", false
+	}
+	return string(p.re.ExpandString(nil, p.endpoint, hostname, m)), true
+}
+
+// vhostEndpoint - the endpoint of the first pattern matching the Host
+// header, ignoring any port
+func (c *Config) vhostEndpoint(host string) (string, bool) {
+	return matchVhosts(c.vhostPatterns, host)
+}
+
+// matchVhosts - the endpoint of the first matching pattern
+func matchVhosts(patterns []vhostPattern, host string) (string, bool) {
+	if len(patterns) == 0 {
+		return "", false
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for i := range patterns {
+		if endpoint, ok := patterns[i].match(host); ok {
+			return endpoint, true
+		}
+	}
+	return "", false
+}
+
+// vhostChange - add or remove a vhost at runtime
+type vhostChange struct {
+	host, endpoint string
+	remove         bool
+}
+
+// changeVhost - apply a runtime vhost change, from a ping. Runtime vhosts
+// are kept in the state store, and take precedence over the config.
+func (fw *Flywheel) changeVhost(change *vhostChange, user string) error {
+	// Published pongs share the map, so it's copied rather than changed
+	vhosts := make(map[string]string, len(fw.vhosts)+1)
+	for host, endpoint := range fw.vhosts {
+		vhosts[host] = endpoint
+	}
+	if change.remove {
+		if _, ok := vhosts[change.host]; !ok {
+			return fmt.Errorf("No runtime vhost %s", change.host)
+		}
+		delete(vhosts, change.host)
+		fw.logf("Vhost %s removed by %s", change.host, user)
+	} else {
+		vhosts[change.host] = change.endpoint
+		fw.logf("Vhost %s -> %s added by %s", change.host, change.endpoint, user)
+	}
+	fw.vhosts = vhosts
+	fw.compileRuntimeVhosts()
+	fw.SaveState()
+	return nil
+}
+
+// compileRuntimeVhosts - compile the patterns among the runtime vhosts.
+// They were checked when added.
+func (fw *Flywheel) compileRuntimeVhosts() {
+	patterns, err := compileVhosts(fw.vhosts)
+	if err != nil {
+		fw.logf("Invalid runtime vhost: %v", err)
+	}
+	fw.vhostPatterns = patterns
+}
+
+// VhostInfo - a vhost, and where it's configured
+type VhostInfo struct {
+	Host     string `json:"host"`
+	Endpoint string `json:"endpoint"`
+	Runtime  bool   `json:"runtime"`
+}
+
+// apiVhosts - list, add or remove vhosts. Changes need an admin token.
+func (handler *Handler) apiVhosts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		handler.writeJSON(w, http.StatusOK, handler.Flywheel.listVhosts(handler.Flywheel.Snapshot()))
+		return
+	case "POST", "DELETE":
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		handler.apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+		return
+	}
+	if !handler.authorizeAdmin(w, r) {
+		return
+	}
+
+	var req struct {
+		Host     string `json:"host"`
+		Endpoint string `json:"endpoint"`
+	}
+	if r.Method == "POST" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			handler.apiError(w, http.StatusBadRequest, err)
+			return
+		}
+	} else {
+		req.Host, req.Endpoint = r.FormValue("host"), r.FormValue("endpoint")
+	}
+
+	change := &vhostChange{host: req.Host, endpoint: req.Endpoint, remove: r.Method == "DELETE"}
+	if change.host == "" || (!change.remove && change.endpoint == "") {
+		handler.apiError(w, http.StatusBadRequest, fmt.Errorf("A host and an endpoint are required"))
+		return
+	}
+	if _, err := compileVhosts(map[string]string{change.host: change.endpoint}); err != nil {
+		handler.apiError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	pong := handler.ping(Ping{vhost: change, user: requestUser(r)})
+	if pong.Err != nil {
+		handler.apiError(w, http.StatusConflict, pong.Err)
+		return
+	}
+	handler.writeJSON(w, http.StatusOK, handler.Flywheel.listVhosts(pong))
+}
+
+// listVhosts - the runtime vhosts, then those of the config
+func (fw *Flywheel) listVhosts(pong Pong) []VhostInfo {
+	var runtime, config []VhostInfo
+	for host, endpoint := range pong.Vhosts {
+		runtime = append(runtime, VhostInfo{Host: host, Endpoint: endpoint, Runtime: true})
+	}
+	for host, endpoint := range fw.config.Vhosts {
+		config = append(config, VhostInfo{Host: host, Endpoint: endpoint})
+	}
+	sort.Sort(vhostInfoList(runtime))
+	sort.Sort(vhostInfoList(config))
+	return append(runtime, config...)
+}
+
+type vhostInfoList []VhostInfo
+
+func (l vhostInfoList) Len() int           { return len(l) }
+func (l vhostInfoList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l vhostInfoList) Less(i, j int) bool { return l[i].Host < l[j].Host }
+
+type vhostPatternList []vhostPattern
+
+func (l vhostPatternList) Len() int      { return len(l) }
+func (l vhostPatternList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l vhostPatternList) Less(i, j int) bool {
+	ri, rj := strings.HasPrefix(l[i].pattern, "~"), strings.HasPrefix(l[j].pattern, "~")
+	if ri != rj {
+		return rj
+	}
+	if !ri {
+		// More literal characters make a wildcard more specific
+		li := len(l[i].pattern) - strings.Count(l[i].pattern, "*")
+		lj := len(l[j].pattern) - strings.Count(l[j].pattern, "*")
+		if li != lj {
+			return li > lj
+		}
+	}
+	return l[i].pattern < l[j].pattern
+}
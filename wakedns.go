@@ -0,0 +1,178 @@
+package flywheel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// wakeDNSInterval - at most one lookup a second is passed on, whoever makes
+// it. Queries are unauthenticated and their source may be spoofed, so a
+// flood mustn't fill the ping queue.
+const wakeDNSInterval = time.Second
+
+// WakeDNSConfig - a tiny authoritative DNS server for clients that connect
+// over plain TCP, e.g. to a database, and never pass through the proxy.
+// Looking up one of the names starts the environment, or resets the idle
+// timer if it's running.
+type WakeDNSConfig struct {
+	Listen  string   `json:"listen"`
+	Names   []string `json:"names"`
+	Address string   `json:"address"`
+	TTL     uint32   `json:"ttl"`
+}
+
+// Validate - check the names and address, and set the default TTL
+func (c *WakeDNSConfig) Validate() error {
+	if c.Listen == "" {
+		return nil
+	}
+	if len(c.Names) == 0 {
+		return fmt.Errorf("Wake DNS needs at least one name")
+	}
+	if ip := net.ParseIP(c.Address); ip == nil || ip.To4() == nil {
+		return fmt.Errorf("Wake DNS address %q isn't an IPv4 address", c.Address)
+	}
+	if c.TTL == 0 {
+		c.TTL = 5
+	}
+	return nil
+}
+
+// DNS message constants, RFC 1035
+const (
+	dnsHeaderLen   = 12
+	dnsTypeA       = 1
+	dnsTypeANY     = 255
+	dnsClassIN     = 1
+	dnsRcodeFormat = 1
+	dnsRcodeRefuse = 5
+)
+
+// ServeWakeDNS - answer DNS queries on the connection until it's closed
+func (fw *Flywheel) ServeWakeDNS(conn net.PacketConn) {
+	config := &fw.config.WakeDNS
+	buf := make([]byte, 512)
+	var lastWake time.Time
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			fw.logf("Wake DNS stopped: %v", err)
+			return
+		}
+
+		reply, name := wakeDNSReply(buf[:n], config)
+		if reply == nil {
+			continue
+		}
+		if name != "" {
+			fw.logf("[%s] DNS lookup of %s", addr, name)
+			if now := fw.now(); now.Sub(lastWake) >= wakeDNSInterval {
+				lastWake = now
+				fw.wake(addr.String())
+			}
+		}
+		if _, err = conn.WriteTo(reply, addr); err != nil {
+			fw.logf("Wake DNS reply failed: %v", err)
+		}
+	}
+}
+
+// wake - ask the flywheel goroutine to start, or count the lookup as
+// activity if it's started. Nothing is sent while it's starting, and
+// nothing waits: the lookup is dropped if the queue is full.
+func (fw *Flywheel) wake(client string) {
+	ping := Ping{requestStart: true, user: clientIP(client), replyTo: make(chan Pong, 1)}
+	switch fw.Snapshot().Status {
+	case STARTING:
+		return
+	case STARTED:
+		ping.requestStart = false
+	}
+	select {
+	case fw.pings <- ping:
+	default:
+		fw.logf("Wake DNS lookup by %s dropped, flywheel is busy", ping.user)
+	}
+}
+
+// wakeDNSReply - build the reply to a query. The name is returned if it's
+// one of ours; nil is returned for messages that aren't worth a reply.
+func wakeDNSReply(query []byte, config *WakeDNSConfig) ([]byte, string) {
+	if len(query) < dnsHeaderLen || query[2]&0x80 != 0 {
+		// Too short, or a response
+		return nil, ""
+	}
+
+	reply := make([]byte, dnsHeaderLen, 64)
+	copy(reply, query[:2])
+	// QR and AA set, opcode and RD copied
+	reply[2] = 0x84 | query[2]&0x79
+
+	name, qtype, qclass, end, ok := parseDNSQuestion(query)
+	if !ok || binary.BigEndian.Uint16(query[4:6]) != 1 {
+		reply[3] = dnsRcodeFormat
+		return reply, ""
+	}
+
+	// Echo the question
+	binary.BigEndian.PutUint16(reply[4:6], 1)
+	reply = append(reply, query[dnsHeaderLen:end]...)
+
+	if !dnsNameMatch(config.Names, name) {
+		reply[3] = dnsRcodeRefuse
+		return reply, ""
+	}
+
+	if qclass == dnsClassIN && (qtype == dnsTypeA || qtype == dnsTypeANY) {
+		binary.BigEndian.PutUint16(reply[6:8], 1)
+		answer := make([]byte, 16)
+		binary.BigEndian.PutUint16(answer[0:2], 0xC000|dnsHeaderLen) // Pointer to the question name
+		binary.BigEndian.PutUint16(answer[2:4], dnsTypeA)
+		binary.BigEndian.PutUint16(answer[4:6], dnsClassIN)
+		binary.BigEndian.PutUint32(answer[6:10], config.TTL)
+		binary.BigEndian.PutUint16(answer[10:12], 4)
+		copy(answer[12:], net.ParseIP(config.Address).To4())
+		reply = append(reply, answer...)
+	}
+	return reply, name
+}
+
+// parseDNSQuestion - read the first question, returning the offset after it
+func parseDNSQuestion(msg []byte) (string, uint16, uint16, int, bool) {
+	var labels []string
+	pos := dnsHeaderLen
+	for {
+		if pos >= len(msg) {
+			return "", 0, 0, 0, false
+		}
+		size := int(msg[pos])
+		pos++
+		if size == 0 {
+			break
+		}
+		// Compression isn't used in questions
+		if size&0xC0 != 0 || pos+size > len(msg) {
+			return "", 0, 0, 0, false
+		}
+		labels = append(labels, string(msg[pos:pos+size]))
+		pos += size
+	}
+	if pos+4 > len(msg) {
+		return "", 0, 0, 0, false
+	}
+	qtype := binary.BigEndian.Uint16(msg[pos : pos+2])
+	qclass := binary.BigEndian.Uint16(msg[pos+2 : pos+4])
+	return strings.Join(labels, "."), qtype, qclass, pos + 4, true
+}
+
+func dnsNameMatch(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(strings.TrimSuffix(n, "."), name) {
+			return true
+		}
+	}
+	return false
+}
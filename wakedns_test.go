@@ -0,0 +1,139 @@
+package flywheel
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func dnsQuery(name string, qtype byte) []byte {
+	msg := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range bytes.Split([]byte(name), []byte(".")) {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0, 0, qtype, 0, 1)
+}
+
+func TestWakeDNSReply(t *testing.T) {
+	config := &WakeDNSConfig{Listen: ":53", Names: []string{"db.staging.example.com."}, Address: "10.0.0.5"}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query   []byte
+		rcode   byte
+		answers byte
+		wake    bool
+	}{
+		{dnsQuery("db.staging.example.com", dnsTypeA), 0, 1, true},
+		{dnsQuery("DB.Staging.Example.com", dnsTypeA), 0, 1, true},
+		{dnsQuery("db.staging.example.com", 28), 0, 0, true},
+		{dnsQuery("www.example.com", dnsTypeA), dnsRcodeRefuse, 0, false},
+		{[]byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0, 3, 'd'}, dnsRcodeFormat, 0, false},
+	}
+
+	for i, test := range tests {
+		reply, name := wakeDNSReply(test.query, config)
+		if reply == nil {
+			t.Fatalf("Test %d: Expected a reply", i)
+		}
+		if reply[0] != 0x12 || reply[1] != 0x34 || reply[2]&0x80 == 0 {
+			t.Errorf("Test %d: Expected a response with the query ID, but got %v", i, reply[:4])
+		}
+		if reply[3]&0x0f != test.rcode || reply[7] != test.answers {
+			t.Errorf("Test %d: Expected rcode %d and %d answers, but got %d and %d", i, test.rcode, test.answers, reply[3]&0x0f, reply[7])
+		}
+		if (name != "") != test.wake {
+			t.Errorf("Test %d: Expected wake %v but got %q", i, test.wake, name)
+		}
+		if test.answers == 1 && !bytes.Equal(reply[len(reply)-4:], []byte{10, 0, 0, 5}) {
+			t.Errorf("Test %d: Expected 10.0.0.5 but got %v", i, reply[len(reply)-4:])
+		}
+	}
+}
+
+func TestServeWakeDNS(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 10, 15, 9, 0, 0, 0, time.UTC))
+	fw := &Flywheel{
+		config: &Config{WakeDNS: WakeDNSConfig{Names: []string{"db.example.com"}, Address: "10.0.0.5", TTL: 5}},
+		clock:  clock,
+		pings:  make(chan Ping, 1),
+	}
+	status := func(status int) {
+		fw.snapshotMu.Lock()
+		fw.snapshot.Status = status
+		fw.snapshotMu.Unlock()
+	}
+	status(STOPPED)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go fw.ServeWakeDNS(conn)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	lookups := func(n int) {
+		buf := make([]byte, 512)
+		for i := 0; i < n; i++ {
+			client.Write(dnsQuery("db.example.com", dnsTypeA))
+			client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := client.Read(buf); err != nil {
+				t.Fatalf("Expected a reply, but got %v", err)
+			}
+		}
+	}
+	queued := func() []Ping {
+		var pings []Ping
+		for {
+			select {
+			case ping := <-fw.pings:
+				pings = append(pings, ping)
+			default:
+				return pings
+			}
+		}
+	}
+
+	// A flood of lookups is one start request a second
+	lookups(20)
+	if pings := queued(); len(pings) != 1 || !pings[0].requestStart || pings[0].user != "127.0.0.1" {
+		t.Errorf("Expected one start request, but got %+v", pings)
+	}
+	lookups(5)
+	if pings := queued(); len(pings) != 0 {
+		t.Errorf("Expected no more requests within a second, but got %+v", pings)
+	}
+
+	// Only activity while started, nothing while starting
+	clock.Advance(time.Second)
+	status(STARTED)
+	lookups(1)
+	if pings := queued(); len(pings) != 1 || pings[0].requestStart {
+		t.Errorf("Expected one activity request, but got %+v", pings)
+	}
+	clock.Advance(time.Second)
+	status(STARTING)
+	lookups(1)
+	if pings := queued(); len(pings) != 0 {
+		t.Errorf("Expected nothing sent while starting, but got %+v", pings)
+	}
+
+	// A full queue drops the lookup rather than block
+	clock.Advance(time.Second)
+	status(STOPPED)
+	fw.pings <- Ping{}
+	lookups(1)
+	clock.Advance(time.Second)
+	lookups(1)
+	if pings := queued(); len(pings) != 1 || pings[0].requestStart {
+		t.Errorf("Expected the lookups to be dropped, but got %+v", pings)
+	}
+}
@@ -0,0 +1,215 @@
+package flywheel
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WakeHookPrefix - the path of the wake hooks, followed by their name
+const WakeHookPrefix = "/flywheel/wake/"
+
+// Signature schemes of wake hooks
+const (
+	// X-Flywheel-Timestamp with the Unix time, and X-Flywheel-Signature
+	// with sha256= and the hex HMAC-SHA256 of the timestamp, a dot and the
+	// body
+	WakeSchemeFlywheel = "flywheel"
+	// Stripe-Signature, t= the Unix time and v1= the hex HMAC-SHA256 of
+	// the time, a dot and the body
+	WakeSchemeStripe = "stripe"
+	// X-Hub-Signature-256, sha256= and the hex HMAC-SHA256 of the body.
+	// GitHub doesn't sign a time, so replays are refused by the
+	// X-GitHub-Delivery ID instead.
+	WakeSchemeGitHub = "github"
+)
+
+// Largest callback body read
+const maxWakeHookBody = 1 << 20
+
+// How long GitHub delivery IDs are remembered
+const githubDeliveryTTL = 24 * time.Hour
+
+var wakeHookName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// WakeHook - an integration that may wake the environment with a signed
+// callback to /flywheel/wake/<name>, e.g. a Stripe or GitHub sandbox
+// webhook. Unlike the start link, a callback can't be replayed by whoever
+// sees it.
+type WakeHook struct {
+	Name   string `json:"name"`
+	Secret Secret `json:"secret"`
+	Scheme string `json:"scheme"`
+
+	// How far the signed time may be from now, default 5m
+	Tolerance Duration `json:"tolerance"`
+}
+
+// Validate - check the hook can verify callbacks, and fill in the defaults
+func (h *WakeHook) Validate() error {
+	if !wakeHookName.MatchString(h.Name) {
+		return fmt.Errorf("Invalid wake hook name %q, expected letters, digits, - and _", h.Name)
+	}
+	if h.Secret == "" {
+		return fmt.Errorf("Wake hook %s needs a secret", h.Name)
+	}
+	switch h.Scheme {
+	case "":
+		h.Scheme = WakeSchemeFlywheel
+	case WakeSchemeFlywheel, WakeSchemeStripe, WakeSchemeGitHub:
+	default:
+		return fmt.Errorf("Unknown wake hook scheme %q, expected flywheel, stripe or github", h.Scheme)
+	}
+	if h.Tolerance <= 0 {
+		h.Tolerance = Duration(5 * time.Minute)
+	}
+	return nil
+}
+
+// wakeHookMAC - the hex HMAC-SHA256 of the parts
+func wakeHookMAC(secret Secret, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return []byte(hex.EncodeToString(mac.Sum(nil)))
+}
+
+// verify - check the signature of a callback, returning what identifies it
+// for refusing replays, and until when it has to be remembered
+func (h *WakeHook) verify(r *http.Request, body []byte, now time.Time) (string, time.Time, error) {
+	var timestamp string
+	var signatures []string
+	switch h.Scheme {
+	case WakeSchemeFlywheel:
+		timestamp = r.Header.Get("X-Flywheel-Timestamp")
+		signatures = []string{strings.TrimPrefix(r.Header.Get("X-Flywheel-Signature"), "sha256=")}
+	case WakeSchemeStripe:
+		for _, field := range strings.Split(r.Header.Get("Stripe-Signature"), ",") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "t":
+				timestamp = kv[1]
+			case "v1":
+				signatures = append(signatures, kv[1])
+			}
+		}
+	case WakeSchemeGitHub:
+		expected := wakeHookMAC(h.Secret, body)
+		signature := strings.TrimPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")
+		if !hmac.Equal([]byte(signature), expected) {
+			return "", time.Time{}, fmt.Errorf("Invalid signature")
+		}
+		delivery := r.Header.Get("X-GitHub-Delivery")
+		if delivery == "" {
+			return "", time.Time{}, fmt.Errorf("Missing X-GitHub-Delivery")
+		}
+		return delivery, now.Add(githubDeliveryTTL), nil
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("Missing or invalid signature timestamp")
+	}
+	signed := time.Unix(unix, 0)
+	tolerance := time.Duration(h.Tolerance)
+	if signed.Before(now.Add(-tolerance)) || signed.After(now.Add(tolerance)) {
+		return "", time.Time{}, fmt.Errorf("Signature timestamp %s is outside the tolerance of %v", signed.UTC().Format(time.RFC3339), tolerance)
+	}
+	expected := wakeHookMAC(h.Secret, []byte(timestamp), []byte("."), body)
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(signature), expected) {
+			return signature, signed.Add(tolerance), nil
+		}
+	}
+	return "", time.Time{}, fmt.Errorf("Invalid signature")
+}
+
+// wakeHookReplays - the callbacks accepted recently, by hook and signature
+// or delivery, until they'd be refused anyway
+type wakeHookReplays struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// first - true if the callback wasn't seen before, remembering it until
+// the time given
+func (s *wakeHookReplays) first(key string, until, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seen == nil {
+		s.seen = make(map[string]time.Time)
+	}
+	for k, expires := range s.seen {
+		if now.After(expires) {
+			delete(s.seen, k)
+		}
+	}
+	if _, ok := s.seen[key]; ok {
+		return false
+	}
+	s.seen[key] = until
+	return true
+}
+
+// serveWakeHook - verify a callback and start the environment. Callbacks
+// get 202 while starting, 200 once started, and no page.
+func (handler *Handler) serveWakeHook(w http.ResponseWriter, r *http.Request) {
+	fw := handler.Flywheel
+	name := strings.TrimPrefix(r.URL.Path, WakeHookPrefix)
+	var hook *WakeHook
+	for i := range fw.config.WakeHooks {
+		if fw.config.WakeHooks[i].Name == name {
+			hook = &fw.config.WakeHooks[i]
+		}
+	}
+	if hook == nil {
+		handler.apiError(w, http.StatusNotFound, fmt.Errorf("Unknown wake hook %s", name))
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		handler.apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWakeHookBody))
+	if err != nil {
+		handler.apiError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	now := fw.now()
+	key, until, err := hook.verify(r, body, now)
+	if err != nil {
+		fw.logf("Wake hook %s refused: %v", name, err)
+		handler.apiError(w, http.StatusUnauthorized, err)
+		return
+	}
+	if !handler.wakeReplays.first(name+":"+key, until, now) {
+		fw.logf("Wake hook %s refused: replayed", name)
+		handler.apiError(w, http.StatusConflict, fmt.Errorf("Callback already accepted"))
+		return
+	}
+
+	pong := handler.ping(Ping{requestStart: true, user: "wake-hook:" + name})
+	if pong.Err != nil {
+		handler.apiError(w, http.StatusServiceUnavailable, pong.Err)
+		return
+	}
+	code := http.StatusAccepted
+	if pong.Status == STARTED {
+		code = http.StatusOK
+	}
+	handler.writeJSON(w, code, pong)
+}
@@ -0,0 +1,116 @@
+package flywheel
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+type putWarmPoolInput struct {
+	_ struct{} `type:"structure"`
+
+	AutoScalingGroupName *string              `type:"string"`
+	MinSize              *int64               `type:"integer"`
+	PoolState            *string              `type:"string"`
+	InstanceReusePolicy  *instanceReusePolicy `type:"structure"`
+}
+
+type instanceReusePolicy struct {
+	_ struct{} `type:"structure"`
+
+	ReuseOnScaleIn *bool `type:"boolean"`
+}
+
+// Move the instances of warm pool groups into their warm pool. The pool is
+// configured to keep stopped instances and take instances back on scale in,
+// so scaling to zero stops the instances instead of terminating them.
+func (fw *Flywheel) stopWarmPoolAutoScaling() error {
+	var zero int64
+	for groupName, size := range fw.config.AutoScaling.WarmPool {
+		if fw.config.Observed(groupName) || fw.deferred(ResourceAutoScalingGroup, groupName) {
+			continue
+		}
+		fw.logf("Moving autoscaling group %s into its warm pool", groupName)
+
+		err := awsCall(fw.autoscaling.Client, "PutWarmPool", &putWarmPoolInput{
+			AutoScalingGroupName: aws.String(groupName),
+			MinSize:              aws.Int64(size),
+			PoolState:            aws.String("Stopped"),
+			InstanceReusePolicy: &instanceReusePolicy{
+				ReuseOnScaleIn: aws.Bool(true),
+			},
+		}, nil)
+		if err != nil {
+			return err
+		}
+
+		// The max size is kept, it limits the size of the warm pool
+		_, err = fw.autoscaling.UpdateAutoScalingGroup(
+			&autoscaling.UpdateAutoScalingGroupInput{
+				AutoScalingGroupName: aws.String(groupName),
+				MinSize:              &zero,
+				DesiredCapacity:      &zero,
+				MaxSize:              aws.Int64(size),
+			},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scale warm pool groups back up, taking the instances from the warm pool
+func (fw *Flywheel) startWarmPoolAutoScaling() error {
+	for groupName, size := range fw.config.AutoScaling.WarmPool {
+		if fw.config.Observed(groupName) || fw.deferred(ResourceAutoScalingGroup, groupName) {
+			continue
+		}
+		fw.logf("Restoring autoscaling group %s from its warm pool", groupName)
+		_, err := fw.autoscaling.UpdateAutoScalingGroup(
+			&autoscaling.UpdateAutoScalingGroupInput{
+				AutoScalingGroupName: aws.String(groupName),
+				MinSize:              aws.Int64(size),
+				DesiredCapacity:      aws.Int64(size),
+				MaxSize:              aws.Int64(size),
+			},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkWarmPoolAutoScalingGroups - map the lifecycle states of the in
+// service instances to instance states. An empty group is stopped.
+func (fw *Flywheel) checkWarmPoolAutoScalingGroups(d *described, health *healthStates) {
+	for groupName := range fw.config.AutoScaling.WarmPool {
+		group, ok := d.groups[groupName]
+		if !ok {
+			continue
+		}
+		if len(group.Instances) == 0 {
+			if aws.Int64Value(group.DesiredCapacity) == 0 {
+				health.add(groupName, "stopped", 1)
+			} else {
+				health.add(groupName, "pending", 1)
+			}
+			continue
+		}
+
+		share := 1 / float64(len(group.Instances))
+		for _, instance := range group.Instances {
+			state := aws.StringValue(instance.LifecycleState)
+			switch {
+			case state == "InService":
+				health.add(groupName, "running", share)
+			case strings.HasPrefix(state, "Pending"):
+				health.add(groupName, "pending", share)
+			default:
+				health.add(groupName, "stopping", share)
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package flywheel
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// WarmStandbyConfig - a small part of the environment that keeps running
+// while it's stopped, serving a lightweight version of the site. Requests
+// to it start the rest of the environment.
+type WarmStandbyConfig struct {
+	// Instances left running
+	Instances []string `json:"instances"`
+	// Size of terminate groups while stopped, instead of 0
+	AutoScaling map[string]int64 `json:"autoscaling"`
+	// Endpoint serving requests while stopped or starting
+	Endpoint string `json:"endpoint"`
+}
+
+// Enabled - true if requests are served while stopped
+func (c *WarmStandbyConfig) Enabled() bool {
+	return c.Endpoint != ""
+}
+
+// Validate - check the standby resources are part of the environment
+func (c *WarmStandbyConfig) Validate(config *Config) error {
+	if !c.Enabled() && (len(c.Instances) > 0 || len(c.AutoScaling) > 0) {
+		return fmt.Errorf("Warm standby needs an endpoint")
+	}
+	for _, id := range c.Instances {
+		if !contains(config.Instances, id) {
+			return fmt.Errorf("Warm standby instance %s isn't in instances", id)
+		}
+	}
+	terminate := config.AutoScaling.TerminateGroups()
+	for groupName, size := range c.AutoScaling {
+		full, ok := terminate[groupName]
+		if !ok {
+			return fmt.Errorf("Warm standby autoscaling group %s isn't terminated when stopping", groupName)
+		}
+		if size < 0 || size >= full {
+			return fmt.Errorf("Warm standby size of autoscaling group %s must be less than %d", groupName, full)
+		}
+	}
+	return nil
+}
+
+// serveWarm - start the environment if it's stopped, and meanwhile serve the
+// request from the warm standby
+func (handler *Handler) serveWarm(w http.ResponseWriter, r *http.Request, pong Pong) {
+	if pong.Status == STOPPED {
+		handler.sendPing("start", requestUser(r))
+	}
+	w.Header().Set("X-Flywheel-Standby", "true")
+	if err := handler.forward(w, r, handler.Flywheel.config.WarmStandby.Endpoint, time.Time{}, 0); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
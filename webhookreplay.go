@@ -0,0 +1,445 @@
+package flywheel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// How often stored webhooks are checked for replay
+const webhookReplayInterval = 5 * time.Second
+
+// WebhookReplayConfig - store the webhooks that arrive while the environment
+// isn't STARTED, and replay them to the backend in order once it is, so
+// third-party callbacks aren't lost while it sleeps
+type WebhookReplayConfig struct {
+	// Paths of the webhooks, e.g. /hooks/stripe. Requests below them are
+	// stored as well.
+	Paths []string `json:"paths"`
+
+	// Methods stored, default POST. Other requests get the usual pages.
+	Methods []string `json:"methods"`
+
+	// Where they are stored: a directory, or an SQS FIFO queue. Only one
+	// may be set.
+	Dir         string `json:"dir"`
+	SQSQueueURL string `json:"sqs-queue-url"`
+
+	// Larger bodies are refused, default 1MiB
+	MaxBody int `json:"max-body"`
+
+	// Webhooks stored for longer are dropped instead of replayed, default
+	// 24h
+	MaxAge Duration `json:"max-age"`
+}
+
+// Enabled - true if webhooks are stored
+func (c *WebhookReplayConfig) Enabled() bool {
+	return len(c.Paths) > 0
+}
+
+// Validate - check the paths and the store, and fill in the defaults
+func (c *WebhookReplayConfig) Validate() error {
+	if !c.Enabled() {
+		if c.Dir != "" || c.SQSQueueURL != "" {
+			return fmt.Errorf("Webhook replay needs paths")
+		}
+		return nil
+	}
+	for _, path := range c.Paths {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("Webhook replay path %q must start with /", path)
+		}
+	}
+	if (c.Dir == "") == (c.SQSQueueURL == "") {
+		return fmt.Errorf("Webhook replay needs a dir or an sqs-queue-url, not both")
+	}
+	if c.SQSQueueURL != "" && !strings.HasSuffix(c.SQSQueueURL, ".fifo") {
+		return fmt.Errorf("Webhook replay queue %s must be a FIFO queue, to keep the order", c.SQSQueueURL)
+	}
+	if len(c.Methods) == 0 {
+		c.Methods = []string{"POST"}
+	}
+	for i, method := range c.Methods {
+		c.Methods[i] = strings.ToUpper(method)
+	}
+	if c.MaxBody <= 0 {
+		c.MaxBody = 1 << 20
+	}
+	if c.MaxAge <= 0 {
+		c.MaxAge = Duration(24 * time.Hour)
+	}
+	return nil
+}
+
+// matches - true if the request is a webhook to store
+func (c *WebhookReplayConfig) matches(r *http.Request) bool {
+	if !contains(c.Methods, r.Method) {
+		return false
+	}
+	for _, path := range c.Paths {
+		if r.URL.Path == path || strings.HasPrefix(r.URL.Path, strings.TrimSuffix(path, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// StoredWebhook - a webhook waiting to be replayed
+type StoredWebhook struct {
+	ID     string      `json:"id"`
+	Time   time.Time   `json:"time"`
+	Method string      `json:"method"`
+	Host   string      `json:"host"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body,omitempty"`
+
+	// What the store needs to remove it, e.g. the SQS receipt handle
+	receipt string
+}
+
+// webhookStore - keeps the webhooks in the order they arrived
+type webhookStore interface {
+	put(hook *StoredWebhook) error
+	// The oldest webhooks, up to a batch
+	next() ([]*StoredWebhook, error)
+	remove(hook *StoredWebhook) error
+}
+
+// WebhookReplay - stores webhooks, and replays them once started. A nil
+// WebhookReplay stores nothing.
+type WebhookReplay struct {
+	config *WebhookReplayConfig
+	store  webhookStore
+	client *http.Client
+
+	mu sync.Mutex
+	// Webhooks may be waiting. New webhooks are stored behind them even
+	// once started, so they stay in order.
+	pending bool
+	// Counts the webhooks stored, to tell if one arrived during a replay
+	stored int
+	seq    int
+}
+
+// NewWebhookReplay - the webhook store, nil if not configured
+func NewWebhookReplay(config *WebhookReplayConfig, sess *session.Session) *WebhookReplay {
+	if !config.Enabled() {
+		return nil
+	}
+	wr := &WebhookReplay{
+		config:  config,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		pending: true,
+	}
+	if config.Dir != "" {
+		wr.store = dirWebhookStore(config.Dir)
+	} else {
+		wr.store = &sqsWebhookStore{
+			queueURL: config.SQSQueueURL,
+			client:   newQueryClient(sess, "sqs", "2012-11-05"),
+		}
+	}
+	return wr
+}
+
+// stores - true if the request is a webhook that can't be delivered now, or
+// would overtake the ones waiting
+func (wr *WebhookReplay) stores(r *http.Request, pong Pong) bool {
+	if wr == nil || !wr.config.matches(r) {
+		return false
+	}
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	return wr.pending || pong.Status != STARTED
+}
+
+// serveWebhook - store the webhook, answering 202 with its id. 503 if it
+// couldn't be stored, so the sender retries.
+func (handler *Handler) serveWebhook(w http.ResponseWriter, r *http.Request) {
+	fw := handler.Flywheel
+	wr := fw.webhooks
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, int64(wr.config.MaxBody)))
+	if err != nil {
+		handler.apiError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+
+	now := fw.now()
+	wr.mu.Lock()
+	wr.seq++
+	hook := &StoredWebhook{
+		ID:     fmt.Sprintf("%020d-%06d", now.UnixNano(), wr.seq%1000000),
+		Time:   now,
+		Method: r.Method,
+		Host:   r.Host,
+		URL:    r.URL.RequestURI(),
+		Header: r.Header,
+		Body:   body,
+	}
+	err = wr.store.put(hook)
+	if err == nil {
+		wr.pending = true
+		wr.stored++
+	}
+	wr.mu.Unlock()
+	if err != nil {
+		fw.logf("Unable to store webhook %s %s: %v", r.Method, r.URL.Path, err)
+		handler.apiError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	fw.logf("Stored webhook %s %s as %s", r.Method, r.URL.Path, hook.ID)
+	handler.writeJSON(w, http.StatusAccepted, struct {
+		ID string `json:"id"`
+	}{hook.ID})
+}
+
+// replayWebhooks - replay the stored webhooks whenever started, until ctx
+// is done
+func (fw *Flywheel) replayWebhooks(ctx context.Context) {
+	ticker := time.NewTicker(webhookReplayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := fw.replayStored(); err != nil {
+				fw.logf("Unable to replay webhooks, retrying: %v", err)
+			}
+		}
+	}
+}
+
+// replayStored - replay the stored webhooks in order once started,
+// removing each once the backend took it. Stops at the first the backend
+// failed, so the rest wait behind it. Webhooks refused with a 4xx aren't
+// retried.
+func (fw *Flywheel) replayStored() error {
+	if fw.Snapshot().Status != STARTED {
+		return nil
+	}
+	wr := fw.webhooks
+	wr.mu.Lock()
+	if !wr.pending {
+		wr.mu.Unlock()
+		return nil
+	}
+	stored := wr.stored
+	wr.mu.Unlock()
+
+	for {
+		hooks, err := wr.store.next()
+		if err != nil {
+			return err
+		}
+		if len(hooks) == 0 {
+			break
+		}
+		for _, hook := range hooks {
+			if age := fw.now().Sub(hook.Time); age > time.Duration(wr.config.MaxAge) {
+				fw.logf("Dropping webhook %s, stored %v ago", hook.ID, age.Round(time.Second))
+			} else if err := fw.replay(hook); err != nil {
+				return fmt.Errorf("Webhook %s: %v", hook.ID, err)
+			}
+			if err := wr.store.remove(hook); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Webhooks stored since are replayed next time
+	wr.mu.Lock()
+	if wr.stored == stored {
+		wr.pending = false
+	}
+	wr.mu.Unlock()
+	return nil
+}
+
+// replay - send a stored webhook to the backend, with the time it arrived
+// in X-Flywheel-Replayed-At
+func (fw *Flywheel) replay(hook *StoredWebhook) error {
+	req, err := http.NewRequest(hook.Method, "http://"+fw.ProxyEndpoint(hook.Host)+hook.URL, bytes.NewReader(hook.Body))
+	if err != nil {
+		return err
+	}
+	for key, values := range hook.Header {
+		req.Header[key] = values
+	}
+	req.Host = hook.Host
+	req.Header.Set("X-Flywheel-Replayed-At", hook.Time.UTC().Format(time.RFC3339))
+	resp, err := fw.webhooks.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("Backend answered %s", resp.Status)
+	}
+	if resp.StatusCode >= 400 {
+		fw.logf("Replayed webhook %s, the backend refused it with %s", hook.ID, resp.Status)
+	} else {
+		fw.logf("Replayed webhook %s", hook.ID)
+	}
+	return nil
+}
+
+// dirWebhookStore - a file per webhook, named so they sort in order
+type dirWebhookStore string
+
+func (d dirWebhookStore) put(hook *StoredWebhook) error {
+	buf, err := json.Marshal(hook)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(string(d), 0700); err != nil {
+		return err
+	}
+	// Written aside first, so a partial file is never replayed
+	tmp := filepath.Join(string(d), "."+hook.ID+".json")
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(string(d), hook.ID+".json"))
+}
+
+func (d dirWebhookStore) next() ([]*StoredWebhook, error) {
+	files, err := ioutil.ReadDir(string(d))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range files {
+		if name := f.Name(); !strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".json") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) > 10 {
+		names = names[:10]
+	}
+	var hooks []*StoredWebhook
+	for _, name := range names {
+		buf, err := ioutil.ReadFile(filepath.Join(string(d), name))
+		if err != nil {
+			return nil, err
+		}
+		hook := &StoredWebhook{}
+		if err := json.Unmarshal(buf, hook); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		hook.receipt = name
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+func (d dirWebhookStore) remove(hook *StoredWebhook) error {
+	return os.Remove(filepath.Join(string(d), hook.receipt))
+}
+
+// sqsWebhookStore - a message per webhook in a FIFO queue, all in one
+// message group so they're received in order
+type sqsWebhookStore struct {
+	queueURL string
+	client   *client.Client
+}
+
+// How long received webhooks are hidden from other receivers while they
+// are replayed
+const sqsReplayVisibility = 60
+
+type sendMessageInput struct {
+	_ struct{} `type:"structure"`
+
+	QueueUrl               *string `type:"string"`
+	MessageBody            *string `type:"string"`
+	MessageGroupId         *string `type:"string"`
+	MessageDeduplicationId *string `type:"string"`
+}
+
+type receiveMessageInput struct {
+	_ struct{} `type:"structure"`
+
+	QueueUrl            *string `type:"string"`
+	MaxNumberOfMessages *int64  `type:"integer"`
+	VisibilityTimeout   *int64  `type:"integer"`
+}
+
+type receiveMessageOutput struct {
+	_ struct{} `type:"structure"`
+
+	Messages []*struct {
+		_ struct{} `type:"structure"`
+
+		Body          *string `type:"string"`
+		ReceiptHandle *string `type:"string"`
+	} `locationName:"Message" type:"list" flattened:"true"`
+}
+
+type deleteMessageInput struct {
+	_ struct{} `type:"structure"`
+
+	QueueUrl      *string `type:"string"`
+	ReceiptHandle *string `type:"string"`
+}
+
+func (s *sqsWebhookStore) put(hook *StoredWebhook) error {
+	buf, err := json.Marshal(hook)
+	if err != nil {
+		return err
+	}
+	return awsCall(s.client, "SendMessage", &sendMessageInput{
+		QueueUrl:               aws.String(s.queueURL),
+		MessageBody:            aws.String(string(buf)),
+		MessageGroupId:         aws.String("flywheel"),
+		MessageDeduplicationId: aws.String(hook.ID),
+	}, nil)
+}
+
+func (s *sqsWebhookStore) next() ([]*StoredWebhook, error) {
+	var resp receiveMessageOutput
+	err := awsCall(s.client, "ReceiveMessage", &receiveMessageInput{
+		QueueUrl:            aws.String(s.queueURL),
+		MaxNumberOfMessages: aws.Int64(10),
+		VisibilityTimeout:   aws.Int64(sqsReplayVisibility),
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	var hooks []*StoredWebhook
+	for _, message := range resp.Messages {
+		hook := &StoredWebhook{}
+		if err := json.Unmarshal([]byte(aws.StringValue(message.Body)), hook); err != nil {
+			return nil, err
+		}
+		hook.receipt = aws.StringValue(message.ReceiptHandle)
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+func (s *sqsWebhookStore) remove(hook *StoredWebhook) error {
+	return awsCall(s.client, "DeleteMessage", &deleteMessageInput{
+		QueueUrl:      aws.String(s.queueURL),
+		ReceiptHandle: aws.String(hook.receipt),
+	}, nil)
+}